@@ -14,6 +14,23 @@ type client struct {
 	Client httprequest.Client
 }
 
+// Audit returns entries from the audit log matching the request.
+func (c *client) Audit(ctx context.Context, p *params.AuditRequest) ([]params.AuditEntry, error) {
+	var r []params.AuditEntry
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// Changes returns the changes that have been made to users after the
+// sequence number in the request. If there are no such changes then it
+// waits for one to be made, returning an empty set of changes if none
+// are made before the wait time expires.
+func (c *client) Changes(ctx context.Context, p *params.ChangesRequest) (*params.ChangesResponse, error) {
+	var r *params.ChangesResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // CreateAgent creates a new agent and returns the newly chosen username
 // for the agent.
 func (c *client) CreateAgent(ctx context.Context, p *params.CreateAgentRequest) (*params.CreateAgentResponse, error) {
@@ -37,6 +54,14 @@ func (c *client) DischargeTokenForUser(ctx context.Context, p *params.DischargeT
 	return r, err
 }
 
+// GetProviderIDs returns the provider ids that identify the given
+// user, starting with the one the user was created with.
+func (c *client) GetProviderIDs(ctx context.Context, p *params.ProviderIDsRequest) (params.ProviderIDsResponse, error) {
+	var r params.ProviderIDsResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // GetSSHKeys returns any SSH keys stored for the given user.
 func (c *client) GetSSHKeys(ctx context.Context, p *params.SSHKeysRequest) (params.SSHKeysResponse, error) {
 	var r params.SSHKeysResponse
@@ -58,6 +83,40 @@ func (c *client) GetUserWithID(ctx context.Context, p *params.GetUserWithIDReque
 	return r, err
 }
 
+// Group returns the information about the requested group.
+func (c *client) Group(ctx context.Context, p *params.GroupRequest) (*params.Group, error) {
+	var r *params.Group
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// GroupMembers returns the members of the requested group. As the groups
+// provided by identity providers can only be determined for each
+// identity, the identities are examined a page at a time. Identities
+// whose groups cannot be determined are returned as unresolved.
+func (c *client) GroupMembers(ctx context.Context, p *params.GroupMembersRequest) (*params.GroupMembersResponse, error) {
+	var r *params.GroupMembersResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// Groups returns all the groups that are stored, are subgroups of a
+// stored group, or are held in the stored groups of any identity.
+func (c *client) Groups(ctx context.Context, p *params.GroupsRequest) ([]params.Group, error) {
+	var r []params.Group
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// LinkProviderID links a provider id to the given user. If the
+// provider id already identifies a different user then that user is
+// merged into the given user and removed.
+func (c *client) LinkProviderID(ctx context.Context, p *params.LinkProviderIDRequest) (params.LinkProviderIDResponse, error) {
+	var r params.LinkProviderIDResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // ModifyUserGroups updates the groups stored for the given user. Groups
 // can be either added or removed in a single query. It is an error to
 // try and both add and remove groups at the same time.
@@ -80,6 +139,52 @@ func (c *client) QueryUsers(ctx context.Context, p *params.QueryUsersRequest) ([
 	return r, err
 }
 
+// QueryUsersPage filters the user database for users that match the
+// given request, returning a page of results at a time.
+func (c *client) QueryUsersPage(ctx context.Context, p *params.QueryUsersPageRequest) (*params.QueryUsersResponse, error) {
+	var r *params.QueryUsersResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// RemoveGroup removes the stored information about the requested group.
+func (c *client) RemoveGroup(ctx context.Context, p *params.RemoveGroupRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// RemoveUser removes the given user. If RemoveAgents is set in the
+// request then any agents owned by the user will also be removed.
+func (c *client) RemoveUser(ctx context.Context, p *params.RemoveUserRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// RevokeRootKey removes a macaroon root key, invalidating all macaroons
+// created with it.
+func (c *client) RevokeRootKey(ctx context.Context, p *params.RevokeRootKeyRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// RootKeys returns information about the unexpired macaroon root keys
+// held by the server, oldest first.
+func (c *client) RootKeys(ctx context.Context, p *params.RootKeysRequest) ([]params.RootKey, error) {
+	var r []params.RootKey
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// RotateRootKey generates a new macaroon root key that will be used for
+// all subsequently created macaroons.
+func (c *client) RotateRootKey(ctx context.Context, p *params.RotateRootKeyRequest) (*params.RootKey, error) {
+	var r *params.RootKey
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// SetGroup stores the information about the requested group.
+func (c *client) SetGroup(ctx context.Context, p *params.SetGroupRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 // SetUserDeprecated creates or updates the user with the given username. If the
 // user already exists then any IDPGroups or SSHKeys specified in the
 // request will be ignored. See SetUserGroups, ModifyUserGroups,
@@ -90,6 +195,13 @@ func (c *client) SetUserDeprecated(ctx context.Context, p *params.SetUserRequest
 	return c.Client.Call(ctx, p, nil)
 }
 
+// SetUserDisabled disables or enables the given user. If Agents is set
+// in the request then any agents owned by the user, including agents
+// owned by those agents, are also disabled or enabled.
+func (c *client) SetUserDisabled(ctx context.Context, p *params.SetUserDisabledRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 // SetUserExtraInfo updates extra-info for the given user. For each
 // specified extra-info field the stored values will be updated to be the
 // specified value. All other values will remain unchanged.
@@ -109,6 +221,28 @@ func (c *client) SetUserGroups(ctx context.Context, p *params.SetUserGroupsReque
 	return c.Client.Call(ctx, p, nil)
 }
 
+// Sync synchronises identities with external directories immediately.
+func (c *client) Sync(ctx context.Context, p *params.SyncRequest) ([]params.SyncResult, error) {
+	var r []params.SyncResult
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// SyncStatus returns the result of the most recent sync of each
+// identity provider that synchronises identities with an external
+// directory.
+func (c *client) SyncStatus(ctx context.Context, p *params.SyncStatusRequest) ([]params.SyncResult, error) {
+	var r []params.SyncResult
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// UnlinkProviderID removes a linked provider id from the given user.
+// The provider id that the user was created with cannot be removed.
+func (c *client) UnlinkProviderID(ctx context.Context, p *params.UnlinkProviderIDRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 // User returns the user information for the request user.
 func (c *client) User(ctx context.Context, p *params.UserRequest) (*params.User, error) {
 	var r *params.User
@@ -131,6 +265,14 @@ func (c *client) UserExtraInfoItem(ctx context.Context, p *params.UserExtraInfoI
 	return r, err
 }
 
+// UserGroupPath returns the path through which the requested user is a
+// member of the requested group.
+func (c *client) UserGroupPath(ctx context.Context, p *params.UserGroupPathRequest) (*params.GroupPath, error) {
+	var r *params.GroupPath
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // UserGroups returns the list of groups associated with the requested
 // user.
 func (c *client) UserGroups(ctx context.Context, p *params.UserGroupsRequest) ([]string, error) {
@@ -78,3 +78,32 @@ func (c *GroupCache) CacheEvict(username string) {
 func (c *GroupCache) CacheEvictAll() {
 	c.cache.EvictAll()
 }
+
+// WatchChanges watches the identity server for changes made to users,
+// evicting the cached groups of each changed user, until the given
+// context is done or an error occurs. It starts with the changes made
+// after the given sequence number (zero starts with the earliest
+// recorded change) and returns the sequence number of the last change
+// processed, which can be used to resume watching. If the server has
+// removed changes that have not been processed then the whole cache is
+// evicted.
+func (gc *GroupCache) WatchChanges(ctx context.Context, since uint64) (uint64, error) {
+	for {
+		resp, err := gc.client.Changes(ctx, &params.ChangesRequest{
+			Since: since,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return since, errgo.Mask(ctx.Err(), errgo.Any)
+			}
+			return since, errgo.Notef(err, "cannot watch changes")
+		}
+		if resp.Reset {
+			gc.cache.EvictAll()
+		}
+		for _, c := range resp.Changes {
+			gc.cache.Evict(string(c.Username))
+		}
+		since = resp.Next
+	}
+}
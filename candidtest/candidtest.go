@@ -65,12 +65,15 @@ func initServer(t Testing, p candid.ServerParams, versions ...string) candid.Han
 	if p.ProviderDataStore == nil {
 		p.ProviderDataStore = memstore.NewProviderDataStore()
 	}
-	if p.RootKeyStore == nil {
+	if p.RootKeyStore == nil && p.RootKeys == nil {
 		p.RootKeyStore = bakery.NewMemRootKeyStore()
 	}
 	if p.Store == nil {
 		p.Store = memstore.NewStore()
 	}
+	if p.GroupStore == nil {
+		p.GroupStore = memstore.NewGroupStore()
+	}
 	if p.Key == nil {
 		var err error
 		p.Key, err = bakery.GenerateKey()
@@ -131,6 +134,13 @@ func AddIdentity(ctx context.Context, st store.Store, identity *store.Identity)
 	if identity.Owner != "" {
 		update[store.Owner] = store.Set
 	}
+	if !identity.Disabled.IsZero() {
+		update[store.Disabled] = store.Set
+		update[store.DisabledReason] = store.Set
+	}
+	if !identity.Expires.IsZero() {
+		update[store.Expires] = store.Set
+	}
 	if err := st.UpdateIdentity(ctx, identity, update); err != nil {
 		panic(err)
 	}
@@ -107,7 +107,7 @@ func errToResp(ctx context.Context, err error) (int, interface{}) {
 	switch errorBody.Code {
 	case params.ErrNotFound:
 		status = http.StatusNotFound
-	case params.ErrForbidden, params.ErrAlreadyExists:
+	case params.ErrForbidden, params.ErrAlreadyExists, params.ErrUserDisabled:
 		status = http.StatusForbidden
 	case params.ErrBadRequest:
 		status = http.StatusBadRequest
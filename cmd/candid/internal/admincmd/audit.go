@@ -0,0 +1,148 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+type auditCommand struct {
+	*candidCommand
+
+	out cmd.Output
+
+	actor     string
+	target    string
+	operation string
+	since     time.Duration
+	limit     int
+}
+
+func newAuditCommand(c *candidCommand) cmd.Command {
+	return &auditCommand{
+		candidCommand: c,
+	}
+}
+
+var auditDoc = `
+The audit command shows entries from the audit log of changes made to
+users, groups and ACLs, most recent first.
+
+    candid audit
+    candid audit --actor admin@candid --since 24h
+    candid audit --target bob --operation set-groups
+`
+
+func (c *auditCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "audit",
+		Purpose: "show the audit log",
+		Doc:     auditDoc,
+	}
+}
+
+func (c *auditCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+
+	c.out.AddFlags(f, "tab", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+		"tab":  formatAuditTab,
+	})
+
+	f.StringVar(&c.actor, "actor", "", "only show changes made by this user")
+	f.StringVar(&c.target, "target", "", "only show changes made to this user or ACL")
+	f.StringVar(&c.operation, "operation", "", "only show changes made by this operation")
+	f.DurationVar(&c.since, "since", 0, "only show changes made within this duration")
+	f.IntVar(&c.limit, "limit", 0, "maximum number of entries to show")
+}
+
+func (c *auditCommand) Init(args []string) error {
+	return errgo.Mask(c.candidCommand.Init(args))
+}
+
+func (c *auditCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req := params.AuditRequest{
+		Actor:     params.Username(c.actor),
+		Target:    c.target,
+		Operation: c.operation,
+		Limit:     c.limit,
+	}
+	if c.since > 0 {
+		req.Since = time.Now().Add(-c.since)
+	}
+	entries, err := client.Audit(context.Background(), &req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	out := make([]auditEntry, len(entries))
+	for i, e := range entries {
+		out[i] = auditEntry{
+			ID:        e.ID,
+			Time:      e.Time.Format(time.RFC3339),
+			Actor:     string(e.Actor),
+			Operation: e.Operation,
+			Target:    e.Target,
+			Before:    e.Before,
+			After:     e.After,
+			RequestID: e.RequestID,
+		}
+	}
+	return c.out.Write(ctxt, out)
+}
+
+// auditEntry represents an entry in the audit log.
+type auditEntry struct {
+	ID        string   `json:"id" yaml:"id"`
+	Time      string   `json:"time" yaml:"time"`
+	Actor     string   `json:"actor" yaml:"actor"`
+	Operation string   `json:"operation" yaml:"operation"`
+	Target    string   `json:"target" yaml:"target"`
+	Before    []string `json:"before,omitempty" yaml:"before,omitempty"`
+	After     []string `json:"after,omitempty" yaml:"after,omitempty"`
+	RequestID string   `json:"request-id,omitempty" yaml:"request-id,omitempty"`
+}
+
+func formatAuditTab(writer io.Writer, value interface{}) error {
+	entries, ok := value.([]auditEntry)
+	if !ok {
+		return errgo.Newf("unexpected value %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTOR\tOPERATION\tTARGET\tBEFORE\tAFTER")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time,
+			e.Actor,
+			e.Operation,
+			e.Target,
+			auditValues(e.Before),
+			auditValues(e.After),
+		)
+	}
+	return errgo.Mask(tw.Flush())
+}
+
+func auditValues(vs []string) string {
+	if len(vs) == 0 {
+		return "-"
+	}
+	return strings.Join(vs, ",")
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/store"
+)
+
+type auditSuite struct {
+	fixture *fixture
+}
+
+func TestAudit(t *testing.T) {
+	qtsuite.Run(qt.New(t), &auditSuite{})
+}
+
+func (s *auditSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+}
+
+func (s *auditSuite) addEntries(c *qt.C) {
+	ctx := context.Background()
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []store.AuditEntry{{
+		Time:      t0,
+		Actor:     "admin@candid",
+		Operation: "set-groups",
+		Target:    "bob",
+		After:     []string{"g1", "g2"},
+	}, {
+		Time:      t0.Add(time.Hour),
+		Actor:     "alice",
+		Operation: "modify-acl",
+		Target:    "read-user",
+		Before:    []string{"admin@candid"},
+		After:     []string{"admin@candid", "bob"},
+	}}
+	for _, e := range entries {
+		err := s.fixture.auditStore.AddAuditEntry(ctx, &e)
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func (s *auditSuite) TestAudit(c *qt.C) {
+	s.addEntries(c)
+	stdout := s.fixture.CheckSuccess(c, "audit", "-a", "admin.agent")
+	c.Assert(stdout, qt.Equals, `
+TIME                 ACTOR        OPERATION  TARGET    BEFORE       AFTER
+2021-01-01T01:00:00Z alice        modify-acl read-user admin@candid admin@candid,bob
+2021-01-01T00:00:00Z admin@candid set-groups bob       -            g1,g2
+
+`[1:])
+}
+
+func (s *auditSuite) TestAuditJSON(c *qt.C) {
+	s.addEntries(c)
+	stdout := s.fixture.CheckSuccess(c, "audit", "-a", "admin.agent", "--actor", "alice", "--format", "json")
+	var entries []map[string]interface{}
+	err := json.Unmarshal([]byte(stdout), &entries)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	delete(entries[0], "id")
+	c.Assert(entries[0], qt.DeepEquals, map[string]interface{}{
+		"time":      "2021-01-01T01:00:00Z",
+		"actor":     "alice",
+		"operation": "modify-acl",
+		"target":    "read-user",
+		"before":    []interface{}{"admin@candid"},
+		"after":     []interface{}{"admin@candid", "bob"},
+	})
+}
+
+func (s *auditSuite) TestAuditSince(c *qt.C) {
+	s.addEntries(c)
+	err := s.fixture.auditStore.AddAuditEntry(context.Background(), &store.AuditEntry{
+		Actor:     "admin@candid",
+		Operation: "modify-groups",
+		Target:    "bob",
+		Before:    []string{"g1", "g2"},
+		After:     []string{"g1"},
+	})
+	c.Assert(err, qt.IsNil)
+	stdout := s.fixture.CheckSuccess(c, "audit", "-a", "admin.agent", "--since", "1h", "--format", "yaml")
+	c.Assert(stdout, qt.Matches, `- id: .*
+  time: .*
+  actor: admin@candid
+  operation: modify-groups
+  target: bob
+  before:
+  - g1
+  - g2
+  after:
+  - g1
+`)
+}
+
+func (s *auditSuite) TestAuditUnexpectedArgument(c *qt.C) {
+	s.fixture.CheckError(c, 2, `unrecognized args: \["bob"\]`, "audit", "-a", "admin.agent", "bob")
+}
@@ -67,10 +67,19 @@ func New() cmd.Command {
 	})
 	supercmd.Register(newACLCommand(c))
 	supercmd.Register(newAddGroupCommand(c))
+	supercmd.Register(newAuditCommand(c))
 	supercmd.Register(newCreateAgentCommand(c))
+	supercmd.Register(newDisableUserCommand(c))
+	supercmd.Register(newEnableUserCommand(c))
 	supercmd.Register(newFindCommand(c))
+	supercmd.Register(newGroupCommand(c))
+	supercmd.Register(newLDAPSyncCommand(c))
+	supercmd.Register(newLinkUserCommand(c))
 	supercmd.Register(newRemoveGroupCommand(c))
+	supercmd.Register(newRemoveUserCommand(c))
+	supercmd.Register(newRootKeysCommand(c))
 	supercmd.Register(newShowCommand(c))
+	supercmd.Register(newUnlinkUserCommand(c))
 	return supercmd
 }
 
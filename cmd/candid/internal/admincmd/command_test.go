@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"path/filepath"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/juju/aclstore/v2"
@@ -25,6 +26,7 @@ import (
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/static"
 	internalcandidtest "github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 	"github.com/canonical/candid/store/memstore"
 )
@@ -34,9 +36,13 @@ type fixture struct {
 
 	command cmd.Command
 
-	aclStore aclstore.ACLStore
-	store    store.Store
-	server   *httptest.Server
+	aclStore   aclstore.ACLStore
+	store      store.Store
+	auditStore store.AuditStore
+	rootKeys   store.RootKeyStore
+	groups     store.GroupStore
+	server     *httptest.Server
+	syncer     *testSyncer
 }
 
 func newFixture(c *qt.C) *fixture {
@@ -47,6 +53,14 @@ func newFixture(c *qt.C) *fixture {
 
 	f.aclStore = aclstore.NewACLStore(memsimplekv.NewStore())
 	f.store = memstore.NewStore()
+	f.auditStore = memstore.NewAuditStore()
+	f.rootKeys = memstore.NewRootKeyStore()
+	f.groups = memstore.NewGroupStore()
+	f.syncer = &testSyncer{
+		IdentityProvider: static.NewIdentityProvider(static.Params{
+			Name: "sync",
+		}),
+	}
 
 	t, ok := c.TB.(candidtest.Testing)
 	if !ok {
@@ -56,11 +70,15 @@ func newFixture(c *qt.C) *fixture {
 	f.server = candidtest.Serve(t, candid.ServerParams{
 		ACLStore:            f.aclStore,
 		Store:               f.store,
+		AuditStore:          f.auditStore,
+		RootKeys:            f.rootKeys,
+		GroupStore:          f.groups,
 		AdminAgentPublicKey: &adminAgentKey.Public,
 		IdentityProviders: []idp.IdentityProvider{
 			static.NewIdentityProvider(static.Params{
 				Name: "static",
 			}),
+			f.syncer,
 		},
 	})
 	c.Assert(err, qt.IsNil)
@@ -216,3 +234,26 @@ type candidtestT struct {
 func (t candidtestT) Cleanup(f func()) {
 	t.Defer(f)
 }
+
+// testSyncer is an identity provider that reports a sync that created
+// a single identity.
+type testSyncer struct {
+	idp.IdentityProvider
+	lastSync *params.SyncResult
+}
+
+func (s *testSyncer) Sync(_ context.Context, dryRun bool) *params.SyncResult {
+	t := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.lastSync = &params.SyncResult{
+		IDP:      s.Name(),
+		DryRun:   dryRun,
+		Started:  t,
+		Finished: t,
+		Created:  []string{"alice"},
+	}
+	return s.lastSync
+}
+
+func (s *testSyncer) LastSync() *params.SyncResult {
+	return s.lastSync
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/gnuflag"
@@ -26,6 +27,7 @@ type createAgentCommand struct {
 	agentFullName string
 	admin         bool
 	parent        bool
+	expires       time.Duration
 	publicKey     *bakery.PublicKey
 }
 
@@ -58,6 +60,11 @@ If the --agent-file flag is specified, the specified file will be updated with
 the new agent information, otherwise the new agent information will be
 printed to the standard output. Note when the -k flag is specified,
 this information will be missing the private key.
+
+If the --expires flag is specified, the agent can no longer be used once
+the given duration has passed, for example:
+
+    candid create-agent --expires 720h
 `
 
 func (c *createAgentCommand) Info() *cmd.Info {
@@ -78,6 +85,7 @@ func (c *createAgentCommand) SetFlags(f *gnuflag.FlagSet) {
 	f.BoolVar(&c.admin, "admin", false, "generate an agent file for the admin user; does not contact the identity manager service")
 	f.StringVar(&c.agentFullName, "name", "", "name of agent")
 	f.BoolVar(&c.parent, "parent", false, "create a parent agent")
+	f.DurationVar(&c.expires, "expires", 0, "duration after which the agent expires")
 }
 
 func (c *createAgentCommand) Init(args []string) error {
@@ -85,6 +93,9 @@ func (c *createAgentCommand) Init(args []string) error {
 	if c.agentFile != "" && c.publicKey != nil {
 		return errgo.Newf("cannot specify public key and an agent file")
 	}
+	if c.expires < 0 {
+		return errgo.Newf("expiry duration cannot be negative")
+	}
 	return errgo.Mask(c.candidCommand.Init(nil))
 }
 
@@ -125,13 +136,22 @@ func (c *createAgentCommand) Run(cmdctx *cmd.Context) error {
 		if len(c.groups) > 0 {
 			return errgo.Newf("cannot specify groups when using --admin flag")
 		}
+		if c.expires > 0 {
+			return errgo.Newf("cannot specify an expiry when using --admin flag")
+		}
 	} else {
+		var expires *time.Time
+		if c.expires > 0 {
+			t := time.Now().Add(c.expires)
+			expires = &t
+		}
 		resp, err := client.CreateAgent(ctx, &params.CreateAgentRequest{
 			CreateAgentBody: params.CreateAgentBody{
 				FullName:   c.agentFullName,
 				Groups:     c.groups,
 				PublicKeys: []*bakery.PublicKey{c.publicKey},
 				Parent:     c.parent,
+				Expires:    expires,
 			},
 		})
 		if err != nil {
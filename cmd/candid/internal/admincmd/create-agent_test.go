@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
@@ -136,3 +137,22 @@ func (s *createAgentSuite) TestCreateAgentWithParentFlag(c *qt.C) {
 	}
 	c.Assert(agents[0].URL, qt.Equals, s.fixture.server.URL)
 }
+
+func (s *createAgentSuite) TestCreateAgentWithExpires(c *qt.C) {
+	out := s.fixture.CheckSuccess(c, "create-agent", "-a", "admin.agent", "--expires", "720h")
+	var v agent.AuthInfo
+	err := json.Unmarshal([]byte(out), &v)
+	c.Assert(err, qt.IsNil)
+	c.Assert(v.Agents, qt.HasLen, 1)
+	id := store.Identity{
+		Username: v.Agents[0].Username,
+	}
+	err = s.fixture.store.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	expires := time.Until(id.Expires)
+	c.Assert(expires > 719*time.Hour && expires <= 720*time.Hour, qt.IsTrue, qt.Commentf("expires in %v", expires))
+}
+
+func (s *createAgentSuite) TestCreateAgentWithNegativeExpires(c *qt.C) {
+	s.fixture.CheckError(c, 2, `expiry duration cannot be negative`, "create-agent", "-a", "admin.agent", "--expires", "-1h")
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+type disableUserCommand struct {
+	userCommand
+
+	reason string
+	agents bool
+}
+
+func newDisableUserCommand(cc *candidCommand) cmd.Command {
+	c := &disableUserCommand{}
+	c.candidCommand = cc
+	return c
+}
+
+var disableUserDoc = `
+The disable-user command disables the specified user. A disabled user
+cannot log in and candid will refuse to discharge caveats for them. The
+user's details are retained so that the user may later be re-enabled
+with the enable-user command.
+
+To disable the user bob:
+    candid disable-user -u bob --reason "left the company"
+
+To disable the user with the email address bob@example.com along with
+all of the agents owned by that user:
+    candid disable-user -e bob@example.com --agents
+`
+
+func (c *disableUserCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "disable-user",
+		Purpose: "disable a user",
+		Doc:     disableUserDoc,
+	}
+}
+
+func (c *disableUserCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.userCommand.SetFlags(f)
+
+	f.StringVar(&c.reason, "reason", "", "reason the user is being disabled")
+	f.BoolVar(&c.agents, "agents", false, "also disable any agents owned by the user")
+}
+
+func (c *disableUserCommand) Run(ctxt *cmd.Context) error {
+	return errgo.Mask(setUserDisabled(ctxt, &c.userCommand, params.SetUserDisabledBody{
+		Disabled: true,
+		Reason:   c.reason,
+		Agents:   c.agents,
+	}))
+}
+
+type enableUserCommand struct {
+	userCommand
+
+	agents bool
+}
+
+func newEnableUserCommand(cc *candidCommand) cmd.Command {
+	c := &enableUserCommand{}
+	c.candidCommand = cc
+	return c
+}
+
+var enableUserDoc = `
+The enable-user command re-enables a user that was previously disabled
+with the disable-user command.
+
+To enable the user bob along with all of the agents owned by that user:
+    candid enable-user -u bob --agents
+`
+
+func (c *enableUserCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "enable-user",
+		Purpose: "enable a disabled user",
+		Doc:     enableUserDoc,
+	}
+}
+
+func (c *enableUserCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.userCommand.SetFlags(f)
+
+	f.BoolVar(&c.agents, "agents", false, "also enable any agents owned by the user")
+}
+
+func (c *enableUserCommand) Run(ctxt *cmd.Context) error {
+	return errgo.Mask(setUserDisabled(ctxt, &c.userCommand, params.SetUserDisabledBody{
+		Agents: c.agents,
+	}))
+}
+
+// setUserDisabled sets the disabled state of the user specified in the
+// given command.
+func setUserDisabled(ctxt *cmd.Context, c *userCommand, body params.SetUserDisabledBody) error {
+	defer c.Close(ctxt)
+	username, err := c.lookupUser(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = client.SetUserDisabled(context.Background(), &params.SetUserDisabledRequest{
+		Username: username,
+		Body:     body,
+	})
+	return errgo.Mask(err)
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+type disableUserSuite struct {
+	fixture *fixture
+}
+
+func TestDisableUser(t *testing.T) {
+	qtsuite.Run(qt.New(t), &disableUserSuite{})
+}
+
+func (s *disableUserSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      "bob@example.com",
+	})
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+		Username:   "a-bob@candid",
+		Owner:      store.MakeProviderIdentity("test", "bob"),
+	})
+}
+
+func (s *disableUserSuite) TestDisableUser(c *qt.C) {
+	s.fixture.CheckNoOutput(c, "disable-user", "-a", "admin.agent", "-u", "bob", "--reason", "left")
+	bob := s.identity(c, "bob")
+	c.Assert(bob.Disabled.IsZero(), qt.IsFalse)
+	c.Assert(bob.DisabledReason, qt.Equals, "left")
+	c.Assert(s.identity(c, "a-bob@candid").Disabled.IsZero(), qt.IsTrue)
+}
+
+func (s *disableUserSuite) TestDisableUserWithAgents(c *qt.C) {
+	s.fixture.CheckNoOutput(c, "disable-user", "-a", "admin.agent", "-e", "bob@example.com", "--agents")
+	c.Assert(s.identity(c, "bob").Disabled.IsZero(), qt.IsFalse)
+	c.Assert(s.identity(c, "a-bob@candid").Disabled.IsZero(), qt.IsFalse)
+}
+
+func (s *disableUserSuite) TestEnableUser(c *qt.C) {
+	s.disable(c, "bob")
+	s.disable(c, "a-bob@candid")
+	s.fixture.CheckNoOutput(c, "enable-user", "-a", "admin.agent", "-u", "bob")
+	bob := s.identity(c, "bob")
+	c.Assert(bob.Disabled.IsZero(), qt.IsTrue)
+	c.Assert(bob.DisabledReason, qt.Equals, "")
+	c.Assert(s.identity(c, "a-bob@candid").Disabled.IsZero(), qt.IsFalse)
+}
+
+func (s *disableUserSuite) TestEnableUserWithAgents(c *qt.C) {
+	s.disable(c, "bob")
+	s.disable(c, "a-bob@candid")
+	s.fixture.CheckNoOutput(c, "enable-user", "-a", "admin.agent", "-u", "bob", "--agents")
+	c.Assert(s.identity(c, "bob").Disabled.IsZero(), qt.IsTrue)
+	c.Assert(s.identity(c, "a-bob@candid").Disabled.IsZero(), qt.IsTrue)
+}
+
+func (s *disableUserSuite) TestDisableUserNotFound(c *qt.C) {
+	s.fixture.CheckError(
+		c,
+		1,
+		`Put http://.*/v1/u/alice/disabled: user alice not found`,
+		"disable-user", "-a", "admin.agent", "-u", "alice",
+	)
+}
+
+func (s *disableUserSuite) TestEnableUserNoUser(c *qt.C) {
+	s.fixture.CheckError(
+		c,
+		2,
+		`no user specified, please specify either username or email`,
+		"enable-user", "-a", "admin.agent",
+	)
+}
+
+func (s *disableUserSuite) identity(c *qt.C, username string) *store.Identity {
+	id := store.Identity{
+		Username: username,
+	}
+	err := s.fixture.store.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	return &id
+}
+
+func (s *disableUserSuite) disable(c *qt.C, username string) {
+	err := s.fixture.store.UpdateIdentity(context.Background(), &store.Identity{
+		Username:       username,
+		Disabled:       time.Now(),
+		DisabledReason: "left",
+	}, store.Update{
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
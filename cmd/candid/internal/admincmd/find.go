@@ -5,7 +5,6 @@ package admincmd
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"strings"
 	"time"
@@ -26,6 +25,7 @@ type findCommand struct {
 	email             string
 	lastLoginDays     uint
 	lastDischargeDays uint
+	expiresDays       uint
 }
 
 func newFindCommand(c *candidCommand) cmd.Command {
@@ -39,6 +39,7 @@ The find command finds users that match the request parameters.
 
     candid find -e bob@example.com
     candid find --last-login=30
+    candid find --expires=7 -d expires
 `
 
 func (c *findCommand) Info() *cmd.Info {
@@ -59,11 +60,12 @@ func (c *findCommand) SetFlags(f *gnuflag.FlagSet) {
 		"tab":   c.formatTab,
 	})
 
-	f.StringVar(&c.detail, "d", "", "include user details, comma separated list of external_id, email, gravatar_id, or fullname output is forced to tab separated")
+	f.StringVar(&c.detail, "d", "", "include user details, comma separated list of external_id, email, gravatar_id, fullname or expires output is forced to tab separated")
 	f.StringVar(&c.email, "e", "", "email address of the user")
 	f.StringVar(&c.email, "email", "", "")
 	f.UintVar(&c.lastLoginDays, "last-login", 0, "users whose last successful login was within this number of days")
 	f.UintVar(&c.lastDischargeDays, "last-discharge", 0, "users whose last successful discharge was within this number of days")
+	f.UintVar(&c.expiresDays, "expires", 0, "agents that expire within this number of days")
 }
 
 func (c *findCommand) Init(args []string) error {
@@ -85,24 +87,37 @@ func (c *findCommand) Run(ctxt *cmd.Context) error {
 	if c.lastDischargeDays > 0 {
 		req.LastDischargeSince = daysAgo(c.lastDischargeDays)
 	}
-	usernames, err := client.QueryUsers(context.Background(), &req)
-	if err != nil {
-		return errgo.Mask(err)
+	if c.expiresDays > 0 {
+		req.ExpiresBefore = daysFromNow(c.expiresDays)
 	}
 	if "" == c.detail {
+		usernames, err := client.QueryUsers(context.Background(), &req)
+		if err != nil {
+			return errgo.Mask(err)
+		}
 		return c.out.Write(ctxt, usernames)
 	}
+	pageReq := params.QueryUsersPageRequest{
+		QueryUsersRequest: req,
+		Full:              true,
+	}
+	var users []params.User
+	for {
+		resp, err := client.QueryUsersPage(context.Background(), &pageReq)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		users = append(users, resp.Users...)
+		if resp.Next == "" {
+			break
+		}
+		pageReq.Next = resp.Next
+	}
 	fields := strings.Split(c.detail, ",")
 	var user_output []map[string]string
-	for _, u := range usernames {
+	for _, user := range users {
 		user_out := make(map[string]string)
-		user_out["username"] = u
-		user, err2 := client.User(context.Background(), &params.UserRequest{
-			Username: params.Username(u),
-		})
-		if err2 != nil {
-			fmt.Fprintf(ctxt.Stderr, "%v ... continuing\n", err2)
-		}
+		user_out["username"] = string(user.Username)
 		for _, f := range fields {
 			switch strings.ToLower(strings.Trim(f, " ")) {
 			case "email":
@@ -113,6 +128,10 @@ func (c *findCommand) Run(ctxt *cmd.Context) error {
 				user_out["fullname"] = user.FullName
 			case "gravatar_id":
 				user_out["gravatar_id"] = user.GravatarID
+			case "expires":
+				if user.Expires != nil {
+					user_out["expires"] = user.Expires.Format(time.RFC3339)
+				}
 			}
 		}
 		user_output = append(user_output, user_out)
@@ -124,7 +143,17 @@ func (c *findCommand) Run(ctxt *cmd.Context) error {
 // number of days, formatted as a string as required
 // by time fields in params.QueryUsersRequest.
 func daysAgo(days uint) string {
-	t := time.Now().AddDate(0, 0, -int(days))
+	return formatTime(time.Now().AddDate(0, 0, -int(days)))
+}
+
+// daysFromNow returns the current time plus the given number of days,
+// formatted as a string as required by time fields in
+// params.QueryUsersRequest.
+func daysFromNow(days uint) string {
+	return formatTime(time.Now().AddDate(0, 0, int(days)))
+}
+
+func formatTime(t time.Time) string {
 	b, err := t.MarshalText()
 	if err != nil {
 		// This should be impossible unless things are severly wrong.
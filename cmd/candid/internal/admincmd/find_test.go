@@ -119,6 +119,48 @@ func (s *findSuite) TestFindLastDischargeTime(c *qt.C) {
 	c.Assert(usernames, qt.DeepEquals, []string{"admin@candid", "alice", "charlie"})
 }
 
+func (s *findSuite) TestFindExpires(c *qt.C) {
+	ctx := context.Background()
+	identities := []store.Identity{{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+		Username:   "a-bob@candid",
+		Expires:    time.Now().Add(2 * 24 * time.Hour),
+	}, {
+		ProviderID: store.MakeProviderIdentity("idm", "a-alice"),
+		Username:   "a-alice@candid",
+		Expires:    time.Now().Add(30 * 24 * time.Hour),
+	}, {
+		ProviderID: store.MakeProviderIdentity("idm", "a-charlie"),
+		Username:   "a-charlie@candid",
+	}}
+	for _, id := range identities {
+		candidtest.AddIdentity(ctx, s.fixture.store, &id)
+	}
+	stdout := s.fixture.CheckSuccess(c, "find", "-a", "admin.agent", "--format", "json", "--expires", "7")
+	var usernames []string
+	err := json.Unmarshal([]byte(stdout), &usernames)
+	c.Assert(err, qt.IsNil)
+	c.Assert(usernames, qt.DeepEquals, []string{"a-bob@candid"})
+}
+
+func (s *findSuite) TestFindWithExpires(c *qt.C) {
+	ctx := context.Background()
+	expires := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+		Username:   "a-bob@candid",
+		Expires:    expires,
+	})
+	stdout := s.fixture.CheckSuccess(c, "find", "-a", "admin.agent", "-d", "expires", "--format", "json", "--expires", "365000")
+	var users []map[string]string
+	err := json.Unmarshal([]byte(stdout), &users)
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []map[string]string{{
+		"username": "a-bob@candid",
+		"expires":  "2100-01-01T00:00:00Z",
+	}})
+}
+
 func (s *findSuite) TestFindWithEmail(c *qt.C) {
 	ctx := context.Background()
 	identities := []store.Identity{{
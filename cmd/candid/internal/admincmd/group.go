@@ -0,0 +1,341 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+var groupCmdDoc = `
+The group command is used to examine the groups known to candid.
+`
+
+func newGroupCommand(cc *candidCommand) cmd.Command {
+	supercmd := cmd.NewSuperCommand(cmd.SuperCommandParams{
+		Name:    "group",
+		Doc:     groupCmdDoc,
+		Purpose: "examine candid groups",
+	})
+
+	supercmd.Register(&groupListCommand{candidCommand: cc})
+	supercmd.Register(&groupShowCommand{candidCommand: cc})
+	supercmd.Register(&groupMembersCommand{candidCommand: cc})
+	supercmd.Register(newGroupPathCommand(cc))
+
+	return supercmd
+}
+
+var groupListDoc = `
+The list command lists the groups that have stored information, or that
+are stored as a group of any user. Groups that are only provided by
+identity providers are not listed.
+
+    candid group list
+`
+
+type groupListCommand struct {
+	*candidCommand
+	out cmd.Output
+}
+
+func (c *groupListCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "list",
+		Purpose: "list groups",
+		Doc:     groupListDoc,
+	}
+}
+
+func (c *groupListCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+	c.out.AddFlags(f, "tab", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+		"tab":  formatGroupsTab,
+	})
+}
+
+func (c *groupListCommand) Init(args []string) error {
+	return errgo.Mask(c.candidCommand.Init(args))
+}
+
+func (c *groupListCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups, err := client.Groups(context.Background(), &params.GroupsRequest{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	out := make([]group, len(groups))
+	for i, g := range groups {
+		out[i] = group(g)
+	}
+	return c.out.Write(ctxt, out)
+}
+
+// group represents a group in the output of the list and show commands.
+type group struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Owners      []string `json:"owners,omitempty" yaml:"owners,omitempty"`
+	Subgroups   []string `json:"subgroups,omitempty" yaml:"subgroups,omitempty"`
+}
+
+func formatGroupsTab(writer io.Writer, value interface{}) error {
+	groups, ok := value.([]group)
+	if !ok {
+		return errgo.Newf("unexpected value %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tOWNERS\tSUBGROUPS\tDESCRIPTION")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", g.Name, strings.Join(g.Owners, ","), strings.Join(g.Subgroups, ","), g.Description)
+	}
+	return errgo.Mask(tw.Flush())
+}
+
+var groupShowDoc = `
+The show command shows the stored information about the specified
+group.
+
+    candid group show group-1
+`
+
+type groupShowCommand struct {
+	*candidCommand
+	out   cmd.Output
+	group string
+}
+
+func (c *groupShowCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "show",
+		Args:    "group",
+		Purpose: "show group details",
+		Doc:     groupShowDoc,
+	}
+}
+
+func (c *groupShowCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+	c.out.AddFlags(f, "yaml", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+	})
+}
+
+func (c *groupShowCommand) Init(args []string) error {
+	group, err := groupArg(args)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c.group = group
+	return errgo.Mask(c.candidCommand.Init(nil))
+}
+
+func (c *groupShowCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	g, err := client.Group(context.Background(), &params.GroupRequest{
+		Group: c.group,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return c.out.Write(ctxt, group(*g))
+}
+
+var groupMembersDoc = `
+The members command lists the users that are members of the specified
+group, whether the membership is stored in candid, provided by the
+user's identity provider or given by membership of a subgroup.
+
+    candid group members group-1
+`
+
+// groupMembersPageSize holds the number of users examined by each
+// request made by the members command.
+const groupMembersPageSize = 500
+
+type groupMembersCommand struct {
+	*candidCommand
+	out   cmd.Output
+	group string
+}
+
+func (c *groupMembersCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "members",
+		Args:    "group",
+		Purpose: "list group members",
+		Doc:     groupMembersDoc,
+	}
+}
+
+func (c *groupMembersCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+	c.out.AddFlags(f, "tab", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+		"tab":  formatGroupMembersTab,
+	})
+}
+
+func (c *groupMembersCommand) Init(args []string) error {
+	group, err := groupArg(args)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c.group = group
+	return errgo.Mask(c.candidCommand.Init(nil))
+}
+
+func (c *groupMembersCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req := params.GroupMembersRequest{
+		Group: c.group,
+		Limit: groupMembersPageSize,
+	}
+	out := []groupMember{}
+	for {
+		resp, err := client.GroupMembers(context.Background(), &req)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, u := range resp.Unresolved {
+			fmt.Fprintf(ctxt.Stderr, "cannot determine whether %s is a member of %s\n", u, c.group)
+		}
+		for _, m := range resp.Members {
+			out = append(out, groupMember{
+				Username: string(m.Username),
+				Stored:   m.Stored,
+			})
+		}
+		if resp.Next == "" {
+			break
+		}
+		req.Next = resp.Next
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Username < out[j].Username
+	})
+	return c.out.Write(ctxt, out)
+}
+
+// groupMember represents a group member in the output of the members
+// command.
+type groupMember struct {
+	Username string `json:"username" yaml:"username"`
+	Stored   bool   `json:"stored,omitempty" yaml:"stored,omitempty"`
+}
+
+func formatGroupMembersTab(writer io.Writer, value interface{}) error {
+	members, ok := value.([]groupMember)
+	if !ok {
+		return errgo.Newf("unexpected value %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tSTORED")
+	for _, m := range members {
+		stored := "no"
+		if m.Stored {
+			stored = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", m.Username, stored)
+	}
+	return errgo.Mask(tw.Flush())
+}
+
+var groupPathDoc = `
+The path command shows how the specified user is a member of the
+specified group. The first group shown is one that the user is directly
+a member of, each following group contains the group before it.
+
+    candid group path -u bob engineering
+`
+
+type groupPathCommand struct {
+	userCommand
+	group string
+}
+
+func newGroupPathCommand(cc *candidCommand) cmd.Command {
+	c := &groupPathCommand{}
+	c.candidCommand = cc
+	return c
+}
+
+func (c *groupPathCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "path",
+		Args:    "group",
+		Purpose: "show how a user is a member of a group",
+		Doc:     groupPathDoc,
+	}
+}
+
+func (c *groupPathCommand) Init(args []string) error {
+	group, err := groupArg(args)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c.group = group
+	return errgo.Mask(c.userCommand.Init(nil))
+}
+
+func (c *groupPathCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	username, err := c.lookupUser(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp, err := client.UserGroupPath(context.Background(), &params.UserGroupPathRequest{
+		Username: username,
+		Group:    c.group,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !resp.Member {
+		return errgo.Newf("%s is not a member of %s", username, c.group)
+	}
+	fmt.Fprintln(ctxt.Stdout, strings.Join(resp.Path, " -> "))
+	return nil
+}
+
+// groupArg returns the group name held in the given command arguments.
+func groupArg(args []string) (string, error) {
+	if len(args) < 1 {
+		return "", errgo.New("group name required")
+	}
+	if len(args) > 1 {
+		return "", errgo.New("only one group may be specified")
+	}
+	return args[0], nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/store"
+)
+
+type groupSuite struct {
+	fixture *fixture
+}
+
+func TestGroup(t *testing.T) {
+	qtsuite.Run(qt.New(t), &groupSuite{})
+}
+
+func (s *groupSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+	ctx := context.Background()
+	err := s.fixture.groups.SetGroup(ctx, &store.Group{
+		Name:        "g1",
+		Description: "group one",
+		Owners:      []string{"alice", "bob"},
+		Subgroups:   []string{"g2"},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.fixture.store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("static", "bob"),
+		Username:   "bob",
+		Groups:     []string{"g2"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *groupSuite) TestList(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "group", "list")
+	// The tabwriter pads the empty columns of g2.
+	c.Assert(stdout, qt.Equals, ""+
+		"NAME OWNERS    SUBGROUPS DESCRIPTION\n"+
+		"g1   alice,bob g2        group one\n"+
+		"g2                       \n"+
+		"\n")
+}
+
+func (s *groupSuite) TestListYAML(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "group", "list", "--format", "yaml")
+	c.Assert(stdout, qt.Equals, `
+- name: g1
+  description: group one
+  owners:
+  - alice
+  - bob
+  subgroups:
+  - g2
+- name: g2
+`[1:])
+}
+
+func (s *groupSuite) TestShow(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "group", "show", "g1")
+	c.Assert(stdout, qt.Equals, `
+name: g1
+description: group one
+owners:
+- alice
+- bob
+subgroups:
+- g2
+`[1:])
+}
+
+func (s *groupSuite) TestShowNoGroup(c *qt.C) {
+	s.fixture.CheckError(c, 2, `group name required`, "-a", "admin.agent", "group", "show")
+}
+
+func (s *groupSuite) TestMembers(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "group", "members", "g2")
+	c.Assert(stdout, qt.Equals, `
+USERNAME STORED
+bob      yes
+
+`[1:])
+}
+
+func (s *groupSuite) TestMembersTooManyGroups(c *qt.C) {
+	s.fixture.CheckError(c, 2, `only one group may be specified`, "-a", "admin.agent", "group", "members", "g1", "g2")
+}
+
+func (s *groupSuite) TestPath(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "group", "path", "-u", "bob", "g1")
+	c.Assert(stdout, qt.Equals, "g2 -> g1\n")
+}
+
+func (s *groupSuite) TestPathNotMember(c *qt.C) {
+	s.fixture.CheckError(c, 1, `bob is not a member of g3`, "-a", "admin.agent", "group", "path", "-u", "bob", "g3")
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+var ldapSyncDoc = `
+The ldap-sync command shows the result of the most recent sync of the
+identities of each LDAP identity provider that is configured to
+synchronise with its directory.
+
+With --now, the identities are synchronised immediately and the result
+is shown. With --dry-run, the sync only reports the changes that would
+be made; use --format yaml to see the identities that would be changed.
+
+    candid ldap-sync
+    candid ldap-sync --now --idp ldap
+    candid ldap-sync --dry-run --format yaml
+`
+
+type ldapSyncCommand struct {
+	*candidCommand
+
+	out    cmd.Output
+	idp    string
+	now    bool
+	dryRun bool
+}
+
+func newLDAPSyncCommand(cc *candidCommand) cmd.Command {
+	c := &ldapSyncCommand{
+		candidCommand: cc,
+	}
+	return c
+}
+
+func (c *ldapSyncCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "ldap-sync",
+		Purpose: "synchronise identities with LDAP directories",
+		Doc:     ldapSyncDoc,
+	}
+}
+
+func (c *ldapSyncCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+	c.out.AddFlags(f, "tab", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+		"tab":  formatSyncResultsTab,
+	})
+	f.StringVar(&c.idp, "idp", "", "only include the identity provider with the given name")
+	f.BoolVar(&c.now, "now", false, "synchronise identities now")
+	f.BoolVar(&c.dryRun, "dry-run", false, "report the changes a sync would make without making them (implies --now)")
+}
+
+func (c *ldapSyncCommand) Init(args []string) error {
+	return errgo.Mask(c.candidCommand.Init(args))
+}
+
+func (c *ldapSyncCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var results []params.SyncResult
+	if c.now || c.dryRun {
+		results, err = client.Sync(context.Background(), &params.SyncRequest{
+			IDP:    c.idp,
+			DryRun: c.dryRun,
+		})
+	} else {
+		results, err = client.SyncStatus(context.Background(), &params.SyncStatusRequest{
+			IDP: c.idp,
+		})
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	out := make([]syncResult, len(results))
+	for i, r := range results {
+		out[i] = syncResult{
+			IDP:      r.IDP,
+			DryRun:   r.DryRun,
+			Started:  r.Started.Format(time.RFC3339),
+			Finished: r.Finished.Format(time.RFC3339),
+			Created:  r.Created,
+			Updated:  r.Updated,
+			Enabled:  r.Enabled,
+			Disabled: r.Disabled,
+			Removed:  r.Removed,
+			Errors:   r.Errors,
+			Error:    r.Error,
+		}
+	}
+	return c.out.Write(ctxt, out)
+}
+
+// syncResult represents the result of a sync in the output of the
+// ldap-sync command.
+type syncResult struct {
+	IDP      string   `json:"idp" yaml:"idp"`
+	DryRun   bool     `json:"dry-run,omitempty" yaml:"dry-run,omitempty"`
+	Started  string   `json:"started" yaml:"started"`
+	Finished string   `json:"finished" yaml:"finished"`
+	Created  []string `json:"created,omitempty" yaml:"created,omitempty"`
+	Updated  []string `json:"updated,omitempty" yaml:"updated,omitempty"`
+	Enabled  []string `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Disabled []string `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Removed  []string `json:"removed,omitempty" yaml:"removed,omitempty"`
+	Errors   []string `json:"errors,omitempty" yaml:"errors,omitempty"`
+	Error    string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func formatSyncResultsTab(writer io.Writer, value interface{}) error {
+	results, ok := value.([]syncResult)
+	if !ok {
+		return errgo.Newf("unexpected value %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "IDP\tFINISHED\tDRY-RUN\tCREATED\tUPDATED\tENABLED\tDISABLED\tREMOVED\tERRORS\tSTATUS")
+	for _, r := range results {
+		dryRun := "no"
+		if r.DryRun {
+			dryRun = "yes"
+		}
+		status := "ok"
+		if r.Error != "" {
+			status = r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", r.IDP, r.Finished, dryRun, len(r.Created), len(r.Updated), len(r.Enabled), len(r.Disabled), len(r.Removed), len(r.Errors), status)
+	}
+	return errgo.Mask(tw.Flush())
+}
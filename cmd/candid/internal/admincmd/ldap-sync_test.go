@@ -0,0 +1,67 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+)
+
+type ldapSyncSuite struct {
+	fixture *fixture
+}
+
+func TestLDAPSync(t *testing.T) {
+	qtsuite.Run(qt.New(t), &ldapSyncSuite{})
+}
+
+func (s *ldapSyncSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+}
+
+func (s *ldapSyncSuite) TestStatusNotRun(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "ldap-sync")
+	c.Assert(stdout, qt.Equals, `
+IDP FINISHED DRY-RUN CREATED UPDATED ENABLED DISABLED REMOVED ERRORS STATUS
+
+`[1:])
+}
+
+func (s *ldapSyncSuite) TestNow(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "ldap-sync", "--now")
+	c.Assert(stdout, qt.Equals, `
+IDP  FINISHED             DRY-RUN CREATED UPDATED ENABLED DISABLED REMOVED ERRORS STATUS
+sync 2021-01-01T00:00:00Z no      1       0       0       0        0       0      ok
+
+`[1:])
+	c.Assert(s.fixture.syncer.LastSync().DryRun, qt.Equals, false)
+}
+
+func (s *ldapSyncSuite) TestStatusYAML(c *qt.C) {
+	s.fixture.syncer.Sync(context.Background(), false)
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "ldap-sync", "--format", "yaml")
+	c.Assert(stdout, qt.Equals, `
+- idp: sync
+  started: "2021-01-01T00:00:00Z"
+  finished: "2021-01-01T00:00:00Z"
+  created:
+  - alice
+`[1:])
+}
+
+func (s *ldapSyncSuite) TestDryRun(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "ldap-sync", "--dry-run", "--idp", "sync", "--format", "json")
+	c.Assert(stdout, qt.Equals, `[{"idp":"sync","dry-run":true,"started":"2021-01-01T00:00:00Z","finished":"2021-01-01T00:00:00Z","created":["alice"]}]`+"\n")
+}
+
+func (s *ldapSyncSuite) TestIDPNotSyncing(c *qt.C) {
+	s.fixture.CheckError(c, 1, `Post http://.*/v1/sync\?idp=static: identity provider "static" not found or does not support sync`, "-a", "admin.agent", "ldap-sync", "--now", "--idp", "static")
+}
+
+func (s *ldapSyncSuite) TestTooManyArguments(c *qt.C) {
+	s.fixture.CheckError(c, 2, `unrecognized args: \["ldap"\]`, "-a", "admin.agent", "ldap-sync", "ldap")
+}
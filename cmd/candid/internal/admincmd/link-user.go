@@ -0,0 +1,135 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/juju/cmd"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+type linkUserCommand struct {
+	userCommand
+
+	providerID string
+}
+
+func newLinkUserCommand(cc *candidCommand) cmd.Command {
+	c := &linkUserCommand{}
+	c.candidCommand = cc
+	return c
+}
+
+var linkUserDoc = `
+The link-user command links a provider ID to the specified user so that
+the user can log in using that identity provider. If the provider ID
+already identifies another user then that user's groups and keys are
+merged into the specified user and the other user is removed.
+
+To link the provider ID "github:1234" to the user bob:
+    candid link-user -u bob github:1234
+`
+
+func (c *linkUserCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "link-user",
+		Args:    "provider-id",
+		Purpose: "link a provider ID to a user",
+		Doc:     linkUserDoc,
+	}
+}
+
+func (c *linkUserCommand) Init(args []string) error {
+	if len(args) != 1 {
+		return errgo.New("provider ID must be specified")
+	}
+	c.providerID = args[0]
+	return errgo.Mask(c.userCommand.Init(nil))
+}
+
+func (c *linkUserCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	username, err := c.lookupUser(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp, err := client.LinkProviderID(context.Background(), &params.LinkProviderIDRequest{
+		Username: username,
+		Body: params.ProviderIDBody{
+			ProviderID: c.providerID,
+		},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if resp.Merged != "" {
+		fmt.Fprintf(ctxt.Stdout, "merged %s into %s\n", resp.Merged, username)
+	}
+	return nil
+}
+
+type unlinkUserCommand struct {
+	userCommand
+
+	providerID string
+}
+
+func newUnlinkUserCommand(cc *candidCommand) cmd.Command {
+	c := &unlinkUserCommand{}
+	c.candidCommand = cc
+	return c
+}
+
+var unlinkUserDoc = `
+The unlink-user command removes a provider ID that was previously linked
+to the specified user. The provider ID that the user was created with
+cannot be removed.
+
+To unlink the provider ID "github:1234" from the user bob:
+    candid unlink-user -u bob github:1234
+`
+
+func (c *unlinkUserCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "unlink-user",
+		Args:    "provider-id",
+		Purpose: "unlink a provider ID from a user",
+		Doc:     unlinkUserDoc,
+	}
+}
+
+func (c *unlinkUserCommand) Init(args []string) error {
+	if len(args) != 1 {
+		return errgo.New("provider ID must be specified")
+	}
+	c.providerID = args[0]
+	return errgo.Mask(c.userCommand.Init(nil))
+}
+
+func (c *unlinkUserCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	username, err := c.lookupUser(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = client.UnlinkProviderID(context.Background(), &params.UnlinkProviderIDRequest{
+		Username: username,
+		Body: params.ProviderIDBody{
+			ProviderID: c.providerID,
+		},
+	})
+	return errgo.Mask(err)
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+type linkUserSuite struct {
+	fixture *fixture
+}
+
+func TestLinkUser(t *testing.T) {
+	qtsuite.Run(qt.New(t), &linkUserSuite{})
+}
+
+func (s *linkUserSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"g1"},
+	})
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test2", "bob"),
+		Username:   "bob2",
+		Groups:     []string{"g2"},
+	})
+}
+
+func (s *linkUserSuite) TestLinkUser(c *qt.C) {
+	s.fixture.CheckNoOutput(c, "link-user", "-a", "admin.agent", "-u", "bob", "test3:bob")
+	bob := s.identity(c, "test3:bob")
+	c.Assert(bob.Username, qt.Equals, "bob")
+	c.Assert(bob.LinkedProviderIDs, qt.DeepEquals, []store.ProviderIdentity{"test3:bob"})
+}
+
+func (s *linkUserSuite) TestLinkUserMerge(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "link-user", "-a", "admin.agent", "-u", "bob", "test2:bob")
+	c.Assert(stdout, qt.Equals, "merged bob2 into bob\n")
+	bob := s.identity(c, "test2:bob")
+	c.Assert(bob.Username, qt.Equals, "bob")
+	c.Assert(bob.Groups, qt.DeepEquals, []string{"g1", "g2"})
+}
+
+func (s *linkUserSuite) TestLinkUserNoProviderID(c *qt.C) {
+	s.fixture.CheckError(
+		c,
+		2,
+		`provider ID must be specified`,
+		"link-user", "-a", "admin.agent", "-u", "bob",
+	)
+}
+
+func (s *linkUserSuite) TestUnlinkUser(c *qt.C) {
+	err := s.fixture.store.UpdateIdentity(context.Background(), &store.Identity{
+		Username:          "bob",
+		LinkedProviderIDs: []store.ProviderIdentity{"test3:bob"},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	s.fixture.CheckNoOutput(c, "unlink-user", "-a", "admin.agent", "-u", "bob", "test3:bob")
+	c.Assert(s.identity(c, "test:bob").LinkedProviderIDs, qt.HasLen, 0)
+}
+
+func (s *linkUserSuite) TestUnlinkUserPrimary(c *qt.C) {
+	s.fixture.CheckError(
+		c,
+		1,
+		`Delete http://.*/v1/u/bob/provider-ids: cannot unlink primary provider id "test:bob"`,
+		"unlink-user", "-a", "admin.agent", "-u", "bob", "test:bob",
+	)
+}
+
+func (s *linkUserSuite) identity(c *qt.C, pid store.ProviderIdentity) *store.Identity {
+	id := store.Identity{
+		ProviderID: pid,
+	}
+	err := s.fixture.store.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	return &id
+}
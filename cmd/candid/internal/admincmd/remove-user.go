@@ -0,0 +1,69 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+type removeUserCommand struct {
+	userCommand
+
+	removeAgents bool
+}
+
+func newRemoveUserCommand(cc *candidCommand) cmd.Command {
+	c := &removeUserCommand{}
+	c.candidCommand = cc
+	return c
+}
+
+var removeUserDoc = `
+The remove-user command removes the specified user from the identity
+server.
+
+To remove the user bob:
+    candid remove-user -u bob
+
+To remove the user with the email address bob@example.com along with
+all of the agents owned by that user:
+    candid remove-user -e bob@example.com --agents
+`
+
+func (c *removeUserCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "remove-user",
+		Purpose: "remove a user",
+		Doc:     removeUserDoc,
+	}
+}
+
+func (c *removeUserCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.userCommand.SetFlags(f)
+
+	f.BoolVar(&c.removeAgents, "agents", false, "also remove any agents owned by the user")
+}
+
+func (c *removeUserCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	username, err := c.lookupUser(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = client.RemoveUser(context.Background(), &params.RemoveUserRequest{
+		Username:     username,
+		RemoveAgents: c.removeAgents,
+	})
+	return errgo.Mask(err)
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+type removeUserSuite struct {
+	fixture *fixture
+}
+
+func TestRemoveUser(t *testing.T) {
+	qtsuite.Run(qt.New(t), &removeUserSuite{})
+}
+
+func (s *removeUserSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+}
+
+func (s *removeUserSuite) TestRemoveUser(c *qt.C) {
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	})
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+		Username:   "a-bob@candid",
+		Owner:      store.MakeProviderIdentity("test", "bob"),
+	})
+	s.fixture.CheckNoOutput(c, "remove-user", "-a", "admin.agent", "-u", "bob")
+	err := s.fixture.store.Identity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = s.fixture.store.Identity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *removeUserSuite) TestRemoveUserWithAgents(c *qt.C) {
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      "bob@example.com",
+	})
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+		Username:   "a-bob@candid",
+		Owner:      store.MakeProviderIdentity("test", "bob"),
+	})
+	s.fixture.CheckNoOutput(c, "remove-user", "-a", "admin.agent", "-e", "bob@example.com", "--agents")
+	err := s.fixture.store.Identity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = s.fixture.store.Identity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-bob"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *removeUserSuite) TestRemoveUserNotFound(c *qt.C) {
+	s.fixture.CheckError(
+		c,
+		1,
+		`Delete http://.*/v1/u/alice: user alice not found`,
+		"remove-user", "-a", "admin.agent", "-u", "alice",
+	)
+}
+
+func (s *removeUserSuite) TestRemoveUserNoUser(c *qt.C) {
+	s.fixture.CheckError(
+		c,
+		2,
+		`no user specified, please specify either username or email`,
+		"remove-user", "-a", "admin.agent",
+	)
+}
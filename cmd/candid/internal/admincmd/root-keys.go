@@ -0,0 +1,203 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+var rootKeysCmdDoc = `
+The root-keys command is used to manage the root keys that candid uses
+to create macaroons.
+`
+
+func newRootKeysCommand(cc *candidCommand) cmd.Command {
+	supercmd := cmd.NewSuperCommand(cmd.SuperCommandParams{
+		Name:    "root-keys",
+		Doc:     rootKeysCmdDoc,
+		Purpose: "manage candid macaroon root keys",
+	})
+
+	supercmd.Register(&rootKeysListCommand{candidCommand: cc})
+	supercmd.Register(&rootKeysRotateCommand{candidCommand: cc})
+	supercmd.Register(&rootKeysRevokeCommand{candidCommand: cc})
+
+	return supercmd
+}
+
+var rootKeysListDoc = `
+The list command lists the unexpired root keys, oldest first. The key
+currently used to create new macaroons is marked as current.
+
+    candid root-keys list
+`
+
+type rootKeysListCommand struct {
+	*candidCommand
+	out cmd.Output
+}
+
+func (c *rootKeysListCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "list",
+		Purpose: "list root keys",
+		Doc:     rootKeysListDoc,
+	}
+}
+
+func (c *rootKeysListCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+	c.out.AddFlags(f, "tab", map[string]cmd.Formatter{
+		"yaml": cmd.FormatYaml,
+		"json": cmd.FormatJson,
+		"tab":  formatRootKeysTab,
+	})
+}
+
+func (c *rootKeysListCommand) Init(args []string) error {
+	return errgo.Mask(c.candidCommand.Init(args))
+}
+
+func (c *rootKeysListCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	keys, err := client.RootKeys(context.Background(), &params.RootKeysRequest{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	out := make([]rootKey, len(keys))
+	for i, k := range keys {
+		out[i] = rootKey{
+			ID:      k.ID,
+			Created: k.Created.Format(time.RFC3339),
+			Expires: k.Expires.Format(time.RFC3339),
+			Current: k.Current,
+		}
+	}
+	return c.out.Write(ctxt, out)
+}
+
+// rootKey represents a root key in the output of the list command.
+type rootKey struct {
+	ID      string `json:"id" yaml:"id"`
+	Created string `json:"created" yaml:"created"`
+	Expires string `json:"expires" yaml:"expires"`
+	Current bool   `json:"current,omitempty" yaml:"current,omitempty"`
+}
+
+func formatRootKeysTab(writer io.Writer, value interface{}) error {
+	keys, ok := value.([]rootKey)
+	if !ok {
+		return errgo.Newf("unexpected value %T", value)
+	}
+	tw := tabwriter.NewWriter(writer, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tEXPIRES\tCURRENT")
+	for _, k := range keys {
+		current := "no"
+		if k.Current {
+			current = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k.ID, k.Created, k.Expires, current)
+	}
+	return errgo.Mask(tw.Flush())
+}
+
+var rootKeysRotateDoc = `
+The rotate command generates a new root key that will be used for all
+subsequently created macaroons, and prints its ID. Macaroons created
+with previous root keys remain valid until those keys expire or are
+revoked.
+
+    candid root-keys rotate
+`
+
+type rootKeysRotateCommand struct {
+	*candidCommand
+}
+
+func (c *rootKeysRotateCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "rotate",
+		Purpose: "generate a new root key",
+		Doc:     rootKeysRotateDoc,
+	}
+}
+
+func (c *rootKeysRotateCommand) Init(args []string) error {
+	return errgo.Mask(c.candidCommand.Init(args))
+}
+
+func (c *rootKeysRotateCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := client.RotateRootKey(context.Background(), &params.RotateRootKeyRequest{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	fmt.Fprintln(ctxt.Stdout, key.ID)
+	return nil
+}
+
+var rootKeysRevokeDoc = `
+The revoke command removes the specified root key. All macaroons and
+discharge tokens created with the key immediately become invalid.
+
+    candid root-keys revoke 0123456789abcdef0123456789abcdef
+`
+
+type rootKeysRevokeCommand struct {
+	*candidCommand
+	id string
+}
+
+func (c *rootKeysRevokeCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "revoke",
+		Args:    "id",
+		Purpose: "revoke a root key",
+		Doc:     rootKeysRevokeDoc,
+	}
+}
+
+func (c *rootKeysRevokeCommand) Init(args []string) error {
+	if err := c.candidCommand.Init(nil); err != nil {
+		return errgo.Mask(err)
+	}
+	if len(args) < 1 {
+		return errgo.New("root key ID required")
+	}
+	if len(args) > 1 {
+		return errgo.New("only one root key may be specified")
+	}
+	c.id = args[0]
+	return nil
+}
+
+func (c *rootKeysRevokeCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = client.RevokeRootKey(context.Background(), &params.RevokeRootKeyRequest{
+		ID: c.id,
+	})
+	return errgo.Mask(err)
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+type rootKeysSuite struct {
+	fixture *fixture
+	keys    []store.RootKey
+}
+
+func TestRootKeys(t *testing.T) {
+	qtsuite.Run(qt.New(t), &rootKeysSuite{})
+}
+
+func (s *rootKeysSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+	now := time.Now().UTC().Truncate(time.Second)
+	s.keys = []store.RootKey{{
+		ID:      []byte("key1"),
+		RootKey: []byte("0123456789abcdef0123456789abcdef"),
+		Created: now.Add(-2 * time.Hour),
+		Expires: now.Add(time.Hour),
+	}, {
+		// key2 conforms to the default root key policy so it will
+		// be used to create new macaroons.
+		ID:      []byte("key2"),
+		RootKey: []byte("fedcba9876543210fedcba9876543210"),
+		Created: now.Add(-time.Hour),
+		Expires: now.Add(2*store.DefaultRootKeyPolicy.ExpiryDuration - time.Hour),
+	}}
+	for _, k := range s.keys {
+		err := s.fixture.rootKeys.InsertRootKey(context.Background(), k)
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func (s *rootKeysSuite) TestList(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "root-keys", "list")
+	c.Assert(stdout, qt.Equals, fmt.Sprintf(`
+ID   CREATED              EXPIRES              CURRENT
+key1 %s %s no
+key2 %s %s yes
+
+`[1:], rfc3339(s.keys[0].Created), rfc3339(s.keys[0].Expires), rfc3339(s.keys[1].Created), rfc3339(s.keys[1].Expires)))
+}
+
+func (s *rootKeysSuite) TestListYAML(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "root-keys", "list", "--format", "yaml")
+	c.Assert(stdout, qt.Equals, fmt.Sprintf(`
+- id: key1
+  created: "%s"
+  expires: "%s"
+- id: key2
+  created: "%s"
+  expires: "%s"
+  current: true
+`[1:], rfc3339(s.keys[0].Created), rfc3339(s.keys[0].Expires), rfc3339(s.keys[1].Created), rfc3339(s.keys[1].Expires)))
+}
+
+func (s *rootKeysSuite) TestRotate(c *qt.C) {
+	stdout := s.fixture.CheckSuccess(c, "-a", "admin.agent", "root-keys", "rotate")
+	id := strings.TrimSpace(stdout)
+	c.Assert(id, qt.Matches, `[0-9a-f]{32}`)
+
+	current, err := store.CurrentRootKey(context.Background(), s.fixture.rootKeys, store.DefaultRootKeyPolicy)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(current.ID), qt.Equals, id)
+}
+
+func (s *rootKeysSuite) TestRevoke(c *qt.C) {
+	s.fixture.CheckNoOutput(c, "-a", "admin.agent", "root-keys", "revoke", "key1")
+	_, err := s.fixture.rootKeys.RootKey(context.Background(), []byte("key1"))
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *rootKeysSuite) TestRevokeNotFound(c *qt.C) {
+	s.fixture.CheckError(c, 1, `Delete http://.*/v1/root-keys/no-such-key: root key "no-such-key" not found`, "-a", "admin.agent", "root-keys", "revoke", "no-such-key")
+}
+
+func (s *rootKeysSuite) TestRevokeNoArguments(c *qt.C) {
+	s.fixture.CheckError(c, 2, `root key ID required`, "-a", "admin.agent", "root-keys", "revoke")
+}
+
+func (s *rootKeysSuite) TestRevokeTooManyArguments(c *qt.C) {
+	s.fixture.CheckError(c, 2, `only one root key may be specified`, "-a", "admin.agent", "root-keys", "revoke", "key1", "key2")
+}
+
+func rfc3339(t time.Time) string {
+	return t.Format(time.RFC3339)
+}
@@ -85,6 +85,16 @@ func (c *showCommand) Run(ctxt *cmd.Context) error {
 	if len(u.SSHKeys) > 0 {
 		user.SSHKeys = u.SSHKeys
 	}
+	if len(u.LinkedExternalIDs) > 0 {
+		user.LinkedExternalIDs = u.LinkedExternalIDs
+	}
+	if u.Expires != nil {
+		user.Expires = timeString(u.Expires)
+	}
+	if u.Disabled != nil {
+		user.Disabled = timeString(u.Disabled)
+		user.DisabledReason = u.DisabledReason
+	}
 	return c.out.Write(ctxt, user)
 }
 
@@ -107,4 +117,10 @@ type user struct {
 	SSHKeys       []string            `json:"ssh-keys" yaml:"ssh-keys"`
 	LastLogin     string              `json:"last-login" yaml:"last-login"`
 	LastDischarge string              `json:"last-discharge" yaml:"last-discharge"`
+
+	LinkedExternalIDs []string `json:"linked-external-ids,omitempty" yaml:"linked-external-ids,omitempty"`
+
+	Expires        string `json:"expires,omitempty" yaml:"expires,omitempty"`
+	Disabled       string `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	DisabledReason string `json:"disabled-reason,omitempty" yaml:"disabled-reason,omitempty"`
 }
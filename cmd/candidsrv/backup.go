@@ -0,0 +1,148 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/candid/cmd/candidsrv/internal/backup"
+	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/store"
+)
+
+// backupCmd implements the backup command, it returns the exit code for
+// the process.
+func backupCmd(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "", "write the archive to the given file instead of standard output")
+	compress := fs.Bool("z", false, "compress the archive with gzip")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s backup [options] <config path>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	backend, code := openBackend(fs.Arg(0))
+	if backend == nil {
+		return code
+	}
+	defer backend.Close()
+
+	f := os.Stdout
+	if *output != "" {
+		// The archive contains secrets, so make sure it is only
+		// readable by the owner.
+		var err error
+		f, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot create archive: %v\n", err)
+			return 1
+		}
+	}
+	counts, err := backup.Backup(context.Background(), backend, f, *compress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot back up: %v\n", err)
+		return 1
+	}
+	if f != os.Stdout {
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write archive: %v\n", err)
+			return 1
+		}
+	}
+	printCounts("backed up", counts)
+	return 0
+}
+
+// restoreCmd implements the restore command, it returns the exit code
+// for the process.
+func restoreCmd(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	verify := fs.Bool("verify", false, "compare the archive with the contents of the storage instead of restoring it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s restore [options] <config path> <archive path>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	backend, code := openBackend(fs.Arg(0))
+	if backend == nil {
+		return code
+	}
+	defer backend.Close()
+
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open archive: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	if *verify {
+		diffs, err := backup.Verify(ctx, backend, f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot verify: %v\n", err)
+			return 1
+		}
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+		if len(diffs) > 0 {
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "storage matches archive\n")
+		return 0
+	}
+	counts, err := backup.Restore(ctx, backend, f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot restore: %v\n", err)
+		return 1
+	}
+	printCounts("restored", counts)
+	return 0
+}
+
+// openBackend opens the storage backend configured in the given
+// configuration file. If the backend cannot be opened an error is
+// printed and the exit code for the process is returned.
+func openBackend(confPath string) (store.Backend, int) {
+	conf, err := config.Read(confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration: %v\n", err)
+		return nil, 2
+	}
+	backend, err := conf.Storage.NewBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open storage: %v\n", err)
+		return nil, 1
+	}
+	return backend, 0
+}
+
+func printCounts(action string, counts backup.Counts) {
+	types := make([]string, 0, len(counts))
+	for typ := range counts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		fmt.Fprintf(os.Stderr, "%s %d %s records\n", action, counts[typ], typ)
+	}
+}
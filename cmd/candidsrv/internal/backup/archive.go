@@ -0,0 +1,318 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package backup implements the backup and restore of all the data held
+// in a store.Backend.
+//
+// A backup archive is a sequence of JSON objects separated by newlines,
+// optionally compressed with gzip. Each object is a record with a type
+// and some data. The first record in an archive is a header, which holds
+// the version of the archive format. The last record is a footer, which
+// holds the number of records of each type in the archive and the
+// SHA-256 checksum of all the (uncompressed) bytes that precede it.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// Version holds the version of the archive format written by Backup.
+const Version = 1
+
+// Record types.
+const (
+	typeHeader   = "header"
+	typeIdentity = "identity"
+	typeACL      = "acl"
+	typeGroup    = "group"
+	typeRootKey  = "root-key"
+	typeKeyValue = "kv"
+	typeMeeting  = "meeting"
+	typeAudit    = "audit"
+	typeFooter   = "footer"
+)
+
+// Counts holds the number of records of each type in an archive.
+type Counts map[string]int
+
+type record struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type footer struct {
+	Counts Counts `json:"counts"`
+	SHA256 string `json:"sha256"`
+}
+
+type identity struct {
+	ID             string              `json:"id"`
+	ProviderID     string              `json:"provider-id"`
+	Username       string              `json:"username"`
+	Name           string              `json:"name,omitempty"`
+	Email          string              `json:"email,omitempty"`
+	Groups         []string            `json:"groups,omitempty"`
+	PublicKeys     []bakery.PublicKey  `json:"public-keys,omitempty"`
+	LastLogin      time.Time           `json:"last-login"`
+	LastDischarge  time.Time           `json:"last-discharge"`
+	ProviderInfo   map[string][]string `json:"provider-info,omitempty"`
+	ExtraInfo      map[string][]string `json:"extra-info,omitempty"`
+	Owner          string              `json:"owner,omitempty"`
+	Disabled       time.Time           `json:"disabled"`
+	DisabledReason string              `json:"disabled-reason,omitempty"`
+	Expires        time.Time           `json:"expires"`
+
+	LinkedProviderIDs []string `json:"linked-provider-ids,omitempty"`
+}
+
+type acl struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type group struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Owners      []string `json:"owners,omitempty"`
+	Subgroups   []string `json:"subgroups,omitempty"`
+}
+
+type rootKey struct {
+	ID      []byte    `json:"id"`
+	RootKey []byte    `json:"root-key"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type keyValue struct {
+	IDP    string    `json:"idp"`
+	Key    string    `json:"key"`
+	Value  []byte    `json:"value"`
+	Expire time.Time `json:"expire"`
+}
+
+type meeting struct {
+	ID      string    `json:"id"`
+	Address string    `json:"address"`
+	Created time.Time `json:"created"`
+}
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Operation string    `json:"operation"`
+	Target    string    `json:"target"`
+	Before    []string  `json:"before,omitempty"`
+	After     []string  `json:"after,omitempty"`
+	RequestID string    `json:"request-id,omitempty"`
+}
+
+// An archiveWriter writes records to an archive.
+type archiveWriter struct {
+	w      io.Writer
+	gz     *gzip.Writer
+	hash   hash.Hash
+	counts Counts
+}
+
+func newArchiveWriter(w io.Writer, compress bool) *archiveWriter {
+	aw := &archiveWriter{
+		w:      w,
+		hash:   sha256.New(),
+		counts: make(Counts),
+	}
+	if compress {
+		aw.gz = gzip.NewWriter(w)
+		aw.w = aw.gz
+	}
+	return aw
+}
+
+// write writes a record of the given type holding the given data.
+func (w *archiveWriter) write(typ string, v interface{}) error {
+	line, err := marshalRecord(typ, v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	w.hash.Write(line)
+	if _, err := w.w.Write(line); err != nil {
+		return errgo.Notef(err, "cannot write archive")
+	}
+	if typ != typeHeader {
+		w.counts[typ]++
+	}
+	return nil
+}
+
+// close writes the footer record and flushes any compressed data. It
+// does not close the underlying writer.
+func (w *archiveWriter) close() error {
+	line, err := marshalRecord(typeFooter, footer{
+		Counts: w.counts,
+		SHA256: hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := w.w.Write(line); err != nil {
+		return errgo.Notef(err, "cannot write archive")
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return errgo.Notef(err, "cannot write archive")
+		}
+	}
+	return nil
+}
+
+func marshalRecord(typ string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal %s", typ)
+	}
+	line, err := json.Marshal(record{
+		Type: typ,
+		Data: data,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal %s", typ)
+	}
+	return append(line, '\n'), nil
+}
+
+// An archiveReader reads the records from an archive, checking the
+// consistency of the archive as it does so.
+type archiveReader struct {
+	r      *bufio.Reader
+	hash   hash.Hash
+	counts Counts
+	line   int
+	done   bool
+	header header
+}
+
+// newArchiveReader returns an archiveReader that reads from the given
+// reader, which may hold either an uncompressed or a gzip compressed
+// archive. The header record is read and checked before it returns.
+func newArchiveReader(r io.Reader) (*archiveReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read archive")
+		}
+		br = bufio.NewReader(gz)
+	}
+	ar := &archiveReader{
+		r:      br,
+		hash:   sha256.New(),
+		counts: make(Counts),
+	}
+	typ, data, err := ar.readLine()
+	if err == io.EOF {
+		return nil, errgo.Newf("archive is empty")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if typ != typeHeader {
+		return nil, errgo.Newf("invalid archive: first record is %q, not header", typ)
+	}
+	if err := json.Unmarshal(data, &ar.header); err != nil {
+		return nil, errgo.Notef(err, "invalid archive header")
+	}
+	if ar.header.Version != Version {
+		return nil, errgo.Newf("unsupported archive version %d", ar.header.Version)
+	}
+	return ar, nil
+}
+
+// next returns the type and data of the next record in the archive. When
+// the footer is reached the contents of the archive are checked against
+// it and next returns io.EOF if they match.
+func (r *archiveReader) next() (string, json.RawMessage, error) {
+	if r.done {
+		return "", nil, io.EOF
+	}
+	sum := r.hash.Sum(nil)
+	typ, data, err := r.readLine()
+	if err == io.EOF {
+		return "", nil, errgo.Newf("archive is truncated: no footer found")
+	}
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	switch typ {
+	case typeHeader:
+		return "", nil, errgo.Newf("invalid archive: unexpected header on line %d", r.line)
+	case typeFooter:
+	default:
+		r.counts[typ]++
+		return typ, data, nil
+	}
+	r.done = true
+	var f footer
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", nil, errgo.Notef(err, "invalid archive footer")
+	}
+	if f.SHA256 != hex.EncodeToString(sum) {
+		return "", nil, errgo.Newf("archive checksum mismatch")
+	}
+	for typ, n := range f.Counts {
+		if r.counts[typ] != n {
+			return "", nil, errgo.Newf("archive contains %d %s records, footer records %d", r.counts[typ], typ, n)
+		}
+	}
+	for typ, n := range r.counts {
+		if f.Counts[typ] != n {
+			return "", nil, errgo.Newf("archive contains %d %s records, footer records %d", n, typ, f.Counts[typ])
+		}
+	}
+	if _, _, err := r.readLine(); err != io.EOF {
+		return "", nil, errgo.Newf("invalid archive: data found after footer")
+	}
+	return "", nil, io.EOF
+}
+
+// readLine reads a single record from the archive.
+func (r *archiveReader) readLine() (string, json.RawMessage, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return "", nil, io.EOF
+		}
+		return "", nil, errgo.Newf("archive is truncated: incomplete line %d", r.line+1)
+	}
+	if err != nil {
+		return "", nil, errgo.Notef(err, "cannot read archive")
+	}
+	r.line++
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return "", nil, errgo.Notef(err, "invalid archive: cannot parse line %d", r.line)
+	}
+	if rec.Type != typeFooter {
+		r.hash.Write(line)
+	}
+	return rec.Type, rec.Data, nil
+}
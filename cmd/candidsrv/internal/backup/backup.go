@@ -0,0 +1,208 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// identityPageSize holds the number of identities read from the store at
+// a time.
+const identityPageSize = 100
+
+// Backup writes an archive of all the data held in the given backend to
+// the given writer, compressing it if compress is true. It returns the
+// number of records of each type written.
+//
+// Data is archived as it is held in the backend, so any identity
+// provider data that has been encrypted by the server remains encrypted
+// in the archive. Other data, including the bakery root keys, is not
+// encrypted and so the archive should be protected accordingly.
+func Backup(ctx context.Context, b store.Backend, w io.Writer, compress bool) (Counts, error) {
+	aw := newArchiveWriter(w, compress)
+	err := aw.write(typeHeader, header{
+		Version: Version,
+		Created: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := walk(ctx, b, aw.write); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := aw.close(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aw.counts, nil
+}
+
+// walk calls f with the type and archive record of every item of data
+// held in the given backend. If f returns an error then walk stops and
+// returns that error.
+func walk(ctx context.Context, b store.Backend, f func(typ string, v interface{}) error) error {
+	if err := walkIdentities(ctx, b.Store(), f); err != nil {
+		return errgo.Mask(err)
+	}
+	bs := b.BackupStore()
+	names, err := bs.ACLNames(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, name := range names {
+		members, err := b.ACLStore().Get(ctx, name)
+		if err != nil {
+			return errgo.Notef(err, "cannot get ACL %q", name)
+		}
+		if err := f(typeACL, &acl{Name: name, Members: members}); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	groups, err := b.GroupStore().Groups(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, g := range groups {
+		if err := f(typeGroup, groupRecord(g)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	keys, err := b.RootKeyStore().RootKeys(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, k := range keys {
+		if err := f(typeRootKey, rootKeyRecord(k)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	err = bs.KeyValues(ctx, func(kv store.KeyValue) error {
+		return f(typeKeyValue, keyValueRecord(kv))
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	meetings, err := bs.Meetings(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, m := range meetings {
+		if err := f(typeMeeting, meetingRecord(m)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	entries, err := b.AuditStore().FindAuditEntries(ctx, store.AuditFilter{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Entries are returned most recent first, archive them in the
+	// order they were added.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := f(typeAudit, auditRecord(entries[i])); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func walkIdentities(ctx context.Context, st store.Store, f func(typ string, v interface{}) error) error {
+	ctx, close := st.Context(ctx)
+	defer close()
+	cursor := ""
+	for {
+		identities, next, err := st.FindIdentitiesPage(ctx, &store.Identity{}, store.Filter{}, cursor, identityPageSize)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, id := range identities {
+			if err := f(typeIdentity, identityRecord(id)); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func identityRecord(id store.Identity) *identity {
+	var linked []string
+	for _, pid := range id.LinkedProviderIDs {
+		linked = append(linked, string(pid))
+	}
+	sort.Strings(linked)
+	return &identity{
+		ID:             id.ID,
+		ProviderID:     string(id.ProviderID),
+		Username:       id.Username,
+		Name:           id.Name,
+		Email:          id.Email,
+		Groups:         id.Groups,
+		PublicKeys:     id.PublicKeys,
+		LastLogin:      id.LastLogin.UTC(),
+		LastDischarge:  id.LastDischarge.UTC(),
+		ProviderInfo:   id.ProviderInfo,
+		ExtraInfo:      id.ExtraInfo,
+		Owner:          string(id.Owner),
+		Disabled:       id.Disabled.UTC(),
+		DisabledReason: id.DisabledReason,
+		Expires:        id.Expires.UTC(),
+
+		LinkedProviderIDs: linked,
+	}
+}
+
+func groupRecord(g store.Group) *group {
+	return &group{
+		Name:        g.Name,
+		Description: g.Description,
+		Owners:      g.Owners,
+		Subgroups:   g.Subgroups,
+	}
+}
+
+func rootKeyRecord(k store.RootKey) *rootKey {
+	return &rootKey{
+		ID:      k.ID,
+		RootKey: k.RootKey,
+		Created: k.Created.UTC(),
+		Expires: k.Expires.UTC(),
+	}
+}
+
+func keyValueRecord(kv store.KeyValue) *keyValue {
+	return &keyValue{
+		IDP:    kv.IDP,
+		Key:    kv.Key,
+		Value:  kv.Value,
+		Expire: kv.Expire.UTC(),
+	}
+}
+
+func meetingRecord(m store.Meeting) *meeting {
+	return &meeting{
+		ID:      m.ID,
+		Address: m.Address,
+		Created: m.Created.UTC(),
+	}
+}
+
+func auditRecord(e store.AuditEntry) *auditEntry {
+	return &auditEntry{
+		Time:      e.Time.UTC(),
+		Actor:     e.Actor,
+		Operation: e.Operation,
+		Target:    e.Target,
+		Before:    e.Before,
+		After:     e.After,
+		RequestID: e.RequestID,
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/cmd/candidsrv/internal/backup"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+	"github.com/canonical/candid/store/sqlstore"
+)
+
+func TestBackupRestore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	src := memstore.NewBackend()
+	populate(c, src)
+	for _, compress := range []bool{false, true} {
+		c.Run(map[bool]string{false: "uncompressed", true: "compressed"}[compress], func(c *qt.C) {
+			var buf bytes.Buffer
+			counts, err := backup.Backup(ctx, src, &buf, compress)
+			c.Assert(err, qt.IsNil)
+			c.Check(counts, qt.DeepEquals, expectCounts)
+			c.Check(bytes.HasPrefix(buf.Bytes(), []byte{0x1f, 0x8b}), qt.Equals, compress)
+
+			dst := memstore.NewBackend()
+			counts, err = backup.Restore(ctx, dst, bytes.NewReader(buf.Bytes()))
+			c.Assert(err, qt.IsNil)
+			c.Check(counts, qt.DeepEquals, expectCounts)
+
+			diffs, err := backup.Verify(ctx, dst, bytes.NewReader(buf.Bytes()))
+			c.Assert(err, qt.IsNil)
+			c.Check(diffs, qt.HasLen, 0)
+			checkRestored(c, src, dst)
+		})
+	}
+}
+
+func TestRestoreSQLite(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	src := newSQLiteBackend(c)
+	defer src.Close()
+	populate(c, src)
+	var buf bytes.Buffer
+	_, err := backup.Backup(ctx, src, &buf, true)
+	c.Assert(err, qt.IsNil)
+
+	dst := newSQLiteBackend(c)
+	defer dst.Close()
+	_, err = backup.Restore(ctx, dst, bytes.NewReader(buf.Bytes()))
+	c.Assert(err, qt.IsNil)
+
+	diffs, err := backup.Verify(ctx, dst, bytes.NewReader(buf.Bytes()))
+	c.Assert(err, qt.IsNil)
+	c.Check(diffs, qt.HasLen, 0)
+	checkRestored(c, src, dst)
+
+	// Back up the restored data and check it is the same.
+	var buf2 bytes.Buffer
+	_, err = backup.Backup(ctx, dst, &buf2, false)
+	c.Assert(err, qt.IsNil)
+	diffs, err = backup.Verify(ctx, src, &buf2)
+	c.Assert(err, qt.IsNil)
+	c.Check(diffs, qt.HasLen, 0)
+}
+
+func TestRestoreOtherBackend(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	src := memstore.NewBackend()
+	populate(c, src)
+	var buf bytes.Buffer
+	_, err := backup.Backup(ctx, src, &buf, false)
+	c.Assert(err, qt.IsNil)
+
+	dst := newSQLiteBackend(c)
+	defer dst.Close()
+	_, err = backup.Restore(ctx, dst, bytes.NewReader(buf.Bytes()))
+	c.Check(err, qt.ErrorMatches, `cannot restore line 2: invalid identity id "0"`)
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrInvalidID)
+}
+
+func TestRestoreNotEmpty(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	src := memstore.NewBackend()
+	populate(c, src)
+	var buf bytes.Buffer
+	_, err := backup.Backup(ctx, src, &buf, false)
+	c.Assert(err, qt.IsNil)
+
+	_, err = backup.Restore(ctx, src, bytes.NewReader(buf.Bytes()))
+	c.Check(err, qt.ErrorMatches, `cannot restore into storage that already contains identities`)
+}
+
+func TestVerifyDifferences(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b := memstore.NewBackend()
+	populate(c, b)
+	var buf bytes.Buffer
+	_, err := backup.Backup(ctx, b, &buf, false)
+	c.Assert(err, qt.IsNil)
+
+	err = b.Store().UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Email:      "alice@example.org",
+	}, store.Update{
+		store.Email: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	// Recreate the bot identity unchanged, apart from its ID.
+	bot := store.Identity{ProviderID: store.MakeProviderIdentity("idm", "bot")}
+	err = b.Store().Identity(ctx, &bot)
+	c.Assert(err, qt.IsNil)
+	err = b.Store().RemoveIdentity(ctx, &store.Identity{ID: bot.ID})
+	c.Assert(err, qt.IsNil)
+	bot.ID = ""
+	err = b.Store().UpdateIdentity(ctx, &bot, store.Update{
+		store.Username:       store.Set,
+		store.PublicKeys:     store.Set,
+		store.Owner:          store.Set,
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+		store.Expires:        store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = b.ACLStore().Add(ctx, "acl2", []string{"carol"})
+	c.Assert(err, qt.IsNil)
+	err = b.GroupStore().RemoveGroup(ctx, "g1")
+	c.Assert(err, qt.IsNil)
+	kv, err := b.ProviderDataStore().KeyValueStore(ctx, "idp2")
+	c.Assert(err, qt.IsNil)
+	err = kv.Set(ctx, "new", []byte("value"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	_, err = b.MeetingStore().Remove(ctx, "meeting1")
+	c.Assert(err, qt.IsNil)
+
+	diffs, err := backup.Verify(ctx, b, &buf)
+	c.Assert(err, qt.IsNil)
+	c.Check(diffs, qt.DeepEquals, []string{
+		`ACL "acl2" differs`,
+		`group "g1" not found in storage`,
+		`identity "idm:bot" ID differs`,
+		`identity "test:alice" differs`,
+		`identity provider "idp2" key "new" not found in archive`,
+		`meeting "meeting1" not found in storage`,
+	})
+}
+
+var checkErrorTests = []struct {
+	about       string
+	modify      func(string) string
+	expectError string
+}{{
+	about: "empty",
+	modify: func(string) string {
+		return ""
+	},
+	expectError: `archive is empty`,
+}, {
+	about: "truncated",
+	modify: func(s string) string {
+		return s[:strings.LastIndex(s[:len(s)-1], "\n")+1]
+	},
+	expectError: `archive is truncated: no footer found`,
+}, {
+	about: "incomplete line",
+	modify: func(s string) string {
+		return s[:len(s)-10]
+	},
+	expectError: `archive is truncated: incomplete line 14`,
+}, {
+	about: "modified",
+	modify: func(s string) string {
+		return strings.Replace(s, `"alice"`, `"eve"`, 1)
+	},
+	expectError: `archive checksum mismatch`,
+}, {
+	about: "unsupported version",
+	modify: func(s string) string {
+		return strings.Replace(s, `"version":1`, `"version":2`, 1)
+	},
+	expectError: `unsupported archive version 2`,
+}, {
+	about: "no header",
+	modify: func(s string) string {
+		return s[strings.Index(s, "\n")+1:]
+	},
+	expectError: `invalid archive: first record is "identity", not header`,
+}, {
+	about: "data after footer",
+	modify: func(s string) string {
+		return s + s
+	},
+	expectError: `invalid archive: data found after footer`,
+}, {
+	about: "invalid JSON",
+	modify: func(s string) string {
+		return strings.Replace(s, "\n", "\n}", 1)
+	},
+	expectError: `invalid archive: cannot parse line 2: .*`,
+}}
+
+func TestCheckErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b := memstore.NewBackend()
+	populate(c, b)
+	var buf bytes.Buffer
+	_, err := backup.Backup(ctx, b, &buf, false)
+	c.Assert(err, qt.IsNil)
+	counts, err := backup.Check(bytes.NewReader(buf.Bytes()))
+	c.Assert(err, qt.IsNil)
+	c.Check(counts, qt.DeepEquals, expectCounts)
+
+	for _, test := range checkErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			archive := test.modify(buf.String())
+			_, err := backup.Check(strings.NewReader(archive))
+			c.Check(err, qt.ErrorMatches, test.expectError)
+
+			// Nothing is restored from an invalid archive.
+			dst := memstore.NewBackend()
+			_, err = backup.Restore(ctx, dst, strings.NewReader(archive))
+			c.Check(err, qt.ErrorMatches, test.expectError)
+			identities, err := dst.Store().FindIdentities(ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+			c.Assert(err, qt.IsNil)
+			c.Check(identities, qt.HasLen, 0)
+		})
+	}
+}
+
+var expectCounts = backup.Counts{
+	"identity": 2,
+	"acl":      2,
+	"group":    1,
+	"root-key": 1,
+	"kv":       3,
+	"meeting":  1,
+	"audit":    2,
+}
+
+var publicKey = bakery.MustGenerateKey().Public
+
+// populate adds some data of every kind to the given backend.
+func populate(c *qt.C, b store.Backend) {
+	ctx := context.Background()
+	err := b.Store().UpdateIdentity(ctx, &store.Identity{
+		ProviderID:    store.MakeProviderIdentity("test", "alice"),
+		Username:      "alice",
+		Name:          "Alice",
+		Email:         "alice@example.com",
+		Groups:        []string{"g1", "g2"},
+		LastLogin:     time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		LastDischarge: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		ProviderInfo:  map[string][]string{"k1": {"v1", "v2"}},
+		ExtraInfo:     map[string][]string{"k2": {"v3"}},
+		LinkedProviderIDs: []store.ProviderIdentity{
+			store.MakeProviderIdentity("test2", "alice"),
+			store.MakeProviderIdentity("test3", "alice"),
+		},
+	}, store.Update{
+		store.Username:          store.Set,
+		store.Name:              store.Set,
+		store.Email:             store.Set,
+		store.Groups:            store.Set,
+		store.LastLogin:         store.Set,
+		store.LastDischarge:     store.Set,
+		store.ProviderInfo:      store.Set,
+		store.ExtraInfo:         store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = b.Store().UpdateIdentity(ctx, &store.Identity{
+		ProviderID:     store.MakeProviderIdentity("idm", "bot"),
+		Username:       "bot@idm",
+		PublicKeys:     []bakery.PublicKey{publicKey},
+		Owner:          store.MakeProviderIdentity("test", "alice"),
+		Disabled:       time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+		DisabledReason: "retired",
+		Expires:        time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+	}, store.Update{
+		store.Username:       store.Set,
+		store.PublicKeys:     store.Set,
+		store.Owner:          store.Set,
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+		store.Expires:        store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = b.ACLStore().CreateACL(ctx, "acl1", []string{"alice"})
+	c.Assert(err, qt.IsNil)
+	err = b.ACLStore().CreateACL(ctx, "acl2", []string{"alice", "bob"})
+	c.Assert(err, qt.IsNil)
+
+	err = b.GroupStore().SetGroup(ctx, &store.Group{
+		Name:        "g1",
+		Description: "Group One",
+		Owners:      []string{"alice"},
+		Subgroups:   []string{"g2"},
+	})
+	c.Assert(err, qt.IsNil)
+
+	_, err = store.RotateRootKey(ctx, b.RootKeyStore(), store.DefaultRootKeyPolicy)
+	c.Assert(err, qt.IsNil)
+
+	kv1, err := b.ProviderDataStore().KeyValueStore(ctx, "idp1")
+	c.Assert(err, qt.IsNil)
+	err = kv1.Set(ctx, "key1", []byte("value1"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	kv2, err := b.ProviderDataStore().KeyValueStore(ctx, "idp2")
+	c.Assert(err, qt.IsNil)
+	err = kv2.Set(ctx, "key1", []byte("value2"), time.Now().Add(time.Hour))
+	c.Assert(err, qt.IsNil)
+	err = kv2.Set(ctx, "key2", []byte{}, time.Time{})
+	c.Assert(err, qt.IsNil)
+
+	err = b.MeetingStore().Put(ctx, "meeting1", "localhost:8081")
+	c.Assert(err, qt.IsNil)
+
+	err = b.AuditStore().AddAuditEntry(ctx, &store.AuditEntry{
+		Time:      time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+		Actor:     "admin@candid",
+		Operation: "set-groups",
+		Target:    "alice",
+		After:     []string{"g1", "g2"},
+	})
+	c.Assert(err, qt.IsNil)
+	err = b.AuditStore().AddAuditEntry(ctx, &store.AuditEntry{
+		Time:      time.Date(2021, 2, 2, 0, 0, 0, 0, time.UTC),
+		Actor:     "admin@candid",
+		Operation: "set-acl",
+		Target:    "acl2",
+		Before:    []string{"alice"},
+		After:     []string{"alice", "bob"},
+		RequestID: "req1",
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+// newSQLiteBackend returns a new backend using an empty SQLite database.
+func newSQLiteBackend(c *qt.C) store.Backend {
+	db, err := sql.Open("sqlite3", sqlstore.SQLiteDataSourceName(filepath.Join(c.Mkdir(), "candid.db")))
+	c.Assert(err, qt.IsNil)
+	b, err := sqlstore.NewBackend("sqlite3", db)
+	c.Assert(err, qt.IsNil)
+	return b
+}
+
+// checkRestored checks that data restored into dst from src is usable.
+func checkRestored(c *qt.C, src, dst store.Backend) {
+	ctx := context.Background()
+	srcIdentity := store.Identity{Username: "bot@idm"}
+	err := src.Store().Identity(ctx, &srcIdentity)
+	c.Assert(err, qt.IsNil)
+	identity := store.Identity{Username: "bot@idm"}
+	err = dst.Store().Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Check(identity.ID, qt.Equals, srcIdentity.ID)
+	c.Check(identity.PublicKeys, qt.DeepEquals, []bakery.PublicKey{publicKey})
+	c.Check(identity.Owner, qt.Equals, store.MakeProviderIdentity("test", "alice"))
+	c.Check(identity.Disabled.Equal(time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)), qt.Equals, true)
+	c.Check(identity.DisabledReason, qt.Equals, "retired")
+	c.Check(identity.Expires.Equal(time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)), qt.Equals, true)
+
+	identity = store.Identity{ProviderID: store.MakeProviderIdentity("test3", "alice")}
+	err = dst.Store().Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Check(identity.Username, qt.Equals, "alice")
+
+	members, err := dst.ACLStore().Get(ctx, "acl2")
+	c.Assert(err, qt.IsNil)
+	c.Check(members, qt.DeepEquals, []string{"alice", "bob"})
+
+	g := store.Group{Name: "g1"}
+	err = dst.GroupStore().Group(ctx, &g)
+	c.Assert(err, qt.IsNil)
+	c.Check(g.Owners, qt.DeepEquals, []string{"alice"})
+	c.Check(g.Subgroups, qt.DeepEquals, []string{"g2"})
+
+	key, id, err := store.NewBakeryRootKeyStore(src.RootKeyStore(), store.DefaultRootKeyPolicy).RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	key2, err := store.NewBakeryRootKeyStore(dst.RootKeyStore(), store.DefaultRootKeyPolicy).Get(ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Check(key2, qt.DeepEquals, key)
+
+	kv, err := dst.ProviderDataStore().KeyValueStore(ctx, "idp1")
+	c.Assert(err, qt.IsNil)
+	value, err := kv.Get(ctx, "key1")
+	c.Assert(err, qt.IsNil)
+	c.Check(string(value), qt.Equals, "value1")
+
+	addr, err := dst.MeetingStore().Get(ctx, "meeting1")
+	c.Assert(err, qt.IsNil)
+	c.Check(addr, qt.Equals, "localhost:8081")
+
+	entries, err := dst.AuditStore().FindAuditEntries(ctx, store.AuditFilter{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Check(entries[0].Operation, qt.Equals, "set-acl")
+	c.Check(entries[0].Time.Equal(time.Date(2021, 2, 2, 0, 0, 0, 0, time.UTC)), qt.Equals, true)
+}
@@ -0,0 +1,332 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// Check reads the archive from the given reader and checks that it is
+// complete and consistent, without restoring anything. It returns the
+// number of records of each type in the archive.
+func Check(r io.Reader) (Counts, error) {
+	ar, err := newArchiveReader(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c := newChecker()
+	for {
+		typ, data, err := ar.next()
+		if err == io.EOF {
+			return ar.counts, nil
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		v, err := decodeRecord(typ, data)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid archive: line %d", ar.line)
+		}
+		if err := c.check(v); err != nil {
+			return nil, errgo.Notef(err, "invalid archive: line %d", ar.line)
+		}
+	}
+}
+
+// Restore restores the archive read from the given reader into the
+// given backend, which must not already hold any identities, ACLs or
+// groups.
+// The whole archive is checked with Check before anything is written to
+// the backend. It returns the number of records of each type restored.
+//
+// Identities are restored with their original IDs, so an archive can
+// only be restored into the same kind of backend as it was created from;
+// restoring into any other fails with an error with a cause of
+// store.ErrInvalidID. Audit entries are restored with their original
+// times, but their IDs are allocated by the new backend.
+func Restore(ctx context.Context, b store.Backend, r io.ReadSeeker) (Counts, error) {
+	if _, err := Check(r); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	if err := checkEmpty(ctx, b); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ar, err := newArchiveReader(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	st := b.Store()
+	ctx, close := st.Context(ctx)
+	defer close()
+	for {
+		typ, data, err := ar.next()
+		if err == io.EOF {
+			return ar.counts, nil
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		v, err := decodeRecord(typ, data)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if err := restoreRecord(ctx, b, v); err != nil {
+			return nil, errgo.NoteMask(err, fmt.Sprintf("cannot restore line %d", ar.line), errgo.Is(store.ErrInvalidID))
+		}
+	}
+}
+
+// checkEmpty returns an error if the given backend holds any
+// identities, ACLs or groups.
+func checkEmpty(ctx context.Context, b store.Backend) error {
+	identities, _, err := b.Store().FindIdentitiesPage(ctx, &store.Identity{}, store.Filter{}, "", 1)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(identities) > 0 {
+		return errgo.Newf("cannot restore into storage that already contains identities")
+	}
+	names, err := b.BackupStore().ACLNames(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(names) > 0 {
+		return errgo.Newf("cannot restore into storage that already contains ACLs")
+	}
+	groups, err := b.GroupStore().Groups(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(groups) > 0 {
+		return errgo.Newf("cannot restore into storage that already contains groups")
+	}
+	return nil
+}
+
+// restoreUpdate holds the update used to restore identities. The
+// expiry time is only set for identities that expire, see
+// identityUpdate.
+var restoreUpdate = store.Update{
+	store.Username:       store.Set,
+	store.Name:           store.Set,
+	store.Email:          store.Set,
+	store.Groups:         store.Set,
+	store.PublicKeys:     store.Set,
+	store.LastLogin:      store.Set,
+	store.LastDischarge:  store.Set,
+	store.ProviderInfo:   store.Set,
+	store.ExtraInfo:      store.Set,
+	store.Owner:          store.Set,
+	store.Disabled:       store.Set,
+	store.DisabledReason: store.Set,
+
+	store.LinkedProviderIDs: store.Set,
+}
+
+// identityUpdate returns the update used to restore the given identity.
+func identityUpdate(id *store.Identity) store.Update {
+	update := restoreUpdate
+	if !id.Expires.IsZero() {
+		update[store.Expires] = store.Set
+	}
+	return update
+}
+
+func restoreRecord(ctx context.Context, b store.Backend, v interface{}) error {
+	switch v := v.(type) {
+	case *identity:
+		var linked []store.ProviderIdentity
+		for _, pid := range v.LinkedProviderIDs {
+			linked = append(linked, store.ProviderIdentity(pid))
+		}
+		id := store.Identity{
+			ID:             v.ID,
+			ProviderID:     store.ProviderIdentity(v.ProviderID),
+			Username:       v.Username,
+			Name:           v.Name,
+			Email:          v.Email,
+			Groups:         v.Groups,
+			PublicKeys:     v.PublicKeys,
+			LastLogin:      v.LastLogin,
+			LastDischarge:  v.LastDischarge,
+			ProviderInfo:   v.ProviderInfo,
+			ExtraInfo:      v.ExtraInfo,
+			Owner:          store.ProviderIdentity(v.Owner),
+			Disabled:       v.Disabled,
+			DisabledReason: v.DisabledReason,
+			Expires:        v.Expires,
+
+			LinkedProviderIDs: linked,
+		}
+		return errgo.Mask(b.BackupStore().InsertIdentity(ctx, &id, identityUpdate(&id)), errgo.Is(store.ErrInvalidID))
+	case *acl:
+		if err := b.ACLStore().CreateACL(ctx, v.Name, v.Members); err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(b.ACLStore().Set(ctx, v.Name, v.Members))
+	case *group:
+		return errgo.Mask(b.GroupStore().SetGroup(ctx, &store.Group{
+			Name:        v.Name,
+			Description: v.Description,
+			Owners:      v.Owners,
+			Subgroups:   v.Subgroups,
+		}))
+	case *rootKey:
+		return errgo.Mask(b.RootKeyStore().InsertRootKey(ctx, store.RootKey{
+			ID:      v.ID,
+			RootKey: v.RootKey,
+			Created: v.Created,
+			Expires: v.Expires,
+		}))
+	case *keyValue:
+		kv, err := b.ProviderDataStore().KeyValueStore(ctx, v.IDP)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(kv.Set(ctx, v.Key, v.Value, v.Expire))
+	case *meeting:
+		return errgo.Mask(b.BackupStore().InsertMeeting(ctx, store.Meeting{
+			ID:      v.ID,
+			Address: v.Address,
+			Created: v.Created,
+		}))
+	case *auditEntry:
+		return errgo.Mask(b.AuditStore().AddAuditEntry(ctx, &store.AuditEntry{
+			Time:      v.Time,
+			Actor:     v.Actor,
+			Operation: v.Operation,
+			Target:    v.Target,
+			Before:    v.Before,
+			After:     v.After,
+			RequestID: v.RequestID,
+		}))
+	}
+	panic("unreachable")
+}
+
+// decodeRecord decodes the data of a record of the given type.
+func decodeRecord(typ string, data json.RawMessage) (interface{}, error) {
+	var v interface{}
+	switch typ {
+	case typeIdentity:
+		v = new(identity)
+	case typeACL:
+		v = new(acl)
+	case typeGroup:
+		v = new(group)
+	case typeRootKey:
+		v = new(rootKey)
+	case typeKeyValue:
+		v = new(keyValue)
+	case typeMeeting:
+		v = new(meeting)
+	case typeAudit:
+		v = new(auditEntry)
+	default:
+		return nil, errgo.Newf("unknown record type %q", typ)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal %s", typ)
+	}
+	return v, nil
+}
+
+// A checker checks that the records in an archive are consistent with
+// each other.
+type checker struct {
+	ids         map[string]bool
+	providerIDs map[string]bool
+	usernames   map[string]bool
+	acls        map[string]bool
+	groups      map[string]bool
+	rootKeys    map[string]bool
+	keyValues   map[[2]string]bool
+	meetings    map[string]bool
+}
+
+func newChecker() *checker {
+	return &checker{
+		ids:         make(map[string]bool),
+		providerIDs: make(map[string]bool),
+		usernames:   make(map[string]bool),
+		acls:        make(map[string]bool),
+		groups:      make(map[string]bool),
+		rootKeys:    make(map[string]bool),
+		keyValues:   make(map[[2]string]bool),
+		meetings:    make(map[string]bool),
+	}
+}
+
+func (c *checker) check(v interface{}) error {
+	switch v := v.(type) {
+	case *identity:
+		if v.ID == "" || v.ProviderID == "" || v.Username == "" {
+			return errgo.Newf("identity has no ID, provider ID or username")
+		}
+		if c.ids[v.ID] {
+			return errgo.Newf("duplicate identity ID %q", v.ID)
+		}
+		if c.providerIDs[v.ProviderID] {
+			return errgo.Newf("duplicate identity %q", v.ProviderID)
+		}
+		if c.usernames[v.Username] {
+			return errgo.Newf("duplicate username %q", v.Username)
+		}
+		c.ids[v.ID] = true
+		c.providerIDs[v.ProviderID] = true
+		c.usernames[v.Username] = true
+	case *acl:
+		if v.Name == "" {
+			return errgo.Newf("ACL has no name")
+		}
+		if c.acls[v.Name] {
+			return errgo.Newf("duplicate ACL %q", v.Name)
+		}
+		c.acls[v.Name] = true
+	case *group:
+		if v.Name == "" {
+			return errgo.Newf("group has no name")
+		}
+		if c.groups[v.Name] {
+			return errgo.Newf("duplicate group %q", v.Name)
+		}
+		c.groups[v.Name] = true
+	case *rootKey:
+		if len(v.ID) == 0 || len(v.RootKey) == 0 {
+			return errgo.Newf("root key has no ID or key")
+		}
+		if c.rootKeys[string(v.ID)] {
+			return errgo.Newf("duplicate root key %q", v.ID)
+		}
+		c.rootKeys[string(v.ID)] = true
+	case *keyValue:
+		if v.IDP == "" || v.Key == "" {
+			return errgo.Newf("key-value record has no identity provider or key")
+		}
+		k := [2]string{v.IDP, v.Key}
+		if c.keyValues[k] {
+			return errgo.Newf("duplicate key %q for identity provider %q", v.Key, v.IDP)
+		}
+		c.keyValues[k] = true
+	case *meeting:
+		if v.ID == "" {
+			return errgo.Newf("meeting has no ID")
+		}
+		if c.meetings[v.ID] {
+			return errgo.Newf("duplicate meeting %q", v.ID)
+		}
+		c.meetings[v.ID] = true
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// timePrecision holds the precision to which times are compared by
+// Verify. Not all backends store times with full precision.
+const timePrecision = time.Millisecond
+
+// Verify compares the archive read from the given reader with the
+// contents of the given backend. It returns a description of each
+// difference found, if the backend holds exactly the data in the archive
+// then no differences are returned. Root keys and key-value store values
+// in the archive that have expired since the archive was created are
+// ignored.
+func Verify(ctx context.Context, b store.Backend, r io.Reader) ([]string, error) {
+	ar, err := newArchiveReader(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	archived := make(contents)
+	for {
+		typ, data, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		v, err := decodeRecord(typ, data)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid archive: line %d", ar.line)
+		}
+		switch v := v.(type) {
+		case *rootKey:
+			if !v.Expires.After(now) {
+				continue
+			}
+		case *keyValue:
+			if !v.Expire.IsZero() && !v.Expire.After(now) {
+				continue
+			}
+		}
+		if err := archived.add(v); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	stored, err := readContents(ctx, b)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var diffs []string
+	for k, v := range archived {
+		sv, ok := stored[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s not found in storage", k))
+		case sv != v:
+			diffs = append(diffs, fmt.Sprintf("%s differs", k))
+		}
+	}
+	for k := range stored {
+		if _, ok := archived[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s not found in archive", k))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// readContents reads the contents of the given backend.
+func readContents(ctx context.Context, b store.Backend) (contents, error) {
+	c := make(contents)
+	if err := walk(ctx, b, func(_ string, v interface{}) error {
+		return c.add(v)
+	}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c, nil
+}
+
+// contents holds the normalized JSON encoding of each record in an
+// archive, keyed by a description of the record.
+type contents map[string]string
+
+func (c contents) add(v interface{}) error {
+	var key string
+	switch v := v.(type) {
+	case *identity:
+		key = fmt.Sprintf("identity %q", v.ProviderID)
+		// The ID is compared separately so that a restore that has
+		// allocated new IDs is reported as such.
+		c[key+" ID"] = v.ID
+		v.ID = ""
+		v.LastLogin = normalizeTime(v.LastLogin)
+		v.LastDischarge = normalizeTime(v.LastDischarge)
+		v.Disabled = normalizeTime(v.Disabled)
+		v.Expires = normalizeTime(v.Expires)
+	case *acl:
+		key = fmt.Sprintf("ACL %q", v.Name)
+		if len(v.Members) == 0 {
+			v.Members = nil
+		}
+	case *group:
+		key = fmt.Sprintf("group %q", v.Name)
+	case *rootKey:
+		key = fmt.Sprintf("root key %q", v.ID)
+		v.Created = normalizeTime(v.Created)
+		v.Expires = normalizeTime(v.Expires)
+	case *keyValue:
+		key = fmt.Sprintf("identity provider %q key %q", v.IDP, v.Key)
+		if len(v.Value) == 0 {
+			v.Value = nil
+		}
+		v.Expire = normalizeTime(v.Expire)
+	case *meeting:
+		key = fmt.Sprintf("meeting %q", v.ID)
+		v.Created = normalizeTime(v.Created)
+	case *auditEntry:
+		v.Time = normalizeTime(v.Time)
+		key = fmt.Sprintf("audit entry %s %s %q", v.Time.Format(time.RFC3339Nano), v.Operation, v.Target)
+		for i := 2; c[key] != ""; i++ {
+			key = fmt.Sprintf("audit entry %s %s %q (%d)", v.Time.Format(time.RFC3339Nano), v.Operation, v.Target, i)
+		}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c[key] = string(data)
+	return nil
+}
+
+func normalizeTime(t time.Time) time.Time {
+	return t.UTC().Truncate(timePrecision)
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package keys manages the key pairs that the candid server uses to
+// decrypt third-party caveats, when they are held in the storage
+// backend.
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// kvStoreName holds the name of the key-value store that holds
+	// the key pairs.
+	kvStoreName = "_third_party_keys"
+
+	// kvKey holds the key of the entry that holds the key pairs.
+	kvKey = "keys"
+)
+
+// Load returns the key pairs held in the given store. The first key is
+// the active key, which should be advertised to clients, the remainder
+// may only be used to decrypt third-party caveats. If there are no keys
+// in the store, Load returns an empty slice.
+func Load(ctx context.Context, s store.ProviderDataStore) ([]*bakery.KeyPair, error) {
+	kv, err := kvStore(ctx, s)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ctx, close := kv.Context(ctx)
+	defer close()
+	data, err := kv.Get(ctx, kvKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	keys, err := unmarshalKeys(data)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// Ensure returns the active key pair held in the given store,
+// generating and storing one if there are no keys in the store.
+func Ensure(ctx context.Context, s store.ProviderDataStore) (*bakery.KeyPair, error) {
+	var active *bakery.KeyPair
+	err := update(ctx, s, func(keys []*bakery.KeyPair) ([]*bakery.KeyPair, error) {
+		if len(keys) > 0 {
+			active = keys[0]
+			return keys, nil
+		}
+		key, err := bakery.GenerateKey()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		active = key
+		return []*bakery.KeyPair{key}, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return active, nil
+}
+
+// Rotate generates a new key pair and adds it to the given store as the
+// active key. All keys that were previously in the store are retained
+// so that they can still be used to decrypt third-party caveats.
+func Rotate(ctx context.Context, s store.ProviderDataStore) (*bakery.KeyPair, error) {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = update(ctx, s, func(keys []*bakery.KeyPair) ([]*bakery.KeyPair, error) {
+		return append([]*bakery.KeyPair{key}, keys...), nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// Prune removes all the keys apart from the active key from the given
+// store. It returns the number of keys removed.
+func Prune(ctx context.Context, s store.ProviderDataStore) (int, error) {
+	n := 0
+	err := update(ctx, s, func(keys []*bakery.KeyPair) ([]*bakery.KeyPair, error) {
+		if len(keys) < 2 {
+			return keys, nil
+		}
+		n = len(keys) - 1
+		return keys[:1], nil
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+// update atomically updates the key pairs held in the given store with
+// the result of calling f with the current key pairs.
+func update(ctx context.Context, s store.ProviderDataStore, f func([]*bakery.KeyPair) ([]*bakery.KeyPair, error)) error {
+	kv, err := kvStore(ctx, s)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ctx, close := kv.Context(ctx)
+	defer close()
+	err = kv.Update(ctx, kvKey, time.Time{}, func(old []byte) ([]byte, error) {
+		var keys []*bakery.KeyPair
+		if old != nil {
+			var err error
+			if keys, err = unmarshalKeys(old); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		keys, err := f(keys)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return json.Marshal(keys)
+	})
+	return errgo.Mask(err)
+}
+
+func kvStore(ctx context.Context, s store.ProviderDataStore) (simplekv.Store, error) {
+	kv, err := s.KeyValueStore(ctx, kvStoreName)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open key store")
+	}
+	return kv, nil
+}
+
+func unmarshalKeys(data []byte) ([]*bakery.KeyPair, error) {
+	var keys []*bakery.KeyPair
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keys_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/cmd/candidsrv/internal/keys"
+	"github.com/canonical/candid/store/memstore"
+)
+
+func TestLoadEmpty(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	ks, err := keys.Load(ctx, memstore.NewProviderDataStore())
+	c.Assert(err, qt.IsNil)
+	c.Assert(ks, qt.HasLen, 0)
+}
+
+func TestEnsure(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := memstore.NewProviderDataStore()
+
+	key, err := keys.Ensure(ctx, s)
+	c.Assert(err, qt.IsNil)
+	ks, err := keys.Load(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ks, qt.DeepEquals, []*bakery.KeyPair{key})
+
+	// Ensuring again returns the existing key.
+	key1, err := keys.Ensure(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.DeepEquals, key)
+}
+
+func TestRotate(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := memstore.NewProviderDataStore()
+
+	key1, err := keys.Rotate(ctx, s)
+	c.Assert(err, qt.IsNil)
+	key2, err := keys.Rotate(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key2.Public, qt.Not(qt.Equals), key1.Public)
+
+	ks, err := keys.Load(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ks, qt.DeepEquals, []*bakery.KeyPair{key2, key1})
+
+	active, err := keys.Ensure(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(active, qt.DeepEquals, key2)
+}
+
+func TestPrune(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := memstore.NewProviderDataStore()
+
+	n, err := keys.Prune(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	_, err = keys.Rotate(ctx, s)
+	c.Assert(err, qt.IsNil)
+	_, err = keys.Rotate(ctx, s)
+	c.Assert(err, qt.IsNil)
+	key, err := keys.Rotate(ctx, s)
+	c.Assert(err, qt.IsNil)
+
+	n, err = keys.Prune(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	ks, err := keys.Load(ctx, s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ks, qt.DeepEquals, []*bakery.KeyPair{key})
+}
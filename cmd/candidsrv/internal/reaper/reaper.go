@@ -0,0 +1,202 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package reaper finds agent identities whose expiry time has passed
+// and either disables or removes them. It also removes old changes
+// from the identity change log.
+package reaper
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candidsrv.reaper")
+
+// An Action determines what is done to an expired agent.
+type Action string
+
+const (
+	// Disable disables expired agents, so that they are retained
+	// but can no longer be used.
+	Disable Action = "disable"
+
+	// Remove removes expired agents from the store. Expired agents
+	// that own other identities are disabled instead.
+	Remove Action = "remove"
+)
+
+// DefaultInterval holds the interval between checks for expired agents
+// used when none is specified.
+const DefaultInterval = time.Hour
+
+// DefaultChangeRetention holds the length of time for which changes
+// are kept in the identity change log when none is specified.
+const DefaultChangeRetention = 30 * 24 * time.Hour
+
+// expiredReason holds the reason recorded when an expired agent is
+// disabled.
+const expiredReason = "expired"
+
+// Params holds the parameters for a reaper.
+type Params struct {
+	// Store holds the store containing the agents.
+	Store store.Store
+
+	// AuditStore optionally holds a store in which to record the
+	// changes made to expired agents.
+	AuditStore store.AuditStore
+
+	// Action holds what is done to expired agents. If this is
+	// empty then Disable is used.
+	Action Action
+
+	// Interval holds the interval between checks for expired
+	// agents. If this is zero then DefaultInterval is used.
+	Interval time.Duration
+
+	// ChangeRetention holds the length of time for which changes
+	// are kept in the identity change log. If this is zero then
+	// DefaultChangeRetention is used.
+	ChangeRetention time.Duration
+}
+
+// Reap disables or removes, according to the given parameters, all
+// agents that expired at or before the given time. It returns the
+// number of agents that were changed. An expired agent that owns other
+// identities is disabled rather than removed, so that the identities it
+// owns are not orphaned; it is removed by a later call once they have
+// gone.
+func Reap(ctx context.Context, p Params, now time.Time) (int, error) {
+	identities, err := p.Store.FindIdentities(
+		ctx,
+		&store.Identity{Expires: now},
+		store.Filter{store.Expires: store.LessThanOrEqual},
+		nil,
+		0, 0,
+	)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot find expired agents")
+	}
+	n := 0
+	for i := range identities {
+		id := &identities[i]
+		if id.ProviderID.Provider() != "idm" {
+			// Only agents are expected to expire.
+			continue
+		}
+		action := p.Action
+		if action == Remove {
+			owner, err := store.OwnsIdentities(ctx, p.Store, id)
+			if err != nil {
+				return n, errgo.Mask(err)
+			}
+			if owner {
+				// Removing the agent would leave the
+				// identities it owns without an owner, so it
+				// is only disabled until they have gone.
+				if id.Disabled.IsZero() {
+					logger.Warningf("not removing expired agent %s as it owns other identities, disabling it instead", id.Username)
+				}
+				action = Disable
+			}
+		}
+		var op string
+		var before, after []string
+		switch action {
+		case Remove:
+			err = p.Store.RemoveIdentity(ctx, &store.Identity{ID: id.ID})
+			op, before = "remove-user", id.Groups
+		case Disable, "":
+			if !id.Disabled.IsZero() {
+				continue
+			}
+			err = p.Store.UpdateIdentity(ctx, &store.Identity{
+				ID:             id.ID,
+				Disabled:       now,
+				DisabledReason: expiredReason,
+			}, store.Update{
+				store.Disabled:       store.Set,
+				store.DisabledReason: store.Set,
+			})
+			op, after = "disable-user", []string{expiredReason}
+		default:
+			return n, errgo.Newf("unknown action %q", p.Action)
+		}
+		if errgo.Cause(err) == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return n, errgo.Notef(err, "cannot update agent %s", id.Username)
+		}
+		n++
+		audit(ctx, p.AuditStore, op, id.Username, before, after)
+	}
+	return n, nil
+}
+
+// RemoveChanges removes the changes made before the retention period
+// in the given parameters, counting back from the given time, from the
+// identity change log. It returns the number of changes removed.
+func RemoveChanges(ctx context.Context, p Params, now time.Time) (int, error) {
+	retention := p.ChangeRetention
+	if retention == 0 {
+		retention = DefaultChangeRetention
+	}
+	n, err := p.Store.RemoveChanges(ctx, now.Add(-retention))
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove old changes")
+	}
+	return n, nil
+}
+
+// Run calls Reap and RemoveChanges with the given parameters at every
+// interval, logging the result, until the given context is done. It is
+// intended to be run in its own goroutine when a server starts.
+func Run(ctx context.Context, p Params) {
+	interval := p.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	for {
+		n, err := Reap(ctx, p, time.Now())
+		if err != nil {
+			logger.Errorf("cannot reap expired agents (%d reaped): %s", n, err)
+		} else if n > 0 {
+			logger.Infof("reaped %d expired agents", n)
+		}
+		n, err = RemoveChanges(ctx, p, time.Now())
+		if err != nil {
+			logger.Errorf("%s", err)
+		} else if n > 0 {
+			logger.Infof("removed %d old changes", n)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// audit records a change made to an expired agent in the given audit
+// store, if there is one.
+func audit(ctx context.Context, st store.AuditStore, op, target string, before, after []string) {
+	if st == nil {
+		return
+	}
+	err := st.AddAuditEntry(ctx, &store.AuditEntry{
+		Operation: op,
+		Target:    target,
+		Before:    before,
+		After:     after,
+	})
+	if err != nil {
+		logger.Errorf("cannot record %s of %s in audit log: %s", op, target, err)
+	}
+}
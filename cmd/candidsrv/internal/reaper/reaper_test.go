@@ -0,0 +1,176 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package reaper_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/cmd/candidsrv/internal/reaper"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+var now = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestReapDisable(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	as := memstore.NewAuditStore()
+	addIdentities(c, st)
+
+	n, err := reaper.Reap(ctx, reaper.Params{
+		Store:      st,
+		AuditStore: as,
+	}, now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+
+	expired := identity(c, st, "a-expired@candid")
+	c.Assert(expired.Disabled.Equal(now), qt.IsTrue)
+	c.Assert(expired.DisabledReason, qt.Equals, "expired")
+	c.Assert(identity(c, st, "a-current@candid").Disabled.IsZero(), qt.IsTrue)
+	c.Assert(identity(c, st, "a-forever@candid").Disabled.IsZero(), qt.IsTrue)
+
+	entries, err := as.FindAuditEntries(ctx, store.AuditFilter{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Operation, qt.Equals, "disable-user")
+	c.Assert(entries[0].Target, qt.Equals, "a-expired@candid")
+
+	// Agents that have already been disabled are left alone.
+	n, err = reaper.Reap(ctx, reaper.Params{
+		Store:  st,
+		Action: reaper.Disable,
+	}, now.Add(time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+}
+
+func TestReapRemove(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	addIdentities(c, st)
+
+	n, err := reaper.Reap(ctx, reaper.Params{
+		Store:  st,
+		Action: reaper.Remove,
+	}, now.Add(48*time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	for _, username := range []string{"a-expired@candid", "a-current@candid"} {
+		err := st.Identity(ctx, &store.Identity{Username: username})
+		c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	}
+	identity(c, st, "a-forever@candid")
+}
+
+func TestReapRemoveOwner(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	addIdentities(c, st)
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "a-owned"),
+		Username:   "a-owned@candid",
+		Owner:      store.MakeProviderIdentity("idm", "a-expired"),
+	}, store.Update{
+		store.Username: store.Set,
+		store.Owner:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// An expired agent that owns another agent is disabled rather
+	// than removed.
+	n, err := reaper.Reap(ctx, reaper.Params{
+		Store:  st,
+		Action: reaper.Remove,
+	}, now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+	expired := identity(c, st, "a-expired@candid")
+	c.Assert(expired.Disabled.Equal(now), qt.IsTrue)
+	c.Assert(expired.DisabledReason, qt.Equals, "expired")
+
+	// Once the owned agent has gone, the expired agent is removed.
+	err = st.RemoveIdentity(ctx, &store.Identity{Username: "a-owned@candid"})
+	c.Assert(err, qt.IsNil)
+	n, err = reaper.Reap(ctx, reaper.Params{
+		Store:  st,
+		Action: reaper.Remove,
+	}, now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+	err = st.Identity(ctx, &store.Identity{Username: "a-expired@candid"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func TestReapUnknownAction(t *testing.T) {
+	c := qt.New(t)
+	st := memstore.NewStore()
+	addIdentities(c, st)
+
+	_, err := reaper.Reap(context.Background(), reaper.Params{
+		Store:  st,
+		Action: "ignore",
+	}, now)
+	c.Assert(err, qt.ErrorMatches, `unknown action "ignore"`)
+}
+
+func TestRemoveChanges(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	addIdentities(c, st)
+
+	n, err := reaper.RemoveChanges(ctx, reaper.Params{
+		Store: st,
+	}, time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	n, err = reaper.RemoveChanges(ctx, reaper.Params{
+		Store:           st,
+		ChangeRetention: time.Hour,
+	}, time.Now().Add(time.Hour+time.Second))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 3)
+}
+
+func addIdentities(c *qt.C, st store.Store) {
+	for _, id := range []store.Identity{{
+		ProviderID: store.MakeProviderIdentity("idm", "a-expired"),
+		Username:   "a-expired@candid",
+		Expires:    now.Add(-time.Minute),
+	}, {
+		ProviderID: store.MakeProviderIdentity("idm", "a-current"),
+		Username:   "a-current@candid",
+		Expires:    now.Add(24 * time.Hour),
+	}, {
+		ProviderID: store.MakeProviderIdentity("idm", "a-forever"),
+		Username:   "a-forever@candid",
+	}} {
+		id := id
+		update := store.Update{store.Username: store.Set}
+		if !id.Expires.IsZero() {
+			update[store.Expires] = store.Set
+		}
+		err := st.UpdateIdentity(context.Background(), &id, update)
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func identity(c *qt.C, st store.Store, username string) *store.Identity {
+	id := store.Identity{Username: username}
+	err := st.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	return &id
+}
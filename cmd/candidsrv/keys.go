@@ -0,0 +1,75 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/candid/cmd/candidsrv/internal/keys"
+	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/store/encryptedstore"
+)
+
+// rotateKeyCmd implements the rotate-key command, it returns the exit
+// code for the process.
+func rotateKeyCmd(args []string) int {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	prune := fs.Bool("prune", false, "remove all keys other than the active key instead of generating a new key")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s rotate-key [options] <config path>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	conf, err := config.Read(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration: %v\n", err)
+		return 2
+	}
+	backend, err := conf.Storage.NewBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open storage: %v\n", err)
+		return 1
+	}
+	defer backend.Close()
+	providerDataStore := backend.ProviderDataStore()
+	if len(conf.EncryptionKeys) > 0 {
+		kr, err := encryptedstore.NewKeyring(conf.EncryptionKeys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot create encryption keyring: %v\n", err)
+			return 2
+		}
+		providerDataStore = encryptedstore.NewProviderDataStore(providerDataStore, kr)
+	}
+
+	ctx := context.Background()
+	if *prune {
+		n, err := keys.Prune(ctx, providerDataStore)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot prune keys: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "removed %d keys\n", n)
+		return 0
+	}
+	if len(conf.EncryptionKeys) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: encryption-keys not configured, private key will be stored unencrypted\n")
+	}
+	key, err := keys.Rotate(ctx, providerDataStore)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot rotate key: %v\n", err)
+		return 1
+	}
+	fmt.Println(key.Public.String())
+	return 0
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"html/template"
@@ -20,19 +21,25 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/canonical/candid"
+	"github.com/canonical/candid/cmd/candidsrv/internal/keys"
+	"github.com/canonical/candid/cmd/candidsrv/internal/reaper"
 	"github.com/canonical/candid/config"
 	"github.com/canonical/candid/idp"
 	_ "github.com/canonical/candid/idp/adfs"
 	_ "github.com/canonical/candid/idp/agent"
 	_ "github.com/canonical/candid/idp/azure"
+	_ "github.com/canonical/candid/idp/github"
 	_ "github.com/canonical/candid/idp/google"
 	_ "github.com/canonical/candid/idp/keycloak"
 	_ "github.com/canonical/candid/idp/keystone"
 	_ "github.com/canonical/candid/idp/ldap"
+	_ "github.com/canonical/candid/idp/saml"
 	_ "github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/idp/usso"
 	_ "github.com/canonical/candid/idp/usso/ussodischarge"
 	_ "github.com/canonical/candid/idp/usso/ussooauth"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/encryptedstore"
 	_ "github.com/canonical/candid/store/memstore"
 	_ "github.com/canonical/candid/store/mgostore"
 	_ "github.com/canonical/candid/store/sqlstore"
@@ -40,9 +47,33 @@ import (
 
 var logger = loggo.GetLogger("candidsrv")
 
+// reEncryptRetryInterval holds the time to wait before retrying a
+// failed attempt to re-encrypt stored data with the current encryption
+// key.
+const reEncryptRetryInterval = 5 * time.Minute
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-schema":
+			exit(migrateSchema(os.Args[2:]))
+		case "backup":
+			exit(backupCmd(os.Args[2:]))
+		case "restore":
+			exit(restoreCmd(os.Args[2:]))
+		case "rotate-key":
+			exit(rotateKeyCmd(os.Args[2:]))
+		case "hash-password":
+			exit(hashPasswordCmd(os.Args[2:]))
+		}
+	}
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s migrate-schema [options] <config path>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s backup [options] <config path>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s restore [options] <config path> <archive path>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s rotate-key [options] <config path>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "       %s hash-password [options]\n", filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 		exit(2)
 	}
@@ -92,16 +123,87 @@ func serve(conf *config.Config) error {
 		return errgo.Mask(err)
 	}
 	defer backend.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	st := backend.Store()
+	providerDataStore := backend.ProviderDataStore()
+	if len(conf.EncryptionKeys) > 0 {
+		kr, err := encryptedstore.NewKeyring(conf.EncryptionKeys)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		go encryptedstore.RunReEncrypt(ctx, st, backend.BackupStore(), providerDataStore, kr, reEncryptRetryInterval)
+		st = encryptedstore.NewStore(st, kr)
+		providerDataStore = encryptedstore.NewProviderDataStore(providerDataStore, kr)
+	}
+	go reaper.Run(ctx, reaper.Params{
+		Store:           st,
+		AuditStore:      backend.AuditStore(),
+		Action:          reaper.Action(conf.ExpiredAgentAction),
+		Interval:        conf.ExpiredAgentCheckInterval.Duration,
+		ChangeRetention: conf.ChangeLogRetention.Duration,
+	})
+	key, thirdPartyKeys, err := thirdPartyKeys(conf, providerDataStore)
+	if err != nil {
+		return errgo.Mask(err)
+	}
 	return serveIdentity(conf, candid.ServerParams{
-		Store:                   backend.Store(),
-		ProviderDataStore:       backend.ProviderDataStore(),
+		Key:                     key,
+		ThirdPartyKeys:          thirdPartyKeys,
+		Store:                   st,
+		ProviderDataStore:       providerDataStore,
 		MeetingStore:            backend.MeetingStore(),
-		RootKeyStore:            backend.BakeryRootKeyStore(),
+		RootKeys:                backend.RootKeyStore(),
 		DebugStatusCheckerFuncs: backend.DebugStatusCheckerFuncs(),
 		ACLStore:                backend.ACLStore(),
+		AuditStore:              backend.AuditStore(),
+		GroupStore:              backend.GroupStore(),
 	})
 }
 
+// thirdPartyKeys determines the key pairs used to decrypt third-party
+// caveats. It returns the active key and a function that returns all the
+// keys that may be used for decryption. If there are keys held in the
+// given store then the first of them is the active key, otherwise the
+// key in the configuration is used. If neither is available a new key
+// is generated and stored.
+func thirdPartyKeys(conf *config.Config, s store.ProviderDataStore) (*bakery.KeyPair, func(context.Context) ([]*bakery.KeyPair, error), error) {
+	var confKey *bakery.KeyPair
+	if conf.PrivateKey != nil {
+		confKey = &bakery.KeyPair{
+			Private: *conf.PrivateKey,
+			Public:  *conf.PublicKey,
+		}
+	}
+	find := func(ctx context.Context) ([]*bakery.KeyPair, error) {
+		ks, err := keys.Load(ctx, s)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if confKey != nil {
+			ks = append(ks, confKey)
+		}
+		return ks, nil
+	}
+	ctx := context.Background()
+	ks, err := keys.Load(ctx, s)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot load third-party keys")
+	}
+	switch {
+	case len(ks) > 0:
+		return ks[0], find, nil
+	case confKey != nil:
+		return confKey, find, nil
+	}
+	key, err := keys.Ensure(ctx, s)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot generate third-party key")
+	}
+	logger.Infof("using generated third-party key %s", key.Public)
+	return key, find, nil
+}
+
 func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 	logger.Infof("setting up the identity server")
 	params.IdentityProviders = defaultIDPs
@@ -120,10 +222,6 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 	}
 
 	params.AdminPassword = conf.AdminPassword
-	params.Key = &bakery.KeyPair{
-		Private: *conf.PrivateKey,
-		Public:  *conf.PublicKey,
-	}
 	params.RendezvousTimeout = conf.RendezvousTimeout.Duration
 	params.Location = conf.Location
 	params.PrivateAddr = conf.PrivateAddr
@@ -134,6 +232,10 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 	params.DischargeTokenTimeout = conf.DischargeTokenTimeout.Duration
 	params.SkipLocationForCookiePaths = conf.SkipLocationForCookiePaths
 	params.EnableEmailLogin = conf.EnableEmailLogin
+	params.RootKeyPolicy = store.RootKeyPolicy{
+		GenerateInterval: conf.RootKeyGenerateInterval.Duration,
+		ExpiryDuration:   conf.RootKeyExpiry.Duration,
+	}
 	srv, err := candid.NewServer(
 		params,
 		candid.V1,
@@ -0,0 +1,66 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/store/sqlstore"
+)
+
+// schemaMigrator is implemented by storage backends that have a
+// versioned database schema.
+type schemaMigrator interface {
+	MigrateSchema(dryRun bool) ([]sqlstore.Migration, error)
+}
+
+// migrateSchema implements the migrate-schema command, it returns the
+// exit code for the process.
+func migrateSchema(args []string) int {
+	fs := flag.NewFlagSet("migrate-schema", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the SQL of any pending migrations without applying them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s migrate-schema [options] <config path>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	conf, err := config.Read(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration: %v\n", err)
+		return 2
+	}
+	m, ok := conf.Storage.BackendFactory.(schemaMigrator)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "storage backend does not have a versioned schema\n")
+		return 1
+	}
+	migrations, err := m.MigrateSchema(*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if len(migrations) == 0 {
+		fmt.Fprintf(os.Stderr, "schema is up to date\n")
+		return 0
+	}
+	for _, m := range migrations {
+		if *dryRun {
+			fmt.Printf("-- migration %d\n%s\n\n", m.Version, strings.TrimSpace(m.SQL))
+		} else {
+			fmt.Fprintf(os.Stderr, "applied migration %d\n", m.Version)
+		}
+	}
+	return 0
+}
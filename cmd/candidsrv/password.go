@@ -0,0 +1,78 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/static"
+)
+
+// hashPasswordCmd implements the hash-password command, it returns the
+// exit code for the process.
+func hashPasswordCmd(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	scheme := fs.String("scheme", static.SchemeBcrypt, fmt.Sprintf("password hashing scheme, one of %s, %s or %s", static.SchemeBcrypt, static.SchemeArgon2id, static.SchemeSHA512Crypt))
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s hash-password [options]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "\nReads a password from the terminal or standard input and prints a hash\nof it for use as a static identity provider user's password.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	password, err := readPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read password: %v\n", err)
+		return 1
+	}
+	hash, err := static.HashPassword(password, *scheme)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot hash password: %v\n", err)
+		return 2
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+// readPassword reads a password from the terminal, asking for it twice,
+// or reads the first line of standard input if it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errgo.Mask(err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirm, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if string(password) != string(confirm) {
+		return "", errgo.New("passwords do not match")
+	}
+	return string(password), nil
+}
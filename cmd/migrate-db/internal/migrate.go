@@ -44,16 +44,20 @@ type Source interface {
 func Copy(ctx context.Context, dst store.Store, src Source) error {
 	var failed bool
 	update := store.Update{
-		store.Username:      store.Set,
-		store.Name:          store.Set,
-		store.Email:         store.Set,
-		store.Groups:        store.Set,
-		store.PublicKeys:    store.Set,
-		store.LastLogin:     store.Set,
-		store.LastDischarge: store.Set,
-		store.ProviderInfo:  store.Set,
-		store.ExtraInfo:     store.Set,
-		store.Owner:         store.Set,
+		store.Username:       store.Set,
+		store.Name:           store.Set,
+		store.Email:          store.Set,
+		store.Groups:         store.Set,
+		store.PublicKeys:     store.Set,
+		store.LastLogin:      store.Set,
+		store.LastDischarge:  store.Set,
+		store.ProviderInfo:   store.Set,
+		store.ExtraInfo:      store.Set,
+		store.Owner:          store.Set,
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+
+		store.LinkedProviderIDs: store.Set,
 	}
 	for src.Next() {
 		identity := src.Identity()
@@ -73,6 +77,15 @@ func Copy(ctx context.Context, dst store.Store, src Source) error {
 		// stored in the destination. This is to make migrations
 		// on running systems safer.
 		if destIdentity.Username == "" || identity.LastLogin.After(destIdentity.LastLogin) {
+			// Only set the expiry time of identities that
+			// expire, any expiry time already in the
+			// destination is removed from those that don't.
+			update := update
+			if identity.Expires.IsZero() {
+				update[store.Expires] = store.Clear
+			} else {
+				update[store.Expires] = store.Set
+			}
 			err := dst.UpdateIdentity(ctx, identity, update)
 			if err != nil {
 				log.Printf("cannot update user %s: %s", identity.Username, err)
@@ -123,14 +123,34 @@ func (s errorStore) FindIdentities(_ context.Context, _ *store.Identity, _ store
 	return nil, s.err
 }
 
+func (s errorStore) FindIdentitiesPage(_ context.Context, _ *store.Identity, _ store.Filter, _ string, _ int) ([]store.Identity, string, error) {
+	return nil, "", s.err
+}
+
 func (s errorStore) UpdateIdentity(_ context.Context, _ *store.Identity, _ store.Update) error {
 	return s.err
 }
 
+func (s errorStore) ReplaceInfo(_ context.Context, _ string, _, _ *store.Identity) error {
+	return s.err
+}
+
+func (s errorStore) RemoveIdentity(_ context.Context, _ *store.Identity) error {
+	return s.err
+}
+
+func (s errorStore) Watch(_ context.Context, _ uint64) ([]store.IdentityChange, error) {
+	return nil, s.err
+}
+
 func (s errorStore) IdentityCounts(_ context.Context) (map[string]int, error) {
 	return nil, s.err
 }
 
+func (s errorStore) RemoveChanges(_ context.Context, _ time.Time) (int, error) {
+	return 0, s.err
+}
+
 func TestCopy(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
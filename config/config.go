@@ -18,6 +18,7 @@ import (
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/encryptedstore"
 )
 
 var logger = loggo.GetLogger("candid.config")
@@ -62,9 +63,12 @@ type Config struct {
 
 	// PublicKey and PrivateKey holds the key pair used by the Candid
 	// server for encryption and decryption of third party caveats.
-	// These must be specified.
-	// TODO generate these automatically if not specified and store
-	// them in the database.
+	// If these are not specified then the key pairs held in the
+	// storage backend are used, and one is generated if there are
+	// none. If they are specified and the storage backend also holds
+	// key pairs, then the most recent key pair in the storage
+	// backend is used as the active key and this key pair is only
+	// used to decrypt third party caveats.
 	PublicKey  *bakery.PublicKey  `yaml:"public-key"`
 	PrivateKey *bakery.PrivateKey `yaml:"private-key"`
 
@@ -116,6 +120,42 @@ type Config struct {
 	// EnableEmailLogin enables the login with email address link on the
 	// authentication required page.
 	EnableEmailLogin bool `yaml:"enable-email-login"`
+
+	// EncryptionKeys holds the keys used to encrypt identity
+	// provider data held in the store. The first key is used to
+	// encrypt new data, any other keys are only used to decrypt data
+	// written before the first key was introduced, and can be
+	// removed once it has all been re-encrypted. If this is empty
+	// then data is stored unencrypted.
+	EncryptionKeys []encryptedstore.Key `yaml:"encryption-keys"`
+
+	// RootKeyGenerateInterval holds the maximum length of time for
+	// which a macaroon root key will be used to create new
+	// macaroons before a new root key is generated. If this is zero
+	// then RootKeyExpiry is used.
+	RootKeyGenerateInterval DurationString `yaml:"root-key-generate-interval"`
+
+	// RootKeyExpiry holds the minimum length of time for which a
+	// macaroon root key remains valid after it was last used to
+	// create a macaroon. If this is zero a default of one year is
+	// used.
+	RootKeyExpiry DurationString `yaml:"root-key-expiry"`
+
+	// ExpiredAgentAction holds what is done to agents once their
+	// expiry time has passed, either "disable" or "remove". If this
+	// is empty expired agents are disabled.
+	ExpiredAgentAction string `yaml:"expired-agent-action"`
+
+	// ExpiredAgentCheckInterval holds the interval between checks
+	// for expired agents. If this is zero a default of one hour is
+	// used.
+	ExpiredAgentCheckInterval DurationString `yaml:"expired-agent-check-interval"`
+
+	// ChangeLogRetention holds the length of time for which changes
+	// made to identities are kept in the change log. Older changes
+	// are removed when expired agents are checked. If this is zero a
+	// default of 30 days is used.
+	ChangeLogRetention DurationString `yaml:"change-log-retention"`
 }
 
 // TLSConfig returns a TLS configuration to be used for serving
@@ -146,12 +186,6 @@ func (c *Config) validate() error {
 	if c.ListenAddress == "" {
 		missing = append(missing, "listen-address")
 	}
-	if c.PrivateKey == nil {
-		missing = append(missing, "private-key")
-	}
-	if c.PublicKey == nil {
-		missing = append(missing, "public-key")
-	}
 	if c.Location == "" {
 		// TODO check it's a valid URL
 		missing = append(missing, "location")
@@ -162,6 +196,19 @@ func (c *Config) validate() error {
 	if len(missing) != 0 {
 		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
 	}
+	if (c.PrivateKey == nil) != (c.PublicKey == nil) {
+		return errgo.Newf("private-key and public-key must be specified together")
+	}
+	if len(c.EncryptionKeys) > 0 {
+		if _, err := encryptedstore.NewKeyring(c.EncryptionKeys); err != nil {
+			return errgo.Notef(err, "invalid encryption-keys")
+		}
+	}
+	switch c.ExpiredAgentAction {
+	case "", "disable", "remove":
+	default:
+		return errgo.Newf("invalid expired-agent-action %q", c.ExpiredAgentAction)
+	}
 	return nil
 }
 
@@ -15,6 +15,7 @@ import (
 	"github.com/canonical/candid/config"
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/encryptedstore"
 	_ "github.com/canonical/candid/store/memstore"
 )
 
@@ -37,6 +38,11 @@ identity-providers:
    name: ks1
    url: http://example.com/keystone
 private-addr: localhost
+encryption-keys:
+ - id: "2"
+   key: Xjf7Qu8yHBL0B5VXbOqAdsN3Ok7S14nZ1mGpnBM+vjQ=
+ - id: "1"
+   key: AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=
 tls-cert: |
   -----BEGIN CERTIFICATE-----
   MIIDLDCCAhQCCQDVXrWn1thP6DANBgkqhkiG9w0BAQsFADBYMQswCQYDVQQGEwJH
@@ -95,6 +101,10 @@ api-macaroon-timeout: 2h
 discharge-macaroon-timeout: 24h
 discharge-token-timeout: 6h
 enable-email-login: true
+root-key-generate-interval: 24h
+root-key-expiry: 720h
+expired-agent-action: remove
+expired-agent-check-interval: 10m
 `
 
 func readConfig(c *qt.C, content string) (*config.Config, error) {
@@ -128,6 +138,12 @@ func TestRead(t *testing.T) {
 	err = key.Private.UnmarshalText([]byte("8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow="))
 	c.Assert(err, qt.IsNil)
 
+	var encKey1, encKey2 encryptedstore.AESKey
+	err = encKey1.UnmarshalText([]byte("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="))
+	c.Assert(err, qt.IsNil)
+	err = encKey2.UnmarshalText([]byte("Xjf7Qu8yHBL0B5VXbOqAdsN3Ok7S14nZ1mGpnBM+vjQ="))
+	c.Assert(err, qt.IsNil)
+
 	var adminPubKey bakery.PublicKey
 	err = adminPubKey.UnmarshalText([]byte("dUnC8p9p3nygtE2h92a47Ooq0rXg0fVSm3YBWou5/UQ="))
 	c.Assert(err, qt.IsNil)
@@ -175,6 +191,17 @@ func TestRead(t *testing.T) {
 		DischargeMacaroonTimeout: config.DurationString{Duration: 24 * time.Hour},
 		DischargeTokenTimeout:    config.DurationString{Duration: 6 * time.Hour},
 		EnableEmailLogin:         true,
+		EncryptionKeys: []encryptedstore.Key{{
+			ID:  "2",
+			Key: encKey2,
+		}, {
+			ID:  "1",
+			Key: encKey1,
+		}},
+		RootKeyGenerateInterval:   config.DurationString{Duration: 24 * time.Hour},
+		RootKeyExpiry:             config.DurationString{Duration: 720 * time.Hour},
+		ExpiredAgentAction:        "remove",
+		ExpiredAgentCheckInterval: config.DurationString{Duration: 10 * time.Minute},
 	})
 }
 
@@ -192,7 +219,24 @@ func TestReadErrorEmpty(t *testing.T) {
 	defer c.Done()
 
 	cfg, err := readConfig(c, "")
-	c.Assert(err, qt.ErrorMatches, "missing fields storage, listen-address, private-key, public-key, location, private-addr in config file")
+	c.Assert(err, qt.ErrorMatches, "missing fields storage, listen-address, location, private-addr in config file")
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorPublicKeyWithoutPrivateKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+`)
+	c.Assert(err, qt.ErrorMatches, `private-key and public-key must be specified together`)
 	c.Assert(cfg, qt.IsNil)
 }
 
@@ -205,6 +249,46 @@ func TestReadErrorInvalidYAML(t *testing.T) {
 	c.Assert(cfg, qt.IsNil)
 }
 
+func TestReadErrorDuplicateEncryptionKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+private-key: 8PjzjakvIlh3BVFKe8axinRDutF6EDIfjtuf4+JaNow=
+public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+encryption-keys:
+ - id: "1"
+   key: Xjf7Qu8yHBL0B5VXbOqAdsN3Ok7S14nZ1mGpnBM+vjQ=
+ - id: "1"
+   key: AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid encryption-keys: duplicate encryption key id "1"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadErrorInvalidExpiredAgentAction(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	store.Register("test", testStorageBackend)
+	cfg, err := readConfig(c, `
+listen-address: 1.2.3.4:5678
+location: http://foo.com:1234
+private-addr: localhost
+storage:
+  type: test
+expired-agent-action: ignore
+`)
+	c.Assert(err, qt.ErrorMatches, `invalid expired-agent-action "ignore"`)
+	c.Assert(cfg, qt.IsNil)
+}
+
 func TestUnrecognisedIDP(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
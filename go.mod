@@ -2,6 +2,7 @@ module github.com/canonical/candid
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/beevik/etree v1.1.0
 	github.com/coreos/go-oidc v0.0.0-20170119174436-2cc7913f9f6f
 	github.com/frankban/quicktest v1.11.3
 	github.com/garyburd/go-oauth v0.0.0-20150329160146-3131beb69b81
@@ -31,9 +32,12 @@ require (
 	github.com/lunixbochs/vtclean v0.0.0-20180621232353-2d01aacdc34a // indirect
 	github.com/mattn/go-colorable v0.0.9 // indirect
 	github.com/mattn/go-isatty v0.0.4 // indirect
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/mhilton/openid v0.0.0-20150511103207-7922a4e937d8
 	github.com/pquerna/cachecontrol v0.0.0-20160421231612-c97913dcbd76 // indirect
 	github.com/prometheus/client_golang v1.5.1
+	github.com/russellhaering/goxmldsig v1.4.0
+	github.com/stretchr/testify v1.9.0 // indirect
 	github.com/yohcop/openid-go v1.0.0
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974
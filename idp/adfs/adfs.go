@@ -6,6 +6,8 @@
 package adfs
 
 import (
+	"time"
+
 	oidc "github.com/coreos/go-oidc"
 	"gopkg.in/errgo.v1"
 
@@ -67,6 +69,21 @@ type Params struct {
 	// MatchEmailAddr is a regular expression that is used to determine if
 	// this identity provider can be used for a particular user email.
 	MatchEmailAddr string `yaml:"match-email-addr"`
+
+	// GroupClaims contains the claims that hold the groups of a
+	// user.
+	GroupClaims []openid.GroupClaim `yaml:"group-claims"`
+
+	// RefreshInterval is how often the user's tokens are refreshed
+	// to check that they may still log in.
+	RefreshInterval time.Duration `yaml:"refresh-interval"`
+
+	// DisablePKCE disables the use of PKCE in the authorization
+	// code flow.
+	DisablePKCE bool `yaml:"disable-pkce"`
+
+	// DisableNonce disables the ID token nonce check.
+	DisableNonce bool `yaml:"disable-nonce"`
 }
 
 // NewIdentityProvider creates an ADFS identity provider with the
@@ -79,15 +96,19 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 		p.Domain = p.Name
 	}
 	return openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
-		Name:           p.Name,
-		Issuer:         p.URL,
-		Domain:         p.Domain,
-		Description:    p.Description,
-		Icon:           p.Icon,
-		Scopes:         []string{oidc.ScopeOpenID, "email", "profile"},
-		ClientID:       p.ClientID,
-		ClientSecret:   p.ClientSecret,
-		Hidden:         p.Hidden,
-		MatchEmailAddr: p.MatchEmailAddr,
+		Name:            p.Name,
+		Issuer:          p.URL,
+		Domain:          p.Domain,
+		Description:     p.Description,
+		Icon:            p.Icon,
+		Scopes:          []string{oidc.ScopeOpenID, "email", "profile"},
+		ClientID:        p.ClientID,
+		ClientSecret:    p.ClientSecret,
+		Hidden:          p.Hidden,
+		MatchEmailAddr:  p.MatchEmailAddr,
+		GroupClaims:     p.GroupClaims,
+		RefreshInterval: p.RefreshInterval,
+		DisablePKCE:     p.DisablePKCE,
+		DisableNonce:    p.DisableNonce,
 	})
 }
@@ -0,0 +1,16 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package github
+
+import (
+	"context"
+
+	"github.com/canonical/candid/idp"
+)
+
+// RefreshAll runs a background group refresh for the given identity
+// provider.
+func RefreshAll(ctx context.Context, i idp.IdentityProvider) error {
+	return i.(*identityProvider).refreshAll(ctx)
+}
@@ -0,0 +1,746 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package github is an identity provider that authenticates users with
+// GitHub using OAuth2. The organisations and teams that a user is a
+// member of are used as their groups.
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"golang.org/x/oauth2"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/names.v2"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.idp.github")
+
+const (
+	defaultName                 = "github"
+	defaultGitHubURL            = "https://github.com"
+	defaultAPIURL               = "https://api.github.com"
+	defaultGroupRefreshInterval = time.Hour
+)
+
+const (
+	// minRefreshCheckInterval is the minimum time between background
+	// group refreshes, so that short refresh intervals do not cause
+	// the refresh to run continuously.
+	minRefreshCheckInterval = time.Minute
+
+	// refreshPageSize is the number of identities that are fetched
+	// from the store at a time during a background group refresh.
+	refreshPageSize = 100
+)
+
+func init() {
+	idp.Register("github", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal github parameters")
+		}
+		if p.ClientID == "" {
+			return nil, errgo.Newf("client-id not specified")
+		}
+		if p.ClientSecret == "" {
+			return nil, errgo.Newf("client-secret not specified")
+		}
+		if p.GroupRefreshInterval < 0 {
+			return nil, errgo.Newf("invalid group-refresh-interval %v", p.GroupRefreshInterval)
+		}
+		return NewIdentityProvider(p), nil
+	})
+}
+
+// Params holds the parameters for a GitHub identity provider.
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	// If this is not set then "github" will be used.
+	Name string `yaml:"name"`
+
+	// Description is the description that will be used with the
+	// identity provider. If this is not set then "GitHub" will be
+	// used.
+	Description string `yaml:"description"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @
+	// separator). If this is not set then "github" will be used.
+	Domain string `yaml:"domain"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden"`
+
+	// MatchEmailAddr is a regular expression that is used to determine if
+	// this identity provider can be used for a particular user email.
+	MatchEmailAddr string `yaml:"match-email-addr"`
+
+	// ClientID is the client ID of the GitHub OAuth application.
+	ClientID string `yaml:"client-id"`
+
+	// ClientSecret is the client secret of the GitHub OAuth
+	// application.
+	ClientSecret string `yaml:"client-secret"`
+
+	// AllowedOrgs contains the organisations whose memberships are
+	// reported as groups. If this is empty then all the
+	// organisations the user is a member of are reported.
+	AllowedOrgs []string `yaml:"allowed-orgs"`
+
+	// GroupRefreshInterval is the maximum age of the cached groups
+	// of a user. The groups of all users are fetched again from
+	// GitHub at this interval, groups that are older than this when
+	// they are needed are also fetched again. The default is one
+	// hour.
+	GroupRefreshInterval time.Duration `yaml:"group-refresh-interval"`
+
+	// GitHubURL is the URL of the GitHub server, used for the OAuth2
+	// endpoints. The default is https://github.com. This is
+	// usually only changed for GitHub Enterprise servers.
+	GitHubURL string `yaml:"github-url"`
+
+	// APIURL is the URL of the GitHub API. The default is
+	// https://api.github.com.
+	APIURL string `yaml:"api-url"`
+}
+
+// NewIdentityProvider creates a new GitHub identity provider.
+func NewIdentityProvider(p Params) idp.IdentityProvider {
+	if p.Name == "" {
+		p.Name = defaultName
+	}
+	if p.Description == "" {
+		p.Description = "GitHub"
+	}
+	if p.Domain == "" {
+		p.Domain = defaultName
+	}
+	if p.GroupRefreshInterval == 0 {
+		p.GroupRefreshInterval = defaultGroupRefreshInterval
+	}
+	if p.GitHubURL == "" {
+		p.GitHubURL = defaultGitHubURL
+	}
+	if p.APIURL == "" {
+		p.APIURL = defaultAPIURL
+	}
+	p.GitHubURL = strings.TrimSuffix(p.GitHubURL, "/")
+	p.APIURL = strings.TrimSuffix(p.APIURL, "/")
+
+	var matchEmailAddr *regexp.Regexp
+	if p.MatchEmailAddr != "" {
+		var err error
+		matchEmailAddr, err = regexp.Compile(p.MatchEmailAddr)
+		if err != nil {
+			// if the email address matcher doesn't compile log the error but
+			// carry on. A regular expression that doesn't compile also doesn't
+			// match anything.
+			logger.Errorf("cannot compile match-email-addr regular expression: %s", err)
+		}
+	}
+	allowedOrgs := make(map[string]bool)
+	for _, org := range p.AllowedOrgs {
+		allowedOrgs[strings.ToLower(org)] = true
+	}
+	return &identityProvider{
+		params:         p,
+		matchEmailAddr: matchEmailAddr,
+		allowedOrgs:    allowedOrgs,
+	}
+}
+
+type identityProvider struct {
+	params         Params
+	initParams     idp.InitParams
+	config         *oauth2.Config
+	matchEmailAddr *regexp.Regexp
+	allowedOrgs    map[string]bool
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL implements idp.IdentityProvider.IconURL.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// IsForEmailAddr returns true when the identity provider should be used
+// to identify a user with the given email address.
+func (idp *identityProvider) IsForEmailAddr(addr string) bool {
+	if idp.matchEmailAddr == nil {
+		return false
+	}
+	return idp.matchEmailAddr.MatchString(addr)
+}
+
+// Init implements idp.IdentityProvider.Init. The groups of the
+// provider's users are refreshed in the background until the given
+// context is done.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	idp.config = &oauth2.Config{
+		ClientID:     idp.params.ClientID,
+		ClientSecret: idp.params.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   idp.params.GitHubURL + "/login/oauth/authorize",
+			TokenURL:  idp.params.GitHubURL + "/login/oauth/access_token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		RedirectURL: idp.initParams.URLPrefix + "/callback",
+		Scopes:      []string{"read:user", "user:email", "read:org"},
+	}
+	go idp.runRefresh(ctx)
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (*identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups. The groups are
+// the organisations and teams (in the form "org/team") that the user
+// is a member of. Groups are cached and are refreshed from GitHub in
+// the background, they are also refreshed here if the cached groups are
+// older than the configured refresh interval. If the groups cannot be
+// refreshed then the cached groups are returned, unless GitHub no
+// longer accepts the user's token in which case the user has no groups
+// until they next log in.
+func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
+	rec, err := idp.getRecord(ctx, identity.ProviderID)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !idp.needsRefresh(rec) {
+		return rec.Groups, nil
+	}
+	return idp.refreshGroups(ctx, identity.ProviderID, rec), nil
+}
+
+// needsRefresh reports whether the groups in the given record should be
+// fetched from GitHub again.
+func (idp *identityProvider) needsRefresh(rec *userRecord) bool {
+	return rec.Token != nil && time.Since(rec.Updated) >= idp.params.GroupRefreshInterval
+}
+
+// refreshGroups fetches the groups of the given user from GitHub and
+// stores them in the user's record. It returns the user's groups, which
+// are the cached groups if they cannot be fetched.
+func (idp *identityProvider) refreshGroups(ctx context.Context, pid store.ProviderIdentity, rec *userRecord) []string {
+	groups, err := idp.newClient(ctx, rec.Token).groups(ctx)
+	switch {
+	case err == nil:
+		rec.Groups = idp.filterGroups(groups)
+	case errgo.Cause(err) == errUnauthorized:
+		logger.Infof("cannot refresh groups for %s: %s", pid, err)
+		rec.Token = nil
+		rec.Groups = nil
+	default:
+		logger.Errorf("cannot refresh groups for %s: %s", pid, err)
+		return rec.Groups
+	}
+	rec.Updated = time.Now()
+	if err := idp.setRecord(ctx, pid, rec); err != nil {
+		logger.Errorf("cannot store groups for %s: %s", pid, err)
+	}
+	return rec.Groups
+}
+
+// runRefresh refreshes the groups of all the provider's users at every
+// refresh interval until the given context is done.
+func (idp *identityProvider) runRefresh(ctx context.Context) {
+	interval := idp.params.GroupRefreshInterval
+	if interval < minRefreshCheckInterval {
+		interval = minRefreshCheckInterval
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		sctx, close := idp.initParams.Store.Context(ctx)
+		if err := idp.refreshAll(sctx); err != nil {
+			logger.Errorf("cannot refresh groups: %s", err)
+		}
+		close()
+	}
+}
+
+// refreshAll refreshes the groups of all the provider's users whose
+// cached groups are older than the refresh interval.
+func (idp *identityProvider) refreshAll(ctx context.Context) error {
+	ref := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, ""),
+	}
+	filter := store.Filter{store.ProviderID: store.Prefix}
+	cursor := ""
+	for {
+		ids, next, err := idp.initParams.Store.FindIdentitiesPage(ctx, ref, filter, cursor, refreshPageSize)
+		if err != nil {
+			return errgo.Notef(err, "cannot find identities")
+		}
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return errgo.Mask(ctx.Err())
+			}
+			rec, err := idp.getRecord(ctx, id.ProviderID)
+			if errgo.Cause(err) == simplekv.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				logger.Errorf("cannot get record for %s: %s", id.ProviderID, err)
+				continue
+			}
+			if idp.needsRefresh(rec) {
+				idp.refreshGroups(ctx, id.ProviderID, rec)
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// filterGroups removes any groups that are not in an allowed
+// organisation.
+func (idp *identityProvider) filterGroups(groups []string) []string {
+	if len(idp.allowedOrgs) == 0 {
+		return groups
+	}
+	var filtered []string
+	for _, g := range groups {
+		org := strings.SplitN(g, "/", 2)[0]
+		if idp.allowedOrgs[strings.ToLower(org)] {
+			filtered = append(filtered, g)
+		}
+	}
+	return filtered
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var ls idputil.LoginState
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+		logger.Infof("Invalid login state: %s", err)
+		idputil.BadRequestf(w, "Login failed: invalid login state")
+		return
+	}
+	switch req.URL.Path {
+	case "/callback":
+		if err := idp.callback(ctx, w, req, ls); err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		}
+	case "/register":
+		if err := idp.register(ctx, w, req, ls); err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		}
+	default:
+		idp.login(ctx, w, req)
+	}
+}
+
+func (idp *identityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, idp.config.AuthCodeURL(idputil.State(req)), http.StatusFound)
+}
+
+func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	if e := req.Form.Get("error"); e != "" {
+		if d := req.Form.Get("error_description"); d != "" {
+			return errgo.Newf("GitHub login failed: %s", d)
+		}
+		return errgo.Newf("GitHub login failed: %s", e)
+	}
+	tok, err := idp.config.Exchange(ctx, req.Form.Get("code"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client := idp.newClient(ctx, tok)
+	gu, err := client.user(ctx)
+	if err != nil {
+		return errgo.Notef(err, "cannot get user")
+	}
+	groups, err := client.groups(ctx)
+	if err != nil {
+		return errgo.Notef(err, "cannot get groups")
+	}
+
+	user := store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, strconv.FormatInt(gu.ID, 10)),
+		Name:       gu.Name,
+		Email:      gu.Email,
+	}
+	if names.IsValidUserName(gu.Login) {
+		user.Username = joinDomain(gu.Login, idp.params.Domain)
+	}
+	// Store the groups before the user is created so that they are
+	// available as soon as the login completes.
+	err = idp.setRecord(ctx, user.ProviderID, &userRecord{
+		Token:   tok,
+		Groups:  idp.filterGroups(groups),
+		Updated: time.Now(),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	existingUser := store.Identity{
+		ProviderID: user.ProviderID,
+	}
+	err = idp.initParams.Store.Identity(ctx, &existingUser)
+	if err == nil {
+		var upd store.Update
+		// A user exists check if it needs updating.
+		if user.Name != "" && existingUser.Name != user.Name {
+			existingUser.Name = user.Name
+			upd[store.Name] = store.Set
+		}
+		if user.Email != "" && existingUser.Email != user.Email {
+			existingUser.Email = user.Email
+			upd[store.Email] = store.Set
+		}
+		if (upd != store.Update{}) {
+			err = idp.initParams.Store.UpdateIdentity(ctx, &existingUser, upd)
+		}
+		if err == nil {
+			idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &existingUser)
+			return nil
+		}
+	}
+	if errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+
+	// The user needs to be created.
+	if user.Username != "" {
+		// Attempt to create a user with the GitHub login as the
+		// username.
+		err := idp.initParams.Store.UpdateIdentity(ctx, &user, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+			store.Email:    store.Set,
+		})
+		if err == nil {
+			idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &user)
+			return nil
+		}
+		if errgo.Cause(err) != store.ErrDuplicateUsername {
+			return errgo.Mask(err)
+		}
+	}
+
+	// The user needs to register.
+	ls.ProviderID = user.ProviderID
+	state, err := idputil.SetLoginCookie(w, idp.initParams.Codec, idp.initParams.Location, idp.initParams.SkipLocationForCookiePaths, ls)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idputil.RegistrationForm(ctx, w, idputil.RegistrationParams{
+		State:    state,
+		Domain:   idp.params.Domain,
+		FullName: user.Name,
+		Email:    user.Email,
+	}, idp.initParams.Template))
+}
+
+// register completes the registration of a new user.
+func (idp *identityProvider) register(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	if ls.ProviderID == "" {
+		return errgo.Newf("registration not in progress")
+	}
+	u := &store.Identity{
+		ProviderID: ls.ProviderID,
+		Name:       req.Form.Get("fullname"),
+		Email:      req.Form.Get("email"),
+	}
+	err := idp.registerUser(ctx, req.Form.Get("username"), u)
+	if err == nil {
+		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, u)
+		return nil
+	}
+	if errgo.Cause(err) != errInvalidUser {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idputil.RegistrationForm(ctx, w, idputil.RegistrationParams{
+		State:    req.Form.Get("state"),
+		Error:    err.Error(),
+		Username: req.Form.Get("username"),
+		Domain:   idp.params.Domain,
+		FullName: req.Form.Get("fullname"),
+		Email:    req.Form.Get("email"),
+	}, idp.initParams.Template))
+}
+
+var errInvalidUser = errgo.New("invalid user")
+
+func (idp *identityProvider) registerUser(ctx context.Context, username string, u *store.Identity) error {
+	if !names.IsValidUserName(username) {
+		return errgo.WithCausef(nil, errInvalidUser, "invalid user name. The username must contain only A-Z, a-z, 0-9, '.', '-', & '+', and must start and end with a letter or number.")
+	}
+	if idputil.ReservedUsernames[username] {
+		return errgo.WithCausef(nil, errInvalidUser, "username %s is not allowed, please choose another.", username)
+	}
+	u.Username = joinDomain(username, idp.params.Domain)
+	err := idp.initParams.Store.UpdateIdentity(ctx, u, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Email:    store.Set,
+	})
+	if err == nil {
+		return nil
+	}
+	if errgo.Cause(err) != store.ErrDuplicateUsername {
+		return errgo.Mask(err)
+	}
+	return errgo.WithCausef(nil, errInvalidUser, "Username already taken, please pick a different one.")
+}
+
+// userRecord holds the information about a user that is stored in the
+// provider's key value store. User records are always stored encrypted
+// as they contain OAuth2 tokens.
+type userRecord struct {
+	// Token holds the OAuth2 token used to refresh the user's
+	// groups. It is nil if GitHub has stopped accepting the token.
+	Token *oauth2.Token `json:"token,omitempty"`
+
+	// Groups holds the user's groups, after filtering by the
+	// allowed organisations.
+	Groups []string `json:"groups"`
+
+	// Updated holds the time the groups were last fetched.
+	Updated time.Time `json:"updated"`
+}
+
+func (idp *identityProvider) getRecord(ctx context.Context, pid store.ProviderIdentity) (*userRecord, error) {
+	buf, err := idp.initParams.KeyValueStore.Get(ctx, userKey(pid))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+	}
+	var rec userRecord
+	if err := idp.initParams.Codec.Decode(string(buf), &rec); err != nil {
+		return nil, errgo.Notef(err, "cannot decode user record")
+	}
+	return &rec, nil
+}
+
+func (idp *identityProvider) setRecord(ctx context.Context, pid store.ProviderIdentity, rec *userRecord) error {
+	buf, err := idp.initParams.Codec.Encode(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idp.initParams.KeyValueStore.Set(ctx, userKey(pid), []byte(buf), time.Time{}))
+}
+
+func userKey(pid store.ProviderIdentity) string {
+	return "user-" + string(pid)
+}
+
+// joinDomain creates a new params.Username with the given name and
+// (optional) domain.
+func joinDomain(name, domain string) string {
+	if domain == "" {
+		return name
+	}
+	return fmt.Sprintf("%s@%s", name, domain)
+}
+
+var errUnauthorized = errgo.New("unauthorized")
+
+// A client is a client for the parts of the GitHub API used by the
+// identity provider.
+type client struct {
+	apiURL string
+	client *http.Client
+}
+
+func (idp *identityProvider) newClient(ctx context.Context, tok *oauth2.Token) *client {
+	return &client{
+		apiURL: idp.params.APIURL,
+		client: idp.config.Client(ctx, tok),
+	}
+}
+
+// githubUser holds the parts of a GitHub user that are used.
+type githubUser struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// user retrieves the authenticated user. If the user has no public
+// email address then their primary verified email address is used.
+func (c *client) user(ctx context.Context) (*githubUser, error) {
+	var u githubUser
+	if _, err := c.get(ctx, c.apiURL+"/user", &u); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errUnauthorized))
+	}
+	if u.Email != "" {
+		return &u, nil
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if _, err := c.get(ctx, c.apiURL+"/user/emails", &emails); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errUnauthorized))
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			u.Email = e.Email
+		}
+	}
+	return &u, nil
+}
+
+// groups retrieves the organisations and teams that the authenticated
+// user is a member of. Organisations are reported as the organisation
+// login and teams as "org/team-slug".
+func (c *client) groups(ctx context.Context) ([]string, error) {
+	var groups []string
+	url := c.apiURL + "/user/orgs"
+	for url != "" {
+		var orgs []struct {
+			Login string `json:"login"`
+		}
+		var err error
+		url, err = c.get(ctx, url, &orgs)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(errUnauthorized))
+		}
+		for _, o := range orgs {
+			groups = append(groups, o.Login)
+		}
+	}
+	url = c.apiURL + "/user/teams"
+	for url != "" {
+		var teams []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+		var err error
+		url, err = c.get(ctx, url, &teams)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(errUnauthorized))
+		}
+		for _, t := range teams {
+			groups = append(groups, t.Organization.Login+"/"+t.Slug)
+		}
+	}
+	return groups, nil
+}
+
+// get performs a GET request on the given URL and unmarshals the JSON
+// response into v. The URL of the next page of results, if there is
+// one, is returned.
+func (c *client) get(ctx context.Context, url string, v interface{}) (next string, _ error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return "", errgo.WithCausef(nil, errUnauthorized, "GET %s: %s", url, errorMessage(body))
+	default:
+		return "", errgo.Newf("GET %s: %s: %s", url, resp.Status, errorMessage(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", errgo.Notef(err, "cannot unmarshal response from %s", url)
+	}
+	return nextLink(resp.Header.Get("Link")), nil
+}
+
+// errorMessage extracts the error message from a GitHub API error
+// response body.
+func errorMessage(body []byte) string {
+	var e struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil || e.Message == "" {
+		return string(body)
+	}
+	return e.Message
+}
+
+// nextLink returns the URL with the relation type "next" in the given
+// Link header, or "" if there is none.
+func nextLink(link string) string {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		url := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(url, "<") || !strings.HasSuffix(url, ">") {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if strings.TrimSpace(p) == `rel="next"` {
+				return url[1 : len(url)-1]
+			}
+		}
+	}
+	return ""
+}
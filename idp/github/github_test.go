@@ -0,0 +1,446 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package github_test
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/github"
+	"github.com/canonical/candid/idp/github/internal/mockgithub"
+	"github.com/canonical/candid/idp/idptest"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+var configTests = []struct {
+	name        string
+	yaml        string
+	expectName  string
+	expectError string
+}{{
+	name: "Defaults",
+	yaml: `
+identity-providers:
+- type: github
+  client-id: client-id
+  client-secret: client-secret
+`[1:],
+	expectName: "github",
+}, {
+	name: "AllParameters",
+	yaml: `
+identity-providers:
+- type: github
+  name: ghe
+  domain: example
+  client-id: client-id
+  client-secret: client-secret
+  allowed-orgs: [canonical]
+  group-refresh-interval: 10m
+  github-url: https://github.example.com
+  api-url: https://github.example.com/api/v3
+`[1:],
+	expectName: "ghe",
+}, {
+	name: "NoClientID",
+	yaml: `
+identity-providers:
+- type: github
+  client-secret: client-secret
+`[1:],
+	expectError: `cannot unmarshal github configuration: client-id not specified`,
+}, {
+	name: "NoClientSecret",
+	yaml: `
+identity-providers:
+- type: github
+  client-id: client-id
+`[1:],
+	expectError: `cannot unmarshal github configuration: client-secret not specified`,
+}, {
+	name: "NegativeRefreshInterval",
+	yaml: `
+identity-providers:
+- type: github
+  client-id: client-id
+  client-secret: client-secret
+  group-refresh-interval: -1m
+`[1:],
+	expectError: `cannot unmarshal github configuration: invalid group-refresh-interval -1m0s`,
+}}
+
+func TestConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range configTests {
+		c.Run(test.name, func(c *qt.C) {
+			var conf config.Config
+			err := yaml.Unmarshal([]byte(test.yaml), &conf)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+			c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, test.expectName)
+		})
+	}
+}
+
+const idpPrefix = "https://idp.example.com"
+
+type githubSuite struct {
+	idptest *idptest.Fixture
+	srv     *mockgithub.Server
+	idp     idp.IdentityProvider
+}
+
+func TestGitHub(t *testing.T) {
+	qtsuite.Run(qt.New(t), &githubSuite{})
+}
+
+func (s *githubSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	s.srv = mockgithub.NewServer("client-id", "client-secret")
+	c.Defer(s.srv.Close)
+	s.srv.AddUser(&mockgithub.User{
+		ID:    1001,
+		Login: "alice",
+		Name:  "Alice",
+		Email: "alice@example.com",
+		Orgs: map[string][]string{
+			"canonical": {"candid", "juju"},
+			"other":     {"team"},
+		},
+	})
+	s.idp = s.newIdentityProvider(c, github.Params{})
+}
+
+func (s *githubSuite) newIdentityProvider(c *qt.C, p github.Params) idp.IdentityProvider {
+	p.ClientID = "client-id"
+	p.ClientSecret = "client-secret"
+	p.GitHubURL = s.srv.URL
+	p.APIURL = s.srv.APIURL()
+	i := github.NewIdentityProvider(p)
+	ip := s.idptest.InitParams(c, idpPrefix)
+	ip.Template = template.New("")
+	template.Must(ip.Template.New("register").Parse("{{.State}}\n{{.Error}}"))
+	// Stop the background group refresh when the test finishes.
+	ctx, cancel := context.WithCancel(s.idptest.Ctx)
+	c.Defer(cancel)
+	err := i.Init(ctx, ip)
+	c.Assert(err, qt.IsNil)
+	return i
+}
+
+func (s *githubSuite) TestName(c *qt.C) {
+	c.Assert(s.idp.Name(), qt.Equals, "github")
+}
+
+func (s *githubSuite) TestDescription(c *qt.C) {
+	c.Assert(s.idp.Description(), qt.Equals, "GitHub")
+}
+
+func (s *githubSuite) TestDomain(c *qt.C) {
+	c.Assert(s.idp.Domain(), qt.Equals, "github")
+}
+
+func (s *githubSuite) TestInteractive(c *qt.C) {
+	c.Assert(s.idp.Interactive(), qt.Equals, true)
+}
+
+func (s *githubSuite) TestURL(c *qt.C) {
+	c.Assert(s.idp.URL("1234"), qt.Equals, idpPrefix+"/login?state=1234")
+}
+
+func (s *githubSuite) TestLogin(c *qt.C) {
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("github", "1001"),
+		Username:   "alice@github",
+		Name:       "Alice",
+		Email:      "alice@example.com",
+	})
+	s.idptest.Store.AssertUser(c, id)
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{
+		"canonical",
+		"other",
+		"canonical/candid",
+		"canonical/juju",
+		"other/team",
+	})
+}
+
+func (s *githubSuite) TestLoginPrimaryEmail(c *qt.C) {
+	s.srv.AddUser(&mockgithub.User{
+		ID:           1002,
+		Login:        "bob",
+		Name:         "Bob",
+		PrimaryEmail: "bob@example.com",
+	})
+	s.srv.SetLoginUser("bob")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Email, qt.Equals, "bob@example.com")
+}
+
+func (s *githubSuite) TestLoginPaginated(c *qt.C) {
+	s.srv.PageSize = 2
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 5)
+}
+
+func (s *githubSuite) TestLoginDenied(c *qt.C) {
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.ErrorMatches, `GitHub login failed: The user has denied your application access.`)
+}
+
+func (s *githubSuite) TestLoginBadClientSecret(c *qt.C) {
+	i := github.NewIdentityProvider(github.Params{
+		ClientID:     "client-id",
+		ClientSecret: "wrong",
+		GitHubURL:    s.srv.URL,
+		APIURL:       s.srv.APIURL(),
+	})
+	err := i.Init(s.idptest.Ctx, s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.IsNil)
+	s.srv.SetLoginUser("alice")
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.ErrorMatches, `(?s)oauth2: cannot fetch token: 401 Unauthorized.*incorrect_client_credentials.*`)
+}
+
+func (s *githubSuite) TestLoginExistingUser(c *qt.C) {
+	err := s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("github", "1001"),
+		Username:   "alice-old@github",
+		Name:       "Alice Old",
+		Email:      "alice-old@example.com",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Email:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice-old@github")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("github", "1001"),
+		Username:   "alice-old@github",
+		Name:       "Alice",
+		Email:      "alice@example.com",
+	})
+}
+
+func (s *githubSuite) TestLoginRegister(c *qt.C) {
+	err := s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice@github",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errgo.Newf("unexpected response %s: %s", resp.Status, buf)
+		}
+		// The updated login state cookie is only valid in the
+		// real login path, make it available to the test server.
+		u, err := url.Parse(idpPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, cookie := range resp.Cookies() {
+			cookie.Path = ""
+			client.Jar.SetCookies(u, []*http.Cookie{cookie})
+		}
+		return client.PostForm(idpPrefix+"/register", url.Values{
+			"state":    {strings.Split(string(buf), "\n")[0]},
+			"username": {"alice2"},
+			"fullname": {"Alice"},
+			"email":    {"alice@example.com"},
+		})
+	})
+	c.Assert(err, qt.IsNil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("github", "1001"),
+		Username:   "alice2@github",
+		Name:       "Alice",
+		Email:      "alice@example.com",
+	})
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 5)
+}
+
+func (s *githubSuite) TestGetGroupsAllowedOrgs(c *qt.C) {
+	i := s.newIdentityProvider(c, github.Params{
+		AllowedOrgs: []string{"Canonical"},
+	})
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	groups, err := i.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{
+		"canonical",
+		"canonical/candid",
+		"canonical/juju",
+	})
+}
+
+func (s *githubSuite) TestGetGroupsCached(c *qt.C) {
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	s.srv.AddUser(&mockgithub.User{
+		ID:    1001,
+		Login: "alice",
+		Orgs: map[string][]string{
+			"new": nil,
+		},
+	})
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 5)
+}
+
+func (s *githubSuite) TestGetGroupsRefreshed(c *qt.C) {
+	i := s.newIdentityProvider(c, github.Params{
+		GroupRefreshInterval: time.Nanosecond,
+	})
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	s.srv.AddUser(&mockgithub.User{
+		ID:    1001,
+		Login: "alice",
+		Orgs: map[string][]string{
+			"new": {"team"},
+		},
+	})
+	groups, err := i.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"new", "new/team"})
+}
+
+func (s *githubSuite) TestGetGroupsTokenRevoked(c *qt.C) {
+	i := s.newIdentityProvider(c, github.Params{
+		GroupRefreshInterval: time.Nanosecond,
+	})
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	s.srv.RevokeTokens("alice")
+	groups, err := i.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 0)
+}
+
+func (s *githubSuite) TestGetGroupsServerUnavailable(c *qt.C) {
+	i := s.newIdentityProvider(c, github.Params{
+		GroupRefreshInterval: time.Nanosecond,
+	})
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	s.srv.Close()
+	groups, err := i.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 5)
+}
+
+func (s *githubSuite) TestRefreshAll(c *qt.C) {
+	i := s.newIdentityProvider(c, github.Params{
+		GroupRefreshInterval: time.Nanosecond,
+	})
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	s.srv.AddUser(&mockgithub.User{
+		ID:    1001,
+		Login: "alice",
+		Orgs: map[string][]string{
+			"new": {"team"},
+		},
+	})
+	err = github.RefreshAll(s.idptest.Ctx, i)
+	c.Assert(err, qt.IsNil)
+
+	// The default provider only uses the cached groups, which
+	// have been refreshed.
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"new", "new/team"})
+}
+
+func (s *githubSuite) TestRefreshAllTokenRevoked(c *qt.C) {
+	i := s.newIdentityProvider(c, github.Params{
+		GroupRefreshInterval: time.Nanosecond,
+	})
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	s.srv.RevokeTokens("alice")
+	err = github.RefreshAll(s.idptest.Ctx, i)
+	c.Assert(err, qt.IsNil)
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 0)
+}
+
+func (s *githubSuite) TestUserRecordEncrypted(c *qt.C) {
+	s.srv.SetLoginUser("alice")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", nil)
+	c.Assert(err, qt.IsNil)
+	kv := s.idptest.InitParams(c, idpPrefix).KeyValueStore
+	buf, err := kv.Get(s.idptest.Ctx, "user-"+string(id.ProviderID))
+	c.Assert(err, qt.IsNil)
+	c.Assert(json.Valid(buf), qt.IsFalse)
+	c.Assert(string(buf), qt.Not(qt.Contains), "token-alice")
+}
+
+func (s *githubSuite) TestGetGroupsUnknownUser(c *qt.C) {
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("github", "9999"),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 0)
+}
+
+func (s *githubSuite) TestInvalidState(c *qt.C) {
+	resp, err := idptest.NewClient(s.idp, s.idptest.Codec).Get("/callback?state=1234")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,344 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package mockgithub provides a mock GitHub server for use in tests.
+package mockgithub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A User is a GitHub user.
+type User struct {
+	ID    int64
+	Login string
+	Name  string
+
+	// Email holds the user's public email address.
+	Email string
+
+	// PrimaryEmail holds the user's primary email address, which is
+	// only available from the emails endpoint.
+	PrimaryEmail string
+
+	// Orgs maps the organisations the user is a member of to the
+	// slugs of the teams in that organisation the user is a member
+	// of.
+	Orgs map[string][]string
+}
+
+// Server provides a mock GitHub server for use in tests. The OAuth2
+// endpoints are served from the root of the server and the API from
+// /api.
+type Server struct {
+	*httptest.Server
+
+	// ClientID and ClientSecret hold the OAuth2 client credentials
+	// that clients must use.
+	ClientID     string
+	ClientSecret string
+
+	// PageSize holds the maximum number of items returned in each
+	// page of a list. If it is zero then lists are not paginated.
+	PageSize int
+
+	mu        sync.Mutex
+	users     map[string]*User
+	loginUser string
+	codes     map[string]string
+	tokens    map[string]string
+}
+
+// NewServer creates a new Server that accepts the given client
+// credentials.
+func NewServer(clientID, clientSecret string) *Server {
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+	s.Reset()
+	router := httprouter.New()
+	router.GET("/login/oauth/authorize", s.authorize)
+	router.POST("/login/oauth/access_token", s.accessToken)
+	router.GET("/api/user", s.user)
+	router.GET("/api/user/emails", s.emails)
+	router.GET("/api/user/orgs", s.orgs)
+	router.GET("/api/user/teams", s.teams)
+	s.Server = httptest.NewServer(router)
+	return s
+}
+
+// APIURL returns the URL of the API provided by the server.
+func (s *Server) APIURL() string {
+	return s.URL + "/api"
+}
+
+// AddUser adds the given user to the server, replacing any user with
+// the same login.
+func (s *Server) AddUser(u *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.Login] = u
+}
+
+// SetLoginUser sets the user that is logged in when an authorization
+// request is received.
+func (s *Server) SetLoginUser(login string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[login]; !ok {
+		panic("no such user: " + login)
+	}
+	s.loginUser = login
+}
+
+// RevokeTokens revokes all the access tokens issued for the given user.
+func (s *Server) RevokeTokens(login string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tok, l := range s.tokens {
+		if l == login {
+			delete(s.tokens, tok)
+		}
+	}
+}
+
+// Reset sets all of the state in the Server back to the default. This
+// should be called between tests.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[string]*User)
+	s.loginUser = ""
+	s.codes = make(map[string]string)
+	s.tokens = make(map[string]string)
+	s.PageSize = 0
+}
+
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req.ParseForm()
+	if req.Form.Get("client_id") != s.ClientID {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.Form.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := url.Values{
+		"state": {req.Form.Get("state")},
+	}
+	if s.loginUser == "" {
+		v.Set("error", "access_denied")
+		v.Set("error_description", "The user has denied your application access.")
+	} else {
+		code := fmt.Sprintf("code%d", len(s.codes)+1)
+		s.codes[code] = s.loginUser
+		v.Set("code", code)
+	}
+	u.RawQuery = v.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+func (s *Server) accessToken(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req.ParseForm()
+	clientID, clientSecret, ok := req.BasicAuth()
+	if !ok {
+		clientID, clientSecret = req.Form.Get("client_id"), req.Form.Get("client_secret")
+	}
+	if clientID != s.ClientID || clientSecret != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "incorrect_client_credentials",
+		})
+		return
+	}
+	login, ok := s.codes[req.Form.Get("code")]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "bad_verification_code",
+		})
+		return
+	}
+	delete(s.codes, req.Form.Get("code"))
+	token := fmt.Sprintf("token-%s-%d", login, len(s.tokens)+1)
+	s.tokens[token] = login
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": token,
+		"token_type":   "bearer",
+		"scope":        "read:org,read:user,user:email",
+	})
+}
+
+// authenticate returns the user authenticated by the request, or nil
+// if the request was not authenticated, in which case an error
+// response has been written.
+func (s *Server) authenticate(w http.ResponseWriter, req *http.Request) *User {
+	auth := req.Header.Get("Authorization")
+	for _, prefix := range []string{"Bearer ", "token "} {
+		if strings.HasPrefix(auth, prefix) {
+			if login, ok := s.tokens[strings.TrimPrefix(auth, prefix)]; ok {
+				return s.users[login]
+			}
+		}
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]string{
+		"message": "Bad credentials",
+	})
+	return nil
+}
+
+type userResponse struct {
+	ID    int64   `json:"id"`
+	Login string  `json:"login"`
+	Name  string  `json:"name"`
+	Email *string `json:"email"`
+}
+
+func (s *Server) user(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.authenticate(w, req)
+	if u == nil {
+		return
+	}
+	resp := userResponse{
+		ID:    u.ID,
+		Login: u.Login,
+		Name:  u.Name,
+	}
+	if u.Email != "" {
+		resp.Email = &u.Email
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type emailResponse struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func (s *Server) emails(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.authenticate(w, req)
+	if u == nil {
+		return
+	}
+	resp := []emailResponse{}
+	if u.PrimaryEmail != "" {
+		resp = append(resp, emailResponse{
+			Email:    u.PrimaryEmail,
+			Primary:  true,
+			Verified: true,
+		})
+	}
+	if u.Email != "" && u.Email != u.PrimaryEmail {
+		resp = append(resp, emailResponse{
+			Email:    u.Email,
+			Verified: true,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type orgResponse struct {
+	Login string `json:"login"`
+}
+
+func (s *Server) orgs(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.authenticate(w, req)
+	if u == nil {
+		return
+	}
+	var orgs []interface{}
+	for _, org := range sortedKeys(u.Orgs) {
+		orgs = append(orgs, orgResponse{Login: org})
+	}
+	s.writePage(w, req, orgs)
+}
+
+type teamResponse struct {
+	Slug         string      `json:"slug"`
+	Organization orgResponse `json:"organization"`
+}
+
+func (s *Server) teams(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.authenticate(w, req)
+	if u == nil {
+		return
+	}
+	var teams []interface{}
+	for _, org := range sortedKeys(u.Orgs) {
+		for _, team := range u.Orgs[org] {
+			teams = append(teams, teamResponse{
+				Slug:         team,
+				Organization: orgResponse{Login: org},
+			})
+		}
+	}
+	s.writePage(w, req, teams)
+}
+
+// writePage writes the requested page of the given list, adding a Link
+// header if there are more pages.
+func (s *Server) writePage(w http.ResponseWriter, req *http.Request, items []interface{}) {
+	if items == nil {
+		items = []interface{}{}
+	}
+	if s.PageSize > 0 {
+		page := 1
+		fmt.Sscan(req.URL.Query().Get("page"), &page)
+		start := (page - 1) * s.PageSize
+		if start > len(items) {
+			start = len(items)
+		}
+		end := start + s.PageSize
+		if end < len(items) {
+			u := *req.URL
+			u.Scheme = "http"
+			u.Host = req.Host
+			v := u.Query()
+			v.Set("page", fmt.Sprint(page+1))
+			u.RawQuery = v.Encode()
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.String()))
+		} else {
+			end = len(items)
+		}
+		items = items[start:end]
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -14,6 +14,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/canonical/candid/idp/idputil/secret"
+	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
 
@@ -45,6 +46,14 @@ type VisitCompleter interface {
 	RedirectSuccess(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, id *store.Identity)
 }
 
+// ReloginRequired is the ProviderInfo key that an identity provider sets
+// when it can no longer confirm that a user is allowed to log in, for
+// example because the user's refresh token has been revoked. The value
+// holds the reason. No further discharges are made for an identity with
+// this value set until the user has logged in interactively again, at
+// which point the identity provider removes the value.
+const ReloginRequired = "relogin-required"
+
 // InitParams are passed to the identity provider to initialise it.
 type InitParams struct {
 	// Store contains the identity store being used in the identity
@@ -55,6 +64,12 @@ type InitParams struct {
 	// store additional data that is not related to identities.
 	KeyValueStore simplekv.Store
 
+	// AuditStore holds the store used to record changes that the
+	// provider makes to identities other than during a login, for
+	// example when synchronising them with a directory. If this is
+	// nil then no audit log will be kept.
+	AuditStore store.AuditStore
+
 	// Oven contains an oven that may be used in the identity
 	// provider to mint new macaroons.
 	Oven *bakery.Oven
@@ -120,7 +135,9 @@ type IdentityProvider interface {
 	// the identity manager once it has determined the identity
 	// providers final location, any initialization tasks that depend
 	// on having access to the final URL, or the per identity
-	// provider database should be performed here.
+	// provider database should be performed here. The given context
+	// is done when the server is closed, any background tasks started
+	// by the identity provider should stop when it is done.
 	Init(ctx context.Context, params InitParams) error
 
 	// URL returns the URL to use to attempt a login with this
@@ -147,3 +164,50 @@ type IdentityProvider interface {
 	// TODO define what happens when the identity doesn't exist.
 	GetGroups(ctx context.Context, id *store.Identity) (groups []string, err error)
 }
+
+// A Syncer is an identity provider that can synchronise the identities
+// it has created with an external directory, creating identities for
+// users that have not yet logged in and deprovisioning identities for
+// users that have been removed from the directory.
+type Syncer interface {
+	IdentityProvider
+
+	// Sync synchronises the identities with the directory and
+	// returns the result. If dryRun is true then no changes are
+	// made, but the result reports the changes that would have been
+	// made. Any error that stops the sync is reported in the
+	// result.
+	Sync(ctx context.Context, dryRun bool) *params.SyncResult
+
+	// LastSync returns the result of the most recent sync, or nil
+	// if there has not been one.
+	LastSync() *params.SyncResult
+}
+
+// An SSHKeyManager is an identity provider that may manage the SSH keys
+// of the identities it has created, for example by reading them from
+// an external directory. The SSH keys of identities from an identity
+// provider that manages them cannot be changed through the API.
+type SSHKeyManager interface {
+	IdentityProvider
+
+	// ManagesSSHKeys reports whether the identity provider manages
+	// the SSH keys of its identities.
+	ManagesSSHKeys() bool
+}
+
+// ManagesSSHKeys reports whether the SSH keys of the given identity are
+// managed by the identity provider, from the given identity providers,
+// that created it.
+func ManagesSSHKeys(idps []IdentityProvider, identity *store.Identity) bool {
+	provider := identity.ProviderID.Provider()
+	for _, ip := range idps {
+		if ip.Name() != provider {
+			continue
+		}
+		if m, ok := ip.(SSHKeyManager); ok && m.ManagesSSHKeys() {
+			return true
+		}
+	}
+	return false
+}
@@ -93,6 +93,7 @@ func (s *Fixture) InitParams(c *qt.C, prefix string) idp.InitParams {
 	return idp.InitParams{
 		Store:                 s.Store.Store,
 		KeyValueStore:         s.kvStore,
+		AuditStore:            s.Store.AuditStore,
 		Oven:                  s.Oven,
 		Codec:                 s.Codec,
 		URLPrefix:             prefix,
@@ -18,6 +18,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 
+	"github.com/canonical/candid/idp/idputil/secret"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
@@ -241,6 +242,44 @@ func ServiceURL(location, dest string) string {
 	return lu.String()
 }
 
+// SecureLocation reports whether the given location URL uses HTTPS, in
+// which case cookies for it should be marked as secure.
+func SecureLocation(location string) bool {
+	u, err := url.Parse(location)
+	return err == nil && u.Scheme == "https"
+}
+
+// SetLoginCookie stores the given login state in the login cookie for
+// the server at the given location. It returns the value that is used
+// to verify the cookie, see secret.Codec.SetCookie.
+func SetLoginCookie(w http.ResponseWriter, codec *secret.Codec, location string, skipLocation bool, ls LoginState) (string, error) {
+	cookiePath := CookiePathRelativeToLocation(LoginCookiePath, location, skipLocation)
+	return codec.SetCookie(w, LoginCookieName, cookiePath, ls)
+}
+
+// SetCrossSiteLoginCookie sets the login cookie sent with the given
+// request again so that, when the location uses HTTPS, it is also sent
+// with cross-site requests. The value of the cookie, and so the value
+// used to verify it, is unchanged. It is for identity providers that
+// post their responses back to candid from another site, such as SAML
+// with the HTTP-POST binding.
+func SetCrossSiteLoginCookie(w http.ResponseWriter, req *http.Request, location string, skipLocation bool) {
+	if !SecureLocation(location) {
+		return
+	}
+	cookie, err := req.Cookie(LoginCookieName)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     LoginCookieName,
+		Value:    cookie.Value,
+		Path:     CookiePathRelativeToLocation(LoginCookiePath, location, skipLocation),
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
 // CookiePathRelativeToLocation returns the Login Cookie Path
 // relative to the sub-path in the location URL given.
 // If skipLocation = true, then it's a no-op.
@@ -6,6 +6,8 @@
 package keycloak
 
 import (
+	"time"
+
 	oidc "github.com/coreos/go-oidc"
 	"gopkg.in/errgo.v1"
 
@@ -65,6 +67,21 @@ type Params struct {
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// GroupClaims contains the claims that hold the groups of a
+	// user.
+	GroupClaims []openid.GroupClaim `yaml:"group-claims"`
+
+	// RefreshInterval is how often the user's tokens are refreshed
+	// to check that they may still log in.
+	RefreshInterval time.Duration `yaml:"refresh-interval"`
+
+	// DisablePKCE disables the use of PKCE in the authorization
+	// code flow.
+	DisablePKCE bool `yaml:"disable-pkce"`
+
+	// DisableNonce disables the ID token nonce check.
+	DisableNonce bool `yaml:"disable-nonce"`
 }
 
 // NewIdentityProvider creates a keycloak identity provider with the
@@ -78,14 +95,18 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 		p.Domain = defaultProviderDomain
 	}
 	return openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
-		Name:         p.Name,
-		Issuer:       p.KeycloakRealm,
-		Domain:       p.Domain,
-		Description:  p.Description,
-		Icon:         p.Icon,
-		Scopes:       []string{oidc.ScopeOpenID, "profile"},
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Hidden:       p.Hidden,
+		Name:            p.Name,
+		Issuer:          p.KeycloakRealm,
+		Domain:          p.Domain,
+		Description:     p.Description,
+		Icon:            p.Icon,
+		Scopes:          []string{oidc.ScopeOpenID, "profile"},
+		ClientID:        p.ClientID,
+		ClientSecret:    p.ClientSecret,
+		Hidden:          p.Hidden,
+		GroupClaims:     p.GroupClaims,
+		RefreshInterval: p.RefreshInterval,
+		DisablePKCE:     p.DisablePKCE,
+		DisableNonce:    p.DisableNonce,
 	})
 }
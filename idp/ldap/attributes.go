@@ -0,0 +1,173 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// sshKeysKey is the ExtraInfo key that holds the SSH keys of an
+	// identity.
+	sshKeysKey = "sshkeys"
+
+	// groupsKey is the ProviderInfo key that holds the groups found
+	// for an identity by a sync.
+	groupsKey = "groups"
+)
+
+// An AttributeMapping maps an attribute of a user's LDAP entry into
+// the user's identity. Exactly one of ExtraInfo and ProviderInfo must
+// be set.
+type AttributeMapping struct {
+	// Attribute is the name of the LDAP attribute.
+	Attribute string `yaml:"attribute"`
+
+	// ExtraInfo is the extra-info key that holds the values of the
+	// attribute. An attribute with a single value is stored as a
+	// JSON string, an attribute with more than one value is stored
+	// as a JSON array of strings.
+	ExtraInfo string `yaml:"extra-info"`
+
+	// ProviderInfo is the provider-info key that holds the values of
+	// the attribute.
+	ProviderInfo string `yaml:"provider-info"`
+}
+
+// checkAttributeMappings checks that the given attribute mappings are
+// valid.
+func checkAttributeMappings(ms []AttributeMapping) error {
+	extraInfo := map[string]bool{sshKeysKey: true}
+	providerInfo := map[string]bool{groupsKey: true}
+	for _, m := range ms {
+		if m.Attribute == "" {
+			return errgo.Newf("missing 'attribute' in 'attribute-mappings'")
+		}
+		switch {
+		case m.ExtraInfo != "" && m.ProviderInfo != "", m.ExtraInfo == "" && m.ProviderInfo == "":
+			return errgo.Newf("attribute mapping for %q must have one of 'extra-info' or 'provider-info'", m.Attribute)
+		case m.ExtraInfo != "":
+			if strings.ContainsAny(m.ExtraInfo, "./$") {
+				return errgo.Newf("invalid 'extra-info' key %q in 'attribute-mappings'", m.ExtraInfo)
+			}
+			if extraInfo[m.ExtraInfo] {
+				return errgo.Newf("'extra-info' key %q in 'attribute-mappings' is already in use", m.ExtraInfo)
+			}
+			extraInfo[m.ExtraInfo] = true
+		default:
+			if strings.ContainsAny(m.ProviderInfo, "./$") {
+				return errgo.Newf("invalid 'provider-info' key %q in 'attribute-mappings'", m.ProviderInfo)
+			}
+			if providerInfo[m.ProviderInfo] {
+				return errgo.Newf("'provider-info' key %q in 'attribute-mappings' is already in use", m.ProviderInfo)
+			}
+			providerInfo[m.ProviderInfo] = true
+		}
+	}
+	return nil
+}
+
+// mapAttributes sets the SSH keys and the mapped attributes of the
+// given identity from the given directory entry. Mapped attributes that
+// are not in the entry are set with no values.
+func (idp *identityProvider) mapAttributes(id *store.Identity, entry *ldap.Entry) {
+	if idp.params.UserQueryAttrs.SSHKeys != "" {
+		setInfo(&id.ExtraInfo, sshKeysKey, entry.GetAttributeValues(idp.params.UserQueryAttrs.SSHKeys))
+	}
+	for _, m := range idp.params.AttributeMappings {
+		values := entry.GetAttributeValues(m.Attribute)
+		if m.ProviderInfo != "" {
+			setInfo(&id.ProviderInfo, m.ProviderInfo, values)
+			continue
+		}
+		setInfo(&id.ExtraInfo, m.ExtraInfo, extraInfoValues(values))
+	}
+}
+
+// extraInfoValues returns the extra-info values that hold the given
+// attribute values.
+func extraInfoValues(values []string) []string {
+	var v interface{}
+	switch len(values) {
+	case 0:
+		return nil
+	case 1:
+		v = values[0]
+	default:
+		v = values
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		// This should not be possible as v only holds strings.
+		panic(err)
+	}
+	return []string{string(buf)}
+}
+
+func setInfo(info *map[string][]string, key string, values []string) {
+	if *info == nil {
+		*info = make(map[string][]string)
+	}
+	(*info)[key] = values
+}
+
+// updateIdentity updates the stored identity with the details in id,
+// applying the given update. The ProviderInfo and ExtraInfo values in
+// id are also set, except that keys with no values are removed from
+// the stored identity.
+func (idp *identityProvider) updateIdentity(ctx context.Context, id *store.Identity, update store.Update) error {
+	set := *id
+	var clear store.Identity
+	set.ProviderInfo, clear.ProviderInfo = splitInfo(id.ProviderInfo)
+	set.ExtraInfo, clear.ExtraInfo = splitInfo(id.ExtraInfo)
+	if len(set.ProviderInfo) > 0 {
+		update[store.ProviderInfo] = store.Set
+	}
+	if len(set.ExtraInfo) > 0 {
+		update[store.ExtraInfo] = store.Set
+	}
+	if err := idp.initParams.Store.UpdateIdentity(ctx, &set, update); err != nil {
+		return errgo.Mask(err)
+	}
+	var clearUpdate store.Update
+	if len(clear.ProviderInfo) > 0 {
+		clearUpdate[store.ProviderInfo] = store.Clear
+	}
+	if len(clear.ExtraInfo) > 0 {
+		clearUpdate[store.ExtraInfo] = store.Clear
+	}
+	if clearUpdate == (store.Update{}) {
+		return nil
+	}
+	clear.ID = set.ID
+	clear.ProviderID = set.ProviderID
+	return errgo.Mask(idp.initParams.Store.UpdateIdentity(ctx, &clear, clearUpdate))
+}
+
+// splitInfo splits the given info map into the keys that have values
+// and the keys that do not.
+func splitInfo(info map[string][]string) (set, clear map[string][]string) {
+	for k, v := range info {
+		if len(v) > 0 {
+			setInfo(&set, k, v)
+		} else {
+			setInfo(&clear, k, nil)
+		}
+	}
+	return set, clear
+}
+
+// ManagesSSHKeys implements idp.SSHKeyManager.ManagesSSHKeys. The SSH
+// keys of identities are managed by the identity provider when they are
+// read from the directory.
+func (idp *identityProvider) ManagesSSHKeys() bool {
+	return idp.params.UserQueryAttrs.SSHKeys != ""
+}
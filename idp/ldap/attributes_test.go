@@ -0,0 +1,138 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap_test
+
+import (
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/ldap"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+func getAttributeParams() ldap.Params {
+	p := getSampleParams()
+	p.UserQueryAttrs.SSHKeys = "sshPublicKey"
+	p.AttributeMappings = []ldap.AttributeMapping{{
+		Attribute: "employeeNumber",
+		ExtraInfo: "employee-number",
+	}, {
+		Attribute: "telephoneNumber",
+		ExtraInfo: "phone",
+	}, {
+		Attribute:    "department",
+		ProviderInfo: "department",
+	}}
+	return p
+}
+
+func (s *ldapSuite) TestHandleAttributeMappings(c *qt.C) {
+	db := getSampleLdapDB()
+	db[1]["sshPublicKey"] = []string{"ssh-ed25519 AAAA1", "ssh-rsa AAAA2"}
+	db[1]["employeeNumber"] = []string{"1234"}
+	db[1]["telephoneNumber"] = []string{"555-0100", "555-0101"}
+	db[1]["department"] = []string{"engineering"}
+	i := s.setupIdp(c, getAttributeParams(), db)
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"department": {"engineering"},
+		},
+		ExtraInfo: map[string][]string{
+			"sshkeys":         {"ssh-ed25519 AAAA1", "ssh-rsa AAAA2"},
+			"employee-number": {`"1234"`},
+			"phone":           {`["555-0100","555-0101"]`},
+		},
+	})
+
+	// Attributes removed from the directory are removed from the
+	// identity at the next login, other information is kept.
+	err = s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		ExtraInfo: map[string][]string{
+			"other": {`"value"`},
+		},
+	}, store.Update{
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	db[1]["sshPublicKey"] = []string{"ssh-ed25519 AAAA1"}
+	delete(db[1], "telephoneNumber")
+	delete(db[1], "department")
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+		ExtraInfo: map[string][]string{
+			"sshkeys":         {"ssh-ed25519 AAAA1"},
+			"employee-number": {`"1234"`},
+			"other":           {`"value"`},
+		},
+	})
+}
+
+func (s *ldapSuite) TestManagesSSHKeys(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams(), getSampleLdapDB())
+	c.Assert(i.(idp.SSHKeyManager).ManagesSSHKeys(), qt.Equals, false)
+
+	i = s.setupIdp(c, getAttributeParams(), getSampleLdapDB())
+	c.Assert(i.(idp.SSHKeyManager).ManagesSSHKeys(), qt.Equals, true)
+}
+
+func (s *ldapSuite) TestSyncAttributeMappings(c *qt.C) {
+	p := getAttributeParams()
+	p.Sync = &ldap.SyncParams{}
+	db := getSyncLdapDB()
+	db[1]["sshPublicKey"] = []string{"ssh-ed25519 AAAA1"}
+	db[1]["department"] = []string{"engineering"}
+	syncer, _ := s.setupSyncer(c, p, db)
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Created, qt.DeepEquals, []string{"user1", "user2"})
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"groups":     {"group1"},
+			"department": {"engineering"},
+		},
+		ExtraInfo: map[string][]string{
+			"sshkeys": {"ssh-ed25519 AAAA1"},
+		},
+	})
+
+	db[1]["sshPublicKey"] = []string{"ssh-ed25519 AAAA3"}
+	db[2]["employeeNumber"] = []string{"5678"}
+	r = syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Updated, qt.DeepEquals, []string{"user1", "user2"})
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"groups":     {"group1"},
+			"department": {"engineering"},
+		},
+		ExtraInfo: map[string][]string{
+			"sshkeys": {"ssh-ed25519 AAAA3"},
+		},
+	})
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user2,ou=users,dc=example,dc=com"),
+		Username:   "user2",
+		ExtraInfo: map[string][]string{
+			"employee-number": {`"5678"`},
+		},
+	})
+
+	// A sync with no changes reports no updates.
+	r = syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Updated, qt.HasLen, 0)
+}
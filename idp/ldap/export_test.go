@@ -4,14 +4,36 @@
 package ldap
 
 import (
+	"context"
+	"crypto/tls"
+	"time"
+
 	"github.com/canonical/candid/idp"
 )
 
 type LDAPConn ldapConn
-type LDAPDialer func(network, address string) (LDAPConn, error)
+type LDAPDialer func(network, address string, tlsConfig *tls.Config, timeout time.Duration) (LDAPConn, error)
 
 func SetLDAP(p idp.IdentityProvider, dialer LDAPDialer) {
-	p.(*identityProvider).dialLDAP = func(netw, addr string) (ldapConn, error) {
-		return dialer(netw, addr)
+	provider(p).dialLDAP = func(netw, addr string, tlsConfig *tls.Config, timeout time.Duration) (ldapConn, error) {
+		return dialer(netw, addr, tlsConfig, timeout)
+	}
+}
+
+// AcquireConn takes a connection from the pool of the given identity
+// provider, returning a function that returns it.
+func AcquireConn(p idp.IdentityProvider) (func(), error) {
+	pl := provider(p).pool
+	pc, err := pl.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return func() { pl.put(pc, true) }, nil
+}
+
+func provider(p idp.IdentityProvider) *identityProvider {
+	if sp, ok := p.(*syncingIdentityProvider); ok {
+		return sp.identityProvider
 	}
+	return p.(*identityProvider)
 }
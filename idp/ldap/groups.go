@@ -0,0 +1,307 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// Group resolution modes.
+const (
+	// groupResolutionDirect finds the groups that directly contain
+	// the user using GroupQueryFilter.
+	groupResolutionDirect = "direct"
+
+	// groupResolutionRecursive finds the groups that directly
+	// contain the user using GroupQueryFilter, and then the groups
+	// that contain those groups, and so on.
+	groupResolutionRecursive = "recursive"
+
+	// groupResolutionInChain finds all the groups that contain the
+	// user, directly or indirectly, in a single search using the
+	// Active Directory LDAP_MATCHING_RULE_IN_CHAIN matching rule.
+	groupResolutionInChain = "in-chain"
+
+	// groupResolutionMemberOf reads the groups from an attribute
+	// (usually memberOf) of the user's entry.
+	groupResolutionMemberOf = "member-of"
+)
+
+const (
+	// matchingRuleInChain is the OID of the Active Directory
+	// LDAP_MATCHING_RULE_IN_CHAIN matching rule.
+	matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+	// defaultMaxDepth is the default maximum depth of group nesting
+	// followed in recursive mode.
+	defaultMaxDepth = 10
+)
+
+// GroupResolution defines how the groups that a user belongs to are
+// found.
+type GroupResolution struct {
+	// Mode selects how the groups are found. It is one of "direct",
+	// "recursive", "in-chain" or "member-of". If this is not set then
+	// "direct" is used.
+	Mode string `yaml:"mode"`
+
+	// MaxDepth is the maximum depth of group nesting that is followed
+	// in "recursive" mode. If this is zero then 10 is used.
+	MaxDepth int `yaml:"max-depth"`
+
+	// MemberAttr is the attribute of a group that holds its members,
+	// used in "in-chain" mode. If this is not set then "member" is
+	// used.
+	MemberAttr string `yaml:"member-attr"`
+
+	// MemberOfAttr is the attribute of a user that holds the DNs of
+	// the groups the user belongs to, used in "member-of" mode. If
+	// this is not set then "memberOf" is used.
+	MemberOfAttr string `yaml:"member-of-attr"`
+
+	// NameAttr is the attribute of a group that holds its name. If
+	// this is not set then "cn" is used.
+	NameAttr string `yaml:"name-attr"`
+}
+
+// setDefaults checks the group resolution parameters and sets the
+// defaults for any that are not set.
+func (r *GroupResolution) setDefaults() error {
+	switch r.Mode {
+	case "":
+		r.Mode = groupResolutionDirect
+	case groupResolutionDirect, groupResolutionRecursive, groupResolutionInChain, groupResolutionMemberOf:
+	default:
+		return errgo.Newf("invalid 'mode' %q in 'group-resolution'", r.Mode)
+	}
+	if r.MaxDepth < 0 {
+		return errgo.Newf("invalid 'max-depth' in 'group-resolution'")
+	}
+	if r.MaxDepth == 0 {
+		r.MaxDepth = defaultMaxDepth
+	}
+	if r.MemberAttr == "" {
+		r.MemberAttr = "member"
+	}
+	if r.MemberOfAttr == "" {
+		r.MemberOfAttr = "memberOf"
+	}
+	if r.NameAttr == "" {
+		r.NameAttr = "cn"
+	}
+	return nil
+}
+
+// usesGroupQueryFilter reports whether the group query filter is used
+// to find groups.
+func (r *GroupResolution) usesGroupQueryFilter() bool {
+	return r.Mode == groupResolutionDirect || r.Mode == groupResolutionRecursive
+}
+
+// findGroups finds the names of the groups that the user with the
+// given DN belongs to.
+func (idp *identityProvider) findGroups(conn ldapConn, dn string) ([]string, error) {
+	var groups []string
+	var err error
+	switch idp.params.GroupResolution.Mode {
+	case groupResolutionRecursive:
+		groups, err = idp.recursiveGroups(conn, dn)
+	case groupResolutionInChain:
+		filter := fmt.Sprintf("(%s:%s:=%s)", idp.params.GroupResolution.MemberAttr, matchingRuleInChain, ldap.EscapeFilter(dn))
+		groups, err = idp.searchGroupNames(conn, filter)
+	case groupResolutionMemberOf:
+		groups, err = idp.memberOfGroups(conn, dn)
+	default:
+		groups, err = idp.directGroups(conn, dn)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return groups, nil
+}
+
+// directGroups returns the names of the groups that directly contain
+// the entry with the given DN.
+func (idp *identityProvider) directGroups(conn ldapConn, dn string) ([]string, error) {
+	filter, err := renderTemplate(
+		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(dn)})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groups, err := idp.searchGroupNames(conn, filter)
+	return groups, errgo.Mask(err)
+}
+
+// recursiveGroups returns the names of the groups that contain the entry
+// with the given DN, either directly or through other groups. Groups are
+// only visited once, so loops in the group membership are not a
+// problem.
+func (idp *identityProvider) recursiveGroups(conn ldapConn, dn string) ([]string, error) {
+	groups := []string{}
+	seen := map[string]bool{normalizeDN(dn): true}
+	members := []string{dn}
+	for depth := 0; len(members) > 0; depth++ {
+		if depth == idp.params.GroupResolution.MaxDepth {
+			logger.Warningf("LDAP group nesting for %s deeper than %d, ignoring deeper groups", dn, depth)
+			break
+		}
+		var next []string
+		for _, member := range members {
+			entries, err := idp.searchMemberGroups(conn, member)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			for _, entry := range entries {
+				key := normalizeDN(entry.DN)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				if name := idp.groupName(entry); name != "" {
+					groups = append(groups, name)
+				}
+				next = append(next, entry.DN)
+			}
+		}
+		members = next
+	}
+	return groups, nil
+}
+
+// memberOfGroups returns the names of the groups listed in the
+// member-of attribute of the entry with the given DN. The name of each
+// group is taken from its DN.
+func (idp *identityProvider) memberOfGroups(conn ldapConn, dn string) ([]string, error) {
+	attr := idp.params.GroupResolution.MemberOfAttr
+	logger.Tracef("LDAP member-of search: basedn=%s scope=base deref_aliases=never filter=(objectClass=*) attributes=[%q]", dn, attr)
+	req := &ldap.SearchRequest{
+		BaseDN:       dn,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    1,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{attr},
+	}
+	res, err := conn.Search(req)
+	if err != nil {
+		logger.Tracef("LDAP search error: %s", err)
+		return nil, errgo.Mask(err)
+	}
+	logResults(res)
+	groups := []string{}
+	if len(res.Entries) == 0 {
+		return groups, nil
+	}
+	for _, groupDN := range res.Entries[0].GetAttributeValues(attr) {
+		name, err := idp.groupNameFromDN(groupDN)
+		if err != nil {
+			logger.Warningf("invalid group DN %q: %s", groupDN, err)
+			continue
+		}
+		groups = append(groups, name)
+	}
+	return groups, nil
+}
+
+// searchMemberGroups returns the entries of the groups that match the
+// group query filter for the given member DN.
+func (idp *identityProvider) searchMemberGroups(conn ldapConn, dn string) ([]*ldap.Entry, error) {
+	filter, err := renderTemplate(
+		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(dn)})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entries, err := idp.searchGroups(conn, filter)
+	return entries, errgo.Mask(err)
+}
+
+// searchGroupNames returns the names of the groups that match the given
+// filter.
+func (idp *identityProvider) searchGroupNames(conn ldapConn, filter string) ([]string, error) {
+	entries, err := idp.searchGroups(conn, filter)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groups := []string{}
+	for _, entry := range entries {
+		if name := idp.groupName(entry); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// searchGroups returns the group entries that match the given filter.
+func (idp *identityProvider) searchGroups(conn ldapConn, filter string) ([]*ldap.Entry, error) {
+	attr := idp.params.GroupResolution.NameAttr
+	logger.Tracef("LDAP groups search: basedn=%s scope=sub deref_aliases=never filter=%s attributes=[%q]", idp.baseDN, filter, attr)
+	req := &ldap.SearchRequest{
+		BaseDN:       idp.baseDN,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		Filter:       filter,
+		Attributes:   []string{attr},
+	}
+	res, err := conn.Search(req)
+	if err != nil {
+		logger.Tracef("LDAP search error: %s", err)
+		return nil, errgo.Mask(err)
+	}
+	logResults(res)
+	entries := make([]*ldap.Entry, 0, len(res.Entries))
+	for _, entry := range res.Entries {
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// groupName returns the name of the given group entry, or "" if it has
+// no name.
+func (idp *identityProvider) groupName(entry *ldap.Entry) string {
+	return entry.GetAttributeValue(idp.params.GroupResolution.NameAttr)
+}
+
+// groupNameFromDN returns the name of the group with the given DN. The
+// name is the value of the name attribute in the first RDN, or the
+// first value in the RDN if there is no such attribute.
+func (idp *identityProvider) groupNameFromDN(dn string) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return "", errgo.Newf("empty DN")
+	}
+	attrs := parsed.RDNs[0].Attributes
+	for _, a := range attrs {
+		if strings.EqualFold(a.Type, idp.params.GroupResolution.NameAttr) {
+			return a.Value, nil
+		}
+	}
+	return attrs[0].Value, nil
+}
+
+// normalizeDN returns a form of the given DN suitable for comparing
+// with other DNs.
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	rdns := make([]string, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		attrs := make([]string, len(rdn.Attributes))
+		for j, a := range rdn.Attributes {
+			attrs[j] = strings.ToLower(a.Type) + "=" + strings.ToLower(a.Value)
+		}
+		rdns[i] = strings.Join(attrs, "+")
+	}
+	return strings.Join(rdns, ",")
+}
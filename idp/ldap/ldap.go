@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
@@ -24,12 +25,26 @@ import (
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/monitoring"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
 
 var logger = loggo.GetLogger("candid.idp.ldap")
 
+const (
+	// defaultTimeout is the default timeout for LDAP operations.
+	defaultTimeout = 30 * time.Second
+
+	// defaultPoolSize is the default maximum number of connections
+	// to the LDAP servers that may be in use at once.
+	defaultPoolSize = 10
+
+	// defaultHealthCheckInterval is the default time before a
+	// failed server is tried again.
+	defaultHealthCheckInterval = time.Minute
+)
+
 func init() {
 	idp.Register("ldap", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
 		var p Params
@@ -64,8 +79,15 @@ type Params struct {
 	Domain string `yaml:"domain"`
 
 	// URL contains an LDAP URL indicating the server to connect to.
+	// Both ldap:// URLs, which use StartTLS, and ldaps:// URLs are
+	// supported.
 	URL string `yaml:"url"`
 
+	// URLs contains the URLs of further LDAP servers. The servers
+	// are tried in order, starting with URL, until a connection can
+	// be made. All the URLs must have the same base DN.
+	URLs []string `yaml:"urls"`
+
 	// CACertificate contains a PEM encoded CA certificate to verify
 	// the ldap connection against.
 	CACertificate string `yaml:"ca-cert"`
@@ -86,15 +108,47 @@ type Params struct {
 	// the LDAP entry.
 	UserQueryAttrs UserQueryAttrs `yaml:"user-query-attrs"`
 
+	// AttributeMappings defines further attributes of a user's LDAP
+	// entry that are stored in the identity's extra-info or
+	// provider-info when the user logs in or is synchronised.
+	AttributeMappings []AttributeMapping `yaml:"attribute-mappings"`
+
 	// GroupQueryFilter defines the template for the LDAP filter to search for
 	// the groups that a user belongs to. The .User value is defined to hold
 	// the user id being searched for - e.g.
 	//    (&(objectClass=groupOfNames)(member={{.User}}))
+	// It is only required for the "direct" and "recursive" group
+	// resolution modes.
 	GroupQueryFilter string `yaml:"group-query-filter"`
 
+	// GroupResolution defines how the groups a user belongs to are
+	// found, including groups that contain other groups.
+	GroupResolution GroupResolution `yaml:"group-resolution"`
+
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// Timeout is the timeout for connecting to an LDAP server and
+	// for each LDAP operation. If this is zero then 30 seconds is
+	// used.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// PoolSize is the maximum number of connections to the LDAP
+	// servers that may be in use at once. Connections bound as DN
+	// are reused between requests. If this is zero then 10 is used.
+	PoolSize int `yaml:"pool-size"`
+
+	// HealthCheckInterval is the time after which a server that
+	// could not be reached is tried again, and the time after which
+	// an idle connection is checked before it is reused. If this is
+	// zero then one minute is used.
+	HealthCheckInterval time.Duration `yaml:"health-check-interval"`
+
+	// Sync defines how identities are synchronised with the
+	// directory. If this is nil then identities are only created
+	// when users log in.
+	Sync *SyncParams `yaml:"sync"`
 }
 
 // UserQueryAttrs defines how user attributes are mapped to attributes in the
@@ -109,6 +163,12 @@ type UserQueryAttrs struct {
 	// UserQueryDisplayNameAttr defines the attribute for a user display name.
 	// If not specified, "displayName" is used.
 	DisplayName string `yaml:"display-name"`
+
+	// SSHKeys defines the attribute that holds a user's SSH public
+	// keys, for example "sshPublicKey". If this is set then the SSH
+	// keys of the identities are managed by the directory and cannot
+	// be changed through the API.
+	SSHKeys string `yaml:"ssh-keys"`
 }
 
 type groupQueryArg struct {
@@ -131,72 +191,153 @@ func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
 	if p.UserQueryAttrs.DisplayName != "" {
 		userQueryAttrs = append(userQueryAttrs, p.UserQueryAttrs.DisplayName)
 	}
+	if p.UserQueryAttrs.SSHKeys != "" {
+		userQueryAttrs = append(userQueryAttrs, p.UserQueryAttrs.SSHKeys)
+	}
+	if err := checkAttributeMappings(p.AttributeMappings); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, m := range p.AttributeMappings {
+		userQueryAttrs = append(userQueryAttrs, m.Attribute)
+	}
 
 	if p.UserQueryFilter == "" {
 		return nil, errgo.Newf("missing 'user-query-filter' config parameter")
 	}
-	if p.GroupQueryFilter == "" {
-		return nil, errgo.Newf("missing 'group-query-filter' config parameter")
+	if err := p.GroupResolution.setDefaults(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var groupQueryFilterTemplate *template.Template
+	if p.GroupResolution.usesGroupQueryFilter() {
+		if p.GroupQueryFilter == "" {
+			return nil, errgo.Newf("missing 'group-query-filter' config parameter")
+		}
+		var err error
+		groupQueryFilterTemplate, err = template.New(
+			"group-query-filter").Parse(p.GroupQueryFilter)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
+		}
+		testFilter, err := renderTemplate(groupQueryFilterTemplate, groupQueryArg{User: "sample"})
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
+		}
+		if _, err = ldap.CompileFilter(testFilter); err != nil {
+			return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
+		}
 	}
 
-	groupQueryFilterTemplate, err := template.New(
-		"group-query-filter").Parse(p.GroupQueryFilter)
-	if err != nil {
-		return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
+	if p.Timeout < 0 {
+		return nil, errgo.Newf("invalid 'timeout' config parameter")
 	}
-	testFilter, err := renderTemplate(groupQueryFilterTemplate, groupQueryArg{User: "sample"})
-	if err != nil {
-		return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
+	if p.Timeout == 0 {
+		p.Timeout = defaultTimeout
+	}
+	if p.PoolSize < 0 {
+		return nil, errgo.Newf("invalid 'pool-size' config parameter")
 	}
-	if _, err = ldap.CompileFilter(testFilter); err != nil {
-		return nil, errgo.Notef(err, "invalid 'group-query-filter' config parameter")
+	if p.PoolSize == 0 {
+		p.PoolSize = defaultPoolSize
+	}
+	if p.HealthCheckInterval < 0 {
+		return nil, errgo.Newf("invalid 'health-check-interval' config parameter")
+	}
+	if p.HealthCheckInterval == 0 {
+		p.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if p.Sync != nil {
+		sp := *p.Sync
+		if err := sp.setDefaults(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		p.Sync = &sp
 	}
 
 	idp := &identityProvider{
 		params:                   p,
 		dialLDAP:                 dialLDAP,
+		metrics:                  monitoring.NewLDAPMetrics(p.Name),
 		userQueryAttrs:           userQueryAttrs,
 		groupQueryFilterTemplate: groupQueryFilterTemplate,
 	}
 
-	u, err := url.Parse(p.URL)
+	var rootCAs *x509.CertPool
+	if p.CACertificate != "" {
+		rootCAs = x509.NewCertPool()
+		rootCAs.AppendCertsFromPEM([]byte(p.CACertificate))
+	}
+	urls := p.URLs
+	if p.URL != "" || len(urls) == 0 {
+		urls = append([]string{p.URL}, urls...)
+	}
+	for i, us := range urls {
+		s, baseDN, err := parseURL(us)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if i == 0 {
+			idp.baseDN = baseDN
+		} else if baseDN != idp.baseDN {
+			return nil, errgo.Newf("base DN of %q does not match %q", us, urls[0])
+		}
+		s.tlsConfig.RootCAs = rootCAs
+		idp.servers = append(idp.servers, s)
+	}
+	idp.pool = &pool{
+		dial:          idp.dial,
+		bind:          idp.bind,
+		check:         checkConn,
+		timeout:       p.Timeout,
+		checkInterval: p.HealthCheckInterval,
+		metrics:       idp.metrics,
+		slots:         make(chan struct{}, p.PoolSize),
+	}
+	if p.Sync != nil {
+		return &syncingIdentityProvider{identityProvider: idp}, nil
+	}
+	return idp, nil
+}
+
+// parseURL parses an LDAP URL returning the server and the base DN.
+func parseURL(us string) (*server, string, error) {
+	u, err := url.Parse(us)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot parse URL")
+		return nil, "", errgo.Notef(err, "cannot parse URL")
 	}
+	s := &server{
+		url:       us,
+		network:   "tcp",
+		tlsConfig: new(tls.Config),
+	}
+	var defaultPort string
 	switch u.Scheme {
 	case "ldap":
-		idp.network = "tcp"
-		// It would be nice to use u.Host and u.Port here, but
-		// these aren't available in go 1.6.
-		host, port, _ := net.SplitHostPort(u.Host)
-		if host == "" {
-			// Asume that the URL didn't specify a port.
-			host = u.Host
-			port = "ldap"
-		}
-		idp.address = net.JoinHostPort(host, port)
-		idp.tlsConfig.ServerName = host
+		defaultPort = "ldap"
+	case "ldaps":
+		defaultPort = "ldaps"
+		s.ldaps = true
 	default:
 		// No other schemes are currently supported.
-		return nil, errgo.Newf("unsupported scheme %q", u.Scheme)
+		return nil, "", errgo.Newf("unsupported scheme %q", u.Scheme)
 	}
-	idp.baseDN = strings.TrimPrefix(u.Path, "/")
-	if p.CACertificate != "" {
-		idp.tlsConfig.RootCAs = x509.NewCertPool()
-		idp.tlsConfig.RootCAs.AppendCertsFromPEM([]byte(p.CACertificate))
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = defaultPort
 	}
-	return idp, nil
+	s.address = net.JoinHostPort(host, port)
+	s.tlsConfig.ServerName = host
+	return s, strings.TrimPrefix(u.Path, "/"), nil
 }
 
 type identityProvider struct {
 	params     Params
 	initParams idp.InitParams
 
-	dialLDAP  func(network, addr string) (ldapConn, error)
-	network   string
-	address   string
-	baseDN    string
-	tlsConfig tls.Config
+	dialLDAP func(network, addr string, tlsConfig *tls.Config, timeout time.Duration) (ldapConn, error)
+	servers  []*server
+	baseDN   string
+	pool     *pool
+	metrics  monitoring.LDAPMetrics
 
 	userQueryAttrs           []string
 	groupQueryFilterTemplate *template.Template
@@ -249,41 +390,25 @@ func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID
 
 //  GetGroups implements idp.IdentityProvider.GetGroups.
 func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
-	conn, err := idp.dial()
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	defer conn.Close()
-
-	_, uid := identity.ProviderID.Split()
-	filter, err := renderTemplate(
-		idp.groupQueryFilterTemplate, groupQueryArg{User: ldap.EscapeFilter(uid)})
+	var groups []string
+	err := idp.withConn(ctx, "groups", func(conn *poolConn) error {
+		var err error
+		groups, err = idp.getGroups(conn, identity)
+		return err
+	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	return groups, nil
+}
 
-	logger.Tracef("LDAP groups search: basedn=%s scope=sub deref_aliases=never filter=%s attributes=[\"cn\"]", idp.baseDN, filter)
-	req := &ldap.SearchRequest{
-		BaseDN:       idp.baseDN,
-		Scope:        ldap.ScopeWholeSubtree,
-		DerefAliases: ldap.NeverDerefAliases,
-		Filter:       filter,
-		Attributes:   []string{"cn"},
-	}
-	res, err := conn.Search(req)
+// getGroups searches for the groups of the given identity.
+func (idp *identityProvider) getGroups(conn ldapConn, identity *store.Identity) ([]string, error) {
+	_, dn := identity.ProviderID.Split()
+	groups, err := idp.findGroups(conn, dn)
 	if err != nil {
-		logger.Tracef("LDAP search error: %s", err)
 		return nil, errgo.Mask(err)
 	}
-	logResults(res)
-
-	groups := []string{}
-	for _, entry := range res.Entries {
-		if entry == nil || len(entry.Attributes) == 0 || len(entry.Attributes[0].Values) == 0 {
-			continue
-		}
-		groups = append(groups, entry.Attributes[0].Values[0])
-	}
 	return groups, nil
 }
 
@@ -314,17 +439,18 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 }
 
 func (idp *identityProvider) loginUser(ctx context.Context, username, password string) (*store.Identity, error) {
-	conn, err := idp.dial()
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	defer conn.Close()
-
-	dn, err := idp.resolveUsername(conn, username)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	id, err := idp.loginDN(ctx, conn, dn, password)
+	var id *store.Identity
+	err := idp.withConn(ctx, "login", func(conn *poolConn) error {
+		dn, err := idp.resolveUsername(conn, username)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		// Binding as the user means that the connection must be
+		// bound as the search user again before it is reused.
+		conn.userBound = true
+		id, err = idp.loginDN(ctx, conn, dn, password)
+		return errgo.Mask(err, errgo.Any)
+	})
 	if err != nil {
 		if errgo.Cause(err) == params.ErrNotFound {
 			return nil, errgo.Notef(err, "user %q not found", username)
@@ -363,25 +489,8 @@ func (idp *identityProvider) loginDN(ctx context.Context, conn ldapConn, dn, pas
 	if len(res.Entries) == 0 {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
 	}
-	var username, email, name string
-	for _, attr := range res.Entries[0].Attributes {
-		switch attr.Name {
-		case idp.params.UserQueryAttrs.ID:
-			username = idputil.NameWithDomain(attr.Values[0], idp.params.Domain)
-		case idp.params.UserQueryAttrs.Email:
-			email = attr.Values[0]
-		case idp.params.UserQueryAttrs.DisplayName:
-			name = attr.Values[0]
-		}
-	}
-	// set groups
-	id := &store.Identity{
-		ProviderID: store.MakeProviderIdentity(idp.params.Name, dn),
-		Username:   username,
-		Name:       name,
-		Email:      email,
-	}
-	err = idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
+	id := idp.identityFromEntry(dn, res.Entries[0])
+	err = idp.updateIdentity(ctx, id, store.Update{
 		store.Username: store.Set,
 		store.Name:     store.Set,
 		store.Email:    store.Set,
@@ -392,6 +501,29 @@ func (idp *identityProvider) loginDN(ctx context.Context, conn ldapConn, dn, pas
 	return id, nil
 }
 
+// identityFromEntry returns an identity for the user with the given DN
+// holding the details in the given directory entry.
+func (idp *identityProvider) identityFromEntry(dn string, entry *ldap.Entry) *store.Identity {
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, dn),
+	}
+	for _, attr := range entry.Attributes {
+		if len(attr.Values) == 0 {
+			continue
+		}
+		switch attr.Name {
+		case idp.params.UserQueryAttrs.ID:
+			id.Username = idputil.NameWithDomain(attr.Values[0], idp.params.Domain)
+		case idp.params.UserQueryAttrs.Email:
+			id.Email = attr.Values[0]
+		case idp.params.UserQueryAttrs.DisplayName:
+			id.Name = attr.Values[0]
+		}
+	}
+	idp.mapAttributes(id, entry)
+	return id
+}
+
 // resolveUsername returns the DN for a username
 func (idp *identityProvider) resolveUsername(conn ldapConn, username string) (string, error) {
 	filter := fmt.Sprintf("(%s=%s)", idp.params.UserQueryAttrs.ID, ldap.EscapeFilter(username))
@@ -415,27 +547,120 @@ func (idp *identityProvider) resolveUsername(conn ldapConn, username string) (st
 	return res.Entries[0].DN, nil
 }
 
-// dial establishes a connection to the LDAP server and binds as the
-// search user (if specified).
-func (idp *identityProvider) dial() (ldapConn, error) {
-	conn, err := idp.dialLDAP(idp.network, idp.address)
+// withConn calls f with a pooled connection bound as the search user.
+// If f fails because of a network error then the connection is
+// discarded and f is called again with a new connection, which may be to
+// a different server. The cause of any error returned from f is
+// preserved.
+func (idp *identityProvider) withConn(ctx context.Context, op string, f func(*poolConn) error) error {
+	start := time.Now()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *poolConn
+		conn, err = idp.pool.get(ctx)
+		if err != nil {
+			break
+		}
+		err = f(conn)
+		if !isNetworkError(err) {
+			idp.pool.put(conn, true)
+			break
+		}
+		logger.Infof("LDAP connection to %s failed: %s", conn.server.url, err)
+		idp.pool.put(conn, false)
+		idp.serverFailed(conn.server)
+	}
+	idp.metrics.ObserveOperation(op, start, err)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// dial establishes a connection to the first LDAP server that can be
+// reached and binds as the search user (if specified). Servers that
+// have recently failed are only tried if no other server can be
+// reached.
+func (idp *identityProvider) dial() (*server, ldapConn, error) {
+	now := time.Now()
+	servers := make([]*server, 0, len(idp.servers))
+	var down []*server
+	for _, s := range idp.servers {
+		if s.available(now) {
+			servers = append(servers, s)
+		} else {
+			down = append(down, s)
+		}
+	}
+	servers = append(servers, down...)
+	var err error
+	for _, s := range servers {
+		var conn ldapConn
+		conn, err = idp.dialServer(s)
+		if err == nil {
+			s.setDownUntil(time.Time{})
+			return s, conn, nil
+		}
+		logger.Warningf("cannot connect to LDAP server %s: %s", s.url, err)
+		idp.serverFailed(s)
+	}
+	return nil, nil, errgo.Mask(err)
+}
+
+// dialServer establishes a connection to the given server and binds
+// as the search user (if specified).
+func (idp *identityProvider) dialServer(s *server) (ldapConn, error) {
+	var tlsConfig *tls.Config
+	if s.ldaps {
+		tlsConfig = s.tlsConfig
+	}
+	conn, err := idp.dialLDAP(s.network, s.address, tlsConfig, idp.params.Timeout)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	if err = conn.StartTLS(&idp.tlsConfig); err != nil {
-		return nil, errgo.Mask(err)
+	conn.SetTimeout(idp.params.Timeout)
+	if !s.ldaps {
+		if err = conn.StartTLS(s.tlsConfig); err != nil {
+			conn.Close()
+			return nil, errgo.Mask(err)
+		}
 	}
 	if idp.params.DN != "" {
-		logger.Tracef("LDAP bind: dn=%s", idp.params.DN)
-		if err := conn.Bind(idp.params.DN, idp.params.Password); err != nil {
-			logger.Tracef("LDAP bind error: %s", err)
+		if err := idp.bind(conn); err != nil {
+			conn.Close()
 			return nil, errgo.Mask(err)
 		}
-		logger.Tracef("LDAP bind success", err)
 	}
 	return conn, nil
 }
 
+// bind binds the given connection as the search user. If no search
+// user is specified the connection is bound anonymously.
+func (idp *identityProvider) bind(conn ldapConn) error {
+	logger.Tracef("LDAP bind: dn=%s", idp.params.DN)
+	if err := conn.Bind(idp.params.DN, idp.params.Password); err != nil {
+		logger.Tracef("LDAP bind error: %s", err)
+		return errgo.Mask(err)
+	}
+	logger.Tracef("LDAP bind success")
+	return nil
+}
+
+// serverFailed records that a connection to the given server failed.
+func (idp *identityProvider) serverFailed(s *server) {
+	s.setDownUntil(time.Now().Add(idp.params.HealthCheckInterval))
+	idp.metrics.ServerFailed(s.url)
+}
+
+// checkConn checks that the given connection is still usable by
+// reading the root DSE.
+func checkConn(conn ldapConn) error {
+	_, err := conn.Search(&ldap.SearchRequest{
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{"1.1"},
+	})
+	return errgo.Mask(err)
+}
+
 func renderTemplate(tmpl *template.Template, ctx interface{}) (string, error) {
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, ctx); err != nil {
@@ -444,11 +669,27 @@ func renderTemplate(tmpl *template.Template, ctx interface{}) (string, error) {
 	return buf.String(), nil
 }
 
-func dialLDAP(network, addr string) (ldapConn, error) {
-	c, err := ldap.Dial(network, addr)
+// dialLDAP connects to the LDAP server at the given address. If
+// tlsConfig is not nil then the connection uses TLS from the start.
+func dialLDAP(network, addr string, tlsConfig *tls.Config, timeout time.Duration) (ldapConn, error) {
+	nc, err := net.DialTimeout(network, addr, timeout)
 	if err != nil {
-		return nil, err
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	isTLS := false
+	if tlsConfig != nil {
+		tc := tls.Client(nc, tlsConfig)
+		tc.SetDeadline(time.Now().Add(timeout))
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		tc.SetDeadline(time.Time{})
+		nc = tc
+		isTLS = true
 	}
+	c := ldap.NewConn(nc, isTLS)
+	c.Start()
 	return c, nil
 }
 
@@ -456,8 +697,10 @@ func dialLDAP(network, addr string) (ldapConn, error) {
 // by the provider. It is defined so that it can be replaced for testing.
 type ldapConn interface {
 	StartTLS(config *tls.Config) error
+	SetTimeout(timeout time.Duration)
 	Bind(username, password string) error
 	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
 	Close()
 }
 
@@ -6,9 +6,11 @@ package ldap_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idptest"
@@ -55,15 +57,87 @@ var newTests = []struct {
 	},
 	expectError: `cannot parse URL: parse "?://"?: missing protocol scheme`,
 }, {
-	about: "unsupported scheme",
+	about: "ldaps url",
 	params: ldap.Params{
 		Name:             "ldaps",
-		URL:              "ldaps://",
+		URL:              "ldaps://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+}, {
+	about: "unsupported scheme",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "http://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `unsupported scheme "http"`,
+}, {
+	about: "multiple urls",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://ldap1/dc=example,dc=com",
+		URLs:             []string{"ldaps://ldap2/dc=example,dc=com"},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+}, {
+	about: "urls only",
+	params: ldap.Params{
+		Name:             "ldap",
+		URLs:             []string{"ldap://ldap1/dc=example,dc=com", "ldap://ldap2/dc=example,dc=com"},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+}, {
+	about: "mismatched base DN",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://ldap1/dc=example,dc=com",
+		URLs:             []string{"ldap://ldap2/dc=example,dc=org"},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `base DN of "ldap://ldap2/dc=example,dc=org" does not match "ldap://ldap1/dc=example,dc=com"`,
+}, {
+	about: "unparsable additional url",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://ldap1",
+		URLs:             []string{"://"},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `cannot parse URL: parse "?://"?: missing protocol scheme`,
+}, {
+	about: "negative pool size",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
 		UserQueryFilter:  "(userAttr=val)",
 		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
 		GroupQueryFilter: "(groupAttr=val)",
+		PoolSize:         -1,
 	},
-	expectError: `unsupported scheme "ldaps"`,
+	expectError: `invalid 'pool-size' config parameter`,
+}, {
+	about: "negative timeout",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		Timeout:          -time.Second,
+	},
+	expectError: `invalid 'timeout' config parameter`,
 }, {
 	about: "missing user query filter",
 	params: ldap.Params{
@@ -121,6 +195,168 @@ var newTests = []struct {
 		GroupQueryFilter: "(invalid=",
 	},
 	expectError: `invalid 'group-query-filter' config parameter.*`,
+}, {
+	about: "invalid group resolution mode",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "://",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		GroupResolution:  ldap.GroupResolution{Mode: "nested"},
+	},
+	expectError: `invalid 'mode' "nested" in 'group-resolution'`,
+}, {
+	about: "negative group resolution max depth",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "://",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		GroupResolution: ldap.GroupResolution{
+			Mode:     "recursive",
+			MaxDepth: -1,
+		},
+	},
+	expectError: `invalid 'max-depth' in 'group-resolution'`,
+}, {
+	about: "recursive group resolution without group query filter",
+	params: ldap.Params{
+		Name:            "ldap",
+		URL:             "://",
+		UserQueryFilter: "(userAttr=val)",
+		UserQueryAttrs:  ldap.UserQueryAttrs{ID: "uid"},
+		GroupResolution: ldap.GroupResolution{Mode: "recursive"},
+	},
+	expectError: `missing 'group-query-filter' config parameter`,
+}, {
+	about: "in-chain group resolution without group query filter",
+	params: ldap.Params{
+		Name:            "ldap",
+		URL:             "ldap://localhost",
+		UserQueryFilter: "(userAttr=val)",
+		UserQueryAttrs:  ldap.UserQueryAttrs{ID: "uid"},
+		GroupResolution: ldap.GroupResolution{Mode: "in-chain"},
+	},
+}, {
+	about: "member-of group resolution without group query filter",
+	params: ldap.Params{
+		Name:            "ldap",
+		URL:             "ldap://localhost",
+		UserQueryFilter: "(userAttr=val)",
+		UserQueryAttrs:  ldap.UserQueryAttrs{ID: "uid"},
+		GroupResolution: ldap.GroupResolution{Mode: "member-of"},
+	},
+}, {
+	about: "invalid sync deprovision action",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		Sync:             &ldap.SyncParams{Deprovision: "delete"},
+	},
+	expectError: `invalid 'deprovision' "delete" in 'sync'`,
+}, {
+	about: "negative sync interval",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		Sync:             &ldap.SyncParams{Interval: -time.Minute},
+	},
+	expectError: `invalid 'interval' in 'sync'`,
+}, {
+	about: "negative sync page size",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		Sync:             &ldap.SyncParams{PageSize: -1},
+	},
+	expectError: `invalid 'page-size' in 'sync'`,
+}, {
+	about: "attribute mapping without attribute",
+	params: ldap.Params{
+		Name:              "ldap",
+		URL:               "ldap://localhost",
+		UserQueryFilter:   "(userAttr=val)",
+		UserQueryAttrs:    ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter:  "(groupAttr=val)",
+		AttributeMappings: []ldap.AttributeMapping{{ExtraInfo: "department"}},
+	},
+	expectError: `missing 'attribute' in 'attribute-mappings'`,
+}, {
+	about: "attribute mapping without target",
+	params: ldap.Params{
+		Name:              "ldap",
+		URL:               "ldap://localhost",
+		UserQueryFilter:   "(userAttr=val)",
+		UserQueryAttrs:    ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter:  "(groupAttr=val)",
+		AttributeMappings: []ldap.AttributeMapping{{Attribute: "department"}},
+	},
+	expectError: `attribute mapping for "department" must have one of 'extra-info' or 'provider-info'`,
+}, {
+	about: "attribute mapping with two targets",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		AttributeMappings: []ldap.AttributeMapping{{
+			Attribute:    "department",
+			ExtraInfo:    "department",
+			ProviderInfo: "department",
+		}},
+	},
+	expectError: `attribute mapping for "department" must have one of 'extra-info' or 'provider-info'`,
+}, {
+	about: "invalid extra-info key",
+	params: ldap.Params{
+		Name:              "ldap",
+		URL:               "ldap://localhost",
+		UserQueryFilter:   "(userAttr=val)",
+		UserQueryAttrs:    ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter:  "(groupAttr=val)",
+		AttributeMappings: []ldap.AttributeMapping{{Attribute: "department", ExtraInfo: "org.department"}},
+	},
+	expectError: `invalid 'extra-info' key "org.department" in 'attribute-mappings'`,
+}, {
+	about: "reserved extra-info key",
+	params: ldap.Params{
+		Name:              "ldap",
+		URL:               "ldap://localhost",
+		UserQueryFilter:   "(userAttr=val)",
+		UserQueryAttrs:    ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter:  "(groupAttr=val)",
+		AttributeMappings: []ldap.AttributeMapping{{Attribute: "sshPublicKey", ExtraInfo: "sshkeys"}},
+	},
+	expectError: `'extra-info' key "sshkeys" in 'attribute-mappings' is already in use`,
+}, {
+	about: "duplicate provider-info key",
+	params: ldap.Params{
+		Name:             "ldap",
+		URL:              "ldap://localhost",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+		AttributeMappings: []ldap.AttributeMapping{{
+			Attribute:    "department",
+			ProviderInfo: "department",
+		}, {
+			Attribute:    "ou",
+			ProviderInfo: "department",
+		}},
+	},
+	expectError: `'provider-info' key "department" in 'attribute-mappings' is already in use`,
 }}
 
 func getSampleLdapDB() ldapDB {
@@ -154,11 +390,17 @@ func getSampleParams() ldap.Params {
 }
 
 func (s *ldapSuite) setupIdp(c *qt.C, params ldap.Params, db ldapDB) idp.IdentityProvider {
+	i, _ := s.setupIdpWithDialer(c, params, db)
+	return i
+}
+
+func (s *ldapSuite) setupIdpWithDialer(c *qt.C, params ldap.Params, db ldapDB) (idp.IdentityProvider, *mockLDAPDialer) {
 	i, err := ldap.NewIdentityProvider(params)
 	c.Assert(err, qt.IsNil)
-	ldap.SetLDAP(i, newMockLDAPDialer(db).Dial)
+	d := newMockLDAPDialer(db)
+	ldap.SetLDAP(i, d.Dial)
 	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
-	return i
+	return i, d
 }
 
 func (s *ldapSuite) TestNewIdentityProvider(c *qt.C) {
@@ -381,6 +623,184 @@ func (s *ldapSuite) TestHandleCustomGroupFilter(c *qt.C) {
 	c.Assert(groups, qt.DeepEquals, []string{"group1", "group2"})
 }
 
+// nestedGroupDocs holds groups in which group1 directly contains user1,
+// group2 contains group1, group3 contains group2 and group4 contains
+// group3 and group2. group5 contains only user2.
+var nestedGroupDocs = []ldapDoc{{
+	"dn":          {"cn=group1,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group1"},
+	"member":      {"uid=user1,ou=users,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group2,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group2"},
+	"member":      {"cn=group1,ou=groups,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group3,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group3"},
+	"member":      {"cn=group2,ou=groups,dc=example,dc=com"},
+}, {
+	"dn":          {"cn=group4,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group4"},
+	"member": {
+		"cn=group3,ou=groups,dc=example,dc=com",
+		"CN=Group2,OU=Groups,DC=example,DC=com",
+	},
+}, {
+	"dn":          {"cn=group5,ou=groups,dc=example,dc=com"},
+	"objectClass": {"groupOfNames"},
+	"cn":          {"group5"},
+	"member":      {"uid=user2,ou=users,dc=example,dc=com"},
+}}
+
+var groupResolutionTests = []struct {
+	about           string
+	groupResolution ldap.GroupResolution
+	docs            []ldapDoc
+	username        string
+	password        string
+	expectGroups    []string
+}{{
+	about:        "direct",
+	docs:         nestedGroupDocs,
+	expectGroups: []string{"group1"},
+}, {
+	about: "recursive",
+	groupResolution: ldap.GroupResolution{
+		Mode: "recursive",
+	},
+	docs:         nestedGroupDocs,
+	expectGroups: []string{"group1", "group2", "group3", "group4"},
+}, {
+	about: "recursive max depth",
+	groupResolution: ldap.GroupResolution{
+		Mode:     "recursive",
+		MaxDepth: 2,
+	},
+	docs:         nestedGroupDocs,
+	expectGroups: []string{"group1", "group2"},
+}, {
+	about: "recursive loop",
+	groupResolution: ldap.GroupResolution{
+		Mode: "recursive",
+	},
+	docs: []ldapDoc{{
+		"dn":          {"cn=group1,ou=groups,dc=example,dc=com"},
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group1"},
+		"member": {
+			"uid=user1,ou=users,dc=example,dc=com",
+			"cn=group2,ou=groups,dc=example,dc=com",
+		},
+	}, {
+		"dn":          {"cn=group2,ou=groups,dc=example,dc=com"},
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group2"},
+		"member":      {"cn=group1,ou=groups,dc=example,dc=com"},
+	}},
+	expectGroups: []string{"group1", "group2"},
+}, {
+	about: "in-chain",
+	groupResolution: ldap.GroupResolution{
+		Mode: "in-chain",
+	},
+	docs: []ldapDoc{{
+		"dn":     {"cn=group1,ou=groups,dc=example,dc=com"},
+		"cn":     {"group1"},
+		"member": {"uid=user1,ou=users,dc=example,dc=com"},
+	}, {
+		"dn":     {"cn=group2,ou=groups,dc=example,dc=com"},
+		"cn":     {"group2"},
+		"member": {"cn=group1,ou=groups,dc=example,dc=com"},
+	}, {
+		"dn":     {"cn=group3,ou=groups,dc=example,dc=com"},
+		"cn":     {"group3"},
+		"member": {"uid=user2,ou=users,dc=example,dc=com"},
+	}},
+	expectGroups: []string{"group1", "group2"},
+}, {
+	about: "in-chain custom attributes",
+	groupResolution: ldap.GroupResolution{
+		Mode:       "in-chain",
+		MemberAttr: "uniqueMember",
+		NameAttr:   "name",
+	},
+	docs: []ldapDoc{{
+		"dn":           {"cn=group1,ou=groups,dc=example,dc=com"},
+		"name":         {"Group One"},
+		"uniqueMember": {"uid=user1,ou=users,dc=example,dc=com"},
+	}, {
+		"dn":           {"cn=group2,ou=groups,dc=example,dc=com"},
+		"name":         {"Group Two"},
+		"uniqueMember": {"cn=group1,ou=groups,dc=example,dc=com"},
+	}},
+	expectGroups: []string{"Group One", "Group Two"},
+}, {
+	about: "member-of",
+	groupResolution: ldap.GroupResolution{
+		Mode: "member-of",
+	},
+	docs: []ldapDoc{{
+		"dn":           {"uid=user3,ou=users,dc=example,dc=com"},
+		"objectClass":  {"account"},
+		"uid":          {"user3"},
+		"userPassword": {"pass3"},
+		"memberOf": {
+			"cn=group1,ou=groups,dc=example,dc=com",
+			"ou=group2+cn=Group Two,ou=groups,dc=example,dc=com",
+			"ou=group3,dc=example,dc=com",
+			"invalid",
+		},
+	}},
+	username:     "user3",
+	password:     "pass3",
+	expectGroups: []string{"group1", "Group Two", "group3"},
+}, {
+	about: "member-of custom attribute",
+	groupResolution: ldap.GroupResolution{
+		Mode:         "member-of",
+		MemberOfAttr: "isMemberOf",
+	},
+	docs: []ldapDoc{{
+		"dn":           {"uid=user3,ou=users,dc=example,dc=com"},
+		"objectClass":  {"account"},
+		"uid":          {"user3"},
+		"userPassword": {"pass3"},
+		"memberOf":     {"cn=group1,ou=groups,dc=example,dc=com"},
+		"isMemberOf":   {"cn=group2,ou=groups,dc=example,dc=com"},
+	}},
+	username:     "user3",
+	password:     "pass3",
+	expectGroups: []string{"group2"},
+}}
+
+func (s *ldapSuite) TestGroupResolution(c *qt.C) {
+	for _, test := range groupResolutionTests {
+		c.Run(test.about, func(c *qt.C) {
+			params := getSampleParams()
+			params.GroupResolution = test.groupResolution
+			sampleDB := append(getSampleLdapDB(), test.docs...)
+			username, password := test.username, test.password
+			if username == "" {
+				username, password = "user1", "pass1"
+			}
+			i := s.setupIdp(c, params, sampleDB)
+			id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm(username, password))
+			c.Assert(err, qt.IsNil)
+			identity := s.idptest.Store.AssertUser(c, &store.Identity{
+				ProviderID: id.ProviderID,
+				Username:   username,
+			})
+			groups, err := i.GetGroups(s.idptest.Ctx, identity)
+			c.Assert(err, qt.IsNil)
+			c.Assert(groups, qt.DeepEquals, test.expectGroups)
+		})
+	}
+}
+
 func (s *ldapSuite) TestHandleIncorrectUsername(c *qt.C) {
 	i := s.setupIdp(c, getSampleParams(), getSampleLdapDB())
 	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user-not-there", "wrong"))
@@ -403,3 +823,158 @@ func (s *ldapSuite) TestHandleUserFilterNoMatch(c *qt.C) {
 	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
 	c.Assert(err, qt.ErrorMatches, `user &#34;user1&#34; not found: not found`)
 }
+
+func (s *ldapSuite) TestLDAPS(c *qt.C) {
+	params := getSampleParams()
+	params.URL = "ldaps://ldap.example.com/dc=example,dc=com"
+	i, d := s.setupIdpWithDialer(c, params, getSampleLdapDB())
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+
+	conns := d.connections()
+	c.Assert(conns, qt.HasLen, 1)
+	c.Check(conns[0].address, qt.Equals, "ldap.example.com:ldaps")
+	c.Check(conns[0].ldaps, qt.Equals, true)
+	c.Check(conns[0].tlsConfig.ServerName, qt.Equals, "ldap.example.com")
+}
+
+func (s *ldapSuite) TestConnectionReuse(c *qt.C) {
+	params := getSampleParams()
+	params.Timeout = 5 * time.Second
+	i, d := s.setupIdpWithDialer(c, params, getSampleLdapDB())
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	identity := s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity(
+			"test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username: id.Username,
+	})
+	for n := 0; n < 3; n++ {
+		_, err := i.GetGroups(s.idptest.Ctx, identity)
+		c.Assert(err, qt.IsNil)
+	}
+
+	conns := d.connections()
+	c.Assert(conns, qt.HasLen, 1)
+	c.Check(conns[0].address, qt.Equals, "localhost:ldap")
+	c.Check(conns[0].ldaps, qt.Equals, false)
+	c.Check(conns[0].tlsConfig.ServerName, qt.Equals, "localhost")
+	c.Check(conns[0].dialTimeout, qt.Equals, 5*time.Second)
+	c.Check(conns[0].timeout, qt.Equals, 5*time.Second)
+	c.Check(conns[0].closed, qt.Equals, false)
+	// The connection was bound as the search user again after the
+	// user logged in.
+	c.Check(conns[0].boundUsername, qt.Equals, "cn=test,dc=example,dc=com")
+}
+
+func (s *ldapSuite) TestFailover(c *qt.C) {
+	params := getSampleParams()
+	params.URL = "ldap://ldap1/dc=example,dc=com"
+	params.URLs = []string{"ldap://ldap2/dc=example,dc=com"}
+	params.HealthCheckInterval = time.Hour
+	i, d := s.setupIdpWithDialer(c, params, getSampleLdapDB())
+	d.setDown("ldap1:ldap", true)
+
+	failures := serverFailures(c, "test", "ldap://ldap1/dc=example,dc=com")
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	conns := d.connections()
+	c.Assert(conns, qt.HasLen, 1)
+	c.Check(conns[0].address, qt.Equals, "ldap2:ldap")
+	c.Check(serverFailures(c, "test", "ldap://ldap1/dc=example,dc=com"), qt.Equals, failures+1)
+
+	// When the second server fails the request is retried on a new
+	// connection to the first server, even though it failed
+	// recently.
+	d.setDown("ldap1:ldap", false)
+	d.setDown("ldap2:ldap", true)
+	identity := s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity(
+			"test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username: "user1",
+	})
+	_, err = i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.IsNil)
+	conns = d.connections()
+	c.Assert(conns, qt.HasLen, 2)
+	c.Check(conns[0].closed, qt.Equals, true)
+	c.Check(conns[1].address, qt.Equals, "ldap1:ldap")
+
+	// When all the servers are down the request fails.
+	d.setDown("ldap1:ldap", true)
+	_, err = i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.ErrorMatches, `.*cannot connect to ldap2:ldap`)
+}
+
+func (s *ldapSuite) TestIdleConnectionCheck(c *qt.C) {
+	params := getSampleParams()
+	params.HealthCheckInterval = time.Nanosecond
+	i, d := s.setupIdpWithDialer(c, params, getSampleLdapDB())
+	identity := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(
+			"test", "uid=user1,ou=users,dc=example,dc=com"),
+	}
+	_, err := i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.IsNil)
+
+	// An idle connection that is still working is reused.
+	_, err = i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.IsNil)
+	conns := d.connections()
+	c.Assert(conns, qt.HasLen, 1)
+	c.Check(conns[0].searches, qt.Equals, 3)
+
+	// A broken idle connection is replaced before it is used.
+	d.setDown("localhost:ldap", true)
+	d.setDown("localhost:ldap", false)
+	_, err = i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.IsNil)
+	conns = d.connections()
+	c.Assert(conns, qt.HasLen, 2)
+	c.Check(conns[0].closed, qt.Equals, true)
+	c.Check(conns[1].searches, qt.Equals, 1)
+}
+
+func (s *ldapSuite) TestPoolSize(c *qt.C) {
+	params := getSampleParams()
+	params.PoolSize = 1
+	params.Timeout = 10 * time.Millisecond
+	i, d := s.setupIdpWithDialer(c, params, getSampleLdapDB())
+	identity := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(
+			"test", "uid=user1,ou=users,dc=example,dc=com"),
+	}
+
+	release, err := ldap.AcquireConn(i)
+	c.Assert(err, qt.IsNil)
+	_, err = i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.ErrorMatches, `timed out waiting for LDAP connection`)
+
+	release()
+	_, err = i.GetGroups(s.idptest.Ctx, identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.connections(), qt.HasLen, 1)
+}
+
+// serverFailures returns the value of the LDAP server failures metric
+// for the given identity provider and server.
+func serverFailures(c *qt.C, idpName, server string) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	c.Assert(err, qt.IsNil)
+	for _, mf := range mfs {
+		if mf.GetName() != "candid_ldap_server_failures_count" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["idp"] == idpName && labels["server"] == server {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
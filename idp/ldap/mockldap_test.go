@@ -6,6 +6,8 @@ package ldap_test
 import (
 	"crypto/tls"
 	"fmt"
+	"sync"
+	"time"
 
 	"gopkg.in/asn1-ber.v1"
 	errgo "gopkg.in/errgo.v1"
@@ -15,22 +17,62 @@ import (
 )
 
 type mockLDAPDialer struct {
-	db    ldapDB
+	db ldapDB
+
+	mu    sync.Mutex
 	conns []*mockLDAPConn
+	// down holds the addresses of servers that cannot be reached.
+	down map[string]bool
 }
 
 func newMockLDAPDialer(db ldapDB) *mockLDAPDialer {
 	d := &mockLDAPDialer{db: db}
 	d.conns = []*mockLDAPConn{}
+	d.down = make(map[string]bool)
 	return d
 }
 
-func (d *mockLDAPDialer) Dial(network, address string) (idpldap.LDAPConn, error) {
-	conn := &mockLDAPConn{network: network, address: address, db: d.db}
+func (d *mockLDAPDialer) Dial(network, address string, tlsConfig *tls.Config, timeout time.Duration) (idpldap.LDAPConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down[address] {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errgo.Newf("cannot connect to %s", address))
+	}
+	conn := &mockLDAPConn{
+		network:     network,
+		address:     address,
+		dialTimeout: timeout,
+		ldaps:       tlsConfig != nil,
+		tlsConfig:   tlsConfig,
+		db:          d.db,
+	}
 	d.conns = append(d.conns, conn)
 	return conn, nil
 }
 
+// setDown sets whether the server at the given address can be reached.
+// When a server goes down all existing connections to it are broken.
+func (d *mockLDAPDialer) setDown(address string, down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down[address] = down
+	if !down {
+		return
+	}
+	for _, c := range d.conns {
+		if c.address == address {
+			c.broken = true
+		}
+	}
+}
+
+// connections returns the connections that have been made.
+func (d *mockLDAPDialer) connections() []*mockLDAPConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*mockLDAPConn(nil), d.conns...)
+}
+
 type mockLDAPConn struct {
 	db ldapDB
 	// network and address are set to the arguments passed to the dial
@@ -38,8 +80,21 @@ type mockLDAPConn struct {
 	network string
 	address string
 
-	// tlsConfig is set when StartTLS is called.
+	// dialTimeout is set to the timeout passed to the dial function.
+	dialTimeout time.Duration
+	// ldaps is set if the connection was dialed with TLS.
+	ldaps bool
+	// tlsConfig is set when the connection is dialed with TLS or
+	// when StartTLS is called.
 	tlsConfig *tls.Config
+	// timeout is set when SetTimeout is called.
+	timeout time.Duration
+	// searches counts the number of times Search is called.
+	searches int
+	// broken is set when the connection to the server has failed.
+	broken bool
+	// pagingSize is set when SearchWithPaging is called.
+	pagingSize uint32
 	// searchReq is set when Search is called.
 	searchReq *ldap.SearchRequest
 	// boundUsername and boundPassword are set when Bind is called.
@@ -54,13 +109,30 @@ func (c *mockLDAPConn) StartTLS(config *tls.Config) error {
 	return nil
 }
 
+func (c *mockLDAPConn) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
 func (c *mockLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.broken || c.closed {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errgo.New("ldap: connection closed"))
+	}
 	c.searchReq = req
+	c.searches++
 
 	found, err := c.db.Search(req.Filter)
 	if err != nil {
 		return nil, err
 	}
+	if req.Scope == ldap.ScopeBaseObject {
+		var base []ldapDoc
+		for _, doc := range found {
+			if doc["dn"][0] == req.BaseDN {
+				base = append(base, doc)
+			}
+		}
+		found = base
+	}
 
 	entries := make([]*ldap.Entry, len(found))
 	for i, res := range found {
@@ -84,7 +156,21 @@ func (c *mockLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, erro
 	return &ldap.SearchResult{Entries: entries}, nil
 }
 
+func (c *mockLDAPConn) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	c.pagingSize = pagingSize
+	return c.Search(req)
+}
+
 func (c *mockLDAPConn) Bind(username, password string) error {
+	if c.broken || c.closed {
+		return ldap.NewError(ldap.ErrorNetwork, errgo.New("ldap: connection closed"))
+	}
+	if username == "" && password == "" {
+		// Anonymous bind.
+		c.boundUsername = ""
+		c.boundPassword = ""
+		return nil
+	}
 	for _, entry := range c.db {
 		dn, ok := entry["dn"]
 		if !ok || len(dn) == 0 || dn[0] != username {
@@ -112,7 +198,7 @@ type ldapDoc map[string][]string
 type ldapDB []ldapDoc
 
 func (db ldapDB) Search(filter string) ([]ldapDoc, error) {
-	match, err := filterMatcher(filter)
+	match, err := db.filterMatcher(filter)
 	if err != nil {
 		return nil, err
 	}
@@ -128,20 +214,20 @@ func (db ldapDB) Search(filter string) ([]ldapDoc, error) {
 
 // filterMatcher returns a function that reports whether a given LDAP document
 // matches the LDAP filter. It returns an error if the filter is malformed.
-func filterMatcher(filter string) (func(ldapDoc) bool, error) {
+func (db ldapDB) filterMatcher(filter string) (func(ldapDoc) bool, error) {
 	packet, err := ldap.CompileFilter(filter)
 	if err != nil {
 		return nil, err
 	}
-	return packetFilterMatcher(packet), nil
+	return db.packetFilterMatcher(packet), nil
 }
 
-func packetFilterMatcher(packet *ber.Packet) func(ldapDoc) bool {
+func (db ldapDB) packetFilterMatcher(packet *ber.Packet) func(ldapDoc) bool {
 	switch packet.Tag {
 	case ldap.FilterAnd:
 		var children []func(ldapDoc) bool
 		for _, child := range packet.Children {
-			children = append(children, packetFilterMatcher(child))
+			children = append(children, db.packetFilterMatcher(child))
 		}
 		return func(doc ldapDoc) bool {
 			for _, child := range children {
@@ -154,7 +240,7 @@ func packetFilterMatcher(packet *ber.Packet) func(ldapDoc) bool {
 	case ldap.FilterOr:
 		var children []func(ldapDoc) bool
 		for _, child := range packet.Children {
-			children = append(children, packetFilterMatcher(child))
+			children = append(children, db.packetFilterMatcher(child))
 		}
 		return func(doc ldapDoc) bool {
 			for _, child := range children {
@@ -165,11 +251,18 @@ func packetFilterMatcher(packet *ber.Packet) func(ldapDoc) bool {
 			return true
 		}
 	case ldap.FilterNot:
-		child := packetFilterMatcher(packet.Children[0])
+		child := db.packetFilterMatcher(packet.Children[0])
 		return func(doc ldapDoc) bool {
 			return !child(doc)
 		}
 
+	case ldap.FilterPresent:
+		attr := string(packet.Data.Bytes())
+		return func(doc ldapDoc) bool {
+			_, ok := doc[attr]
+			return ok
+		}
+
 	case ldap.FilterEqualityMatch:
 		expected := string(packet.Children[1].Data.Bytes())
 		return func(doc ldapDoc) bool {
@@ -185,7 +278,48 @@ func packetFilterMatcher(packet *ber.Packet) func(ldapDoc) bool {
 			return false
 		}
 
+	case ldap.FilterExtensibleMatch:
+		var rule, attr, value string
+		for _, child := range packet.Children {
+			switch child.Tag {
+			case ldap.MatchingRuleAssertionMatchingRule:
+				rule = string(child.Data.Bytes())
+			case ldap.MatchingRuleAssertionType:
+				attr = string(child.Data.Bytes())
+			case ldap.MatchingRuleAssertionMatchValue:
+				value = string(child.Data.Bytes())
+			}
+		}
+		if rule != "1.2.840.113556.1.4.1941" {
+			panic(fmt.Sprintf("unimplemented matching rule: %v", rule))
+		}
+		// LDAP_MATCHING_RULE_IN_CHAIN matches any entry that
+		// refers to the value through a chain of attr values.
+		return func(doc ldapDoc) bool {
+			return db.inChain(doc, attr, value, make(map[string]bool))
+		}
+
 	default:
 		panic(fmt.Sprintf("unimplemented tag: %v", packet.Tag))
 	}
 }
+
+// inChain reports whether the given document refers to the given DN
+// through a chain of attr values.
+func (db ldapDB) inChain(doc ldapDoc, attr, dn string, seen map[string]bool) bool {
+	if seen[doc["dn"][0]] {
+		return false
+	}
+	seen[doc["dn"][0]] = true
+	for _, v := range doc[attr] {
+		if v == dn {
+			return true
+		}
+		for _, d := range db {
+			if d["dn"][0] == v && db.inChain(d, attr, dn, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
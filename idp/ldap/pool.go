@@ -0,0 +1,225 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/canonical/candid/internal/monitoring"
+)
+
+// A server holds the details of one of the LDAP servers that the
+// identity provider connects to.
+type server struct {
+	// url holds the URL of the server as configured.
+	url string
+
+	network string
+	address string
+
+	// ldaps is set if TLS is used from the start of the connection,
+	// rather than being started with StartTLS.
+	ldaps     bool
+	tlsConfig *tls.Config
+
+	// mu protects the fields below it.
+	mu sync.Mutex
+
+	// downUntil holds the time until which the server should not be
+	// used because a connection to it failed.
+	downUntil time.Time
+}
+
+// available reports whether the server should be tried at the given
+// time.
+func (s *server) available(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.downUntil)
+}
+
+// setDownUntil marks the server as unavailable until the given time.
+func (s *server) setDownUntil(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downUntil = t
+}
+
+// A pool holds connections that are bound as the search user so that
+// they can be reused between requests. The number of connections that
+// can be in use at any time is bounded.
+type pool struct {
+	// dial establishes a new bound connection.
+	dial func() (*server, ldapConn, error)
+
+	// bind binds the given connection as the search user.
+	bind func(ldapConn) error
+
+	// check checks that the given connection is still usable.
+	check func(ldapConn) error
+
+	// timeout is the maximum time to wait for a connection when
+	// all the connections are in use.
+	timeout time.Duration
+
+	// checkInterval is the time that a connection may be idle
+	// before it is checked again.
+	checkInterval time.Duration
+
+	metrics monitoring.LDAPMetrics
+
+	// slots holds a value for every connection that is in use.
+	slots chan struct{}
+
+	// mu protects the fields below it.
+	mu    sync.Mutex
+	idle  []*poolConn
+	inUse int
+}
+
+// A poolConn is a connection obtained from a pool.
+type poolConn struct {
+	ldapConn
+
+	// server holds the server that the connection is to.
+	server *server
+
+	// userBound is set when the connection has been bound as a user
+	// other than the search user.
+	userBound bool
+
+	// lastUsed holds the time the connection was returned to the
+	// pool.
+	lastUsed time.Time
+}
+
+// get returns a connection from the pool, establishing a new connection
+// if there are no idle connections. If the maximum number of
+// connections are already in use then get waits for one to be returned.
+func (p *pool) get(ctx context.Context) (*poolConn, error) {
+	t := time.NewTimer(p.timeout)
+	defer t.Stop()
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errgo.Notef(ctx.Err(), "cannot get LDAP connection")
+	case <-t.C:
+		p.metrics.PoolWaitTimedOut()
+		return nil, errgo.Newf("timed out waiting for LDAP connection")
+	}
+	for {
+		pc := p.takeIdle()
+		if pc == nil {
+			break
+		}
+		if time.Since(pc.lastUsed) < p.checkInterval {
+			return pc, nil
+		}
+		err := p.check(pc)
+		if err == nil {
+			return pc, nil
+		}
+		logger.Infof("discarding LDAP connection to %s: %s", pc.server.url, err)
+		p.close(pc)
+	}
+	s, conn, err := p.dial()
+	if err != nil {
+		<-p.slots
+		return nil, errgo.Mask(err)
+	}
+	pc := &poolConn{
+		ldapConn: conn,
+		server:   s,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse++
+	p.updateMetrics()
+	return pc, nil
+}
+
+// put returns a connection obtained from get to the pool. If reuse is
+// false, or the connection cannot be bound as the search user again,
+// the connection is closed.
+func (p *pool) put(pc *poolConn, reuse bool) {
+	if reuse && pc.userBound {
+		if err := p.bind(pc.ldapConn); err != nil {
+			logger.Infof("cannot rebind LDAP connection to %s: %s", pc.server.url, err)
+			reuse = false
+		}
+		pc.userBound = false
+	}
+	if !reuse {
+		p.discard(pc)
+		return
+	}
+	pc.lastUsed = time.Now()
+	p.mu.Lock()
+	p.inUse--
+	p.idle = append(p.idle, pc)
+	p.updateMetrics()
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// takeIdle removes the most recently used idle connection from the
+// pool and returns it, or returns nil if there are no idle
+// connections.
+func (p *pool) takeIdle() *poolConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	pc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	p.inUse++
+	p.updateMetrics()
+	return pc
+}
+
+// discard closes a connection obtained from the pool, allowing another
+// connection to be used in its place.
+func (p *pool) discard(pc *poolConn) {
+	p.close(pc)
+	<-p.slots
+}
+
+// close closes a connection obtained from the pool.
+func (p *pool) close(pc *poolConn) {
+	pc.Close()
+	p.mu.Lock()
+	p.inUse--
+	p.updateMetrics()
+	p.mu.Unlock()
+}
+
+// updateMetrics updates the pool metrics. It must be called with p.mu
+// held.
+func (p *pool) updateMetrics() {
+	p.metrics.SetPoolConnections(len(p.idle), p.inUse)
+}
+
+// isNetworkError reports whether any error in the chain of errors
+// underlying err was caused by a failure of the connection to the LDAP
+// server, including an operation timing out.
+func isNetworkError(err error) bool {
+	for err != nil {
+		if ldap.IsErrorWithCode(errgo.Cause(err), ldap.ErrorNetwork) {
+			return true
+		}
+		w, ok := err.(errgo.Wrapper)
+		if !ok {
+			return false
+		}
+		err = w.Underlying()
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// Deprovisioning actions.
+const (
+	// deprovisionDisable disables identities that are no longer in
+	// the directory, so that they are retained but can no longer be
+	// used.
+	deprovisionDisable = "disable"
+
+	// deprovisionRemove removes identities that are no longer in
+	// the directory from the store. Identities that own other
+	// identities, such as agents, are disabled instead.
+	deprovisionRemove = "remove"
+)
+
+const (
+	// defaultSyncPageSize is the default number of entries requested
+	// in each page of directory search results.
+	defaultSyncPageSize = 500
+
+	// syncDisabledReason holds the reason recorded when an identity is
+	// disabled because it is no longer in the directory. Only
+	// identities disabled for this reason are enabled again if they
+	// reappear.
+	syncDisabledReason = "not found in LDAP directory"
+)
+
+// SyncParams defines how the identities created by the identity
+// provider are synchronised with the directory.
+type SyncParams struct {
+	// Interval is the time between scheduled syncs. If this is zero
+	// then identities are only synchronised on request.
+	Interval time.Duration `yaml:"interval"`
+
+	// PageSize is the number of entries requested in each page of
+	// directory search results. If this is zero then 500 is used.
+	PageSize int `yaml:"page-size"`
+
+	// Deprovision is the action taken for identities whose users no
+	// longer match UserQueryFilter. It is either "disable" or
+	// "remove". If this is not set then "disable" is used. Identities
+	// that own other identities are always disabled.
+	Deprovision string `yaml:"deprovision"`
+
+	// DryRun is set if scheduled syncs should only report the
+	// changes that would be made, without making them.
+	DryRun bool `yaml:"dry-run"`
+}
+
+// setDefaults checks the sync parameters and sets the defaults for any
+// that are not set.
+func (p *SyncParams) setDefaults() error {
+	if p.Interval < 0 {
+		return errgo.Newf("invalid 'interval' in 'sync'")
+	}
+	if p.PageSize < 0 {
+		return errgo.Newf("invalid 'page-size' in 'sync'")
+	}
+	if p.PageSize == 0 {
+		p.PageSize = defaultSyncPageSize
+	}
+	switch p.Deprovision {
+	case "":
+		p.Deprovision = deprovisionDisable
+	case deprovisionDisable, deprovisionRemove:
+	default:
+		return errgo.Newf("invalid 'deprovision' %q in 'sync'", p.Deprovision)
+	}
+	return nil
+}
+
+// A syncingIdentityProvider is an LDAP identity provider that
+// synchronises its identities with the directory. It is used when the
+// sync parameters are specified.
+type syncingIdentityProvider struct {
+	*identityProvider
+
+	// syncMu is held while a sync is running, so that only one sync
+	// runs at a time.
+	syncMu sync.Mutex
+
+	// mu protects the fields below it.
+	mu       sync.Mutex
+	lastSync *params.SyncResult
+}
+
+var _ idp.Syncer = (*syncingIdentityProvider)(nil)
+
+// Init implements idp.IdentityProvider.Init. If an interval is
+// configured then syncs are run at that interval until the given
+// context is done.
+func (idp *syncingIdentityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	if err := idp.identityProvider.Init(ctx, params); err != nil {
+		return errgo.Mask(err)
+	}
+	if idp.params.Sync.Interval > 0 {
+		go idp.runSync(ctx)
+	}
+	return nil
+}
+
+// runSync runs a sync immediately and then at every interval until the
+// given context is done.
+func (idp *syncingIdentityProvider) runSync(ctx context.Context) {
+	for {
+		sctx, close := idp.initParams.Store.Context(ctx)
+		idp.Sync(sctx, idp.params.Sync.DryRun)
+		close()
+		select {
+		case <-time.After(idp.params.Sync.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LastSync implements idp.Syncer.LastSync.
+func (idp *syncingIdentityProvider) LastSync() *params.SyncResult {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.lastSync
+}
+
+// Sync implements idp.Syncer.Sync. Identities are created or updated
+// for all the users that match UserQueryFilter, with their groups held
+// in ProviderInfo. Identities created by the identity provider for
+// users that are no longer in the directory are deprovisioned.
+func (idp *syncingIdentityProvider) Sync(ctx context.Context, dryRun bool) *params.SyncResult {
+	idp.syncMu.Lock()
+	defer idp.syncMu.Unlock()
+	r := &params.SyncResult{
+		IDP:     idp.params.Name,
+		DryRun:  dryRun,
+		Started: time.Now(),
+	}
+	if err := idp.sync(ctx, r); err != nil {
+		logger.Errorf("cannot sync LDAP identities for %s: %s", idp.params.Name, err)
+		r.Error = err.Error()
+	}
+	r.Finished = time.Now()
+	logger.Infof("LDAP sync for %s (dry run %v): %d created, %d updated, %d enabled, %d disabled, %d removed, %d errors",
+		idp.params.Name, dryRun, len(r.Created), len(r.Updated), len(r.Enabled), len(r.Disabled), len(r.Removed), len(r.Errors))
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.lastSync = r
+	return r
+}
+
+// sync synchronises the identities with the directory, recording the
+// changes in r.
+func (idp *syncingIdentityProvider) sync(ctx context.Context, r *params.SyncResult) error {
+	users, err := idp.directoryUsers(ctx, r)
+	if err != nil {
+		return errgo.Notef(err, "cannot read users from directory")
+	}
+	if len(users) == 0 {
+		// It is much more likely that the directory or the
+		// filter is misconfigured than that every user has gone,
+		// so don't deprovision everyone.
+		return errgo.Newf("no users found in directory")
+	}
+	found := make(map[string]bool, len(users))
+	for _, u := range users {
+		_, dn := u.ProviderID.Split()
+		found[normalizeDN(dn)] = true
+		if err := idp.syncIdentity(ctx, r, u); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: %s", u.Username, err))
+		}
+	}
+	ref := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, ""),
+	}
+	filter := store.Filter{store.ProviderID: store.Prefix}
+	cursor := ""
+	for {
+		ids, next, err := idp.initParams.Store.FindIdentitiesPage(ctx, ref, filter, cursor, idp.params.Sync.PageSize)
+		if err != nil {
+			return errgo.Notef(err, "cannot find identities")
+		}
+		for i := range ids {
+			_, dn := ids[i].ProviderID.Split()
+			if found[normalizeDN(dn)] {
+				continue
+			}
+			if err := idp.deprovisionIdentity(ctx, r, &ids[i]); err != nil {
+				r.Errors = append(r.Errors, fmt.Sprintf("%s: %s", ids[i].Username, err))
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// directoryUsers returns identities for all the users in the directory
+// that match UserQueryFilter, including their groups. Entries that
+// cannot be used are reported in r.
+func (idp *syncingIdentityProvider) directoryUsers(ctx context.Context, r *params.SyncResult) ([]*store.Identity, error) {
+	var users []*store.Identity
+	err := idp.withConn(ctx, "sync", func(conn *poolConn) error {
+		users = nil
+		logger.Tracef("LDAP sync search: basedn=%s scope=sub deref_aliases=never filter=%s attributes=%s", idp.baseDN, idp.params.UserQueryFilter, idp.userQueryAttrs)
+		req := &ldap.SearchRequest{
+			BaseDN:       idp.baseDN,
+			Scope:        ldap.ScopeWholeSubtree,
+			DerefAliases: ldap.NeverDerefAliases,
+			Filter:       idp.params.UserQueryFilter,
+			Attributes:   idp.userQueryAttrs,
+		}
+		res, err := conn.SearchWithPaging(req, uint32(idp.params.Sync.PageSize))
+		if err != nil {
+			logger.Tracef("LDAP search error: %s", err)
+			return errgo.Mask(err)
+		}
+		for _, entry := range res.Entries {
+			id := idp.identityFromEntry(entry.DN, entry)
+			if id.Username == "" {
+				r.Errors = append(r.Errors, fmt.Sprintf("%s: no %s attribute", entry.DN, idp.params.UserQueryAttrs.ID))
+				continue
+			}
+			groups, err := idp.findGroups(conn, entry.DN)
+			if err != nil {
+				return errgo.Notef(err, "cannot find groups for %s", entry.DN)
+			}
+			setInfo(&id.ProviderInfo, groupsKey, groups)
+			users = append(users, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+// syncIdentity creates or updates the identity for the given directory
+// user, recording any change in r.
+func (idp *syncingIdentityProvider) syncIdentity(ctx context.Context, r *params.SyncResult, u *store.Identity) error {
+	existing := store.Identity{
+		ProviderID: u.ProviderID,
+	}
+	err := idp.initParams.Store.Identity(ctx, &existing)
+	if errgo.Cause(err) == store.ErrNotFound {
+		r.Created = append(r.Created, u.Username)
+		if r.DryRun {
+			return nil
+		}
+		return errgo.Mask(idp.updateIdentity(ctx, u, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+			store.Email:    store.Set,
+		}))
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var update store.Update
+	if existing.Username != u.Username {
+		update[store.Username] = store.Set
+	}
+	if existing.Name != u.Name {
+		update[store.Name] = store.Set
+	}
+	if existing.Email != u.Email {
+		update[store.Email] = store.Set
+	}
+	if !sameInfo(existing.ProviderInfo, u.ProviderInfo) {
+		update[store.ProviderInfo] = store.Set
+	}
+	if !sameInfo(existing.ExtraInfo, u.ExtraInfo) {
+		update[store.ExtraInfo] = store.Set
+	}
+	enable := !existing.Disabled.IsZero() && existing.DisabledReason == syncDisabledReason
+	if enable {
+		update[store.Disabled] = store.Set
+		update[store.DisabledReason] = store.Set
+		r.Enabled = append(r.Enabled, u.Username)
+	}
+	if update == (store.Update{}) {
+		return nil
+	}
+	if !enable {
+		r.Updated = append(r.Updated, u.Username)
+	}
+	if r.DryRun {
+		return nil
+	}
+	u.ID = existing.ID
+	if err := idp.updateIdentity(ctx, u, update); err != nil {
+		return errgo.Mask(err)
+	}
+	if enable {
+		idp.audit(ctx, "enable-user", u.Username, []string{syncDisabledReason}, nil)
+	}
+	return nil
+}
+
+// deprovisionIdentity disables or removes the given identity, whose
+// user is no longer in the directory, recording any change in r. An
+// identity that owns other identities is disabled rather than removed,
+// so that the identities it owns are not orphaned.
+func (idp *syncingIdentityProvider) deprovisionIdentity(ctx context.Context, r *params.SyncResult, id *store.Identity) error {
+	action := idp.params.Sync.Deprovision
+	if action == deprovisionRemove {
+		owner, err := store.OwnsIdentities(ctx, idp.initParams.Store, id)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if owner {
+			if id.Disabled.IsZero() {
+				logger.Warningf("not removing %s as it owns other identities, disabling it instead", id.Username)
+			}
+			action = deprovisionDisable
+		}
+	}
+	switch action {
+	case deprovisionRemove:
+		r.Removed = append(r.Removed, id.Username)
+		if r.DryRun {
+			return nil
+		}
+		err := idp.initParams.Store.RemoveIdentity(ctx, &store.Identity{ID: id.ID})
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		idp.audit(ctx, "remove-user", id.Username, id.Groups, nil)
+		return nil
+	default:
+		if !id.Disabled.IsZero() {
+			return nil
+		}
+		r.Disabled = append(r.Disabled, id.Username)
+		if r.DryRun {
+			return nil
+		}
+		err := idp.initParams.Store.UpdateIdentity(ctx, &store.Identity{
+			ID:             id.ID,
+			Disabled:       time.Now(),
+			DisabledReason: syncDisabledReason,
+		}, store.Update{
+			store.Disabled:       store.Set,
+			store.DisabledReason: store.Set,
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		idp.audit(ctx, "disable-user", id.Username, nil, []string{syncDisabledReason})
+		return nil
+	}
+}
+
+// audit records a change made by a sync to the given identity in the
+// audit store, if there is one.
+func (idp *syncingIdentityProvider) audit(ctx context.Context, op, target string, before, after []string) {
+	if idp.initParams.AuditStore == nil {
+		return
+	}
+	err := idp.initParams.AuditStore.AddAuditEntry(ctx, &store.AuditEntry{
+		Operation: op,
+		Target:    target,
+		Before:    before,
+		After:     after,
+	})
+	if err != nil {
+		logger.Errorf("cannot record %s of %s in audit log: %s", op, target, err)
+	}
+}
+
+// sameValues reports whether a and b hold the same values, ignoring
+// order.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameInfo reports whether the values of each key in b are the same as
+// the values of that key in a. Keys in a that are not in b are
+// ignored.
+func sameInfo(a, b map[string][]string) bool {
+	for k, v := range b {
+		if !sameValues(a[k], v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,345 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap_test
+
+import (
+	"context"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/ldap"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func getSyncParams() ldap.Params {
+	p := getSampleParams()
+	p.UserQueryAttrs.Email = "mail"
+	p.UserQueryAttrs.DisplayName = "displayName"
+	p.Sync = &ldap.SyncParams{
+		PageSize: 100,
+	}
+	return p
+}
+
+func getSyncLdapDB() ldapDB {
+	return append(getSampleLdapDB(), ldapDoc{
+		"dn":          {"cn=group1,ou=groups,dc=example,dc=com"},
+		"objectClass": {"groupOfNames"},
+		"cn":          {"group1"},
+		"member":      {"uid=user1,ou=users,dc=example,dc=com"},
+	})
+}
+
+func (s *ldapSuite) setupSyncer(c *qt.C, params ldap.Params, db ldapDB) (idp.Syncer, *mockLDAPDialer) {
+	i, d := s.setupIdpWithDialer(c, params, db)
+	syncer, ok := i.(idp.Syncer)
+	c.Assert(ok, qt.Equals, true)
+	return syncer, d
+}
+
+func (s *ldapSuite) addIdentity(c *qt.C, id *store.Identity) {
+	err := s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, id, store.Update{
+		store.Username:       store.Set,
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+// auditEntries returns the entries in the audit log, without their IDs
+// and times.
+func (s *ldapSuite) auditEntries(c *qt.C) []store.AuditEntry {
+	entries, err := s.idptest.Store.AuditStore.FindAuditEntries(s.idptest.Ctx, store.AuditFilter{})
+	c.Assert(err, qt.IsNil)
+	for i := range entries {
+		entries[i].ID = ""
+		entries[i].Time = time.Time{}
+	}
+	return entries
+}
+
+func (s *ldapSuite) TestNoSyncWithoutParams(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams(), getSampleLdapDB())
+	_, ok := i.(idp.Syncer)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func (s *ldapSuite) TestSync(c *qt.C) {
+	db := getSyncLdapDB()
+	db[1]["mail"] = []string{"user1@example.com"}
+	db[1]["displayName"] = []string{"User One"}
+	syncer, d := s.setupSyncer(c, getSyncParams(), db)
+	c.Assert(syncer.LastSync(), qt.IsNil)
+
+	// An identity for a user no longer in the directory.
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user3,ou=users,dc=example,dc=com"),
+		Username:   "user3",
+	})
+	// An identity from another identity provider.
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("other", "uid=user4,ou=users,dc=example,dc=com"),
+		Username:   "user4",
+	})
+
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.IDP, qt.Equals, "test")
+	c.Assert(r.Created, qt.DeepEquals, []string{"user1", "user2"})
+	c.Assert(r.Updated, qt.HasLen, 0)
+	c.Assert(r.Disabled, qt.DeepEquals, []string{"user3"})
+	c.Assert(r.Finished.Before(r.Started), qt.Equals, false)
+	c.Assert(syncer.LastSync(), qt.Equals, r)
+	c.Assert(d.connections()[0].pagingSize, qt.Equals, uint32(100))
+
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:     "user1",
+		Name:         "User One",
+		Email:        "user1@example.com",
+		ProviderInfo: map[string][]string{"groups": {"group1"}},
+	})
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user2,ou=users,dc=example,dc=com"),
+		Username:   "user2",
+	})
+	id := store.Identity{Username: "user3"}
+	err := s.idptest.Store.Store.Identity(s.idptest.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Disabled.IsZero(), qt.Equals, false)
+	c.Assert(id.DisabledReason, qt.Equals, "not found in LDAP directory")
+	c.Assert(s.auditEntries(c), qt.DeepEquals, []store.AuditEntry{{
+		Operation: "disable-user",
+		Target:    "user3",
+		After:     []string{"not found in LDAP directory"},
+	}})
+	id = store.Identity{Username: "user4"}
+	err = s.idptest.Store.Store.Identity(s.idptest.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Disabled.IsZero(), qt.Equals, true)
+
+	// A second sync makes no changes.
+	r = syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Created, qt.HasLen, 0)
+	c.Assert(r.Updated, qt.HasLen, 0)
+	c.Assert(r.Disabled, qt.HasLen, 0)
+	c.Assert(s.auditEntries(c), qt.HasLen, 1)
+}
+
+func (s *ldapSuite) TestSyncChanges(c *qt.C) {
+	db := getSyncLdapDB()
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+		Disabled:   time.Now(),
+		// Disabled by a previous sync.
+		DisabledReason: "not found in LDAP directory",
+	})
+	s.addIdentity(c, &store.Identity{
+		ProviderID:     store.MakeProviderIdentity("test", "uid=user2,ou=users,dc=example,dc=com"),
+		Username:       "user2",
+		Disabled:       time.Now(),
+		DisabledReason: "disabled by an administrator",
+	})
+	syncer, _ := s.setupSyncer(c, getSyncParams(), db)
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Created, qt.HasLen, 0)
+	c.Assert(r.Enabled, qt.DeepEquals, []string{"user1"})
+	c.Assert(r.Updated, qt.HasLen, 0)
+	c.Assert(s.auditEntries(c), qt.DeepEquals, []store.AuditEntry{{
+		Operation: "enable-user",
+		Target:    "user1",
+		Before:    []string{"not found in LDAP directory"},
+	}})
+
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:     "user1",
+		ProviderInfo: map[string][]string{"groups": {"group1"}},
+	})
+	id := store.Identity{Username: "user2"}
+	err := s.idptest.Store.Store.Identity(s.idptest.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.DisabledReason, qt.Equals, "disabled by an administrator")
+
+	db[1]["mail"] = []string{"user1@example.com"}
+	db[3]["member"] = append(db[3]["member"], "uid=user2,ou=users,dc=example,dc=com")
+	r = syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Updated, qt.DeepEquals, []string{"user1", "user2"})
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:     "user1",
+		Email:        "user1@example.com",
+		ProviderInfo: map[string][]string{"groups": {"group1"}},
+	})
+}
+
+func (s *ldapSuite) TestSyncDryRun(c *qt.C) {
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user3,ou=users,dc=example,dc=com"),
+		Username:   "user3",
+	})
+	syncer, _ := s.setupSyncer(c, getSyncParams(), getSyncLdapDB())
+	r := syncer.Sync(s.idptest.Ctx, true)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.DryRun, qt.Equals, true)
+	c.Assert(r.Created, qt.DeepEquals, []string{"user1", "user2"})
+	c.Assert(r.Disabled, qt.DeepEquals, []string{"user3"})
+
+	ids, err := s.idptest.Store.Store.FindIdentities(s.idptest.Ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids, qt.HasLen, 1)
+	c.Assert(ids[0].Username, qt.Equals, "user3")
+	c.Assert(ids[0].Disabled.IsZero(), qt.Equals, true)
+	c.Assert(s.auditEntries(c), qt.HasLen, 0)
+}
+
+func (s *ldapSuite) TestSyncRemove(c *qt.C) {
+	p := getSyncParams()
+	p.Sync.Deprovision = "remove"
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user3,ou=users,dc=example,dc=com"),
+		Username:   "user3",
+	})
+	syncer, _ := s.setupSyncer(c, p, getSyncLdapDB())
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Removed, qt.DeepEquals, []string{"user3"})
+	c.Assert(r.Disabled, qt.HasLen, 0)
+
+	err := s.idptest.Store.Store.Identity(s.idptest.Ctx, &store.Identity{Username: "user3"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(s.auditEntries(c), qt.DeepEquals, []store.AuditEntry{{
+		Operation: "remove-user",
+		Target:    "user3",
+	}})
+}
+
+func (s *ldapSuite) TestSyncRemoveOwner(c *qt.C) {
+	p := getSyncParams()
+	p.Sync.Deprovision = "remove"
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user3,ou=users,dc=example,dc=com"),
+		Username:   "user3",
+	})
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user4,ou=users,dc=example,dc=com"),
+		Username:   "user4",
+	})
+	err := s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "agent1"),
+		Username:   "agent1@candid",
+		Owner:      store.MakeProviderIdentity("test", "uid=user3,ou=users,dc=example,dc=com"),
+	}, store.Update{
+		store.Username: store.Set,
+		store.Owner:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	syncer, _ := s.setupSyncer(c, p, getSyncLdapDB())
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Removed, qt.DeepEquals, []string{"user4"})
+	c.Assert(r.Disabled, qt.DeepEquals, []string{"user3"})
+
+	id := store.Identity{Username: "user3"}
+	err = s.idptest.Store.Store.Identity(s.idptest.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Disabled.IsZero(), qt.Equals, false)
+	c.Assert(id.DisabledReason, qt.Equals, "not found in LDAP directory")
+	err = s.idptest.Store.Store.Identity(s.idptest.Ctx, &store.Identity{Username: "user4"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = s.idptest.Store.Store.Identity(s.idptest.Ctx, &store.Identity{Username: "agent1@candid"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.auditEntries(c), qt.DeepEquals, []store.AuditEntry{{
+		Operation: "remove-user",
+		Target:    "user4",
+	}, {
+		Operation: "disable-user",
+		Target:    "user3",
+		After:     []string{"not found in LDAP directory"},
+	}})
+
+	// The identity stays disabled, and is not reported again, while
+	// it owns other identities.
+	r = syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Removed, qt.HasLen, 0)
+	c.Assert(r.Disabled, qt.HasLen, 0)
+}
+
+func (s *ldapSuite) TestSyncNoUsers(c *qt.C) {
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+	})
+	p := getSyncParams()
+	p.UserQueryFilter = "(objectClass=person)"
+	syncer, _ := s.setupSyncer(c, p, getSyncLdapDB())
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "no users found in directory")
+	c.Assert(r.Disabled, qt.HasLen, 0)
+	c.Assert(syncer.LastSync(), qt.Equals, r)
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		Username:   "user1",
+	})
+}
+
+func (s *ldapSuite) TestSyncDirectoryUnavailable(c *qt.C) {
+	syncer, d := s.setupSyncer(c, getSyncParams(), getSyncLdapDB())
+	d.setDown("localhost:ldap", true)
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Matches, `cannot read users from directory: .*cannot connect to localhost:ldap`)
+}
+
+func (s *ldapSuite) TestSyncDuplicateUsername(c *qt.C) {
+	s.addIdentity(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("other", "user1"),
+		Username:   "user1",
+	})
+	syncer, _ := s.setupSyncer(c, getSyncParams(), getSyncLdapDB())
+	r := syncer.Sync(s.idptest.Ctx, false)
+	c.Assert(r.Error, qt.Equals, "")
+	c.Assert(r.Created, qt.DeepEquals, []string{"user1", "user2"})
+	c.Assert(r.Errors, qt.HasLen, 1)
+	c.Assert(r.Errors[0], qt.Matches, `user1: .*`)
+}
+
+func (s *ldapSuite) TestSyncScheduled(c *qt.C) {
+	p := getSyncParams()
+	p.Sync.Interval = time.Millisecond
+	p.Sync.DryRun = true
+	i, err := ldap.NewIdentityProvider(p)
+	c.Assert(err, qt.IsNil)
+	d := newMockLDAPDialer(getSyncLdapDB())
+	ldap.SetLDAP(i, d.Dial)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Defer(cancel)
+	i.Init(ctx, s.idptest.InitParams(c, idpPrefix))
+	syncer := i.(idp.Syncer)
+
+	var r *params.SyncResult
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if r = syncer.LastSync(); r != nil {
+			break
+		}
+	}
+	c.Assert(r, qt.Not(qt.IsNil))
+	c.Assert(r.DryRun, qt.Equals, true)
+	c.Assert(r.Created, qt.DeepEquals, []string{"user1", "user2"})
+
+	// No more syncs are run once the context is done.
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	r = syncer.LastSync()
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(syncer.LastSync(), qt.Equals, r)
+}
@@ -0,0 +1,18 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+
+	"github.com/canonical/candid/idp"
+)
+
+var RefreshFailures = refreshFailures
+
+// RefreshAll runs a background token refresh for the given identity
+// provider.
+func RefreshAll(ctx context.Context, i idp.IdentityProvider) error {
+	return i.(*openidConnectIdentityProvider).refreshAll(ctx)
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A GroupClaim describes how the values of a claim in an ID token, or
+// a userinfo response, are mapped to the groups of a user.
+type GroupClaim struct {
+	// Claim is the name of the claim holding the groups, for
+	// example "groups" or "roles". The claim may hold either a
+	// string or a list of strings. If there is no claim with this
+	// exact name then the name is treated as a "." separated path
+	// to a claim in a nested object, for example
+	// "realm_access.roles".
+	Claim string `yaml:"claim"`
+
+	// Domain, if set, is the domain that the claim values are
+	// qualified with (for example "admins@example.com"). Values
+	// qualified with a different domain are ignored and the domain
+	// is removed from the remaining values. Unqualified values are
+	// used unchanged.
+	Domain string `yaml:"domain"`
+
+	// Filter, if set, is a regular expression that values must
+	// match to be used as groups. The expression is matched against
+	// the whole value, after any domain has been removed.
+	Filter string `yaml:"filter"`
+
+	// Prefix and Suffix are added to each value to make the group
+	// name.
+	Prefix string `yaml:"prefix"`
+	Suffix string `yaml:"suffix"`
+}
+
+// groupMapper converts claims to groups according to a set of
+// GroupClaims.
+type groupMapper struct {
+	claims  []GroupClaim
+	filters []*regexp.Regexp
+	invalid []bool
+}
+
+func newGroupMapper(claims []GroupClaim) *groupMapper {
+	m := &groupMapper{
+		claims:  claims,
+		filters: make([]*regexp.Regexp, len(claims)),
+		invalid: make([]bool, len(claims)),
+	}
+	for i, gc := range claims {
+		if gc.Filter == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + gc.Filter + ")$")
+		if err != nil {
+			// A filter that doesn't compile is logged and matches
+			// nothing, in the same way as match-email-addr.
+			logger.Errorf("cannot compile filter for group claim %q: %s", gc.Claim, err)
+			m.invalid[i] = true
+		}
+		m.filters[i] = re
+	}
+	return m
+}
+
+// enabled reports whether any group claims have been configured.
+func (m *groupMapper) enabled() bool {
+	return len(m.claims) > 0
+}
+
+// groups returns the groups derived from the given claims. The
+// returned boolean reports whether any of the configured claims were
+// present.
+func (m *groupMapper) groups(claims map[string]interface{}) ([]string, bool) {
+	var groups []string
+	found := false
+	seen := make(map[string]bool)
+	for i, gc := range m.claims {
+		v, ok := lookupClaim(claims, gc.Claim)
+		if !ok || m.invalid[i] {
+			continue
+		}
+		found = true
+		for _, value := range claimValues(v) {
+			if gc.Domain != "" {
+				if n := strings.LastIndex(value, "@"); n >= 0 {
+					if !strings.EqualFold(value[n+1:], gc.Domain) {
+						continue
+					}
+					value = value[:n]
+				}
+			}
+			if value == "" {
+				continue
+			}
+			if m.filters[i] != nil && !m.filters[i].MatchString(value) {
+				continue
+			}
+			g := gc.Prefix + value + gc.Suffix
+			if !seen[g] {
+				seen[g] = true
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups, found
+}
+
+// lookupClaim finds the claim with the given name. If there is no
+// claim with that exact name the name is used as a path through nested
+// objects.
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := claims[name]; ok {
+		return v, true
+	}
+	parts := strings.Split(name, ".")
+	if len(parts) == 1 {
+		return nil, false
+	}
+	var v interface{} = claims
+	for _, p := range parts {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[p]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// claimValues returns the string values held in a claim.
+func claimValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// A loginRecord holds the secrets generated when a login attempt is
+// started that must be presented, or checked, when the issuer
+// redirects back to candid.
+type loginRecord struct {
+	// CodeVerifier holds the PKCE (RFC 7636) code verifier that must
+	// be sent with the authorization code. It is empty if PKCE is
+	// disabled.
+	CodeVerifier string `json:"code-verifier,omitempty"`
+
+	// Nonce holds the value that must be in the nonce claim of the
+	// ID token. It is empty if nonce validation is disabled.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// setLogin stores the given record for the login attempt with the given
+// state.
+func (idp *openidConnectIdentityProvider) setLogin(ctx context.Context, state string, lr *loginRecord, expires time.Time) error {
+	buf, err := json.Marshal(lr)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idp.initParams.KeyValueStore.Set(ctx, loginKey(state), buf, expires))
+}
+
+// takeLogin retrieves and removes the record for the login attempt
+// with the given state, so that each login attempt can only be
+// completed once.
+func (idp *openidConnectIdentityProvider) takeLogin(ctx context.Context, state string) (*loginRecord, error) {
+	var buf []byte
+	err := idp.initParams.KeyValueStore.Update(ctx, loginKey(state), time.Now(), func(old []byte) ([]byte, error) {
+		buf = old
+		return []byte{}, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(buf) == 0 {
+		return nil, errgo.Newf("login attempt not found")
+	}
+	var lr loginRecord
+	if err := json.Unmarshal(buf, &lr); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &lr, nil
+}
+
+// newSecret returns a new random string suitable for use as a PKCE code
+// verifier or an ID token nonce.
+func newSecret() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// codeChallenge returns the S256 PKCE code challenge for the given code
+// verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// loginKey returns the key used to store the login record for the given
+// state.
+func loginKey(state string) string {
+	return "login-" + state
+}
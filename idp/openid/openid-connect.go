@@ -7,12 +7,17 @@ package openid
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/oauth2"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/names.v2"
@@ -25,7 +30,35 @@ import (
 
 var logger = loggo.GetLogger("candid.idp.openid")
 
+// defaultRefreshInterval is the default time after which a user's
+// tokens are refreshed.
+const defaultRefreshInterval = 15 * time.Minute
+
+const (
+	// minRefreshCheckInterval is the minimum time between background
+	// token refreshes, so that short refresh intervals do not cause
+	// the refresh to run continuously.
+	minRefreshCheckInterval = time.Minute
+
+	// refreshPageSize is the number of identities that are fetched
+	// from the store at a time during a background token refresh.
+	refreshPageSize = 100
+
+	// refreshClaimTimeout is the time after which a claim on the
+	// refresh of a user's token is considered abandoned, for example
+	// because the server that made it stopped.
+	refreshClaimTimeout = time.Minute
+)
+
+var refreshFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "candid",
+	Subsystem: "openid",
+	Name:      "token_refresh_failures_count",
+	Help:      "Count of failed OpenID Connect token refreshes.",
+}, []string{"idp", "reason"})
+
 func init() {
+	prometheus.MustRegister(refreshFailures)
 	idp.Register("openid-connect", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
 		var p OpenIDConnectParams
 		if err := unmarshal(&p); err != nil {
@@ -43,6 +76,9 @@ func init() {
 		if p.ClientSecret == "" {
 			return nil, errgo.Newf("client-secret not specified")
 		}
+		if p.RefreshInterval < 0 {
+			return nil, errgo.Newf("invalid refresh-interval %v", p.RefreshInterval)
+		}
 		return NewOpenIDConnectIdentityProvider(p), nil
 	})
 }
@@ -63,6 +99,10 @@ type IdentityCreator interface {
 	// If the Name or Email values are non-zero these values will either
 	// replace any currently stored values, or be used as defaults when
 	// registering a new user.
+	//
+	// If the identity includes a "groups" value in its ProviderInfo
+	// then those groups are stored with the user, otherwise the groups
+	// are taken from the ID token using the configured GroupClaims.
 	CreateIdentity(context.Context, *oauth2.Token) (store.Identity, error)
 }
 
@@ -101,6 +141,31 @@ type OpenIDConnectParams struct {
 	// MatchEmailAddr is a regular expression that is used to determine if
 	// this identity provider can be used for a particular user email.
 	MatchEmailAddr string `yaml:"match-email-addr"`
+
+	// GroupClaims contains the claims that hold the groups of a
+	// user. The groups are taken from the ID token when the user
+	// logs in. If the issuer returns a refresh token (which usually
+	// requires the "offline_access" scope) then the groups are
+	// periodically refreshed from the issuer's userinfo endpoint.
+	GroupClaims []GroupClaim `yaml:"group-claims"`
+
+	// RefreshInterval is the time after which a user's refresh
+	// token is used to check that the user is still allowed access
+	// and to refresh their groups. If the refresh fails because the
+	// issuer has revoked the token then the user must log in again.
+	// The default is 15 minutes.
+	RefreshInterval time.Duration `yaml:"refresh-interval"`
+
+	// DisablePKCE disables the use of PKCE (RFC 7636) in the
+	// authorization code flow. It should only be set for issuers
+	// that reject authorization requests containing a code
+	// challenge.
+	DisablePKCE bool `yaml:"disable-pkce"`
+
+	// DisableNonce disables sending a nonce in the authorization
+	// request and checking it in the returned ID token. It should
+	// only be set for issuers that do not return the nonce.
+	DisableNonce bool `yaml:"disable-nonce"`
 	
 	// IdentityCreator is the IdentityCreator that the identity provider
 	// will use to convert the OAuth2 token into a candid Identity. If
@@ -118,6 +183,9 @@ func NewOpenIDConnectIdentityProvider(params OpenIDConnectParams) idp.IdentityPr
 	if len(params.Scopes) == 0 {
 		params.Scopes = []string{oidc.ScopeOpenID}
 	}
+	if params.RefreshInterval == 0 {
+		params.RefreshInterval = defaultRefreshInterval
+	}
 
 	var matchEmailAddr *regexp.Regexp
 	if params.MatchEmailAddr != "" {
@@ -134,6 +202,7 @@ func NewOpenIDConnectIdentityProvider(params OpenIDConnectParams) idp.IdentityPr
 	return &openidConnectIdentityProvider{
 		params:         params,
 		matchEmailAddr: matchEmailAddr,
+		groups:         newGroupMapper(params.GroupClaims),
 	}
 }
 
@@ -143,6 +212,7 @@ type openidConnectIdentityProvider struct {
 	provider       *oidc.Provider
 	config         *oauth2.Config
 	matchEmailAddr *regexp.Regexp
+	groups         *groupMapper
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -185,7 +255,9 @@ func (idp *openidConnectIdentityProvider) IsForEmailAddr(addr string) bool {
 }
 
 // Init implements idp.IdentityProvider.Init by performing discovery on
-// the issuer and set up the identity provider.
+// the issuer and set up the identity provider. It also starts the
+// background token refresh, which runs until the given context is
+// done.
 func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
 	var err error
@@ -200,6 +272,7 @@ func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.I
 		RedirectURL:  idp.initParams.URLPrefix + "/callback",
 		Scopes:       idp.params.Scopes,
 	}
+	go idp.runRefresh(ctx)
 	return nil
 }
 
@@ -212,9 +285,263 @@ func (idp *openidConnectIdentityProvider) URL(state string) string {
 func (idp *openidConnectIdentityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
 }
 
-//  GetGroups implements idp.IdentityProvider.GetGroups.
-func (*openidConnectIdentityProvider) GetGroups(context.Context, *store.Identity) ([]string, error) {
-	return nil, nil
+// GetGroups implements idp.IdentityProvider.GetGroups by returning the
+// groups stored when the user last logged in.
+//
+// If a refresh token is available for the user then once the refresh
+// interval has passed it is used to check that the user is still
+// allowed access. The same check is made for all users in the
+// background, so that users who are never asked for their groups are
+// also checked. If the issuer rejects the refresh token the identity
+// is marked as requiring an interactive login and no groups are
+// returned. If group claims are configured then the groups are also
+// refreshed from the userinfo endpoint.
+func (idp *openidConnectIdentityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
+	groups := identity.ProviderInfo["groups"]
+	if needsRelogin(identity) {
+		return nil, nil
+	}
+	tok, err := idp.refreshToken(ctx, identity)
+	if errgo.Cause(err) == errTokenRevoked {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if tok == nil || !idp.groups.enabled() {
+		return groups, nil
+	}
+	ui, err := idp.provider.UserInfo(ctx, oauth2.StaticTokenSource(tok))
+	if err != nil {
+		refreshFailures.WithLabelValues(idp.params.Name, "userinfo").Inc()
+		logger.Errorf("cannot refresh groups for %s: %s", identity.ProviderID, err)
+		return groups, nil
+	}
+	var claims map[string]interface{}
+	if err := ui.Claims(&claims); err != nil {
+		refreshFailures.WithLabelValues(idp.params.Name, "userinfo").Inc()
+		logger.Errorf("cannot refresh groups for %s: %s", identity.ProviderID, err)
+		return groups, nil
+	}
+	newGroups, ok := idp.groups.groups(claims)
+	if !ok {
+		// The userinfo response does not contain the group
+		// claims, keep the groups from the ID token.
+		return groups, nil
+	}
+	err = idp.initParams.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID:   identity.ProviderID,
+		ProviderInfo: map[string][]string{"groups": newGroups},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	})
+	if err != nil {
+		logger.Errorf("cannot store groups for %s: %s", identity.ProviderID, err)
+	}
+	return newGroups, nil
+}
+
+// errTokenRevoked is the cause of the error returned from refreshToken
+// when the issuer has rejected the user's refresh token.
+var errTokenRevoked = errgo.New("refresh token revoked")
+
+// errNoRefresh is used to abandon a claim on a token record that does
+// not need to be refreshed.
+var errNoRefresh = errgo.New("no refresh needed")
+
+// refreshToken uses the stored refresh token of the given identity to
+// get a new token from the issuer once the refresh interval has passed,
+// which checks that the user is still allowed access. It returns the
+// new token, or nil if the token was not refreshed because it is not
+// due, another refresh is in progress or the issuer could not be
+// reached. If the issuer rejects the refresh token then the identity is
+// marked as requiring an interactive login and an error with a cause
+// of errTokenRevoked is returned.
+func (idp *openidConnectIdentityProvider) refreshToken(ctx context.Context, identity *store.Identity) (*oauth2.Token, error) {
+	tr, err := idp.claimRefresh(ctx, identity.ProviderID)
+	if errgo.Cause(err) == simplekv.ErrNotFound || errgo.Cause(err) == errNoRefresh {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Always use the refresh token so that the issuer checks that
+	// the user is still allowed access.
+	tok, err := idp.config.TokenSource(ctx, &oauth2.Token{RefreshToken: tr.Token.RefreshToken}).Token()
+	if err != nil {
+		if isInvalidGrant(err) {
+			refreshFailures.WithLabelValues(idp.params.Name, "invalid_grant").Inc()
+			logger.Infof("refresh token for %s rejected, login required: %s", identity.ProviderID, err)
+			if err := idp.requireRelogin(ctx, identity, "refresh token rejected by issuer"); err != nil {
+				return nil, errgo.Mask(err)
+			}
+			return nil, errgo.WithCausef(nil, errTokenRevoked, "")
+		}
+		refreshFailures.WithLabelValues(idp.params.Name, "error").Inc()
+		logger.Errorf("cannot refresh token for %s: %s", identity.ProviderID, err)
+		if err := idp.releaseRefresh(ctx, identity.ProviderID, tr, nil); err != nil {
+			logger.Errorf("cannot release token for %s: %s", identity.ProviderID, err)
+		}
+		return nil, nil
+	}
+	if tok.RefreshToken == "" {
+		// The issuer has not rotated the refresh token.
+		tok.RefreshToken = tr.Token.RefreshToken
+	}
+	if err := idp.releaseRefresh(ctx, identity.ProviderID, tr, tok); err != nil {
+		logger.Errorf("cannot store token for %s: %s", identity.ProviderID, err)
+	}
+	return tok, nil
+}
+
+// claimRefresh claims the refresh of the stored token of the given
+// user and returns the claimed token record. Only one refresh of a
+// user's token may be in progress at a time, so that a refresh token
+// that has been rotated by one refresh is never used by another. If the
+// token is not due to be refreshed, or another refresh holds the claim,
+// an error with a cause of errNoRefresh is returned. If there is no
+// stored token an error with a cause of simplekv.ErrNotFound is
+// returned.
+func (idp *openidConnectIdentityProvider) claimRefresh(ctx context.Context, pid store.ProviderIdentity) (*tokenRecord, error) {
+	now := time.Now()
+	var claimed *tokenRecord
+	err := idp.initParams.KeyValueStore.Update(ctx, tokenKey(pid), time.Time{}, func(old []byte) ([]byte, error) {
+		tr, err := idp.decodeToken(old)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+		}
+		if now.Sub(tr.Refreshed) < idp.params.RefreshInterval || now.Sub(tr.RefreshStarted) < refreshClaimTimeout {
+			return nil, errNoRefresh
+		}
+		tr.RefreshStarted = now
+		claimed = tr
+		return idp.encodeToken(tr)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound), errgo.Is(errNoRefresh))
+	}
+	return claimed, nil
+}
+
+// releaseRefresh releases the claim made by claimRefresh, which
+// returned the given token record. If tok is not nil then it replaces
+// the stored token, which is marked as refreshed. The stored record is
+// only changed if the claim is still held.
+func (idp *openidConnectIdentityProvider) releaseRefresh(ctx context.Context, pid store.ProviderIdentity, claimed *tokenRecord, tok *oauth2.Token) error {
+	err := idp.initParams.KeyValueStore.Update(ctx, tokenKey(pid), time.Time{}, func(old []byte) ([]byte, error) {
+		tr, err := idp.decodeToken(old)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+		}
+		if !tr.RefreshStarted.Equal(claimed.RefreshStarted) {
+			return nil, errgo.Newf("refresh claim lost")
+		}
+		tr.RefreshStarted = time.Time{}
+		if tok != nil {
+			tr.Token = tok
+			tr.Refreshed = time.Now()
+		}
+		return idp.encodeToken(tr)
+	})
+	return errgo.Mask(err)
+}
+
+// runRefresh refreshes the tokens of all the provider's users at every
+// refresh interval until the given context is done.
+func (idp *openidConnectIdentityProvider) runRefresh(ctx context.Context) {
+	interval := idp.params.RefreshInterval
+	if interval < minRefreshCheckInterval {
+		interval = minRefreshCheckInterval
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		sctx, close := idp.initParams.Store.Context(ctx)
+		if err := idp.refreshAll(sctx); err != nil {
+			logger.Errorf("cannot refresh tokens: %s", err)
+		}
+		close()
+	}
+}
+
+// refreshAll refreshes the tokens, and groups, of all the provider's
+// users whose tokens are older than the refresh interval.
+func (idp *openidConnectIdentityProvider) refreshAll(ctx context.Context) error {
+	ref := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, ""),
+	}
+	filter := store.Filter{store.ProviderID: store.Prefix}
+	cursor := ""
+	for {
+		ids, next, err := idp.initParams.Store.FindIdentitiesPage(ctx, ref, filter, cursor, refreshPageSize)
+		if err != nil {
+			return errgo.Notef(err, "cannot find identities")
+		}
+		for i := range ids {
+			if ctx.Err() != nil {
+				return errgo.Mask(ctx.Err())
+			}
+			if _, err := idp.GetGroups(ctx, &ids[i]); err != nil {
+				logger.Errorf("cannot refresh token for %s: %s", ids[i].ProviderID, err)
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// requireRelogin marks the given identity as requiring an interactive
+// login and removes the stored token.
+func (p *openidConnectIdentityProvider) requireRelogin(ctx context.Context, identity *store.Identity, reason string) error {
+	err := p.initParams.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID:   identity.ProviderID,
+		ProviderInfo: map[string][]string{idp.ReloginRequired: {reason}},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(p.initParams.KeyValueStore.Set(ctx, tokenKey(identity.ProviderID), []byte{}, time.Time{}))
+}
+
+// needsRelogin reports whether the given identity has been marked as
+// requiring an interactive login.
+func needsRelogin(identity *store.Identity) bool {
+	return len(identity.ProviderInfo[idp.ReloginRequired]) > 0
+}
+
+// clearRelogin removes any requirement for an interactive login from
+// the given identity. It reports whether the identity was changed.
+func clearRelogin(identity *store.Identity) bool {
+	if _, ok := identity.ProviderInfo[idp.ReloginRequired]; !ok {
+		return false
+	}
+	identity.ProviderInfo[idp.ReloginRequired] = []string{}
+	return true
+}
+
+// isInvalidGrant reports whether the given error is an OAuth2
+// invalid_grant error returned from the token endpoint.
+func isInvalidGrant(err error) bool {
+	rerr, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		return false
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rerr.Body, &resp); err == nil {
+		return resp.Error == "invalid_grant"
+	}
+	// Some issuers return form encoded errors.
+	v, err := url.ParseQuery(string(rerr.Body))
+	return err == nil && v.Get("error") == "invalid_grant"
 }
 
 // Handle implements idp.IdentityProvider.Handle.
@@ -235,19 +562,73 @@ func (idp *openidConnectIdentityProvider) Handle(ctx context.Context, w http.Res
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
 	default:
-		idp.login(ctx, w, req)
+		if err := idp.login(ctx, w, req, ls); err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		}
 	}
 }
 
-func (idp *openidConnectIdentityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	http.Redirect(w, req, idp.config.AuthCodeURL(idputil.State(req)), http.StatusFound)
+// login starts the authorization code flow with the issuer. The
+// PKCE code verifier and the nonce for the login attempt are recorded
+// so that they can be checked when the issuer redirects back to the
+// callback.
+func (idp *openidConnectIdentityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	var lr loginRecord
+	var opts []oauth2.AuthCodeOption
+	if !idp.params.DisablePKCE {
+		v, err := newSecret()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		lr.CodeVerifier = v
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge", codeChallenge(v)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+	if !idp.params.DisableNonce {
+		nonce, err := newSecret()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		lr.Nonce = nonce
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	state := idputil.State(req)
+	if err := idp.setLogin(ctx, state, &lr, ls.Expires); err != nil {
+		return errgo.Mask(err)
+	}
+	http.Redirect(w, req, idp.config.AuthCodeURL(state, opts...), http.StatusFound)
+	return nil
 }
 
 func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
-	tok, err := idp.config.Exchange(ctx, req.Form.Get("code"))
+	// Each login attempt may only be completed once.
+	lr, err := idp.takeLogin(ctx, idputil.State(req))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if e := req.Form.Get("error"); e != "" {
+		if d := req.Form.Get("error_description"); d != "" {
+			return errgo.Newf("login failed: %s", d)
+		}
+		return errgo.Newf("login failed: %s", e)
+	}
+	var opts []oauth2.AuthCodeOption
+	if lr.CodeVerifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", lr.CodeVerifier))
+	}
+	tok, err := idp.config.Exchange(ctx, req.Form.Get("code"), opts...)
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if lr.Nonce != "" {
+		// Check the nonce before the token is used in any other
+		// way, in case the token has been replayed.
+		if _, _, err := idp.verifyIDToken(ctx, tok, lr.Nonce); err != nil {
+			return errgo.Mask(err)
+		}
+	}
 
 	ic := idp.params.IdentityCreator
 	if ic == nil {
@@ -257,6 +638,28 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if _, ok := user.ProviderInfo["groups"]; !ok && idp.groups.enabled() {
+		// The IdentityCreator didn't determine the groups, take
+		// them from the ID token.
+		_, claims, err := idp.verifyIDToken(ctx, tok, "")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		groups, _ := idp.groups.groups(claims)
+		if user.ProviderInfo == nil {
+			user.ProviderInfo = make(map[string][]string)
+		}
+		user.ProviderInfo["groups"] = groups
+	}
+	if tok.RefreshToken != "" {
+		err := idp.setToken(ctx, user.ProviderID, &tokenRecord{
+			Token:     tok,
+			Refreshed: time.Now(),
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	
 	existingUser := store.Identity{
 		ProviderID: user.ProviderID,
@@ -273,6 +676,16 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 			existingUser.Email = user.Email
 			upd[store.Email] = store.Set
 		}
+		if groups, ok := user.ProviderInfo["groups"]; ok {
+			if existingUser.ProviderInfo == nil {
+				existingUser.ProviderInfo = make(map[string][]string)
+			}
+			existingUser.ProviderInfo["groups"] = groups
+			upd[store.ProviderInfo] = store.Set
+		}
+		if clearRelogin(&existingUser) {
+			upd[store.ProviderInfo] = store.Set
+		}
 		if (upd != store.Update{}) {
 			err = idp.initParams.Store.UpdateIdentity(ctx, &existingUser, upd)
 		}
@@ -292,6 +705,7 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 			store.Username: store.Set,
 			store.Name: store.Set,
 			store.Email: store.Set,
+			store.ProviderInfo: store.Set,
 		})
 		if err == nil {
 			idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &user)
@@ -302,10 +716,19 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 		}
 	}
 	
-	// The user needs to register.	
+	// The user needs to register. Keep the groups so that they can
+	// be stored with the new user.
+	if groups, ok := user.ProviderInfo["groups"]; ok {
+		buf, err := json.Marshal(groups)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := idp.initParams.KeyValueStore.Set(ctx, registrationKey(user.ProviderID), buf, ls.Expires); err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	ls.ProviderID = user.ProviderID
-	cookiePath := idputil.CookiePathRelativeToLocation(idputil.LoginCookiePath, idp.initParams.Location, idp.initParams.SkipLocationForCookiePaths)
-	state, err := idp.initParams.Codec.SetCookie(w, idputil.LoginCookieName, cookiePath, ls)
+	state, err := idputil.SetLoginCookie(w, idp.initParams.Codec, idp.initParams.Location, idp.initParams.SkipLocationForCookiePaths, ls)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -323,7 +746,17 @@ func (idp *openidConnectIdentityProvider) register(ctx context.Context, w http.R
 		Name:       req.Form.Get("fullname"),
 		Email:      req.Form.Get("email"),
 	}
-	err := idp.registerUser(ctx, req.Form.Get("username"), u)
+	buf, err := idp.initParams.KeyValueStore.Get(ctx, registrationKey(ls.ProviderID))
+	if err == nil {
+		var groups []string
+		if err := json.Unmarshal(buf, &groups); err != nil {
+			return errgo.Mask(err)
+		}
+		u.ProviderInfo = map[string][]string{"groups": groups}
+	} else if errgo.Cause(err) != simplekv.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	err = idp.registerUser(ctx, req.Form.Get("username"), u)
 	if err == nil {
 		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, u)
 		return nil
@@ -352,9 +785,10 @@ func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, user
 	}
 	u.Username = joinDomain(username, idp.params.Domain)
 	err := idp.initParams.Store.UpdateIdentity(ctx, u, store.Update{
-		store.Username: store.Set,
-		store.Name:     store.Set,
-		store.Email:    store.Set,
+		store.Username:     store.Set,
+		store.Name:         store.Set,
+		store.Email:        store.Set,
+		store.ProviderInfo: store.Set,
 	})
 	if err == nil {
 		return nil
@@ -370,16 +804,10 @@ func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, user
 // the given token. The ProviderID will be created using the ProviderID
 // function. The Username, Name & Email values will be taken from the
 // claims "preferred_username", "name" & "email" if they are present.
+// If any GroupClaims are configured the groups are stored in the
+// "groups" ProviderInfo value.
 func (idp *openidConnectIdentityProvider) CreateIdentity(ctx context.Context, tok *oauth2.Token) (store.Identity, error) {
-	idtok := tok.Extra("id_token")
-	if idtok == nil {
-		return store.Identity{}, errgo.Newf("no id_token in OpenID response")
-	}
-	idtoks, ok := idtok.(string)
-	if !ok {
-		return store.Identity{}, errgo.Newf("invalid id_token in OpenID response")
-	}
-	id, err := idp.provider.Verifier(&oidc.Config{ClientID: idp.config.ClientID}).Verify(ctx, idtoks)
+	id, allClaims, err := idp.verifyIDToken(ctx, tok, "")
 	if err != nil {
 		return store.Identity{}, errgo.Mask(err)
 	}
@@ -395,9 +823,44 @@ func (idp *openidConnectIdentityProvider) CreateIdentity(ctx context.Context, to
 		user.Email = claims.Email
 		user.Name = claims.FullName
 	}
+	if idp.groups.enabled() {
+		groups, _ := idp.groups.groups(allClaims)
+		user.ProviderInfo = map[string][]string{"groups": groups}
+	}
 	return user, nil
 }
 
+// verifyIDToken verifies the "id_token" attached to the given token and
+// returns the ID token along with all of its claims. If nonce is not
+// empty the ID token must have a matching nonce claim.
+func (idp *openidConnectIdentityProvider) verifyIDToken(ctx context.Context, tok *oauth2.Token, nonce string) (*oidc.IDToken, map[string]interface{}, error) {
+	idtok := tok.Extra("id_token")
+	if idtok == nil {
+		return nil, nil, errgo.Newf("no id_token in OpenID response")
+	}
+	idtoks, ok := idtok.(string)
+	if !ok {
+		return nil, nil, errgo.Newf("invalid id_token in OpenID response")
+	}
+	// The nonce is checked below, so that an ID token without a
+	// nonce is also rejected.
+	id, err := idp.provider.Verifier(&oidc.Config{
+		ClientID:       idp.config.ClientID,
+		SkipNonceCheck: true,
+	}).Verify(ctx, idtoks)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	if nonce != "" && id.Nonce != nonce {
+		return nil, nil, errgo.Newf("invalid nonce in id_token")
+	}
+	var claims map[string]interface{}
+	if err := id.Claims(&claims); err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return id, claims, nil
+}
+
 // claims contains the set of claims possibly returned in the OpenID
 // token.
 type claims struct {
@@ -415,6 +878,55 @@ func joinDomain(name, domain string) string {
 	return fmt.Sprintf("%s@%s", name, domain)
 }
 
+// tokenRecord holds the OAuth2 token of a user, which is stored so that
+// it can be refreshed. Token records are always stored encrypted as
+// they contain refresh tokens.
+type tokenRecord struct {
+	Token     *oauth2.Token `json:"token"`
+	Refreshed time.Time     `json:"refreshed"`
+
+	// RefreshStarted holds the time at which the refresh of the
+	// token that is in progress was claimed. It is zero if no
+	// refresh is in progress.
+	RefreshStarted time.Time `json:"refresh-started"`
+}
+
+func (idp *openidConnectIdentityProvider) decodeToken(buf []byte) (*tokenRecord, error) {
+	if len(buf) == 0 {
+		// The token has been removed.
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "")
+	}
+	var tr tokenRecord
+	if err := idp.initParams.Codec.Decode(string(buf), &tr); err != nil {
+		return nil, errgo.Notef(err, "cannot decode token")
+	}
+	return &tr, nil
+}
+
+func (idp *openidConnectIdentityProvider) encodeToken(tr *tokenRecord) ([]byte, error) {
+	buf, err := idp.initParams.Codec.Encode(tr)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return []byte(buf), nil
+}
+
+func (idp *openidConnectIdentityProvider) setToken(ctx context.Context, pid store.ProviderIdentity, tr *tokenRecord) error {
+	buf, err := idp.encodeToken(tr)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idp.initParams.KeyValueStore.Set(ctx, tokenKey(pid), buf, time.Time{}))
+}
+
+func tokenKey(pid store.ProviderIdentity) string {
+	return "token-" + string(pid)
+}
+
+func registrationKey(pid store.ProviderIdentity) string {
+	return "registration-" + string(pid)
+}
+
 // registrationState holds state information about a registration that is
 // in progress.
 type registrationState struct {
@@ -7,6 +7,7 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"html/template"
@@ -16,12 +17,15 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 	"gopkg.in/yaml.v2"
@@ -89,6 +93,18 @@ identity-providers:
   client-id: test-client-id
 `[1:],
 	expectError: "cannot unmarshal openid-connect configuration: client-secret not specified",
+}, {
+	name: "NegativeRefreshInterval",
+	yaml: `
+identity-providers:
+- type: openid-connect
+  name: test
+  issuer: example.com
+  client-id: test-client-id
+  client-secret: test-client-secret
+  refresh-interval: -1m
+`[1:],
+	expectError: "cannot unmarshal openid-connect configuration: invalid refresh-interval -1m0s",
 }}
 
 func TestConfig(t *testing.T) {
@@ -194,7 +210,7 @@ func TestURL(t *testing.T) {
 		}
 	})
 
-	err := idp.Init(context.Background(), idppkg.InitParams{
+	err := idp.Init(initContext(c), idppkg.InitParams{
 		URLPrefix: "https://example.com/login/oidc",
 	})
 	c.Assert(err, qt.IsNil)
@@ -222,7 +238,7 @@ func TestIconURL(t *testing.T) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
-	err := idp.Init(context.Background(), idppkg.InitParams{
+	err := idp.Init(initContext(c), idppkg.InitParams{
 		Location: "https://example.com",
 	})
 	c.Assert(err, qt.IsNil)
@@ -244,7 +260,7 @@ func TestHandleLogin(t *testing.T) {
 	f := idptest.NewFixture(c, candidtest.NewStore())
 
 	ip := f.InitParams(c, "http://example.com/login/oidc")
-	err := idp.Init(context.Background(), ip)
+	err := idp.Init(initContext(c), ip)
 	c.Assert(err, qt.IsNil)
 
 	cl := idptest.NewClient(idp, ip.Codec)
@@ -265,10 +281,66 @@ func TestHandleLogin(t *testing.T) {
 	c.Check(vs.Get("client_id"), qt.Equals, "test-client-id")
 	c.Check(vs.Get("redirect_uri"), qt.Equals, "http://example.com/login/oidc/callback")
 	c.Check(vs.Get("scope"), qt.Equals, "openid email")
+	c.Check(vs.Get("code_challenge"), qt.Not(qt.Equals), "")
+	c.Check(vs.Get("code_challenge_method"), qt.Equals, "S256")
+	c.Check(vs.Get("nonce"), qt.Not(qt.Equals), "")
+
+	// Each login attempt uses new values.
+	resp, err = cl.Get("/login")
+	c.Assert(err, qt.IsNil)
+	u, err = url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	c.Check(u.Query().Get("code_challenge"), qt.Not(qt.Equals), vs.Get("code_challenge"))
+	c.Check(u.Query().Get("nonce"), qt.Not(qt.Equals), vs.Get("nonce"))
+}
+
+func TestHandleLoginDisablePKCEAndNonce(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+
+	p := openid.OpenIDConnectParams{
+		Name:         "oidc",
+		Issuer:       srv.URL,
+		DisablePKCE:  true,
+		DisableNonce: true,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	ip := f.InitParams(c, "http://example.com/login/oidc")
+	err := idp.Init(initContext(c), ip)
+	c.Assert(err, qt.IsNil)
+
+	cl := idptest.NewClient(idp, ip.Codec)
+	cl.SetLoginState(idputil.LoginState{
+		ReturnTo: "http://example.com/callback",
+		State:    "1234",
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+	resp, err := cl.Get("/login")
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusFound, qt.Commentf(resp.Status))
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	vs := u.Query()
+	c.Check(vs.Get("code_challenge"), qt.Equals, "")
+	c.Check(vs.Get("code_challenge_method"), qt.Equals, "")
+	c.Check(vs.Get("nonce"), qt.Equals, "")
+
+	// The login still completes with an issuer that doesn't support
+	// PKCE or nonces.
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+	})
+	c.Check(id.Username, qt.Equals, "user1")
 }
 
 var handleCallbackTests = []struct {
 	name             string
+	groupClaims      []openid.GroupClaim
 	storedIdentities func(string) []store.Identity
 	claims           map[string]interface{}
 	expectIdentity   func(string) store.Identity
@@ -356,6 +428,82 @@ var handleCallbackTests = []struct {
 		"email":              "user1@example.com",
 		"name":               "User One",
 	},
+}, {
+	name: "NewUserWithGroups",
+	groupClaims: []openid.GroupClaim{{
+		Claim:  "groups",
+		Domain: "example.com",
+		Filter: "[a-z]+",
+	}, {
+		Claim:  "realm_access.roles",
+		Prefix: "role-",
+		Suffix: "-x",
+	}, {
+		Claim: "missing",
+	}},
+	claims: map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"eng", "ops@example.com", "sales@other.com", "Admins", "eng"},
+		"realm_access": map[string]interface{}{
+			"roles": []string{"r1"},
+		},
+	},
+	expectIdentity: func(s string) store.Identity {
+		return store.Identity{
+			ProviderID: store.ProviderIdentity("oidc:" + s + ":user-id-1"),
+			Username:   "user1",
+			ProviderInfo: map[string][]string{
+				"groups": {"eng", "ops", "role-r1-x"},
+			},
+		}
+	},
+}, {
+	name: "SingleValueGroupClaim",
+	groupClaims: []openid.GroupClaim{{
+		Claim: "https://example.com/role",
+	}},
+	claims: map[string]interface{}{
+		"sub":                      "user-id-1",
+		"preferred_username":       "user1",
+		"https://example.com/role": "admin",
+	},
+	expectIdentity: func(s string) store.Identity {
+		return store.Identity{
+			ProviderID: store.ProviderIdentity("oidc:" + s + ":user-id-1"),
+			Username:   "user1",
+			ProviderInfo: map[string][]string{
+				"groups": {"admin"},
+			},
+		}
+	},
+}, {
+	name: "ExistingUserUpdateGroups",
+	groupClaims: []openid.GroupClaim{{
+		Claim: "groups",
+	}},
+	storedIdentities: func(s string) []store.Identity {
+		return []store.Identity{{
+			ProviderID: store.ProviderIdentity("oidc:" + s + ":user-id-1"),
+			Username:   "user1",
+			ProviderInfo: map[string][]string{
+				"groups": {"old"},
+			},
+		}}
+	},
+	claims: map[string]interface{}{
+		"sub":    "user-id-1",
+		"groups": []string{"new"},
+	},
+	expectIdentity: func(s string) store.Identity {
+		return store.Identity{
+			ProviderID: store.ProviderIdentity("oidc:" + s + ":user-id-1"),
+			Username:   "user1",
+			ProviderInfo: map[string][]string{
+				"groups": {"new"},
+			},
+		}
+	},
 }}
 
 func TestHandleCallback(t *testing.T) {
@@ -367,8 +515,9 @@ func TestHandleCallback(t *testing.T) {
 			defer srv.Close()
 
 			p := openid.OpenIDConnectParams{
-				Name:   "oidc",
-				Issuer: srv.URL,
+				Name:        "oidc",
+				Issuer:      srv.URL,
+				GroupClaims: test.groupClaims,
 			}
 			p.ClientID, p.ClientSecret = srv.clientCreds()
 			idp := openid.NewOpenIDConnectIdentityProvider(p)
@@ -378,15 +527,16 @@ func TestHandleCallback(t *testing.T) {
 			ip := f.InitParams(c, "http://example.com/login/oidc")
 			ip.Template = template.New("")
 			template.Must(ip.Template.New("register").Parse("{{.State}}\n{{.Error}}"))
-			err := idp.Init(context.Background(), ip)
+			err := idp.Init(initContext(c), ip)
 			c.Assert(err, qt.IsNil)
 
 			if test.storedIdentities != nil {
 				for _, id := range test.storedIdentities(srv.URL) {
 					err := st.Store.UpdateIdentity(context.Background(), &id, store.Update{
-						store.Username: store.Set,
-						store.Email:    store.Set,
-						store.Name:     store.Set,
+						store.Username:     store.Set,
+						store.Email:        store.Set,
+						store.Name:         store.Set,
+						store.ProviderInfo: store.Set,
 					})
 					c.Assert(err, qt.IsNil)
 				}
@@ -404,7 +554,9 @@ func TestHandleCallback(t *testing.T) {
 			for k, v := range test.claims {
 				srv.setClaim(k, v)
 			}
-			resp, err := cl.Get("/callback?code=" + srv.code())
+			code := authorize(c, cl)
+			resp, err := cl.Get("/callback?code=" + code)
+			c.Assert(err, qt.IsNil)
 			id, err := f.ParseResponse(c, resp)
 			c.Assert(err, qt.IsNil)
 			if test.expectIdentity == nil {
@@ -473,7 +625,7 @@ func TestHandleRegister(t *testing.T) {
 			ip := f.InitParams(c, "http://example.com/login/oidc")
 			ip.Template = template.New("")
 			template.Must(ip.Template.New("register").Parse("{{.State}}\n{{.Error}}"))
-			err := idp.Init(context.Background(), ip)
+			err := idp.Init(initContext(c), ip)
 			c.Assert(err, qt.IsNil)
 
 			for _, id := range test.storedIdentities {
@@ -521,13 +673,560 @@ func TestHandleRegister(t *testing.T) {
 	}
 }
 
+var callbackErrorTests = []struct {
+	name        string
+	setup       func(*qt.C, *testOIDCServer, *idptest.Client) string
+	expectError string
+}{{
+	name: "NoLogin",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		return "/callback?code=" + srv.code()
+	},
+	expectError: `login attempt not found`,
+}, {
+	name: "Replay",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		code := authorize(c, cl)
+		_, err := cl.Get("/callback?code=" + code)
+		c.Assert(err, qt.IsNil)
+		return "/callback?code=" + code
+	},
+	expectError: `login attempt not found`,
+}, {
+	name: "IssuerError",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		authorize(c, cl)
+		return "/callback?error=access_denied"
+	},
+	expectError: `login failed: access_denied`,
+}, {
+	name: "IssuerErrorDescription",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		authorize(c, cl)
+		return "/callback?error=access_denied&error_description=The+user+denied+access."
+	},
+	expectError: `login failed: The user denied access.`,
+}, {
+	name: "InvalidCodeVerifier",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		code := authorize(c, cl)
+		srv.setCodeChallenge(codeChallenge("some-other-verifier"))
+		return "/callback?code=" + code
+	},
+	expectError: `(?s)oauth2: cannot fetch token: 400 Bad Request.*invalid_grant.*`,
+}, {
+	name: "InvalidNonce",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		code := authorize(c, cl)
+		srv.setClaim("nonce", "some-other-nonce")
+		return "/callback?code=" + code
+	},
+	expectError: `invalid nonce in id_token`,
+}, {
+	name: "MissingNonce",
+	setup: func(c *qt.C, srv *testOIDCServer, cl *idptest.Client) string {
+		code := authorize(c, cl)
+		srv.setClaim("nonce", "")
+		return "/callback?code=" + code
+	},
+	expectError: `invalid nonce in id_token`,
+}}
+
+func TestHandleCallbackError(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range callbackErrorTests {
+		c.Run(test.name, func(c *qt.C) {
+			srv := newTestOIDCServer()
+			defer srv.Close()
+
+			p := openid.OpenIDConnectParams{
+				Name:   "oidc",
+				Issuer: srv.URL,
+			}
+			p.ClientID, p.ClientSecret = srv.clientCreds()
+			idp := openid.NewOpenIDConnectIdentityProvider(p)
+			f := idptest.NewFixture(c, candidtest.NewStore())
+			ip := f.InitParams(c, "http://example.com/login/oidc")
+			err := idp.Init(initContext(c), ip)
+			c.Assert(err, qt.IsNil)
+
+			cl := idptest.NewClient(idp, ip.Codec)
+			cl.SetLoginState(idputil.LoginState{
+				ReturnTo: "http://example.com/callback",
+				State:    "1234",
+				Expires:  time.Now().Add(10 * time.Minute),
+			})
+			srv.setClaim("aud", p.ClientID)
+			srv.setClaim("exp", time.Now().Add(time.Minute).Unix())
+			srv.setClaim("iat", time.Now().Unix())
+			srv.setClaim("sub", "user-id-1")
+			srv.setClaim("preferred_username", "user1")
+
+			resp, err := cl.Get(test.setup(c, srv, cl))
+			c.Assert(err, qt.IsNil)
+			defer resp.Body.Close()
+			_, err = f.ParseResponse(c, resp)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+// codeChallenge returns the S256 PKCE code challenge for the given
+// verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestGetGroups(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+	srv.setRefreshToken("refresh-token")
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		RefreshInterval: time.Nanosecond,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	st := candidtest.NewStore()
+	f := idptest.NewFixture(c, st)
+	ip := f.InitParams(c, "http://example.com/login/oidc")
+	err := idp.Init(initContext(c), ip)
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"g1"},
+	})
+	c.Assert(id.ProviderInfo["groups"], qt.DeepEquals, []string{"g1"})
+
+	// The groups are refreshed from the userinfo endpoint.
+	srv.setUserInfo(map[string]interface{}{
+		"sub":    "user-id-1",
+		"groups": []string{"g2", "g3"},
+	})
+	groups, err := idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g2", "g3"})
+	st.AssertUser(c, &store.Identity{
+		ProviderID: id.ProviderID,
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"groups": {"g2", "g3"},
+		},
+	})
+
+	// A new access token is obtained for each refresh.
+	srv.revokeAccessTokens()
+	srv.setUserInfo(map[string]interface{}{
+		"sub":    "user-id-1",
+		"groups": []string{"g4"},
+	})
+	groups, err = idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g4"})
+
+	// Userinfo responses without the group claim leave the groups
+	// unchanged.
+	srv.setUserInfo(map[string]interface{}{
+		"sub": "user-id-1",
+	})
+	err = st.Store.Identity(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	groups, err = idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g4"})
+}
+
+func TestGetGroupsNoRefreshToken(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		RefreshInterval: time.Nanosecond,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"g1"},
+	})
+	srv.setUserInfo(map[string]interface{}{
+		"sub":    "user-id-1",
+		"groups": []string{"g2"},
+	})
+	groups, err := idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+}
+
+func TestGetGroupsRefreshInterval(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+	srv.setRefreshToken("refresh-token")
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		RefreshInterval: time.Hour,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"g1"},
+	})
+
+	// The token was refreshed too recently to be refreshed again.
+	srv.setRefreshToken("")
+	groups, err := idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+}
+
+func TestGetGroupsRefreshRevoked(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+	srv.setRefreshToken("refresh-token")
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		RefreshInterval: time.Nanosecond,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	st := candidtest.NewStore()
+	f := idptest.NewFixture(c, st)
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	claims := map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"g1"},
+	}
+	id := loginTestUser(c, srv, idp, f, claims)
+
+	// Revoke the refresh token at the issuer, the user must now log
+	// in again.
+	failures := testutil.ToFloat64(openid.RefreshFailures.WithLabelValues("oidc", "invalid_grant"))
+	srv.setRefreshToken("new-refresh-token")
+	groups, err := idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 0)
+	c.Assert(testutil.ToFloat64(openid.RefreshFailures.WithLabelValues("oidc", "invalid_grant")), qt.Equals, failures+1)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: id.ProviderID,
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"groups":           {"g1"},
+			"relogin-required": {"refresh token rejected by issuer"},
+		},
+	})
+
+	// The identity stays marked until the user logs in again.
+	err = st.Store.Identity(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	groups, err = idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 0)
+
+	// Logging in again clears the mark and stores the new refresh
+	// token.
+	id = loginTestUser(c, srv, idp, f, claims)
+	c.Assert(id.ProviderInfo["relogin-required"], qt.HasLen, 0)
+	groups, err = idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+}
+
+func TestGetGroupsRefreshUnavailable(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+	srv.setRefreshToken("refresh-token")
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		RefreshInterval: time.Nanosecond,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"g1"},
+	})
+
+	// If the issuer cannot be reached the existing groups are used.
+	failures := testutil.ToFloat64(openid.RefreshFailures.WithLabelValues("oidc", "error"))
+	srv.Close()
+	groups, err := idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+	c.Assert(testutil.ToFloat64(openid.RefreshFailures.WithLabelValues("oidc", "error")), qt.Equals, failures+1)
+}
+
+func TestGetGroupsConcurrentRefresh(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+	srv.setRefreshToken("refresh-token")
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		RefreshInterval: time.Nanosecond,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+		"groups":             []string{"g1"},
+	})
+	srv.setUserInfo(map[string]interface{}{
+		"sub":    "user-id-1",
+		"groups": []string{"g1"},
+	})
+
+	// Block the first refresh at the issuer.
+	var refreshes int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv.setRefreshHook(func() {
+		if atomic.AddInt32(&refreshes, 1) == 1 {
+			close(started)
+			<-release
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		groups, err := idp.GetGroups(context.Background(), id)
+		c.Check(err, qt.IsNil)
+		c.Check(groups, qt.DeepEquals, []string{"g1"})
+	}()
+	<-started
+
+	// While the first refresh is in progress the token is not
+	// refreshed again, which would reuse the refresh token.
+	groups, err := idp.GetGroups(context.Background(), id)
+	close(release)
+	<-done
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+	c.Assert(atomic.LoadInt32(&refreshes), qt.Equals, int32(1))
+
+	// Once the first refresh has completed the token can be
+	// refreshed again.
+	groups, err = idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+	c.Assert(atomic.LoadInt32(&refreshes), qt.Equals, int32(2))
+}
+
+func TestRefreshAllTokenRevoked(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+	srv.setRefreshToken("refresh-token")
+
+	p := openid.OpenIDConnectParams{
+		Name:            "oidc",
+		Issuer:          srv.URL,
+		RefreshInterval: time.Nanosecond,
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	st := candidtest.NewStore()
+	f := idptest.NewFixture(c, st)
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":                "user-id-1",
+		"preferred_username": "user1",
+	})
+
+	// The background refresh finds that the token has been revoked
+	// without the user's groups being requested.
+	srv.setRefreshToken("new-refresh-token")
+	err = openid.RefreshAll(context.Background(), idp)
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: id.ProviderID,
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"relogin-required": {"refresh token rejected by issuer"},
+		},
+	})
+}
+
+type groupsIdentityCreator struct{}
+
+func (groupsIdentityCreator) CreateIdentity(context.Context, *oauth2.Token) (store.Identity, error) {
+	return store.Identity{
+		ProviderID: "oidc:user-id-1",
+		Username:   "user1",
+		ProviderInfo: map[string][]string{
+			"groups": {"creator-group"},
+		},
+	}, nil
+}
+
+func TestGetGroupsIdentityCreator(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newTestOIDCServer()
+	defer srv.Close()
+
+	p := openid.OpenIDConnectParams{
+		Name:   "oidc",
+		Issuer: srv.URL,
+		GroupClaims: []openid.GroupClaim{{
+			Claim: "groups",
+		}},
+		IdentityCreator: groupsIdentityCreator{},
+	}
+	p.ClientID, p.ClientSecret = srv.clientCreds()
+	idp := openid.NewOpenIDConnectIdentityProvider(p)
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := idp.Init(initContext(c), f.InitParams(c, "http://example.com/login/oidc"))
+	c.Assert(err, qt.IsNil)
+
+	id := loginTestUser(c, srv, idp, f, map[string]interface{}{
+		"sub":    "user-id-1",
+		"groups": []string{"g1"},
+	})
+	groups, err := idp.GetGroups(context.Background(), id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"creator-group"})
+}
+
+// initContext returns a context with which to initialise an identity
+// provider, which is cancelled when the test completes.
+func initContext(c *qt.C) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	return ctx
+}
+
+// loginTestUser logs in to the given identity provider as a user with
+// the given claims, returning the identity that was logged in.
+func loginTestUser(c *qt.C, srv *testOIDCServer, idp idppkg.IdentityProvider, f *idptest.Fixture, claims map[string]interface{}) *store.Identity {
+	clientID, _ := srv.clientCreds()
+	srv.setClaim("aud", clientID)
+	srv.setClaim("exp", time.Now().Add(time.Minute).Unix())
+	srv.setClaim("iat", time.Now().Unix())
+	for k, v := range claims {
+		srv.setClaim(k, v)
+	}
+	cl := idptest.NewClient(idp, f.Codec)
+	cl.SetLoginState(idputil.LoginState{
+		ReturnTo: "http://example.com/callback",
+		State:    "1234",
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+	code := authorize(c, cl)
+	resp, err := cl.Get("/callback?code=" + code)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	id, err := f.ParseResponse(c, resp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id, qt.Not(qt.IsNil))
+	return id
+}
+
+// authorize starts a login with the given client and follows the
+// redirect to the issuer's authorization endpoint, returning the
+// authorization code that the issuer sends back to the callback.
+func authorize(c *qt.C, cl *idptest.Client) string {
+	resp, err := cl.Get("/login")
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusFound)
+	hc := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err = hc.Get(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusFound)
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	return u.Query().Get("code")
+}
+
 type testOIDCServer struct {
 	*httptest.Server
 
 	mu                     sync.Mutex
 	clientID, clientSecret string
 	claims_                map[string]interface{}
+	userInfo_              map[string]interface{}
 	code_                  string
+	codeChallenge_         string
+	nonce_                 string
+	refreshToken_          string
+	refreshHook_           func()
+	accessTokens           map[string]bool
 	key_                   *rsa.PrivateKey
 }
 
@@ -542,10 +1241,14 @@ func (s *testOIDCServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.URL.Path {
 	case "/.well-known/openid-configuration":
 		s.serveConfiguration(w, req)
+	case "/auth":
+		s.serveAuth(w, req)
 	case "/token":
 		s.serveToken(w, req)
 	case "/keys":
 		s.serveKeys(w, req)
+	case "/userinfo":
+		s.serveUserInfo(w, req)
 	default:
 		http.NotFound(w, req)
 	}
@@ -557,6 +1260,7 @@ func (s *testOIDCServer) serveConfiguration(w http.ResponseWriter, req *http.Req
 		"authorization_endpoint":                s.URL + "/auth",
 		"token_endpoint":                        s.URL + "/token",
 		"jwks_uri":                              s.URL + "/keys",
+		"userinfo_endpoint":                     s.URL + "/userinfo",
 		"id_token_signing_alg_values_supported": []string{"RS256"},
 	}
 	buf, err := json.Marshal(conf)
@@ -567,6 +1271,34 @@ func (s *testOIDCServer) serveConfiguration(w http.ResponseWriter, req *http.Req
 	w.Write(buf)
 }
 
+// serveAuth implements the authorization endpoint. The user is
+// authorized immediately and redirected back to the client with a code.
+func (s *testOIDCServer) serveAuth(w http.ResponseWriter, req *http.Request) {
+	u, err := url.Parse(req.Form.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	switch req.Form.Get("code_challenge_method") {
+	case "":
+		s.codeChallenge_ = ""
+	case "S256":
+		s.codeChallenge_ = req.Form.Get("code_challenge")
+	default:
+		s.mu.Unlock()
+		http.Error(w, "unsupported code_challenge_method", http.StatusBadRequest)
+		return
+	}
+	s.nonce_ = req.Form.Get("nonce")
+	s.mu.Unlock()
+	u.RawQuery = url.Values{
+		"code":  {s.code()},
+		"state": {req.Form.Get("state")},
+	}.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
 func (s *testOIDCServer) serveToken(w http.ResponseWriter, req *http.Request) {
 	clientID, clientSecret := s.clientCreds()
 	user, pw, ok := req.BasicAuth()
@@ -584,21 +1316,53 @@ func (s *testOIDCServer) serveToken(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if req.Form.Get("code") != s.code() {
+	if req.Form.Get("grant_type") == "refresh_token" {
+		if hook := s.refreshHook(); hook != nil {
+			hook()
+		}
+		if rt := s.refreshToken(); rt == "" || req.Form.Get("refresh_token") != rt {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		buf, err := json.Marshal(map[string]interface{}{
+			"access_token":  s.newAccessToken(),
+			"refresh_token": s.refreshToken(),
+			"expires_in":    60,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+		return
+	}
+	if req.Form.Get("code") != s.code() || !s.checkCodeVerifier(req.Form.Get("code_verifier")) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(`{"error":"invalid_grant"}`))
 		return
 	}
 	tok := map[string]string{
-		"access_token": uuid.New().String(),
+		"access_token": s.newAccessToken(),
+	}
+	if rt := s.refreshToken(); rt != "" {
+		tok["refresh_token"] = rt
 	}
 	signer, err := jose.NewSigner(jose.SigningKey{jose.RS256, s.key()}, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	claims := s.claims()
+	claims := make(map[string]interface{})
+	if nonce := s.nonce(); nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range s.claims() {
+		claims[k] = v
+	}
 	if claims["iss"] == nil {
 		claims["iss"] = s.URL
 	}
@@ -635,6 +1399,99 @@ func (s *testOIDCServer) serveKeys(w http.ResponseWriter, req *http.Request) {
 	w.Write(buf)
 }
 
+func (s *testOIDCServer) serveUserInfo(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.accessTokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")] {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	buf, err := json.Marshal(s.userInfo_)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (s *testOIDCServer) newAccessToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessTokens == nil {
+		s.accessTokens = make(map[string]bool)
+	}
+	tok := uuid.New().String()
+	s.accessTokens[tok] = true
+	return tok
+}
+
+// revokeAccessTokens makes all the issued access tokens invalid.
+func (s *testOIDCServer) revokeAccessTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTokens = nil
+}
+
+func (s *testOIDCServer) refreshToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshToken_
+}
+
+func (s *testOIDCServer) setRefreshToken(rt string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshToken_ = rt
+}
+
+func (s *testOIDCServer) refreshHook() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshHook_
+}
+
+// setRefreshHook sets a function that is called whenever a refresh
+// token is used.
+func (s *testOIDCServer) setRefreshHook(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshHook_ = f
+}
+
+func (s *testOIDCServer) setUserInfo(v map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userInfo_ = v
+}
+
+// checkCodeVerifier checks the given PKCE code verifier against the
+// code challenge sent to the authorization endpoint.
+func (s *testOIDCServer) checkCodeVerifier(verifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.codeChallenge_ == "" {
+		return true
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == s.codeChallenge_
+}
+
+// setCodeChallenge overrides the code challenge sent to the
+// authorization endpoint.
+func (s *testOIDCServer) setCodeChallenge(challenge string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codeChallenge_ = challenge
+}
+
+func (s *testOIDCServer) nonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nonce_
+}
+
 func (s *testOIDCServer) clientCreds() (id, secret string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
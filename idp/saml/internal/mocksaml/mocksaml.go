@@ -0,0 +1,330 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package mocksaml provides a mock SAML identity provider for use in
+// tests.
+package mocksaml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/canonical/candid/idp/saml/internal/xmldsig"
+)
+
+// A User is a user known to the identity provider.
+type User struct {
+	// NameID holds the name identifier of the user.
+	NameID string
+
+	// Attributes holds the attributes that are sent for the user.
+	Attributes map[string][]string
+}
+
+// Handler is an http.Handler that provides a mock implementation of a
+// SAML identity provider. Authentication requests can be sent to
+// /sso using either the HTTP-Redirect or HTTP-POST binding, the
+// response is always sent using the HTTP-POST binding. The metadata of
+// the identity provider is available at /metadata.
+type Handler struct {
+	location      string
+	key           *rsa.PrivateKey
+	cert          *x509.Certificate
+	users         map[string]*User
+	loginUser     string
+	signResponse  bool
+	signAssertion bool
+	conditions    bool
+	audience      bool
+}
+
+// New creates a new Handler that will be served at the given location.
+// A new signing key is generated for each Handler.
+func New(location string) *Handler {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: location},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	h := &Handler{
+		location: location,
+		key:      key,
+		cert:     cert,
+	}
+	h.Reset()
+	return h
+}
+
+// EntityID returns the entity ID of the identity provider.
+func (h *Handler) EntityID() string {
+	return h.location + "/metadata"
+}
+
+// Certificate returns the PEM encoded certificate that the identity
+// provider signs messages with.
+func (h *Handler) Certificate() string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: h.cert.Raw,
+	}))
+}
+
+// AddUser adds u to the identity provider's users.
+func (h *Handler) AddUser(u *User) {
+	h.users[u.NameID] = u
+}
+
+// SetLoginUser sets the user that is logged in when an authentication
+// request is received. If no user is set then authentication requests
+// fail.
+func (h *Handler) SetLoginUser(nameID string) {
+	if _, ok := h.users[nameID]; !ok {
+		panic("no such user: " + nameID)
+	}
+	h.loginUser = nameID
+}
+
+// SetSigning sets which parts of the response are signed. By default
+// only the assertion is signed.
+func (h *Handler) SetSigning(response, assertion bool) {
+	h.signResponse = response
+	h.signAssertion = assertion
+}
+
+// SetConditions sets whether the assertion in the response has
+// conditions, and whether the conditions include an audience
+// restriction. By default both are included.
+func (h *Handler) SetConditions(conditions, audience bool) {
+	h.conditions = conditions
+	h.audience = audience
+}
+
+// Reset sets all of the state in the Handler back to the default. This
+// should be called between tests.
+func (h *Handler) Reset() {
+	h.users = make(map[string]*User)
+	h.loginUser = ""
+	h.signResponse = false
+	h.signAssertion = true
+	h.conditions = true
+	h.audience = true
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/metadata":
+		h.metadata(w, req)
+	case "/sso":
+		h.sso(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (h *Handler) metadata(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	metadataTemplate.Execute(w, map[string]string{
+		"EntityID":    h.EntityID(),
+		"Certificate": base64.StdEncoding.EncodeToString(h.cert.Raw),
+		"SSOURL":      h.location + "/sso",
+	})
+}
+
+// authnRequest holds the parts of an authentication request that are
+// used by the mock identity provider.
+type authnRequest struct {
+	ID                          string `xml:",attr"`
+	AssertionConsumerServiceURL string `xml:",attr"`
+	Issuer                      string `xml:"Issuer"`
+}
+
+func (h *Handler) sso(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	buf, err := base64.StdEncoding.DecodeString(req.Form.Get("SAMLRequest"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Method == "GET" {
+		buf, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(buf)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var ar authnRequest
+	if err := xml.Unmarshal(buf, &ar); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := h.response(&ar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	postFormTemplate.Execute(w, map[string]string{
+		"URL":          ar.AssertionConsumerServiceURL,
+		"SAMLResponse": base64.StdEncoding.EncodeToString(resp),
+		"RelayState":   req.Form.Get("RelayState"),
+	})
+}
+
+// response creates the response to the given authentication request.
+func (h *Handler) response(ar *authnRequest) ([]byte, error) {
+	now := time.Now().UTC()
+	params := responseParams{
+		ResponseID:   fmt.Sprintf("_response%d", now.UnixNano()),
+		AssertionID:  fmt.Sprintf("_assertion%d", now.UnixNano()),
+		InResponseTo: ar.ID,
+		Destination:  ar.AssertionConsumerServiceURL,
+		Audience:     ar.Issuer,
+		Issuer:       h.EntityID(),
+		IssueInstant: now.Format(timeFormat),
+		NotBefore:    now.Add(-time.Minute).Format(timeFormat),
+		NotOnOrAfter: now.Add(5 * time.Minute).Format(timeFormat),
+		User:         h.users[h.loginUser],
+		Conditions:   h.conditions,
+		Restrict:     h.audience,
+	}
+	var buf bytes.Buffer
+	if err := responseTemplate.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	resp, err := xmldsig.Parse(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if a := resp.Child(nsAssertion, "Assertion"); a != nil && h.signAssertion {
+		if err := xmldsig.Sign(a, 1, h.key, h.cert); err != nil {
+			return nil, err
+		}
+	}
+	if h.signResponse {
+		if err := xmldsig.Sign(resp, 1, h.key, h.cert); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Bytes()
+}
+
+const (
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	timeFormat  = "2006-01-02T15:04:05Z"
+)
+
+type responseParams struct {
+	ResponseID   string
+	AssertionID  string
+	InResponseTo string
+	Destination  string
+	Audience     string
+	Issuer       string
+	IssueInstant string
+	NotBefore    string
+	NotOnOrAfter string
+	User         *User
+	Conditions   bool
+	Restrict     bool
+}
+
+var funcs = template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+}
+
+var responseTemplate = template.Must(template.New("").Funcs(funcs).Parse(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="{{.ResponseID}}" Version="2.0" IssueInstant="{{.IssueInstant}}" Destination="{{xml .Destination}}" InResponseTo="{{xml .InResponseTo}}">
+  <saml:Issuer>{{xml .Issuer}}</saml:Issuer>
+{{- if .User}}
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ID="{{.AssertionID}}" Version="2.0" IssueInstant="{{.IssueInstant}}">
+    <saml:Issuer>{{xml .Issuer}}</saml:Issuer>
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">{{xml .User.NameID}}</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData InResponseTo="{{xml .InResponseTo}}" Recipient="{{xml .Destination}}" NotOnOrAfter="{{.NotOnOrAfter}}"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+{{- if .Conditions}}
+    <saml:Conditions NotBefore="{{.NotBefore}}" NotOnOrAfter="{{.NotOnOrAfter}}">
+{{- if .Restrict}}
+      <saml:AudienceRestriction><saml:Audience>{{xml .Audience}}</saml:Audience></saml:AudienceRestriction>
+{{- end}}
+    </saml:Conditions>
+{{- end}}
+    <saml:AuthnStatement AuthnInstant="{{.IssueInstant}}"><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement>
+    <saml:AttributeStatement>
+{{- range $name, $values := .User.Attributes}}
+      <saml:Attribute Name="{{xml $name}}" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:basic">
+{{- range $values}}
+        <saml:AttributeValue xsi:type="xs:string">{{xml .}}</saml:AttributeValue>
+{{- end}}
+      </saml:Attribute>
+{{- end}}
+    </saml:AttributeStatement>
+  </saml:Assertion>
+{{- else}}
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Responder"><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"/></samlp:StatusCode><samlp:StatusMessage>no user logged in</samlp:StatusMessage></samlp:Status>
+{{- end}}
+</samlp:Response>
+`))
+
+var metadataTemplate = template.Must(template.New("").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="{{xml .EntityID}}">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data>
+          <ds:X509Certificate>{{.Certificate}}</ds:X509Certificate>
+        </ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:2.0:nameid-format:persistent</md:NameIDFormat>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="{{xml .SSOURL}}"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="{{xml .SSOURL}}"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>
+`))
+
+var postFormTemplate = htmltemplate.Must(htmltemplate.New("").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.URL}}">
+<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,221 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package xmldsig
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// Namespace is the XML digital signature namespace.
+	Namespace = "http://www.w3.org/2000/09/xmldsig#"
+
+	excC14N            = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+// signatureMethods holds the supported signature algorithms. SHA-1
+// based algorithms are deliberately not supported.
+var signatureMethods = map[string]bool{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": true,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": true,
+}
+
+// digestMethods holds the supported digest algorithms.
+var digestMethods = map[string]bool{
+	"http://www.w3.org/2001/04/xmlenc#sha256": true,
+	"http://www.w3.org/2001/04/xmlenc#sha512": true,
+}
+
+// transforms holds the supported reference transforms.
+var transforms = map[string]bool{
+	envelopedSignature: true,
+	excC14N:            true,
+}
+
+// ErrNoSignature is the cause of the error returned from Verify when
+// the element is not signed.
+var ErrNoSignature = errgo.New("no signature")
+
+// Signature returns the enveloped signature of the given element, or
+// nil if it doesn't have one.
+func Signature(e *Element) *Element {
+	return e.Child(Namespace, "Signature")
+}
+
+// Verify verifies the enveloped signature of the given element at the
+// given time, and returns the signed element. Only the returned element
+// is covered by the signature, so any information must be read from it
+// rather than from e.
+//
+// The signature must be a child of the element and have a single
+// reference to the element itself, which must be identified by its ID
+// attribute. The signature must have been made by the key of one of the
+// given certificates, which must be valid at the given time. If the
+// element has no signature then an error with a cause of ErrNoSignature
+// is returned.
+func Verify(e *Element, certs []*x509.Certificate, now time.Time) (*Element, error) {
+	sigs := e.ChildElements(Namespace, "Signature")
+	switch len(sigs) {
+	case 0:
+		return nil, errgo.WithCausef(nil, ErrNoSignature, "%s not signed", e.Name())
+	case 1:
+	default:
+		return nil, errgo.Newf("invalid signature: %s has %d signatures", e.Name(), len(sigs))
+	}
+	id := e.Attr("ID")
+	if id == "" {
+		return nil, errgo.Newf("invalid signature: %s has no ID", e.Name())
+	}
+	if err := checkSignature(sigs[0], id); err != nil {
+		return nil, errgo.Notef(err, "invalid signature")
+	}
+	if refersTo(e.e, sigs[0].e, id) {
+		// Only the signature that has been checked may be
+		// used to validate the element.
+		return nil, errgo.Newf("invalid signature: multiple signatures reference %s", e.Name())
+	}
+	if len(certs) == 0 {
+		return nil, errgo.Newf("invalid signature: no certificates")
+	}
+
+	nsctx, err := etreeutils.NSBuildParentContext(e.e)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	detached, err := etreeutils.NSDetatch(nsctx, e.e)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	stores := []dsig.X509CertificateStore{&dsig.MemoryX509CertificateStore{Roots: certs}}
+	if sigs[0].Child(Namespace, "KeyInfo") == nil && len(certs) > 1 {
+		// Without KeyInfo the certificate used to make the
+		// signature is only known when there is a single root,
+		// so try each certificate in turn.
+		stores = stores[:0]
+		for _, cert := range certs {
+			stores = append(stores, &dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert}})
+		}
+	}
+	for _, store := range stores {
+		ctx := dsig.NewDefaultValidationContext(store)
+		ctx.Clock = dsig.NewFakeClockAt(now)
+		var signed *etree.Element
+		signed, err = ctx.Validate(detached)
+		if err == nil {
+			return &Element{signed}, nil
+		}
+	}
+	return nil, errgo.Notef(err, "invalid signature")
+}
+
+// checkSignature checks that the given signature only uses the
+// supported algorithms and has a single reference to the given ID.
+func checkSignature(sig *Element, id string) error {
+	signedInfo := sig.Child(Namespace, "SignedInfo")
+	if signedInfo == nil {
+		return errgo.Newf("no SignedInfo")
+	}
+	cm := signedInfo.Child(Namespace, "CanonicalizationMethod")
+	if cm == nil || cm.Attr("Algorithm") != excC14N {
+		return errgo.Newf("unsupported canonicalization method")
+	}
+	sm := signedInfo.Child(Namespace, "SignatureMethod")
+	if sm == nil {
+		return errgo.Newf("no SignatureMethod")
+	}
+	if !signatureMethods[sm.Attr("Algorithm")] {
+		return errgo.Newf("unsupported signature method %q", sm.Attr("Algorithm"))
+	}
+	refs := signedInfo.ChildElements(Namespace, "Reference")
+	if len(refs) != 1 {
+		return errgo.Newf("expected 1 reference, found %d", len(refs))
+	}
+	if refs[0].Attr("URI") != "#"+id {
+		return errgo.Newf("reference does not match element")
+	}
+	if ts := refs[0].Child(Namespace, "Transforms"); ts != nil {
+		for _, t := range ts.ChildElements(Namespace, "Transform") {
+			if !transforms[t.Attr("Algorithm")] {
+				return errgo.Newf("unsupported transform %q", t.Attr("Algorithm"))
+			}
+		}
+	}
+	dm := refs[0].Child(Namespace, "DigestMethod")
+	if dm == nil {
+		return errgo.Newf("no DigestMethod")
+	}
+	if !digestMethods[dm.Attr("Algorithm")] {
+		return errgo.Newf("unsupported digest method %q", dm.Attr("Algorithm"))
+	}
+	return nil
+}
+
+// refersTo reports whether any signature within e, other than sig, has
+// a reference that could refer to the element with the given ID.
+func refersTo(e, sig *etree.Element, id string) bool {
+	for _, ce := range e.ChildElements() {
+		if ce == sig {
+			continue
+		}
+		if ce := (&Element{ce}); ce.Is(Namespace, "Signature") {
+			if signedInfo := ce.Child(Namespace, "SignedInfo"); signedInfo != nil {
+				for _, ref := range signedInfo.ChildElements(Namespace, "Reference") {
+					if uri := ref.Attr("URI"); uri == "" || uri[1:] == id {
+						return true
+					}
+				}
+			}
+		}
+		if refersTo(ce, sig, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign adds an enveloped RSA-SHA256 signature to the given element
+// using the given key and certificate, which is included in the
+// signature's KeyInfo. The element must have an ID attribute. The
+// signature is inserted so that it follows the first n child elements
+// of e.
+func Sign(e *Element, n int, key *rsa.PrivateKey, cert *x509.Certificate) error {
+	if e.Attr("ID") == "" {
+		return errgo.Newf("%s has no ID", e.Name())
+	}
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+	}))
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := ctx.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		return errgo.Mask(err)
+	}
+	nsctx, err := etreeutils.NSBuildParentContext(e.e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	detached, err := etreeutils.NSDetatch(nsctx, e.e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sig, err := ctx.ConstructSignature(detached, true)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	index := len(e.e.Child)
+	if elems := e.e.ChildElements(); n < len(elems) {
+		index = elems[n].Index()
+	}
+	e.e.InsertChildAt(index, sig)
+	return nil
+}
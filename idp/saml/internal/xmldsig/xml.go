@@ -0,0 +1,145 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package xmldsig provides the subset of XML digital signatures needed
+// to verify, and for testing create, signed SAML messages.
+//
+// The signatures are processed by github.com/russellhaering/goxmldsig,
+// this package restricts the signatures that are accepted and provides
+// a namespace aware view of the parsed elements.
+package xmldsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/beevik/etree"
+	"gopkg.in/errgo.v1"
+)
+
+// An Element is an element in a parsed document.
+type Element struct {
+	e *etree.Element
+}
+
+// Parse parses the given XML document. Documents containing a DTD are
+// rejected.
+func Parse(data []byte) (*Element, error) {
+	if err := checkWellFormed(data); err != nil {
+		return nil, errgo.Notef(err, "cannot parse XML")
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, errgo.Notef(err, "cannot parse XML")
+	}
+	var root *etree.Element
+	for _, t := range doc.Child {
+		switch t := t.(type) {
+		case *etree.Element:
+			if root != nil {
+				return nil, errgo.Newf("cannot parse XML: multiple document elements")
+			}
+			root = t
+		case *etree.CharData:
+			if strings.TrimSpace(t.Data) != "" {
+				return nil, errgo.Newf("cannot parse XML: character data outside document element")
+			}
+		}
+	}
+	if root == nil {
+		return nil, errgo.Newf("cannot parse XML: no document element")
+	}
+	return &Element{root}, nil
+}
+
+// checkWellFormed checks that the given document is well formed and
+// does not contain a DTD. The etree parser does not check that start
+// and end elements match.
+func checkWellFormed(data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if _, ok := t.(xml.Directive); ok {
+			return errgo.Newf("DTDs are not supported")
+		}
+	}
+}
+
+// Bytes returns the XML encoding of the document that has the element
+// as its document element.
+func (e *Element) Bytes() ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(e.e.Copy())
+	buf, err := doc.WriteToBytes()
+	return buf, errgo.Mask(err)
+}
+
+// Name returns the local name of the element.
+func (e *Element) Name() string {
+	return e.e.Tag
+}
+
+// Is reports whether the element has the given namespace and local
+// name.
+func (e *Element) Is(space, name string) bool {
+	return e.e.Tag == name && e.e.NamespaceURI() == space
+}
+
+// Attr returns the value of the unqualified attribute with the given
+// name, or an empty string if there is no such attribute.
+func (e *Element) Attr(name string) string {
+	for _, a := range e.e.Attr {
+		if a.Space == "" && a.Key == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first child element with the given namespace and
+// local name, or nil if there is no such element.
+func (e *Element) Child(space, name string) *Element {
+	if elems := e.ChildElements(space, name); len(elems) > 0 {
+		return elems[0]
+	}
+	return nil
+}
+
+// ChildElements returns all the child elements with the given namespace
+// and local name.
+func (e *Element) ChildElements(space, name string) []*Element {
+	var elems []*Element
+	for _, ce := range e.e.ChildElements() {
+		ce := &Element{ce}
+		if ce.Is(space, name) {
+			elems = append(elems, ce)
+		}
+	}
+	return elems
+}
+
+// Text returns the character data directly contained in the element
+// with any leading and trailing white space removed.
+func (e *Element) Text() string {
+	var sb strings.Builder
+	for _, t := range e.e.Child {
+		if cd, ok := t.(*etree.CharData); ok {
+			sb.WriteString(cd.Data)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// SetText replaces the character data directly contained in the
+// element.
+func (e *Element) SetText(s string) {
+	e.e.SetText(s)
+}
@@ -0,0 +1,306 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package xmldsig_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/saml/internal/xmldsig"
+)
+
+var parseErrorTests = []struct {
+	name        string
+	doc         string
+	expectError string
+}{{
+	name:        "DTD",
+	doc:         `<!DOCTYPE root [<!ELEMENT root EMPTY>]><root/>`,
+	expectError: `cannot parse XML: DTDs are not supported`,
+}, {
+	name:        "Empty",
+	doc:         ``,
+	expectError: `cannot parse XML: no document element`,
+}, {
+	name:        "MultipleRoots",
+	doc:         `<a/><b/>`,
+	expectError: `cannot parse XML: multiple document elements`,
+}, {
+	name:        "MismatchedEnd",
+	doc:         `<a></b>`,
+	expectError: `cannot parse XML: XML syntax error on line 1: element <a> closed by </b>`,
+}, {
+	name:        "Unterminated",
+	doc:         `<a><b></b>`,
+	expectError: `cannot parse XML: XML syntax error on line 1: unexpected EOF`,
+}}
+
+func TestParseErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseErrorTests {
+		c.Run(test.name, func(c *qt.C) {
+			_, err := xmldsig.Parse([]byte(test.doc))
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+const testDoc = `<p:Response xmlns:p="urn:p" xmlns:a="urn:a" ID="r1"><a:Issuer>issuer</a:Issuer><a:Assertion ID="a1"><a:Issuer>issuer</a:Issuer><a:Subject>alice</a:Subject></a:Assertion></p:Response>`
+
+func TestSignVerify(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	e, err := verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(e.Child("urn:a", "Issuer").Text(), qt.Equals, "issuer")
+	c.Assert(e.Child("urn:a", "Subject").Text(), qt.Equals, "alice")
+	c.Assert(xmldsig.Signature(e), qt.IsNil)
+}
+
+func TestVerifyMultipleCertificates(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	_, cert2 := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert2, cert}, time.Now())
+	c.Assert(err, qt.IsNil)
+
+	// Without KeyInfo each certificate is tried in turn.
+	doc = removeKeyInfo(c, doc)
+	_, err = verifyAssertion(c, doc, []*x509.Certificate{cert2, cert}, time.Now())
+	c.Assert(err, qt.IsNil)
+}
+
+func TestVerifyNotSigned(t *testing.T) {
+	c := qt.New(t)
+	_, cert := newCertificate(c)
+	doc, err := xmldsig.Parse([]byte(testDoc))
+	c.Assert(err, qt.IsNil)
+	_, err = xmldsig.Verify(doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `Response not signed`)
+	c.Assert(errgo.Cause(err), qt.Equals, xmldsig.ErrNoSignature)
+}
+
+func TestVerifyWrongCertificate(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	_, cert2 := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert2}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: Could not verify certificate against trusted certs`)
+
+	doc = removeKeyInfo(c, doc)
+	_, err = verifyAssertion(c, doc, []*x509.Certificate{cert2}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: crypto/rsa: verification error`)
+}
+
+func TestVerifyExpiredCertificate(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now().Add(2*time.Hour))
+	c.Assert(err, qt.ErrorMatches, `invalid signature: Cert is not valid at this time`)
+}
+
+func TestVerifyModified(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	doc = replace(c, doc, "alice", "mallory")
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: Signature could not be verified`)
+}
+
+func TestVerifyModifiedSignedInfo(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+
+	// Change the digest to match a modified assertion.
+	modified := signedDoc(c, key, cert, "alice", "mallory")
+	doc = replace(c, doc, digestValue(c, doc), digestValue(c, modified))
+	doc = replace(c, doc, "alice", "mallory")
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: crypto/rsa: verification error`)
+}
+
+func TestVerifyWrongReference(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	doc = replace(c, doc, `URI="#a1"`, `URI="#r1"`)
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: reference does not match element`)
+}
+
+func TestVerifyEmptyReference(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	doc = replace(c, doc, `URI="#a1"`, `URI=""`)
+	_, err := verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: reference does not match element`)
+}
+
+func TestVerifySignatureNotChild(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+
+	// A signature of the assertion does not sign the response.
+	e, err := xmldsig.Parse([]byte(replace(c, doc, `URI="#a1"`, `URI="#r1"`)))
+	c.Assert(err, qt.IsNil)
+	_, err = xmldsig.Verify(e, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `Response not signed`)
+	c.Assert(errgo.Cause(err), qt.Equals, xmldsig.ErrNoSignature)
+}
+
+func TestVerifyMultipleSignatures(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc, err := xmldsig.Parse([]byte(testDoc))
+	c.Assert(err, qt.IsNil)
+	a := doc.Child("urn:a", "Assertion")
+	err = xmldsig.Sign(a, 1, key, cert)
+	c.Assert(err, qt.IsNil)
+	err = xmldsig.Sign(a, 1, key, cert)
+	c.Assert(err, qt.IsNil)
+	_, err = xmldsig.Verify(a, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: Assertion has 2 signatures`)
+}
+
+func TestVerifyNestedSignature(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+
+	// Add a second signature of the assertion within the subject.
+	e, err := xmldsig.Parse([]byte(doc))
+	c.Assert(err, qt.IsNil)
+	sig := xmldsig.Signature(e.Child("urn:a", "Assertion"))
+	buf, err := sig.Bytes()
+	c.Assert(err, qt.IsNil)
+	doc = replace(c, doc, "alice", string(buf)+"alice")
+	_, err = verifyAssertion(c, doc, []*x509.Certificate{cert}, time.Now())
+	c.Assert(err, qt.ErrorMatches, `invalid signature: multiple signatures reference Assertion`)
+}
+
+var unsupportedAlgorithmTests = []struct {
+	name        string
+	old         string
+	new         string
+	expectError string
+}{{
+	name:        "RSASHA1",
+	old:         "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+	new:         "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+	expectError: `invalid signature: unsupported signature method "http://www.w3.org/2000/09/xmldsig#rsa-sha1"`,
+}, {
+	name:        "DSASHA1",
+	old:         "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+	new:         "http://www.w3.org/2000/09/xmldsig#dsa-sha1",
+	expectError: `invalid signature: unsupported signature method "http://www.w3.org/2000/09/xmldsig#dsa-sha1"`,
+}, {
+	name:        "SHA1Digest",
+	old:         "http://www.w3.org/2001/04/xmlenc#sha256",
+	new:         "http://www.w3.org/2000/09/xmldsig#sha1",
+	expectError: `invalid signature: unsupported digest method "http://www.w3.org/2000/09/xmldsig#sha1"`,
+}, {
+	name:        "Canonicalization",
+	old:         `<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>`,
+	new:         `<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2006/12/xml-c14n11"/>`,
+	expectError: `invalid signature: unsupported canonicalization method`,
+}, {
+	name:        "Transform",
+	old:         `<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>`,
+	new:         `<ds:Transform Algorithm="http://www.w3.org/2006/12/xml-c14n11"/>`,
+	expectError: `invalid signature: unsupported transform "http://www.w3.org/2006/12/xml-c14n11"`,
+}}
+
+func TestVerifyUnsupportedAlgorithm(t *testing.T) {
+	c := qt.New(t)
+	key, cert := newCertificate(c)
+	doc := signedDoc(c, key, cert)
+	for _, test := range unsupportedAlgorithmTests {
+		c.Run(test.name, func(c *qt.C) {
+			_, err := verifyAssertion(c, replace(c, doc, test.old, test.new), []*x509.Certificate{cert}, time.Now())
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+// signedDoc returns testDoc with the assertion signed with the given
+// key. If oldnew is not empty then it holds pairs of strings that are
+// replaced in testDoc before it is signed.
+func signedDoc(c *qt.C, key *rsa.PrivateKey, cert *x509.Certificate, oldnew ...string) string {
+	doc, err := xmldsig.Parse([]byte(strings.NewReplacer(oldnew...).Replace(testDoc)))
+	c.Assert(err, qt.IsNil)
+	err = xmldsig.Sign(doc.Child("urn:a", "Assertion"), 1, key, cert)
+	c.Assert(err, qt.IsNil)
+	buf, err := doc.Bytes()
+	c.Assert(err, qt.IsNil)
+	return string(buf)
+}
+
+// verifyAssertion parses the given document and verifies the assertion
+// within it.
+func verifyAssertion(c *qt.C, doc string, certs []*x509.Certificate, now time.Time) (*xmldsig.Element, error) {
+	e, err := xmldsig.Parse([]byte(doc))
+	c.Assert(err, qt.IsNil)
+	a := e.Child("urn:a", "Assertion")
+	c.Assert(a, qt.Not(qt.IsNil))
+	return xmldsig.Verify(a, certs, now)
+}
+
+// replace replaces old with new in the given document, which must
+// contain old.
+func replace(c *qt.C, doc, old, new string) string {
+	c.Assert(strings.Contains(doc, old), qt.IsTrue, qt.Commentf("%q not found in %s", old, doc))
+	return strings.Replace(doc, old, new, 1)
+}
+
+var keyInfoRE = regexp.MustCompile(`<ds:KeyInfo>.*</ds:KeyInfo>`)
+
+// removeKeyInfo removes the KeyInfo from the signature in the given
+// document.
+func removeKeyInfo(c *qt.C, doc string) string {
+	c.Assert(keyInfoRE.MatchString(doc), qt.IsTrue)
+	return keyInfoRE.ReplaceAllString(doc, "")
+}
+
+var digestValueRE = regexp.MustCompile(`<ds:DigestValue>(.*)</ds:DigestValue>`)
+
+// digestValue returns the reference digest value in the given document.
+func digestValue(c *qt.C, doc string) string {
+	m := digestValueRE.FindStringSubmatch(doc)
+	c.Assert(m, qt.HasLen, 2)
+	return m[1]
+}
+
+func newCertificate(c *qt.C) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, qt.IsNil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	c.Assert(err, qt.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, qt.IsNil)
+	return key, cert
+}
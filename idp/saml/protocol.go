@@ -0,0 +1,373 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/saml/internal/xmldsig"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	bindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	confirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	timeFormat = "2006-01-02T15:04:05Z"
+)
+
+// maxClockSkew is the maximum difference that is tolerated between the
+// clocks of candid and the identity provider when checking the validity
+// period of an assertion.
+const maxClockSkew = 3 * time.Minute
+
+// authnRequest is a SAML authentication request.
+type authnRequest struct {
+	XMLName                     xml.Name      `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string        `xml:",attr"`
+	Version                     string        `xml:",attr"`
+	IssueInstant                string        `xml:",attr"`
+	Destination                 string        `xml:",attr"`
+	AssertionConsumerServiceURL string        `xml:",attr"`
+	ProtocolBinding             string        `xml:",attr"`
+	Issuer                      string        `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameIDPolicy                *nameIDPolicy `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+type nameIDPolicy struct {
+	Format      string `xml:",attr,omitempty"`
+	AllowCreate bool   `xml:",attr"`
+}
+
+// entityDescriptor holds SAML metadata. It is used both to publish the
+// metadata of candid as a service provider and to read the metadata of
+// the identity provider.
+type entityDescriptor struct {
+	XMLName          xml.Name       `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID         string         `xml:"entityID,attr"`
+	SPSSODescriptor  *ssoDescriptor `xml:"SPSSODescriptor"`
+	IDPSSODescriptor *ssoDescriptor `xml:"IDPSSODescriptor"`
+}
+
+type ssoDescriptor struct {
+	AuthnRequestsSigned        string          `xml:",attr,omitempty"`
+	WantAssertionsSigned       string          `xml:",attr,omitempty"`
+	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
+	KeyDescriptors             []keyDescriptor `xml:"KeyDescriptor"`
+	NameIDFormats              []string        `xml:"NameIDFormat"`
+	SingleSignOnServices       []endpoint      `xml:"SingleSignOnService"`
+	AssertionConsumerServices  []endpoint      `xml:"AssertionConsumerService"`
+}
+
+type keyDescriptor struct {
+	Use          string   `xml:"use,attr,omitempty"`
+	Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+}
+
+type endpoint struct {
+	Binding  string `xml:",attr"`
+	Location string `xml:",attr"`
+	Index    string `xml:"index,attr,omitempty"`
+}
+
+// signingCertificates returns the certificates that the identity
+// provider described by the given descriptor uses to sign messages.
+func (d *ssoDescriptor) signingCertificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, kd := range d.KeyDescriptors {
+		if kd.Use != "" && kd.Use != "signing" {
+			continue
+		}
+		for _, s := range kd.Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot decode certificate")
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// singleSignOnService returns the location of the single sign-on
+// service with the given binding, or an empty string if there is no
+// such service.
+func (d *ssoDescriptor) singleSignOnService(binding string) string {
+	for _, ep := range d.SingleSignOnServices {
+		if ep.Binding == binding {
+			return ep.Location
+		}
+	}
+	return ""
+}
+
+// parseCertificates parses all the PEM encoded certificates in the
+// given data.
+func parseCertificates(data string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// An assertion holds the information about an authenticated user taken
+// from a validated SAML response.
+type assertion struct {
+	// InResponseTo holds the ID of the request that the response
+	// was sent for.
+	InResponseTo string
+
+	// NameID holds the identifier of the user.
+	NameID string
+
+	// Attributes holds the values of the attributes in the
+	// assertion. Each attribute is stored under both its name and
+	// its friendly name.
+	Attributes map[string][]string
+}
+
+// attribute returns the first value of the given attribute, or an empty
+// string if it has no values.
+func (a *assertion) attribute(name string) string {
+	if vs := a.Attributes[name]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// responseValidator holds the parameters used to validate a SAML
+// response.
+type responseValidator struct {
+	// entityID holds the entity ID of the service provider, which
+	// must be in the audience of the assertion.
+	entityID string
+
+	// acsURL holds the URL of the assertion consumer service, to
+	// which the response must have been sent.
+	acsURL string
+
+	// issuer holds the entity ID of the identity provider, the
+	// assertion must have been issued by it.
+	issuer string
+
+	// certs holds the certificates that can be used to sign the
+	// response.
+	certs []*x509.Certificate
+}
+
+// parseResponse parses the given base64 encoded SAML response and
+// validates it at the given time. Either the response or the assertion
+// within it must be signed. Only the contents of the element that has
+// been verified are used, so any content added outside the signature
+// is ignored.
+func (v *responseValidator) parseResponse(samlResponse string, now time.Time) (*assertion, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(samlResponse), ""))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decode SAML response")
+	}
+	resp, err := xmldsig.Parse(buf)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !resp.Is(nsProtocol, "Response") {
+		return nil, errgo.Newf("unexpected SAML message %s", resp.Name())
+	}
+	responseSigned := false
+	switch signed, err := xmldsig.Verify(resp, v.certs, now); errgo.Cause(err) {
+	case nil:
+		resp = signed
+		responseSigned = true
+	case xmldsig.ErrNoSignature:
+	default:
+		return nil, errgo.Mask(err)
+	}
+	if dest := resp.Attr("Destination"); dest != "" && dest != v.acsURL {
+		return nil, errgo.Newf("response has unexpected destination %q", dest)
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	a := &assertion{
+		InResponseTo: resp.Attr("InResponseTo"),
+	}
+	if a.InResponseTo == "" {
+		return nil, errgo.Newf("unsolicited responses are not supported")
+	}
+	if resp.Child(nsAssertion, "EncryptedAssertion") != nil {
+		return nil, errgo.Newf("encrypted assertions are not supported")
+	}
+	assertions := resp.ChildElements(nsAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errgo.Newf("expected 1 assertion, found %d", len(assertions))
+	}
+	ae := assertions[0]
+	if !responseSigned {
+		ae, err = xmldsig.Verify(ae, v.certs, now)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot verify assertion")
+		}
+	}
+	if err := v.checkAssertion(ae, a.InResponseTo, now); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	a.NameID = ae.Child(nsAssertion, "Subject").Child(nsAssertion, "NameID").Text()
+	a.Attributes = make(map[string][]string)
+	for _, as := range ae.ChildElements(nsAssertion, "AttributeStatement") {
+		for _, attr := range as.ChildElements(nsAssertion, "Attribute") {
+			var values []string
+			for _, av := range attr.ChildElements(nsAssertion, "AttributeValue") {
+				values = append(values, av.Text())
+			}
+			for _, name := range []string{attr.Attr("Name"), attr.Attr("FriendlyName")} {
+				if name != "" {
+					a.Attributes[name] = append(a.Attributes[name], values...)
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// checkStatus returns an error if the given response does not have a
+// success status.
+func checkStatus(resp *xmldsig.Element) error {
+	status := resp.Child(nsProtocol, "Status")
+	if status == nil {
+		return errgo.Newf("response has no status")
+	}
+	code := status.Child(nsProtocol, "StatusCode")
+	if code == nil {
+		return errgo.Newf("response has no status code")
+	}
+	if code.Attr("Value") == statusSuccess {
+		return nil
+	}
+	value := code.Attr("Value")
+	if sub := code.Child(nsProtocol, "StatusCode"); sub != nil {
+		value = sub.Attr("Value")
+	}
+	if msg := status.Child(nsProtocol, "StatusMessage"); msg != nil && msg.Text() != "" {
+		return errgo.Newf("login failed: %s (%s)", msg.Text(), value)
+	}
+	return errgo.Newf("login failed: %s", value)
+}
+
+// checkAssertion checks that the given assertion is valid for this
+// service provider at the given time. The assertion must have been
+// issued by the expected issuer and must have an audience restriction
+// that includes the service provider.
+func (v *responseValidator) checkAssertion(ae *xmldsig.Element, inResponseTo string, now time.Time) error {
+	issuer := ae.Child(nsAssertion, "Issuer")
+	if issuer == nil {
+		return errgo.Newf("assertion has no issuer")
+	}
+	if issuer.Text() != v.issuer {
+		return errgo.Newf("assertion has unexpected issuer %q", issuer.Text())
+	}
+	subject := ae.Child(nsAssertion, "Subject")
+	if subject == nil || subject.Child(nsAssertion, "NameID") == nil || subject.Child(nsAssertion, "NameID").Text() == "" {
+		return errgo.Newf("assertion has no subject")
+	}
+	confirmed := false
+	for _, sc := range subject.ChildElements(nsAssertion, "SubjectConfirmation") {
+		if sc.Attr("Method") != confirmationBearer {
+			continue
+		}
+		scd := sc.Child(nsAssertion, "SubjectConfirmationData")
+		if scd == nil || scd.Attr("Recipient") != v.acsURL {
+			continue
+		}
+		if scd.Attr("InResponseTo") != inResponseTo {
+			// The response itself might not be signed, so the
+			// request ID must also be in the signed assertion.
+			continue
+		}
+		if expired(now, scd.Attr("NotOnOrAfter")) {
+			continue
+		}
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		return errgo.Newf("assertion has no valid bearer subject confirmation")
+	}
+	conditions := ae.Child(nsAssertion, "Conditions")
+	if conditions == nil {
+		return errgo.Newf("assertion has no conditions")
+	}
+	if nb := conditions.Attr("NotBefore"); nb != "" && notYetValid(now, nb) {
+		return errgo.Newf("assertion not valid until %s", nb)
+	}
+	if nooa := conditions.Attr("NotOnOrAfter"); nooa != "" && expired(now, nooa) {
+		return errgo.Newf("assertion expired at %s", nooa)
+	}
+	ars := conditions.ChildElements(nsAssertion, "AudienceRestriction")
+	if len(ars) == 0 {
+		return errgo.Newf("assertion has no audience restriction")
+	}
+	for _, ar := range ars {
+		found := false
+		for _, aud := range ar.ChildElements(nsAssertion, "Audience") {
+			if aud.Text() == v.entityID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errgo.Newf("assertion not intended for %s", v.entityID)
+		}
+	}
+	return nil
+}
+
+// expired reports whether the given SAML time is in the past, allowing
+// for clock skew. Invalid times are treated as expired.
+func expired(now time.Time, s string) bool {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return true
+	}
+	return !now.Before(t.Add(maxClockSkew))
+}
+
+// notYetValid reports whether the given SAML time is in the future,
+// allowing for clock skew. Invalid times are treated as being in the
+// future.
+func notYetValid(now time.Time, s string) bool {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return true
+	}
+	return now.Add(maxClockSkew).Before(t)
+}
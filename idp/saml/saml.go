@@ -0,0 +1,673 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package saml is an identity provider that authenticates users with a
+// SAML 2.0 identity provider. Candid acts as a SAML service provider
+// using the web browser SSO profile.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/names.v2"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.idp.saml")
+
+func init() {
+	idp.Register("saml", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal saml parameters")
+		}
+		if p.Name == "" {
+			return nil, errgo.Newf("name not specified")
+		}
+		if p.MetadataURL == "" {
+			if p.SSOURL == "" {
+				return nil, errgo.Newf("metadata-url or sso-url must be specified")
+			}
+			if p.Issuer == "" {
+				return nil, errgo.Newf("issuer not specified")
+			}
+			if p.Certificate == "" {
+				return nil, errgo.Newf("certificate not specified")
+			}
+		}
+		switch p.Binding {
+		case "", "redirect", "post":
+		default:
+			return nil, errgo.Newf("unsupported binding %q", p.Binding)
+		}
+		return NewIdentityProvider(p), nil
+	})
+}
+
+// Params holds the parameters for a SAML identity provider.
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name"`
+
+	// Description is the description that will be used with the
+	// identity provider. If this is not set then Name will be used.
+	Description string `yaml:"description"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @ separator).
+	Domain string `yaml:"domain"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden"`
+
+	// MatchEmailAddr is a regular expression that is used to determine if
+	// this identity provider can be used for a particular user email.
+	MatchEmailAddr string `yaml:"match-email-addr"`
+
+	// EntityID is the entity ID that identifies candid to the SAML
+	// identity provider. If this is not set then the URL of the
+	// service provider metadata is used.
+	EntityID string `yaml:"entity-id"`
+
+	// MetadataURL is the URL of the SAML identity provider's
+	// metadata. If this is set then any of SSOURL, Issuer and
+	// Certificate that are not set will be taken from the metadata.
+	MetadataURL string `yaml:"metadata-url"`
+
+	// SSOURL is the URL of the single sign-on service of the SAML
+	// identity provider.
+	SSOURL string `yaml:"sso-url"`
+
+	// Issuer is the entity ID of the SAML identity provider. Only
+	// assertions issued by this entity are accepted.
+	Issuer string `yaml:"issuer"`
+
+	// Certificate contains the PEM encoded certificates that the SAML
+	// identity provider uses to sign its responses.
+	Certificate string `yaml:"certificate"`
+
+	// Binding is the binding used to send authentication requests to
+	// the SAML identity provider, either "redirect" or "post". If
+	// this is not set then the HTTP-Redirect binding is used if the
+	// identity provider supports it.
+	Binding string `yaml:"binding"`
+
+	// NameIDFormat is the format of name identifier to request from
+	// the SAML identity provider. The name identifier is used to
+	// identify users, so it should be persistent. If this is not set
+	// then the identity provider chooses the format.
+	NameIDFormat string `yaml:"name-id-format"`
+
+	// Attributes holds the names of the SAML attributes that
+	// hold the details of the user.
+	Attributes Attributes `yaml:"attributes"`
+}
+
+// Attributes holds the names of the SAML attributes that are mapped to
+// the details of a user. Attributes can be specified by either their
+// name or their friendly name.
+type Attributes struct {
+	// Username is the attribute holding the user's preferred
+	// username. The default is "uid".
+	Username string `yaml:"username"`
+
+	// Email is the attribute holding the user's email address. The
+	// default is "email".
+	Email string `yaml:"email"`
+
+	// Name is the attribute holding the user's display name. The
+	// default is "displayName".
+	Name string `yaml:"name"`
+
+	// Groups is the attribute holding the groups that the user is a
+	// member of. The default is "groups".
+	Groups string `yaml:"groups"`
+}
+
+// NewIdentityProvider creates a new SAML identity provider.
+func NewIdentityProvider(p Params) idp.IdentityProvider {
+	if p.Description == "" {
+		p.Description = p.Name
+	}
+	if p.Attributes.Username == "" {
+		p.Attributes.Username = "uid"
+	}
+	if p.Attributes.Email == "" {
+		p.Attributes.Email = "email"
+	}
+	if p.Attributes.Name == "" {
+		p.Attributes.Name = "displayName"
+	}
+	if p.Attributes.Groups == "" {
+		p.Attributes.Groups = "groups"
+	}
+	var matchEmailAddr *regexp.Regexp
+	if p.MatchEmailAddr != "" {
+		var err error
+		matchEmailAddr, err = regexp.Compile(p.MatchEmailAddr)
+		if err != nil {
+			// if the email address matcher doesn't compile log the error but
+			// carry on. A regular expression that doesn't compile also doesn't
+			// match anything.
+			logger.Errorf("cannot compile match-email-addr regular expression: %s", err)
+		}
+	}
+	return &identityProvider{
+		params:         p,
+		matchEmailAddr: matchEmailAddr,
+	}
+}
+
+type identityProvider struct {
+	params         Params
+	initParams     idp.InitParams
+	matchEmailAddr *regexp.Regexp
+
+	// ssoURL and binding hold the location and binding of the
+	// single sign-on service that authentication requests are sent
+	// to.
+	ssoURL  string
+	binding string
+
+	validator responseValidator
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// IsForEmailAddr returns true when the identity provider should be used
+// to identify a user with the given email address.
+func (idp *identityProvider) IsForEmailAddr(addr string) bool {
+	if idp.matchEmailAddr == nil {
+		return false
+	}
+	return idp.matchEmailAddr.MatchString(addr)
+}
+
+// Init implements idp.IdentityProvider.Init by determining the details
+// of the SAML identity provider, fetching its metadata if necessary.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	idp.validator = responseValidator{
+		entityID: idp.params.EntityID,
+		acsURL:   params.URLPrefix + "/acs",
+		issuer:   idp.params.Issuer,
+	}
+	if idp.validator.entityID == "" {
+		idp.validator.entityID = params.URLPrefix + "/metadata"
+	}
+	binding := bindingRedirect
+	if idp.params.Binding == "post" {
+		binding = bindingPOST
+	}
+	idp.ssoURL, idp.binding = idp.params.SSOURL, binding
+	if idp.params.Certificate != "" {
+		certs, err := parseCertificates(idp.params.Certificate)
+		if err != nil {
+			return errgo.Notef(err, "cannot parse certificate")
+		}
+		idp.validator.certs = certs
+	}
+	if idp.params.MetadataURL != "" {
+		md, err := fetchMetadata(ctx, idp.params.MetadataURL)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if idp.validator.issuer == "" {
+			idp.validator.issuer = md.EntityID
+		}
+		if idp.validator.certs == nil {
+			idp.validator.certs, err = md.IDPSSODescriptor.signingCertificates()
+			if err != nil {
+				return errgo.Notef(err, "invalid metadata")
+			}
+		}
+		if idp.ssoURL == "" {
+			idp.ssoURL = md.IDPSSODescriptor.singleSignOnService(binding)
+			if idp.ssoURL == "" && idp.params.Binding == "" {
+				idp.ssoURL, idp.binding = md.IDPSSODescriptor.singleSignOnService(bindingPOST), bindingPOST
+			}
+		}
+	}
+	if idp.ssoURL == "" {
+		return errgo.Newf("no single sign-on service available")
+	}
+	if idp.validator.issuer == "" {
+		return errgo.Newf("no issuer available")
+	}
+	if len(idp.validator.certs) == 0 {
+		return errgo.Newf("no signing certificates available")
+	}
+	return nil
+}
+
+// fetchMetadata retrieves the metadata of a SAML identity provider.
+func fetchMetadata(ctx context.Context, url string) (*entityDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get metadata")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errgo.Newf("cannot get metadata: %s", resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get metadata")
+	}
+	var md entityDescriptor
+	if err := xml.Unmarshal(buf, &md); err != nil {
+		return nil, errgo.Notef(err, "cannot parse metadata")
+	}
+	if md.IDPSSODescriptor == nil {
+		return nil, errgo.Newf("invalid metadata: no IDPSSODescriptor")
+	}
+	return &md, nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (*identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups by returning the
+// groups that were in the most recent assertion for the user.
+func (*identityProvider) GetGroups(_ context.Context, identity *store.Identity) ([]string, error) {
+	return identity.ProviderInfo["groups"], nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/metadata" {
+		idp.metadata(w)
+		return
+	}
+	state := req.Form.Get("state")
+	if req.URL.Path == "/acs" {
+		// The identity provider returns the state as the relay
+		// state.
+		state = req.Form.Get("RelayState")
+	}
+	var ls idputil.LoginState
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, state, &ls); err != nil {
+		logger.Infof("Invalid login state: %s", err)
+		idputil.BadRequestf(w, "Login failed: invalid login state")
+		return
+	}
+	var err error
+	switch req.URL.Path {
+	case "/acs":
+		err = idp.acs(ctx, w, req, state, ls)
+	case "/register":
+		err = idp.register(ctx, w, req, ls)
+	default:
+		err = idp.login(ctx, w, req, state, ls)
+	}
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+	}
+}
+
+// metadata writes the service provider metadata.
+func (idp *identityProvider) metadata(w http.ResponseWriter) {
+	md := entityDescriptor{
+		EntityID: idp.validator.entityID,
+		SPSSODescriptor: &ssoDescriptor{
+			AuthnRequestsSigned:        "false",
+			WantAssertionsSigned:       "true",
+			ProtocolSupportEnumeration: nsProtocol,
+			AssertionConsumerServices: []endpoint{{
+				Binding:  bindingPOST,
+				Location: idp.validator.acsURL,
+				Index:    "0",
+			}},
+		},
+	}
+	if idp.params.NameIDFormat != "" {
+		md.SPSSODescriptor.NameIDFormats = []string{idp.params.NameIDFormat}
+	}
+	buf, err := xml.MarshalIndent(md, "", "  ")
+	if err != nil {
+		logger.Errorf("cannot marshal metadata: %s", err)
+		http.Error(w, "cannot marshal metadata", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(buf)
+}
+
+// login sends an authentication request to the SAML identity provider.
+func (idp *identityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request, state string, ls idputil.LoginState) error {
+	// The identity provider posts its response back from another
+	// site, so the login cookie has to be sent with cross-site
+	// requests.
+	idputil.SetCrossSiteLoginCookie(w, req, idp.initParams.Location, idp.initParams.SkipLocationForCookiePaths)
+	id, err := newID()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Record the request so that the response can be matched to
+	// this login attempt.
+	if err := idp.initParams.KeyValueStore.Set(ctx, requestKey(id), []byte(state), ls.Expires); err != nil {
+		return errgo.Mask(err)
+	}
+	ar := authnRequest{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(timeFormat),
+		Destination:                 idp.ssoURL,
+		AssertionConsumerServiceURL: idp.validator.acsURL,
+		ProtocolBinding:             bindingPOST,
+		Issuer:                      idp.validator.entityID,
+		NameIDPolicy: &nameIDPolicy{
+			Format:      idp.params.NameIDFormat,
+			AllowCreate: true,
+		},
+	}
+	buf, err := xml.Marshal(ar)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if idp.binding == bindingPOST {
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		return errgo.Mask(postFormTemplate.Execute(w, postForm{
+			URL:         idp.ssoURL,
+			SAMLRequest: base64.StdEncoding.EncodeToString(buf),
+			RelayState:  state,
+		}))
+	}
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	fw.Write(buf)
+	if err := fw.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	u, err := url.Parse(idp.ssoURL)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	v := u.Query()
+	v.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	v.Set("RelayState", state)
+	u.RawQuery = v.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+	return nil
+}
+
+// postForm holds the parameters for postFormTemplate.
+type postForm struct {
+	URL         string
+	SAMLRequest string
+	RelayState  string
+}
+
+// postFormTemplate is the page used to send an authentication request
+// using the HTTP-POST binding.
+var postFormTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Login</title></head>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.URL}}">
+<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+<noscript><input type="submit" value="Continue"></noscript>
+</form>
+</body>
+</html>
+`))
+
+// acs implements the assertion consumer service, which receives the
+// response from the SAML identity provider.
+func (idp *identityProvider) acs(ctx context.Context, w http.ResponseWriter, req *http.Request, state string, ls idputil.LoginState) error {
+	a, err := idp.validator.parseResponse(req.Form.Get("SAMLResponse"), time.Now())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Check that the response is for a request made in this login
+	// attempt, and that the request has not already been used.
+	err = idp.initParams.KeyValueStore.Update(ctx, requestKey(a.InResponseTo), ls.Expires, func(old []byte) ([]byte, error) {
+		if string(old) != state {
+			return nil, errgo.Newf("unexpected response to request %q", a.InResponseTo)
+		}
+		return []byte{}, nil
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	user := store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, a.NameID),
+		Name:       a.attribute(idp.params.Attributes.Name),
+		Email:      a.attribute(idp.params.Attributes.Email),
+		ProviderInfo: map[string][]string{
+			"groups": a.Attributes[idp.params.Attributes.Groups],
+		},
+	}
+	if username := a.attribute(idp.params.Attributes.Username); names.IsValidUserName(username) {
+		user.Username = joinDomain(username, idp.params.Domain)
+	}
+
+	existingUser := store.Identity{
+		ProviderID: user.ProviderID,
+	}
+	err = idp.initParams.Store.Identity(ctx, &existingUser)
+	if err == nil {
+		upd := store.Update{
+			store.ProviderInfo: store.Set,
+		}
+		existingUser.ProviderInfo = user.ProviderInfo
+		if user.Name != "" {
+			existingUser.Name = user.Name
+			upd[store.Name] = store.Set
+		}
+		if user.Email != "" {
+			existingUser.Email = user.Email
+			upd[store.Email] = store.Set
+		}
+		if err := idp.initParams.Store.UpdateIdentity(ctx, &existingUser, upd); err != nil {
+			return errgo.Mask(err)
+		}
+		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &existingUser)
+		return nil
+	}
+	if errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+
+	// The user needs to be created.
+	if user.Username != "" {
+		// Attempt to create a user with the preferred username.
+		err := idp.initParams.Store.UpdateIdentity(ctx, &user, store.Update{
+			store.Username:     store.Set,
+			store.Name:         store.Set,
+			store.Email:        store.Set,
+			store.ProviderInfo: store.Set,
+		})
+		if err == nil {
+			idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &user)
+			return nil
+		}
+		if errgo.Cause(err) != store.ErrDuplicateUsername {
+			return errgo.Mask(err)
+		}
+	}
+
+	// The user needs to register. Keep the groups from the
+	// assertion so that they can be stored with the new user.
+	groups, err := json.Marshal(user.ProviderInfo["groups"])
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, registrationKey(user.ProviderID), groups, ls.Expires); err != nil {
+		return errgo.Mask(err)
+	}
+	ls.ProviderID = user.ProviderID
+	state, err = idputil.SetLoginCookie(w, idp.initParams.Codec, idp.initParams.Location, idp.initParams.SkipLocationForCookiePaths, ls)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idputil.RegistrationForm(ctx, w, idputil.RegistrationParams{
+		State:    state,
+		Domain:   idp.params.Domain,
+		FullName: user.Name,
+		Email:    user.Email,
+	}, idp.initParams.Template))
+}
+
+// register completes the registration of a new user.
+func (idp *identityProvider) register(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	if ls.ProviderID == "" {
+		return errgo.Newf("registration not in progress")
+	}
+	u := &store.Identity{
+		ProviderID: ls.ProviderID,
+		Name:       req.Form.Get("fullname"),
+		Email:      req.Form.Get("email"),
+	}
+	buf, err := idp.initParams.KeyValueStore.Get(ctx, registrationKey(ls.ProviderID))
+	if err == nil {
+		var groups []string
+		if err := json.Unmarshal(buf, &groups); err != nil {
+			return errgo.Mask(err)
+		}
+		u.ProviderInfo = map[string][]string{"groups": groups}
+	} else if errgo.Cause(err) != simplekv.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	err = idp.registerUser(ctx, req.Form.Get("username"), u)
+	if err == nil {
+		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, u)
+		return nil
+	}
+	if errgo.Cause(err) != errInvalidUser {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idputil.RegistrationForm(ctx, w, idputil.RegistrationParams{
+		State:    req.Form.Get("state"),
+		Error:    err.Error(),
+		Username: req.Form.Get("username"),
+		Domain:   idp.params.Domain,
+		FullName: req.Form.Get("fullname"),
+		Email:    req.Form.Get("email"),
+	}, idp.initParams.Template))
+}
+
+var errInvalidUser = errgo.New("invalid user")
+
+func (idp *identityProvider) registerUser(ctx context.Context, username string, u *store.Identity) error {
+	if !names.IsValidUserName(username) {
+		return errgo.WithCausef(nil, errInvalidUser, "invalid user name. The username must contain only A-Z, a-z, 0-9, '.', '-', & '+', and must start and end with a letter or number.")
+	}
+	if idputil.ReservedUsernames[username] {
+		return errgo.WithCausef(nil, errInvalidUser, "username %s is not allowed, please choose another.", username)
+	}
+	u.Username = joinDomain(username, idp.params.Domain)
+	err := idp.initParams.Store.UpdateIdentity(ctx, u, store.Update{
+		store.Username:     store.Set,
+		store.Name:         store.Set,
+		store.Email:        store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	if err == nil {
+		return nil
+	}
+	if errgo.Cause(err) != store.ErrDuplicateUsername {
+		return errgo.Mask(err)
+	}
+	return errgo.WithCausef(nil, errInvalidUser, "Username already taken, please pick a different one.")
+}
+
+// newID creates a new random SAML message ID.
+func newID() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	// IDs must not start with a digit.
+	return "_" + hex.EncodeToString(buf), nil
+}
+
+// requestKey returns the key used to record the authentication request
+// with the given ID.
+func requestKey(id string) string {
+	return "request-" + id
+}
+
+// registrationKey returns the key used to store the groups of a user
+// that is registering.
+func registrationKey(pid store.ProviderIdentity) string {
+	return "registration-" + string(pid)
+}
+
+// joinDomain creates a new params.Username with the given name and
+// (optional) domain.
+func joinDomain(name, domain string) string {
+	if domain == "" {
+		return name
+	}
+	return fmt.Sprintf("%s@%s", name, domain)
+}
@@ -0,0 +1,529 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package saml_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idptest"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/idp/saml"
+	"github.com/canonical/candid/idp/saml/internal/mocksaml"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+var configTests = []struct {
+	name        string
+	yaml        string
+	expectError string
+}{{
+	name: "MetadataURL",
+	yaml: `
+identity-providers:
+- type: saml
+  name: test
+  metadata-url: https://idp.example.com/metadata
+`[1:],
+}, {
+	name: "SSOURL",
+	yaml: `
+identity-providers:
+- type: saml
+  name: test
+  sso-url: https://idp.example.com/sso
+  issuer: https://idp.example.com/metadata
+  certificate: |
+    -----BEGIN CERTIFICATE-----
+    -----END CERTIFICATE-----
+  binding: post
+  attributes:
+    username: urn:oid:0.9.2342.19200300.100.1.1
+`[1:],
+}, {
+	name: "NoName",
+	yaml: `
+identity-providers:
+- type: saml
+  metadata-url: https://idp.example.com/metadata
+`[1:],
+	expectError: `cannot unmarshal saml configuration: name not specified`,
+}, {
+	name: "NoSSOURL",
+	yaml: `
+identity-providers:
+- type: saml
+  name: test
+`[1:],
+	expectError: `cannot unmarshal saml configuration: metadata-url or sso-url must be specified`,
+}, {
+	name: "NoCertificate",
+	yaml: `
+identity-providers:
+- type: saml
+  name: test
+  sso-url: https://idp.example.com/sso
+  issuer: https://idp.example.com/metadata
+`[1:],
+	expectError: `cannot unmarshal saml configuration: certificate not specified`,
+}, {
+	name: "NoIssuer",
+	yaml: `
+identity-providers:
+- type: saml
+  name: test
+  sso-url: https://idp.example.com/sso
+  certificate: test
+`[1:],
+	expectError: `cannot unmarshal saml configuration: issuer not specified`,
+}, {
+	name: "BadBinding",
+	yaml: `
+identity-providers:
+- type: saml
+  name: test
+  metadata-url: https://idp.example.com/metadata
+  binding: artifact
+`[1:],
+	expectError: `cannot unmarshal saml configuration: unsupported binding "artifact"`,
+}}
+
+func TestConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range configTests {
+		c.Run(test.name, func(c *qt.C) {
+			var conf config.Config
+			err := yaml.Unmarshal([]byte(test.yaml), &conf)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(conf.IdentityProviders, qt.HasLen, 1)
+			c.Assert(conf.IdentityProviders[0].Name(), qt.Equals, "test")
+		})
+	}
+}
+
+const idpPrefix = "https://idp.example.com"
+
+type samlSuite struct {
+	idptest *idptest.Fixture
+	mock    *mocksaml.Handler
+	srv     *httptest.Server
+	idp     idp.IdentityProvider
+}
+
+func TestSAML(t *testing.T) {
+	qtsuite.Run(qt.New(t), &samlSuite{})
+}
+
+func (s *samlSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	s.srv = httptest.NewServer(nil)
+	c.Defer(s.srv.Close)
+	s.mock = mocksaml.New(s.srv.URL)
+	s.srv.Config.Handler = s.mock
+	s.mock.AddUser(&mocksaml.User{
+		NameID: "alice-id",
+		Attributes: map[string][]string{
+			"uid":         {"alice"},
+			"email":       {"alice@example.com"},
+			"displayName": {"Alice"},
+			"groups":      {"g1", "g2"},
+		},
+	})
+	s.idp = s.newIdentityProvider(c, saml.Params{
+		Name:        "saml",
+		Domain:      "saml",
+		MetadataURL: s.srv.URL + "/metadata",
+	})
+}
+
+func (s *samlSuite) newIdentityProvider(c *qt.C, p saml.Params) idp.IdentityProvider {
+	i := saml.NewIdentityProvider(p)
+	ip := s.idptest.InitParams(c, idpPrefix)
+	ip.Template = template.New("")
+	template.Must(ip.Template.New("register").Parse("{{.State}}\n{{.Error}}"))
+	err := i.Init(s.idptest.Ctx, ip)
+	c.Assert(err, qt.IsNil)
+	return i
+}
+
+func (s *samlSuite) TestName(c *qt.C) {
+	c.Assert(s.idp.Name(), qt.Equals, "saml")
+}
+
+func (s *samlSuite) TestDescription(c *qt.C) {
+	c.Assert(s.idp.Description(), qt.Equals, "saml")
+}
+
+func (s *samlSuite) TestDomain(c *qt.C) {
+	c.Assert(s.idp.Domain(), qt.Equals, "saml")
+}
+
+func (s *samlSuite) TestInteractive(c *qt.C) {
+	c.Assert(s.idp.Interactive(), qt.Equals, true)
+}
+
+func (s *samlSuite) TestURL(c *qt.C) {
+	c.Assert(s.idp.URL("1234"), qt.Equals, idpPrefix+"/login?state=1234")
+}
+
+func (s *samlSuite) TestMetadata(c *qt.C) {
+	resp, err := idptest.NewClient(s.idp, s.idptest.Codec).Get("/metadata")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "application/samlmetadata+xml")
+	var md struct {
+		EntityID                 string `xml:"entityID,attr"`
+		AssertionConsumerService struct {
+			Binding  string `xml:",attr"`
+			Location string `xml:",attr"`
+		} `xml:"SPSSODescriptor>AssertionConsumerService"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&md)
+	c.Assert(err, qt.IsNil)
+	c.Check(md.EntityID, qt.Equals, idpPrefix+"/metadata")
+	c.Check(md.AssertionConsumerService.Binding, qt.Equals, "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST")
+	c.Check(md.AssertionConsumerService.Location, qt.Equals, idpPrefix+"/acs")
+}
+
+func (s *samlSuite) TestLoginRedirectBinding(c *qt.C) {
+	s.mock.SetLoginUser("alice-id")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.IsNil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("saml", "alice-id"),
+		Username:   "alice@saml",
+		Name:       "Alice",
+		Email:      "alice@example.com",
+		ProviderInfo: map[string][]string{
+			"groups": {"g1", "g2"},
+		},
+	})
+	s.idptest.Store.AssertUser(c, id)
+	groups, err := s.idp.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "g2"})
+}
+
+func (s *samlSuite) TestLoginPOSTBinding(c *qt.C) {
+	i := s.newIdentityProvider(c, saml.Params{
+		Name:        "saml",
+		Domain:      "saml",
+		SSOURL:      s.srv.URL + "/sso",
+		Issuer:      s.mock.EntityID(),
+		Certificate: s.mock.Certificate(),
+		Binding:     "post",
+	})
+	s.mock.SetLoginUser("alice-id")
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		// The first form sends the request to the identity
+		// provider, the second sends the response back.
+		resp, err := postForm(client, resp)
+		if err != nil {
+			return nil, err
+		}
+		return postForm(client, resp)
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice@saml")
+}
+
+func (s *samlSuite) TestLoginCrossSiteCookie(c *qt.C) {
+	i := saml.NewIdentityProvider(saml.Params{
+		Name:        "saml",
+		MetadataURL: s.srv.URL + "/metadata",
+	})
+	ip := s.idptest.InitParams(c, idpPrefix)
+	ip.Location = "https://candid.example.com/candid"
+	err := i.Init(s.idptest.Ctx, ip)
+	c.Assert(err, qt.IsNil)
+
+	client := idptest.NewClient(i, s.idptest.Codec)
+	client.SetLoginState(idputil.LoginState{
+		ReturnTo: "http://result.example.com/callback",
+		State:    "1234",
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+	resp, err := client.Get("/login")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusFound)
+
+	// The login cookie is set again so that it is sent with the
+	// response posted back from the identity provider.
+	cookies := resp.Cookies()
+	c.Assert(cookies, qt.HasLen, 1)
+	c.Check(cookies[0].Name, qt.Equals, idputil.LoginCookieName)
+	c.Check(cookies[0].Path, qt.Equals, "/candid/login")
+	c.Check(cookies[0].Secure, qt.IsTrue)
+	c.Check(cookies[0].SameSite, qt.Equals, http.SameSiteNoneMode)
+}
+
+func (s *samlSuite) TestLoginSignedResponse(c *qt.C) {
+	s.mock.SetSigning(true, false)
+	s.mock.SetLoginUser("alice-id")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice@saml")
+}
+
+func (s *samlSuite) TestLoginNotSigned(c *qt.C) {
+	s.mock.SetSigning(false, false)
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.ErrorMatches, `cannot verify assertion: Assertion not signed`)
+}
+
+func (s *samlSuite) TestLoginModifiedAssertion(c *qt.C) {
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		action, v, err := parseForm(resp)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := base64.StdEncoding.DecodeString(v.Get("SAMLResponse"))
+		if err != nil {
+			return nil, err
+		}
+		buf = bytes.Replace(buf, []byte(">alice<"), []byte(">admin<"), -1)
+		v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(buf))
+		return client.PostForm(action, v)
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot verify assertion: invalid signature: Signature could not be verified`)
+}
+
+func (s *samlSuite) TestLoginWrongCertificate(c *qt.C) {
+	i := s.newIdentityProvider(c, saml.Params{
+		Name:        "saml",
+		SSOURL:      s.srv.URL + "/sso",
+		Issuer:      s.mock.EntityID(),
+		Certificate: mocksaml.New(s.srv.URL).Certificate(),
+	})
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.ErrorMatches, `cannot verify assertion: invalid signature: Could not verify certificate against trusted certs`)
+}
+
+func (s *samlSuite) TestLoginNoConditions(c *qt.C) {
+	s.mock.SetConditions(false, false)
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.ErrorMatches, `assertion has no conditions`)
+}
+
+func (s *samlSuite) TestLoginNoAudienceRestriction(c *qt.C) {
+	s.mock.SetConditions(true, false)
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.ErrorMatches, `assertion has no audience restriction`)
+}
+
+func (s *samlSuite) TestLoginWrongIssuer(c *qt.C) {
+	i := s.newIdentityProvider(c, saml.Params{
+		Name:        "saml",
+		MetadataURL: s.srv.URL + "/metadata",
+		Issuer:      "https://other.example.com",
+	})
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.ErrorMatches, `assertion has unexpected issuer ".*/metadata"`)
+}
+
+func (s *samlSuite) TestLoginFailed(c *qt.C) {
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.ErrorMatches, `login failed: no user logged in \(urn:oasis:names:tc:SAML:2.0:status:AuthnFailed\)`)
+}
+
+func (s *samlSuite) TestLoginReplay(c *qt.C) {
+	s.mock.SetLoginUser("alice-id")
+	_, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		action, v, err := parseForm(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = client.PostForm(action, v)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			return nil, errgo.Newf("unexpected status %s", resp.Status)
+		}
+		return client.PostForm(action, v)
+	})
+	c.Assert(err, qt.ErrorMatches, `unexpected response to request "_[0-9a-f]+"`)
+}
+
+func (s *samlSuite) TestLoginExistingUser(c *qt.C) {
+	err := s.idptest.Store.Store.UpdateIdentity(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("saml", "alice-id"),
+		Username:   "alice-old@saml",
+		Name:       "Alice Old",
+		Email:      "alice-old@example.com",
+		ProviderInfo: map[string][]string{
+			"groups": {"g0"},
+		},
+	}, store.Update{
+		store.Username:     store.Set,
+		store.Name:         store.Set,
+		store.Email:        store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	s.mock.SetLoginUser("alice-id")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", postForm)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice-old@saml")
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("saml", "alice-id"),
+		Username:   "alice-old@saml",
+		Name:       "Alice",
+		Email:      "alice@example.com",
+		ProviderInfo: map[string][]string{
+			"groups": {"g1", "g2"},
+		},
+	})
+}
+
+func (s *samlSuite) TestLoginRegister(c *qt.C) {
+	s.mock.AddUser(&mocksaml.User{
+		NameID: "bob-id",
+		Attributes: map[string][]string{
+			"displayName": {"Bob"},
+			"groups":      {"g3"},
+		},
+	})
+	s.mock.SetLoginUser("bob-id")
+	id, err := s.idptest.DoInteractiveLogin(c, s.idp, idpPrefix+"/login", func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		resp, err := postForm(client, resp)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errgo.Newf("unexpected response %s: %s", resp.Status, buf)
+		}
+		// The updated login state cookie is only valid in the
+		// real login path, make it available to the test server.
+		u, err := url.Parse(idpPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, cookie := range resp.Cookies() {
+			cookie.Path = ""
+			client.Jar.SetCookies(u, []*http.Cookie{cookie})
+		}
+		return client.PostForm(idpPrefix+"/register", url.Values{
+			"state":    {strings.Split(string(buf), "\n")[0]},
+			"username": {"bob"},
+			"fullname": {"Bob"},
+		})
+	})
+	c.Assert(err, qt.IsNil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("saml", "bob-id"),
+		Username:   "bob@saml",
+		Name:       "Bob",
+		ProviderInfo: map[string][]string{
+			"groups": {"g3"},
+		},
+	})
+}
+
+func (s *samlSuite) TestInvalidRelayState(c *qt.C) {
+	resp, err := idptest.NewClient(s.idp, s.idptest.Codec).Get("/acs?RelayState=1234")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func TestInitMetadataNotFound(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	i := saml.NewIdentityProvider(saml.Params{
+		Name:        "saml",
+		MetadataURL: srv.URL + "/metadata",
+	})
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := i.Init(f.Ctx, f.InitParams(c, idpPrefix))
+	c.Assert(err, qt.ErrorMatches, `cannot get metadata: 404 Not Found`)
+}
+
+func TestInitNoIssuer(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write([]byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata"><md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"><md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/></md:IDPSSODescriptor></md:EntityDescriptor>`))
+	}))
+	defer srv.Close()
+	i := saml.NewIdentityProvider(saml.Params{
+		Name:        "saml",
+		MetadataURL: srv.URL + "/metadata",
+		Certificate: mocksaml.New(srv.URL).Certificate(),
+	})
+	f := idptest.NewFixture(c, candidtest.NewStore())
+	err := i.Init(f.Ctx, f.InitParams(c, idpPrefix))
+	c.Assert(err, qt.ErrorMatches, `no issuer available`)
+}
+
+var (
+	formRegexp  = regexp.MustCompile(`<form method="POST" action="([^"]*)">`)
+	inputRegexp = regexp.MustCompile(`<input type="hidden" name="([^"]*)" value="([^"]*)">`)
+)
+
+// parseForm parses the auto-submitting form used by the HTTP-POST
+// binding from the given response.
+func parseForm(resp *http.Response) (string, url.Values, error) {
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	m := formRegexp.FindSubmatch(buf)
+	if m == nil {
+		return "", nil, errgo.Newf("no form in response %s: %s", resp.Status, buf)
+	}
+	v := make(url.Values)
+	for _, m := range inputRegexp.FindAllSubmatch(buf, -1) {
+		v.Set(html.UnescapeString(string(m[1])), html.UnescapeString(string(m[2])))
+	}
+	return html.UnescapeString(string(m[1])), v, nil
+}
+
+// postForm submits the HTTP-POST binding form in the given response.
+func postForm(client *http.Client, resp *http.Response) (*http.Response, error) {
+	action, v, err := parseForm(resp)
+	if err != nil {
+		return nil, err
+	}
+	return client.PostForm(action, v)
+}
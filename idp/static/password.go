@@ -0,0 +1,356 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/errgo.v1"
+)
+
+// Password hashing schemes.
+const (
+	SchemeBcrypt      = "bcrypt"
+	SchemeArgon2id    = "argon2id"
+	SchemeSHA512Crypt = "sha512-crypt"
+)
+
+const (
+	// argon2id parameters used for new hashes.
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	// sha512-crypt parameters, see
+	// https://www.akkadia.org/drepper/SHA-crypt.txt.
+	sha512CryptSaltLen       = 16
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+)
+
+// cryptAlphabet is the alphabet used by the crypt(3) base64 encoding.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HashPassword returns a hash of the given password using the given
+// scheme, which is one of SchemeBcrypt, SchemeArgon2id or
+// SchemeSHA512Crypt. The hash is in the format expected in
+// UserInfo.Password.
+func HashPassword(password, scheme string) (string, error) {
+	switch scheme {
+	case SchemeBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+		return string(hash), nil
+	case SchemeArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", errgo.Mask(err)
+		}
+		h := argon2Hash{
+			time:    argon2Time,
+			memory:  argon2Memory,
+			threads: argon2Threads,
+			salt:    salt,
+		}
+		h.key = h.derive(password, argon2KeyLen)
+		return h.String(), nil
+	case SchemeSHA512Crypt:
+		buf := make([]byte, sha512CryptSaltLen)
+		if _, err := rand.Read(buf); err != nil {
+			return "", errgo.Mask(err)
+		}
+		for i := range buf {
+			buf[i] = cryptAlphabet[int(buf[i])%len(cryptAlphabet)]
+		}
+		h := sha512CryptHash{
+			rounds: sha512CryptDefaultRounds,
+			salt:   string(buf),
+		}
+		h.hash = h.derive(password)
+		return h.String(), nil
+	default:
+		return "", errgo.Newf("unknown password hashing scheme %q", scheme)
+	}
+}
+
+// passwordScheme returns the scheme used to hash the given stored
+// password, or the empty string if the password is held in plaintext.
+func passwordScheme(stored string) string {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return SchemeBcrypt
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return SchemeArgon2id
+	case strings.HasPrefix(stored, "$6$"):
+		return SchemeSHA512Crypt
+	default:
+		return ""
+	}
+}
+
+// checkPasswordHash checks that the given stored password is either
+// plaintext or a hash in a supported format.
+func checkPasswordHash(stored string) error {
+	var err error
+	switch passwordScheme(stored) {
+	case SchemeBcrypt:
+		_, err = bcrypt.Cost([]byte(stored))
+	case SchemeArgon2id:
+		_, err = parseArgon2Hash(stored)
+	case SchemeSHA512Crypt:
+		_, err = parseSHA512CryptHash(stored)
+	}
+	return errgo.Mask(err)
+}
+
+// checkPassword reports whether the given password matches the stored
+// password, which may be plaintext or hashed.
+func checkPassword(stored, password string) (bool, error) {
+	switch passwordScheme(stored) {
+	case SchemeBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+		return true, nil
+	case SchemeArgon2id:
+		h, err := parseArgon2Hash(stored)
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+		key := h.derive(password, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+	case SchemeSHA512Crypt:
+		h, err := parseSHA512CryptHash(stored)
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+		hash := h.derive(password)
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(h.hash)) == 1, nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, nil
+	}
+}
+
+// argon2Hash holds an argon2id hash in the PHC string format, for
+// example:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(s string) (*argon2Hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errgo.Newf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, errgo.Newf("invalid argon2id hash version")
+	}
+	if version != argon2.Version {
+		return nil, errgo.Newf("unsupported argon2id version %d", version)
+	}
+	var h argon2Hash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, errgo.Newf("invalid argon2id hash parameters")
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errgo.Newf("invalid argon2id hash salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errgo.Newf("invalid argon2id hash key")
+	}
+	return &h, nil
+}
+
+func (h *argon2Hash) derive(password string, keyLen uint32) []byte {
+	return argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, keyLen)
+}
+
+func (h *argon2Hash) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.memory,
+		h.time,
+		h.threads,
+		base64.RawStdEncoding.EncodeToString(h.salt),
+		base64.RawStdEncoding.EncodeToString(h.key),
+	)
+}
+
+// sha512CryptHash holds a SHA-512 based crypt(3) hash, for example:
+//
+//	$6$rounds=5000$<salt>$<hash>
+type sha512CryptHash struct {
+	rounds       int
+	customRounds bool
+	salt         string
+	hash         string
+}
+
+func parseSHA512CryptHash(s string) (*sha512CryptHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) < 4 || parts[1] != "6" {
+		return nil, errgo.Newf("invalid sha512-crypt hash")
+	}
+	h := sha512CryptHash{
+		rounds: sha512CryptDefaultRounds,
+	}
+	parts = parts[2:]
+	if strings.HasPrefix(parts[0], "rounds=") {
+		rounds, err := strconv.Atoi(strings.TrimPrefix(parts[0], "rounds="))
+		if err != nil {
+			return nil, errgo.Newf("invalid sha512-crypt hash rounds")
+		}
+		h.rounds = rounds
+		h.customRounds = true
+		if h.rounds < sha512CryptMinRounds {
+			h.rounds = sha512CryptMinRounds
+		}
+		if h.rounds > sha512CryptMaxRounds {
+			h.rounds = sha512CryptMaxRounds
+		}
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errgo.Newf("invalid sha512-crypt hash")
+	}
+	h.salt = parts[0]
+	if len(h.salt) > sha512CryptSaltLen {
+		h.salt = h.salt[:sha512CryptSaltLen]
+	}
+	h.hash = parts[1]
+	return &h, nil
+}
+
+func (h *sha512CryptHash) String() string {
+	if h.customRounds {
+		return fmt.Sprintf("$6$rounds=%d$%s$%s", h.rounds, h.salt, h.hash)
+	}
+	return fmt.Sprintf("$6$%s$%s", h.salt, h.hash)
+}
+
+// sha512CryptOrder holds the order in which the bytes of the final
+// digest are encoded in a sha512-crypt hash.
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// derive returns the encoded hash of the given password using the salt
+// and rounds in h, as described in
+// https://www.akkadia.org/drepper/SHA-crypt.txt.
+func (h *sha512CryptHash) derive(password string) string {
+	p := []byte(password)
+	s := []byte(h.salt)
+
+	b := sha512.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	bsum := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	a.Write(repeatBytes(bsum, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(bsum)
+		} else {
+			a.Write(p)
+		}
+	}
+	asum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pseq := repeatBytes(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(asum[0]); i++ {
+		ds.Write(s)
+	}
+	sseq := repeatBytes(ds.Sum(nil), len(s))
+
+	csum := asum
+	for i := 0; i < h.rounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(pseq)
+		} else {
+			c.Write(csum)
+		}
+		if i%3 != 0 {
+			c.Write(sseq)
+		}
+		if i%7 != 0 {
+			c.Write(pseq)
+		}
+		if i&1 != 0 {
+			c.Write(csum)
+		} else {
+			c.Write(pseq)
+		}
+		csum = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	for _, o := range sha512CryptOrder {
+		writeCryptBase64(&out, uint(csum[o[0]])<<16|uint(csum[o[1]])<<8|uint(csum[o[2]]), 4)
+	}
+	writeCryptBase64(&out, uint(csum[63]), 2)
+	return out.String()
+}
+
+// repeatBytes returns the first n bytes of b repeated as many times as
+// necessary.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		m := n - len(out)
+		if m > len(b) {
+			m = len(b)
+		}
+		out = append(out, b[:m]...)
+	}
+	return out
+}
+
+// writeCryptBase64 writes the lowest n*6 bits of w to sb using the
+// crypt(3) base64 encoding, least significant bits first.
+func writeCryptBase64(sb *strings.Builder, w uint, n int) {
+	for i := 0; i < n; i++ {
+		sb.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/static"
+)
+
+var checkPasswordTests = []struct {
+	about       string
+	stored      string
+	password    string
+	expect      bool
+	expectError string
+}{{
+	about:    "plaintext",
+	stored:   "pass1",
+	password: "pass1",
+	expect:   true,
+}, {
+	about:    "plaintext mismatch",
+	stored:   "pass1",
+	password: "pass2",
+}, {
+	about:    "bcrypt",
+	stored:   "$2a$04$OBhzEx4ebwneeI2/mo7h3eRIEybol93lq8EpcOvxmc2.zbCCSgHbS",
+	password: "pass1",
+	expect:   true,
+}, {
+	about:    "bcrypt 2y",
+	stored:   "$2y$04$OBhzEx4ebwneeI2/mo7h3eRIEybol93lq8EpcOvxmc2.zbCCSgHbS",
+	password: "pass1",
+	expect:   true,
+}, {
+	about:    "bcrypt mismatch",
+	stored:   "$2a$04$OBhzEx4ebwneeI2/mo7h3eRIEybol93lq8EpcOvxmc2.zbCCSgHbS",
+	password: "pass2",
+}, {
+	about:       "invalid bcrypt",
+	stored:      "$2a$04$short",
+	password:    "pass1",
+	expectError: `crypto/bcrypt: hashedSecret too short to be a bcrypted password`,
+}, {
+	about:    "argon2id",
+	stored:   "$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$v6NQk9HUBcnSV5pnygfB/m5bKAxqEaIrmYkm4KU86oQ",
+	password: "pass1",
+	expect:   true,
+}, {
+	about:    "argon2id mismatch",
+	stored:   "$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$v6NQk9HUBcnSV5pnygfB/m5bKAxqEaIrmYkm4KU86oQ",
+	password: "pass2",
+}, {
+	about:       "invalid argon2id parameters",
+	stored:      "$argon2id$v=19$m=1024$c29tZXNhbHQ$v6NQk9HUBcnSV5pnygfB/m5bKAxqEaIrmYkm4KU86oQ",
+	password:    "pass1",
+	expectError: `invalid argon2id hash parameters`,
+}, {
+	about:       "unsupported argon2id version",
+	stored:      "$argon2id$v=16$m=1024,t=1,p=1$c29tZXNhbHQ$v6NQk9HUBcnSV5pnygfB/m5bKAxqEaIrmYkm4KU86oQ",
+	password:    "pass1",
+	expectError: `unsupported argon2id version 16`,
+}, {
+	// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt.
+	about:    "sha512-crypt",
+	stored:   "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	password: "Hello world!",
+	expect:   true,
+}, {
+	about:    "sha512-crypt with rounds and long salt",
+	stored:   "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	password: "Hello world!",
+	expect:   true,
+}, {
+	about:    "sha512-crypt with too few rounds",
+	stored:   "$6$rounds=10$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+	password: "the minimum number is still observed",
+	expect:   true,
+}, {
+	about:    "sha512-crypt mismatch",
+	stored:   "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	password: "Hello world",
+}, {
+	about:       "invalid sha512-crypt",
+	stored:      "$6$saltstring",
+	password:    "Hello world!",
+	expectError: `invalid sha512-crypt hash`,
+}}
+
+func TestCheckPassword(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range checkPasswordTests {
+		c.Run(test.about, func(c *qt.C) {
+			ok, err := static.CheckPassword(test.stored, test.password)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(ok, qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	c := qt.New(t)
+	for _, scheme := range []string{static.SchemeBcrypt, static.SchemeArgon2id, static.SchemeSHA512Crypt} {
+		c.Run(scheme, func(c *qt.C) {
+			hash, err := static.HashPassword("pass1", scheme)
+			c.Assert(err, qt.IsNil)
+			hash2, err := static.HashPassword("pass1", scheme)
+			c.Assert(err, qt.IsNil)
+			c.Assert(hash2, qt.Not(qt.Equals), hash)
+
+			ok, err := static.CheckPassword(hash, "pass1")
+			c.Assert(err, qt.IsNil)
+			c.Assert(ok, qt.Equals, true)
+			ok, err = static.CheckPassword(hash, "pass2")
+			c.Assert(err, qt.IsNil)
+			c.Assert(ok, qt.Equals, false)
+		})
+	}
+	_, err := static.HashPassword("pass1", "md5")
+	c.Assert(err, qt.ErrorMatches, `unknown password hashing scheme "md5"`)
+}
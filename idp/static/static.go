@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
@@ -56,6 +58,18 @@ type Params struct {
 	// passwords and list of groups.
 	Users map[string]UserInfo `yaml:"users"`
 
+	// UsersFile is the path of a file holding further users that are
+	// allowed to authenticate. If the file name ends in .yaml or .yml
+	// then it holds a map from username to UserInfo in YAML format,
+	// otherwise it is in htpasswd format. The file is read again
+	// whenever it changes. Users in the file override users with the
+	// same name in Users.
+	UsersFile string `yaml:"users-file"`
+
+	// UsersFileCheckInterval is the time between checks for changes
+	// to UsersFile. If this is zero then 10 seconds is used.
+	UsersFileCheckInterval time.Duration `yaml:"users-file-check-interval"`
+
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
@@ -66,7 +80,10 @@ type Params struct {
 }
 
 type UserInfo struct {
-	// Password is the password for the user.
+	// Password is the password for the user. This may be a bcrypt,
+	// argon2id or sha512-crypt hash of the password, as created by
+	// HashPassword. Any other value is compared with the password in
+	// plaintext.
 	Password string `yaml:"password"`
 	// Name is the full name of the user.
 	Name string `yaml:"name"`
@@ -81,6 +98,9 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 	if p.Description == "" {
 		p.Description = p.Name
 	}
+	if p.UsersFileCheckInterval <= 0 {
+		p.UsersFileCheckInterval = defaultUsersFileCheckInterval
+	}
 	var matchEmailAddr *regexp.Regexp
 	if p.MatchEmailAddr != "" {
 		var err error
@@ -96,6 +116,7 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 	return &identityProvider{
 		params:         p,
 		matchEmailAddr: matchEmailAddr,
+		users:          p.Users,
 	}
 }
 
@@ -103,6 +124,13 @@ type identityProvider struct {
 	params         Params
 	initParams     idp.InitParams
 	matchEmailAddr *regexp.Regexp
+
+	// mu protects the fields below it.
+	mu sync.Mutex
+
+	// users holds the users from the configuration and the users
+	// file.
+	users map[string]UserInfo
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -144,9 +172,22 @@ func (idp *identityProvider) IsForEmailAddr(addr string) bool {
 	return idp.matchEmailAddr.MatchString(addr)
 }
 
-// Init implements idp.IdentityProvider.Init.
+// Init implements idp.IdentityProvider.Init. If a users file is
+// configured then it is read, and then read again whenever it changes
+// until the given context is done.
 func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	if err := idp.checkUsers(idp.params.Users, "the configuration"); err != nil {
+		return errgo.Mask(err)
+	}
+	if idp.params.UsersFile == "" {
+		return nil
+	}
+	fi, err := idp.loadUsersFile()
+	if err != nil {
+		return errgo.Notef(err, "cannot load users file")
+	}
+	go idp.watchUsersFile(ctx, fi)
 	return nil
 }
 
@@ -163,7 +204,7 @@ func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID
 func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
 	_, fulluser := identity.ProviderID.Split()
 	username := strings.SplitN(fulluser, "@", 2)[0]
-	if user, ok := idp.params.Users[username]; ok {
+	if user, ok := idp.user(username); ok {
 		groups := make([]string, len(user.Groups))
 		copy(groups, user.Groups)
 		return groups, nil
@@ -199,8 +240,12 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 }
 
 func (idp *identityProvider) loginUser(ctx context.Context, user, password string) (*store.Identity, error) {
-	if userData, ok := idp.params.Users[user]; ok {
-		if userData.Password == password {
+	if userData, ok := idp.user(user); ok {
+		match, err := checkPassword(userData.Password, password)
+		if err != nil {
+			logger.Errorf("cannot check password for user %q: %s", user, err)
+		}
+		if match {
 			username := idputil.NameWithDomain(user, idp.params.Domain)
 			id := &store.Identity{
 				ProviderID: store.MakeProviderIdentity(idp.params.Name, username),
@@ -0,0 +1,151 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultUsersFileCheckInterval is the default time between checks for
+// changes to the users file.
+const defaultUsersFileCheckInterval = 10 * time.Second
+
+// user returns the details of the user with the given name.
+func (idp *identityProvider) user(name string) (UserInfo, bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	u, ok := idp.users[name]
+	return u, ok
+}
+
+// checkUsers checks that the passwords of the given users are either
+// plaintext or hashes in a supported format, logging a warning if any
+// are plaintext. The source is used in the warning to say where the
+// users come from.
+func (idp *identityProvider) checkUsers(users map[string]UserInfo, source string) error {
+	var plaintext []string
+	for name, u := range users {
+		if err := checkPasswordHash(u.Password); err != nil {
+			return errgo.Notef(err, "invalid password for user %q", name)
+		}
+		if passwordScheme(u.Password) == "" {
+			plaintext = append(plaintext, name)
+		}
+	}
+	if len(plaintext) > 0 {
+		sort.Strings(plaintext)
+		logger.Warningf("static identity provider %q has plaintext passwords in %s for users %s; use \"candidsrv hash-password\" to hash them", idp.params.Name, source, strings.Join(plaintext, ", "))
+	}
+	return nil
+}
+
+// loadUsersFile reads the users in the users file, which replace any
+// users that have been read from it before. Users in the file override
+// users with the same name in the configuration. It returns the file
+// information from before the file was read, so that later changes can
+// be detected.
+func (idp *identityProvider) loadUsersFile() (os.FileInfo, error) {
+	fi, err := os.Stat(idp.params.UsersFile)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data, err := ioutil.ReadFile(idp.params.UsersFile)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var fileUsers map[string]UserInfo
+	switch filepath.Ext(idp.params.UsersFile) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &fileUsers); err != nil {
+			return nil, errgo.Notef(err, "cannot parse %s", idp.params.UsersFile)
+		}
+	default:
+		fileUsers, err = parseHtpasswd(data)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse %s", idp.params.UsersFile)
+		}
+	}
+	if err := idp.checkUsers(fileUsers, idp.params.UsersFile); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	users := make(map[string]UserInfo, len(idp.params.Users)+len(fileUsers))
+	for name, u := range idp.params.Users {
+		users[name] = u
+	}
+	for name, u := range fileUsers {
+		users[name] = u
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.users = users
+	return fi, nil
+}
+
+// parseHtpasswd parses a file in the htpasswd format. Each line holds
+// a username and password separated by a colon. Blank lines and lines
+// starting with # are ignored.
+func parseHtpasswd(data []byte) (map[string]UserInfo, error) {
+	users := make(map[string]UserInfo)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errgo.Newf("invalid entry on line %d", n)
+		}
+		users[parts[0]] = UserInfo{
+			Password: parts[1],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return users, nil
+}
+
+// watchUsersFile reloads the users file whenever it changes until the
+// given context is done. The given file information is from when the
+// file was last read.
+func (idp *identityProvider) watchUsersFile(ctx context.Context, last os.FileInfo) {
+	ticker := time.NewTicker(idp.params.UsersFileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		fi, err := os.Stat(idp.params.UsersFile)
+		if err != nil {
+			if last != nil {
+				logger.Errorf("cannot read users file for static identity provider %q: %s", idp.params.Name, err)
+			}
+			last = nil
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		if _, err := idp.loadUsersFile(); err != nil {
+			logger.Errorf("cannot reload users for static identity provider %q, keeping previous users: %s", idp.params.Name, err)
+			continue
+		}
+		logger.Infof("reloaded users for static identity provider %q from %s", idp.params.Name, idp.params.UsersFile)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/loggo"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+// pass1Hash is a bcrypt hash of "pass1".
+const pass1Hash = "$2a$04$OBhzEx4ebwneeI2/mo7h3eRIEybol93lq8EpcOvxmc2.zbCCSgHbS"
+
+func (s *staticSuite) initIdp(c *qt.C, params static.Params) (idp.IdentityProvider, error) {
+	i := static.NewIdentityProvider(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Defer(cancel)
+	err := i.Init(ctx, s.idptest.InitParams(c, idpPrefix))
+	return i, err
+}
+
+func writeFile(c *qt.C, path, data string) {
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestHandleHashedPassword(c *qt.C) {
+	params := getSampleParams()
+	u := params.Users["user1"]
+	u.Password = pass1Hash
+	params.Users["user1"] = u
+	i, err := s.initIdp(c, params)
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", pass1Hash))
+	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;user1&#34;`)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestPlaintextPasswordWarning(c *qt.C) {
+	w := new(loggo.TestWriter)
+	err := loggo.RegisterWriter("static-test", w)
+	c.Assert(err, qt.IsNil)
+	c.Defer(func() {
+		loggo.RemoveWriter("static-test")
+	})
+	params := getSampleParams()
+	params.Users["user2"] = static.UserInfo{Password: pass1Hash}
+	params.Users["user3"] = static.UserInfo{Password: "pass3"}
+	_, err = s.initIdp(c, params)
+	c.Assert(err, qt.IsNil)
+	var warnings []string
+	for _, e := range w.Log() {
+		if e.Level == loggo.WARNING {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	c.Assert(warnings, qt.DeepEquals, []string{
+		`static identity provider "test" has plaintext passwords in the configuration for users user1, user3; use "candidsrv hash-password" to hash them`,
+	})
+}
+
+func (s *staticSuite) TestInvalidPasswordHash(c *qt.C) {
+	params := getSampleParams()
+	params.Users["user2"] = static.UserInfo{Password: "$6$nohash"}
+	_, err := s.initIdp(c, params)
+	c.Assert(err, qt.ErrorMatches, `invalid password for user "user2": invalid sha512-crypt hash`)
+}
+
+func (s *staticSuite) TestUsersFileYAML(c *qt.C) {
+	path := filepath.Join(c.Mkdir(), "users.yaml")
+	writeFile(c, path, `
+user1:
+  password: `+pass1Hash+`
+  name: File User One
+  groups: [group3]
+user2:
+  password: pass2
+`)
+	params := getSampleParams()
+	params.UsersFile = path
+	i, err := s.initIdp(c, params)
+	c.Assert(err, qt.IsNil)
+
+	// The user in the file replaces the user in the configuration.
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+		Username:   "user1",
+		Name:       "File User One",
+	})
+	groups, err := i.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"group3"})
+
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass2"))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestUsersFileHtpasswd(c *qt.C) {
+	path := filepath.Join(c.Mkdir(), "htpasswd")
+	writeFile(c, path, `
+# break-glass accounts
+user2:`+pass1Hash+`
+
+user3:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1
+`)
+	params := getSampleParams()
+	params.UsersFile = path
+	i, err := s.initIdp(c, params)
+	c.Assert(err, qt.IsNil)
+
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass1"))
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user3", "Hello world!"))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestUsersFileErrors(c *qt.C) {
+	dir := c.Mkdir()
+	params := getSampleParams()
+
+	params.UsersFile = filepath.Join(dir, "no-such-file")
+	_, err := s.initIdp(c, params)
+	c.Assert(err, qt.ErrorMatches, `cannot load users file: stat .*no-such-file: no such file or directory`)
+
+	params.UsersFile = filepath.Join(dir, "htpasswd")
+	writeFile(c, params.UsersFile, "user2:pass2\nuser3\n")
+	_, err = s.initIdp(c, params)
+	c.Assert(err, qt.ErrorMatches, `cannot load users file: cannot parse .*htpasswd: invalid entry on line 2`)
+
+	params.UsersFile = filepath.Join(dir, "users.yaml")
+	writeFile(c, params.UsersFile, "user2: [pass2]\n")
+	_, err = s.initIdp(c, params)
+	c.Assert(err, qt.ErrorMatches, `(?s)cannot load users file: cannot parse .*users.yaml: yaml: unmarshal errors:.*`)
+}
+
+func (s *staticSuite) TestUsersFileReload(c *qt.C) {
+	path := filepath.Join(c.Mkdir(), "htpasswd")
+	writeFile(c, path, "user2:pass2\n")
+	params := getSampleParams()
+	params.UsersFile = path
+	params.UsersFileCheckInterval = time.Millisecond
+	i, err := s.initIdp(c, params)
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass2"))
+	c.Assert(err, qt.IsNil)
+
+	// An invalid file is ignored.
+	writeFile(c, path, "user2\n")
+	setModTime(c, path, time.Now().Add(time.Minute))
+	time.Sleep(20 * time.Millisecond)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass2"))
+	c.Assert(err, qt.IsNil)
+
+	writeFile(c, path, "user3:pass3\n")
+	setModTime(c, path, time.Now().Add(2*time.Minute))
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user3", "pass3"))
+		if err == nil {
+			break
+		}
+	}
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass2"))
+	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;user2&#34;`)
+	// Users in the configuration are kept.
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestUsersFileWatchStops(c *qt.C) {
+	path := filepath.Join(c.Mkdir(), "htpasswd")
+	writeFile(c, path, "user2:pass2\n")
+	params := getSampleParams()
+	params.UsersFile = path
+	params.UsersFileCheckInterval = time.Millisecond
+	i := static.NewIdentityProvider(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := i.Init(ctx, s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.IsNil)
+
+	// Once the context is done changes to the file are no longer
+	// loaded.
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	writeFile(c, path, "user3:pass3\n")
+	setModTime(c, path, time.Now().Add(time.Minute))
+	time.Sleep(20 * time.Millisecond)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user3", "pass3"))
+	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;user3&#34;`)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user2", "pass2"))
+	c.Assert(err, qt.IsNil)
+}
+
+func setModTime(c *qt.C, path string, t time.Time) {
+	err := os.Chtimes(path, t, t)
+	c.Assert(err, qt.IsNil)
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/loggo"
@@ -32,10 +33,15 @@ const (
 
 var AdminProviderID = store.MakeProviderIdentity("idm", "admin")
 
+// errReloginRequired is the cause of errors returned when an identity
+// must log in interactively again before it can be used.
+var errReloginRequired = errgo.New("login required")
+
 const (
 	kindGlobal = "global"
 	kindUser   = "u"
 	kindUserID = "uid"
+	kindGroup  = "g"
 )
 
 // The following constants define possible operation actions.
@@ -80,6 +86,8 @@ type Authorizer struct {
 	location       string
 	checker        *identchecker.Checker
 	store          store.Store
+	groupStore     store.GroupStore
+	groupExpander  *groupExpander
 	groupResolvers map[string]groupResolver
 	aclManager     *aclstore.Manager
 }
@@ -102,6 +110,11 @@ type Params struct {
 	// Store is the identity store.
 	Store store.Store
 
+	// GroupStore holds the store of group information. This is used
+	// to find the owners of groups and the groups nested within
+	// them. If it is nil then no groups have owners or are nested.
+	GroupStore store.GroupStore
+
 	// IdentityProviders contains the set of identity providers that
 	// are configured for the service. The authenticatore uses these
 	// to get group information for authenticated users.
@@ -123,6 +136,8 @@ func New(params Params) (*Authorizer, error) {
 		adminPassword: params.AdminPassword,
 		location:      params.Location,
 		store:         params.Store,
+		groupStore:    params.GroupStore,
+		groupExpander: &groupExpander{store: params.GroupStore},
 		aclManager:    params.ACLManager,
 	}
 	resolvers := make(map[string]groupResolver)
@@ -134,6 +149,7 @@ func New(params Params) (*Authorizer, error) {
 	resolvers["idm"] = candidGroupResolver{
 		store:     params.Store,
 		resolvers: resolvers,
+		expander:  a.groupExpander,
 	}
 
 	a.groupResolvers = resolvers
@@ -181,6 +197,15 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 		case ActionCreateParentAgent:
 			acl, err := a.aclManager.ACL(ctx, writeUserACL)
 			return acl, false, errgo.Mask(err)
+		case ActionReadGroups:
+			acl, err := a.aclManager.ACL(ctx, readUserGroupsACL)
+			return acl, false, errgo.Mask(err)
+		case ActionReadAdmin:
+			acl, err := a.aclManager.ACL(ctx, readUserACL)
+			return acl, false, errgo.Mask(err)
+		case ActionWriteAdmin:
+			acl, err := a.aclManager.ACL(ctx, writeUserACL)
+			return acl, false, errgo.Mask(err)
 		}
 	case kindUser:
 		if name == "" {
@@ -243,6 +268,29 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 			}
 			return append(acl, acl1...), false, errgo.Mask(err)
 		}
+	case kindGroup:
+		// The entity names all the groups that the operation
+		// applies to, separated by spaces.
+		groups := strings.Fields(name)
+		switch op.Action {
+		case ActionRead:
+			acl, err := a.aclManager.ACL(ctx, readUserGroupsACL)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			owners, err := a.groupOwners(ctx, groups)
+			return append(acl, owners...), false, errgo.Mask(err)
+		case ActionWriteGroups:
+			acl, err := a.aclManager.ACL(ctx, writeUserACL)
+			if err != nil {
+				return nil, false, errgo.Mask(err)
+			}
+			owners, err := a.groupOwners(ctx, groups)
+			return append(acl, owners...), false, errgo.Mask(err)
+		case ActionWriteAdmin:
+			acl, err := a.aclManager.ACL(ctx, writeUserACL)
+			return acl, false, errgo.Mask(err)
+		}
 	case "groups":
 		switch op.Action {
 		case ActionDischarge:
@@ -253,6 +301,51 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 	return nil, false, nil
 }
 
+// groupOwners returns the owners that own all of the given groups.
+func (a *Authorizer) groupOwners(ctx context.Context, groups []string) ([]string, error) {
+	if a.groupStore == nil || len(groups) == 0 {
+		return nil, nil
+	}
+	var owners []string
+	for i, name := range groups {
+		g := store.Group{Name: name}
+		if err := a.groupStore.Group(ctx, &g); err != nil {
+			if errgo.Cause(err) == store.ErrNotFound {
+				// A group that is not stored has no
+				// owners.
+				return nil, nil
+			}
+			return nil, errgo.Mask(err)
+		}
+		if i == 0 {
+			owners = g.Owners
+			continue
+		}
+		owners = intersectStrings(owners, g.Owners)
+	}
+	return owners, nil
+}
+
+// intersectStrings returns the values in ss that are also in ts.
+func intersectStrings(ss, ts []string) []string {
+	var out []string
+	for _, s := range ss {
+		for _, t := range ts {
+			if s == t {
+				out = append(out, s)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// InvalidateGroups discards any cached information about the stored
+// groups. It should be called whenever the stored groups are changed.
+func (a *Authorizer) InvalidateGroups() {
+	a.groupExpander.invalidate()
+}
+
 // SetAdminPublicKey configures the public key on the admin user. This is
 // to allow agent login as the admin user.
 func (a *Authorizer) SetAdminPublicKey(ctx context.Context, pk *bakery.PublicKey) error {
@@ -283,6 +376,22 @@ func (a *Authorizer) SetAdminPublicKey(ctx context.Context, pk *bakery.PublicKey
 func (a *Authorizer) Auth(ctx context.Context, mss []macaroon.Slice, ops ...bakery.Op) (*identchecker.AuthInfo, error) {
 	authInfo, err := a.checker.Auth(mss...).Allow(ctx, ops...)
 	if err != nil {
+		// The bakery does not preserve the cause of errors
+		// returned when determining the identity, so look for a
+		// disabled user explicitly.
+		if derr := disabledError(err); derr != nil {
+			return nil, derr
+		}
+		if rerr := errorWithCause(err, errReloginRequired); rerr != nil {
+			// The identity must log in again, so ask for a new
+			// authentication discharge.
+			return nil, &bakery.DischargeRequiredError{
+				Message:           rerr.Error(),
+				Ops:               []bakery.Op{identchecker.LoginOp},
+				Caveats:           []checkers.Caveat{a.loginCaveat()},
+				ForAuthentication: true,
+			}
+		}
 		if errgo.Cause(err) == bakery.ErrPermissionDenied {
 			return nil, errgo.WithCausef(err, params.ErrUnauthorized, "")
 		}
@@ -291,6 +400,46 @@ func (a *Authorizer) Auth(ctx context.Context, mss []macaroon.Slice, ops ...bake
 	return authInfo, nil
 }
 
+// disabledError returns the first error in the chain of errors
+// underlying err that has a cause of params.ErrUserDisabled, or nil if
+// there is no such error.
+func disabledError(err error) error {
+	return errorWithCause(err, params.ErrUserDisabled)
+}
+
+// errorWithCause returns the first error in the chain of errors
+// underlying err that has the given cause, or nil if there is no such
+// error.
+func errorWithCause(err, cause error) error {
+	for err != nil {
+		if errgo.Cause(err) == cause {
+			return err
+		}
+		w, ok := err.(errgo.Wrapper)
+		if !ok {
+			return nil
+		}
+		err = w.Underlying()
+	}
+	return nil
+}
+
+// CheckEnabled checks that the given identity has not been disabled and
+// has not expired. If it has, an error with a cause of
+// params.ErrUserDisabled is returned.
+func CheckEnabled(id *store.Identity) error {
+	if !id.Expires.IsZero() && !time.Now().Before(id.Expires) {
+		return errgo.WithCausef(nil, params.ErrUserDisabled, "user %s expired at %s", id.Username, id.Expires.UTC().Format(time.RFC3339))
+	}
+	if id.Disabled.IsZero() {
+		return nil
+	}
+	if id.DisabledReason != "" {
+		return errgo.WithCausef(nil, params.ErrUserDisabled, "user %s is disabled: %s", id.Username, id.DisabledReason)
+	}
+	return errgo.WithCausef(nil, params.ErrUserDisabled, "user %s is disabled", id.Username)
+}
+
 func isDischargeRequiredError(err error) bool {
 	_, ok := errgo.Cause(err).(*bakery.DischargeRequiredError)
 	return ok
@@ -329,6 +478,9 @@ func (a *Authorizer) IdentityFromContext(ctx context.Context) (identchecker.Iden
 		if err != nil {
 			return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 		}
+		if err := CheckEnabled(&id.Identity); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(params.ErrUserDisabled))
+		}
 		return id, nil, nil
 	}
 	if username, password, ok := userCredentialsFromContext(ctx); ok {
@@ -347,15 +499,19 @@ func (a *Authorizer) IdentityFromContext(ctx context.Context) (identchecker.Iden
 		}
 		return nil, nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid credentials")
 	}
-	return nil, []checkers.Caveat{
-		checkers.NeedDeclaredCaveat(
-			checkers.Caveat{
-				Location:  a.location,
-				Condition: "is-authenticated-user",
-			},
-			"username",
-		),
-	}, nil
+	return nil, []checkers.Caveat{a.loginCaveat()}, nil
+}
+
+// loginCaveat returns the caveat that must be discharged to
+// authenticate a user.
+func (a *Authorizer) loginCaveat() checkers.Caveat {
+	return checkers.NeedDeclaredCaveat(
+		checkers.Caveat{
+			Location:  a.location,
+			Condition: "is-authenticated-user",
+		},
+		"username",
+	)
 }
 
 // CheckUserDomain checks that the given user name has
@@ -393,6 +549,12 @@ func (a *Authorizer) DeclaredIdentity(ctx context.Context, declared map[string]s
 	if err := CheckUserDomain(ctx, id.Username); err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if err := CheckEnabled(&id.Identity); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUserDisabled))
+	}
+	if reason := id.ProviderInfo[idp.ReloginRequired]; len(reason) > 0 {
+		return nil, errgo.WithCausef(nil, errReloginRequired, "user %s must log in again: %s", id.Username, reason[0])
+	}
 	return id, nil
 }
 
@@ -437,23 +599,81 @@ func (id *Identity) Allow(ctx context.Context, acl []string) (bool, error) {
 
 // Groups returns all the groups associated with the user. The groups
 // include those stored in the identity server's database along with any
-// retrieved by the relevent identity provider's GetGroups method. Once
-// the set of groups has been determined it is cached in the Identity.
+// retrieved by the relevent identity provider's GetGroups method, and
+// any stored groups that contain those groups. Once the set of groups
+// has been determined it is cached in the Identity.
 func (id *Identity) Groups(ctx context.Context) ([]string, error) {
+	if id.resolvedGroups != nil {
+		return id.resolvedGroups, nil
+	}
+	groups, ok := id.directGroups(ctx)
+	expanded, err := id.authorizer.groupExpander.expand(ctx, groups)
+	if err != nil {
+		logger.Warningf("error expanding groups: %s", err)
+		return groups, nil
+	}
+	if ok {
+		id.resolvedGroups = expanded
+	}
+	return expanded, nil
+}
+
+// ResolvedGroups is like Groups except that it returns an error if the
+// groups provided by the identity's identity provider, or the groups
+// containing them, could not be determined.
+func (id *Identity) ResolvedGroups(ctx context.Context) ([]string, error) {
 	if id.resolvedGroups != nil {
 		return id.resolvedGroups, nil
 	}
 	groups := id.Identity.Groups
-	if gr := id.authorizer.groupResolvers[id.ProviderID.Provider()]; gr != nil {
+	gr := id.authorizer.groupResolvers[id.ProviderID.Provider()]
+	if gr != nil {
 		var err error
 		groups, err = gr.resolveGroups(ctx, &id.Identity)
 		if err != nil {
-			logger.Warningf("error resolving groups: %s", err)
-		} else {
-			id.resolvedGroups = groups
+			return nil, errgo.Notef(err, "cannot resolve groups")
 		}
 	}
-	return groups, nil
+	expanded, err := id.authorizer.groupExpander.expand(ctx, groups)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot expand groups")
+	}
+	if gr != nil {
+		id.resolvedGroups = expanded
+	}
+	return expanded, nil
+}
+
+// GroupPath returns the path through which the user is a member of the
+// given group. The path starts with a group that the user is directly a
+// member of, either in the identity server's database or according to
+// the identity provider, and ends with the given group. Any intermediate
+// groups are stored groups that contain the previous group. If the user
+// is not a member of the group then GroupPath returns nil.
+func (id *Identity) GroupPath(ctx context.Context, group string) ([]string, error) {
+	groups, _ := id.directGroups(ctx)
+	path, err := id.authorizer.groupExpander.path(ctx, groups, group)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return path, nil
+}
+
+// directGroups returns the groups that the user is directly a member
+// of. If the groups could not be completely resolved then the groups
+// stored in the identity server's database are returned along with a
+// false value.
+func (id *Identity) directGroups(ctx context.Context) ([]string, bool) {
+	gr := id.authorizer.groupResolvers[id.ProviderID.Provider()]
+	if gr == nil {
+		return id.Identity.Groups, false
+	}
+	groups, err := gr.resolveGroups(ctx, &id.Identity)
+	if err != nil {
+		logger.Warningf("error resolving groups: %s", err)
+		return groups, false
+	}
+	return groups, true
 }
 
 // trivialAllow reports whether the username should be allowed
@@ -494,6 +714,16 @@ func UserIDOp(uid string, action string) bakery.Op {
 	return op(kindUserID+"-"+uid, action)
 }
 
+// GroupOp is an operation specific to a group.
+func GroupOp(group string, action string) bakery.Op {
+	return op(kindGroup+"-"+group, action)
+}
+
+// GroupsOp is an operation that applies to all of the given groups.
+func GroupsOp(groups []string, action string) bakery.Op {
+	return op(kindGroup+"-"+strings.Join(groups, " "), action)
+}
+
 // GlobalOp is an operation that is not specific to a user.
 func GlobalOp(action string) bakery.Op {
 	return op(kindGlobal, action)
@@ -528,6 +758,7 @@ type groupResolver interface {
 type candidGroupResolver struct {
 	store     store.Store
 	resolvers map[string]groupResolver
+	expander  *groupExpander
 }
 
 // resolveGroups implements groupResolver by checking that the groups
@@ -564,6 +795,12 @@ func (r candidGroupResolver) resolveGroups(ctx context.Context, identity *store.
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	// The owner may grant membership of groups that contain the
+	// owner's groups.
+	ownerGroups, err = r.expander.expand(ctx, ownerGroups)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	allowedGroups := make([]string, 0, len(identity.Groups))
 	for _, g1 := range identity.Groups {
 		for _, g2 := range ownerGroups {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sort"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
@@ -70,6 +71,7 @@ func (s *authSuite) Init(c *qt.C) {
 		Location:         identityLocation,
 		MacaroonVerifier: s.oven,
 		Store:            s.store.Store,
+		GroupStore:       s.store.GroupStore,
 		IdentityProviders: []idp.IdentityProvider{
 			static.NewIdentityProvider(static.Params{
 				Name: "test",
@@ -236,6 +238,9 @@ var aclForOpTests = []struct {
 }, {
 	op:     auth.GlobalOp("createAgent"),
 	expect: []string{identchecker.Everyone},
+}, {
+	op:     auth.GlobalOp("readAdmin"),
+	expect: []string{auth.AdminUsername, auth.UserInformationGroup},
 }, {
 	op: op("global-foo", "login"),
 }, {
@@ -293,6 +298,26 @@ func (s *authSuite) TestNonExistentUser(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `could not determine identity: user noone not found`)
 }
 
+func (s *authSuite) TestReloginRequired(c *qt.C) {
+	s.createIdentity(c, "test", nil)
+	err := s.store.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test"),
+		ProviderInfo: map[string][]string{
+			idp.ReloginRequired: {"token revoked"},
+		},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	m := s.identityMacaroon(c, "test")
+	_, err = s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, identchecker.LoginOp)
+	c.Assert(err, qt.ErrorMatches, `macaroon discharge required: user test must log in again: token revoked`)
+	derr, ok := errgo.Cause(err).(*bakery.DischargeRequiredError)
+	c.Assert(ok, qt.Equals, true, qt.Commentf("error %#v is not DischargeRequiredError", err))
+	c.Assert(derr.Ops, qt.DeepEquals, []bakery.Op{identchecker.LoginOp})
+	c.Assert(derr.Caveats, qt.DeepEquals, []checkers.Caveat{{Condition: "need-declared username is-authenticated-user", Location: "https://identity.test/id"}})
+}
+
 func (s *authSuite) TestExistingUserGroups(c *qt.C) {
 	// good identity
 	s.createIdentity(c, "test", nil, "test-group1", "test-group2")
@@ -302,6 +327,182 @@ func (s *authSuite) TestExistingUserGroups(c *qt.C) {
 	assertAuthorizedGroups(c, authInfo, []string{"test-group1", "test-group2"})
 }
 
+func (s *authSuite) TestNestedGroups(c *qt.C) {
+	s.setGroups(c, map[string][]string{
+		"engineering":  {"team-a", "team-b"},
+		"staff":        {"engineering", "sales"},
+		"everyone-ish": {"somegroup"},
+	})
+
+	id := s.createIdentity(c, "test", nil, "team-a")
+	groups, err := id.Groups(s.context)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"engineering", "staff", "team-a"})
+
+	// Groups provided by the identity provider are also expanded.
+	id = s.createIdentity(c, "testuser", nil)
+	groups, err = id.Groups(s.context)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"everyone-ish", "somegroup"})
+
+	ok, err := id.Allow(s.context, []string{"everyone-ish"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.Equals, true)
+}
+
+func (s *authSuite) TestNestedGroupsCycle(c *qt.C) {
+	s.setGroups(c, map[string][]string{
+		"g1": {"g2"},
+		"g2": {"g3"},
+		"g3": {"g1"},
+	})
+	id := s.createIdentity(c, "test", nil, "g1")
+	groups, err := id.Groups(s.context)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "g2", "g3"})
+}
+
+func (s *authSuite) TestNestedGroupsDepthLimit(c *qt.C) {
+	// Create a chain of groups, each of which contains the previous
+	// one, that is deeper than the limit.
+	subgroups := make(map[string][]string)
+	var expect []string
+	for i := 1; i <= auth.MaxGroupDepth+2; i++ {
+		name := fmt.Sprintf("g%02d", i)
+		subgroups[name] = []string{fmt.Sprintf("g%02d", i-1)}
+		if i <= auth.MaxGroupDepth {
+			expect = append(expect, name)
+		}
+	}
+	s.setGroups(c, subgroups)
+	id := s.createIdentity(c, "test", nil, "g00")
+	groups, err := id.Groups(s.context)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, append([]string{"g00"}, expect...))
+}
+
+func (s *authSuite) TestNestedGroupsAgent(c *qt.C) {
+	s.setGroups(c, map[string][]string{
+		"engineering": {"team-a"},
+	})
+	s.createIdentity(c, "test", nil, "team-a")
+	err := s.store.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "agent"),
+		Username:   "agent@candid",
+		Groups:     []string{"engineering", "other"},
+		Owner:      store.MakeProviderIdentity("test", "test"),
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+		store.Owner:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	id, err := s.authorizer.Identity(s.context, &store.Identity{
+		Username: "agent@candid",
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The agent's owner is a member of engineering through team-a,
+	// so the agent may be a member of engineering.
+	groups, err := id.Groups(s.context)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"engineering"})
+}
+
+func (s *authSuite) TestGroupPath(c *qt.C) {
+	s.setGroups(c, map[string][]string{
+		"engineering": {"team-a", "team-b"},
+		"staff":       {"engineering", "sales"},
+	})
+	id := s.createIdentity(c, "test", nil, "team-a", "sales")
+
+	path, err := id.GroupPath(s.context, "staff")
+	c.Assert(err, qt.IsNil)
+	c.Assert(path, qt.DeepEquals, []string{"sales", "staff"})
+
+	path, err = id.GroupPath(s.context, "engineering")
+	c.Assert(err, qt.IsNil)
+	c.Assert(path, qt.DeepEquals, []string{"team-a", "engineering"})
+
+	path, err = id.GroupPath(s.context, "team-a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(path, qt.DeepEquals, []string{"team-a"})
+
+	path, err = id.GroupPath(s.context, "team-b")
+	c.Assert(err, qt.IsNil)
+	c.Assert(path, qt.IsNil)
+}
+
+func (s *authSuite) TestStoredGroupsCached(c *qt.C) {
+	gs := &countingGroupStore{GroupStore: s.store.GroupStore}
+	aclManager, err := aclstore.NewManager(s.context, aclstore.Params{
+		Store:             s.store.ACLStore,
+		InitialAdminUsers: []string{auth.AdminUsername},
+	})
+	c.Assert(err, qt.IsNil)
+	authorizer, err := auth.New(auth.Params{
+		Location:         identityLocation,
+		MacaroonVerifier: s.oven,
+		Store:            s.store.Store,
+		GroupStore:       gs,
+		ACLManager:       aclManager,
+	})
+	c.Assert(err, qt.IsNil)
+	s.setGroups(c, map[string][]string{
+		"engineering": {"team-a"},
+	})
+	s.createIdentity(c, "test", nil, "team-a")
+	groups := func() []string {
+		id, err := authorizer.Identity(s.context, &store.Identity{Username: "test"})
+		c.Assert(err, qt.IsNil)
+		groups, err := id.Groups(s.context)
+		c.Assert(err, qt.IsNil)
+		return groups
+	}
+	c.Assert(groups(), qt.DeepEquals, []string{"engineering", "team-a"})
+	c.Assert(groups(), qt.DeepEquals, []string{"engineering", "team-a"})
+	c.Assert(gs.calls, qt.Equals, 1)
+
+	// Invalidating the groups causes them to be read again.
+	s.setGroups(c, map[string][]string{
+		"staff": {"engineering"},
+	})
+	authorizer.InvalidateGroups()
+	c.Assert(groups(), qt.DeepEquals, []string{"engineering", "staff", "team-a"})
+	c.Assert(gs.calls, qt.Equals, 2)
+
+	// The cache expires.
+	c.Patch(auth.GroupCacheTTL, time.Duration(0))
+	authorizer.InvalidateGroups()
+	c.Assert(groups(), qt.DeepEquals, []string{"engineering", "staff", "team-a"})
+	c.Assert(groups(), qt.DeepEquals, []string{"engineering", "staff", "team-a"})
+	c.Assert(gs.calls, qt.Equals, 4)
+}
+
+// countingGroupStore is a store.GroupStore that counts the calls made
+// to Groups.
+type countingGroupStore struct {
+	store.GroupStore
+	calls int
+}
+
+func (s *countingGroupStore) Groups(ctx context.Context) ([]store.Group, error) {
+	s.calls++
+	return s.GroupStore.Groups(ctx)
+}
+
+// setGroups stores groups with the given subgroups.
+func (s *authSuite) setGroups(c *qt.C, subgroups map[string][]string) {
+	for name, sgs := range subgroups {
+		err := s.store.GroupStore.SetGroup(s.context, &store.Group{
+			Name:      name,
+			Subgroups: sgs,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	s.authorizer.InvalidateGroups()
+}
+
 func assertAuthorizedGroups(c *qt.C, authInfo *identchecker.AuthInfo, expectGroups []string) {
 	c.Assert(authInfo.Identity, qt.Not(qt.IsNil))
 	ident := authInfo.Identity.(*auth.Identity)
@@ -5,6 +5,7 @@ package auth
 
 var (
 	AuthorizerACLForOp = (*Authorizer).aclForOp
+	GroupCacheTTL      = &groupCacheTTL
 )
 
 const CheckersNamespace = checkersNamespace
@@ -0,0 +1,175 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// MaxGroupDepth holds the maximum number of levels of nested groups
+// that will be followed when determining the groups that an identity
+// is a member of.
+const MaxGroupDepth = 10
+
+// groupCacheTTL holds the maximum time for which the stored group
+// hierarchy is cached. Changes made through this server invalidate the
+// cache immediately, this limits the time for which changes made by
+// other servers using the same store are not seen.
+var groupCacheTTL = 30 * time.Second
+
+// A groupExpander expands a set of groups to include the stored groups
+// that contain them, either directly or through other nested groups.
+type groupExpander struct {
+	store store.GroupStore
+
+	mu sync.Mutex
+	// cached holds the cached result of parents, if it has not
+	// expired.
+	cached  map[string][]string
+	expires time.Time
+	// generation is incremented every time the cache is
+	// invalidated, so that a result read before an invalidation is
+	// not cached.
+	generation int
+}
+
+// invalidate discards the cached stored group hierarchy.
+func (e *groupExpander) invalidate() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cached = nil
+	e.generation++
+}
+
+// expand returns the given groups along with all the stored groups that
+// contain any of them.
+func (e *groupExpander) expand(ctx context.Context, groups []string) ([]string, error) {
+	parents, err := e.parents(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(parents) == 0 {
+		return groups, nil
+	}
+	var expanded []string
+	err = walkGroups(groups, parents, func(group, _ string) bool {
+		expanded = append(expanded, group)
+		return false
+	})
+	if err != nil {
+		logger.Warningf("cannot expand groups %q: %s", groups, err)
+	}
+	return uniqueStrings(expanded), nil
+}
+
+// path returns the path through the stored groups by which membership
+// of the given groups implies membership of the target group. The path
+// starts with one of the given groups and ends with the target group.
+// If membership of the given groups does not imply membership of the
+// target group then path returns nil.
+func (e *groupExpander) path(ctx context.Context, groups []string, target string) ([]string, error) {
+	parents, err := e.parents(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	via := make(map[string]string)
+	found := false
+	err = walkGroups(groups, parents, func(group, child string) bool {
+		via[group] = child
+		found = group == target
+		return found
+	})
+	if !found {
+		if err != nil {
+			logger.Warningf("cannot expand groups %q: %s", groups, err)
+		}
+		return nil, nil
+	}
+	var path []string
+	for g := target; g != ""; g = via[g] {
+		path = append([]string{g}, path...)
+	}
+	return path, nil
+}
+
+// parents returns a map from each group to the stored groups that
+// contain it. The result must not be modified.
+func (e *groupExpander) parents(ctx context.Context) (map[string][]string, error) {
+	if e.store == nil {
+		return nil, nil
+	}
+	e.mu.Lock()
+	if e.cached != nil && time.Now().Before(e.expires) {
+		defer e.mu.Unlock()
+		return e.cached, nil
+	}
+	generation := e.generation
+	e.mu.Unlock()
+
+	groups, err := e.store.Groups(ctx)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get stored groups")
+	}
+	parents := make(map[string][]string)
+	for _, g := range groups {
+		for _, sg := range g.Subgroups {
+			parents[sg] = append(parents[sg], g.Name)
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.generation == generation {
+		e.cached = parents
+		e.expires = time.Now().Add(groupCacheTTL)
+	}
+	return parents, nil
+}
+
+// walkGroups visits the given groups and then, breadth first, the
+// groups that contain them as found in the given parents map. Each
+// group is visited at most once, so cycles in the group hierarchy are
+// not followed. The function f is called with each group visited and
+// the group through which it was reached, which is empty for the
+// initial groups. If f returns true the walk stops. If the hierarchy is
+// more than MaxGroupDepth levels deep an error is returned after all
+// groups up to that depth have been visited.
+func walkGroups(groups []string, parents map[string][]string, f func(group, child string) bool) error {
+	visited := make(map[string]bool)
+	for _, g := range groups {
+		if visited[g] {
+			continue
+		}
+		visited[g] = true
+		if f(g, "") {
+			return nil
+		}
+	}
+	level := groups
+	for depth := 0; len(level) > 0; depth++ {
+		var next []string
+		for _, g := range level {
+			for _, p := range parents[g] {
+				if visited[p] {
+					continue
+				}
+				if depth == MaxGroupDepth {
+					return errgo.Newf("groups nested more than %d deep", MaxGroupDepth)
+				}
+				visited[p] = true
+				if f(p, g) {
+					return nil
+				}
+				next = append(next, p)
+			}
+		}
+		level = next
+	}
+	return nil
+}
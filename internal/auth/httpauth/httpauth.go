@@ -51,7 +51,7 @@ func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.
 	}
 	derr, ok := errgo.Cause(err).(*bakery.DischargeRequiredError)
 	if !ok {
-		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized), errgo.Is(params.ErrUserDisabled))
 	}
 	caveats := append(derr.Caveats, checkers.TimeBeforeCaveat(time.Now().Add(a.timeout)))
 	m, err := a.oven.NewMacaroon(
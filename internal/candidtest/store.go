@@ -22,21 +22,25 @@ import (
 // Store implements a test fixture that contains memory-based
 // store implementations for use with tests.
 type Store struct {
-	Store              store.Store
-	ProviderDataStore  store.ProviderDataStore
-	MeetingStore       meeting.Store
-	BakeryRootKeyStore bakery.RootKeyStore
-	ACLStore           aclstore.ACLStore
+	Store             store.Store
+	ProviderDataStore store.ProviderDataStore
+	MeetingStore      meeting.Store
+	RootKeys          store.RootKeyStore
+	ACLStore          aclstore.ACLStore
+	AuditStore        store.AuditStore
+	GroupStore        store.GroupStore
 }
 
 // NewStore returns a new Store that uses in-memory storage.
 func NewStore() *Store {
 	return &Store{
-		Store:              memstore.NewStore(),
-		ProviderDataStore:  memstore.NewProviderDataStore(),
-		MeetingStore:       memstore.NewMeetingStore(),
-		BakeryRootKeyStore: bakery.NewMemRootKeyStore(),
-		ACLStore:           aclstore.NewACLStore(memsimplekv.NewStore()),
+		Store:             memstore.NewStore(),
+		ProviderDataStore: memstore.NewProviderDataStore(),
+		MeetingStore:      memstore.NewMeetingStore(),
+		RootKeys:          memstore.NewRootKeyStore(),
+		ACLStore:          aclstore.NewACLStore(memsimplekv.NewStore()),
+		AuditStore:        memstore.NewAuditStore(),
+		GroupStore:        memstore.NewGroupStore(),
 	}
 }
 
@@ -47,8 +51,10 @@ func (s *Store) ServerParams() identity.ServerParams {
 		Store:             s.Store,
 		ProviderDataStore: s.ProviderDataStore,
 		MeetingStore:      s.MeetingStore,
-		RootKeyStore:      s.BakeryRootKeyStore,
+		RootKeys:          s.RootKeys,
 		ACLStore:          s.ACLStore,
+		AuditStore:        s.AuditStore,
+		GroupStore:        s.GroupStore,
 	}
 }
 
@@ -79,6 +85,7 @@ func AssertEqualIdentity(c *qt.C, obtained, expected *store.Identity) {
 		cmpopts.EquateEmpty(),
 		cmpopts.SortSlices(func(s, t string) bool { return s < t }),
 		cmpopts.SortSlices(func(x, y bakery.PublicKey) bool { return string(x.Key[:]) < string(y.Key[:]) }),
+		cmpopts.SortSlices(func(x, y store.ProviderIdentity) bool { return x < y }),
 	}
 	msg := cmp.Diff(obtained, expected, opts...)
 	if msg != "" {
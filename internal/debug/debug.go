@@ -5,13 +5,16 @@ package debug
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/juju/loggo"
 	"github.com/juju/utils/debugstatus"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/version"
 )
@@ -46,6 +49,11 @@ func newDebugAPIHandler(params identity.HandlerParams) *debugAPIHandler {
 		teams:    params.DebugTeams,
 	}
 	checkerFuncs := append(stdCheckers, params.DebugStatusCheckerFuncs...)
+	for _, ip := range params.IdentityProviders {
+		if s, ok := ip.(idp.Syncer); ok {
+			checkerFuncs = append(checkerFuncs, syncStatus(s))
+		}
+	}
 	h.hnd = debugstatus.Handler{
 		Check: func(ctx context.Context) map[string]debugstatus.CheckResult {
 			// TODO (mhilton) re-instate meeting status checks.
@@ -70,3 +78,28 @@ type debugAPIHandler struct {
 func (h *debugAPIHandler) handler(p httprequest.Params) (*debugstatus.Handler, context.Context, error) {
 	return &h.hnd, p.Context, nil
 }
+
+// syncStatus returns a debugstatus.CheckerFunc that reports the result
+// of the most recent sync of the given identity provider.
+func syncStatus(s idp.Syncer) debugstatus.CheckerFunc {
+	return func(context.Context) (key string, result debugstatus.CheckResult) {
+		result.Name = fmt.Sprintf("Last sync of %s identities", s.Name())
+		r := s.LastSync()
+		switch {
+		case r == nil:
+			result.Value = "not yet run"
+			result.Passed = true
+		case r.Error != "":
+			result.Value = fmt.Sprintf("failed at %s: %s", r.Finished.Format(time.RFC3339), r.Error)
+		default:
+			dryRun := ""
+			if r.DryRun {
+				dryRun = " (dry run)"
+			}
+			result.Value = fmt.Sprintf("completed at %s%s: %d created, %d updated, %d enabled, %d disabled, %d removed, %d errors",
+				r.Finished.Format(time.RFC3339), dryRun, len(r.Created), len(r.Updated), len(r.Enabled), len(r.Disabled), len(r.Removed), len(r.Errors))
+			result.Passed = true
+		}
+		return "sync_" + s.Name(), result
+	}
+}
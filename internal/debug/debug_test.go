@@ -4,6 +4,7 @@
 package debug_test
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"regexp"
@@ -17,9 +18,11 @@ import (
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
 
+	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/debug"
 	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store/mgostore"
 	buildver "github.com/canonical/candid/version"
 )
@@ -104,7 +107,7 @@ func newFixture(c *qt.C) *fixture {
 
 	sp := identity.ServerParams{
 		MeetingStore:            backend.MeetingStore(),
-		RootKeyStore:            backend.BakeryRootKeyStore(),
+		RootKeys:                backend.RootKeyStore(),
 		Store:                   backend.Store(),
 		DebugStatusCheckerFuncs: backend.DebugStatusCheckerFuncs(),
 		DebugTeams:              []string{"debuggers"},
@@ -116,3 +119,70 @@ func newFixture(c *qt.C) *fixture {
 		srv: srv,
 	}
 }
+
+var syncStatusTests = []struct {
+	about        string
+	result       *params.SyncResult
+	expectValue  string
+	expectPassed bool
+}{{
+	about:        "not run",
+	expectValue:  "not yet run",
+	expectPassed: true,
+}, {
+	about: "success",
+	result: &params.SyncResult{
+		Finished: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Created:  []string{"alice", "bob"},
+		Disabled: []string{"charlie"},
+	},
+	expectValue:  "completed at 2021-01-02T03:04:05Z: 2 created, 0 updated, 0 enabled, 1 disabled, 0 removed, 0 errors",
+	expectPassed: true,
+}, {
+	about: "dry run",
+	result: &params.SyncResult{
+		DryRun:   true,
+		Finished: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Removed:  []string{"charlie"},
+	},
+	expectValue:  "completed at 2021-01-02T03:04:05Z (dry run): 0 created, 0 updated, 0 enabled, 0 disabled, 1 removed, 0 errors",
+	expectPassed: true,
+}, {
+	about: "failure",
+	result: &params.SyncResult{
+		Finished: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Error:    "no users found in directory",
+	},
+	expectValue: "failed at 2021-01-02T03:04:05Z: no users found in directory",
+}}
+
+func TestSyncStatus(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	for _, test := range syncStatusTests {
+		c.Run(test.about, func(c *qt.C) {
+			key, result := debug.SyncStatus(&testSyncer{result: test.result})(context.Background())
+			c.Assert(key, qt.Equals, "sync_test")
+			c.Assert(result.Name, qt.Equals, "Last sync of test identities")
+			c.Assert(result.Value, qt.Equals, test.expectValue)
+			c.Assert(result.Passed, qt.Equals, test.expectPassed)
+		})
+	}
+}
+
+type testSyncer struct {
+	idp.IdentityProvider
+	result *params.SyncResult
+}
+
+func (s *testSyncer) Name() string {
+	return "test"
+}
+
+func (s *testSyncer) Sync(context.Context, bool) *params.SyncResult {
+	return s.result
+}
+
+func (s *testSyncer) LastSync() *params.SyncResult {
+	return s.result
+}
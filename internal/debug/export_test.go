@@ -11,7 +11,8 @@ type (
 )
 
 var (
-	New = newDebugAPIHandler
+	New        = newDebugAPIHandler
+	SyncStatus = syncStatus
 )
 
 // DecodeCookie is a wrapper around decodeCookie that can be used for
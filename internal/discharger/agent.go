@@ -73,6 +73,9 @@ func (h *handler) AgentLogin(p httprequest.Params, req *agentLoginRequest) (*age
 	if req.PublicKey == nil {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "public-key not specified")
 	}
+	if err := h.checkAgentEnabled(p.Context, req.Username); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUserDisabled))
+	}
 	m, err := h.agentMacaroon(p.Context, httpbakery.RequestVersion(p.Request), identchecker.LoginOp, req.Username, req.PublicKey)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -97,6 +100,22 @@ func (h *handler) agentMacaroon(ctx context.Context, vers bakery.Version, op bak
 	return m, errgo.Mask(err)
 }
 
+// checkAgentEnabled checks that the given agent user has not been
+// disabled. Agents that are not found are not rejected here, as the
+// login will fail later when the public key is checked.
+func (h *handler) checkAgentEnabled(ctx context.Context, user string) error {
+	id := store.Identity{
+		Username: user,
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(auth.CheckEnabled(&id), errgo.Is(params.ErrUserDisabled))
+}
+
 // legacyAgentLoginRequest is the expected GET request to the agent-login
 // endpoint.
 type legacyAgentLoginRequest struct {
@@ -141,6 +160,9 @@ func (h *handler) LegacyAgentLoginPost(p httprequest.Params, req *legacyAgentLog
 
 // legacyAgentLogin handles the common parts of the legacy agent login protocols.
 func (h *handler) legacyAgentLogin(ctx context.Context, req *http.Request, dischargeID string, user string, key *bakery.PublicKey) (*agent.LegacyAgentResponse, error) {
+	if err := h.checkAgentEnabled(ctx, user); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUserDisabled))
+	}
 	loginOp := loginOp(user)
 	vers := httpbakery.RequestVersion(req)
 	ctx = httpbakery.ContextWithRequest(ctx, req)
@@ -12,8 +12,11 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
@@ -25,6 +28,7 @@ import (
 	"github.com/canonical/candid/internal/discharger"
 	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
 )
 
 type agentSuite struct {
@@ -33,8 +37,13 @@ type agentSuite struct {
 	dischargeCreator *candidtest.DischargeCreator
 }
 
+func TestAgent(t *testing.T) {
+	qtsuite.Run(qt.New(t), &agentSuite{})
+}
+
 func (s *agentSuite) Init(c *qt.C) {
-	s.srv = candidtest.NewMemServer(c, map[string]identity.NewAPIHandlerFunc{
+	s.store = candidtest.NewStore()
+	s.srv = candidtest.NewServer(c, s.store.ServerParams(), map[string]identity.NewAPIHandlerFunc{
 		"discharger": discharger.NewAPIHandler,
 	})
 	s.dischargeCreator = candidtest.NewDischargeCreator(s.srv)
@@ -58,6 +67,53 @@ func (s *agentSuite) TestHTTPBakeryAgentDischarge(c *qt.C) {
 	c.Assert(err, qt.IsNil)
 }
 
+func (s *agentSuite) TestHTTPBakeryAgentDischargeDisabled(c *qt.C) {
+	key := s.srv.CreateAgent(c, "bob@candid")
+	s.disableUser(c, "bob@candid")
+	client := s.srv.Client(nil)
+	client.Key = key
+	err := agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: client.Key,
+		Agents: []agent.Agent{{
+			URL:      s.srv.URL,
+			Username: "bob@candid",
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.ErrorMatches, `cannot get discharge from ".*": cannot acquire agent macaroon: Get .*/login/agent.*: user bob@candid is disabled: retired`)
+}
+
+func (s *agentSuite) TestLegacyAgentDischargeDisabled(c *qt.C) {
+	key := s.srv.CreateAgent(c, "bob@candid")
+	s.disableUser(c, "bob@candid")
+	client := s.srv.Client(nil)
+	client.Key = key
+	client.Transport = fakeLegacyServerTransport{client.Transport}
+	err := agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: client.Key,
+		Agents: []agent.Agent{{
+			URL:      s.srv.URL,
+			Username: "bob@candid",
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = s.dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.ErrorMatches, `.*user bob@candid is disabled: retired`)
+}
+
+func (s *agentSuite) disableUser(c *qt.C, username string) {
+	err := s.store.Store.UpdateIdentity(context.Background(), &store.Identity{
+		Username:       username,
+		Disabled:       time.Now(),
+		DisabledReason: "retired",
+	}, store.Update{
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
+
 func (s *agentSuite) TestGetAgentDischargeNoCookie(c *qt.C) {
 	client := &httprequest.Client{
 		BaseURL: s.srv.URL,
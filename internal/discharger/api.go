@@ -42,7 +42,7 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		place:         place,
 	}
 	codec := secret.NewCodec(params.Key)
-	err = initIDPs(context.Background(), initIDPParams{
+	err = initIDPs(params.Context, initIDPParams{
 		HandlerParams:         params,
 		Codec:                 codec,
 		DischargeTokenCreator: dt,
@@ -56,6 +56,10 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		place:   place,
 		reqAuth: reqAuth,
 	}
+	kr := newKeyring(params.Context, params.Key, params.ThirdPartyKeys, httpbakery.DischargerParams{
+		CheckerP:        checker,
+		ErrorToResponse: identity.ReqServer.ErrorMapper,
+	})
 	handlers := identity.ReqServer.Handlers(handlerCreator(handlerParams{
 		HandlerParams:         params,
 		checker:               checker,
@@ -65,13 +69,9 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		place:                 place,
 		reqAuth:               reqAuth,
 		codec:                 codec,
+		keyring:               kr,
 	}))
-	d := httpbakery.NewDischarger(httpbakery.DischargerParams{
-		CheckerP:        checker,
-		Key:             params.Key,
-		ErrorToResponse: identity.ReqServer.ErrorMapper,
-	})
-	for _, h := range d.Handlers() {
+	for _, h := range kr.handlers() {
 		handlers = append(handlers, h)
 
 		// also add the discharger endpoint at the legacy location.
@@ -94,6 +94,7 @@ type handlerParams struct {
 	place                 *place
 	reqAuth               *httpauth.Authorizer
 	codec                 *secret.Codec
+	keyring               *keyring
 }
 
 // handlerCreator returns a function that creates new instances of the discharger API handler for a request.
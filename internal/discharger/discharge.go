@@ -129,7 +129,7 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 	}
 	if err != nil {
 		// TODO return appropriate error code when permission denied.
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUserDisabled))
 	}
 	logger.Debugf("authorization for %#v succeeded", authInfo.Identity)
 	c.updateDischargeTime(ctx, authInfo.Identity.Id())
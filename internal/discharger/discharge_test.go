@@ -15,6 +15,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -902,3 +903,158 @@ func (s *dischargeSuite) TestDischargeUserID(c *qt.C) {
 	c.Assert(err, qt.IsNil)
 	c.Assert(username, qt.Equals, auth.AdminUsername)
 }
+
+func TestDischargeWithRotatedKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Patch(discharger.MinKeyRefreshInterval, time.Duration(0))
+
+	oldKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	// The old key is not available when the server starts so that
+	// the keys are refreshed when a caveat addressed to it is seen.
+	keys := new(testKeys)
+	srv := newRotatedKeyServer(c, keys)
+	keys.set(srv.Key, oldKey)
+
+	// The active key is still advertised.
+	info, err := httpbakery.ThirdPartyInfoForLocation(testContext, nil, srv.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, srv.Key.Public)
+
+	for _, version := range []bakery.Version{bakery.Version1, bakery.LatestVersion} {
+		c.Logf("version %d", version)
+		locator := bakery.NewThirdPartyStore()
+		locator.AddInfo(srv.URL, bakery.ThirdPartyInfo{
+			PublicKey: oldKey.Public,
+			Version:   version,
+		})
+		dc := candidtest.NewDischargeCreator(srv)
+		dc.Bakery = identchecker.NewBakery(identchecker.BakeryParams{
+			Locator:        locator,
+			Key:            bakery.MustGenerateKey(),
+			IdentityClient: srv.AdminIdentityClient(false),
+			Location:       "discharge-test",
+		})
+		ms, err := dc.Discharge(c, "is-authenticated-user", srv.AdminClient())
+		c.Assert(err, qt.IsNil)
+		dc.AssertMacaroon(c, ms, identchecker.LoginOp, auth.AdminUsername)
+
+		// Check that interactive discharges, which complete with
+		// the wait endpoint, also work.
+		dc.AssertDischarge(c, httpbakery.WebBrowserInteractor{
+			OpenWebBrowser: candidtest.PasswordLogin(c, "test", "password"),
+		})
+	}
+}
+
+func TestRotatedActiveKeyAdvertised(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Patch(discharger.KeyRefreshInterval, 10*time.Millisecond)
+
+	keys := new(testKeys)
+	srv := newRotatedKeyServer(c, keys)
+	info, err := httpbakery.ThirdPartyInfoForLocation(testContext, nil, srv.URL)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.PublicKey, qt.Equals, srv.Key.Public)
+
+	// The new active key is advertised once the keys have been
+	// refreshed.
+	newKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	keys.set(newKey, srv.Key)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err = httpbakery.ThirdPartyInfoForLocation(testContext, nil, srv.URL)
+		c.Assert(err, qt.IsNil)
+		if info.PublicKey == newKey.Public || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(info.PublicKey, qt.Equals, newKey.Public)
+
+	// Caveats addressed to the original key can still be
+	// discharged.
+	dc := candidtest.NewDischargeCreator(srv)
+	ms, err := dc.Discharge(c, "is-authenticated-user", srv.AdminClient())
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, auth.AdminUsername)
+}
+
+func TestUnknownKeyRefreshLimited(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	keys := new(testKeys)
+	srv := newRotatedKeyServer(c, keys)
+	n := keys.calls()
+
+	// Caveats addressed to unknown keys only cause the keys to be
+	// refreshed once within the minimum refresh interval.
+	unknownKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	for i := 0; i < 3; i++ {
+		// The caveat is not valid, but holds the prefix of
+		// the key that it is addressed to.
+		cav := append([]byte{byte(bakery.Version3)}, unknownKey.Public.Key[:]...)
+		resp, err := http.PostForm(srv.URL+"/discharge", url.Values{
+			"id64":     {base64.RawURLEncoding.EncodeToString([]byte("id"))},
+			"caveat64": {base64.RawURLEncoding.EncodeToString(cav)},
+		})
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Not(qt.Equals), http.StatusOK)
+	}
+	c.Assert(keys.calls(), qt.Equals, n)
+}
+
+// testKeys provides the ThirdPartyKeys function for a server.
+type testKeys struct {
+	mu    sync.Mutex
+	keys  []*bakery.KeyPair
+	ncall int
+}
+
+func (k *testKeys) set(keys ...*bakery.KeyPair) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
+
+func (k *testKeys) calls() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.ncall
+}
+
+func (k *testKeys) find(context.Context) ([]*bakery.KeyPair, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.ncall++
+	return k.keys, nil
+}
+
+func newRotatedKeyServer(c *qt.C, keys *testKeys) *candidtest.Server {
+	store := candidtest.NewStore()
+	sp := store.ServerParams()
+	sp.AdminPassword = "test-password"
+	sp.ThirdPartyKeys = keys.find
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"test": {
+					Password: "password",
+					Name:     "Test User",
+					Email:    "test@example.com",
+				},
+			},
+		}),
+	}
+	return candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+}
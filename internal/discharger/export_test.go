@@ -12,7 +12,11 @@ import (
 	"github.com/canonical/candid/store"
 )
 
-var NewIDPHandler = newIDPHandler
+var (
+	NewIDPHandler         = newIDPHandler
+	KeyRefreshInterval    = &keyRefreshInterval
+	MinKeyRefreshInterval = &minKeyRefreshInterval
+)
 
 type LoginInfo loginInfo
 
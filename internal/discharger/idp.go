@@ -46,6 +46,7 @@ func initIDPs(ctx context.Context, params initIDPParams) error {
 		if err := ip.Init(ctx, idp.InitParams{
 			Store:                      params.Store,
 			KeyValueStore:              kvStore,
+			AuditStore:                 params.AuditStore,
 			Oven:                       params.Oven,
 			Codec:                      params.Codec,
 			Location:                   params.Location,
@@ -125,17 +126,38 @@ func (c *visitCompleter) Success(ctx context.Context, w http.ResponseWriter, req
 		}
 	}
 
+	linkURL := c.params.Location + linkCookiePath
+	if err := auth.CheckEnabled(id); err != nil {
+		// Disabled users cannot link other identities.
+		linkURL = ""
+	} else if err := c.setLinkCookie(ctx, w, id); err != nil {
+		logger.Errorf("cannot set link cookie: %s", err)
+		linkURL = ""
+	}
 	t := c.params.Template.Lookup("login")
 	if t == nil {
 		fmt.Fprintf(w, "Login successful as %s", id.Username)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	if err := t.Execute(w, id); err != nil {
+	if err := t.Execute(w, loginSuccessParams{
+		Identity: id,
+		LinkURL:  linkURL,
+	}); err != nil {
 		logger.Errorf("error processing login template: %s", err)
 	}
 }
 
+// loginSuccessParams holds the parameters sent to the login template.
+type loginSuccessParams struct {
+	*store.Identity
+
+	// LinkURL holds the URL that can be used to link another
+	// identity provider to the identity. It is empty if linking is
+	// not possible.
+	LinkURL string
+}
+
 // Failure implements idp.VisitCompleter.Failure.
 func (c *visitCompleter) Failure(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, err error) {
 	_, bakeryErr := httpbakery.ErrorToResponse(ctx, err)
@@ -190,7 +212,7 @@ func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWri
 func (c *visitCompleter) redirect(w http.ResponseWriter, req *http.Request, returnTo string, query url.Values) error {
 	// Check the return to is a whitelisted address, and is a valid URL.
 	var validReturnTo bool
-	if returnTo == c.params.Location+"/login-complete" {
+	if returnTo == c.params.Location+"/login-complete" || returnTo == c.params.Location+"/link/complete" {
 		validReturnTo = true
 	} else {
 		for _, rurl := range c.params.RedirectLoginWhitelist {
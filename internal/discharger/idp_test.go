@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
@@ -17,6 +18,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/discharger"
@@ -44,10 +46,11 @@ func (s *idpSuite) Init(c *qt.C) {
 
 	s.template = template.New("")
 
+	rks := store.NewBakeryRootKeyStore(s.store.RootKeys, store.DefaultRootKeyPolicy)
 	oven := bakery.NewOven(bakery.OvenParams{
 		Namespace: auth.Namespace,
 		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
-			return s.store.BakeryRootKeyStore
+			return rks
 		},
 		Key:      bakery.MustGenerateKey(),
 		Location: "candidtest",
@@ -67,7 +70,7 @@ func (s *idpSuite) Init(c *qt.C) {
 		ServerParams: identity.ServerParams{
 			Store:        s.store.Store,
 			MeetingStore: s.store.MeetingStore,
-			RootKeyStore: s.store.BakeryRootKeyStore,
+			RootKeyStore: rks,
 			Template:     s.template,
 		},
 		MeetingPlace: s.meetingPlace,
@@ -210,3 +213,39 @@ func (s *idpSuite) TestLoginRedirectFailureInvalidReturnTo(c *qt.C) {
 		Message: `test error`,
 	})
 }
+
+func TestIdentityProviderContextDoneOnClose(t *testing.T) {
+	c := qt.New(t)
+	ip := &contextRecorder{
+		IdentityProvider: static.NewIdentityProvider(static.Params{Name: "test"}),
+	}
+	sp := candidtest.NewStore().ServerParams()
+	sp.Key = bakery.MustGenerateKey()
+	sp.Location = "http://candid.example.com"
+	sp.PrivateAddr = "localhost"
+	sp.Template = candidtest.DefaultTemplate
+	sp.IdentityProviders = []idp.IdentityProvider{ip}
+	srv, err := identity.New(sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ip.ctx.Err(), qt.IsNil)
+
+	// Background tasks started by identity providers, such as
+	// reloading the static users file, stop when the server is
+	// closed.
+	srv.Close()
+	c.Assert(ip.ctx.Err(), qt.Equals, context.Canceled)
+}
+
+// contextRecorder is an identity provider that records the context it
+// is initialised with.
+type contextRecorder struct {
+	idp.IdentityProvider
+	ctx context.Context
+}
+
+func (r *contextRecorder) Init(ctx context.Context, params idp.InitParams) error {
+	r.ctx = ctx
+	return r.IdentityProvider.Init(ctx, params)
+}
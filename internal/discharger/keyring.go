@@ -0,0 +1,310 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/canonical/candid/internal/identity"
+)
+
+var (
+	// keyRefreshInterval holds the time between periodic refreshes
+	// of the known keys.
+	keyRefreshInterval = time.Minute
+
+	// minKeyRefreshInterval holds the minimum time between
+	// refreshes of the known keys caused by caveats that are not
+	// addressed to any known key. This stops requests with such
+	// caveats, which do not need to be authenticated, from causing
+	// the keys to be read from the store every time.
+	minKeyRefreshInterval = 10 * time.Second
+)
+
+// A keyring holds the key pairs that can be used to decrypt third-party
+// caveats addressed to the server. The active key, which is advertised
+// to clients, is the first key found by the keyring's find function, or
+// the server's Key if none have been found.
+type keyring struct {
+	key    *bakery.KeyPair
+	find   func(context.Context) ([]*bakery.KeyPair, error)
+	params httpbakery.DischargerParams
+
+	// refreshMu is held while the keys are being refreshed, so that
+	// only one refresh happens at a time.
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+
+	mu          sync.Mutex
+	active      *bakery.KeyPair
+	keys        []*bakery.KeyPair
+	dischargers map[bakery.PublicKey][]httprequest.Handler
+}
+
+// newKeyring creates a new keyring with the given key, which is always
+// used to decrypt caveats. The given find function, if not nil, is used
+// to find the active key and other keys that can be used to decrypt
+// caveats. The keys are found again periodically until the given
+// context is done. The given discharger parameters are used to create
+// the discharge handlers for each key.
+func newKeyring(ctx context.Context, key *bakery.KeyPair, find func(context.Context) ([]*bakery.KeyPair, error), p httpbakery.DischargerParams) *keyring {
+	kr := &keyring{
+		key:         key,
+		find:        find,
+		params:      p,
+		active:      key,
+		keys:        []*bakery.KeyPair{key},
+		dischargers: make(map[bakery.PublicKey][]httprequest.Handler),
+	}
+	if find != nil {
+		if err := kr.refresh(ctx); err != nil {
+			logger.Errorf("cannot find third-party keys: %s", err)
+		}
+		go kr.run(ctx)
+	}
+	return kr
+}
+
+// run refreshes the known keys every keyRefreshInterval until the given
+// context is done.
+func (kr *keyring) run(ctx context.Context) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := kr.refresh(ctx); err != nil {
+			logger.Errorf("cannot find third-party keys: %s", err)
+		}
+	}
+}
+
+// activeKey returns the key pair that is advertised to clients.
+func (kr *keyring) activeKey() *bakery.KeyPair {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	return kr.active
+}
+
+// keyForCaveat returns the key pair that can be used to decrypt the
+// given third-party caveat. If the caveat is not addressed to any of the
+// known keys then the keys are refreshed, in case a key has been added
+// since they were last found, unless they have been refreshed within
+// minKeyRefreshInterval. If there is still no suitable key then the
+// active key is returned.
+func (kr *keyring) keyForCaveat(ctx context.Context, caveat []byte) *bakery.KeyPair {
+	if len(caveat) == 0 {
+		return kr.activeKey()
+	}
+	if key := kr.findKey(caveat); key != nil {
+		return key
+	}
+	if kr.find == nil {
+		return kr.activeKey()
+	}
+	if err := kr.refreshIfStale(ctx); err != nil {
+		logger.Errorf("cannot find third-party keys: %s", err)
+		return kr.activeKey()
+	}
+	if key := kr.findKey(caveat); key != nil {
+		return key
+	}
+	return kr.activeKey()
+}
+
+// findKey returns the known key pair that the given caveat is
+// addressed to, or nil if there is none.
+func (kr *keyring) findKey(caveat []byte) *bakery.KeyPair {
+	kr.mu.Lock()
+	keys := kr.keys
+	kr.mu.Unlock()
+	for _, key := range keys {
+		if caveatAddressedTo(caveat, &key.Public) {
+			return key
+		}
+	}
+	return nil
+}
+
+// publicKeyPrefixLen holds the length of the public key prefix in
+// version 2 and 3 third-party caveats.
+const publicKeyPrefixLen = 4
+
+// caveatAddressedTo reports whether the given encoded third-party
+// caveat was encrypted for the given public key.
+func caveatAddressedTo(caveat []byte, key *bakery.PublicKey) bool {
+	if len(caveat) == 0 {
+		return false
+	}
+	switch caveat[0] {
+	case byte(bakery.Version2), byte(bakery.Version3):
+		// The version byte is followed by a prefix of the
+		// public key.
+		if len(caveat) < 1+publicKeyPrefixLen {
+			return false
+		}
+		return bytes.Equal(caveat[1:1+publicKeyPrefixLen], key.Key[:publicKeyPrefixLen])
+	case 'e':
+		// Version 1 caveats are base64-encoded JSON objects
+		// that contain the whole public key.
+		data, err := base64.StdEncoding.DecodeString(string(caveat))
+		if err != nil {
+			return false
+		}
+		var v struct {
+			ThirdPartyPublicKey *bakery.PublicKey
+		}
+		if err := json.Unmarshal(data, &v); err != nil || v.ThirdPartyPublicKey == nil {
+			return false
+		}
+		return *v.ThirdPartyPublicKey == *key
+	}
+	return false
+}
+
+// refreshIfStale refreshes the known keys if they have not been
+// refreshed within minKeyRefreshInterval.
+func (kr *keyring) refreshIfStale(ctx context.Context) error {
+	kr.refreshMu.Lock()
+	defer kr.refreshMu.Unlock()
+	if time.Since(kr.lastRefresh) < minKeyRefreshInterval {
+		return nil
+	}
+	return errgo.Mask(kr.refreshLocked(ctx))
+}
+
+// refresh updates the known keys using the keyring's find function.
+func (kr *keyring) refresh(ctx context.Context) error {
+	kr.refreshMu.Lock()
+	defer kr.refreshMu.Unlock()
+	return errgo.Mask(kr.refreshLocked(ctx))
+}
+
+// refreshLocked is like refresh except that refreshMu must be held.
+func (kr *keyring) refreshLocked(ctx context.Context) error {
+	// Record the attempt even if it fails so that a failing store
+	// is not retried for every request.
+	kr.lastRefresh = time.Now()
+	found, err := kr.find(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	active := kr.key
+	if len(found) > 0 {
+		active = found[0]
+	}
+	keys := []*bakery.KeyPair{active}
+	if active.Public != kr.key.Public {
+		keys = append(keys, kr.key)
+	}
+	for _, key := range found {
+		if key.Public != active.Public && key.Public != kr.key.Public {
+			keys = append(keys, key)
+		}
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if active.Public != kr.active.Public {
+		logger.Infof("third-party key %s is now active", active.Public)
+	}
+	kr.active = active
+	kr.keys = keys
+	return nil
+}
+
+// handlers returns the handlers for the third-party caveat discharge
+// service. The /publickey and /discharge/info endpoints advertise the
+// active key, and the /discharge endpoint discharges caveats
+// addressed to any key in the keyring.
+func (kr *keyring) handlers() []httprequest.Handler {
+	hs := httpbakery.NewDischarger(kr.params).Handlers()
+	for i, h := range hs {
+		method, path := h.Method, h.Path
+		if method == "POST" && path == "/discharge" {
+			hs[i].Handle = kr.discharge
+			continue
+		}
+		hs[i].Handle = func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+			kr.serveWithKey(kr.activeKey(), method, path, w, req, p)
+		}
+	}
+	return hs
+}
+
+// discharge handles a /discharge request using the discharge handler
+// for the key that the requested caveat is addressed to.
+func (kr *keyring) discharge(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	key := kr.keyForCaveat(req.Context(), requestCaveat(req))
+	kr.serveWithKey(key, "POST", "/discharge", w, req, p)
+}
+
+// serveWithKey serves the given request using the discharger handler
+// with the given method and path that uses the given key.
+func (kr *keyring) serveWithKey(key *bakery.KeyPair, method, path string, w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	h, err := kr.handler(key, method, path)
+	if err != nil {
+		identity.WriteError(req.Context(), w, err)
+		return
+	}
+	h(w, req, p)
+}
+
+// handler returns the discharger handler with the given method and path
+// that uses the given key.
+func (kr *keyring) handler(key *bakery.KeyPair, method, path string) (httprouter.Handle, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	hs, ok := kr.dischargers[key.Public]
+	if !ok {
+		p := kr.params
+		p.Key = key
+		hs = httpbakery.NewDischarger(p).Handlers()
+		kr.dischargers[key.Public] = hs
+	}
+	for _, h := range hs {
+		if h.Method == method && h.Path == path {
+			return h.Handle, nil
+		}
+	}
+	return nil, errgo.Newf("no discharger handler for %s %s", method, path)
+}
+
+// requestCaveat returns the third-party caveat in the given discharge
+// request. It returns nil if the caveat cannot be determined, in which
+// case the discharge handler will return an appropriate error.
+func requestCaveat(req *http.Request) []byte {
+	if err := req.ParseForm(); err != nil {
+		return nil
+	}
+	var data string
+	switch {
+	case req.Form.Get("caveat64") != "":
+		data = req.Form.Get("caveat64")
+	case req.Form.Get("id64") != "":
+		data = req.Form.Get("id64")
+	default:
+		return []byte(req.Form.Get("id"))
+	}
+	caveat, err := macaroon.Base64Decode([]byte(data))
+	if err != nil {
+		return nil
+	}
+	return caveat
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// linkCookieName is the name of the cookie that holds the code
+	// identifying the user that most recently logged in. The user
+	// may then link another identity provider to their account.
+	linkCookieName = "candid-link"
+
+	// linkStateCookieName is the name of the cookie that holds the
+	// state of a link in progress.
+	linkStateCookieName = "candid-link-state"
+
+	// linkCookiePath is the path associated with the link cookies.
+	linkCookiePath = "/link"
+)
+
+// linkState holds the state of a link in progress.
+type linkState struct {
+	// ProviderID holds the provider ID of the user that the new
+	// provider ID will be linked to.
+	ProviderID store.ProviderIdentity
+
+	// Expires holds the time that this link attempt should expire.
+	Expires time.Time
+}
+
+// linkRequest is a request to start linking another identity provider
+// to the user that has most recently logged in.
+type linkRequest struct {
+	httprequest.Route `httprequest:"GET /link"`
+
+	// Domain holds the requested identity provider domain, if any.
+	Domain string `httprequest:"domain,form"`
+}
+
+// Link handles the GET /link endpoint. It presents the user that has
+// just logged in with the choice of identity providers they can link
+// to their account.
+func (h *handler) Link(p httprequest.Params, req *linkRequest) error {
+	cookie, err := p.Request.Cookie(linkCookieName)
+	if err != nil {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "login required")
+	}
+	var id store.Identity
+	if err := h.params.identityStore.Get(p.Context, cookie.Value, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "login required")
+		}
+		return errgo.Mask(err)
+	}
+	expires := time.Now().Add(15 * time.Minute)
+	cookiePath := idputil.CookiePathRelativeToLocation(linkCookiePath, h.params.Location, h.params.SkipLocationForCookiePaths)
+	linkStateID, err := h.params.codec.SetCookie(p.Response, linkStateCookieName, cookiePath, linkState{
+		ProviderID: id.ProviderID,
+		Expires:    expires,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	state, err := idputil.SetLoginCookie(p.Response, h.params.codec, h.params.Location, h.params.SkipLocationForCookiePaths, idputil.LoginState{
+		ReturnTo: h.params.Location + "/link/complete",
+		State:    linkStateID,
+		Expires:  expires,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(h.authChoice(p.Response, p.Request, state, req.Domain, "", false))
+}
+
+// linkCompleteRequest is a request that completes a link attempt.
+type linkCompleteRequest struct {
+	httprequest.Route `httprequest:"GET /link/complete"`
+
+	// State holds the link state that was sent with the original
+	// link request. This must match the candid-link-state cookie
+	// for the request to be processed.
+	State string `httprequest:"state,form"`
+
+	// Code holds the code identifying the user that logged in to
+	// the new identity provider. This is only set on successful
+	// requests.
+	Code string `httprequest:"code,form"`
+
+	// Error holds the error message from a failed login.
+	Error string `httprequest:"error,form"`
+}
+
+// LinkComplete handles completing the link process. The login to the
+// new identity provider returns here with either a code identifying the
+// logged in user, or an error. If the login was successful then the
+// provider ID of the newly logged in user is linked to the original
+// user, merging the two users if necessary.
+func (h *handler) LinkComplete(p httprequest.Params, req *linkCompleteRequest) {
+	ctx := p.Context
+	var ls linkState
+	if err := h.params.codec.Cookie(p.Request, linkStateCookieName, req.State, &ls); err != nil {
+		logger.Infof("link error: %s", err)
+		idputil.BadRequestf(p.Response, "invalid link state")
+		return
+	}
+	if time.Now().After(ls.Expires) {
+		idputil.BadRequestf(p.Response, "link expired")
+		return
+	}
+	if req.Error != "" {
+		identity.WriteError(ctx, p.Response, errgo.New(req.Error))
+		return
+	}
+	var linked store.Identity
+	if err := h.params.identityStore.Get(ctx, req.Code, &linked); err != nil {
+		identity.WriteError(ctx, p.Response, errgo.Mask(err, errgo.Is(store.ErrNotFound)))
+		return
+	}
+	id := store.Identity{
+		ProviderID: ls.ProviderID,
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		identity.WriteError(ctx, p.Response, errgo.Mask(err, errgo.Is(store.ErrNotFound)))
+		return
+	}
+	before := providerIDs(&id)
+	merged, err := store.LinkProviderID(ctx, h.params.Store, &id, linked.ProviderID, !idp.ManagesSSHKeys(h.params.IdentityProviders, &id), auth.CheckEnabled)
+	if err != nil {
+		identity.WriteError(ctx, p.Response, errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrDuplicateProviderID), errgo.Is(params.ErrUserDisabled)))
+		return
+	}
+	if merged != nil {
+		h.audit(p, id.Username, "merge-user", merged.Username, providerIDs(merged), []string{id.Username})
+	}
+	if after := providerIDs(&id); len(after) != len(before) {
+		h.audit(p, id.Username, "link-provider-id", id.Username, before, after)
+	}
+
+	t := h.params.Template.Lookup("link")
+	if t == nil {
+		fmt.Fprintf(p.Response, "Linked %s to %s", linked.ProviderID, id.Username)
+		return
+	}
+	p.Response.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := t.Execute(p.Response, linkSuccessParams{
+		Identity: &id,
+		Linked:   linked.ProviderID,
+	}); err != nil {
+		logger.Errorf("error processing link template: %s", err)
+	}
+}
+
+// linkSuccessParams holds the parameters sent to the link template.
+type linkSuccessParams struct {
+	*store.Identity
+
+	// Linked holds the provider ID that has been linked to the
+	// identity.
+	Linked store.ProviderIdentity
+}
+
+// setLinkCookie sets the cookie that allows the given user, who has
+// just logged in, to link another identity provider to their account.
+func (c *visitCompleter) setLinkCookie(ctx context.Context, w http.ResponseWriter, id *store.Identity) error {
+	code, err := c.identityStore.Put(ctx, id, time.Now().Add(15*time.Minute))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkCookieName,
+		Value:    code,
+		Path:     idputil.CookiePathRelativeToLocation(linkCookiePath, c.params.Location, c.params.SkipLocationForCookiePaths),
+		HttpOnly: true,
+		Secure:   idputil.SecureLocation(c.params.Location),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// audit records a change made by a link in the audit log.
+func (h *handler) audit(p httprequest.Params, actor, op, target string, before, after []string) {
+	if h.params.AuditStore == nil {
+		return
+	}
+	err := h.params.AuditStore.AddAuditEntry(p.Context, &store.AuditEntry{
+		Actor:     actor,
+		Operation: op,
+		Target:    target,
+		Before:    before,
+		After:     after,
+		RequestID: identity.RequestID(p.Request),
+	})
+	if err != nil {
+		logger.Errorf("cannot record %s of %s in audit log: %s", op, target, err)
+	}
+}
+
+// providerIDs returns all the provider IDs that identify the given
+// identity, starting with the primary one.
+func providerIDs(id *store.Identity) []string {
+	pids := []string{string(id.ProviderID)}
+	for _, pid := range id.LinkedProviderIDs {
+		pids = append(pids, string(pid))
+	}
+	return pids
+}
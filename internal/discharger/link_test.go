@@ -0,0 +1,218 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/store"
+)
+
+func TestLink(t *testing.T) {
+	qtsuite.Run(qt.New(t), &linkSuite{})
+}
+
+type linkSuite struct {
+	store  *candidtest.Store
+	srv    *candidtest.Server
+	client *http.Client
+}
+
+func (s *linkSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	sp := s.store.ServerParams()
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"test": {
+					Password: "testpassword",
+					Name:     "Test User",
+					Email:    "test@example.com",
+				},
+			},
+		}),
+		static.NewIdentityProvider(static.Params{
+			Name:   "test2",
+			Domain: "test2",
+			Users: map[string]static.UserInfo{
+				"bob": {
+					Password: "bobpassword",
+					Name:     "Bob",
+				},
+			},
+		}),
+	}
+	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	s.client = &http.Client{
+		Jar: jar,
+	}
+}
+
+func (s *linkSuite) TestLink(c *qt.C) {
+	body := s.login(c, "/login?domain=", "test", "testpassword")
+	c.Assert(body, qt.Equals, "login successful as user test\n")
+
+	body = s.login(c, "/link?domain=test2", "bob", "bobpassword")
+	c.Assert(body, qt.Equals, "Linked test2:bob@test2 to test")
+
+	for _, pid := range []store.ProviderIdentity{"test:test", "test2:bob@test2"} {
+		id := store.Identity{
+			ProviderID: pid,
+		}
+		err := s.store.Store.Identity(s.srv.Ctx, &id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(id.Username, qt.Equals, "test")
+		c.Assert(id.ProviderID, qt.Equals, store.ProviderIdentity("test:test"))
+		c.Assert(id.LinkedProviderIDs, qt.DeepEquals, []store.ProviderIdentity{"test2:bob@test2"})
+	}
+
+	// The user that was created by logging in to test2 has been
+	// merged.
+	err := s.store.Store.Identity(s.srv.Ctx, &store.Identity{
+		Username: "bob@test2",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *linkSuite) TestLinkCookie(c *qt.C) {
+	var cookies []*http.Cookie
+	s.client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil {
+			cookies = append(cookies, resp.Cookies()...)
+		}
+		return resp, err
+	})
+	s.login(c, "/login?domain=", "test", "testpassword")
+
+	var link *http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name == "candid-link" {
+			link = cookie
+		}
+	}
+	c.Assert(link, qt.Not(qt.IsNil))
+	c.Assert(link.HttpOnly, qt.IsTrue)
+	c.Assert(link.SameSite, qt.Equals, http.SameSiteLaxMode)
+	// The test server does not use HTTPS.
+	c.Assert(link.Secure, qt.IsFalse)
+}
+
+func (s *linkSuite) TestLinkDisabled(c *qt.C) {
+	body := s.login(c, "/login?domain=", "test", "testpassword")
+	c.Assert(body, qt.Equals, "login successful as user test\n")
+	s.disable(c, "test")
+
+	resp := s.loginResponse(c, "/link?domain=test2", "bob", "bobpassword")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Matches, `.*user test is disabled.*`)
+
+	id := store.Identity{
+		ProviderID: "test:test",
+	}
+	err = s.store.Store.Identity(s.srv.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.LinkedProviderIDs, qt.HasLen, 0)
+}
+
+func (s *linkSuite) TestLinkCookieNotSetForDisabledUser(c *qt.C) {
+	s.login(c, "/login?domain=", "test", "testpassword")
+	s.disable(c, "test")
+
+	var cookies []*http.Cookie
+	s.client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil {
+			cookies = append(cookies, resp.Cookies()...)
+		}
+		return resp, err
+	})
+	resp := s.loginResponse(c, "/login?domain=", "test", "testpassword")
+	resp.Body.Close()
+	for _, cookie := range cookies {
+		c.Assert(cookie.Name, qt.Not(qt.Equals), "candid-link")
+	}
+}
+
+func (s *linkSuite) TestLinkNotLoggedIn(c *qt.C) {
+	resp, err := s.client.Get(s.srv.URL + "/link")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
+
+func (s *linkSuite) TestLinkCompleteInvalidState(c *qt.C) {
+	resp, err := s.client.Get(s.srv.URL + "/link/complete?state=1234&code=5678")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "invalid link state")
+}
+
+// login visits the given path on the server and then logs in to the
+// first identity provider offered with the given username and password.
+// It returns the body of the final response.
+func (s *linkSuite) login(c *qt.C, path, username, password string) string {
+	resp := s.loginResponse(c, path, username, password)
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK, qt.Commentf("%s", buf))
+	return string(buf)
+}
+
+// loginResponse is like login except that it returns the final
+// response whatever its status.
+func (s *linkSuite) loginResponse(c *qt.C, path, username, password string) *http.Response {
+	resp, err := s.client.Get(s.srv.URL + path)
+	c.Assert(err, qt.IsNil)
+	resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm(username, password))(s.client, resp)
+	c.Assert(err, qt.IsNil)
+	return resp
+}
+
+// disable disables the user with the given username.
+func (s *linkSuite) disable(c *qt.C, username string) {
+	id := store.Identity{
+		Username: username,
+	}
+	err := s.store.Store.Identity(s.srv.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		ID:       id.ID,
+		Disabled: time.Now(),
+	}, store.Update{
+		store.Disabled: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -81,10 +81,14 @@ func (h *handler) WaitLegacy(p httprequest.Params, req *waitRequest) (*waitRespo
 	// DischargeToken don't necessarily have access to the original origin
 	// (because they might be creating the token in response to a callback
 	// from an external identity provider, for example).
+	caveat := reqInfo.Caveat
+	if len(caveat) == 0 {
+		caveat = reqInfo.CaveatId
+	}
 	m, err := bakery.Discharge(p.Context, bakery.DischargeParams{
 		Id:     reqInfo.CaveatId,
 		Caveat: reqInfo.Caveat,
-		Key:    h.params.Key,
+		Key:    h.params.keyring.keyForCaveat(ctx, caveat),
 		Checker: bakery.ThirdPartyCaveatCheckerFunc(func(ctx context.Context, ci *bakery.ThirdPartyCaveatInfo) ([]checkers.Caveat, error) {
 			return h.params.checker.checkThirdPartyCaveat(ctx, httpbakery.ThirdPartyCaveatCheckerParams{
 				Caveat:   ci,
@@ -0,0 +1,125 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/juju/aclstore/v2"
+
+	"github.com/canonical/candid/store"
+)
+
+// requestIDHeader is the HTTP header used to identify a request. If a
+// client does not provide a request ID one will be generated.
+const requestIDHeader = "X-Request-Id"
+
+// withRequestID ensures that the given request has a request ID. The ID
+// is also returned to the client in the response headers.
+func withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newRequestID()
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return req
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("cannot read random bytes: %v", err))
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
+// RequestID returns the ID of the given request.
+func RequestID(req *http.Request) string {
+	return req.Header.Get(requestIDHeader)
+}
+
+// An aclAuditHandler wraps the handler for the /acl endpoints such
+// that any successful change to an ACL is recorded in the audit log.
+type aclAuditHandler struct {
+	handler    http.Handler
+	aclStore   aclstore.ACLStore
+	auditStore store.AuditStore
+}
+
+// ServeHTTP implements http.Handler.
+func (h aclAuditHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var op string
+	switch req.Method {
+	case "PUT":
+		op = "set-acl"
+	case "POST":
+		op = "modify-acl"
+	}
+	if h.auditStore == nil || op == "" {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+	ctx := req.Context()
+	name := strings.TrimPrefix(req.URL.Path, "/acl/")
+	before, err := h.aclStore.Get(ctx, name)
+	if err != nil {
+		// The handler will report any error.
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+	var actor string
+	req = req.WithContext(context.WithValue(ctx, aclActorKey{}, &actor))
+	sw := &statusResponseWriter{
+		ResponseWriter: w,
+		status:         http.StatusOK,
+	}
+	h.handler.ServeHTTP(sw, req)
+	if sw.status != http.StatusOK || actor == "" {
+		return
+	}
+	after, err := h.aclStore.Get(ctx, name)
+	if err != nil {
+		logger.Errorf("cannot get ACL %q: %s", name, err)
+	}
+	err = h.auditStore.AddAuditEntry(ctx, &store.AuditEntry{
+		Actor:     actor,
+		Operation: op,
+		Target:    name,
+		Before:    before,
+		After:     after,
+		RequestID: RequestID(req),
+	})
+	if err != nil {
+		logger.Errorf("cannot record change to ACL %q: %s", name, err)
+	}
+}
+
+type aclActorKey struct{}
+
+// setACLActor records the authenticated user making a request to the
+// /acl endpoints so that it can be added to the audit log.
+func setACLActor(ctx context.Context, username string) {
+	if actor, _ := ctx.Value(aclActorKey{}).(*string); actor != nil {
+		*actor = username
+	}
+}
+
+// statusResponseWriter is an http.ResponseWriter that records the
+// status code of the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -63,6 +63,12 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		PublicKey: sp.Key.Public,
 		Version:   bakery.LatestVersion,
 	})
+	if sp.RootKeyPolicy == (store.RootKeyPolicy{}) {
+		sp.RootKeyPolicy = store.DefaultRootKeyPolicy
+	}
+	if sp.RootKeyStore == nil && sp.RootKeys != nil {
+		sp.RootKeyStore = store.NewBakeryRootKeyStore(sp.RootKeys, sp.RootKeyPolicy)
+	}
 	var rksf func([]bakery.Op) bakery.RootKeyStore
 	if sp.RootKeyStore != nil {
 		rksf = func([]bakery.Op) bakery.RootKeyStore {
@@ -97,6 +103,7 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		Location:          sp.Location,
 		MacaroonVerifier:  oven,
 		Store:             sp.Store,
+		GroupStore:        sp.GroupStore,
 		IdentityProviders: sp.IdentityProviders,
 		ACLManager:        aclManager,
 	})
@@ -105,17 +112,22 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	}
 
 	aclAuthenticator := httpauth.New(oven, auth, sp.APIMacaroonTimeout)
-	aclHandler := aclManager.NewHandler(aclstore.HandlerParams{
-		RootPath: "/acl",
-		Authenticate: func(ctx context.Context, w http.ResponseWriter, req *http.Request) (aclstore.Identity, error) {
-			ai, err := aclAuthenticator.Auth(ctx, req, identchecker.LoginOp)
-			if err != nil {
-				WriteError(ctx, w, err)
-				return nil, errgo.Mask(err)
-			}
-			return ai.Identity.(aclstore.Identity), nil
-		},
-	})
+	aclHandler := aclAuditHandler{
+		handler: aclManager.NewHandler(aclstore.HandlerParams{
+			RootPath: "/acl",
+			Authenticate: func(ctx context.Context, w http.ResponseWriter, req *http.Request) (aclstore.Identity, error) {
+				ai, err := aclAuthenticator.Auth(ctx, req, identchecker.LoginOp)
+				if err != nil {
+					WriteError(ctx, w, err)
+					return nil, errgo.Mask(err)
+				}
+				setACLActor(ctx, ai.Identity.Id())
+				return ai.Identity.(aclstore.Identity), nil
+			},
+		}),
+		aclStore:   sp.ACLStore,
+		auditStore: sp.AuditStore,
+	}
 
 	if err := auth.SetAdminPublicKey(context.Background(), sp.AdminAgentPublicKey); err != nil {
 		return nil, errgo.Mask(err)
@@ -135,10 +147,12 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	prometheus.Register(storeCollector)
 
 	// Create the HTTP server.
+	ctx, cancel := context.WithCancel(context.Background())
 	srv := &Server{
 		router:         httprouter.New(),
 		meetingPlace:   place,
 		storeCollector: storeCollector,
+		cancel:         cancel,
 	}
 	// Disable the automatic rerouting in order to maintain
 	// compatibility. It might be worthwhile relaxing this in the
@@ -157,11 +171,13 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	for name, newAPI := range versions {
 		handlers, err := newAPI(HandlerParams{
 			ServerParams: sp,
+			Context:      ctx,
 			Oven:         oven,
 			Authorizer:   auth,
 			MeetingPlace: place,
 		})
 		if err != nil {
+			srv.Close()
 			return nil, errgo.Notef(err, "cannot create API %s", name)
 		}
 		for _, h := range handlers {
@@ -176,6 +192,9 @@ type Server struct {
 	router         *httprouter.Router
 	meetingPlace   *meeting.Place
 	storeCollector monitoring.StoreCollector
+
+	// cancel cancels the context passed to the API handlers.
+	cancel context.CancelFunc
 }
 
 // ServeHTTP implements http.Handler.
@@ -192,12 +211,14 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Bakery-Protocol-Version, Macaroons, X-Requested-With, Content-Type")
 	w.Header().Set("Access-Control-Cache-Max-Age", "600")
+	req = withRequestID(w, req)
 	srv.router.ServeHTTP(w, req)
 }
 
 // Close  closes any resources held by this Handler.
 func (s *Server) Close() {
 	logger.Debugf("Closing Server")
+	s.cancel()
 	s.meetingPlace.Close()
 	prometheus.Unregister(s.storeCollector)
 }
@@ -217,15 +238,41 @@ type ServerParams struct {
 	// store macaroon root keys within the identity server.
 	RootKeyStore bakery.RootKeyStore
 
+	// RootKeys holds the store of macaroon root keys that is
+	// managed by the root key administration endpoints. If
+	// RootKeyStore is nil then a root key store that uses RootKeys
+	// will be used to create macaroons. If this is nil then root
+	// keys cannot be administered.
+	RootKeys store.RootKeyStore
+
+	// RootKeyPolicy holds the policy used to generate new root keys
+	// in RootKeys. If this is zero, store.DefaultRootKeyPolicy will
+	// be used.
+	RootKeyPolicy store.RootKeyPolicy
+
 	// Store holds the identities store for the identity server.
 	Store store.Store
 
 	// AdminPassword holds the password for admin login.
 	AdminPassword string
 
-	// Key holds the keypair to use with the bakery service.
+	// Key holds the keypair to use with the bakery service. It is
+	// used to decrypt third-party caveats addressed to the server
+	// and, unless ThirdPartyKeys returns a different active key, is
+	// the key advertised to clients.
 	Key *bakery.KeyPair
 
+	// ThirdPartyKeys, if set, returns other key pairs that may be
+	// used to decrypt third-party caveats addressed to the server,
+	// such as keys that were active before the key was rotated. If
+	// any keys are returned the first is the active key, which
+	// replaces Key as the key advertised to clients. It is called
+	// when the server starts, periodically while the server is
+	// running and when a caveat is received that cannot be
+	// decrypted with any key already known, so that keys added
+	// after the server started will be found.
+	ThirdPartyKeys func(context.Context) ([]*bakery.KeyPair, error)
+
 	// Location holds a URL representing the externally accessible
 	// base URL of the service, without a trailing slash.
 	Location string
@@ -266,6 +313,16 @@ type ServerParams struct {
 	// ACLStore holds the ACLStore for the identity server.
 	ACLStore aclstore.ACLStore
 
+	// AuditStore holds the store used to record changes made to
+	// identities, groups and ACLs. If this is nil then no audit
+	// log will be kept.
+	AuditStore store.AuditStore
+
+	// GroupStore holds the store used to hold information about
+	// groups, such as their owners. If this is nil then groups
+	// cannot be stored.
+	GroupStore store.GroupStore
+
 	// RedirectLoginWhitelist contains a list of URLs that are
 	// trusted to be used as return_to URLs during an interactive
 	// login.
@@ -294,6 +351,11 @@ type ServerParams struct {
 type HandlerParams struct {
 	ServerParams
 
+	// Context contains a context that is done when the server is
+	// closed. Any background tasks started by the handlers should
+	// stop when it is done.
+	Context context.Context
+
 	// Oven contains a bakery.Oven that should be used by handlers to
 	// mint new macaroons.
 	Oven *bakery.Oven
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
@@ -335,6 +336,59 @@ func (s *fullServerSuite) TestACL(c *qt.C) {
 	c.Assert(acl, qt.DeepEquals, []string{"test-2"})
 }
 
+func (s *fullServerSuite) TestACLAudit(c *qt.C) {
+	ctx := context.Background()
+	client := aclclient.New(aclclient.NewParams{
+		BaseURL: s.srv.URL + "/acl",
+		Doer:    s.srv.AdminClient(),
+	})
+	err := client.Add(ctx, "read-user", []string{"test-1"})
+	c.Assert(err, qt.IsNil)
+	err = client.Set(ctx, "read-user", []string{"test-2"})
+	c.Assert(err, qt.IsNil)
+	// Failed changes are not recorded.
+	err = client.Set(ctx, "no-such-acl", []string{"test-2"})
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	entries, err := s.store.AuditStore.FindAuditEntries(ctx, store.AuditFilter{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 2)
+	for i := range entries {
+		c.Assert(entries[i].RequestID, qt.Not(qt.Equals), "")
+		entries[i].ID = ""
+		entries[i].Time = time.Time{}
+		entries[i].RequestID = ""
+	}
+	c.Assert(entries, qt.DeepEquals, []store.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "set-acl",
+		Target:    "read-user",
+		Before:    []string{auth.AdminUsername, "test-1"},
+		After:     []string{"test-2"},
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "modify-acl",
+		Target:    "read-user",
+		Before:    []string{auth.AdminUsername},
+		After:     []string{auth.AdminUsername, "test-1"},
+	}})
+}
+
+func (s *fullServerSuite) TestRequestID(c *qt.C) {
+	resp, err := http.Get(s.srv.URL + "/acl/read-user")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("X-Request-Id"), qt.Matches, "[0-9a-f]{32}")
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/acl/read-user", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("X-Request-Id", "my-request")
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("X-Request-Id"), qt.Equals, "my-request")
+}
+
 func (s *fullServerSuite) TestACLMACARAQResponse(c *qt.C) {
 	resp, err := http.Get(s.srv.URL + "/acl/read-user")
 	c.Assert(err, qt.IsNil)
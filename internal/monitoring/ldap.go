@@ -0,0 +1,90 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ldapOperationDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace: "candid",
+		Subsystem: "ldap",
+		Name:      "operation_duration",
+		Help:      "The duration of an LDAP operation.",
+	}, []string{"idp", "operation"})
+	ldapOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "ldap",
+		Name:      "operation_errors_count",
+		Help:      "Count of LDAP operations that failed.",
+	}, []string{"idp", "operation"})
+	ldapServerFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "ldap",
+		Name:      "server_failures_count",
+		Help:      "Count of failed connections to an LDAP server.",
+	}, []string{"idp", "server"})
+	ldapPoolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "candid",
+		Subsystem: "ldap",
+		Name:      "pool_connections",
+		Help:      "The number of pooled LDAP connections.",
+	}, []string{"idp", "state"})
+	ldapPoolWaitTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "ldap",
+		Name:      "pool_wait_timeouts_count",
+		Help:      "Count of requests that timed out waiting for a pooled LDAP connection.",
+	}, []string{"idp"})
+)
+
+func init() {
+	prometheus.MustRegister(ldapOperationDuration)
+	prometheus.MustRegister(ldapOperationErrors)
+	prometheus.MustRegister(ldapServerFailures)
+	prometheus.MustRegister(ldapPoolConnections)
+	prometheus.MustRegister(ldapPoolWaitTimeouts)
+}
+
+// LDAPMetrics records the metrics for an LDAP identity provider.
+type LDAPMetrics struct {
+	idp string
+}
+
+// NewLDAPMetrics returns the LDAPMetrics for the identity provider with
+// the given name.
+func NewLDAPMetrics(idp string) LDAPMetrics {
+	return LDAPMetrics{idp: idp}
+}
+
+// ObserveOperation records the completion of an operation that started
+// at the given time. If err is not nil then the operation is recorded
+// as having failed.
+func (m LDAPMetrics) ObserveOperation(op string, startTime time.Time, err error) {
+	ldapOperationDuration.WithLabelValues(m.idp, op).Observe(float64(time.Since(startTime)) / float64(time.Second))
+	if err != nil {
+		ldapOperationErrors.WithLabelValues(m.idp, op).Inc()
+	}
+}
+
+// ServerFailed records a failed connection to the given server.
+func (m LDAPMetrics) ServerFailed(server string) {
+	ldapServerFailures.WithLabelValues(m.idp, server).Inc()
+}
+
+// SetPoolConnections records the number of idle and in-use pooled
+// connections.
+func (m LDAPMetrics) SetPoolConnections(idle, inUse int) {
+	ldapPoolConnections.WithLabelValues(m.idp, "idle").Set(float64(idle))
+	ldapPoolConnections.WithLabelValues(m.idp, "in-use").Set(float64(inUse))
+}
+
+// PoolWaitTimedOut records a request that timed out waiting for a
+// pooled connection.
+func (m LDAPMetrics) PoolWaitTimedOut() {
+	ldapPoolWaitTimeouts.WithLabelValues(m.idp).Inc()
+}
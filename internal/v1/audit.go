@@ -0,0 +1,71 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// Audit returns entries from the audit log matching the request.
+func (h *handler) Audit(p httprequest.Params, r *params.AuditRequest) ([]params.AuditEntry, error) {
+	logger.Tracef("Audit %#v", r)
+	if h.params.AuditStore == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "audit log not enabled")
+	}
+	entries, err := h.params.AuditStore.FindAuditEntries(p.Context, store.AuditFilter{
+		Actor:     string(r.Actor),
+		Target:    r.Target,
+		Operation: r.Operation,
+		Since:     r.Since,
+		Until:     r.Until,
+		Limit:     r.Limit,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := make([]params.AuditEntry, len(entries))
+	for i, e := range entries {
+		resp[i] = params.AuditEntry{
+			ID:        e.ID,
+			Time:      e.Time,
+			Actor:     params.Username(e.Actor),
+			Operation: e.Operation,
+			Target:    e.Target,
+			Before:    e.Before,
+			After:     e.After,
+			RequestID: e.RequestID,
+		}
+	}
+	logger.Tracef("Audit response %#v", resp)
+	return resp, nil
+}
+
+// audit records a change made by the current request in the audit
+// log. Failure to record the change is logged, but does not cause the
+// request to fail as the change will already have been made.
+func (h *handler) audit(p httprequest.Params, op, target string, before, after []string) {
+	if h.params.AuditStore == nil {
+		return
+	}
+	var actor string
+	if id := identityFromContext(p.Context); id != nil {
+		actor = id.Id()
+	}
+	err := h.params.AuditStore.AddAuditEntry(p.Context, &store.AuditEntry{
+		Actor:     actor,
+		Operation: op,
+		Target:    target,
+		Before:    before,
+		After:     after,
+		RequestID: identity.RequestID(p.Request),
+	})
+	if err != nil {
+		logger.Errorf("cannot record %s of %s in audit log: %s", op, target, err)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func TestAuditAPI(t *testing.T) {
+	qtsuite.Run(qt.New(t), &auditSuite{})
+}
+
+type auditSuite struct {
+	store       *candidtest.Store
+	srv         *candidtest.Server
+	adminClient *candidclient.Client
+}
+
+func (s *auditSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	s.srv = candidtest.NewServer(c, s.store.ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	s.adminClient = s.srv.AdminIdentityClient(false)
+
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *auditSuite) TestAuditGroupChanges(c *qt.C) {
+	err := s.adminClient.SetUserGroups(s.srv.Ctx, &params.SetUserGroupsRequest{
+		Username: "bob",
+		Groups:   params.Groups{Groups: []string{"g2", "g3"}},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.ModifyUserGroups(s.srv.Ctx, &params.ModifyUserGroupsRequest{
+		Username: "bob",
+		Groups:   params.ModifyGroups{Remove: []string{"g2"}},
+	})
+	c.Assert(err, qt.IsNil)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "modify-groups",
+		Target:    "bob",
+		Before:    []string{"g2", "g3"},
+		After:     []string{"g3"},
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "set-groups",
+		Target:    "bob",
+		Before:    []string{"g1"},
+		After:     []string{"g2", "g3"},
+	}})
+}
+
+func (s *auditSuite) TestAuditSSHKeyChanges(c *qt.C) {
+	err := s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+		Username: "bob",
+		Body:     params.PutSSHKeysBody{SSHKeys: []string{"key1", "key2"}},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.DeleteSSHKeys(s.srv.Ctx, &params.DeleteSSHKeysRequest{
+		Username: "bob",
+		Body:     params.DeleteSSHKeysBody{SSHKeys: []string{"key1"}},
+	})
+	c.Assert(err, qt.IsNil)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "delete-ssh-keys",
+		Target:    "bob",
+		Before:    []string{"key1", "key2"},
+		After:     []string{"key2"},
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "put-ssh-keys",
+		Target:    "bob",
+		After:     []string{"key1", "key2"},
+	}})
+}
+
+func (s *auditSuite) TestAuditExtraInfoChanges(c *qt.C) {
+	err := s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username:  "bob",
+		ExtraInfo: map[string]interface{}{"a": 1, "b": "x"},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "a",
+		Data:     2,
+	})
+	c.Assert(err, qt.IsNil)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "set-extra-info",
+		Target:    "bob",
+		Before:    []string{"a=1"},
+		After:     []string{"a=2"},
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "set-extra-info",
+		Target:    "bob",
+		After:     []string{"a=1", `b="x"`},
+	}})
+}
+
+func (s *auditSuite) TestAuditRemoveUser(c *qt.C) {
+	err := s.adminClient.RemoveUser(s.srv.Ctx, &params.RemoveUserRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "remove-user",
+		Target:    "bob",
+		Before:    []string{"g1"},
+	}})
+}
+
+func (s *auditSuite) TestAuditFailedChangeNotRecorded(c *qt.C) {
+	err := s.adminClient.SetUserGroups(s.srv.Ctx, &params.SetUserGroupsRequest{
+		Username: "alice",
+		Groups:   params.Groups{Groups: []string{"g2"}},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/alice/groups: user alice not found`)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+}
+
+func (s *auditSuite) TestAuditFilter(c *qt.C) {
+	addEntry := func(e store.AuditEntry) {
+		err := s.store.AuditStore.AddAuditEntry(s.srv.Ctx, &e)
+		c.Assert(err, qt.IsNil)
+	}
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	addEntry(store.AuditEntry{Time: t0, Actor: "alice", Operation: "set-groups", Target: "bob"})
+	addEntry(store.AuditEntry{Time: t0.Add(time.Hour), Actor: "alice", Operation: "set-acl", Target: "read-user"})
+	addEntry(store.AuditEntry{Time: t0.Add(2 * time.Hour), Actor: "carol", Operation: "set-groups", Target: "dave"})
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{
+		Actor: "alice",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(auditTargets(entries), qt.DeepEquals, []string{"read-user", "bob"})
+
+	entries, err = s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{
+		Operation: "set-groups",
+		Since:     t0.Add(time.Minute),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(auditTargets(entries), qt.DeepEquals, []string{"dave"})
+
+	entries, err = s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{
+		Until: t0.Add(2 * time.Hour),
+		Limit: 1,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(auditTargets(entries), qt.DeepEquals, []string{"read-user"})
+
+	entries, err = s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{
+		Target: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(auditTargets(entries), qt.DeepEquals, []string{"bob"})
+}
+
+func (s *auditSuite) TestAuditUnauthorized(c *qt.C) {
+	client := s.srv.IdentityClient(c, "alice@candid")
+	_, err := client.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/audit: permission denied`)
+}
+
+// normalizeAuditEntries checks that the given entries have the fields
+// set by the server and then clears them so that the entries can be
+// compared.
+func normalizeAuditEntries(c *qt.C, entries []params.AuditEntry) []params.AuditEntry {
+	for i := range entries {
+		c.Assert(entries[i].ID, qt.Not(qt.Equals), "")
+		c.Assert(entries[i].Time.IsZero(), qt.Equals, false)
+		c.Assert(entries[i].RequestID, qt.Not(qt.Equals), "")
+		entries[i].ID = ""
+		entries[i].Time = time.Time{}
+		entries[i].RequestID = ""
+	}
+	return entries
+}
+
+func auditTargets(entries []params.AuditEntry) []string {
+	targets := make([]string, len(entries))
+	for i, e := range entries {
+		targets[i] = e.Target
+	}
+	return targets
+}
@@ -22,6 +22,11 @@ func opForRequest(r interface{}) bakery.Op {
 			return auth.UserOp(params.Username(r.Owner), auth.ActionRead)
 		}
 		return auth.GlobalOp(auth.ActionRead)
+	case *params.QueryUsersPageRequest:
+		if r.Owner != "" {
+			return auth.UserOp(params.Username(r.Owner), auth.ActionRead)
+		}
+		return auth.GlobalOp(auth.ActionRead)
 	case *params.UserRequest:
 		return auth.UserOp(r.Username, auth.ActionRead)
 	case *params.SetUserRequest:
@@ -31,6 +36,10 @@ func opForRequest(r interface{}) bakery.Op {
 			return auth.UserOp(r.Owner, auth.ActionCreateAgent)
 		}
 		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *params.RemoveUserRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *params.SetUserDisabledRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
 	case *params.CreateAgentRequest:
 		if r.Parent {
 			return auth.GlobalOp(auth.ActionCreateParentAgent)
@@ -38,10 +47,19 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.GlobalOp(auth.ActionCreateAgent)
 	case *params.UserGroupsRequest:
 		return auth.UserOp(r.Username, auth.ActionReadGroups)
+	case *params.UserGroupPathRequest:
+		return auth.UserOp(r.Username, auth.ActionReadGroups)
 	case *params.SetUserGroupsRequest:
 		return auth.UserOp(r.Username, auth.ActionWriteGroups)
 	case *params.ModifyUserGroupsRequest:
-		return auth.UserOp(r.Username, auth.ActionWriteGroups)
+		// Owners of groups are allowed to add and remove members,
+		// so the operation is on the groups being changed rather
+		// than the user.
+		groups := r.Groups.Add
+		if len(groups) == 0 {
+			groups = r.Groups.Remove
+		}
+		return auth.GroupsOp(groups, auth.ActionWriteGroups)
 	case *params.UserIDPGroupsRequest:
 		return auth.UserOp(r.Username, auth.ActionReadGroups)
 	case *params.WhoAmIRequest:
@@ -52,6 +70,12 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.UserOp(r.Username, auth.ActionWriteSSHKeys)
 	case *params.DeleteSSHKeysRequest:
 		return auth.UserOp(r.Username, auth.ActionWriteSSHKeys)
+	case *params.ProviderIDsRequest:
+		return auth.UserOp(r.Username, auth.ActionReadAdmin)
+	case *params.LinkProviderIDRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
+	case *params.UnlinkProviderIDRequest:
+		return auth.UserOp(r.Username, auth.ActionWriteAdmin)
 	case *params.UserTokenRequest:
 		return auth.UserOp(r.Username, auth.ActionReadAdmin)
 	case *params.VerifyTokenRequest:
@@ -70,6 +94,30 @@ func opForRequest(r interface{}) bakery.Op {
 		return auth.UserIDOp(r.UserID, auth.ActionRead)
 	case *params.GetUserGroupsWithIDRequest:
 		return auth.UserIDOp(r.UserID, auth.ActionReadGroups)
+	case *params.AuditRequest:
+		return auth.GlobalOp(auth.ActionReadAdmin)
+	case *params.ChangesRequest:
+		return auth.GlobalOp(auth.ActionRead)
+	case *params.RootKeysRequest:
+		return auth.GlobalOp(auth.ActionReadAdmin)
+	case *params.RotateRootKeyRequest:
+		return auth.GlobalOp(auth.ActionWriteAdmin)
+	case *params.RevokeRootKeyRequest:
+		return auth.GlobalOp(auth.ActionWriteAdmin)
+	case *params.SyncStatusRequest:
+		return auth.GlobalOp(auth.ActionReadAdmin)
+	case *params.SyncRequest:
+		return auth.GlobalOp(auth.ActionWriteAdmin)
+	case *params.GroupsRequest:
+		return auth.GlobalOp(auth.ActionReadGroups)
+	case *params.GroupRequest:
+		return auth.GroupOp(r.Group, auth.ActionRead)
+	case *params.SetGroupRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteAdmin)
+	case *params.RemoveGroupRequest:
+		return auth.GroupOp(r.Group, auth.ActionWriteAdmin)
+	case *params.GroupMembersRequest:
+		return auth.GroupOp(r.Group, auth.ActionRead)
 	default:
 		logger.Infof("unknown API argument type %#v", r)
 	}
@@ -0,0 +1,81 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// defaultChangesWait is the time that a changes request waits
+	// for a change when the request does not specify a time.
+	defaultChangesWait = 30 * time.Second
+
+	// maxChangesWait is the maximum time that a changes request
+	// waits for a change.
+	maxChangesWait = 60 * time.Second
+)
+
+// Changes returns the changes that have been made to users after the
+// sequence number in the request. If there are no such changes then it
+// waits for one to be made, returning an empty set of changes if none
+// are made before the wait time expires. If changes after the sequence
+// number have been removed from the change log then the response is
+// marked as a reset, with no changes.
+func (h *handler) Changes(p httprequest.Params, r *params.ChangesRequest) (*params.ChangesResponse, error) {
+	logger.Tracef("Changes %#v", r)
+	wait := defaultChangesWait
+	if r.Wait > 0 {
+		wait = time.Duration(r.Wait) * time.Second
+		if wait > maxChangesWait {
+			wait = maxChangesWait
+		}
+	}
+	ctx, cancel := context.WithTimeout(p.Context, wait)
+	defer cancel()
+	resp := params.ChangesResponse{
+		Changes: []params.UserChange{},
+		Next:    r.Since,
+	}
+	changes, err := h.params.Store.Watch(ctx, r.Since)
+	if errgo.Cause(err) == context.DeadlineExceeded && p.Context.Err() == nil {
+		return &resp, nil
+	}
+	if rerr, ok := errgo.Cause(err).(*store.ChangesRemovedError); ok {
+		resp.Reset = true
+		resp.Next = rerr.Sequence
+		return &resp, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, c := range changes {
+		resp.Changes = append(resp.Changes, userChange(c))
+		resp.Next = c.Sequence
+	}
+	return &resp, nil
+}
+
+// userChange converts the given store change into the form returned by
+// the API.
+func userChange(c store.IdentityChange) params.UserChange {
+	uc := params.UserChange{
+		Sequence:   c.Sequence,
+		Type:       c.Type.String(),
+		Time:       c.Time,
+		Username:   params.Username(c.Username),
+		ExternalID: string(c.ProviderID),
+	}
+	for _, f := range c.Fields {
+		uc.Fields = append(uc.Fields, f.String())
+	}
+	return uc
+}
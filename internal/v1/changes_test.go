@@ -0,0 +1,214 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func TestChangesAPI(t *testing.T) {
+	qtsuite.Run(qt.New(t), &changesSuite{})
+}
+
+type changesSuite struct {
+	store       *candidtest.Store
+	srv         *candidtest.Server
+	adminClient *candidclient.Client
+}
+
+func (s *changesSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	s.srv = candidtest.NewServer(c, s.store.ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	s.adminClient = s.srv.AdminIdentityClient(false)
+}
+
+func (s *changesSuite) TestChanges(c *qt.C) {
+	resp, err := s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{Wait: 1})
+	c.Assert(err, qt.IsNil)
+	since := resp.Next
+
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.SetUserGroups(s.srv.Ctx, &params.SetUserGroupsRequest{
+		Username: "bob",
+		Groups:   params.Groups{Groups: []string{"g1"}},
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp, err = s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{
+		Since: since,
+		Wait:  1,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Changes, qt.HasLen, 2)
+	for i := range resp.Changes {
+		c.Assert(resp.Changes[i].Time.IsZero(), qt.Equals, false)
+		resp.Changes[i].Time = time.Time{}
+	}
+	c.Assert(resp, qt.DeepEquals, &params.ChangesResponse{
+		Changes: []params.UserChange{{
+			Sequence:   since + 1,
+			Type:       "created",
+			Username:   "bob",
+			ExternalID: "test:bob",
+			Fields:     []string{"username"},
+		}, {
+			Sequence:   since + 2,
+			Type:       "updated",
+			Username:   "bob",
+			ExternalID: "test:bob",
+			Fields:     []string{"groups"},
+		}},
+		Next: since + 2,
+	})
+}
+
+func (s *changesSuite) TestChangesWaitExpires(c *qt.C) {
+	resp, err := s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{Wait: 1})
+	c.Assert(err, qt.IsNil)
+	since := resp.Next
+
+	resp, err = s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{
+		Since: since,
+		Wait:  1,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, &params.ChangesResponse{
+		Changes: []params.UserChange{},
+		Next:    since,
+	})
+}
+
+func (s *changesSuite) TestChangesWaitsForChange(c *qt.C) {
+	resp, err := s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{Wait: 1})
+	c.Assert(err, qt.IsNil)
+	since := resp.Next
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+			Username:   "bob",
+			ProviderID: store.MakeProviderIdentity("test", "bob"),
+		}, store.Update{
+			store.Username: store.Set,
+		})
+	}()
+	resp, err = s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{
+		Since: since,
+		Wait:  10,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Changes, qt.HasLen, 1)
+	c.Assert(resp.Changes[0].Username, qt.Equals, params.Username("bob"))
+	c.Assert(resp.Next, qt.Equals, since+1)
+}
+
+func (s *changesSuite) TestChangesUnauthorized(c *qt.C) {
+	client := s.srv.IdentityClient(c, "alice@candid")
+	_, err := client.Changes(s.srv.Ctx, &params.ChangesRequest{})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/changes: permission denied`)
+}
+
+func (s *changesSuite) TestChangesRemoved(c *qt.C) {
+	resp, err := s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{Wait: 1})
+	c.Assert(err, qt.IsNil)
+	since := resp.Next
+
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = s.store.Store.RemoveChanges(s.srv.Ctx, time.Now().Add(time.Second))
+	c.Assert(err, qt.IsNil)
+
+	resp, err = s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{
+		Since: since,
+		Wait:  1,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, &params.ChangesResponse{
+		Changes: []params.UserChange{},
+		Next:    since + 1,
+		Reset:   true,
+	})
+
+	// Continuing from the returned sequence number waits for new
+	// changes.
+	resp, err = s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{
+		Since: resp.Next,
+		Wait:  1,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, &params.ChangesResponse{
+		Changes: []params.UserChange{},
+		Next:    since + 1,
+	})
+}
+
+func (s *changesSuite) TestGroupCacheWatchChangesRemoved(c *qt.C) {
+	resp, err := s.adminClient.Changes(s.srv.Ctx, &params.ChangesRequest{Wait: 1})
+	c.Assert(err, qt.IsNil)
+	since := resp.Next
+
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	cache := candidclient.NewGroupCache(s.adminClient, time.Hour)
+	groups, err := cache.Groups("bob")
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+
+	// Change the groups and remove the change from the log before
+	// the cache has seen it.
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"g2"},
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = s.store.Store.RemoveChanges(s.srv.Ctx, time.Now().Add(time.Second))
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(s.srv.Ctx, 500*time.Millisecond)
+	defer cancel()
+	next, err := cache.WatchChanges(ctx, since)
+	c.Assert(errgo.Cause(err), qt.Equals, context.DeadlineExceeded)
+	c.Assert(next, qt.Equals, since+2)
+
+	groups, err = cache.Groups("bob")
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g2"})
+}
@@ -6,3 +6,9 @@ package v1
 var (
 	GravatarHash = gravatarHash
 )
+
+const (
+	DefaultQueryUsersPageLimit = defaultQueryUsersPageLimit
+	MaxQueryUsersPageLimit     = maxQueryUsersPageLimit
+	DefaultGroupMembersLimit   = defaultGroupMembersLimit
+)
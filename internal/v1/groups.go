@@ -0,0 +1,285 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"context"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// identityPageSize holds the number of identities read from the store
+// at a time when all identities need to be examined.
+const identityPageSize = 100
+
+const (
+	// defaultGroupMembersLimit holds the number of identities examined
+	// by a group members request that does not specify a limit.
+	defaultGroupMembersLimit = 100
+
+	// maxGroupMembersLimit holds the maximum number of identities that
+	// can be examined by a single group members request.
+	maxGroupMembersLimit = 1000
+)
+
+// Groups returns all the groups that are stored, are subgroups of a
+// stored group, or are held in the stored groups of any identity.
+func (h *handler) Groups(p httprequest.Params, r *params.GroupsRequest) ([]params.Group, error) {
+	logger.Tracef("Groups %#v", r)
+	groups := make(map[string]params.Group)
+	if h.params.GroupStore != nil {
+		stored, err := h.params.GroupStore.Groups(p.Context)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, g := range stored {
+			groups[g.Name] = groupParams(g)
+		}
+		for _, g := range stored {
+			for _, sg := range g.Subgroups {
+				if _, ok := groups[sg]; !ok {
+					groups[sg] = params.Group{Name: sg}
+				}
+			}
+		}
+	}
+	err := h.forEachIdentity(p.Context, func(id *store.Identity) error {
+		for _, g := range id.Groups {
+			if _, ok := groups[g]; !ok {
+				groups[g] = params.Group{Name: g}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := make([]params.Group, 0, len(groups))
+	for _, g := range groups {
+		resp = append(resp, g)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].Name < resp[j].Name
+	})
+	return resp, nil
+}
+
+// Group returns the information about the requested group.
+func (h *handler) Group(p httprequest.Params, r *params.GroupRequest) (*params.Group, error) {
+	logger.Tracef("Group %#v", r)
+	if h.params.GroupStore == nil {
+		return &params.Group{Name: r.Group}, nil
+	}
+	g := store.Group{Name: r.Group}
+	if err := h.params.GroupStore.Group(p.Context, &g); err != nil {
+		if errgo.Cause(err) != store.ErrNotFound {
+			return nil, errgo.Mask(err)
+		}
+		// Groups do not need to be stored to have members.
+		return &params.Group{Name: r.Group}, nil
+	}
+	resp := groupParams(g)
+	return &resp, nil
+}
+
+// SetGroup stores the information about the requested group.
+func (h *handler) SetGroup(p httprequest.Params, r *params.SetGroupRequest) error {
+	logger.Tracef("SetGroup %#v", r)
+	gs, err := h.groupStore()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if r.Group == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "group name not specified")
+	}
+	before := store.Group{Name: r.Group}
+	if err := gs.Group(p.Context, &before); err != nil && errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	g := store.Group{
+		Name:        r.Group,
+		Description: r.Body.Description,
+		Owners:      r.Body.Owners,
+		Subgroups:   r.Body.Subgroups,
+	}
+	if err := checkGroupCycle(p.Context, gs, &g); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := gs.SetGroup(p.Context, &g); err != nil {
+		return errgo.Mask(err)
+	}
+	h.params.Authorizer.InvalidateGroups()
+	h.audit(p, "set-group", g.Name, before.Owners, g.Owners)
+	return nil
+}
+
+// RemoveGroup removes the stored information about the requested group.
+func (h *handler) RemoveGroup(p httprequest.Params, r *params.RemoveGroupRequest) error {
+	logger.Tracef("RemoveGroup %#v", r)
+	gs, err := h.groupStore()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	before := store.Group{Name: r.Group}
+	if err := gs.Group(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
+	if err := gs.RemoveGroup(p.Context, r.Group); err != nil {
+		return translateStoreError(err)
+	}
+	h.params.Authorizer.InvalidateGroups()
+	h.audit(p, "remove-group", r.Group, before.Owners, nil)
+	return nil
+}
+
+// GroupMembers returns the members of the requested group. As the groups
+// provided by identity providers can only be determined for each
+// identity, the identities are examined a page at a time. Identities
+// whose groups cannot be determined are returned as unresolved.
+func (h *handler) GroupMembers(p httprequest.Params, r *params.GroupMembersRequest) (*params.GroupMembersResponse, error) {
+	logger.Tracef("GroupMembers %#v", r)
+	limit := r.Limit
+	switch {
+	case limit < 0:
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid limit %d", r.Limit)
+	case limit == 0:
+		limit = defaultGroupMembersLimit
+	case limit > maxGroupMembersLimit:
+		limit = maxGroupMembersLimit
+	}
+	identities, next, err := h.params.Store.FindIdentitiesPage(p.Context, &store.Identity{}, store.Filter{}, r.Next, limit)
+	if errgo.Cause(err) == store.ErrInvalidCursor {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid next value %q", r.Next)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Identities are returned in username order, so the members
+	// are too.
+	resp := params.GroupMembersResponse{
+		Members: []params.GroupMember{},
+		Next:    next,
+	}
+	for i := range identities {
+		identity := &identities[i]
+		ok, err := h.isGroupMember(p.Context, identity, r.Group)
+		if err != nil {
+			logger.Errorf("cannot determine groups of %q: %s", identity.Username, err)
+			resp.Unresolved = append(resp.Unresolved, params.Username(identity.Username))
+			continue
+		}
+		if ok {
+			resp.Members = append(resp.Members, params.GroupMember{
+				Username: params.Username(identity.Username),
+				Stored:   containsString(identity.Groups, r.Group),
+			})
+		}
+	}
+	return &resp, nil
+}
+
+// isGroupMember reports whether the given identity is a member of the
+// given group.
+func (h *handler) isGroupMember(ctx context.Context, identity *store.Identity, group string) (bool, error) {
+	id, err := h.params.Authorizer.Identity(ctx, identity)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	groups, err := id.ResolvedGroups(ctx)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return containsString(groups, group), nil
+}
+
+// checkGroupCycle checks that storing the given group would not make
+// the group a subgroup of itself. If it would, an error with a cause of
+// params.ErrBadRequest is returned.
+func checkGroupCycle(ctx context.Context, gs store.GroupStore, group *store.Group) error {
+	stored, err := gs.Groups(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	subgroups := make(map[string][]string)
+	for _, g := range stored {
+		subgroups[g.Name] = g.Subgroups
+	}
+	subgroups[group.Name] = group.Subgroups
+	visited := make(map[string]bool)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		if name == group.Name {
+			return true
+		}
+		if visited[name] {
+			return false
+		}
+		visited[name] = true
+		for _, sg := range subgroups[name] {
+			if visit(sg) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, sg := range group.Subgroups {
+		if visit(sg) {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "group %q cannot be a subgroup of itself", group.Name)
+		}
+	}
+	return nil
+}
+
+// forEachIdentity calls f with every identity in the store. If f
+// returns an error then forEachIdentity stops and returns that error.
+func (h *handler) forEachIdentity(ctx context.Context, f func(*store.Identity) error) error {
+	cursor := ""
+	for {
+		identities, next, err := h.params.Store.FindIdentitiesPage(ctx, &store.Identity{}, store.Filter{}, cursor, identityPageSize)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for i := range identities {
+			if err := f(&identities[i]); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// groupStore returns the store of group information, or an error with
+// a cause of params.ErrNotFound if there is none.
+func (h *handler) groupStore() (store.GroupStore, error) {
+	if h.params.GroupStore == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "group management not enabled")
+	}
+	return h.params.GroupStore, nil
+}
+
+func groupParams(g store.Group) params.Group {
+	return params.Group{
+		Name:        g.Name,
+		Description: g.Description,
+		Owners:      g.Owners,
+		Subgroups:   g.Subgroups,
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,495 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func TestGroupsAPI(t *testing.T) {
+	qtsuite.Run(qt.New(t), &groupsSuite{})
+}
+
+type groupsSuite struct {
+	store       *candidtest.Store
+	srv         *candidtest.Server
+	adminClient *candidclient.Client
+}
+
+func (s *groupsSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	sp := s.store.ServerParams()
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{
+			Name: "test",
+			Users: map[string]static.UserInfo{
+				"bob": {
+					Password: "bobpassword",
+					Groups:   []string{"g1", "idpgroup"},
+				},
+			},
+		}),
+		groupsErrorIDP{static.NewIdentityProvider(static.Params{
+			Name: "broken",
+		})},
+	}
+	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	s.adminClient = s.srv.AdminIdentityClient(false)
+
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Groups:     []string{"g2"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *groupsSuite) TestSetGroup(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "g1",
+		Body: params.SetGroupBody{
+			Description: "group one",
+			Owners:      []string{"alice"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	g, err := s.adminClient.Group(s.srv.Ctx, &params.GroupRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(g, qt.DeepEquals, &params.Group{
+		Name:        "g1",
+		Description: "group one",
+		Owners:      []string{"alice"},
+	})
+
+	err = s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "g1",
+		Body: params.SetGroupBody{
+			Owners: []string{"alice", "bob"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "set-group",
+		Target:    "g1",
+		Before:    []string{"alice"},
+		After:     []string{"alice", "bob"},
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "set-group",
+		Target:    "g1",
+		After:     []string{"alice"},
+	}})
+}
+
+func (s *groupsSuite) TestGroupNotStored(c *qt.C) {
+	g, err := s.adminClient.Group(s.srv.Ctx, &params.GroupRequest{
+		Group: "g2",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(g, qt.DeepEquals, &params.Group{Name: "g2"})
+}
+
+func (s *groupsSuite) TestGroups(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "g3",
+		Body: params.SetGroupBody{
+			Description: "group three",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	groups, err := s.adminClient.Groups(s.srv.Ctx, &params.GroupsRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Check(groups, qt.DeepEquals, []params.Group{{
+		Name: "g2",
+	}, {
+		Name:        "g3",
+		Description: "group three",
+	}})
+}
+
+func (s *groupsSuite) TestRemoveGroup(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "g1",
+		Body: params.SetGroupBody{
+			Owners: []string{"alice"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.RemoveGroup(s.srv.Ctx, &params.RemoveGroupRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+
+	g, err := s.adminClient.Group(s.srv.Ctx, &params.GroupRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(g, qt.DeepEquals, &params.Group{Name: "g1"})
+
+	err = s.adminClient.RemoveGroup(s.srv.Ctx, &params.RemoveGroupRequest{
+		Group: "g1",
+	})
+	c.Check(err, qt.ErrorMatches, `Delete .*/v1/g/g1: group g1 not found`)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "remove-group",
+		Target:    "g1",
+		Before:    []string{"alice"},
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "set-group",
+		Target:    "g1",
+		After:     []string{"alice"},
+	}})
+}
+
+func (s *groupsSuite) TestGroupMembers(c *qt.C) {
+	s.srv.CreateUser(c, "alice", "g1")
+
+	resp, err := s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp, qt.DeepEquals, &params.GroupMembersResponse{
+		Members: []params.GroupMember{{
+			Username: "alice",
+			Stored:   true,
+		}, {
+			Username: "bob",
+		}},
+	})
+
+	resp, err = s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g2",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp.Members, qt.DeepEquals, []params.GroupMember{{
+		Username: "bob",
+		Stored:   true,
+	}})
+
+	resp, err = s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "nobody",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp.Members, qt.HasLen, 0)
+}
+
+func (s *groupsSuite) TestGroupMembersPaged(c *qt.C) {
+	for _, u := range []string{"alice", "carol", "dave"} {
+		s.srv.CreateUser(c, u, "g1")
+	}
+
+	var members []params.GroupMember
+	req := params.GroupMembersRequest{
+		Group: "g1",
+		Limit: 2,
+	}
+	pages := 0
+	for {
+		resp, err := s.adminClient.GroupMembers(s.srv.Ctx, &req)
+		c.Assert(err, qt.IsNil)
+		c.Assert(len(resp.Members) <= 2, qt.Equals, true)
+		members = append(members, resp.Members...)
+		pages++
+		if resp.Next == "" {
+			break
+		}
+		req.Next = resp.Next
+	}
+	c.Check(pages > 1, qt.Equals, true)
+	c.Check(members, qt.DeepEquals, []params.GroupMember{{
+		Username: "alice",
+		Stored:   true,
+	}, {
+		Username: "bob",
+	}, {
+		Username: "carol",
+		Stored:   true,
+	}, {
+		Username: "dave",
+		Stored:   true,
+	}})
+}
+
+func (s *groupsSuite) TestGroupMembersDefaultLimit(c *qt.C) {
+	// Together with bob and the admin user this makes more users
+	// than are examined by a request without a limit.
+	for i := 0; i < v1.DefaultGroupMembersLimit; i++ {
+		s.srv.CreateUser(c, fmt.Sprintf("user%04d", i), "g1")
+	}
+	resp, err := s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(len(resp.Members) < v1.DefaultGroupMembersLimit, qt.Equals, true)
+	c.Check(resp.Next, qt.Not(qt.Equals), "")
+}
+
+func (s *groupsSuite) TestGroupMembersUnresolved(c *qt.C) {
+	s.srv.CreateUser(c, "alice", "g1")
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "eve",
+		ProviderID: store.MakeProviderIdentity("broken", "eve"),
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp, err := s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp, qt.DeepEquals, &params.GroupMembersResponse{
+		Members: []params.GroupMember{{
+			Username: "alice",
+			Stored:   true,
+		}, {
+			Username: "bob",
+		}},
+		Unresolved: []params.Username{"eve"},
+	})
+}
+
+func (s *groupsSuite) TestGroupMembersInvalidRequest(c *qt.C) {
+	_, err := s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g1",
+		Limit: -1,
+	})
+	c.Check(err, qt.ErrorMatches, `Get .*/v1/g/g1/members.*: invalid limit -1`)
+
+	_, err = s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g1",
+		Next:  "not a cursor",
+	})
+	c.Check(err, qt.ErrorMatches, `Get .*/v1/g/g1/members.*: invalid next value "not a cursor"`)
+}
+
+func (s *groupsSuite) TestOwnerModifiesGroup(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "g3",
+		Body: params.SetGroupBody{
+			Owners: []string{"owner@candid"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	client := s.srv.IdentityClient(c, "owner@candid")
+
+	err = client.ModifyUserGroups(s.srv.Ctx, &params.ModifyUserGroupsRequest{
+		Username: "bob",
+		Groups:   params.ModifyGroups{Add: []string{"g3"}},
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp, err := client.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g3",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp.Members, qt.DeepEquals, []params.GroupMember{{
+		Username: "bob",
+		Stored:   true,
+	}})
+
+	err = client.ModifyUserGroups(s.srv.Ctx, &params.ModifyUserGroupsRequest{
+		Username: "bob",
+		Groups:   params.ModifyGroups{Remove: []string{"g3"}},
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The owner cannot modify membership of groups it does not own.
+	err = client.ModifyUserGroups(s.srv.Ctx, &params.ModifyUserGroupsRequest{
+		Username: "bob",
+		Groups:   params.ModifyGroups{Add: []string{"g3", "g4"}},
+	})
+	c.Check(err, qt.ErrorMatches, `Post .*/v1/u/bob/groups: permission denied`)
+
+	// The owner cannot change the group information.
+	err = client.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "g3",
+		Body: params.SetGroupBody{
+			Owners: []string{"owner@candid", "other@candid"},
+		},
+	})
+	c.Check(err, qt.ErrorMatches, `Put .*/v1/g/g3: permission denied`)
+}
+
+func (s *groupsSuite) TestUnauthorized(c *qt.C) {
+	client := s.srv.IdentityClient(c, "someone@candid")
+
+	_, err := client.Groups(s.srv.Ctx, &params.GroupsRequest{})
+	c.Check(err, qt.ErrorMatches, `Get .*/v1/g: permission denied`)
+	_, err = client.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "g1",
+	})
+	c.Check(err, qt.ErrorMatches, `Get .*/v1/g/g1/members: permission denied`)
+}
+
+func (s *groupsSuite) TestSubgroups(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "engineering",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"g2", "team-b"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "staff",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"engineering"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(groups, qt.DeepEquals, []string{"engineering", "g1", "g2", "idpgroup", "staff"})
+
+	resp, err := s.adminClient.GroupMembers(s.srv.Ctx, &params.GroupMembersRequest{
+		Group: "staff",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp.Members, qt.DeepEquals, []params.GroupMember{{
+		Username: "bob",
+	}})
+
+	all, err := s.adminClient.Groups(s.srv.Ctx, &params.GroupsRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Check(all, qt.DeepEquals, []params.Group{{
+		Name:      "engineering",
+		Subgroups: []string{"g2", "team-b"},
+	}, {
+		Name: "g2",
+	}, {
+		Name:      "staff",
+		Subgroups: []string{"engineering"},
+	}, {
+		Name: "team-b",
+	}})
+}
+
+func (s *groupsSuite) TestSubgroupCycle(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "engineering",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"team-a"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "team-a",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"team-a1", "engineering"},
+		},
+	})
+	c.Check(err, qt.ErrorMatches, `Put .*/v1/g/team-a: group "team-a" cannot be a subgroup of itself`)
+	c.Check(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "team-a",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"team-a"},
+		},
+	})
+	c.Check(err, qt.ErrorMatches, `Put .*/v1/g/team-a: group "team-a" cannot be a subgroup of itself`)
+}
+
+func (s *groupsSuite) TestUserGroupPath(c *qt.C) {
+	err := s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "engineering",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"idpgroup"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.adminClient.SetGroup(s.srv.Ctx, &params.SetGroupRequest{
+		Group: "staff",
+		Body: params.SetGroupBody{
+			Subgroups: []string{"engineering"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp, err := s.adminClient.UserGroupPath(s.srv.Ctx, &params.UserGroupPathRequest{
+		Username: "bob",
+		Group:    "staff",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp, qt.DeepEquals, &params.GroupPath{
+		Member: true,
+		Path:   []string{"idpgroup", "engineering", "staff"},
+	})
+
+	resp, err = s.adminClient.UserGroupPath(s.srv.Ctx, &params.UserGroupPathRequest{
+		Username: "bob",
+		Group:    "sales",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp, qt.DeepEquals, &params.GroupPath{})
+
+	// Users can find how they are members of groups.
+	client := s.srv.IdentityClient(c, "someone@candid", "g1")
+	resp, err = client.UserGroupPath(s.srv.Ctx, &params.UserGroupPathRequest{
+		Username: "someone@candid",
+		Group:    "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Check(resp, qt.DeepEquals, &params.GroupPath{
+		Member: true,
+		Path:   []string{"g1"},
+	})
+	_, err = client.UserGroupPath(s.srv.Ctx, &params.UserGroupPathRequest{
+		Username: "bob",
+		Group:    "g1",
+	})
+	c.Check(err, qt.ErrorMatches, `Get .*/v1/u/bob/groups/g1: permission denied`)
+}
+
+// groupsErrorIDP is an identity provider that cannot determine the
+// groups of any identity.
+type groupsErrorIDP struct {
+	idp.IdentityProvider
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups.
+func (groupsErrorIDP) GetGroups(context.Context, *store.Identity) ([]string, error) {
+	return nil, errgo.New("groups not available")
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// RootKeys returns information about the unexpired macaroon root keys
+// held by the server, oldest first.
+func (h *handler) RootKeys(p httprequest.Params, r *params.RootKeysRequest) ([]params.RootKey, error) {
+	logger.Tracef("RootKeys %#v", r)
+	rks, err := h.rootKeyStore()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	keys, err := rks.RootKeys(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	now := time.Now()
+	var current []byte
+	for _, k := range keys {
+		// The current key is the most recently created key that
+		// conforms to the policy, which will be the last one found.
+		if h.params.RootKeyPolicy.IsCurrent(k, now) {
+			current = k.ID
+		}
+	}
+	resp := make([]params.RootKey, len(keys))
+	for i, k := range keys {
+		resp[i] = rootKeyParams(k)
+		resp[i].Current = current != nil && string(k.ID) == string(current)
+	}
+	return resp, nil
+}
+
+// RotateRootKey generates a new macaroon root key that will be used for
+// all subsequently created macaroons.
+func (h *handler) RotateRootKey(p httprequest.Params, r *params.RotateRootKeyRequest) (*params.RootKey, error) {
+	logger.Tracef("RotateRootKey %#v", r)
+	rks, err := h.rootKeyStore()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	key, err := store.RotateRootKey(p.Context, rks, h.params.RootKeyPolicy)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	h.audit(p, "rotate-root-key", string(key.ID), nil, nil)
+	resp := rootKeyParams(key)
+	resp.Current = true
+	return &resp, nil
+}
+
+// RevokeRootKey removes a macaroon root key, invalidating all macaroons
+// created with it.
+func (h *handler) RevokeRootKey(p httprequest.Params, r *params.RevokeRootKeyRequest) error {
+	logger.Tracef("RevokeRootKey %#v", r)
+	rks, err := h.rootKeyStore()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := rks.RemoveRootKey(p.Context, []byte(r.ID)); err != nil {
+		return translateStoreError(err)
+	}
+	h.audit(p, "revoke-root-key", r.ID, nil, nil)
+	return nil
+}
+
+// rootKeyStore returns the store of root keys that can be administered,
+// or an error with a cause of params.ErrNotFound if there is none.
+func (h *handler) rootKeyStore() (store.RootKeyStore, error) {
+	if h.params.RootKeys == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "root key management not enabled")
+	}
+	return h.params.RootKeys, nil
+}
+
+func rootKeyParams(k store.RootKey) params.RootKey {
+	return params.RootKey{
+		ID:      string(k.ID),
+		Created: k.Created,
+		Expires: k.Expires,
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+)
+
+func TestRootKeysAPI(t *testing.T) {
+	qtsuite.Run(qt.New(t), &rootKeysSuite{})
+}
+
+type rootKeysSuite struct {
+	store       *candidtest.Store
+	srv         *candidtest.Server
+	adminClient *candidclient.Client
+}
+
+func (s *rootKeysSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	s.srv = candidtest.NewServer(c, s.store.ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	s.adminClient = s.srv.AdminIdentityClient(false)
+}
+
+func (s *rootKeysSuite) TestRootKeys(c *qt.C) {
+	// Logging in as the admin creates the first root key.
+	keys, err := s.adminClient.RootKeys(s.srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 1)
+	c.Check(keys[0].Current, qt.Equals, true)
+	c.Check(keys[0].Expires.After(keys[0].Created), qt.Equals, true)
+
+	stored, err := s.store.RootKeys.RootKeys(s.srv.Ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored, qt.HasLen, 1)
+	c.Check(keys[0].ID, qt.Equals, string(stored[0].ID))
+}
+
+func (s *rootKeysSuite) TestRotateRootKey(c *qt.C) {
+	keys, err := s.adminClient.RootKeys(s.srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 1)
+
+	// Make sure the new key is created later than the old one.
+	time.Sleep(10 * time.Millisecond)
+	key, err := s.adminClient.RotateRootKey(s.srv.Ctx, &params.RotateRootKeyRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Check(key.Current, qt.Equals, true)
+	c.Check(key.ID, qt.Not(qt.Equals), keys[0].ID)
+
+	// The existing client's macaroon, created with the old key,
+	// remains valid.
+	keys2, err := s.adminClient.RootKeys(s.srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys2, qt.HasLen, 2)
+	c.Check(keys2[0].ID, qt.Equals, keys[0].ID)
+	c.Check(keys2[0].Current, qt.Equals, false)
+	c.Check(keys2[1].ID, qt.Equals, key.ID)
+	c.Check(keys2[1].Current, qt.Equals, true)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "rotate-root-key",
+		Target:    key.ID,
+	}})
+}
+
+func (s *rootKeysSuite) TestRevokeRootKey(c *qt.C) {
+	userClient := s.srv.IdentityClient(c, "bob@candid", "g1")
+	_, err := userClient.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+
+	keys, err := s.adminClient.RootKeys(s.srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 1)
+
+	err = s.adminClient.RevokeRootKey(s.srv.Ctx, &params.RevokeRootKeyRequest{
+		ID: keys[0].ID,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The macaroon held by the user's client is no longer valid, so
+	// the client must obtain a new one.
+	resp, err := userClient.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Check(resp.User, qt.Equals, "bob@candid")
+
+	keys2, err := s.adminClient.RootKeys(s.srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys2, qt.HasLen, 1)
+	c.Check(keys2[0].ID, qt.Not(qt.Equals), keys[0].ID)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "revoke-root-key",
+		Target:    keys[0].ID,
+	}})
+}
+
+func (s *rootKeysSuite) TestRevokeRootKeyNotFound(c *qt.C) {
+	err := s.adminClient.RevokeRootKey(s.srv.Ctx, &params.RevokeRootKeyRequest{
+		ID: "no-such-key",
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/root-keys/no-such-key: root key "no-such-key" not found`)
+}
+
+func (s *rootKeysSuite) TestRootKeysUnauthorized(c *qt.C) {
+	client := s.srv.IdentityClient(c, "bob@candid", "g1")
+	_, err := client.RootKeys(s.srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/root-keys: permission denied`)
+	_, err = client.RotateRootKey(s.srv.Ctx, &params.RotateRootKeyRequest{})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/root-keys/rotate: permission denied`)
+}
+
+func TestRootKeysNotEnabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.RootKeys = nil
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	_, err := srv.AdminIdentityClient(false).RootKeys(srv.Ctx, &params.RootKeysRequest{})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/root-keys: root key management not enabled`)
+}
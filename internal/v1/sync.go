@@ -0,0 +1,67 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/params"
+)
+
+// SyncStatus returns the result of the most recent sync of each
+// identity provider that synchronises identities with an external
+// directory.
+func (h *handler) SyncStatus(p httprequest.Params, r *params.SyncStatusRequest) ([]params.SyncResult, error) {
+	logger.Tracef("SyncStatus %#v", r)
+	syncers, err := h.syncers(r.IDP)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	results := []params.SyncResult{}
+	for _, s := range syncers {
+		if res := s.LastSync(); res != nil {
+			results = append(results, *res)
+		}
+	}
+	return results, nil
+}
+
+// Sync synchronises identities with external directories immediately.
+func (h *handler) Sync(p httprequest.Params, r *params.SyncRequest) ([]params.SyncResult, error) {
+	logger.Tracef("Sync %#v", r)
+	syncers, err := h.syncers(r.IDP)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	results := make([]params.SyncResult, len(syncers))
+	for i, s := range syncers {
+		results[i] = *s.Sync(p.Context, r.DryRun)
+		if !r.DryRun {
+			h.audit(p, "sync", s.Name(), nil, nil)
+		}
+	}
+	return results, nil
+}
+
+// syncers returns the identity providers that can synchronise
+// identities. If name is not empty then only the identity provider with
+// that name is returned, and an error with a cause of
+// params.ErrNotFound is returned if there is no such identity provider
+// that can synchronise identities.
+func (h *handler) syncers(name string) ([]idp.Syncer, error) {
+	var syncers []idp.Syncer
+	for _, ip := range h.params.IdentityProviders {
+		s, ok := ip.(idp.Syncer)
+		if !ok || name != "" && ip.Name() != name {
+			continue
+		}
+		syncers = append(syncers, s)
+	}
+	if name != "" && len(syncers) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "identity provider %q not found or does not support sync", name)
+	}
+	return syncers, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+)
+
+func TestSyncAPI(t *testing.T) {
+	qtsuite.Run(qt.New(t), &syncSuite{})
+}
+
+type syncSuite struct {
+	store       *candidtest.Store
+	srv         *candidtest.Server
+	adminClient *candidclient.Client
+	syncers     []*testSyncer
+}
+
+func (s *syncSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	sp := s.store.ServerParams()
+	s.syncers = []*testSyncer{
+		newTestSyncer("sync1"),
+		newTestSyncer("sync2"),
+	}
+	sp.IdentityProviders = []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{Name: "test"}),
+		s.syncers[0],
+		s.syncers[1],
+	}
+	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	s.adminClient = s.srv.AdminIdentityClient(false)
+}
+
+func (s *syncSuite) TestSync(c *qt.C) {
+	results, err := s.adminClient.SyncStatus(s.srv.Ctx, &params.SyncStatusRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(results, qt.HasLen, 0)
+
+	results, err = s.adminClient.Sync(s.srv.Ctx, &params.SyncRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(results, qt.HasLen, 2)
+	c.Check(results[0].IDP, qt.Equals, "sync1")
+	c.Check(results[0].Created, qt.DeepEquals, []string{"alice"})
+	c.Check(results[1].IDP, qt.Equals, "sync2")
+
+	results, err = s.adminClient.SyncStatus(s.srv.Ctx, &params.SyncStatusRequest{
+		IDP: "sync2",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(results, qt.HasLen, 1)
+	c.Check(results[0].IDP, qt.Equals, "sync2")
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(normalizeAuditEntries(c, entries), qt.DeepEquals, []params.AuditEntry{{
+		Actor:     auth.AdminUsername,
+		Operation: "sync",
+		Target:    "sync2",
+	}, {
+		Actor:     auth.AdminUsername,
+		Operation: "sync",
+		Target:    "sync1",
+	}})
+}
+
+func (s *syncSuite) TestSyncOneDryRun(c *qt.C) {
+	results, err := s.adminClient.Sync(s.srv.Ctx, &params.SyncRequest{
+		IDP:    "sync1",
+		DryRun: true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(results, qt.HasLen, 1)
+	c.Check(results[0].IDP, qt.Equals, "sync1")
+	c.Check(results[0].DryRun, qt.Equals, true)
+	c.Check(s.syncers[1].LastSync(), qt.IsNil)
+
+	entries, err := s.adminClient.Audit(s.srv.Ctx, &params.AuditRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+}
+
+func (s *syncSuite) TestSyncNotFound(c *qt.C) {
+	_, err := s.adminClient.Sync(s.srv.Ctx, &params.SyncRequest{
+		IDP: "test",
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/sync\?idp=test: identity provider "test" not found or does not support sync`)
+	_, err = s.adminClient.SyncStatus(s.srv.Ctx, &params.SyncStatusRequest{
+		IDP: "no-such-idp",
+	})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/sync\?idp=no-such-idp: identity provider "no-such-idp" not found or does not support sync`)
+}
+
+func (s *syncSuite) TestSyncUnauthorized(c *qt.C) {
+	client := s.srv.IdentityClient(c, "bob@candid", "g1")
+	_, err := client.SyncStatus(s.srv.Ctx, &params.SyncStatusRequest{})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/sync: permission denied`)
+	_, err = client.Sync(s.srv.Ctx, &params.SyncRequest{})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/sync: permission denied`)
+	c.Check(s.syncers[0].LastSync(), qt.IsNil)
+}
+
+// testSyncer is an identity provider that reports a sync that
+// created a single identity.
+type testSyncer struct {
+	idp.IdentityProvider
+	lastSync *params.SyncResult
+}
+
+func newTestSyncer(name string) *testSyncer {
+	return &testSyncer{
+		IdentityProvider: static.NewIdentityProvider(static.Params{Name: name}),
+	}
+}
+
+func (s *testSyncer) Sync(_ context.Context, dryRun bool) *params.SyncResult {
+	s.lastSync = &params.SyncResult{
+		IDP:     s.Name(),
+		DryRun:  dryRun,
+		Created: []string{"alice"},
+	}
+	return s.lastSync
+}
+
+func (s *testSyncer) LastSync() *params.SyncResult {
+	return s.lastSync
+}
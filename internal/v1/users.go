@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
@@ -32,10 +34,96 @@ var blacklistUsernames = map[params.Username]bool{
 	auth.AdminUsername: true,
 }
 
+const (
+	// defaultQueryUsersPageLimit holds the number of users returned
+	// by a paged query that does not specify a limit.
+	defaultQueryUsersPageLimit = 100
+
+	// maxQueryUsersPageLimit holds the maximum number of users that
+	// can be returned by a single paged query.
+	maxQueryUsersPageLimit = 1000
+)
+
 // QueryUsers filters the user database for users that match the given
 // request. If no filters are requested all usernames will be returned.
 func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest) ([]string, error) {
 	logger.Tracef("QueryUsers %#v", r)
+	identity, filter, err := h.queryUsersFilter(p.Context, r)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	identities, _, err := h.params.Store.FindIdentitiesPage(p.Context, identity, filter, "", 0)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	usernames := make([]string, len(identities))
+	for i, id := range identities {
+		usernames[i] = id.Username
+	}
+	logger.Tracef("QueryUsers response %#v", usernames)
+	return usernames, nil
+}
+
+// QueryUsersPage filters the user database for users that match the
+// given request, returning a page of results at a time.
+func (h *handler) QueryUsersPage(p httprequest.Params, r *params.QueryUsersPageRequest) (*params.QueryUsersResponse, error) {
+	logger.Tracef("QueryUsersPage %#v", r)
+	var resp params.QueryUsersResponse
+	identity, filter, err := h.queryUsersFilter(p.Context, &r.QueryUsersRequest)
+	if errgo.Cause(err) == store.ErrNotFound {
+		return &resp, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	limit := r.Limit
+	switch {
+	case limit < 0:
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid limit %d", r.Limit)
+	case limit == 0:
+		limit = defaultQueryUsersPageLimit
+	case limit > maxQueryUsersPageLimit:
+		limit = maxQueryUsersPageLimit
+	}
+	identities, next, err := h.params.Store.FindIdentitiesPage(p.Context, identity, filter, r.Next, limit)
+	if errgo.Cause(err) == store.ErrInvalidCursor {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid next value %q", r.Next)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp.Next = next
+	if r.Full {
+		resp.Users = make([]params.User, len(identities))
+		for i := range identities {
+			id, err := h.params.Authorizer.Identity(p.Context, &identities[i])
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			u, err := h.userFromIdentity(p.Context, id)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			resp.Users[i] = *u
+		}
+	} else {
+		resp.Usernames = make([]string, len(identities))
+		for i, id := range identities {
+			resp.Usernames[i] = id.Username
+		}
+	}
+	logger.Tracef("QueryUsersPage response %#v", resp)
+	return &resp, nil
+}
+
+// queryUsersFilter returns the identity and filter to use to find the
+// identities matching the given request. If the request names an owner
+// that does not exist, so that no identities can match, an error with
+// a cause of store.ErrNotFound is returned.
+func (h *handler) queryUsersFilter(ctx context.Context, r *params.QueryUsersRequest) (*store.Identity, store.Filter, error) {
 	var identity store.Identity
 	var filter store.Filter
 	if r.ExternalID != "" {
@@ -45,11 +133,26 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 	if r.Email != "" {
 		identity.Email = r.Email
 		filter[store.Email] = store.Equal
+	} else if r.EmailMatch != "" {
+		identity.Email = r.EmailMatch
+		filter[store.Email] = store.Match
+	}
+	if r.UsernamePrefix != "" {
+		identity.Username = r.UsernamePrefix
+		filter[store.Username] = store.Prefix
+	}
+	if r.NameMatch != "" {
+		identity.Name = r.NameMatch
+		filter[store.Name] = store.Match
+	}
+	if r.Group != "" {
+		identity.Groups = []string{r.Group}
+		filter[store.Groups] = store.Contains
 	}
 	if len(r.LastLoginSince) > 0 {
 		var t time.Time
 		if err := t.UnmarshalText([]byte(r.LastLoginSince)); err != nil {
-			return nil, errgo.Notef(err, "cannot unmarshal last-login-since")
+			return nil, filter, errgo.Notef(err, "cannot unmarshal last-login-since")
 		}
 		identity.LastLogin = t
 		filter[store.LastLogin] = store.GreaterThanOrEqual
@@ -57,39 +160,32 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 	if len(r.LastDischargeSince) > 0 {
 		var t time.Time
 		if err := t.UnmarshalText([]byte(r.LastDischargeSince)); err != nil {
-			return nil, errgo.Notef(err, "cannot unmarshal last-discharge-since")
+			return nil, filter, errgo.Notef(err, "cannot unmarshal last-discharge-since")
 		}
 		identity.LastDischarge = t
 		filter[store.LastDischarge] = store.GreaterThanOrEqual
 	}
+	if len(r.ExpiresBefore) > 0 {
+		var t time.Time
+		if err := t.UnmarshalText([]byte(r.ExpiresBefore)); err != nil {
+			return nil, filter, errgo.Notef(err, "cannot unmarshal expires-before")
+		}
+		identity.Expires = t
+		filter[store.Expires] = store.LessThanOrEqual
+	}
 	if r.Owner != "" {
 		ownerIdentity := store.Identity{
 			Username: r.Owner,
 		}
-		err := h.params.Store.Identity(p.Context, &ownerIdentity)
-		if errgo.Cause(err) == store.ErrNotFound {
-			// If the owner doesn't exist then it has no agents.
-			return []string{}, nil
-		}
+		err := h.params.Store.Identity(ctx, &ownerIdentity)
 		if err != nil {
-			return nil, errgo.Mask(err)
+			// If the owner doesn't exist then it has no agents.
+			return nil, filter, errgo.Mask(err, errgo.Is(store.ErrNotFound))
 		}
 		identity.Owner = ownerIdentity.ProviderID
 		filter[store.Owner] = store.Equal
 	}
-
-	// TODO(mhilton) make sure this endpoint can be queried as a
-	// subset once there are more users.
-	identities, err := h.params.Store.FindIdentities(p.Context, &identity, filter, []store.Sort{{Field: store.Username}}, 0, 0)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	usernames := make([]string, len(identities))
-	for i, id := range identities {
-		usernames[i] = id.Username
-	}
-	logger.Tracef("QueryUsers response %#v", usernames)
-	return usernames, nil
+	return &identity, filter, nil
 }
 
 // User returns the user information for the request user.
@@ -171,10 +267,18 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 		identity.Owner = owner.ProviderID
 		update[store.Owner] = store.Set
 	}
+	if u.Expires != nil && !u.Expires.IsZero() {
+		if !u.Expires.After(time.Now()) {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "expiry time %s is in the past", u.Expires.UTC().Format(time.RFC3339))
+		}
+		identity.Expires = *u.Expires
+		update[store.Expires] = store.Set
+	}
 	// TODO add tags to Identity?
 	if err := h.params.Store.UpdateIdentity(p.Context, identity, update); err != nil {
 		return nil, translateStoreError(err)
 	}
+	h.audit(p, "create-agent", identity.Username, nil, identity.Groups)
 	resp := &params.CreateAgentResponse{
 		Username: params.Username(identity.Username),
 	}
@@ -182,6 +286,161 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 	return resp, nil
 }
 
+// RemoveUser removes the given user. If RemoveAgents is set in the
+// request then any agents owned by the user will also be removed.
+func (h *handler) RemoveUser(p httprequest.Params, r *params.RemoveUserRequest) error {
+	logger.Tracef("RemoveUser %#v", r)
+	if r.Username == auth.AdminUsername {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot remove %s", r.Username)
+	}
+	identity := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &identity); err != nil {
+		return translateStoreError(err)
+	}
+	if r.RemoveAgents {
+		agents, err := h.params.Store.FindIdentities(
+			p.Context,
+			&store.Identity{Owner: identity.ProviderID},
+			store.Filter{store.Owner: store.Equal},
+			nil,
+			0, 0,
+		)
+		if err != nil {
+			return errgo.Notef(err, "cannot find agents")
+		}
+		for _, agent := range agents {
+			err := h.params.Store.RemoveIdentity(p.Context, &store.Identity{ID: agent.ID})
+			if errgo.Cause(err) == store.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return errgo.Notef(err, "cannot remove agent %s", agent.Username)
+			}
+			h.audit(p, "remove-user", agent.Username, agent.Groups, nil)
+		}
+	}
+	if err := h.params.Store.RemoveIdentity(p.Context, &store.Identity{ID: identity.ID}); err != nil {
+		return translateStoreError(err)
+	}
+	h.audit(p, "remove-user", identity.Username, identity.Groups, nil)
+	logger.Tracef("RemoveUser complete")
+	return nil
+}
+
+// SetUserDisabled disables or enables the given user. If Agents is set
+// in the request then any agents owned by the user, including agents
+// owned by those agents, are also disabled or enabled.
+func (h *handler) SetUserDisabled(p httprequest.Params, r *params.SetUserDisabledRequest) error {
+	logger.Tracef("SetUserDisabled %#v", r)
+	if r.Username == auth.AdminUsername && r.Body.Disabled {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot disable %s", r.Username)
+	}
+	identity := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &identity); err != nil {
+		return translateStoreError(err)
+	}
+	var disabled time.Time
+	reason := ""
+	if r.Body.Disabled {
+		disabled = time.Now()
+		reason = r.Body.Reason
+	}
+	if r.Body.Agents {
+		agents, err := h.ownedAgents(p.Context, &identity)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for i := range agents {
+			err := h.setDisabled(p, &agents[i], disabled, reason)
+			if errgo.Cause(err) == store.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return errgo.Notef(err, "cannot update agent %s", agents[i].Username)
+			}
+		}
+	}
+	if err := h.setDisabled(p, &identity, disabled, reason); err != nil {
+		return translateStoreError(err)
+	}
+	return nil
+}
+
+// ownedAgents returns all the agents owned, directly or through other
+// agents, by the given identity. An agent is owned by an identity if its
+// owner is either the ProviderID or one of the LinkedProviderIDs of the
+// identity.
+func (h *handler) ownedAgents(ctx context.Context, identity *store.Identity) ([]store.Identity, error) {
+	visited := map[string]bool{identity.ID: true}
+	var agents []store.Identity
+	owners := []store.Identity{*identity}
+	for len(owners) > 0 {
+		owner := owners[0]
+		owners = owners[1:]
+		pids := append([]store.ProviderIdentity{owner.ProviderID}, owner.LinkedProviderIDs...)
+		for _, pid := range pids {
+			found, err := h.params.Store.FindIdentities(
+				ctx,
+				&store.Identity{Owner: pid},
+				store.Filter{store.Owner: store.Equal},
+				nil,
+				0, 0,
+			)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot find agents")
+			}
+			for _, agent := range found {
+				if visited[agent.ID] {
+					continue
+				}
+				visited[agent.ID] = true
+				agents = append(agents, agent)
+				owners = append(owners, agent)
+			}
+		}
+	}
+	return agents, nil
+}
+
+// setDisabled sets the disabled time and reason of the given identity
+// and records the change in the audit log. An identity that is already
+// in the requested state is left unchanged, so that the time it was
+// originally disabled is retained.
+func (h *handler) setDisabled(p httprequest.Params, identity *store.Identity, disabled time.Time, reason string) error {
+	if identity.Disabled.IsZero() == disabled.IsZero() {
+		return nil
+	}
+	err := h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ID:             identity.ID,
+		Disabled:       disabled,
+		DisabledReason: reason,
+	}, store.Update{
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	if disabled.IsZero() {
+		h.audit(p, "enable-user", identity.Username, nonEmpty(identity.DisabledReason), nil)
+	} else {
+		h.audit(p, "disable-user", identity.Username, nil, nonEmpty(reason))
+	}
+	return nil
+}
+
+// nonEmpty returns a slice holding s, or nil if s is empty.
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
 // SetUserDeprecated creates or updates the user with the given username. If the
 // user already exists then any IDPGroups or SSHKeys specified in the
 // request will be ignored. See SetUserGroups, ModifyUserGroups,
@@ -228,6 +487,26 @@ func (h *handler) UserGroups(p httprequest.Params, r *params.UserGroupsRequest)
 	return groups, nil
 }
 
+// UserGroupPath returns the path through which the requested user is a
+// member of the requested group.
+func (h *handler) UserGroupPath(p httprequest.Params, r *params.UserGroupPathRequest) (*params.GroupPath, error) {
+	logger.Tracef("UserGroupPath %#v", r)
+	id, err := h.params.Authorizer.Identity(p.Context, &store.Identity{
+		Username: string(r.Username),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	path, err := id.GroupPath(p.Context, r.Group)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &params.GroupPath{
+		Member: len(path) > 0,
+		Path:   path,
+	}, nil
+}
+
 // UserIDPGroups returns the list of groups associated with the requested
 // user. This is deprected and UserGroups should be used in preference.
 func (h *handler) UserIDPGroups(p httprequest.Params, r *params.UserIDPGroupsRequest) ([]string, error) {
@@ -240,6 +519,12 @@ func (h *handler) UserIDPGroups(p httprequest.Params, r *params.UserIDPGroupsReq
 // given value.
 func (h *handler) SetUserGroups(p httprequest.Params, r *params.SetUserGroupsRequest) error {
 	logger.Tracef("SetUserGroups %#v", r)
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
 	identity := store.Identity{
 		Username: string(r.Username),
 		Groups:   r.Groups.Groups,
@@ -248,6 +533,7 @@ func (h *handler) SetUserGroups(p httprequest.Params, r *params.SetUserGroupsReq
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.audit(p, "set-groups", identity.Username, before.Groups, identity.Groups)
 	logger.Tracef("SetUserGroups complete")
 	return nil
 }
@@ -271,10 +557,23 @@ func (h *handler) ModifyUserGroups(p httprequest.Params, r *params.ModifyUserGro
 		identity.Groups = r.Groups.Remove
 		update[store.Groups] = store.Pull
 	}
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
 	err := h.params.Store.UpdateIdentity(p.Context, &identity, update)
 	if err != nil {
 		return translateStoreError(err)
 	}
+	after := store.Identity{
+		ID: before.ID,
+	}
+	if err := h.params.Store.Identity(p.Context, &after); err != nil {
+		return translateStoreError(err)
+	}
+	h.audit(p, "modify-groups", identity.Username, before.Groups, after.Groups)
 	logger.Tracef("SetUserGroups complete")
 	return nil
 }
@@ -300,6 +599,15 @@ func (h *handler) GetSSHKeys(p httprequest.Params, r *params.SSHKeysRequest) (pa
 // will be added to, otherwise they will be replaced.
 func (h *handler) PutSSHKeys(p httprequest.Params, r *params.PutSSHKeysRequest) error {
 	logger.Tracef("PutSSHKeys %#v", r)
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
+	if err := h.checkSSHKeysWritable(&before); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
 	id := store.Identity{
 		Username: string(r.Username),
 		ExtraInfo: map[string][]string{
@@ -313,6 +621,13 @@ func (h *handler) PutSSHKeys(p httprequest.Params, r *params.PutSSHKeysRequest)
 	if err != nil {
 		return translateStoreError(err)
 	}
+	after := store.Identity{
+		ID: before.ID,
+	}
+	if err := h.params.Store.Identity(p.Context, &after); err != nil {
+		return translateStoreError(err)
+	}
+	h.audit(p, "put-ssh-keys", before.Username, before.ExtraInfo["sshkeys"], after.ExtraInfo["sshkeys"])
 	logger.Tracef("PutSSHKeys complete")
 	return nil
 }
@@ -322,6 +637,15 @@ func (h *handler) PutSSHKeys(p httprequest.Params, r *params.PutSSHKeysRequest)
 // key that is not associated with the user.
 func (h *handler) DeleteSSHKeys(p httprequest.Params, r *params.DeleteSSHKeysRequest) error {
 	logger.Tracef("DeleteSSHKeys %#v", r)
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
+	if err := h.checkSSHKeysWritable(&before); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
 	id := store.Identity{
 		Username: string(r.Username),
 		ExtraInfo: map[string][]string{
@@ -335,10 +659,133 @@ func (h *handler) DeleteSSHKeys(p httprequest.Params, r *params.DeleteSSHKeysReq
 	if err != nil {
 		return translateStoreError(err)
 	}
+	after := store.Identity{
+		ID: before.ID,
+	}
+	if err := h.params.Store.Identity(p.Context, &after); err != nil {
+		return translateStoreError(err)
+	}
+	h.audit(p, "delete-ssh-keys", before.Username, before.ExtraInfo["sshkeys"], after.ExtraInfo["sshkeys"])
 	logger.Tracef("DeleteSSHKeys complete")
 	return nil
 }
 
+// checkSSHKeysWritable returns an error with a cause of
+// params.ErrForbidden if the SSH keys of the given identity are managed
+// by the identity provider that created it.
+func (h *handler) checkSSHKeysWritable(id *store.Identity) error {
+	if idp.ManagesSSHKeys(h.params.IdentityProviders, id) {
+		return errgo.WithCausef(nil, params.ErrForbidden, "ssh keys of %q are managed by identity provider %q", id.Username, id.ProviderID.Provider())
+	}
+	return nil
+}
+
+// GetProviderIDs returns the provider ids that identify the given
+// user, starting with the one the user was created with.
+func (h *handler) GetProviderIDs(p httprequest.Params, r *params.ProviderIDsRequest) (params.ProviderIDsResponse, error) {
+	logger.Tracef("GetProviderIDs %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return params.ProviderIDsResponse{}, translateStoreError(err)
+	}
+	resp := params.ProviderIDsResponse{
+		ProviderIDs: providerIDs(&id),
+	}
+	logger.Tracef("GetProviderIDs response %#v", resp)
+	return resp, nil
+}
+
+// LinkProviderID links a provider id to the given user. If the
+// provider id already identifies a different user then that user is
+// merged into the given user and removed.
+func (h *handler) LinkProviderID(p httprequest.Params, r *params.LinkProviderIDRequest) (params.LinkProviderIDResponse, error) {
+	logger.Tracef("LinkProviderID %#v", r)
+	if r.Body.ProviderID == "" {
+		return params.LinkProviderIDResponse{}, errgo.WithCausef(nil, params.ErrBadRequest, "provider id not specified")
+	}
+	identity := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &identity); err != nil {
+		return params.LinkProviderIDResponse{}, translateStoreError(err)
+	}
+	if identity.Owner != "" {
+		return params.LinkProviderIDResponse{}, errgo.WithCausef(nil, params.ErrBadRequest, "cannot link provider id to agent %s", identity.Username)
+	}
+	before := providerIDs(&identity)
+	merged, err := store.LinkProviderID(p.Context, h.params.Store, &identity, store.ProviderIdentity(r.Body.ProviderID), !idp.ManagesSSHKeys(h.params.IdentityProviders, &identity), auth.CheckEnabled)
+	if errgo.Cause(err) == params.ErrUserDisabled {
+		return params.LinkProviderIDResponse{}, errgo.Mask(err, errgo.Is(params.ErrUserDisabled))
+	}
+	if err != nil {
+		return params.LinkProviderIDResponse{}, translateStoreError(err)
+	}
+	var resp params.LinkProviderIDResponse
+	if merged != nil {
+		resp.Merged = params.Username(merged.Username)
+		h.audit(p, "merge-user", merged.Username, providerIDs(merged), []string{identity.Username})
+	}
+	h.audit(p, "link-provider-id", identity.Username, before, providerIDs(&identity))
+	logger.Tracef("LinkProviderID response %#v", resp)
+	return resp, nil
+}
+
+// UnlinkProviderID removes a linked provider id from the given user.
+// The provider id that the user was created with cannot be removed.
+func (h *handler) UnlinkProviderID(p httprequest.Params, r *params.UnlinkProviderIDRequest) error {
+	logger.Tracef("UnlinkProviderID %#v", r)
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
+	pid := store.ProviderIdentity(r.Body.ProviderID)
+	if pid == before.ProviderID {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot unlink primary provider id %q", pid)
+	}
+	found := false
+	for _, linked := range before.LinkedProviderIDs {
+		if linked == pid {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errgo.WithCausef(nil, params.ErrNotFound, "provider id %q not linked to %s", pid, before.Username)
+	}
+	err := h.params.Store.UpdateIdentity(p.Context, &store.Identity{
+		ID:                before.ID,
+		LinkedProviderIDs: []store.ProviderIdentity{pid},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Pull,
+	})
+	if err != nil {
+		return translateStoreError(err)
+	}
+	after := store.Identity{
+		ID: before.ID,
+	}
+	if err := h.params.Store.Identity(p.Context, &after); err != nil {
+		return translateStoreError(err)
+	}
+	h.audit(p, "unlink-provider-id", before.Username, providerIDs(&before), providerIDs(&after))
+	logger.Tracef("UnlinkProviderID complete")
+	return nil
+}
+
+// providerIDs returns all the provider ids that identify the given
+// identity, starting with the primary one.
+func providerIDs(id *store.Identity) []string {
+	pids := []string{string(id.ProviderID)}
+	for _, pid := range id.LinkedProviderIDs {
+		pids = append(pids, string(pid))
+	}
+	return pids
+}
+
 // UserToken returns a token, in the form of a macaroon, identifying
 // the user. This token can only be generated by an administrator.
 func (h *handler) UserToken(p httprequest.Params, r *params.UserTokenRequest) (*bakery.Macaroon, error) {
@@ -422,10 +869,22 @@ func (h *handler) SetUserExtraInfo(p httprequest.Params, r *params.SetUserExtraI
 		}
 		id.ExtraInfo[k] = []string{string(buf)}
 	}
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
+	if _, ok := id.ExtraInfo[store.SSHKeysExtraInfoKey]; ok {
+		if err := h.checkSSHKeysWritable(&before); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+	}
 	err := h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.ExtraInfo: store.Set})
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.audit(p, "set-extra-info", id.Username, extraInfoValues(before.ExtraInfo, id.ExtraInfo), extraInfoValues(id.ExtraInfo, id.ExtraInfo))
 	logger.Tracef("SetUserExtraInfo complete")
 	return nil
 }
@@ -463,6 +922,17 @@ func (h *handler) SetUserExtraInfoItem(p httprequest.Params, r *params.SetUserEx
 	if err := checkExtraInfoKey(r.Item); err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
+	before := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &before); err != nil {
+		return translateStoreError(err)
+	}
+	if r.Item == store.SSHKeysExtraInfoKey {
+		if err := h.checkSSHKeysWritable(&before); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+	}
 	buf, err := json.Marshal(r.Data)
 	if err != nil {
 		// This should not be possible as it was only just unmarshalled.
@@ -473,10 +943,24 @@ func (h *handler) SetUserExtraInfoItem(p httprequest.Params, r *params.SetUserEx
 	if err != nil {
 		return translateStoreError(err)
 	}
+	h.audit(p, "set-extra-info", id.Username, extraInfoValues(before.ExtraInfo, id.ExtraInfo), extraInfoValues(id.ExtraInfo, id.ExtraInfo))
 	logger.Tracef("SetUserExtraInfoItem complete")
 	return nil
 }
 
+// extraInfoValues returns the values held in extraInfo for each of the
+// keys in the keys map in a form suitable for the audit log.
+func extraInfoValues(extraInfo, keys map[string][]string) []string {
+	var values []string
+	for k := range keys {
+		for _, v := range extraInfo[k] {
+			values = append(values, k+"="+v)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
 func checkExtraInfoKey(key string) error {
 	if strings.ContainsAny(key, "./$") {
 		return errgo.WithCausef(nil, params.ErrBadRequest, "%q bad key for extra-info", key)
@@ -500,6 +984,7 @@ func (h *handler) userFromIdentity(ctx context.Context, id *auth.Identity) (*par
 	}
 	var owner params.Username
 	var externalID string
+	var linkedExternalIDs []string
 	if id.Owner != "" {
 		ownerIdentity := store.Identity{
 			ProviderID: id.Owner,
@@ -511,6 +996,9 @@ func (h *handler) userFromIdentity(ctx context.Context, id *auth.Identity) (*par
 		owner = params.Username(ownerIdentity.Username)
 	} else {
 		externalID = string(id.ProviderID)
+		for _, pid := range id.LinkedProviderIDs {
+			linkedExternalIDs = append(linkedExternalIDs, string(pid))
+		}
 	}
 	var sshKeys []string
 	if len(id.ExtraInfo["sshkeys"]) > 0 {
@@ -524,18 +1012,30 @@ func (h *handler) userFromIdentity(ctx context.Context, id *auth.Identity) (*par
 	if !id.LastDischarge.IsZero() {
 		lastDischarge = &id.LastDischarge
 	}
+	var disabled *time.Time
+	if !id.Disabled.IsZero() {
+		disabled = &id.Disabled
+	}
+	var expires *time.Time
+	if !id.Expires.IsZero() {
+		expires = &id.Expires
+	}
 	return &params.User{
-		Username:      params.Username(id.Username),
-		ExternalID:    externalID,
-		FullName:      id.Name,
-		Email:         id.Email,
-		GravatarID:    gravatarHash(id.Email),
-		IDPGroups:     groups,
-		Owner:         owner,
-		PublicKeys:    publicKeys,
-		SSHKeys:       sshKeys,
-		LastLogin:     lastLogin,
-		LastDischarge: lastDischarge,
+		Username:          params.Username(id.Username),
+		ExternalID:        externalID,
+		LinkedExternalIDs: linkedExternalIDs,
+		FullName:          id.Name,
+		Email:             id.Email,
+		GravatarID:        gravatarHash(id.Email),
+		IDPGroups:         groups,
+		Owner:             owner,
+		PublicKeys:        publicKeys,
+		SSHKeys:           sshKeys,
+		LastLogin:         lastLogin,
+		LastDischarge:     lastDischarge,
+		Disabled:          disabled,
+		DisabledReason:    id.DisabledReason,
+		Expires:           expires,
 	}, nil
 }
 
@@ -576,7 +1076,7 @@ func translateStoreError(err error) error {
 	switch errgo.Cause(err) {
 	case store.ErrNotFound:
 		cause = params.ErrNotFound
-	case store.ErrDuplicateUsername:
+	case store.ErrDuplicateUsername, store.ErrDuplicateProviderID:
 		cause = params.ErrAlreadyExists
 	case nil:
 		return nil
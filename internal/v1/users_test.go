@@ -11,6 +11,8 @@ import (
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
@@ -54,6 +56,7 @@ func (s *usersSuite) Init(c *qt.C) {
 				},
 			},
 		}),
+		sshKeyManager{static.NewIdentityProvider(static.Params{Name: "managed"})},
 	}
 	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
 		"discharger": discharger.NewAPIHandler,
@@ -172,6 +175,71 @@ func (s *usersSuite) TestCreateAgent(c *qt.C) {
 	c.Assert(groups, qt.HasLen, 0)
 }
 
+func (s *usersSuite) TestCreateAgentWithExpiry(c *qt.C) {
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client:  s.srv.Client(s.interactor),
+	})
+	c.Assert(err, qt.IsNil)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	resp, err := client.CreateAgent(s.srv.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Expires:    &expires,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	u, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: resp.Username,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Expires, qt.Not(qt.IsNil))
+	c.Assert(u.Expires.Equal(expires), qt.IsTrue)
+
+	newAgentClient := func() *candidclient.Client {
+		agentClient, err := candidclient.New(candidclient.NewParams{
+			BaseURL: s.srv.URL,
+			Client: &httpbakery.Client{
+				Client: httpbakery.NewHTTPClient(),
+				Key:    privKey1,
+			},
+			AgentUsername: string(resp.Username),
+		})
+		c.Assert(err, qt.IsNil)
+		return agentClient
+	}
+	_, err = newAgentClient().WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+
+	// Once the agent has expired it can no longer log in.
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username: string(resp.Username),
+		Expires:  time.Now().Add(-time.Minute),
+	}, store.Update{
+		store.Expires: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = newAgentClient().WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/whoami: cannot get discharge from ".*": cannot acquire agent macaroon: .*: user a-.*@candid expired at .*`)
+}
+
+func (s *usersSuite) TestCreateAgentWithExpiryInPast(c *qt.C) {
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client:  s.srv.Client(s.interactor),
+	})
+	c.Assert(err, qt.IsNil)
+	expires := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = client.CreateAgent(s.srv.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+			Expires:    &expires,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/u: expiry time 2020-01-01T00:00:00Z is in the past`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
+
 func (s *usersSuite) TestCreateAgentAsAgent(c *qt.C) {
 	client := s.srv.IdentityClient(c, "testagent@candid", "testgroup")
 	_, err := client.CreateAgent(s.srv.Ctx, &params.CreateAgentRequest{
@@ -491,12 +559,190 @@ func (s *usersSuite) TestQueryUsersBadLastDischarge(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*last-discharge-since=yesterday.*: cannot unmarshal last-discharge-since: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`)
 }
 
+func (s *usersSuite) TestQueryUsersExpiresBefore(c *qt.C) {
+	now := time.Now()
+	expires0, expires1 := now.Add(time.Hour), now.Add(48*time.Hour)
+	s.addUser(c, params.User{
+		Username:   "a-agent0@candid",
+		ExternalID: "idm:a-agent0",
+		Expires:    &expires0,
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent1@candid",
+		ExternalID: "idm:a-agent1",
+		Expires:    &expires1,
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent2@candid",
+		ExternalID: "idm:a-agent2",
+	})
+	users, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		ExpiresBefore: now.Add(24 * time.Hour).Format(time.RFC3339Nano),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"a-agent0@candid"})
+}
+
+func (s *usersSuite) TestQueryUsersBadExpiresBefore(c *qt.C) {
+	_, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		ExpiresBefore: "tomorrow",
+	})
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*expires-before=tomorrow.*: cannot unmarshal expires-before: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`)
+}
+
 func (s *usersSuite) TestQueryUsersUnauthorized(c *qt.C) {
 	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
 	_, err := client.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{})
 	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*: permission denied`)
 }
 
+func (s *usersSuite) addQueryUsers(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "alice",
+		ExternalID: "test:alice",
+		FullName:   "Alice Smith",
+		Email:      "alice@example.com",
+		IDPGroups:  []string{"g1", "g2"},
+	})
+	s.addUser(c, params.User{
+		Username:   "alfred",
+		ExternalID: "test:alfred",
+		FullName:   "Alfred Jones",
+		Email:      "alfred@example.org",
+		IDPGroups:  []string{"g1"},
+	})
+	s.addUser(c, params.User{
+		Username:   "bob",
+		ExternalID: "test:bob",
+		FullName:   "Bob Smith",
+		Email:      "bob@example.com",
+	})
+}
+
+var queryUsersFilterTests = []struct {
+	about  string
+	req    params.QueryUsersRequest
+	expect []string
+}{{
+	about:  "username prefix",
+	req:    params.QueryUsersRequest{UsernamePrefix: "al"},
+	expect: []string{"alfred", "alice"},
+}, {
+	about:  "name match",
+	req:    params.QueryUsersRequest{NameMatch: "SMITH"},
+	expect: []string{"alice", "bob"},
+}, {
+	about:  "email match",
+	req:    params.QueryUsersRequest{EmailMatch: "example.org"},
+	expect: []string{"alfred"},
+}, {
+	about:  "group",
+	req:    params.QueryUsersRequest{Group: "g1"},
+	expect: []string{"alfred", "alice"},
+}, {
+	about:  "combined filters",
+	req:    params.QueryUsersRequest{Group: "g1", NameMatch: "smith"},
+	expect: []string{"alice"},
+}, {
+	about:  "no match",
+	req:    params.QueryUsersRequest{Group: "g3"},
+	expect: []string{},
+}}
+
+func (s *usersSuite) TestQueryUsersFilters(c *qt.C) {
+	s.addQueryUsers(c)
+	for _, test := range queryUsersFilterTests {
+		c.Run(test.about, func(c *qt.C) {
+			users, err := s.adminClient.QueryUsers(s.srv.Ctx, &test.req)
+			c.Assert(err, qt.IsNil)
+			c.Assert(users, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func (s *usersSuite) TestQueryUsersPaging(c *qt.C) {
+	s.addQueryUsers(c)
+	var usernames []string
+	req := params.QueryUsersPageRequest{
+		Limit: 2,
+	}
+	for pages := 0; ; pages++ {
+		c.Assert(pages < 3, qt.Equals, true, qt.Commentf("too many pages"))
+		resp, err := s.adminClient.QueryUsersPage(s.srv.Ctx, &req)
+		c.Assert(err, qt.IsNil)
+		c.Assert(len(resp.Usernames) <= 2, qt.Equals, true)
+		usernames = append(usernames, resp.Usernames...)
+		if resp.Next == "" {
+			break
+		}
+		req.Next = resp.Next
+	}
+	c.Assert(usernames, qt.DeepEquals, []string{auth.AdminUsername, "alfred", "alice", "bob"})
+}
+
+func (s *usersSuite) TestQueryUsersFull(c *qt.C) {
+	s.addQueryUsers(c)
+	resp, err := s.adminClient.QueryUsersPage(s.srv.Ctx, &params.QueryUsersPageRequest{
+		QueryUsersRequest: params.QueryUsersRequest{
+			UsernamePrefix: "ali",
+		},
+		Full: true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Usernames, qt.HasLen, 0)
+	c.Assert(resp.Users, qt.HasLen, 1)
+	u, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "alice",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Users[0], qt.DeepEquals, *u)
+}
+
+func (s *usersSuite) TestQueryUsersLimits(c *qt.C) {
+	// Together with the admin user this makes one more user than can
+	// be returned by a single paged query.
+	for i := 0; i < v1.MaxQueryUsersPageLimit; i++ {
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+			Username:   fmt.Sprintf("user%04d", i),
+			ProviderID: store.MakeProviderIdentity("test", fmt.Sprintf("user%04d", i)),
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+
+	usernames, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(usernames, qt.HasLen, v1.MaxQueryUsersPageLimit+1)
+
+	resp, err := s.adminClient.QueryUsersPage(s.srv.Ctx, &params.QueryUsersPageRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Usernames, qt.HasLen, v1.DefaultQueryUsersPageLimit)
+	c.Assert(resp.Next, qt.Not(qt.Equals), "")
+
+	resp, err = s.adminClient.QueryUsersPage(s.srv.Ctx, &params.QueryUsersPageRequest{
+		Full: true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Users, qt.HasLen, v1.DefaultQueryUsersPageLimit)
+	c.Assert(resp.Next, qt.Not(qt.Equals), "")
+
+	resp, err = s.adminClient.QueryUsersPage(s.srv.Ctx, &params.QueryUsersPageRequest{
+		Limit: 2 * v1.MaxQueryUsersPageLimit,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Usernames, qt.HasLen, v1.MaxQueryUsersPageLimit)
+	c.Assert(resp.Next, qt.Not(qt.Equals), "")
+}
+
+func (s *usersSuite) TestQueryUsersBadNext(c *qt.C) {
+	_, err := s.adminClient.QueryUsersPage(s.srv.Ctx, &params.QueryUsersPageRequest{
+		Next: "not a cursor!",
+	})
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/users?.*: invalid next value "not a cursor!"`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
+
 func (s *usersSuite) TestQueryAgentUsers(c *qt.C) {
 	err := s.store.Store.UpdateIdentity(
 		s.srv.Ctx,
@@ -551,6 +797,442 @@ func (s *usersSuite) TestQueryAgentUsersOwnerNotFound(c *qt.C) {
 	c.Assert(users, qt.DeepEquals, []string{})
 }
 
+func (s *usersSuite) TestRemoveUser(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+		FullName:   "Joe Bloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent@candid",
+		ExternalID: "idm:a-agent",
+		Owner:      "jbloggs",
+	})
+	err := s.adminClient.RemoveUser(s.srv.Ctx, &params.RemoveUserRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+
+	_, err = s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/u/jbloggs: user jbloggs not found`)
+
+	// The agent is left in place when RemoveAgents is not set.
+	s.store.AssertUser(c, &store.Identity{
+		Username:   "a-agent@candid",
+		ProviderID: "idm:a-agent",
+		Owner:      "test:http://example.com/jbloggs",
+	})
+}
+
+func (s *usersSuite) TestRemoveUserWithAgents(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent1@candid",
+		ExternalID: "idm:a-agent1",
+		Owner:      "jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent2@candid",
+		ExternalID: "idm:a-agent2",
+		Owner:      "jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs2",
+		ExternalID: "test:http://example.com/jbloggs2",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent3@candid",
+		ExternalID: "idm:a-agent3",
+		Owner:      "jbloggs2",
+	})
+	err := s.adminClient.RemoveUser(s.srv.Ctx, &params.RemoveUserRequest{
+		Username:     "jbloggs",
+		RemoveAgents: true,
+	})
+	c.Assert(err, qt.IsNil)
+
+	users, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"a-agent3@candid", auth.AdminUsername, "jbloggs2"})
+}
+
+func (s *usersSuite) TestRemoveUserNotFound(c *qt.C) {
+	err := s.adminClient.RemoveUser(s.srv.Ctx, &params.RemoveUserRequest{
+		Username: "not-there",
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/u/not-there: user not-there not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func (s *usersSuite) TestRemoveUserAdmin(c *qt.C) {
+	err := s.adminClient.RemoveUser(s.srv.Ctx, &params.RemoveUserRequest{
+		Username: auth.AdminUsername,
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/u/admin@candid: cannot remove admin@candid`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+}
+
+func (s *usersSuite) TestRemoveUserUnauthorized(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	client := s.srv.IdentityClient(c, "a-bob@candid", "testgroup")
+	err := client.RemoveUser(s.srv.Ctx, &params.RemoveUserRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/u/jbloggs: permission denied`)
+	s.store.AssertUser(c, &store.Identity{
+		Username:   "jbloggs",
+		ProviderID: "test:http://example.com/jbloggs",
+	})
+}
+
+func (s *usersSuite) TestSetUserDisabled(c *qt.C) {
+	client := s.srv.IdentityClient(c, "bob@candid")
+	_, err := client.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+
+	err = s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "bob@candid",
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+			Reason:   "compromised",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	u, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "bob@candid",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Disabled, qt.Not(qt.IsNil))
+	c.Assert(u.DisabledReason, qt.Equals, "compromised")
+
+	// The macaroon already held by the client is no longer accepted.
+	_, err = client.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.ErrorMatches, `Get .*/v1/whoami: user bob@candid is disabled: compromised`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUserDisabled)
+
+	err = s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "bob@candid",
+	})
+	c.Assert(err, qt.IsNil)
+	u, err = s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "bob@candid",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Disabled, qt.IsNil)
+	c.Assert(u.DisabledReason, qt.Equals, "")
+	_, err = client.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *usersSuite) TestSetUserDisabledWithAgents(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent1@candid",
+		ExternalID: "idm:a-agent1",
+		Owner:      "jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent2@candid",
+		ExternalID: "idm:a-agent2",
+	})
+	err := s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+			Agents:   true,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	disabled := func(username params.Username) bool {
+		u, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+			Username: username,
+		})
+		c.Assert(err, qt.IsNil)
+		return u.Disabled != nil
+	}
+	c.Assert(disabled("jbloggs"), qt.IsTrue)
+	c.Assert(disabled("a-agent1@candid"), qt.IsTrue)
+	c.Assert(disabled("a-agent2@candid"), qt.IsFalse)
+
+	err = s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: params.SetUserDisabledBody{
+			Agents: true,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(disabled("jbloggs"), qt.IsFalse)
+	c.Assert(disabled("a-agent1@candid"), qt.IsFalse)
+}
+
+func (s *usersSuite) TestSetUserDisabledWithAgentsRecursive(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	// a-agent1 is owned by jbloggs and a-agent2 is owned by a-agent1.
+	s.addUser(c, params.User{
+		Username:   "a-agent1@candid",
+		ExternalID: "idm:a-agent1",
+		Owner:      "jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "a-agent2@candid",
+		ExternalID: "idm:a-agent2",
+		Owner:      "a-agent1@candid",
+	})
+	// a-agent3 is owned by a provider ID that is linked to jbloggs.
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:          "jbloggs",
+		LinkedProviderIDs: []store.ProviderIdentity{"test2:jbloggs"},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Push,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:   "a-agent3@candid",
+		ProviderID: "idm:a-agent3",
+		Owner:      "test2:jbloggs",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Owner:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	s.addUser(c, params.User{
+		Username:   "a-agent4@candid",
+		ExternalID: "idm:a-agent4",
+	})
+	err = s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+			Agents:   true,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	disabled := func(username params.Username) bool {
+		u, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+			Username: username,
+		})
+		c.Assert(err, qt.IsNil)
+		return u.Disabled != nil
+	}
+	c.Assert(disabled("jbloggs"), qt.IsTrue)
+	c.Assert(disabled("a-agent1@candid"), qt.IsTrue)
+	c.Assert(disabled("a-agent2@candid"), qt.IsTrue)
+	c.Assert(disabled("a-agent3@candid"), qt.IsTrue)
+	c.Assert(disabled("a-agent4@candid"), qt.IsFalse)
+
+	err = s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: params.SetUserDisabledBody{
+			Agents: true,
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(disabled("jbloggs"), qt.IsFalse)
+	c.Assert(disabled("a-agent1@candid"), qt.IsFalse)
+	c.Assert(disabled("a-agent2@candid"), qt.IsFalse)
+	c.Assert(disabled("a-agent3@candid"), qt.IsFalse)
+}
+
+func (s *usersSuite) TestSetUserDisabledNotFound(c *qt.C) {
+	err := s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "not-there",
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/not-there/disabled: user not-there not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func (s *usersSuite) TestSetUserDisabledAdmin(c *qt.C) {
+	err := s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: auth.AdminUsername,
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/admin@candid/disabled: cannot disable admin@candid`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+}
+
+func (s *usersSuite) TestSetUserDisabledUnauthorized(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	client := s.srv.IdentityClient(c, "a-bob@candid", "testgroup")
+	err := client.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "jbloggs",
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/jbloggs/disabled: permission denied`)
+}
+
+func (s *usersSuite) TestProviderIDs(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+		IDPGroups:  []string{"g1"},
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs2",
+		ExternalID: "test2:jbloggs",
+		IDPGroups:  []string{"g2"},
+	})
+	resp, err := s.adminClient.LinkProviderID(s.srv.Ctx, &params.LinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test3:jbloggs",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Merged, qt.Equals, params.Username(""))
+
+	// Linking the provider id of another user merges that user.
+	resp, err = s.adminClient.LinkProviderID(s.srv.Ctx, &params.LinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test2:jbloggs",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Merged, qt.Equals, params.Username("jbloggs2"))
+
+	pids, err := s.adminClient.GetProviderIDs(s.srv.Ctx, &params.ProviderIDsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(pids.ProviderIDs[0], qt.Equals, "test:http://example.com/jbloggs")
+	c.Assert(pids.ProviderIDs[1:], qt.CmpEquals(cmpopts.SortSlices(func(x, y string) bool { return x < y })), []string{"test2:jbloggs", "test3:jbloggs"})
+
+	u, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.IDPGroups, qt.CmpEquals(cmpopts.SortSlices(func(x, y string) bool { return x < y })), []string{"g1", "g2"})
+	c.Assert(u.LinkedExternalIDs, qt.HasLen, 2)
+
+	_, err = s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "jbloggs2",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	err = s.adminClient.UnlinkProviderID(s.srv.Ctx, &params.UnlinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test3:jbloggs",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	pids, err = s.adminClient.GetProviderIDs(s.srv.Ctx, &params.ProviderIDsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(pids.ProviderIDs, qt.DeepEquals, []string{"test:http://example.com/jbloggs", "test2:jbloggs"})
+}
+
+func (s *usersSuite) TestUnlinkProviderIDErrors(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	err := s.adminClient.UnlinkProviderID(s.srv.Ctx, &params.UnlinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test:http://example.com/jbloggs",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/u/jbloggs/provider-ids: cannot unlink primary provider id "test:http://example.com/jbloggs"`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = s.adminClient.UnlinkProviderID(s.srv.Ctx, &params.UnlinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test2:jbloggs",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/u/jbloggs/provider-ids: provider id "test2:jbloggs" not linked to jbloggs`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func (s *usersSuite) TestLinkProviderIDDisabled(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	s.addUser(c, params.User{
+		Username:   "jbloggs2",
+		ExternalID: "test2:jbloggs",
+	})
+	err := s.adminClient.SetUserDisabled(s.srv.Ctx, &params.SetUserDisabledRequest{
+		Username: "jbloggs2",
+		Body: params.SetUserDisabledBody{
+			Disabled: true,
+			Reason:   "compromised",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A disabled user cannot be merged into another user.
+	_, err = s.adminClient.LinkProviderID(s.srv.Ctx, &params.LinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test2:jbloggs",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/u/jbloggs/provider-ids: user jbloggs2 is disabled: compromised`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUserDisabled)
+
+	// Nothing can be linked to a disabled user.
+	_, err = s.adminClient.LinkProviderID(s.srv.Ctx, &params.LinkProviderIDRequest{
+		Username: "jbloggs2",
+		Body: params.ProviderIDBody{
+			ProviderID: "test3:jbloggs",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/u/jbloggs2/provider-ids: user jbloggs2 is disabled: compromised`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUserDisabled)
+
+	pids, err := s.adminClient.GetProviderIDs(s.srv.Ctx, &params.ProviderIDsRequest{
+		Username: "jbloggs2",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(pids.ProviderIDs, qt.DeepEquals, []string{"test2:jbloggs"})
+}
+
+func (s *usersSuite) TestLinkProviderIDUnauthorized(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "test:http://example.com/jbloggs",
+	})
+	client := s.srv.IdentityClient(c, "a-bob@candid", "testgroup")
+	_, err := client.LinkProviderID(s.srv.Ctx, &params.LinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test2:jbloggs",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Post .*/v1/u/jbloggs/provider-ids: permission denied`)
+}
+
 func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	s.addUser(c, params.User{
 		Username:   "jbloggs",
@@ -647,6 +1329,97 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	})
 }
 
+func (s *usersSuite) TestManagedSSHKeys(c *qt.C) {
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("managed", "jbloggs"),
+		Username:   "jbloggs",
+		ExtraInfo: map[string][]string{
+			"sshkeys": {"36ASDER56"},
+		},
+	}, store.Update{
+		store.Username:  store.Set,
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	sshKeys, err := s.adminClient.GetSSHKeys(s.srv.Ctx, &params.SSHKeysRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{"36ASDER56"})
+
+	err = s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+		Username: "jbloggs",
+		Body: params.PutSSHKeysBody{
+			SSHKeys: []string{"90SDFGS45"},
+			Add:     true,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/jbloggs/ssh-keys: ssh keys of "jbloggs" are managed by identity provider "managed"`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+
+	err = s.adminClient.DeleteSSHKeys(s.srv.Ctx, &params.DeleteSSHKeysRequest{
+		Username: "jbloggs",
+		Body: params.DeleteSSHKeysBody{
+			SSHKeys: []string{"36ASDER56"},
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Delete .*/v1/u/jbloggs/ssh-keys: ssh keys of "jbloggs" are managed by identity provider "managed"`)
+
+	// The SSH keys cannot be changed as extra-info either.
+	err = s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username: "jbloggs",
+		ExtraInfo: map[string]interface{}{
+			"sshkeys": []string{"90SDFGS45"},
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/jbloggs/extra-info: ssh keys of "jbloggs" are managed by identity provider "managed"`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "sshkeys",
+		Data:     []string{"90SDFGS45"},
+	})
+	c.Assert(err, qt.ErrorMatches, `Put .*/v1/u/jbloggs/extra-info/sshkeys: ssh keys of "jbloggs" are managed by identity provider "managed"`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+
+	// Other extra-info items can still be set.
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "jbloggs",
+		Item:     "item1",
+		Data:     1,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Merging a user with SSH keys does not add their keys.
+	err = s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test2", "jbloggs"),
+		Username:   "jbloggs2",
+		ExtraInfo: map[string][]string{
+			"sshkeys": {"90SDFGS45"},
+		},
+	}, store.Update{
+		store.Username:  store.Set,
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	resp, err := s.adminClient.LinkProviderID(s.srv.Ctx, &params.LinkProviderIDRequest{
+		Username: "jbloggs",
+		Body: params.ProviderIDBody{
+			ProviderID: "test2:jbloggs",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Merged, qt.Equals, params.Username("jbloggs2"))
+
+	sshKeys, err = s.adminClient.GetSSHKeys(s.srv.Ctx, &params.SSHKeysRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(sshKeys.SSHKeys, qt.DeepEquals, []string{"36ASDER56"})
+}
+
 func (s *usersSuite) TestVerifyUserToken(c *qt.C) {
 	s.addUser(c, params.User{
 		Username:   "jbloggs",
@@ -1035,7 +1808,7 @@ func (s *usersSuite) addUser(c *qt.C, u params.User) {
 		c.Assert(err, qt.IsNil)
 		identity.Owner = owner.ProviderID
 	}
-	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &identity, store.Update{
+	update := store.Update{
 		store.Username:     store.Set,
 		store.Name:         store.Set,
 		store.Email:        store.Set,
@@ -1043,7 +1816,12 @@ func (s *usersSuite) addUser(c *qt.C, u params.User) {
 		store.PublicKeys:   store.Set,
 		store.ProviderInfo: store.Set,
 		store.Owner:        store.Set,
-	})
+	}
+	if u.Expires != nil {
+		identity.Expires = *u.Expires
+		update[store.Expires] = store.Set
+	}
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &identity, update)
 	c.Assert(err, qt.IsNil)
 }
 
@@ -1189,3 +1967,13 @@ func (s *usersSuite) TestGetUserIDGroups(c *qt.C) {
 		})
 	}
 }
+
+// sshKeyManager is an identity provider that manages the SSH keys of
+// its identities.
+type sshKeyManager struct {
+	idp.IdentityProvider
+}
+
+func (sshKeyManager) ManagesSSHKeys() bool {
+	return true
+}
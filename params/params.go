@@ -100,9 +100,74 @@ type QueryUsersRequest struct {
 	// last discharge time after the given time.
 	LastDischargeSince string `httprequest:"last-discharge-since,form"`
 
+	// ExpiresBefore, if present, must contain a time marshaled as if
+	// using Time.MarshalText. It matches all identities that have
+	// an expiry time no later than the given time. Identities that
+	// never expire are not matched.
+	ExpiresBefore string `httprequest:"expires-before,form,omitempty"`
+
 	// Owner, if present, matches all agent identities with the given
 	// owner.
 	Owner string `httprequest:"owner,form"`
+
+	// UsernamePrefix, if present, matches all identities with a
+	// username starting with the given string.
+	UsernamePrefix string `httprequest:"username-prefix,form,omitempty"`
+
+	// NameMatch, if present, matches all identities with a full
+	// name containing the given string, ignoring case.
+	NameMatch string `httprequest:"name-match,form,omitempty"`
+
+	// EmailMatch, if present, matches all identities with an email
+	// address containing the given string, ignoring case.
+	EmailMatch string `httprequest:"email-match,form,omitempty"`
+
+	// Group, if present, matches all identities that are members of
+	// the given group.
+	Group string `httprequest:"group,form,omitempty"`
+}
+
+// QueryUsersPageRequest is a request to query the users in the system
+// a page at a time.
+type QueryUsersPageRequest struct {
+	httprequest.Route `httprequest:"GET /v1/users"`
+
+	// QueryUsersRequest holds the filters to apply to the query. Its
+	// route is not used.
+	QueryUsersRequest
+
+	// Limit, if positive, holds the maximum number of users to
+	// return. If there are more matching users, the Next field of
+	// the response will be set. The server may return fewer users
+	// than requested, and it limits the number of users returned
+	// even if Limit is not set.
+	Limit int `httprequest:"limit,form,omitempty"`
+
+	// Next, if present, holds the Next value from a previous
+	// response and continues the query from where that response
+	// finished.
+	Next string `httprequest:"next,form,omitempty"`
+
+	// Full, if set, causes the full user records to be returned in
+	// the Users field of the response rather than just their
+	// usernames.
+	Full bool `httprequest:"full,form,omitempty"`
+}
+
+// QueryUsersResponse holds the response to a QueryUsersPageRequest.
+type QueryUsersResponse struct {
+	// Usernames holds the usernames of the matching users. It is
+	// not set when full user records were requested.
+	Usernames []string `json:"usernames,omitempty"`
+
+	// Users holds the matching users when full user records were
+	// requested.
+	Users []User `json:"users,omitempty"`
+
+	// Next holds the value to use as the Next field in a request
+	// for the next page of results. It is empty if there are no
+	// more results.
+	Next string `json:"next,omitempty"`
 }
 
 // UserRequest is a request for the user details of the named user.
@@ -113,8 +178,13 @@ type UserRequest struct {
 
 // User represents a user in the system.
 type User struct {
-	Username      Username            `json:"username,omitempty"`
-	ExternalID    string              `json:"external_id"`
+	Username   Username `json:"username,omitempty"`
+	ExternalID string   `json:"external_id"`
+
+	// LinkedExternalIDs holds any further external ids that have been
+	// linked to the user.
+	LinkedExternalIDs []string `json:"linked_external_ids,omitempty"`
+
 	FullName      string              `json:"fullname"`
 	Email         string              `json:"email"`
 	GravatarID    string              `json:"gravatar_id"`
@@ -124,6 +194,15 @@ type User struct {
 	SSHKeys       []string            `json:"ssh_keys"`
 	LastLogin     *time.Time          `json:"last_login,omitempty"`
 	LastDischarge *time.Time          `json:"last_discharge,omitempty"`
+
+	// Disabled holds the time the user was disabled. It is nil if
+	// the user is enabled.
+	Disabled       *time.Time `json:"disabled,omitempty"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+
+	// Expires holds the time after which the user can no longer be
+	// used. It is nil if the user never expires.
+	Expires *time.Time `json:"expires,omitempty"`
 }
 
 // SetUserRequest is a request to set the details of a user.
@@ -134,6 +213,40 @@ type SetUserRequest struct {
 	User              `httprequest:",body"`
 }
 
+// RemoveUserRequest is a request to remove the named user.
+type RemoveUserRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username"`
+	Username          Username `httprequest:"username,path"`
+
+	// RemoveAgents, if true, additionally removes all agent
+	// identities owned by the user.
+	RemoveAgents bool `httprequest:"remove-agents,form,omitempty"`
+}
+
+// SetUserDisabledRequest is a request to disable or enable the
+// specified user. A disabled user cannot log in, and discharges are
+// refused for them.
+type SetUserDisabledRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/disabled"`
+	Username          Username            `httprequest:"username,path"`
+	Body              SetUserDisabledBody `httprequest:",body"`
+}
+
+// SetUserDisabledBody holds the body of a SetUserDisabledRequest.
+type SetUserDisabledBody struct {
+	// Disabled holds whether the user should be disabled.
+	Disabled bool `json:"disabled"`
+
+	// Reason optionally holds the reason the user is being
+	// disabled. It is ignored when enabling a user.
+	Reason string `json:"reason,omitempty"`
+
+	// Agents, if true, additionally disables or enables all agent
+	// identities owned by the user, including those owned by the
+	// user's agents.
+	Agents bool `json:"agents,omitempty"`
+}
+
 // CreateAgentRequest is a request to add an agent.
 type CreateAgentRequest struct {
 	httprequest.Route `httprequest:"POST /v1/u"`
@@ -153,6 +266,10 @@ type CreateAgentBody struct {
 	// creating user remains a member. Only users in the write-user
 	// ACL can create a parent agent.
 	Parent bool `json:"parent,omitempty"`
+
+	// Expires optionally holds the time after which the agent can
+	// no longer be used. If it is nil the agent never expires.
+	Expires *time.Time `json:"expires,omitempty"`
 }
 
 // CreateAgentResponse holds the response from a
@@ -195,6 +312,27 @@ type ModifyGroups struct {
 	Remove []string `json:"remove"`
 }
 
+// UserGroupPathRequest is a request for the path through which the
+// specified user is a member of the specified group. It is intended for
+// debugging group membership.
+type UserGroupPathRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/groups/:group"`
+	Username          Username `httprequest:"username,path"`
+	Group             string   `httprequest:"group,path"`
+}
+
+// GroupPath is the response to a UserGroupPathRequest.
+type GroupPath struct {
+	// Member holds whether the user is a member of the group.
+	Member bool `json:"member"`
+
+	// Path holds the groups through which the user is a member of
+	// the group. It starts with a group that the user is directly a
+	// member of and ends with the requested group. Each group is a
+	// subgroup of the group that follows it.
+	Path []string `json:"path,omitempty"`
+}
+
 // UserIDPGroupsRequest defines the deprecated path for
 // UserGroupsRequest. It should no longer be used.
 type UserIDPGroupsRequest struct {
@@ -255,6 +393,52 @@ type DeleteSSHKeysBody struct {
 	SSHKeys []string `json:"ssh-keys"`
 }
 
+// ProviderIDsRequest is a request for the list of provider ids that
+// identify the specified user. The first provider id is always the one
+// the user was originally created with.
+type ProviderIDsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/provider-ids"`
+	Username          Username `httprequest:"username,path"`
+}
+
+// ProviderIDsResponse holds a response to the GET
+// /v1/u/:username/provider-ids endpoint.
+type ProviderIDsResponse struct {
+	ProviderIDs []string `json:"provider_ids"`
+}
+
+// LinkProviderIDRequest is a request to link a provider id to the
+// specified user. If the provider id already identifies another user
+// then that user is merged into the specified user.
+type LinkProviderIDRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/provider-ids"`
+	Username          Username       `httprequest:"username,path"`
+	Body              ProviderIDBody `httprequest:",body"`
+}
+
+// LinkProviderIDResponse holds the response from a
+// LinkProviderIDRequest.
+type LinkProviderIDResponse struct {
+	// Merged holds the username of the user that was merged into the
+	// specified user, if any.
+	Merged Username `json:"merged,omitempty"`
+}
+
+// UnlinkProviderIDRequest is a request to unlink a provider id from
+// the specified user. The provider id that the user was originally
+// created with cannot be unlinked.
+type UnlinkProviderIDRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/provider-ids"`
+	Username          Username       `httprequest:"username,path"`
+	Body              ProviderIDBody `httprequest:",body"`
+}
+
+// ProviderIDBody holds the body of a LinkProviderIDRequest or an
+// UnlinkProviderIDRequest.
+type ProviderIDBody struct {
+	ProviderID string `json:"provider_id"`
+}
+
 // UserExtraInfoRequest is a request for the arbitrary extra information
 // stored about the user.
 type UserExtraInfoRequest struct {
@@ -343,3 +527,321 @@ type GetUserGroupsWithIDRequest struct {
 type GroupsResponse struct {
 	Groups []string `json:"groups"`
 }
+
+// AuditRequest is a request for entries from the audit log. Entries
+// are returned most recent first.
+type AuditRequest struct {
+	httprequest.Route `httprequest:"GET /v1/audit"`
+
+	// Actor, if present, matches all entries for changes made by
+	// the given user.
+	Actor Username `httprequest:"actor,form,omitempty"`
+
+	// Target, if present, matches all entries for changes made to
+	// the given user or ACL.
+	Target string `httprequest:"target,form,omitempty"`
+
+	// Operation, if present, matches all entries for the given
+	// operation.
+	Operation string `httprequest:"operation,form,omitempty"`
+
+	// Since, if present, matches all entries recorded at or after
+	// the given time.
+	Since time.Time `httprequest:"since,form,omitempty"`
+
+	// Until, if present, matches all entries recorded before the
+	// given time.
+	Until time.Time `httprequest:"until,form,omitempty"`
+
+	// Limit, if positive, holds the maximum number of entries to
+	// return.
+	Limit int `httprequest:"limit,form,omitempty"`
+}
+
+// AuditEntry holds a single entry from the audit log.
+type AuditEntry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     Username  `json:"actor"`
+	Operation string    `json:"operation"`
+	Target    string    `json:"target"`
+	Before    []string  `json:"before,omitempty"`
+	After     []string  `json:"after,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// ChangesRequest is a request for the changes made to users. If there
+// have been no changes since the requested sequence number then the
+// server waits for a change to be made before responding.
+type ChangesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/changes"`
+
+	// Since holds the sequence number of the last change seen by
+	// the client. Only changes made after it will be returned. A
+	// client with no previous state should use zero.
+	Since uint64 `httprequest:"since,form,omitempty"`
+
+	// Wait, if positive, holds the maximum number of seconds to
+	// wait for a change to be made. The server may limit this to a
+	// shorter time.
+	Wait int `httprequest:"wait,form,omitempty"`
+}
+
+// ChangesResponse holds the response to a ChangesRequest.
+type ChangesResponse struct {
+	// Changes holds the changes that have been made, in sequence
+	// order. This will be empty if no changes were made before the
+	// wait time expired.
+	Changes []UserChange `json:"changes"`
+
+	// Next holds the value to use as the Since field in a request
+	// for the following changes.
+	Next uint64 `json:"next"`
+
+	// Reset is set when changes made after the requested sequence
+	// number have been removed from the server's change log, so
+	// they cannot be returned. The client should discard any state
+	// that depends on having seen every change and continue from
+	// Next.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// UserChange holds a single change made to a user.
+type UserChange struct {
+	// Sequence holds the sequence number of the change.
+	Sequence uint64 `json:"sequence"`
+
+	// Type holds the type of the change, one of "created",
+	// "updated" or "removed".
+	Type string `json:"type"`
+
+	// Time holds the time at which the change was made.
+	Time time.Time `json:"time"`
+
+	// Username holds the username of the changed user.
+	Username Username `json:"username"`
+
+	// ExternalID holds the external ID of the changed user.
+	ExternalID string `json:"external_id"`
+
+	// Fields holds the names of the fields of the user record that
+	// were written by the change.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// RootKeysRequest is a request for the macaroon root keys held by the
+// server. The keys themselves are never returned.
+type RootKeysRequest struct {
+	httprequest.Route `httprequest:"GET /v1/root-keys"`
+}
+
+// RootKey holds information about a macaroon root key.
+type RootKey struct {
+	// ID holds the ID of the root key.
+	ID string `json:"id"`
+
+	// Created holds the time the root key was created.
+	Created time.Time `json:"created"`
+
+	// Expires holds the time after which macaroons created with
+	// the root key will no longer be valid.
+	Expires time.Time `json:"expires"`
+
+	// Current holds whether the root key is currently used to
+	// create new macaroons.
+	Current bool `json:"current,omitempty"`
+}
+
+// RotateRootKeyRequest is a request to generate a new macaroon root
+// key that will be used for all subsequently created macaroons.
+// Macaroons created with previous root keys remain valid. The response
+// holds the new RootKey.
+type RotateRootKeyRequest struct {
+	httprequest.Route `httprequest:"POST /v1/root-keys/rotate"`
+}
+
+// RevokeRootKeyRequest is a request to remove a macaroon root key.
+// All macaroons, including discharge tokens, that were created with
+// the root key immediately become invalid.
+type RevokeRootKeyRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/root-keys/:id"`
+	ID                string `httprequest:"id,path"`
+}
+
+// SyncResult holds the result of synchronising the identities created
+// by an identity provider with an external directory, such as an LDAP
+// server. The identities changed are listed by username.
+type SyncResult struct {
+	// IDP holds the name of the identity provider.
+	IDP string `json:"idp"`
+
+	// DryRun holds whether the sync only reported the changes that
+	// would have been made, without making them.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Started holds the time the sync started.
+	Started time.Time `json:"started"`
+
+	// Finished holds the time the sync finished.
+	Finished time.Time `json:"finished"`
+
+	// Created holds the identities that were created.
+	Created []string `json:"created,omitempty"`
+
+	// Updated holds the identities whose details were changed.
+	Updated []string `json:"updated,omitempty"`
+
+	// Enabled holds the identities that were enabled again after
+	// they reappeared in the directory.
+	Enabled []string `json:"enabled,omitempty"`
+
+	// Disabled holds the identities that were disabled because they
+	// are no longer in the directory.
+	Disabled []string `json:"disabled,omitempty"`
+
+	// Removed holds the identities that were removed because they
+	// are no longer in the directory.
+	Removed []string `json:"removed,omitempty"`
+
+	// Errors holds any errors encountered synchronising individual
+	// identities.
+	Errors []string `json:"errors,omitempty"`
+
+	// Error holds the error that stopped the sync from completing,
+	// if any.
+	Error string `json:"error,omitempty"`
+}
+
+// SyncStatusRequest is a request for the result of the most recent
+// sync of each identity provider that synchronises identities with an
+// external directory. If IDP is set only that identity provider is
+// included. Identity providers that have not yet synchronised are
+// omitted. The response holds a []SyncResult.
+type SyncStatusRequest struct {
+	httprequest.Route `httprequest:"GET /v1/sync"`
+	IDP               string `httprequest:"idp,form,omitempty"`
+}
+
+// SyncRequest is a request to synchronise identities with external
+// directories immediately. If IDP is set only that identity provider
+// is synchronised, otherwise all identity providers that support
+// synchronisation are. If DryRun is set no changes are made, but the
+// results report the changes that would have been made. The response
+// holds a []SyncResult.
+type SyncRequest struct {
+	httprequest.Route `httprequest:"POST /v1/sync"`
+	IDP               string `httprequest:"idp,form,omitempty"`
+	DryRun            bool   `httprequest:"dry-run,form,omitempty"`
+}
+
+// Group holds information about a group.
+type Group struct {
+	// Name holds the name of the group.
+	Name string `json:"name"`
+
+	// Description holds a human readable description of the group.
+	Description string `json:"description,omitempty"`
+
+	// Owners holds the users and groups that are allowed to manage
+	// the membership of the group.
+	Owners []string `json:"owners,omitempty"`
+
+	// Subgroups holds the groups that are part of the group. Members
+	// of these groups are also members of the group.
+	Subgroups []string `json:"subgroups,omitempty"`
+}
+
+// GroupsRequest is a request for all the groups known to the server.
+// This includes all groups that have been stored with SetGroupRequest
+// and all groups that are stored for any user. Groups provided only by
+// an identity provider are not included. The response is a list of
+// Group values ordered by name.
+type GroupsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/g"`
+}
+
+// GroupRequest is a request for the information about a group. Groups
+// do not need to be stored in order to have members, so a Group is
+// returned for any group name.
+type GroupRequest struct {
+	httprequest.Route `httprequest:"GET /v1/g/:group"`
+	Group             string `httprequest:"group,path"`
+}
+
+// SetGroupRequest is a request to store the information about a group.
+type SetGroupRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/g/:group"`
+	Group             string       `httprequest:"group,path"`
+	Body              SetGroupBody `httprequest:",body"`
+}
+
+// SetGroupBody holds the body of a SetGroupRequest.
+type SetGroupBody struct {
+	// Description holds a human readable description of the group.
+	Description string `json:"description,omitempty"`
+
+	// Owners holds the users and groups that are allowed to manage
+	// the membership of the group.
+	Owners []string `json:"owners,omitempty"`
+
+	// Subgroups holds the groups that are part of the group. Members
+	// of these groups are also members of the group.
+	Subgroups []string `json:"subgroups,omitempty"`
+}
+
+// RemoveGroupRequest is a request to remove the stored information
+// about a group. Group membership is not changed.
+type RemoveGroupRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/g/:group"`
+	Group             string `httprequest:"group,path"`
+}
+
+// GroupMembersRequest is a request for the members of a group. Members
+// include users that have the group stored by candid and users that
+// are given the group by their identity provider. As the groups given
+// by identity providers can only be determined for each user, each
+// request examines a page of users at a time.
+type GroupMembersRequest struct {
+	httprequest.Route `httprequest:"GET /v1/g/:group/members"`
+	Group             string `httprequest:"group,path"`
+
+	// Limit, if positive, holds the maximum number of users to
+	// examine. If there are more users to examine, the Next field
+	// of the response will be set. The server may examine fewer
+	// users than requested, and it limits the number of users
+	// examined even if Limit is not set.
+	Limit int `httprequest:"limit,form,omitempty"`
+
+	// Next, if present, holds the Next value from a previous
+	// response and continues the request from where that response
+	// finished.
+	Next string `httprequest:"next,form,omitempty"`
+}
+
+// GroupMembersResponse holds the response to a GroupMembersRequest.
+type GroupMembersResponse struct {
+	// Members holds the members of the group found, ordered by
+	// username.
+	Members []GroupMember `json:"members"`
+
+	// Unresolved holds the usernames of the users examined whose
+	// groups could not be determined, ordered by username. These
+	// users might be members of the group.
+	Unresolved []Username `json:"unresolved,omitempty"`
+
+	// Next holds the value to use as the Next field in a request
+	// for the next page of results. It is empty if there are no
+	// more results.
+	Next string `json:"next,omitempty"`
+}
+
+// GroupMember holds information about a member of a group.
+type GroupMember struct {
+	// Username holds the username of the member.
+	Username Username `json:"username"`
+
+	// Stored holds whether the membership is stored by candid. If
+	// this is false then the membership was provided by the
+	// member's identity provider or by a subgroup.
+	Stored bool `json:"stored,omitempty"`
+}
@@ -4,6 +4,7 @@
 package candid
 
 import (
+	"context"
 	"html/template"
 	"net/http"
 	"sort"
@@ -62,15 +63,41 @@ type ServerParams struct {
 	// store macaroon root keys within the identity server.
 	RootKeyStore bakery.RootKeyStore
 
+	// RootKeys holds the store of macaroon root keys that is
+	// managed by the root key administration endpoints. If
+	// RootKeyStore is nil then a root key store that uses RootKeys
+	// will be used to create macaroons. If this is nil then root
+	// keys cannot be administered.
+	RootKeys store.RootKeyStore
+
+	// RootKeyPolicy holds the policy used to generate new root keys
+	// in RootKeys. If this is zero, store.DefaultRootKeyPolicy will
+	// be used.
+	RootKeyPolicy store.RootKeyPolicy
+
 	// Store holds the identities store for the identity server.
 	Store store.Store
 
 	// AdminPassword holds the password for admin login.
 	AdminPassword string
 
-	// Key holds the keypair to use with the bakery service.
+	// Key holds the keypair to use with the bakery service. It is
+	// used to decrypt third-party caveats addressed to the server
+	// and, unless ThirdPartyKeys returns a different active key, is
+	// the key advertised to clients.
 	Key *bakery.KeyPair
 
+	// ThirdPartyKeys, if set, returns other key pairs that may be
+	// used to decrypt third-party caveats addressed to the server,
+	// such as keys that were active before the key was rotated. If
+	// any keys are returned the first is the active key, which
+	// replaces Key as the key advertised to clients. It is called
+	// when the server starts, periodically while the server is
+	// running and when a caveat is received that cannot be
+	// decrypted with any key already known, so that keys added
+	// after the server started will be found.
+	ThirdPartyKeys func(context.Context) ([]*bakery.KeyPair, error)
+
 	// Location holds a URL representing the externally accessible
 	// base URL of the service, without a trailing slash.
 	Location string
@@ -111,6 +138,16 @@ type ServerParams struct {
 	// ACLStore holds the ACLStore for the identity server.
 	ACLStore aclstore.ACLStore
 
+	// AuditStore holds the store used to record changes made to
+	// identities, groups and ACLs. If this is nil then no audit
+	// log will be kept.
+	AuditStore store.AuditStore
+
+	// GroupStore holds the store used to hold information about
+	// groups, such as their owners. If this is nil then groups
+	// cannot be stored.
+	GroupStore store.GroupStore
+
 	// RedirectLoginWhitelist contains a list of URLs that are
 	// trusted to be used as return_to URLs during an interactive
 	// login.
@@ -0,0 +1,81 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// An AuditEntry is a record of a single mutation made to the data held
+// by the identity manager.
+type AuditEntry struct {
+	// ID contains the unique ID of the entry. This is assigned by
+	// the store when the entry is added.
+	ID string
+
+	// Time contains the time at which the mutation was made.
+	Time time.Time
+
+	// Actor contains the username of the identity that made the
+	// change.
+	Actor string
+
+	// Operation contains the name of the operation that was
+	// performed, for example "set-groups" or "set-acl".
+	Operation string
+
+	// Target contains the name of the entity that was changed. This
+	// will either be a username or the name of an ACL, depending on
+	// the operation.
+	Target string
+
+	// Before contains the relevant values of the target before the
+	// mutation was made.
+	Before []string
+
+	// After contains the relevant values of the target after the
+	// mutation was made.
+	After []string
+
+	// RequestID contains the ID of the HTTP request that made the
+	// change.
+	RequestID string
+}
+
+// An AuditFilter specifies which entries should be returned from
+// FindAuditEntries. Any zero valued field matches all entries.
+type AuditFilter struct {
+	// Actor matches entries with the given actor.
+	Actor string
+
+	// Target matches entries with the given target.
+	Target string
+
+	// Operation matches entries with the given operation.
+	Operation string
+
+	// Since matches entries recorded at or after the given time.
+	Since time.Time
+
+	// Until matches entries recorded before the given time.
+	Until time.Time
+
+	// Limit restricts the number of entries returned.
+	Limit int
+}
+
+// An AuditStore is a store for the audit log of changes made to
+// identities, groups and ACLs.
+type AuditStore interface {
+	// AddAuditEntry adds the given entry to the audit log. The ID
+	// of the given entry will be updated to the ID assigned by the
+	// store. If the Time of the entry is zero then the current time
+	// will be used.
+	AddAuditEntry(ctx context.Context, entry *AuditEntry) error
+
+	// FindAuditEntries returns the entries in the audit log that
+	// match the given filter, most recent first.
+	FindAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
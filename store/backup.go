@@ -0,0 +1,74 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// A KeyValue holds a value from one of the identity provider key-value
+// stores returned by a ProviderDataStore.
+type KeyValue struct {
+	// IDP contains the name of the identity provider that owns the
+	// key-value store.
+	IDP string
+
+	// Key contains the key of the value.
+	Key string
+
+	// Value contains the stored value.
+	Value []byte
+
+	// Expire contains the time at which the value expires, if it is
+	// zero the value does not expire.
+	Expire time.Time
+}
+
+// A Meeting holds an entry from a meeting store.
+type Meeting struct {
+	// ID contains the ID of the meeting.
+	ID string
+
+	// Address contains the address of the server handling the
+	// meeting.
+	Address string
+
+	// Created contains the time the meeting was created.
+	Created time.Time
+}
+
+// A BackupStore provides access to the data held by a backend that
+// cannot otherwise be enumerated or restored using the stores that the
+// backend provides, so that the backend can be backed up. Root keys are
+// backed up and restored using the backend's RootKeyStore.
+type BackupStore interface {
+	// ACLNames returns the names of all the ACLs held in the
+	// backend's ACL store.
+	ACLNames(ctx context.Context) ([]string, error)
+
+	// KeyValues calls f with every unexpired value held in the
+	// key-value stores returned by the backend's ProviderDataStore.
+	// If f returns an error then KeyValues stops and returns the
+	// error with its cause unmasked. Values can be restored by
+	// setting them in the appropriate key-value store.
+	KeyValues(ctx context.Context, f func(KeyValue) error) error
+
+	// Meetings returns all the meetings held in the backend's
+	// meeting store.
+	Meetings(ctx context.Context) ([]Meeting, error)
+
+	// InsertMeeting adds the given meeting to the backend's meeting
+	// store, preserving its creation time.
+	InsertMeeting(ctx context.Context, m Meeting) error
+
+	// InsertIdentity adds the given identity to the backend's store
+	// with the ID that it holds, rather than allocating a new one,
+	// setting the fields in the given update as Store.UpdateIdentity
+	// does. The ID must have been allocated by the same kind of
+	// backend, if it cannot be used then an error with a cause of
+	// ErrInvalidID is returned. It is an error if the ID, provider ID
+	// or username is already in use.
+	InsertIdentity(ctx context.Context, identity *Identity, update Update) error
+}
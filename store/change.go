@@ -0,0 +1,135 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"time"
+)
+
+// MaxWatchChanges holds the maximum number of changes that will be
+// returned from a single call to Store.Watch.
+const MaxWatchChanges = 1000
+
+// A ChangeType is the type of a change made to an identity.
+type ChangeType byte
+
+const (
+	NoChange ChangeType = iota
+
+	// IdentityCreated is the type of change recorded when a new
+	// identity is added to the store.
+	IdentityCreated
+
+	// IdentityUpdated is the type of change recorded when fields of
+	// an existing identity are updated.
+	IdentityUpdated
+
+	// IdentityRemoved is the type of change recorded when an
+	// identity is removed from the store.
+	IdentityRemoved
+)
+
+var changeTypeNames = []string{
+	NoChange:        "",
+	IdentityCreated: "created",
+	IdentityUpdated: "updated",
+	IdentityRemoved: "removed",
+}
+
+// String returns the name of the change type.
+func (t ChangeType) String() string {
+	if int(t) < len(changeTypeNames) {
+		return changeTypeNames[t]
+	}
+	return ""
+}
+
+var fieldNames = []string{
+	ProviderID:        "providerid",
+	Username:          "username",
+	Name:              "name",
+	Email:             "email",
+	Groups:            "groups",
+	PublicKeys:        "publickeys",
+	LastLogin:         "lastlogin",
+	LastDischarge:     "lastdischarge",
+	ProviderInfo:      "providerinfo",
+	ExtraInfo:         "extrainfo",
+	Owner:             "owner",
+	Disabled:          "disabled",
+	DisabledReason:    "disabledreason",
+	Expires:           "expires",
+	LinkedProviderIDs: "linkedproviderids",
+}
+
+// String returns the name of the field.
+func (f Field) String() string {
+	if f >= 0 && int(f) < len(fieldNames) {
+		return fieldNames[f]
+	}
+	return ""
+}
+
+// An IdentityChange records a change made to an identity.
+type IdentityChange struct {
+	// Sequence contains the sequence number of the change. Every
+	// change recorded in a store has a higher sequence number than
+	// the changes recorded before it.
+	Sequence uint64
+
+	// Type contains the type of the change.
+	Type ChangeType
+
+	// Time contains the time at which the change was made.
+	Time time.Time
+
+	// ID contains the ID of the changed identity.
+	ID string
+
+	// ProviderID contains the provider ID of the changed identity.
+	ProviderID ProviderIdentity
+
+	// Username contains the username of the changed identity.
+	Username string
+
+	// Fields contains the fields that were written by the change.
+	// It is empty when an identity is removed.
+	Fields []Field
+}
+
+// ChangedFields returns the fields that are written by the given
+// update, in field order. The LastLogin and LastDischarge fields are
+// not included as they are written every time an identity is used.
+func ChangedFields(update Update) []Field {
+	var fields []Field
+	for f, op := range update {
+		if op == NoUpdate || Field(f) == LastLogin || Field(f) == LastDischarge {
+			continue
+		}
+		fields = append(fields, Field(f))
+	}
+	return fields
+}
+
+// FieldMask returns the given fields encoded as a bit mask, suitable
+// for storing in a database.
+func FieldMask(fields []Field) int {
+	var mask int
+	for _, f := range fields {
+		mask |= 1 << uint(f)
+	}
+	return mask
+}
+
+// MaskFields returns the fields encoded in the given bit mask, as
+// created by FieldMask.
+func MaskFields(mask int) []Field {
+	var fields []Field
+	for f := Field(0); f < NumFields; f++ {
+		if mask&(1<<uint(f)) != 0 {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
-	"gopkg.in/macaroon-bakery.v2/bakery"
 
 	"github.com/canonical/candid/meeting"
 )
@@ -18,9 +17,10 @@ type Backend interface {
 	// implementation that uses the backend.
 	ProviderDataStore() ProviderDataStore
 
-	// BakeryRootKeyStore returns a new bakery.RootKeyStore
-	// implementation that uses the backend.
-	BakeryRootKeyStore() bakery.RootKeyStore
+	// RootKeyStore returns a new RootKeyStore implementation that
+	// uses the backend. Use NewBakeryRootKeyStore to create a
+	// bakery.RootKeyStore from it.
+	RootKeyStore() RootKeyStore
 
 	// MeetingStore returns a new meeting.Store implementation
 	// that uses the backend.
@@ -39,6 +39,18 @@ type Backend interface {
 	// ACLs for system functions.
 	ACLStore() aclstore.ACLStore
 
+	// AuditStore returns a new AuditStore that is used to record
+	// changes made to identities, groups and ACLs.
+	AuditStore() AuditStore
+
+	// GroupStore returns a new GroupStore that is used to store
+	// information about groups.
+	GroupStore() GroupStore
+
+	// BackupStore returns a new BackupStore that is used to back up
+	// and restore the backend.
+	BackupStore() BackupStore
+
 	// Close closes the Backend instance.
 	Close()
 }
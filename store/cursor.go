@@ -0,0 +1,37 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"encoding/base64"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// usernameCursorPrefix is added to the start of the data in a username
+// cursor so that the cursor format can be changed in the future.
+const usernameCursorPrefix = "u:"
+
+// UsernameCursor returns a cursor for use with
+// Store.FindIdentitiesPage that continues after the identity with the
+// given username.
+func UsernameCursor(username string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(usernameCursorPrefix + username))
+}
+
+// ParseUsernameCursor returns the username from a cursor created with
+// UsernameCursor. An empty cursor returns an empty username. If the
+// cursor is not valid then an error with a cause of ErrInvalidCursor is
+// returned.
+func ParseUsernameCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(buf), usernameCursorPrefix) || len(buf) == len(usernameCursorPrefix) {
+		return "", errgo.WithCausef(nil, ErrInvalidCursor, "invalid cursor %q", cursor)
+	}
+	return string(buf[len(usernameCursorPrefix):]), nil
+}
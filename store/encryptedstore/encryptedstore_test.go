@@ -0,0 +1,481 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package encryptedstore_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/encryptedstore"
+	"github.com/canonical/candid/store/memstore"
+	"github.com/canonical/candid/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	kr := newKeyring(c, "1")
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		return encryptedstore.NewStore(memstore.NewStore(), kr)
+	})
+}
+
+func TestKeyValueStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	kr := newKeyring(c, "1")
+	storetest.TestKeyValueStore(c, func(c *qt.C) store.ProviderDataStore {
+		return encryptedstore.NewProviderDataStore(memstore.NewProviderDataStore(), kr)
+	})
+}
+
+func TestIdentityDataEncrypted(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	raw := memstore.NewStore()
+	st := encryptedstore.NewStore(raw, newKeyring(c, "1"))
+	identity := store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "bob"),
+		Username:     "bob",
+		ProviderInfo: map[string][]string{"token": {"secret1"}},
+		ExtraInfo:    map[string][]string{"extra": {"secret2", "secret3"}},
+	}
+	err := st.UpdateIdentity(ctx, &identity, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+		store.ExtraInfo:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	rawIdentity := store.Identity{Username: "bob"}
+	err = raw.Identity(ctx, &rawIdentity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(rawIdentity.ProviderInfo["token"], qt.HasLen, 1)
+	c.Assert(rawIdentity.ExtraInfo["extra"], qt.HasLen, 2)
+	for _, v := range append(rawIdentity.ProviderInfo["token"], rawIdentity.ExtraInfo["extra"]...) {
+		c.Assert(strings.Contains(v, "secret"), qt.Equals, false)
+	}
+
+	identity2 := store.Identity{Username: "bob"}
+	err = st.Identity(ctx, &identity2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity2.ProviderInfo, qt.DeepEquals, identity.ProviderInfo)
+	c.Assert(identity2.ExtraInfo, qt.DeepEquals, identity.ExtraInfo)
+}
+
+func TestKeyValueDataEncrypted(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	raw := memstore.NewProviderDataStore()
+	rawKV, err := raw.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	kv, err := encryptedstore.NewProviderDataStore(raw, newKeyring(c, "1")).KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+
+	err = kv.Set(ctx, "key", []byte("secret"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	data, err := rawKV.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(strings.Contains(string(data), "secret"), qt.Equals, false)
+
+	data, err = kv.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, "secret")
+}
+
+func TestIdentityDataBoundToContext(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	raw := memstore.NewStore()
+	st := encryptedstore.NewStore(raw, newKeyring(c, "1"))
+	for _, name := range []string{"alice", "bob"} {
+		err := st.UpdateIdentity(ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	// Values set on an identity specified by username are bound
+	// to its provider ID.
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		Username:     "bob",
+		ProviderInfo: map[string][]string{"token": {"secret"}},
+	}, store.Update{
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	identity := store.Identity{Username: "bob"}
+	err = st.Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.ProviderInfo, qt.DeepEquals, map[string][]string{"token": {"secret"}})
+
+	rawIdentity := store.Identity{Username: "bob"}
+	err = raw.Identity(ctx, &rawIdentity)
+	c.Assert(err, qt.IsNil)
+	encrypted := rawIdentity.ProviderInfo["token"]
+
+	tests := []struct {
+		about       string
+		identity    store.Identity
+		update      store.Update
+		expectError string
+	}{{
+		about: "another identity",
+		identity: store.Identity{
+			Username:     "alice",
+			ProviderInfo: map[string][]string{"token": encrypted},
+		},
+		update:      store.Update{store.ProviderInfo: store.Set},
+		expectError: `cannot decrypt provider info for "test:alice": cannot decrypt data key: .*`,
+	}, {
+		about: "another field",
+		identity: store.Identity{
+			Username:  "bob",
+			ExtraInfo: map[string][]string{"token": encrypted},
+		},
+		update:      store.Update{store.ExtraInfo: store.Set},
+		expectError: `cannot decrypt extra info for "test:bob": cannot decrypt data key: .*`,
+	}, {
+		about: "another key",
+		identity: store.Identity{
+			Username:     "bob",
+			ProviderInfo: map[string][]string{"other": encrypted},
+		},
+		update:      store.Update{store.ProviderInfo: store.Set},
+		expectError: `cannot decrypt provider info for "test:bob": cannot decrypt data key: .*`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			identity := test.identity
+			err := raw.UpdateIdentity(ctx, &identity, test.update)
+			c.Assert(err, qt.IsNil)
+			err = st.Identity(ctx, &store.Identity{Username: identity.Username})
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestKeyValueDataBoundToContext(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	raw := memstore.NewProviderDataStore()
+	pds := encryptedstore.NewProviderDataStore(raw, newKeyring(c, "1"))
+	kv, err := pds.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	err = kv.Set(ctx, "key", []byte("secret"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	rawKV, err := raw.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	data, err := rawKV.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+
+	// The value cannot be read from another key.
+	err = rawKV.Set(ctx, "other", data, time.Time{})
+	c.Assert(err, qt.IsNil)
+	_, err = kv.Get(ctx, "other")
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt "other": cannot decrypt data key: .*`)
+
+	// The value cannot be read from another store.
+	rawKV2, err := raw.KeyValueStore(ctx, "test2")
+	c.Assert(err, qt.IsNil)
+	err = rawKV2.Set(ctx, "key", data, time.Time{})
+	c.Assert(err, qt.IsNil)
+	kv2, err := pds.KeyValueStore(ctx, "test2")
+	c.Assert(err, qt.IsNil)
+	_, err = kv2.Get(ctx, "key")
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt "key": cannot decrypt data key: .*`)
+}
+
+func TestReadUnencryptedData(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	raw := memstore.NewStore()
+	err := raw.UpdateIdentity(ctx, &store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "bob"),
+		Username:     "bob",
+		ProviderInfo: map[string][]string{"k1": {"v1", "v2"}},
+	}, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	st := encryptedstore.NewStore(raw, newKeyring(c, "1"))
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		Username:     "bob",
+		ProviderInfo: map[string][]string{"k1": {"v1", "v3"}},
+	}, store.Update{
+		store.ProviderInfo: store.Pull,
+	})
+	c.Assert(err, qt.IsNil)
+
+	identity := store.Identity{Username: "bob"}
+	err = st.Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.ProviderInfo, qt.DeepEquals, map[string][]string{"k1": {"v2"}})
+}
+
+func TestReEncrypt(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	raw := memstore.NewStore()
+	err := raw.UpdateIdentity(ctx, &store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "alice"),
+		Username:     "alice",
+		ProviderInfo: map[string][]string{"k1": {"v1"}},
+	}, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	keys1 := newKeys("1")
+	kr1, err := encryptedstore.NewKeyring(keys1)
+	c.Assert(err, qt.IsNil)
+	err = encryptedstore.NewStore(raw, kr1).UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		ExtraInfo:  map[string][]string{"k2": {"v2"}},
+	}, store.Update{
+		store.Username:  store.Set,
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = raw.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "carol"),
+		Username:   "carol",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	kr2, err := encryptedstore.NewKeyring(append(newKeys("2"), keys1...))
+	c.Assert(err, qt.IsNil)
+	n, err := encryptedstore.ReEncrypt(ctx, raw, kr2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	identities, err := raw.FindIdentities(ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	for _, identity := range identities {
+		for _, vs := range identity.ProviderInfo {
+			for _, v := range vs {
+				c.Assert(kr2.NeedsReEncrypt([]byte(v)), qt.Equals, false)
+			}
+		}
+		for _, vs := range identity.ExtraInfo {
+			for _, v := range vs {
+				c.Assert(kr2.NeedsReEncrypt([]byte(v)), qt.Equals, false)
+			}
+		}
+	}
+
+	// Running again has nothing to do.
+	n, err = encryptedstore.ReEncrypt(ctx, raw, kr2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	// All data can now be read without the old key.
+	identities, err = encryptedstore.NewStore(raw, newKeyring(c, "2")).FindIdentities(ctx, &store.Identity{}, store.Filter{}, []store.Sort{{Field: store.Username}}, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 3)
+	c.Assert(identities[0].ProviderInfo, qt.DeepEquals, map[string][]string{"k1": {"v1"}})
+	c.Assert(identities[1].ExtraInfo, qt.DeepEquals, map[string][]string{"k2": {"v2"}})
+}
+
+func TestConcurrentPush(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	st := encryptedstore.NewStore(memstore.NewStore(), newKeyring(c, "1"))
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	const n = 5
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update := store.Update{
+				store.ExtraInfo: store.Push,
+			}
+			errs[i] = st.UpdateIdentity(ctx, &store.Identity{
+				Username:  "bob",
+				ExtraInfo: map[string][]string{"k1": {fmt.Sprintf("v%d", i)}},
+			}, update)
+			// The caller's update is not changed.
+			c.Check(update, qt.Equals, store.Update{store.ExtraInfo: store.Push})
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		c.Assert(err, qt.IsNil)
+	}
+
+	identity := store.Identity{Username: "bob"}
+	err = st.Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	sort.Strings(identity.ExtraInfo["k1"])
+	c.Assert(identity.ExtraInfo, qt.DeepEquals, map[string][]string{
+		"k1": {"v0", "v1", "v2", "v3", "v4"},
+	})
+}
+
+func TestReEncryptConflict(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	keys1 := newKeys("1")
+	kr1, err := encryptedstore.NewKeyring(keys1)
+	c.Assert(err, qt.IsNil)
+	kr2, err := encryptedstore.NewKeyring(append(newKeys("2"), keys1...))
+	c.Assert(err, qt.IsNil)
+
+	raw := memstore.NewStore()
+	err = encryptedstore.NewStore(raw, kr1).UpdateIdentity(ctx, &store.Identity{
+		ProviderID:   store.MakeProviderIdentity("test", "bob"),
+		Username:     "bob",
+		ProviderInfo: map[string][]string{"token": {"old-token"}},
+	}, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Simulate a login that writes a new token while the
+	// identity is being re-encrypted.
+	st := &replaceHookStore{
+		Store: raw,
+		hook: func() {
+			err := encryptedstore.NewStore(raw, kr2).UpdateIdentity(ctx, &store.Identity{
+				Username:     "bob",
+				ProviderInfo: map[string][]string{"token": {"new-token"}},
+			}, store.Update{
+				store.ProviderInfo: store.Set,
+			})
+			c.Check(err, qt.IsNil)
+		},
+	}
+	n, err := encryptedstore.ReEncrypt(ctx, st, kr2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	identity := store.Identity{Username: "bob"}
+	err = encryptedstore.NewStore(raw, newKeyring(c, "2")).Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.ProviderInfo, qt.DeepEquals, map[string][]string{"token": {"new-token"}})
+}
+
+// replaceHookStore is a store.Store that calls hook before the first
+// call to ReplaceInfo.
+type replaceHookStore struct {
+	store.Store
+	hook func()
+}
+
+func (s *replaceHookStore) ReplaceInfo(ctx context.Context, id string, old, new *store.Identity) error {
+	if s.hook != nil {
+		s.hook()
+		s.hook = nil
+	}
+	return s.Store.ReplaceInfo(ctx, id, old, new)
+}
+
+func TestReEncryptKeyValues(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	keys1 := newKeys("1")
+	kr1, err := encryptedstore.NewKeyring(keys1)
+	c.Assert(err, qt.IsNil)
+	kr2, err := encryptedstore.NewKeyring(append(newKeys("2"), keys1...))
+	c.Assert(err, qt.IsNil)
+
+	backend := memstore.NewBackend()
+	raw := backend.ProviderDataStore()
+	rawKV, err := raw.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	err = rawKV.Set(ctx, "k1", []byte("v1"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	kv1, err := encryptedstore.NewProviderDataStore(raw, kr1).KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	expire := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	err = kv1.Set(ctx, "k2", []byte("v2"), expire)
+	c.Assert(err, qt.IsNil)
+	kv2, err := encryptedstore.NewProviderDataStore(raw, kr2).KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	err = kv2.Set(ctx, "k3", []byte("v3"), time.Time{})
+	c.Assert(err, qt.IsNil)
+
+	n, err := encryptedstore.ReEncryptKeyValues(ctx, backend.BackupStore(), raw, kr2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	// Running again has nothing to do.
+	n, err = encryptedstore.ReEncryptKeyValues(ctx, backend.BackupStore(), raw, kr2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	// All data can now be read without the old key.
+	kv, err := encryptedstore.NewProviderDataStore(raw, newKeyring(c, "2")).KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	for _, k := range []string{"k1", "k2", "k3"} {
+		data, err := kv.Get(ctx, k)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(data), qt.Equals, "v"+k[1:])
+		data, err = rawKV.Get(ctx, k)
+		c.Assert(err, qt.IsNil)
+		c.Assert(kr2.NeedsReEncrypt(data), qt.Equals, false)
+	}
+
+	// Expiry times are kept.
+	var expires []time.Time
+	err = backend.BackupStore().KeyValues(ctx, func(kv store.KeyValue) error {
+		if kv.Key == "k2" {
+			expires = append(expires, kv.Expire)
+		}
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(expires, qt.HasLen, 1)
+	c.Assert(expires[0].Equal(expire), qt.Equals, true)
+}
+
+func newKeyring(c *qt.C, id string) *encryptedstore.Keyring {
+	kr, err := encryptedstore.NewKeyring(newKeys(id))
+	c.Assert(err, qt.IsNil)
+	return kr
+}
+
+func newKeys(id string) []encryptedstore.Key {
+	var key encryptedstore.AESKey
+	copy(key[:], strings.Repeat(id, encryptedstore.KeyLen))
+	return []encryptedstore.Key{{ID: id, Key: key}}
+}
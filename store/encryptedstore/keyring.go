@@ -0,0 +1,278 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package encryptedstore provides stores that encrypt sensitive data
+// before it is written to an underlying store.
+//
+// Data is protected using envelope encryption: every value is encrypted
+// with its own randomly generated data key, and that data key is itself
+// encrypted with a key-encryption key from a Keyring. The identifier of
+// the key-encryption key is stored alongside the encrypted value, so
+// that the key-encryption key can be rotated by adding a new key to the
+// front of the Keyring while retaining the old keys until all data has
+// been re-encrypted (see ReEncrypt).
+//
+// Every value is bound to the context in which it is stored, such as
+// the provider ID of its identity and its field and key, so that an
+// encrypted value cannot be decrypted after being moved elsewhere in
+// the store.
+package encryptedstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// KeyLen holds the length in bytes of a key-encryption key.
+const KeyLen = 32
+
+// ErrUnknownKey is the error cause returned when stored data was
+// encrypted with a key that is not in the keyring.
+var ErrUnknownKey = errgo.New("unknown encryption key")
+
+// prefix is the prefix of all values encrypted by this package. Values
+// without this prefix, or prefixV1, are assumed to have been written
+// before encryption was enabled and are returned unaltered.
+const prefix = "$candid-enc2$"
+
+// prefixV1 is the prefix of values encrypted before values were bound
+// to their context. They can still be decrypted, but always need to
+// be re-encrypted.
+const prefixV1 = "$candid-enc1$"
+
+// An AESKey holds an AES-256 key. It marshals and unmarshals as base64
+// text.
+type AESKey [KeyLen]byte
+
+// MarshalText implements encoding.TextMarshaler.
+func (k AESKey) MarshalText() ([]byte, error) {
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(k)))
+	base64.StdEncoding.Encode(data, k[:])
+	return data, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *AESKey) UnmarshalText(data []byte) error {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(buf, data)
+	if err != nil {
+		return errgo.Notef(err, "cannot decode key")
+	}
+	if n != KeyLen {
+		return errgo.Newf("wrong length for key, got %d want %d", n, KeyLen)
+	}
+	copy(k[:], buf)
+	return nil
+}
+
+// A Key is a key-encryption key.
+type Key struct {
+	// ID identifies the key. It is stored with every value
+	// encrypted using the key so must not be changed while any data
+	// is encrypted with it. It must not contain a '$' character.
+	ID string `yaml:"id"`
+
+	// Key holds the key itself.
+	Key AESKey `yaml:"key"`
+}
+
+// A Keyring holds the key-encryption keys used to protect stored data.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a new Keyring holding the given keys. The first key
+// is the current key which is used to encrypt all new data, the other
+// keys are only used to decrypt data written using them.
+func NewKeyring(keys []Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errgo.New("no encryption keys specified")
+	}
+	kr := &Keyring{
+		current: keys[0].ID,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for _, k := range keys {
+		if k.ID == "" {
+			return nil, errgo.New("encryption key has no id")
+		}
+		if strings.Contains(k.ID, "$") {
+			return nil, errgo.Newf("invalid encryption key id %q", k.ID)
+		}
+		if _, ok := kr.aeads[k.ID]; ok {
+			return nil, errgo.Newf("duplicate encryption key id %q", k.ID)
+		}
+		aead, err := newAEAD(k.Key[:])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		kr.aeads[k.ID] = aead
+	}
+	return kr, nil
+}
+
+// Current returns the ID of the key used to encrypt new data.
+func (kr *Keyring) Current() string {
+	return kr.current
+}
+
+// Encrypt encrypts the given plaintext with a new data key which is in
+// turn encrypted with the current key-encryption key. Both are bound to
+// the given context, the same context must be used to decrypt the
+// value.
+func (kr *Keyring) Encrypt(plaintext []byte, context ...string) ([]byte, error) {
+	var dataKey [KeyLen]byte
+	if _, err := rand.Read(dataKey[:]); err != nil {
+		return nil, errgo.Notef(err, "cannot generate data key")
+	}
+	ad := additionalData(context)
+	wrappedKey, err := seal(kr.aeads[kr.current], dataKey[:], ad)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := newAEAD(dataKey[:])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ciphertext, err := seal(aead, plaintext, ad)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(prefix)
+	buf.WriteString(kr.current)
+	buf.WriteByte('$')
+	buf.WriteString(base64.RawStdEncoding.EncodeToString(wrappedKey))
+	buf.WriteByte('$')
+	buf.WriteString(base64.RawStdEncoding.EncodeToString(ciphertext))
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts data previously encrypted with Encrypt using the
+// given context. Data that was not encrypted is returned unaltered. If
+// the data was encrypted with a key that is not in the keyring then an
+// error with a cause of ErrUnknownKey is returned.
+func (kr *Keyring) Decrypt(data []byte, context ...string) ([]byte, error) {
+	var ad []byte
+	switch {
+	case bytes.HasPrefix(data, []byte(prefix)):
+		data = data[len(prefix):]
+		ad = additionalData(context)
+	case bytes.HasPrefix(data, []byte(prefixV1)):
+		data = data[len(prefixV1):]
+	default:
+		return data, nil
+	}
+	parts := strings.Split(string(data), "$")
+	if len(parts) != 3 {
+		return nil, errgo.New("invalid encrypted value")
+	}
+	kek, ok := kr.aeads[parts[0]]
+	if !ok {
+		return nil, errgo.WithCausef(nil, ErrUnknownKey, "cannot decrypt value: key %q not found", parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid encrypted value")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid encrypted value")
+	}
+	dataKey, err := open(kek, wrappedKey, ad)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt data key")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	plaintext, err := open(aead, ciphertext, ad)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt value")
+	}
+	return plaintext, nil
+}
+
+// NeedsReEncrypt reports whether the given stored data is either not
+// encrypted or not encrypted with the current key.
+func (kr *Keyring) NeedsReEncrypt(data []byte) bool {
+	return !bytes.HasPrefix(data, []byte(prefix+kr.current+"$"))
+}
+
+// reEncrypt decrypts the given stored data and encrypts it with the
+// current key, using the given context for both.
+func (kr *Keyring) reEncrypt(data []byte, context ...string) ([]byte, error) {
+	plaintext, err := kr.Decrypt(data, context...)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrUnknownKey))
+	}
+	return kr.Encrypt(plaintext, context...)
+}
+
+// encryptString is like Encrypt but operates on strings.
+func (kr *Keyring) encryptString(s string, context ...string) (string, error) {
+	data, err := kr.Encrypt([]byte(s), context...)
+	return string(data), err
+}
+
+// decryptString is like Decrypt but operates on strings.
+func (kr *Keyring) decryptString(s string, context ...string) (string, error) {
+	data, err := kr.Decrypt([]byte(s), context...)
+	return string(data), err
+}
+
+// additionalData returns the additional data used to bind a value to
+// the given context. Each element is prefixed with its length so that
+// different contexts always give different data.
+func additionalData(context []string) []byte {
+	var buf bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	for _, s := range context {
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(s)))])
+		buf.WriteString(s)
+	}
+	return buf.Bytes()
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
+
+// seal encrypts the given plaintext and additional data with a random
+// nonce, which is prepended to the returned ciphertext.
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errgo.Notef(err, "cannot generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts ciphertext created by seal with the same additional
+// data.
+func open(aead cipher.AEAD, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errgo.New("ciphertext too short")
+	}
+	n := aead.NonceSize()
+	// Use a non-nil destination so that an empty plaintext is
+	// returned as an empty, rather than nil, slice.
+	return aead.Open([]byte{}, ciphertext[:n], ciphertext[n:], ad)
+}
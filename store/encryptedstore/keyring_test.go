@@ -0,0 +1,161 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package encryptedstore_test
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store/encryptedstore"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	c := qt.New(t)
+
+	kr := newKeyring(c, "1")
+	data1, err := kr.Encrypt([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	data2, err := kr.Encrypt([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data1), qt.Not(qt.Equals), string(data2))
+	c.Assert(kr.NeedsReEncrypt(data1), qt.Equals, false)
+
+	for _, data := range [][]byte{data1, data2} {
+		plaintext, err := kr.Decrypt(data)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(plaintext), qt.Equals, "hello")
+	}
+}
+
+func TestDecryptWrongContext(t *testing.T) {
+	c := qt.New(t)
+
+	kr := newKeyring(c, "1")
+	data, err := kr.Encrypt([]byte("hello"), "a", "b")
+	c.Assert(err, qt.IsNil)
+	plaintext, err := kr.Decrypt(data, "a", "b")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(plaintext), qt.Equals, "hello")
+
+	for _, context := range [][]string{nil, {"a"}, {"a", "c"}, {"ab"}, {"a", "b", ""}} {
+		_, err := kr.Decrypt(data, context...)
+		c.Assert(err, qt.ErrorMatches, `cannot decrypt data key: .*`, qt.Commentf("%q", context))
+	}
+}
+
+// v1Data holds "hello" encrypted by the key from newKeys("1") before
+// values were bound to their context.
+const v1Data = "$candid-enc1$1$0UI52xBx+Uo1t9ivlGBdbxPhU+DUWmBSkiVyNxjmMQV7FQqUFL1Xg3IAXDbdCNKDREqzFoiUTO1TSvSl$ov5/BGyK/CqxMRC4ldK+2zjvfHK8Z9g3HVgsKP6ZUbsQ"
+
+func TestDecryptV1(t *testing.T) {
+	c := qt.New(t)
+
+	kr := newKeyring(c, "1")
+	plaintext, err := kr.Decrypt([]byte(v1Data), "a", "b")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(plaintext), qt.Equals, "hello")
+	c.Assert(kr.NeedsReEncrypt([]byte(v1Data)), qt.Equals, true)
+}
+
+func TestDecryptUnencrypted(t *testing.T) {
+	c := qt.New(t)
+
+	kr := newKeyring(c, "1")
+	plaintext, err := kr.Decrypt([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(plaintext), qt.Equals, "hello")
+	c.Assert(kr.NeedsReEncrypt([]byte("hello")), qt.Equals, true)
+}
+
+func TestDecryptWithOldKey(t *testing.T) {
+	c := qt.New(t)
+
+	keys1 := newKeys("1")
+	kr1, err := encryptedstore.NewKeyring(keys1)
+	c.Assert(err, qt.IsNil)
+	data, err := kr1.Encrypt([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+
+	kr2, err := encryptedstore.NewKeyring(append(newKeys("2"), keys1...))
+	c.Assert(err, qt.IsNil)
+	c.Assert(kr2.Current(), qt.Equals, "2")
+	c.Assert(kr2.NeedsReEncrypt(data), qt.Equals, true)
+	plaintext, err := kr2.Decrypt(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(plaintext), qt.Equals, "hello")
+
+	_, err = newKeyring(c, "2").Decrypt(data)
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt value: key "1" not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, encryptedstore.ErrUnknownKey)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	c := qt.New(t)
+
+	kr := newKeyring(c, "1")
+	data, err := kr.Encrypt([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	// Change the first character of the encoded ciphertext, which
+	// always leaves valid base64.
+	i := bytes.LastIndexByte(data, '$') + 1
+	if data[i] == 'A' {
+		data[i] = 'B'
+	} else {
+		data[i] = 'A'
+	}
+	_, err = kr.Decrypt(data)
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt value: .*`)
+}
+
+var newKeyringErrorTests = []struct {
+	about       string
+	keys        []encryptedstore.Key
+	expectError string
+}{{
+	about:       "no keys",
+	expectError: `no encryption keys specified`,
+}, {
+	about:       "no id",
+	keys:        []encryptedstore.Key{{}},
+	expectError: `encryption key has no id`,
+}, {
+	about:       "invalid id",
+	keys:        []encryptedstore.Key{{ID: "a$b"}},
+	expectError: `invalid encryption key id "a\$b"`,
+}, {
+	about:       "duplicate id",
+	keys:        []encryptedstore.Key{{ID: "1"}, {ID: "2"}, {ID: "1"}},
+	expectError: `duplicate encryption key id "1"`,
+}}
+
+func TestNewKeyringError(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range newKeyringErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := encryptedstore.NewKeyring(test.keys)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestAESKeyUnmarshalText(t *testing.T) {
+	c := qt.New(t)
+
+	var key encryptedstore.AESKey
+	err := key.UnmarshalText([]byte("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="))
+	c.Assert(err, qt.IsNil)
+	for i := range key {
+		c.Assert(key[i], qt.Equals, byte(i))
+	}
+	data, err := key.MarshalText()
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")
+
+	err = key.UnmarshalText([]byte("AAEC"))
+	c.Assert(err, qt.ErrorMatches, `wrong length for key, got 3 want 32`)
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package encryptedstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewProviderDataStore returns a store.ProviderDataStore that encrypts
+// all values written to the key-value stores of the given
+// ProviderDataStore. Keys are stored unencrypted. Each value is bound
+// to the name of its key-value store and its key.
+//
+// Values written with an old key are re-encrypted with the current key
+// by ReEncryptKeyValues.
+func NewProviderDataStore(s store.ProviderDataStore, kr *Keyring) store.ProviderDataStore {
+	return &providerDataStore{
+		ProviderDataStore: s,
+		kr:                kr,
+	}
+}
+
+type providerDataStore struct {
+	store.ProviderDataStore
+	kr *Keyring
+}
+
+// KeyValueStore implements store.ProviderDataStore.KeyValueStore.
+func (s *providerDataStore) KeyValueStore(ctx context.Context, idp string) (simplekv.Store, error) {
+	kv, err := s.ProviderDataStore.KeyValueStore(ctx, idp)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &keyValueStore{
+		Store: kv,
+		name:  idp,
+		kr:    s.kr,
+	}, nil
+}
+
+// keyValueStore implements an encrypting simplekv.Store.
+type keyValueStore struct {
+	simplekv.Store
+	name string
+	kr   *Keyring
+}
+
+// Get implements simplekv.Store.Get.
+func (s *keyValueStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.Store.Get(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	value, err := s.kr.Decrypt(data, s.name, key)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt %q", key)
+	}
+	return value, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *keyValueStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	data, err := s.kr.Encrypt(value, s.name, key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.Store.Set(ctx, key, data, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *keyValueStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	err := s.Store.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		if old != nil {
+			var err error
+			if old, err = s.kr.Decrypt(old, s.name, key); err != nil {
+				return nil, errgo.Notef(err, "cannot decrypt %q", key)
+			}
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		data, err := s.kr.Encrypt(value, s.name, key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return data, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
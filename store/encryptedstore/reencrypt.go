@@ -0,0 +1,222 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package encryptedstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/loggo"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.store.encryptedstore")
+
+// reEncryptPageSize holds the number of identities read from the store
+// at a time by ReEncrypt.
+const reEncryptPageSize = 100
+
+// ReEncrypt re-encrypts the ProviderInfo and ExtraInfo values of every
+// identity in the given store that are either unencrypted or encrypted
+// with a key other than the current key in the given keyring. The store
+// must be the underlying store, not one returned by NewStore. It
+// returns the number of identities that were updated.
+//
+// Values are replaced using ReplaceInfo, so values that are changed
+// while ReEncrypt is running are not overwritten.
+//
+// Once ReEncrypt and ReEncryptKeyValues have completed successfully,
+// keys other than the current key are no longer required.
+func ReEncrypt(ctx context.Context, st store.Store, kr *Keyring) (int, error) {
+	ctx, close := st.Context(ctx)
+	defer close()
+	n := 0
+	cursor := ""
+	for {
+		identities, next, err := st.FindIdentitiesPage(ctx, &store.Identity{}, store.Filter{}, cursor, reEncryptPageSize)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		for i := range identities {
+			ok, err := reEncryptIdentity(ctx, st, kr, &identities[i])
+			if err != nil {
+				return n, errgo.Notef(err, "cannot re-encrypt %q", identities[i].ProviderID)
+			}
+			if ok {
+				n++
+			}
+		}
+		if next == "" {
+			return n, nil
+		}
+		cursor = next
+	}
+}
+
+// reEncryptIdentity re-encrypts the stale values of the given identity,
+// which has been read from the given store. If the values are changed
+// concurrently then the identity is read again and the re-encryption
+// is retried. It reports whether any values were re-encrypted.
+func reEncryptIdentity(ctx context.Context, st store.Store, kr *Keyring, identity *store.Identity) (bool, error) {
+	for i := 0; ; i++ {
+		var old, new store.Identity
+		old.ProviderInfo, new.ProviderInfo = staleInfo(kr, identity.ProviderID, store.ProviderInfo, identity.ProviderInfo)
+		old.ExtraInfo, new.ExtraInfo = staleInfo(kr, identity.ProviderID, store.ExtraInfo, identity.ExtraInfo)
+		if old.ProviderInfo == nil && old.ExtraInfo == nil {
+			return false, nil
+		}
+		err := st.ReplaceInfo(ctx, identity.ID, &old, &new)
+		switch {
+		case err == nil:
+			return true, nil
+		case errgo.Cause(err) == store.ErrNotFound:
+			// The identity has been removed since it was found.
+			return false, nil
+		case errgo.Cause(err) != store.ErrConflict || i == maxReplaceAttempts-1:
+			return false, errgo.Mask(err)
+		}
+		identity = &store.Identity{ID: identity.ID}
+		if err := st.Identity(ctx, identity); err != nil {
+			if errgo.Cause(err) == store.ErrNotFound {
+				return false, nil
+			}
+			return false, errgo.Mask(err)
+		}
+	}
+}
+
+// staleInfo returns the stored values of all the keys in the given
+// ProviderInfo or ExtraInfo map of the identity with the given provider
+// ID that have any value that needs to be re-encrypted, along with the
+// values re-encrypted with the current key. It returns nil maps if
+// there are no such keys, or if any of the values cannot be
+// re-encrypted.
+func staleInfo(kr *Keyring, providerID store.ProviderIdentity, field store.Field, info map[string][]string) (old, new map[string][]string) {
+	for k, vs := range info {
+		needsReEncrypt := false
+		for _, v := range vs {
+			if kr.NeedsReEncrypt([]byte(v)) {
+				needsReEncrypt = true
+				break
+			}
+		}
+		if !needsReEncrypt {
+			continue
+		}
+		encvs := make([]string, len(vs))
+		for i, v := range vs {
+			data, err := kr.reEncrypt([]byte(v), infoContext(providerID, field, k)...)
+			if err != nil {
+				logger.Errorf("cannot re-encrypt %q: %s", k, err)
+				return nil, nil
+			}
+			encvs[i] = string(data)
+		}
+		if old == nil {
+			old = make(map[string][]string)
+			new = make(map[string][]string)
+		}
+		old[k] = vs
+		new[k] = encvs
+	}
+	return old, new
+}
+
+// errNotStale is used to abandon the update of a key-value store value
+// that no longer needs to be re-encrypted.
+var errNotStale = errgo.New("value does not need re-encrypting")
+
+// ReEncryptKeyValues re-encrypts every value held in the key-value
+// stores of the given ProviderDataStore that is either unencrypted or
+// encrypted with a key other than the current key in the given
+// keyring. The values are found using the given BackupStore, which must
+// be from the same backend as the ProviderDataStore. The
+// ProviderDataStore must be the underlying store, not one returned by
+// NewProviderDataStore. It returns the number of values that were
+// updated.
+//
+// Values are replaced using the key-value store's Update method, so
+// values that are changed while ReEncryptKeyValues is running are not
+// overwritten.
+func ReEncryptKeyValues(ctx context.Context, bs store.BackupStore, pds store.ProviderDataStore, kr *Keyring) (int, error) {
+	// Find the stale values before updating any, as the key-value
+	// stores cannot be written while they are being enumerated.
+	var stale []store.KeyValue
+	err := bs.KeyValues(ctx, func(kv store.KeyValue) error {
+		if kr.NeedsReEncrypt(kv.Value) {
+			kv.Value = nil
+			stale = append(stale, kv)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	n := 0
+	for _, skv := range stale {
+		kv, err := pds.KeyValueStore(ctx, skv.IDP)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		err = kv.Update(ctx, skv.Key, skv.Expire, func(old []byte) ([]byte, error) {
+			if old == nil || !kr.NeedsReEncrypt(old) {
+				// The value has been removed or
+				// rewritten since it was found.
+				return nil, errNotStale
+			}
+			data, err := kr.reEncrypt(old, skv.IDP, skv.Key)
+			if err != nil {
+				logger.Errorf("cannot re-encrypt value %q for %q: %s", skv.Key, skv.IDP, err)
+				return nil, errNotStale
+			}
+			return data, nil
+		})
+		if errgo.Cause(err) == errNotStale {
+			continue
+		}
+		if err != nil {
+			return n, errgo.Notef(err, "cannot re-encrypt value %q for %q", skv.Key, skv.IDP)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// RunReEncrypt calls ReEncrypt on the given store and
+// ReEncryptKeyValues on the given BackupStore and ProviderDataStore,
+// logging the results. If either fails they are retried after the
+// given interval until they succeed or the given context is done. It
+// is intended to be run in its own goroutine when a server starts.
+func RunReEncrypt(ctx context.Context, st store.Store, bs store.BackupStore, pds store.ProviderDataStore, kr *Keyring, retryInterval time.Duration) {
+	identitiesDone := false
+	for {
+		var err error
+		if !identitiesDone {
+			var n int
+			n, err = ReEncrypt(ctx, st, kr)
+			if err == nil {
+				logger.Infof("re-encrypted %d identities with key %q", n, kr.Current())
+				identitiesDone = true
+			} else {
+				logger.Errorf("cannot re-encrypt identities (%d re-encrypted): %s", n, err)
+			}
+		}
+		if identitiesDone {
+			var n int
+			n, err = ReEncryptKeyValues(ctx, bs, pds, kr)
+			if err == nil {
+				logger.Infof("re-encrypted %d key-value store values with key %q", n, kr.Current())
+				return
+			}
+			logger.Errorf("cannot re-encrypt key-value store values (%d re-encrypted): %s", n, err)
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package encryptedstore
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewStore returns a store.Store that encrypts the values in the
+// ProviderInfo and ExtraInfo fields of every identity before it is
+// written to the given store, and decrypts them when identities are
+// read. The keys of the ProviderInfo and ExtraInfo maps, and all other
+// identity fields, are stored unencrypted so that they can still be
+// used for searching. Each value is bound to the provider ID of its
+// identity, its field and its key, so it cannot be decrypted if it is
+// moved to another identity, field or key.
+func NewStore(s store.Store, kr *Keyring) store.Store {
+	return &identityStore{
+		Store: s,
+		kr:    kr,
+	}
+}
+
+// identityStore implements an encrypting store.Store. Methods that do
+// not read or write identity information are passed directly to the
+// underlying store.
+type identityStore struct {
+	store.Store
+	kr *Keyring
+}
+
+// Identity implements store.Store.Identity.
+func (s *identityStore) Identity(ctx context.Context, identity *store.Identity) error {
+	if err := s.Store.Identity(ctx, identity); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.decryptIdentity(identity))
+}
+
+// FindIdentities implements store.Store.FindIdentities.
+func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	identities, err := s.Store.FindIdentities(ctx, ref, filter, sort, skip, limit)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for i := range identities {
+		if err := s.decryptIdentity(&identities[i]); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return identities, nil
+}
+
+// FindIdentitiesPage implements store.Store.FindIdentitiesPage.
+func (s *identityStore) FindIdentitiesPage(ctx context.Context, ref *store.Identity, filter store.Filter, cursor string, limit int) ([]store.Identity, string, error) {
+	identities, next, err := s.Store.FindIdentitiesPage(ctx, ref, filter, cursor, limit)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+	for i := range identities {
+		if err := s.decryptIdentity(&identities[i]); err != nil {
+			return nil, "", errgo.Mask(err)
+		}
+	}
+	return identities, next, nil
+}
+
+// maxReplaceAttempts holds the number of times an atomic replacement
+// of ProviderInfo and ExtraInfo values is attempted before giving up
+// because the values are being changed concurrently.
+const maxReplaceAttempts = 10
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+//
+// As each value is encrypted differently every time it is written,
+// Push and Pull updates to the ProviderInfo and ExtraInfo fields of an
+// existing identity cannot be performed by the underlying store.
+// Instead the current values are read and replaced with the result of
+// the update using ReplaceInfo, which fails if they have been changed
+// in the meantime, in which case the update is retried. The other
+// fields are updated before the ProviderInfo and ExtraInfo values.
+func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	providerID := identity.ProviderID
+	if providerID == "" && (update[store.ProviderInfo] == store.Set || update[store.ExtraInfo] == store.Set) {
+		// The values are bound to the provider ID, so find it
+		// when the identity is specified some other way.
+		ref := store.Identity{
+			ID:       identity.ID,
+			Username: identity.Username,
+		}
+		if err := s.Store.Identity(ctx, &ref); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		providerID = ref.ProviderID
+	}
+	encUpdate := update
+	var current *store.Identity
+	if needsCurrent(update[store.ProviderInfo]) || needsCurrent(update[store.ExtraInfo]) {
+		current = &store.Identity{
+			ID:         identity.ID,
+			ProviderID: identity.ProviderID,
+			Username:   identity.Username,
+		}
+		switch err := s.Store.Identity(ctx, current); {
+		case errgo.Cause(err) == store.ErrNotFound:
+			// The identity does not exist yet. Either it will
+			// be created, in which case there are no current
+			// values to merge with, or the underlying store
+			// will return the appropriate error.
+			current = nil
+			encUpdate[store.ProviderInfo] = createOp(update[store.ProviderInfo])
+			encUpdate[store.ExtraInfo] = createOp(update[store.ExtraInfo])
+		case err != nil:
+			return errgo.Mask(err)
+		default:
+			// The values are replaced after the other
+			// fields have been updated.
+			if needsCurrent(update[store.ProviderInfo]) {
+				encUpdate[store.ProviderInfo] = store.NoUpdate
+			}
+			if needsCurrent(update[store.ExtraInfo]) {
+				encUpdate[store.ExtraInfo] = store.NoUpdate
+			}
+		}
+	}
+	if current == nil || encUpdate != (store.Update{}) {
+		encIdentity := *identity
+		var err error
+		if encIdentity.ProviderInfo, err = s.encryptInfo(providerID, store.ProviderInfo, identity.ProviderInfo, encUpdate[store.ProviderInfo]); err != nil {
+			return errgo.Mask(err)
+		}
+		if encIdentity.ExtraInfo, err = s.encryptInfo(providerID, store.ExtraInfo, identity.ExtraInfo, encUpdate[store.ExtraInfo]); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := s.Store.UpdateIdentity(ctx, &encIdentity, encUpdate); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		identity.ID = encIdentity.ID
+	}
+	if current == nil {
+		return nil
+	}
+	identity.ID = current.ID
+	for i := 0; ; i++ {
+		err := s.mergeInfo(ctx, current, identity, update)
+		if errgo.Cause(err) != store.ErrConflict || i == maxReplaceAttempts-1 {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrConflict))
+		}
+		current = &store.Identity{ID: current.ID}
+		if err := s.Store.Identity(ctx, current); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+		}
+	}
+}
+
+func needsCurrent(op store.Operation) bool {
+	return op == store.Push || op == store.Pull
+}
+
+// createOp returns the operation equivalent to the given operation
+// when the values are updated in a new identity.
+func createOp(op store.Operation) store.Operation {
+	switch op {
+	case store.Push:
+		return store.Set
+	case store.Pull:
+		return store.NoUpdate
+	default:
+		return op
+	}
+}
+
+// mergeInfo applies the Push and Pull operations on the ProviderInfo
+// and ExtraInfo fields in the given update to the given current stored
+// identity, using the values in the given identity, and replaces the
+// stored values with the result. If the stored values have changed
+// since current was read then an error with a cause of
+// store.ErrConflict is returned.
+func (s *identityStore) mergeInfo(ctx context.Context, current, identity *store.Identity, update store.Update) error {
+	var old, new store.Identity
+	var err error
+	old.ProviderInfo, new.ProviderInfo, err = s.mergeInfoValues(current.ProviderID, store.ProviderInfo, current.ProviderInfo, identity.ProviderInfo, update[store.ProviderInfo])
+	if err != nil {
+		return errgo.Notef(err, "cannot decrypt provider info for %q", current.ProviderID)
+	}
+	old.ExtraInfo, new.ExtraInfo, err = s.mergeInfoValues(current.ProviderID, store.ExtraInfo, current.ExtraInfo, identity.ExtraInfo, update[store.ExtraInfo])
+	if err != nil {
+		return errgo.Notef(err, "cannot decrypt extra info for %q", current.ProviderID)
+	}
+	if len(old.ProviderInfo) == 0 && len(old.ExtraInfo) == 0 {
+		return nil
+	}
+	return errgo.Mask(s.Store.ReplaceInfo(ctx, current.ID, &old, &new), errgo.Is(store.ErrNotFound), errgo.Is(store.ErrConflict))
+}
+
+// mergeInfoValues applies the given operation with the given values
+// of the given field to the current stored values of the identity with
+// the given provider ID. It returns the stored values of the keys that
+// are changed by the operation and their encrypted new values.
+func (s *identityStore) mergeInfoValues(providerID store.ProviderIdentity, field store.Field, current, info map[string][]string, op store.Operation) (old, new map[string][]string, _ error) {
+	if !needsCurrent(op) {
+		return nil, nil, nil
+	}
+	for k, vs := range info {
+		cvs := append([]string(nil), current[k]...)
+		if err := s.decryptValues(providerID, field, k, cvs); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(ErrUnknownKey))
+		}
+		mvs := mergeStrings(cvs, vs, op)
+		if equalStrings(mvs, cvs) {
+			continue
+		}
+		encvs, err := s.encryptValues(providerID, field, k, mvs)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		if old == nil {
+			old = make(map[string][]string)
+			new = make(map[string][]string)
+		}
+		old[k] = current[k]
+		new[k] = encvs
+	}
+	return old, new, nil
+}
+
+// ReplaceInfo implements store.Store.ReplaceInfo. The given old values
+// are compared with the decrypted stored values.
+func (s *identityStore) ReplaceInfo(ctx context.Context, id string, old, new *store.Identity) error {
+	var encNew store.Identity
+	for i := 0; ; i++ {
+		current := store.Identity{ID: id}
+		if err := s.Store.Identity(ctx, &current); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+		}
+		var err error
+		if i == 0 {
+			// The new values are bound to the provider ID,
+			// which is only known once the identity has
+			// been read.
+			if encNew.ProviderInfo, err = s.encryptInfo(current.ProviderID, store.ProviderInfo, new.ProviderInfo, store.Set); err != nil {
+				return errgo.Mask(err)
+			}
+			if encNew.ExtraInfo, err = s.encryptInfo(current.ProviderID, store.ExtraInfo, new.ExtraInfo, store.Set); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		var encOld store.Identity
+		if encOld.ProviderInfo, err = s.storedInfo(&current, store.ProviderInfo, current.ProviderInfo, old.ProviderInfo); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrConflict))
+		}
+		if encOld.ExtraInfo, err = s.storedInfo(&current, store.ExtraInfo, current.ExtraInfo, old.ExtraInfo); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrConflict))
+		}
+		err = s.Store.ReplaceInfo(ctx, id, &encOld, &encNew)
+		if errgo.Cause(err) != store.ErrConflict || i == maxReplaceAttempts-1 {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound), errgo.Is(store.ErrConflict))
+		}
+	}
+}
+
+// storedInfo returns the stored values, held in the given field of the
+// given identity, of the keys in the given old ProviderInfo or
+// ExtraInfo values. If the decrypted stored values are not the same as
+// the old values then an error with a cause of store.ErrConflict is
+// returned.
+func (s *identityStore) storedInfo(identity *store.Identity, field store.Field, current, old map[string][]string) (map[string][]string, error) {
+	if len(old) == 0 {
+		return nil, nil
+	}
+	stored := make(map[string][]string, len(old))
+	for k, vs := range old {
+		cvs := append([]string(nil), current[k]...)
+		if err := s.decryptValues(identity.ProviderID, field, k, cvs); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !store.EqualValues(cvs, vs) {
+			return nil, store.ConflictError(identity.ID)
+		}
+		stored[k] = current[k]
+	}
+	return stored, nil
+}
+
+// encryptInfo returns the encrypted form of the given ProviderInfo or
+// ExtraInfo map, held in the given field of the identity with the given
+// provider ID, when it is written with the given operation.
+func (s *identityStore) encryptInfo(providerID store.ProviderIdentity, field store.Field, info map[string][]string, op store.Operation) (map[string][]string, error) {
+	if op != store.Set {
+		// Other operations don't use the values.
+		return info, nil
+	}
+	encInfo := make(map[string][]string, len(info))
+	for k, vs := range info {
+		encvs, err := s.encryptValues(providerID, field, k, vs)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		encInfo[k] = encvs
+	}
+	return encInfo, nil
+}
+
+// encryptValues returns the encrypted form of the given values of the
+// given key in the given field of the identity with the given provider
+// ID.
+func (s *identityStore) encryptValues(providerID store.ProviderIdentity, field store.Field, key string, vs []string) ([]string, error) {
+	if len(vs) == 0 {
+		return vs, nil
+	}
+	encvs := make([]string, len(vs))
+	for i, v := range vs {
+		var err error
+		if encvs[i], err = s.kr.encryptString(v, infoContext(providerID, field, key)...); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return encvs, nil
+}
+
+// decryptIdentity decrypts the ProviderInfo and ExtraInfo values of
+// the given identity in place.
+func (s *identityStore) decryptIdentity(identity *store.Identity) error {
+	if err := s.decryptInfo(identity.ProviderID, store.ProviderInfo, identity.ProviderInfo); err != nil {
+		return errgo.Notef(err, "cannot decrypt provider info for %q", identity.ProviderID)
+	}
+	if err := s.decryptInfo(identity.ProviderID, store.ExtraInfo, identity.ExtraInfo); err != nil {
+		return errgo.Notef(err, "cannot decrypt extra info for %q", identity.ProviderID)
+	}
+	return nil
+}
+
+func (s *identityStore) decryptInfo(providerID store.ProviderIdentity, field store.Field, info map[string][]string) error {
+	for k, vs := range info {
+		if err := s.decryptValues(providerID, field, k, vs); err != nil {
+			return errgo.Mask(err, errgo.Is(ErrUnknownKey))
+		}
+	}
+	return nil
+}
+
+// decryptValues decrypts the given values of the given key in the given
+// field of the identity with the given provider ID in place.
+func (s *identityStore) decryptValues(providerID store.ProviderIdentity, field store.Field, key string, vs []string) error {
+	for i, v := range vs {
+		var err error
+		if vs[i], err = s.kr.decryptString(v, infoContext(providerID, field, key)...); err != nil {
+			return errgo.Mask(err, errgo.Is(ErrUnknownKey))
+		}
+	}
+	return nil
+}
+
+// infoContext returns the context to which the values of the given key
+// in the given field of the identity with the given provider ID are
+// bound when they are encrypted.
+func infoContext(providerID store.ProviderIdentity, field store.Field, key string) []string {
+	return []string{string(providerID), field.String(), key}
+}
+
+// mergeStrings applies the given Push or Pull operation to the given
+// values, returning the result. It returns a new slice.
+func mergeStrings(current, vs []string, op store.Operation) []string {
+	result := append([]string(nil), current...)
+	for _, v := range vs {
+		i := indexString(result, v)
+		switch {
+		case op == store.Push && i == -1:
+			result = append(result, v)
+		case op == store.Pull && i != -1:
+			result = append(result[:i], result[i+1:]...)
+		}
+	}
+	return result
+}
+
+func indexString(ss []string, s string) int {
+	for i, t := range ss {
+		if t == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -17,6 +17,24 @@ var (
 	// ErrDuplicateUsername is the error cause used when an update
 	// attempts to set a username that is already in use.
 	ErrDuplicateUsername = errgo.New("duplicate username")
+
+	// ErrInvalidCursor is the error cause used when a cursor passed
+	// to FindIdentitiesPage is not valid.
+	ErrInvalidCursor = errgo.New("invalid cursor")
+
+	// ErrDuplicateProviderID is the error cause used when an update
+	// attempts to link a provider ID that already identifies another
+	// identity.
+	ErrDuplicateProviderID = errgo.New("duplicate provider id")
+
+	// ErrConflict is the error cause used when a conditional update
+	// is not made because the stored values have changed.
+	ErrConflict = errgo.New("conflict")
+
+	// ErrInvalidID is the error cause used when an identity ID
+	// given to BackupStore.InsertIdentity cannot be used by the
+	// backend.
+	ErrInvalidID = errgo.New("invalid identity id")
 )
 
 // NotFoundError creates a new error with a cause of ErrNotFound and an
@@ -44,6 +62,14 @@ func DuplicateUsernameError(username string) error {
 	return err
 }
 
+// DuplicateProviderIDError creates a new error with a cause of
+// ErrDuplicateProviderID and an appropriate message.
+func DuplicateProviderIDError(providerID ProviderIdentity) error {
+	err := errgo.WithCausef(nil, ErrDuplicateProviderID, "provider id %q already in use", providerID)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
 // KeyNotFoundError creates a new error with a cause of ErrNotFound and
 // an appropriate message.
 func KeyNotFoundError(key string) error {
@@ -51,3 +77,41 @@ func KeyNotFoundError(key string) error {
 	err.(*errgo.Err).SetLocation(1)
 	return err
 }
+
+// RootKeyNotFoundError creates a new error with a cause of ErrNotFound
+// and an appropriate message.
+func RootKeyNotFoundError(id []byte) error {
+	err := errgo.WithCausef(nil, ErrNotFound, "root key %q not found", id)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
+// GroupNotFoundError creates a new error with a cause of ErrNotFound and
+// an appropriate message.
+func GroupNotFoundError(name string) error {
+	err := errgo.WithCausef(nil, ErrNotFound, "group %s not found", name)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
+// ConflictError creates a new error with a cause of ErrConflict and an
+// appropriate message.
+func ConflictError(id string) error {
+	err := errgo.WithCausef(nil, ErrConflict, "identity %q has been changed", id)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
+// ChangesRemovedError is the error returned by Watch when changes made
+// after the requested sequence number have been removed from the change
+// log, so that the changes that remain do not follow on from it.
+type ChangesRemovedError struct {
+	// Sequence holds the sequence number of the last change that
+	// has been removed.
+	Sequence uint64
+}
+
+// Error implements the error interface.
+func (e *ChangesRemovedError) Error() string {
+	return fmt.Sprintf("changes up to %d have been removed", e.Sequence)
+}
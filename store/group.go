@@ -0,0 +1,50 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+)
+
+// A Group holds the information stored about a group. Groups do not
+// need to be stored in order for identities to be members of them, a
+// stored group adds information about a group that is not otherwise
+// available.
+type Group struct {
+	// Name contains the name of the group.
+	Name string
+
+	// Description contains a human readable description of the
+	// group.
+	Description string
+
+	// Owners contains the users and groups that are allowed to
+	// manage the membership of the group.
+	Owners []string
+
+	// Subgroups contains the names of the groups that are part of
+	// the group. Members of any of these groups are also members of
+	// the group.
+	Subgroups []string
+}
+
+// A GroupStore is a store for information about groups.
+type GroupStore interface {
+	// Group fills in the given group using its Name. If there is no
+	// such group an error with a cause of ErrNotFound will be
+	// returned.
+	Group(ctx context.Context, group *Group) error
+
+	// Groups returns all the groups in the store, ordered by name.
+	Groups(ctx context.Context) ([]Group, error)
+
+	// SetGroup adds the given group to the store, replacing any
+	// group with the same name.
+	SetGroup(ctx context.Context, group *Group) error
+
+	// RemoveGroup removes the group with the given name from the
+	// store. If there is no such group an error with a cause of
+	// ErrNotFound will be returned.
+	RemoveGroup(ctx context.Context, name string) error
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// SSHKeysExtraInfoKey holds the ExtraInfo key under which the SSH keys
+// of an identity are stored.
+const SSHKeysExtraInfoKey = "sshkeys"
+
+// LinkProviderID links the given provider ID to the identity in the
+// given store that matches identity, which is then filled in with the
+// updated identity as by Store.Identity.
+//
+// If the provider ID already identifies a different identity then that
+// identity is merged into the one being linked to: its groups and
+// public keys are added to those of the identity, all of its provider
+// IDs are linked to the identity and it is removed from the store. Its
+// SSH keys are also added if mergeSSHKeys is true, which should be
+// false when the SSH keys of the identity being linked to are managed
+// by its identity provider. In this case the identity that was merged
+// is returned. Should its provider IDs fail to be linked, the merged
+// identity is restored to the store.
+//
+// If check is not nil then it is called with the identity being linked
+// to and with any identity that would be merged into it before anything
+// is changed. If check returns an error then nothing is linked and the
+// error is returned with its cause preserved.
+func LinkProviderID(ctx context.Context, st Store, identity *Identity, providerID ProviderIdentity, mergeSSHKeys bool, check func(*Identity) error) (*Identity, error) {
+	if err := st.Identity(ctx, identity); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	if check != nil {
+		if err := check(identity); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	other := Identity{
+		ProviderID: providerID,
+	}
+	var merged *Identity
+	switch err := st.Identity(ctx, &other); {
+	case errgo.Cause(err) == ErrNotFound:
+	case err != nil:
+		return nil, errgo.Mask(err)
+	case other.ID == identity.ID:
+		// The provider ID already identifies the identity.
+		return nil, nil
+	default:
+		merged = &other
+	}
+	if merged != nil && check != nil {
+		if err := check(merged); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	if merged != nil {
+		// Add the details of the merged identity before it is
+		// removed, so that nothing is lost should the merge
+		// fail part way through.
+		add := Identity{
+			ID:         identity.ID,
+			Groups:     merged.Groups,
+			PublicKeys: merged.PublicKeys,
+		}
+		update := Update{
+			Groups:     Push,
+			PublicKeys: Push,
+		}
+		if keys := merged.ExtraInfo[SSHKeysExtraInfoKey]; mergeSSHKeys && len(keys) > 0 {
+			add.ExtraInfo = map[string][]string{
+				SSHKeysExtraInfoKey: keys,
+			}
+			update[ExtraInfo] = Push
+		}
+		if err := st.UpdateIdentity(ctx, &add, update); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		// The merged identity has to be removed before its
+		// provider IDs can be linked to another identity.
+		if err := st.RemoveIdentity(ctx, &Identity{ID: merged.ID}); err != nil {
+			return nil, errgo.Notef(err, "cannot remove %s", merged.Username)
+		}
+	}
+	link := Identity{
+		ID:                identity.ID,
+		LinkedProviderIDs: []ProviderIdentity{providerID},
+	}
+	if merged != nil {
+		link.LinkedProviderIDs = append([]ProviderIdentity{merged.ProviderID}, merged.LinkedProviderIDs...)
+	}
+	if err := st.UpdateIdentity(ctx, &link, Update{LinkedProviderIDs: Push}); err != nil {
+		if merged != nil {
+			// Put back the merged identity so that its
+			// provider IDs can still be used.
+			if rerr := restoreIdentity(ctx, st, merged); rerr != nil {
+				return nil, errgo.Notef(rerr, "cannot restore %s after failed link (link error: %v)", merged.Username, err)
+			}
+		}
+		return nil, errgo.Mask(err, errgo.Is(ErrNotFound), errgo.Is(ErrDuplicateProviderID))
+	}
+	*identity = Identity{ID: identity.ID}
+	if err := st.Identity(ctx, identity); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return merged, nil
+}
+
+// restoreIdentity creates the given identity, which has been removed,
+// again in the given store. The restored identity is given a new ID.
+func restoreIdentity(ctx context.Context, st Store, identity *Identity) error {
+	restored := *identity
+	restored.ID = ""
+	update := Update{
+		Username:          Set,
+		Name:              Set,
+		Email:             Set,
+		Groups:            Set,
+		PublicKeys:        Set,
+		LastLogin:         Set,
+		LastDischarge:     Set,
+		ProviderInfo:      Set,
+		ExtraInfo:         Set,
+		Owner:             Set,
+		Disabled:          Set,
+		DisabledReason:    Set,
+		LinkedProviderIDs: Set,
+	}
+	if !restored.Expires.IsZero() {
+		update[Expires] = Set
+	}
+	return errgo.Mask(st.UpdateIdentity(ctx, &restored, update))
+}
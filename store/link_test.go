@@ -0,0 +1,113 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+func TestLinkProviderIDRestoresMergedIdentity(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := failLinkStore{memstore.NewStore()}
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: "test:test-user-1",
+		Username:   "test-user-1",
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID:        "test2:test-user-2",
+		Username:          "test-user-2",
+		Email:             "test2@example.com",
+		Groups:            []string{"g2"},
+		LinkedProviderIDs: []store.ProviderIdentity{"test3:test-user-2"},
+	}, store.Update{
+		store.Username:          store.Set,
+		store.Email:             store.Set,
+		store.Groups:            store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	identity := store.Identity{
+		Username: "test-user-1",
+	}
+	_, err = store.LinkProviderID(ctx, st, &identity, "test2:test-user-2", true, nil)
+	c.Assert(err, qt.ErrorMatches, `cannot link`)
+
+	// The identity that would have been merged is still available
+	// from all of its provider IDs.
+	for _, pid := range []store.ProviderIdentity{"test2:test-user-2", "test3:test-user-2"} {
+		merged := store.Identity{
+			ProviderID: pid,
+		}
+		err = st.Identity(ctx, &merged)
+		c.Assert(err, qt.IsNil)
+		c.Assert(merged.Username, qt.Equals, "test-user-2")
+		c.Assert(merged.Email, qt.Equals, "test2@example.com")
+		c.Assert(merged.Groups, qt.DeepEquals, []string{"g2"})
+	}
+}
+
+func TestLinkProviderIDWithoutSSHKeys(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: "test:test-user-1",
+		Username:   "test-user-1",
+		ExtraInfo: map[string][]string{
+			"sshkeys": {"ssh-rsa key1"},
+		},
+	}, store.Update{
+		store.Username:  store.Set,
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: "test2:test-user-2",
+		Username:   "test-user-2",
+		Groups:     []string{"g2"},
+		ExtraInfo: map[string][]string{
+			"sshkeys": {"ssh-rsa key2"},
+		},
+	}, store.Update{
+		store.Username:  store.Set,
+		store.Groups:    store.Set,
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	identity := store.Identity{
+		Username: "test-user-1",
+	}
+	merged, err := store.LinkProviderID(ctx, st, &identity, "test2:test-user-2", false, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(merged.Username, qt.Equals, "test-user-2")
+	c.Assert(identity.Groups, qt.DeepEquals, []string{"g2"})
+	c.Assert(identity.ExtraInfo["sshkeys"], qt.DeepEquals, []string{"ssh-rsa key1"})
+}
+
+// failLinkStore is a store that fails to link provider IDs.
+type failLinkStore struct {
+	store.Store
+}
+
+func (s failLinkStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if update[store.LinkedProviderIDs] == store.Push {
+		return errgo.New("cannot link")
+	}
+	return s.Store.UpdateIdentity(ctx, identity, update)
+}
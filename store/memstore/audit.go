@@ -0,0 +1,84 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package memstore
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewAuditStore returns a new in-memory store.AuditStore implementation.
+func NewAuditStore() store.AuditStore {
+	return new(auditStore)
+}
+
+type auditStore struct {
+	mu sync.Mutex
+
+	// entries holds the audit log, in the order that the entries
+	// were added. The ID of each entry is its index in the slice.
+	entries []store.AuditEntry
+}
+
+// AddAuditEntry implements store.AuditStore.AddAuditEntry.
+func (s *auditStore) AddAuditEntry(_ context.Context, entry *store.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.ID = strconv.Itoa(len(s.entries))
+	var e store.AuditEntry
+	copyAuditEntry(&e, entry)
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+// FindAuditEntries implements store.AuditStore.FindAuditEntries.
+func (s *auditStore) FindAuditEntries(_ context.Context, filter store.AuditFilter) ([]store.AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []store.AuditEntry
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+		e := &s.entries[i]
+		if !matchAuditEntry(e, filter) {
+			continue
+		}
+		entries = append(entries, store.AuditEntry{})
+		copyAuditEntry(&entries[len(entries)-1], e)
+	}
+	return entries, nil
+}
+
+func matchAuditEntry(e *store.AuditEntry, filter store.AuditFilter) bool {
+	if filter.Actor != "" && e.Actor != filter.Actor {
+		return false
+	}
+	if filter.Target != "" && e.Target != filter.Target {
+		return false
+	}
+	if filter.Operation != "" && e.Operation != filter.Operation {
+		return false
+	}
+	if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !e.Time.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+func copyAuditEntry(dst, src *store.AuditEntry) {
+	*dst = *src
+	dst.Before = updateStrings(nil, src.Before, store.Set)
+	dst.After = updateStrings(nil, src.After, store.Set)
+}
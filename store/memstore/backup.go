@@ -0,0 +1,46 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package memstore
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// backupStore implements store.BackupStore for the in-memory backend.
+type backupStore struct {
+	b *backend
+}
+
+// ACLNames implements store.BackupStore.ACLNames.
+func (s *backupStore) ACLNames(_ context.Context) ([]string, error) {
+	var names []string
+	for _, kv := range s.b.aclKeyValueStore.all() {
+		names = append(names, kv.Key)
+	}
+	return names, nil
+}
+
+// KeyValues implements store.BackupStore.KeyValues.
+func (s *backupStore) KeyValues(_ context.Context, f func(store.KeyValue) error) error {
+	return errgo.Mask(s.b.providerData.keyValues(f), errgo.Any)
+}
+
+// Meetings implements store.BackupStore.Meetings.
+func (s *backupStore) Meetings(_ context.Context) ([]store.Meeting, error) {
+	return s.b.meetingStore.all(), nil
+}
+
+// InsertMeeting implements store.BackupStore.InsertMeeting.
+func (s *backupStore) InsertMeeting(ctx context.Context, m store.Meeting) error {
+	return errgo.Mask(s.b.meetingStore.put(ctx, m.ID, m.Address, m.Created))
+}
+
+// InsertIdentity implements store.BackupStore.InsertIdentity.
+func (s *backupStore) InsertIdentity(_ context.Context, identity *store.Identity, update store.Update) error {
+	return errgo.Mask(s.b.store.insertIdentity(identity, update), errgo.Is(store.ErrInvalidID), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID))
+}
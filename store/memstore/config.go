@@ -2,9 +2,7 @@ package memstore
 
 import (
 	"github.com/juju/aclstore/v2"
-	"github.com/juju/simplekv/memsimplekv"
 	"github.com/juju/utils/debugstatus"
-	"gopkg.in/macaroon-bakery.v2/bakery"
 
 	"github.com/canonical/candid/meeting"
 	"github.com/canonical/candid/store"
@@ -12,22 +10,39 @@ import (
 
 func init() {
 	store.Register("memory", func(func(interface{}) error) (store.BackendFactory, error) {
-		return &backend{
-			store:        NewStore(),
-			rootKeys:     bakery.NewMemRootKeyStore(),
-			providerData: NewProviderDataStore(),
-			meetingStore: NewMeetingStore(),
-			aclStore:     aclstore.NewACLStore(memsimplekv.NewStore()),
-		}, nil
+		return newBackend(), nil
 	})
 }
 
+// NewBackend returns a new store.Backend that holds all its data in
+// memory.
+func NewBackend() store.Backend {
+	return newBackend()
+}
+
+func newBackend() *backend {
+	aclKeyValueStore := newKeyValueStore()
+	return &backend{
+		store:            newStore(),
+		rootKeys:         newRootKeyStore(),
+		providerData:     newProviderDataStore(),
+		meetingStore:     newMeetingStore(),
+		aclKeyValueStore: aclKeyValueStore,
+		aclStore:         aclstore.NewACLStore(aclKeyValueStore),
+		auditStore:       NewAuditStore(),
+		groupStore:       newGroupStore(),
+	}
+}
+
 type backend struct {
-	store        store.Store
-	providerData store.ProviderDataStore
-	rootKeys     bakery.RootKeyStore
-	meetingStore meeting.Store
-	aclStore     aclstore.ACLStore
+	store            *memStore
+	providerData     *providerDataStore
+	rootKeys         *rootKeyStore
+	meetingStore     *meetingStore
+	aclKeyValueStore *keyValueStore
+	aclStore         aclstore.ACLStore
+	auditStore       store.AuditStore
+	groupStore       *groupStore
 }
 
 // NewBackend implements store.BackendFactory.NewBackend.
@@ -45,8 +60,8 @@ func (b *backend) Store() store.Store {
 	return b.store
 }
 
-// BakeryRootKeyStore implements store.Backend.BakeryRootKeyStore.
-func (b *backend) BakeryRootKeyStore() bakery.RootKeyStore {
+// RootKeyStore implements store.Backend.RootKeyStore.
+func (b *backend) RootKeyStore() store.RootKeyStore {
 	return b.rootKeys
 }
 
@@ -64,5 +79,20 @@ func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
+// AuditStore implements store.Backend.AuditStore.
+func (b *backend) AuditStore() store.AuditStore {
+	return b.auditStore
+}
+
+// GroupStore implements store.Backend.GroupStore.
+func (b *backend) GroupStore() store.GroupStore {
+	return b.groupStore
+}
+
+// BackupStore implements store.Backend.BackupStore.
+func (b *backend) BackupStore() store.BackupStore {
+	return &backupStore{b}
+}
+
 func (b *backend) Close() {
 }
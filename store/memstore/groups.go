@@ -0,0 +1,83 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package memstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewGroupStore returns a new in-memory store.GroupStore.
+func NewGroupStore() store.GroupStore {
+	return newGroupStore()
+}
+
+// groupStore is an in-memory implementation of store.GroupStore.
+type groupStore struct {
+	mu     sync.Mutex
+	groups map[string]store.Group
+}
+
+func newGroupStore() *groupStore {
+	return &groupStore{
+		groups: make(map[string]store.Group),
+	}
+}
+
+// Group implements store.GroupStore.Group.
+func (s *groupStore) Group(_ context.Context, group *store.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[group.Name]
+	if !ok {
+		return store.GroupNotFoundError(group.Name)
+	}
+	copyGroup(group, &g)
+	return nil
+}
+
+// Groups implements store.GroupStore.Groups.
+func (s *groupStore) Groups(_ context.Context) ([]store.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := make([]store.Group, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, store.Group{})
+		copyGroup(&groups[len(groups)-1], &g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// SetGroup implements store.GroupStore.SetGroup.
+func (s *groupStore) SetGroup(_ context.Context, group *store.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var g store.Group
+	copyGroup(&g, group)
+	s.groups[group.Name] = g
+	return nil
+}
+
+// RemoveGroup implements store.GroupStore.RemoveGroup.
+func (s *groupStore) RemoveGroup(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[name]; !ok {
+		return store.GroupNotFoundError(name)
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+func copyGroup(dst, src *store.Group) {
+	*dst = *src
+	dst.Owners = updateStrings(nil, src.Owners, store.Set)
+	dst.Subgroups = updateStrings(nil, src.Subgroups, store.Set)
+}
@@ -5,24 +5,30 @@ package memstore
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/juju/simplekv"
-	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
 
 	"github.com/canonical/candid/store"
 )
 
 // NewProviderDataStore creates a new in-memory store.ProviderDataStore.
 func NewProviderDataStore() store.ProviderDataStore {
+	return newProviderDataStore()
+}
+
+func newProviderDataStore() *providerDataStore {
 	return &providerDataStore{
-		stores: make(map[string]simplekv.Store),
+		stores: make(map[string]*keyValueStore),
 	}
 }
 
 type providerDataStore struct {
 	mu     sync.Mutex
-	stores map[string]simplekv.Store
+	stores map[string]*keyValueStore
 }
 
 // KeyValueStore implements store.ProviderDataStore.KeyValueStore.
@@ -30,7 +36,123 @@ func (s *providerDataStore) KeyValueStore(_ context.Context, idp string) (simple
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.stores[idp] == nil {
-		s.stores[idp] = memsimplekv.NewStore()
+		s.stores[idp] = newKeyValueStore()
 	}
 	return s.stores[idp], nil
 }
+
+// keyValues calls f with all the values in all the key-value stores,
+// sorted by identity provider and key.
+func (s *providerDataStore) keyValues(f func(store.KeyValue) error) error {
+	s.mu.Lock()
+	idps := make([]string, 0, len(s.stores))
+	stores := make(map[string]*keyValueStore, len(s.stores))
+	for idp, kv := range s.stores {
+		idps = append(idps, idp)
+		stores[idp] = kv
+	}
+	s.mu.Unlock()
+	sort.Strings(idps)
+	for _, idp := range idps {
+		for _, kv := range stores[idp].all() {
+			kv.IDP = idp
+			if err := f(kv); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+	}
+	return nil
+}
+
+// keyValueStore is an in-memory implementation of simplekv.Store that
+// can be enumerated. As with memsimplekv, expiry times are recorded but
+// values are not removed when they expire.
+type keyValueStore struct {
+	mu   sync.Mutex
+	data map[string]keyValueEntry
+}
+
+type keyValueEntry struct {
+	value  []byte
+	expire time.Time
+}
+
+func newKeyValueStore() *keyValueStore {
+	return &keyValueStore{
+		data: make(map[string]keyValueEntry),
+	}
+}
+
+// Context implements simplekv.Store.Context by returning the given
+// context unchanged along with a NOP close function.
+func (s *keyValueStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *keyValueStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.data[key]
+	if !ok {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return e.value, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *keyValueStore) Set(_ context.Context, key string, value []byte, expire time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value, expire)
+	return nil
+}
+
+// set sets the value with the given key. It must be called with s.mu
+// held.
+func (s *keyValueStore) set(key string, value []byte, expire time.Time) {
+	if value == nil {
+		value = []byte{}
+	}
+	s.data[key] = keyValueEntry{
+		value:  value,
+		expire: expire,
+	}
+}
+
+// Update implements simplekv.Store.Update.
+func (s *keyValueStore) Update(_ context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newVal, err := getVal(s.data[key].value)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.set(key, newVal, expire)
+	return nil
+}
+
+// all returns all the unexpired values in the store, sorted by key.
+func (s *keyValueStore) all() []store.KeyValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kvs := make([]store.KeyValue, 0, len(s.data))
+	for k, e := range s.data {
+		if expired(e.expire) {
+			continue
+		}
+		kvs = append(kvs, store.KeyValue{
+			Key:    k,
+			Value:  e.value,
+			Expire: e.expire,
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs
+}
+
+func expired(t time.Time) bool {
+	return !t.IsZero() && t.Before(time.Now())
+}
@@ -5,16 +5,22 @@ package memstore
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	errgo "gopkg.in/errgo.v1"
 
 	"github.com/canonical/candid/meeting"
+	"github.com/canonical/candid/store"
 )
 
 // NewMeetingStore creates a new in-memory meeting.Store implementation.
 func NewMeetingStore() meeting.Store {
+	return newMeetingStore()
+}
+
+func newMeetingStore() *meetingStore {
 	return &meetingStore{
 		data: make(map[string]meetingStoreEntry),
 	}
@@ -90,3 +96,21 @@ func (s *meetingStore) RemoveOld(_ context.Context, addr string, olderThan time.
 	}
 	return ids, nil
 }
+
+// all returns all the meetings in the store, sorted by ID.
+func (s *meetingStore) all() []store.Meeting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meetings := make([]store.Meeting, 0, len(s.data))
+	for id, e := range s.data {
+		meetings = append(meetings, store.Meeting{
+			ID:      id,
+			Address: e.address,
+			Created: e.time,
+		})
+	}
+	sort.Slice(meetings, func(i, j int) bool {
+		return meetings[i].ID < meetings[j].ID
+	})
+	return meetings
+}
@@ -49,6 +49,42 @@ func TestACLStore(t *testing.T) {
 	})
 }
 
+func TestAuditStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestAuditStore(c, func(c *qt.C) store.AuditStore {
+		return memstore.NewAuditStore()
+	})
+}
+
+func TestBackupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestBackupStore(c, func(c *qt.C) store.Backend {
+		return memstore.NewBackend()
+	})
+}
+
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestRootKeyStore(c, func(c *qt.C) store.RootKeyStore {
+		return memstore.NewRootKeyStore()
+	})
+}
+
+func TestGroupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestGroupStore(c, func(c *qt.C) store.GroupStore {
+		return memstore.NewGroupStore()
+	})
+}
+
 func TestConfigUnmarshal(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
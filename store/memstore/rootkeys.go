@@ -0,0 +1,99 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package memstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewRootKeyStore returns a new in-memory store.RootKeyStore.
+func NewRootKeyStore() store.RootKeyStore {
+	return newRootKeyStore()
+}
+
+// rootKeyStore is an in-memory implementation of store.RootKeyStore.
+type rootKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]store.RootKey
+}
+
+func newRootKeyStore() *rootKeyStore {
+	return &rootKeyStore{
+		keys: make(map[string]store.RootKey),
+	}
+}
+
+// RootKey implements store.RootKeyStore.RootKey.
+func (s *rootKeyStore) RootKey(_ context.Context, id []byte) (store.RootKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[string(id)]
+	if !ok || key.Expires.Before(time.Now()) {
+		return store.RootKey{}, store.RootKeyNotFoundError(id)
+	}
+	return key, nil
+}
+
+// FindLatestRootKey implements store.RootKeyStore.FindLatestRootKey.
+func (s *rootKeyStore) FindLatestRootKey(_ context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (store.RootKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest store.RootKey
+	for _, key := range s.keys {
+		if key.Created.Before(createdAfter) || key.Expires.Before(expiresAfter) || key.Expires.After(expiresBefore) {
+			continue
+		}
+		if latest.ID == nil || key.Created.After(latest.Created) {
+			latest = key
+		}
+	}
+	if latest.ID == nil {
+		return store.RootKey{}, errgo.WithCausef(nil, store.ErrNotFound, "no suitable root key found")
+	}
+	return latest, nil
+}
+
+// InsertRootKey implements store.RootKeyStore.InsertRootKey.
+func (s *rootKeyStore) InsertRootKey(_ context.Context, key store.RootKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[string(key.ID)] = key
+	return nil
+}
+
+// RootKeys implements store.RootKeyStore.RootKeys.
+func (s *rootKeyStore) RootKeys(_ context.Context) ([]store.RootKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	keys := make([]store.RootKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		if key.Expires.Before(now) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys, nil
+}
+
+// RemoveRootKey implements store.RootKeyStore.RemoveRootKey.
+func (s *rootKeyStore) RemoveRootKey(_ context.Context, id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[string(id)]; !ok {
+		return store.RootKeyNotFoundError(id)
+	}
+	delete(s.keys, string(id))
+	return nil
+}
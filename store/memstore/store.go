@@ -21,13 +21,36 @@ import (
 )
 
 type memStore struct {
-	mu         sync.Mutex
+	mu sync.Mutex
+
+	// identities holds all the identities in the store, indexed by
+	// ID. Removed identities are replaced by a nil entry so that the
+	// IDs of the remaining identities are unaffected.
 	identities []*store.Identity
+
+	// changes holds the log of changes made to identities. The
+	// change with sequence number n is held at index
+	// n-removedChanges-1.
+	changes []store.IdentityChange
+
+	// removedChanges holds the number of changes that have been
+	// removed from the start of the change log.
+	removedChanges uint64
+
+	// changed is closed and replaced whenever a change is
+	// recorded, to wake up any waiting Watch calls.
+	changed chan struct{}
 }
 
 // NewStore creates a new in-memory store.Store instance.
 func NewStore() store.Store {
-	return &memStore{}
+	return newStore()
+}
+
+func newStore() *memStore {
+	return &memStore{
+		changed: make(chan struct{}),
+	}
 }
 
 // Context implements store.Store.Context by returning the given context
@@ -41,14 +64,12 @@ var adminID = store.MakeProviderIdentity("idm", "admin")
 // RemoveAll is implemented so that tests can clear out the data.
 // It removes all identities except the admin identity created at
 // init time.
-// TODO provide a standard store.Store way of removing
-// identities.
 func (s *memStore) RemoveAll() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	var identities []*store.Identity
 	for _, identity := range s.identities {
-		if identity.ProviderID == adminID {
+		if identity != nil && identity.ProviderID == adminID {
 			identities = append(identities, identity)
 		}
 	}
@@ -62,11 +83,10 @@ func (s *memStore) Identity(_ context.Context, identity *store.Identity) error {
 	var id *store.Identity
 	switch {
 	case identity.ID != "":
-		n, err := strconv.Atoi(identity.ID)
-		if err != nil || n >= len(s.identities) {
+		id = s.identityFromID(identity.ID)
+		if id == nil {
 			return store.NotFoundError(identity.ID, "", "")
 		}
-		id = s.identities[n]
 	case identity.ProviderID != "":
 		id = s.identityFromProviderID(identity.ProviderID)
 		if id == nil {
@@ -84,11 +104,21 @@ func (s *memStore) Identity(_ context.Context, identity *store.Identity) error {
 	return nil
 }
 
+// identityFromID finds the identity with the given ID.
+func (s *memStore) identityFromID(id string) *store.Identity {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 || n >= len(s.identities) {
+		return nil
+	}
+	return s.identities[n]
+}
+
 // identityFromProviderID performs a linear search to find an identitty
-// with the given providerID.
+// with the given providerID, either as its primary provider ID or as
+// a linked one.
 func (s *memStore) identityFromProviderID(providerID store.ProviderIdentity) *store.Identity {
 	for _, id := range s.identities {
-		if id.ProviderID == providerID {
+		if id != nil && (id.ProviderID == providerID || containsProviderIdentity(id.LinkedProviderIDs, providerID)) {
 			return id
 		}
 	}
@@ -99,7 +129,7 @@ func (s *memStore) identityFromProviderID(providerID store.ProviderIdentity) *st
 // with the given username.
 func (s *memStore) identityFromUsername(username string) *store.Identity {
 	for _, id := range s.identities {
-		if id.Username == username {
+		if id != nil && id.Username == username {
 			return id
 		}
 	}
@@ -112,7 +142,7 @@ func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filt
 	defer s.mu.Unlock()
 	identities := make([]store.Identity, 0, len(s.identities))
 	for _, identity := range s.identities {
-		if !matchIdentity(identity, ref, filter) {
+		if identity == nil || !matchIdentity(identity, ref, filter) {
 			continue
 		}
 		var identity1 store.Identity
@@ -135,31 +165,104 @@ func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filt
 	return identities, nil
 }
 
+// FindIdentitiesPage implements store.Store.FindIdentitiesPage.
+func (s *memStore) FindIdentitiesPage(ctx context.Context, ref *store.Identity, filter store.Filter, cursor string, limit int) ([]store.Identity, string, error) {
+	after, err := store.ParseUsernameCursor(cursor)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Is(store.ErrInvalidCursor))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var identities []store.Identity
+	for _, identity := range s.identities {
+		if identity == nil || identity.Username <= after || !matchIdentity(identity, ref, filter) {
+			continue
+		}
+		var identity1 store.Identity
+		copyIdentity(&identity1, identity)
+		identities = append(identities, identity1)
+	}
+	sort.Sort(identitySort{
+		identities: identities,
+		sort:       []store.Sort{{Field: store.Username}},
+	})
+	var next string
+	if limit > 0 && limit < len(identities) {
+		identities = identities[:limit]
+		next = store.UsernameCursor(identities[limit-1].Username)
+	}
+	return identities, next, nil
+}
+
 func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 	for f, c := range filter {
 		if c == store.NoComparison {
 			continue
 		}
-		var r int
+		var match bool
 		switch store.Field(f) {
 		case store.ProviderID:
-			r = strings.Compare(string(a.ProviderID), string(b.ProviderID))
+			match = matchString(string(a.ProviderID), string(b.ProviderID), c)
 		case store.Username:
-			r = strings.Compare(a.Username, b.Username)
+			match = matchString(a.Username, b.Username, c)
 		case store.Name:
-			r = strings.Compare(a.Name, b.Name)
+			match = matchString(a.Name, b.Name, c)
 		case store.Email:
-			r = strings.Compare(a.Email, b.Email)
+			match = matchString(a.Email, b.Email, c)
 		case store.LastLogin:
-			r = cmpTime(a.LastLogin, b.LastLogin)
+			match = matchCmp(cmpTime(a.LastLogin, b.LastLogin), c)
 		case store.LastDischarge:
-			r = cmpTime(a.LastDischarge, b.LastDischarge)
+			match = matchCmp(cmpTime(a.LastDischarge, b.LastDischarge), c)
 		case store.Owner:
-			r = strings.Compare(string(a.Owner), string(b.Owner))
+			match = matchString(string(a.Owner), string(b.Owner), c)
+		case store.Disabled:
+			match = matchCmp(cmpTime(a.Disabled, b.Disabled), c)
+		case store.DisabledReason:
+			match = matchString(a.DisabledReason, b.DisabledReason, c)
+		case store.Expires:
+			// As with a NULL value in the SQL stores, an
+			// identity that never expires does not match any
+			// comparison.
+			match = !a.Expires.IsZero() && matchCmp(cmpTime(a.Expires, b.Expires), c)
+		case store.Groups:
+			if c != store.Contains {
+				panic("unsupported comparison")
+			}
+			match = containsAll(a.Groups, b.Groups)
 		default:
 			panic("unsupported filter field")
 		}
-		if !matchCmp(r, c) {
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// matchString determines whether the string a has the relationship
+// with the string b specified by the given store.Comparison.
+func matchString(a, b string, c store.Comparison) bool {
+	switch c {
+	case store.Prefix:
+		return strings.HasPrefix(a, b)
+	case store.Match:
+		return strings.Contains(strings.ToLower(a), strings.ToLower(b))
+	default:
+		return matchCmp(strings.Compare(a, b), c)
+	}
+}
+
+// containsAll determines whether all the values in vs are also in set.
+func containsAll(set, vs []string) bool {
+	for _, v := range vs {
+		found := false
+		for _, s := range set {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
 			return false
 		}
 	}
@@ -240,6 +343,10 @@ func (s identitySort) cmp(a, b *store.Identity, f store.Field, desc bool) int {
 		cmp = cmpTime(a.LastLogin, b.LastLogin)
 	case store.LastDischarge:
 		cmp = cmpTime(a.LastDischarge, b.LastDischarge)
+	case store.Disabled:
+		cmp = cmpTime(a.Disabled, b.Disabled)
+	case store.Expires:
+		cmp = cmpTime(a.Expires, b.Expires)
 	default:
 		panic("unsupported sort field")
 	}
@@ -256,11 +363,10 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 	var id *store.Identity
 	switch {
 	case identity.ID != "":
-		n, err := strconv.Atoi(identity.ID)
-		if err != nil || n >= len(s.identities) {
+		id = s.identityFromID(identity.ID)
+		if id == nil {
 			return store.NotFoundError(identity.ID, "", "")
 		}
-		id = s.identities[n]
 	case identity.ProviderID != "":
 		id = s.identityFromProviderID(identity.ProviderID)
 		if id == nil {
@@ -275,12 +381,18 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 				ExtraInfo:    make(map[string][]string),
 			}
 			if err := s.updateIdentity(id, identity, update); err != nil {
-				return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
+				return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID))
 			}
 			s.identities = append(s.identities, id)
 			identity.ID = id.ID
+			s.recordChange(store.IdentityCreated, id, store.ChangedFields(update))
 			return nil
 		}
+		if id.ProviderID != identity.ProviderID {
+			// Logging in with a linked provider ID never renames
+			// the identity.
+			update[store.Username] = store.NoUpdate
+		}
 	case identity.Username != "":
 		id = s.identityFromUsername(identity.Username)
 		if id == nil {
@@ -289,13 +401,190 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 	default:
 		return store.NotFoundError("", "", "")
 	}
-	return errgo.Mask(s.updateIdentity(id, identity, update), errgo.Is(store.ErrDuplicateUsername))
+	if err := s.updateIdentity(id, identity, update); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID))
+	}
+	if fields := store.ChangedFields(update); len(fields) > 0 {
+		s.recordChange(store.IdentityUpdated, id, fields)
+	}
+	return nil
+}
+
+// insertIdentity adds the given identity with the ID that it holds,
+// see store.BackupStore.InsertIdentity.
+func (s *memStore) insertIdentity(identity *store.Identity, update store.Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := strconv.Atoi(identity.ID)
+	if err != nil || n < 0 || strconv.Itoa(n) != identity.ID {
+		return errgo.WithCausef(nil, store.ErrInvalidID, "invalid identity id %q", identity.ID)
+	}
+	if s.identityFromID(identity.ID) != nil || s.identityFromProviderID(identity.ProviderID) != nil {
+		return errgo.Newf("identity %q or provider id %q already in use", identity.ID, identity.ProviderID)
+	}
+	id := &store.Identity{
+		ID:           identity.ID,
+		ProviderID:   identity.ProviderID,
+		ProviderInfo: make(map[string][]string),
+		ExtraInfo:    make(map[string][]string),
+	}
+	if err := s.updateIdentity(id, identity, update); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID))
+	}
+	for len(s.identities) <= n {
+		s.identities = append(s.identities, nil)
+	}
+	s.identities[n] = id
+	s.recordChange(store.IdentityCreated, id, store.ChangedFields(update))
+	return nil
+}
+
+// ReplaceInfo implements store.Store.ReplaceInfo.
+func (s *memStore) ReplaceInfo(_ context.Context, id string, old, new *store.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	identity := s.identityFromID(id)
+	if identity == nil {
+		return store.NotFoundError(id, "", "")
+	}
+	if !sameInfo(identity.ProviderInfo, old.ProviderInfo) || !sameInfo(identity.ExtraInfo, old.ExtraInfo) {
+		return store.ConflictError(id)
+	}
+	var fields []store.Field
+	if len(old.ProviderInfo) > 0 {
+		identity.ProviderInfo = replaceInfo(identity.ProviderInfo, old.ProviderInfo, new.ProviderInfo)
+		fields = append(fields, store.ProviderInfo)
+	}
+	if len(old.ExtraInfo) > 0 {
+		identity.ExtraInfo = replaceInfo(identity.ExtraInfo, old.ExtraInfo, new.ExtraInfo)
+		fields = append(fields, store.ExtraInfo)
+	}
+	if len(fields) > 0 {
+		s.recordChange(store.IdentityUpdated, identity, fields)
+	}
+	return nil
+}
+
+// sameInfo reports whether every key in old holds the same values in
+// info.
+func sameInfo(info, old map[string][]string) bool {
+	for k, vs := range old {
+		if !store.EqualValues(info[k], vs) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceInfo replaces the values in info of every key in old with the
+// values in new, returning the resulting map.
+func replaceInfo(info, old, new map[string][]string) map[string][]string {
+	if info == nil {
+		info = make(map[string][]string)
+	}
+	for k := range old {
+		if len(new[k]) == 0 {
+			delete(info, k)
+			continue
+		}
+		info[k] = append([]string(nil), new[k]...)
+	}
+	return info
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity.
+func (s *memStore) RemoveIdentity(_ context.Context, identity *store.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var id *store.Identity
+	switch {
+	case identity.ID != "":
+		id = s.identityFromID(identity.ID)
+	case identity.ProviderID != "":
+		id = s.identityFromProviderID(identity.ProviderID)
+	case identity.Username != "":
+		id = s.identityFromUsername(identity.Username)
+	}
+	if id == nil {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	for i := range s.identities {
+		if s.identities[i] == id {
+			s.identities[i] = nil
+			break
+		}
+	}
+	s.recordChange(store.IdentityRemoved, id, nil)
+	return nil
+}
+
+// recordChange adds a change of the given type to the given identity
+// to the change log. It must be called with s.mu held.
+func (s *memStore) recordChange(typ store.ChangeType, id *store.Identity, fields []store.Field) {
+	s.changes = append(s.changes, store.IdentityChange{
+		Sequence:   s.removedChanges + uint64(len(s.changes)) + 1,
+		Type:       typ,
+		Time:       time.Now(),
+		ID:         id.ID,
+		ProviderID: id.ProviderID,
+		Username:   id.Username,
+		Fields:     fields,
+	})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Watch implements store.Store.Watch.
+func (s *memStore) Watch(ctx context.Context, since uint64) ([]store.IdentityChange, error) {
+	for {
+		s.mu.Lock()
+		if since < s.removedChanges {
+			s.mu.Unlock()
+			return nil, &store.ChangesRemovedError{Sequence: s.removedChanges}
+		}
+		start := int(since - s.removedChanges)
+		if start < len(s.changes) {
+			changes := s.changes[start:]
+			if len(changes) > store.MaxWatchChanges {
+				changes = changes[:store.MaxWatchChanges]
+			}
+			changes = append([]store.IdentityChange(nil), changes...)
+			s.mu.Unlock()
+			return changes, nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, errgo.Mask(ctx.Err(), errgo.Any)
+		}
+	}
+}
+
+// RemoveChanges implements store.Store.RemoveChanges.
+func (s *memStore) RemoveChanges(_ context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := sort.Search(len(s.changes), func(i int) bool {
+		return !s.changes[i].Time.Before(before)
+	})
+	s.changes = append([]store.IdentityChange(nil), s.changes[n:]...)
+	s.removedChanges += uint64(n)
+	return n, nil
 }
 
 func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update) error {
 	if update[store.ProviderID] != store.NoUpdate {
 		panic(errgo.Newf("unsupported operation %v requested on ProviderID field", update[store.ProviderID]))
 	}
+	if op := update[store.LinkedProviderIDs]; op == store.Set || op == store.Push {
+		for _, pid := range src.LinkedProviderIDs {
+			if id := s.identityFromProviderID(pid); id != nil && id != dst {
+				return store.DuplicateProviderIDError(pid)
+			}
+		}
+	}
 	switch update[store.Username] {
 	case store.NoUpdate:
 	case store.Set:
@@ -316,6 +605,10 @@ func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update)
 	dst.ProviderInfo = updateMap(dst.ProviderInfo, src.ProviderInfo, update[store.ProviderInfo])
 	dst.ExtraInfo = updateMap(dst.ExtraInfo, src.ExtraInfo, update[store.ExtraInfo])
 	dst.Owner = updateProviderIdentity(dst.Owner, src.Owner, update[store.Owner])
+	dst.Disabled = updateTime(dst.Disabled, src.Disabled, update[store.Disabled])
+	dst.DisabledReason = updateString(dst.DisabledReason, src.DisabledReason, update[store.DisabledReason])
+	dst.Expires = updateTime(dst.Expires, src.Expires, update[store.Expires])
+	dst.LinkedProviderIDs = updateProviderIdentities(dst.LinkedProviderIDs, src.LinkedProviderIDs, update[store.LinkedProviderIDs], dst.ProviderID)
 	return nil
 }
 
@@ -345,6 +638,46 @@ func updateProviderIdentity(dst, src store.ProviderIdentity, op store.Operation)
 	}
 }
 
+// updateProviderIdentities updates a set of linked provider IDs. The
+// given primary provider ID is never added to the set.
+func updateProviderIdentities(dst, src []store.ProviderIdentity, op store.Operation, primary store.ProviderIdentity) []store.ProviderIdentity {
+	switch op {
+	case store.NoUpdate:
+		return dst
+	case store.Set, store.Push:
+		if op == store.Set {
+			dst = nil
+		}
+		for _, pid := range src {
+			if pid != primary && !containsProviderIdentity(dst, pid) {
+				dst = append(dst, pid)
+			}
+		}
+		return dst
+	case store.Clear:
+		return nil
+	case store.Pull:
+		var ndst []store.ProviderIdentity
+		for _, pid := range dst {
+			if !containsProviderIdentity(src, pid) {
+				ndst = append(ndst, pid)
+			}
+		}
+		return ndst
+	default:
+		panic("unsupported operation requested on []store.ProviderIdentity field")
+	}
+}
+
+func containsProviderIdentity(pids []store.ProviderIdentity, pid store.ProviderIdentity) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
 func updateTime(dst, src time.Time, op store.Operation) time.Time {
 	switch op {
 	case store.NoUpdate:
@@ -448,6 +781,7 @@ func copyIdentity(dst, src *store.Identity) {
 	*dst = *src
 	dst.Groups = updateStrings(nil, src.Groups, store.Set)
 	dst.PublicKeys = updateKeys(nil, src.PublicKeys, store.Set)
+	dst.LinkedProviderIDs = append([]store.ProviderIdentity(nil), src.LinkedProviderIDs...)
 	dst.ProviderInfo = updateMap(make(map[string][]string), src.ProviderInfo, store.Set)
 	dst.ExtraInfo = updateMap(make(map[string][]string), src.ExtraInfo, store.Set)
 }
@@ -458,6 +792,9 @@ func (s *memStore) IdentityCounts(_ context.Context) (map[string]int, error) {
 	defer s.mu.Unlock()
 	counts := make(map[string]int)
 	for _, id := range s.identities {
+		if id == nil {
+			continue
+		}
 		counts[id.ProviderID.Provider()]++
 	}
 	return counts, nil
@@ -0,0 +1,129 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mgostore
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/canonical/candid/store"
+)
+
+const auditCollection = "audit"
+
+// auditDocument is the document stored in MongoDB for each audit log
+// entry.
+type auditDocument struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Time      time.Time
+	Actor     string
+	Operation string
+	Target    string
+	Before    []string `bson:",omitempty"`
+	After     []string `bson:",omitempty"`
+	RequestID string   `bson:",omitempty"`
+}
+
+// auditStore is an implementation of store.AuditStore that uses a
+// mongodb collection for the persistent data store.
+type auditStore struct {
+	b *backend
+}
+
+// AddAuditEntry implements store.AuditStore.AddAuditEntry.
+func (s *auditStore) AddAuditEntry(ctx context.Context, entry *store.AuditEntry) error {
+	coll := s.b.c(ctx, auditCollection)
+	defer coll.Database.Session.Close()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	doc := auditDocument{
+		ID:        bson.NewObjectId(),
+		Time:      entry.Time,
+		Actor:     entry.Actor,
+		Operation: entry.Operation,
+		Target:    entry.Target,
+		Before:    entry.Before,
+		After:     entry.After,
+		RequestID: entry.RequestID,
+	}
+	if err := coll.Insert(&doc); err != nil {
+		return errgo.Mask(err)
+	}
+	entry.ID = doc.ID.Hex()
+	return nil
+}
+
+// FindAuditEntries implements store.AuditStore.FindAuditEntries.
+func (s *auditStore) FindAuditEntries(ctx context.Context, filter store.AuditFilter) ([]store.AuditEntry, error) {
+	coll := s.b.c(ctx, auditCollection)
+	defer coll.Database.Session.Close()
+
+	q := make(bson.M)
+	if filter.Actor != "" {
+		q["actor"] = filter.Actor
+	}
+	if filter.Target != "" {
+		q["target"] = filter.Target
+	}
+	if filter.Operation != "" {
+		q["operation"] = filter.Operation
+	}
+	timeQuery := make(bson.M)
+	if !filter.Since.IsZero() {
+		timeQuery["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		timeQuery["$lt"] = filter.Until
+	}
+	if len(timeQuery) > 0 {
+		q["time"] = timeQuery
+	}
+	query := coll.Find(q).Sort("-time", "-_id")
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	it := query.Iter()
+	var entries []store.AuditEntry
+	var doc auditDocument
+	for it.Next(&doc) {
+		entries = append(entries, store.AuditEntry{
+			ID:        doc.ID.Hex(),
+			Time:      doc.Time,
+			Actor:     doc.Actor,
+			Operation: doc.Operation,
+			Target:    doc.Target,
+			Before:    doc.Before,
+			After:     doc.After,
+			RequestID: doc.RequestID,
+		})
+		doc = auditDocument{}
+	}
+	if err := it.Close(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entries, nil
+}
+
+func ensureAuditIndexes(db *mgo.Database) error {
+	coll := db.C(auditCollection)
+	indexes := []mgo.Index{{
+		Key: []string{"time"},
+	}, {
+		Key: []string{"actor", "time"},
+	}, {
+		Key: []string{"target", "time"},
+	}}
+	for _, index := range indexes {
+		if err := coll.EnsureIndex(index); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
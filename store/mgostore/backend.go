@@ -5,14 +5,11 @@ package mgostore
 
 import (
 	"context"
-	"time"
 
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/simplekv/mgosimplekv"
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
-	"gopkg.in/macaroon-bakery.v2/bakery"
-	"gopkg.in/macaroon-bakery.v2/bakery/mgorootkeystore"
 	mgo "gopkg.in/mgo.v2"
 
 	"github.com/canonical/candid/meeting"
@@ -26,7 +23,6 @@ const aclsCollection = "acls"
 // required by the identity service.
 type backend struct {
 	db       *mgo.Database
-	rootKeys *mgorootkeystore.RootKeys
 	aclStore aclstore.ACLStore
 }
 
@@ -47,8 +43,13 @@ func NewBackend(db *mgo.Database) (_ store.Backend, err error) {
 	if err := ensureMeetingIndexes(db); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	rk := mgorootkeystore.NewRootKeys(1000) // TODO(mhilton) make this configurable?
-	if err := ensureBakeryIndexes(rk, db); err != nil {
+	if err := ensureAuditIndexes(db); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := ensureChangesCollections(db); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := ensureBakeryIndexes(db); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	aclStore, err := mgosimplekv.NewStore(db.C(aclsCollection))
@@ -57,7 +58,6 @@ func NewBackend(db *mgo.Database) (_ store.Backend, err error) {
 	}
 	return &backend{
 		db:       db,
-		rootKeys: rk,
 		aclStore: aclstore.NewACLStore(aclStore),
 	}, nil
 }
@@ -109,14 +109,9 @@ func (b *backend) MeetingStore() meeting.Store {
 	return &meetingStore{b}
 }
 
-// BakeryRootKeyStore implements store.Backend.BakeryRootKeyStore.
-func (b *backend) BakeryRootKeyStore() bakery.RootKeyStore {
-	return &rootKeyStore{
-		b: b,
-		policy: mgorootkeystore.Policy{
-			ExpiryDuration: 365 * 24 * time.Hour,
-		},
-	}
+// RootKeyStore implements store.Backend.RootKeyStore.
+func (b *backend) RootKeyStore() store.RootKeyStore {
+	return &rootKeyStore{b}
 }
 
 // ProviderDataStore implements store.Backend.ProviderDataStore.
@@ -124,6 +119,16 @@ func (b *backend) ProviderDataStore() store.ProviderDataStore {
 	return &providerDataStore{b}
 }
 
+// GroupStore implements store.Backend.GroupStore.
+func (b *backend) GroupStore() store.GroupStore {
+	return &groupStore{b}
+}
+
+// BackupStore implements store.Backend.BackupStore.
+func (b *backend) BackupStore() store.BackupStore {
+	return &backupStore{b}
+}
+
 // DebugStatusCheckerFuncs implements store.Backend.DebugStatusCheckerFuncs.
 func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
 	return []debugstatus.CheckerFunc{
@@ -137,6 +142,11 @@ func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
+// AuditStore implements store.Backend.AuditStore.
+func (b *backend) AuditStore() store.AuditStore {
+	return &auditStore{b}
+}
+
 type collector struct {
 	db *mgo.Database
 }
@@ -148,6 +158,10 @@ func (c collector) Collections() []*mgo.Collection {
 		c.db.C(meetingCollection),
 		c.db.C(identitiesCollection),
 		c.db.C(aclsCollection),
+		c.db.C(auditCollection),
+		c.db.C(changesCollection),
+		c.db.C(countersCollection),
+		c.db.C(groupsCollection),
 	}
 }
 
@@ -0,0 +1,133 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mgostore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/canonical/candid/store"
+)
+
+// kvCollectionPrefix holds the prefix added to the name of an identity
+// provider to make the name of the collection holding its key-value
+// store.
+const kvCollectionPrefix = "kv"
+
+// backupStore implements store.BackupStore.
+type backupStore struct {
+	b *backend
+}
+
+// ACLNames implements store.BackupStore.ACLNames.
+func (s *backupStore) ACLNames(ctx context.Context) ([]string, error) {
+	coll := s.b.c(ctx, aclsCollection)
+	defer coll.Database.Session.Close()
+
+	var names []string
+	var doc struct {
+		Key string `bson:"_id"`
+	}
+	iter := coll.Find(nil).Select(bson.D{{"_id", 1}}).Sort("_id").Iter()
+	for iter.Next(&doc) {
+		names = append(names, doc.Key)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot find ACLs")
+	}
+	return names, nil
+}
+
+// KeyValues implements store.BackupStore.KeyValues.
+func (s *backupStore) KeyValues(ctx context.Context, f func(store.KeyValue) error) error {
+	names, err := s.b.db.With(s.b.s(ctx)).CollectionNames()
+	if err != nil {
+		return errgo.Notef(err, "cannot find key-value stores")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasPrefix(name, kvCollectionPrefix) {
+			continue
+		}
+		if err := s.keyValues(ctx, name, f); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+// kvDoc is the document stored by mgosimplekv.
+type kvDoc struct {
+	Key    string    `bson:"_id"`
+	Value  []byte    `bson:"value"`
+	Expire time.Time `bson:"expire"`
+}
+
+func (s *backupStore) keyValues(ctx context.Context, name string, f func(store.KeyValue) error) error {
+	coll := s.b.c(ctx, name)
+	defer coll.Database.Session.Close()
+
+	idp := strings.TrimPrefix(name, kvCollectionPrefix)
+	now := time.Now()
+	var doc kvDoc
+	iter := coll.Find(nil).Sort("_id").Iter()
+	for iter.Next(&doc) {
+		if !doc.Expire.IsZero() && !doc.Expire.After(now) {
+			continue
+		}
+		err := f(store.KeyValue{
+			IDP:    idp,
+			Key:    doc.Key,
+			Value:  doc.Value,
+			Expire: doc.Expire,
+		})
+		if err != nil {
+			iter.Close()
+			return errgo.Mask(err, errgo.Any)
+		}
+		doc = kvDoc{}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot read %q", name)
+	}
+	return nil
+}
+
+// Meetings implements store.BackupStore.Meetings.
+func (s *backupStore) Meetings(ctx context.Context) ([]store.Meeting, error) {
+	coll := s.b.c(ctx, meetingCollection)
+	defer coll.Database.Session.Close()
+
+	var meetings []store.Meeting
+	var d doc
+	iter := coll.Find(nil).Sort("_id").Iter()
+	for iter.Next(&d) {
+		meetings = append(meetings, store.Meeting{
+			ID:      d.Id,
+			Address: d.Addr,
+			Created: d.Created,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot find meetings")
+	}
+	return meetings, nil
+}
+
+// InsertMeeting implements store.BackupStore.InsertMeeting.
+func (s *backupStore) InsertMeeting(ctx context.Context, m store.Meeting) error {
+	ms := &meetingStore{s.b}
+	return errgo.Mask(ms.put(ctx, m.ID, m.Address, m.Created))
+}
+
+// InsertIdentity implements store.BackupStore.InsertIdentity.
+func (s *backupStore) InsertIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	is := &identityStore{s.b}
+	return errgo.Mask(is.insertIdentity(ctx, identity, update), errgo.Is(store.ErrInvalidID), errgo.Is(store.ErrDuplicateProviderID))
+}
@@ -5,39 +5,125 @@ package mgostore
 
 import (
 	"context"
+	"time"
 
 	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/dbrootkeystore"
 	"gopkg.in/macaroon-bakery.v2/bakery/mgorootkeystore"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/canonical/candid/store"
 )
 
 const macaroonCollection = "macaroons"
 
+// rootKeyStore implements store.RootKeyStore. Root keys are stored in
+// the same format as that used by mgorootkeystore.
 type rootKeyStore struct {
-	b      *backend
-	policy mgorootkeystore.Policy
+	b *backend
+}
+
+// RootKey implements store.RootKeyStore.RootKey.
+func (s *rootKeyStore) RootKey(ctx context.Context, id []byte) (store.RootKey, error) {
+	coll := s.b.c(ctx, macaroonCollection)
+	defer coll.Database.Session.Close()
+
+	var key dbrootkeystore.RootKey
+	err := coll.Find(bson.D{{"_id", id}, {"expires", bson.D{{"$gt", time.Now()}}}}).One(&key)
+	if err == mgo.ErrNotFound {
+		return store.RootKey{}, store.RootKeyNotFoundError(id)
+	}
+	if err != nil {
+		return store.RootKey{}, errgo.Mask(err)
+	}
+	return fromDBRootKey(key), nil
+}
+
+// FindLatestRootKey implements store.RootKeyStore.FindLatestRootKey.
+func (s *rootKeyStore) FindLatestRootKey(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (store.RootKey, error) {
+	coll := s.b.c(ctx, macaroonCollection)
+	defer coll.Database.Session.Close()
+
+	var key dbrootkeystore.RootKey
+	err := coll.Find(bson.D{
+		{"created", bson.D{{"$gte", createdAfter}}},
+		{"expires", bson.D{
+			{"$gte", expiresAfter},
+			{"$lte", expiresBefore},
+		}},
+	}).Sort("-created").One(&key)
+	if err == mgo.ErrNotFound {
+		return store.RootKey{}, errgo.WithCausef(nil, store.ErrNotFound, "no suitable root key found")
+	}
+	if err != nil {
+		return store.RootKey{}, errgo.Mask(err)
+	}
+	return fromDBRootKey(key), nil
+}
+
+// InsertRootKey implements store.RootKeyStore.InsertRootKey.
+func (s *rootKeyStore) InsertRootKey(ctx context.Context, key store.RootKey) error {
+	coll := s.b.c(ctx, macaroonCollection)
+	defer coll.Database.Session.Close()
+
+	_, err := coll.UpsertId(key.ID, &dbrootkeystore.RootKey{
+		Id:      key.ID,
+		RootKey: key.RootKey,
+		Created: key.Created,
+		Expires: key.Expires,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot insert root key")
+	}
+	return nil
 }
 
-// Get implements bakery.RootKeyStore.Get by wrapping mgorootkeystore
-// implementation with code to determine the collection.
-func (s rootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+// RootKeys implements store.RootKeyStore.RootKeys.
+func (s *rootKeyStore) RootKeys(ctx context.Context) ([]store.RootKey, error) {
 	coll := s.b.c(ctx, macaroonCollection)
 	defer coll.Database.Session.Close()
-	store := s.b.rootKeys.NewStore(coll, s.policy)
-	return store.Get(ctx, id)
+
+	var keys []store.RootKey
+	var key dbrootkeystore.RootKey
+	iter := coll.Find(bson.D{{"expires", bson.D{{"$gt", time.Now()}}}}).Sort("created").Iter()
+	for iter.Next(&key) {
+		keys = append(keys, fromDBRootKey(key))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot find root keys")
+	}
+	return keys, nil
 }
 
-// RootKey implements bakery.RootKeyStore.RootKey by wrapping
-// mgorootkeystore implementation with code to determine the collection.
-func (s rootKeyStore) RootKey(ctx context.Context) ([]byte, []byte, error) {
+// RemoveRootKey implements store.RootKeyStore.RemoveRootKey.
+func (s *rootKeyStore) RemoveRootKey(ctx context.Context, id []byte) error {
 	coll := s.b.c(ctx, macaroonCollection)
 	defer coll.Database.Session.Close()
-	store := s.b.rootKeys.NewStore(coll, s.policy)
-	return store.RootKey(ctx)
+
+	err := coll.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return store.RootKeyNotFoundError(id)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot remove root key")
+	}
+	return nil
+}
+
+func fromDBRootKey(key dbrootkeystore.RootKey) store.RootKey {
+	return store.RootKey{
+		ID:      key.Id,
+		RootKey: key.RootKey,
+		Created: key.Created,
+		Expires: key.Expires,
+	}
 }
 
-func ensureBakeryIndexes(rk *mgorootkeystore.RootKeys, db *mgo.Database) error {
-	if err := rk.EnsureIndex(db.C(macaroonCollection)); err != nil {
+func ensureBakeryIndexes(db *mgo.Database) error {
+	// The indexes used by mgorootkeystore are also suitable for
+	// rootKeyStore.
+	if err := mgorootkeystore.NewRootKeys(0).EnsureIndex(db.C(macaroonCollection)); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
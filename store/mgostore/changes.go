@@ -0,0 +1,221 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mgostore
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/canonical/candid/store"
+)
+
+const (
+	changesCollection  = "changes"
+	countersCollection = "counters"
+
+	// removedChangesCounter is the ID of the counter that holds the
+	// sequence number of the last change removed from the changes
+	// collection.
+	removedChangesCounter = "changes-removed"
+)
+
+var (
+	// watchPollInterval holds the interval at which Watch checks
+	// the database for new changes.
+	watchPollInterval = 500 * time.Millisecond
+
+	// changeGapTimeout holds the time after which Watch assumes
+	// that a missing sequence number will never be recorded, for
+	// example because the server that allocated it failed before
+	// recording its change.
+	changeGapTimeout = 10 * time.Second
+)
+
+// changeDocument is the document stored in MongoDB for each change
+// made to an identity.
+type changeDocument struct {
+	Sequence   uint64 `bson:"_id"`
+	Time       time.Time
+	Type       int
+	IdentityID string
+	ProviderID string
+	Username   string
+	Fields     int
+}
+
+// counterDocument holds a sequence counter.
+type counterDocument struct {
+	ID       string `bson:"_id"`
+	Sequence uint64
+}
+
+// insertChange records a change of the given type to the given
+// identity. Sequence numbers are allocated before the change is
+// inserted, so changes may be inserted slightly out of order; Watch
+// allows for this.
+func (s *identityStore) insertChange(ctx context.Context, typ store.ChangeType, identity *store.Identity, fields []store.Field) error {
+	counters := s.b.c(ctx, countersCollection)
+	defer counters.Database.Session.Close()
+
+	var counter counterDocument
+	_, err := counters.FindId(changesCollection).Apply(mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"sequence", 1}}}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if err != nil {
+		return errgo.Notef(err, "cannot allocate change sequence number")
+	}
+	err = counters.Database.C(changesCollection).Insert(&changeDocument{
+		Sequence:   counter.Sequence,
+		Time:       time.Now(),
+		Type:       int(typ),
+		IdentityID: identity.ID,
+		ProviderID: string(identity.ProviderID),
+		Username:   identity.Username,
+		Fields:     store.FieldMask(fields),
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot record change")
+	}
+	return nil
+}
+
+// Watch implements store.Store.Watch by polling the changes collection.
+func (s *identityStore) Watch(ctx context.Context, since uint64) ([]store.IdentityChange, error) {
+	var ticker *time.Ticker
+	for {
+		changes, err := s.findChanges(ctx, since)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		// Check for removed changes after finding the changes so
+		// that any removed while finding them are also detected.
+		if err := s.checkChangesRemoved(ctx, since); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if len(changes) > 0 {
+			return changes, nil
+		}
+		if ticker == nil {
+			ticker = time.NewTicker(watchPollInterval)
+			defer ticker.Stop()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, errgo.Mask(ctx.Err(), errgo.Any)
+		}
+	}
+}
+
+// findChanges returns the changes after since. If there is a gap in the
+// sequence numbers then only the changes before the gap are returned,
+// unless the gap has been there for longer than changeGapTimeout.
+func (s *identityStore) findChanges(ctx context.Context, since uint64) ([]store.IdentityChange, error) {
+	coll := s.b.c(ctx, changesCollection)
+	defer coll.Database.Session.Close()
+
+	var docs []changeDocument
+	err := coll.Find(bson.D{{"_id", bson.D{{"$gt", since}}}}).Sort("_id").Limit(store.MaxWatchChanges).All(&docs)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find changes")
+	}
+	changes := make([]store.IdentityChange, 0, len(docs))
+	next := since + 1
+	for _, doc := range docs {
+		if doc.Sequence != next && time.Since(doc.Time) < changeGapTimeout {
+			// The missing change may still be being
+			// recorded.
+			break
+		}
+		changes = append(changes, store.IdentityChange{
+			Sequence:   doc.Sequence,
+			Type:       store.ChangeType(doc.Type),
+			Time:       doc.Time,
+			ID:         doc.IdentityID,
+			ProviderID: store.ProviderIdentity(doc.ProviderID),
+			Username:   doc.Username,
+			Fields:     store.MaskFields(doc.Fields),
+		})
+		next = doc.Sequence + 1
+	}
+	return changes, nil
+}
+
+// checkChangesRemoved returns a *store.ChangesRemovedError if any
+// change after since has been removed from the changes collection.
+func (s *identityStore) checkChangesRemoved(ctx context.Context, since uint64) error {
+	coll := s.b.c(ctx, countersCollection)
+	defer coll.Database.Session.Close()
+
+	var counter counterDocument
+	err := coll.FindId(removedChangesCounter).One(&counter)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot find removed changes")
+	}
+	if counter.Sequence > since {
+		return &store.ChangesRemovedError{Sequence: counter.Sequence}
+	}
+	return nil
+}
+
+// RemoveChanges implements store.Store.RemoveChanges. The changes are
+// removed by sequence number, up to the last change made before the
+// given time, and that sequence number is recorded so that Watch can
+// detect that they have been removed.
+func (s *identityStore) RemoveChanges(ctx context.Context, before time.Time) (int, error) {
+	coll := s.b.c(ctx, changesCollection)
+	defer coll.Database.Session.Close()
+
+	var last changeDocument
+	err := coll.Find(bson.D{{"time", bson.D{{"$lt", before}}}}).Sort("-_id").One(&last)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove changes")
+	}
+	// Record the removal first so that a watcher never finds the
+	// changes missing without also finding that they were removed.
+	_, err = coll.Database.C(countersCollection).UpsertId(removedChangesCounter, bson.D{{"$max", bson.D{{"sequence", last.Sequence}}}})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove changes")
+	}
+	info, err := coll.RemoveAll(bson.D{{"_id", bson.D{{"$lte", last.Sequence}}}})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove changes")
+	}
+	return info.Removed, nil
+}
+
+// ensureChangesCollections makes sure that the collections used to
+// record changes exist, so that they are reported by the debug status
+// checks before any changes have been made, and that the changes
+// collection is indexed by time.
+func ensureChangesCollections(db *mgo.Database) error {
+	for _, name := range []string{changesCollection, countersCollection} {
+		err := db.C(name).Create(&mgo.CollectionInfo{})
+		if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == mongoNamespaceExists {
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(db.C(changesCollection).EnsureIndex(mgo.Index{
+		Key: []string{"time"},
+	}))
+}
+
+// mongoNamespaceExists is the error code returned by MongoDB when
+// creating a collection that already exists.
+const mongoNamespaceExists = 48
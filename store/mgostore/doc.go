@@ -18,17 +18,21 @@ var logger = loggo.GetLogger("candid.store.mgostore")
 // fieldNames provides the name used in the mongo documents for each
 // field.
 var fieldNames = []string{
-	store.ProviderID:    "providerid",
-	store.Username:      "username",
-	store.Name:          "name",
-	store.Email:         "email",
-	store.Groups:        "groups",
-	store.PublicKeys:    "publickeys",
-	store.LastLogin:     "lastlogin",
-	store.LastDischarge: "lastdischarge",
-	store.ProviderInfo:  "providerinfo",
-	store.ExtraInfo:     "extrainfo",
-	store.Owner:         "owner",
+	store.ProviderID:        "providerid",
+	store.Username:          "username",
+	store.Name:              "name",
+	store.Email:             "email",
+	store.Groups:            "groups",
+	store.PublicKeys:        "publickeys",
+	store.LastLogin:         "lastlogin",
+	store.LastDischarge:     "lastdischarge",
+	store.ProviderInfo:      "providerinfo",
+	store.ExtraInfo:         "extrainfo",
+	store.Owner:             "owner",
+	store.Disabled:          "disabled",
+	store.DisabledReason:    "disabledreason",
+	store.Expires:           "expires",
+	store.LinkedProviderIDs: "linkedproviderids",
 }
 
 // identityDocument holds the in-database representation of a user in the identities
@@ -72,6 +76,21 @@ type identityDocument struct {
 
 	// Owner holds the provider id of the owner.
 	Owner string
+
+	// Disabled holds the time that the identity was disabled.
+	Disabled time.Time
+
+	// DisabledReason holds the reason that the identity was
+	// disabled.
+	DisabledReason string
+
+	// Expires holds the time after which the identity can no longer
+	// be used.
+	Expires time.Time
+
+	// LinkedProviderIDs holds the provider ids, other than
+	// ProviderID, that identify the user.
+	LinkedProviderIDs []string
 }
 
 // PublicKeys converts the stored public keys into the format used by the
@@ -91,6 +110,20 @@ func (d identityDocument) PublicKeys() []bakery.PublicKey {
 	return pks[:i]
 }
 
+// linkedProviderIDs converts the stored linked provider ids into
+// store.ProviderIdentity values. The primary provider id is never
+// included, even if it has been linked.
+func (d identityDocument) linkedProviderIDs() []store.ProviderIdentity {
+	var pids []store.ProviderIdentity
+	for _, pid := range d.LinkedProviderIDs {
+		if pid == d.ProviderID {
+			continue
+		}
+		pids = append(pids, store.ProviderIdentity(pid))
+	}
+	return pids
+}
+
 type updateDocument struct {
 	Set      bson.D `bson:"$set,omitempty"`
 	Unset    bson.D `bson:"$unset,omitempty"`
@@ -0,0 +1,110 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mgostore
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"github.com/canonical/candid/store"
+)
+
+const groupsCollection = "groups"
+
+// groupDocument is the document stored in MongoDB for each group.
+type groupDocument struct {
+	Name        string   `bson:"_id"`
+	Description string   `bson:",omitempty"`
+	Owners      []string `bson:",omitempty"`
+	Subgroups   []string `bson:",omitempty"`
+}
+
+// groupStore is an implementation of store.GroupStore that uses a
+// mongodb collection for the persistent data store.
+type groupStore struct {
+	b *backend
+}
+
+// Group implements store.GroupStore.Group.
+func (s *groupStore) Group(ctx context.Context, group *store.Group) error {
+	coll := s.b.c(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	var doc groupDocument
+	err := coll.FindId(group.Name).One(&doc)
+	if err == mgo.ErrNotFound {
+		return store.GroupNotFoundError(group.Name)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	*group = fromGroupDocument(doc)
+	return nil
+}
+
+// Groups implements store.GroupStore.Groups.
+func (s *groupStore) Groups(ctx context.Context) ([]store.Group, error) {
+	coll := s.b.c(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	var groups []store.Group
+	iter := coll.Find(nil).Sort("_id").Iter()
+	for {
+		// Use a new document each time so that fields omitted
+		// from a document are not left over from the previous
+		// one.
+		var doc groupDocument
+		if !iter.Next(&doc) {
+			break
+		}
+		groups = append(groups, fromGroupDocument(doc))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot find groups")
+	}
+	return groups, nil
+}
+
+// SetGroup implements store.GroupStore.SetGroup.
+func (s *groupStore) SetGroup(ctx context.Context, group *store.Group) error {
+	coll := s.b.c(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	_, err := coll.UpsertId(group.Name, &groupDocument{
+		Name:        group.Name,
+		Description: group.Description,
+		Owners:      group.Owners,
+		Subgroups:   group.Subgroups,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot set group")
+	}
+	return nil
+}
+
+// RemoveGroup implements store.GroupStore.RemoveGroup.
+func (s *groupStore) RemoveGroup(ctx context.Context, name string) error {
+	coll := s.b.c(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	err := coll.RemoveId(name)
+	if err == mgo.ErrNotFound {
+		return store.GroupNotFoundError(name)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot remove group")
+	}
+	return nil
+}
+
+func fromGroupDocument(doc groupDocument) store.Group {
+	return store.Group{
+		Name:        doc.Name,
+		Description: doc.Description,
+		Owners:      doc.Owners,
+		Subgroups:   doc.Subgroups,
+	}
+}
@@ -16,5 +16,5 @@ type providerDataStore struct {
 }
 
 func (s *providerDataStore) KeyValueStore(ctx context.Context, idp string) (simplekv.Store, error) {
-	return mgosimplekv.NewStore(s.backend.db.C("kv" + idp))
+	return mgosimplekv.NewStore(s.backend.db.C(kvCollectionPrefix + idp))
 }
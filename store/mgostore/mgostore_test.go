@@ -1,7 +1,6 @@
 package mgostore_test
 
 import (
-	"context"
 	"os"
 	"testing"
 	"time"
@@ -53,23 +52,40 @@ func TestACLStore(t *testing.T) {
 	})
 }
 
-func TestRootKeyStore(t *testing.T) {
+func TestAuditStore(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
 
-	f := newFixture(c)
+	storetest.TestAuditStore(c, func(c *qt.C) store.AuditStore {
+		return newFixture(c).backend.AuditStore()
+	})
+}
 
-	rks := f.backend.BakeryRootKeyStore()
+func TestBackupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
 
-	ctx := context.Background()
+	storetest.TestBackupStore(c, func(c *qt.C) store.Backend {
+		return newFixture(c).backend
+	})
+}
 
-	key, id, err := rks.RootKey(ctx)
-	c.Assert(err, qt.IsNil)
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
 
-	key2, err := rks.Get(ctx, id)
-	c.Assert(err, qt.IsNil)
+	storetest.TestRootKeyStore(c, func(c *qt.C) store.RootKeyStore {
+		return newFixture(c).backend.RootKeyStore()
+	})
+}
 
-	c.Assert(key2, qt.DeepEquals, key)
+func TestGroupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestGroupStore(c, func(c *qt.C) store.GroupStore {
+		return newFixture(c).backend.GroupStore()
+	})
 }
 
 type fixture struct {
@@ -6,6 +6,7 @@ package mgostore
 import (
 	"context"
 	"fmt"
+	"regexp"
 
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
@@ -53,6 +54,10 @@ func (s *identityStore) Identity(ctx context.Context, identity *store.Identity)
 	identity.ProviderInfo = doc.ProviderInfo
 	identity.ExtraInfo = doc.ExtraInfo
 	identity.Owner = store.ProviderIdentity(doc.Owner)
+	identity.Disabled = doc.Disabled
+	identity.DisabledReason = doc.DisabledReason
+	identity.Expires = doc.Expires
+	identity.LinkedProviderIDs = doc.linkedProviderIDs()
 	return nil
 }
 
@@ -64,7 +69,7 @@ func identityQuery(identity *store.Identity) bson.D {
 		}
 		return bson.D{{"_id", bson.ObjectIdHex(identity.ID)}}
 	case identity.ProviderID != "":
-		return bson.D{{"providerid", identity.ProviderID}}
+		return providerIDQuery(identity.ProviderID)
 	case identity.Username != "":
 		return bson.D{{"username", identity.Username}}
 	default:
@@ -74,6 +79,16 @@ func identityQuery(identity *store.Identity) bson.D {
 	return bson.D{{"_id", ""}}
 }
 
+// providerIDQuery returns a query that matches the identity identified
+// by the given provider ID, either as its primary provider ID or as a
+// linked one.
+func providerIDQuery(pid store.ProviderIdentity) bson.D {
+	return bson.D{{"$or", []bson.D{
+		{{"providerid", pid}},
+		{{"linkedproviderids", pid}},
+	}}}
+}
+
 // FindIdentities implements store.Store.FindIdentities by querying the
 // mongodb database. The given context must have a mgo.Session added
 // using ContextWithSession.
@@ -99,23 +114,72 @@ func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity,
 	if limit > 0 {
 		q = q.Limit(limit)
 	}
-	it := q.Iter()
-	identities := make([]store.Identity, 0, limit)
+	identities, err := readIdentities(q.Iter(), limit)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return identities, nil
+}
+
+// FindIdentitiesPage implements store.Store.FindIdentitiesPage by
+// querying the mongodb database. The given context must have a
+// mgo.Session added using ContextWithSession.
+func (s *identityStore) FindIdentitiesPage(ctx context.Context, ref *store.Identity, filter store.Filter, cursor string, limit int) ([]store.Identity, string, error) {
+	after, err := store.ParseUsernameCursor(cursor)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Is(store.ErrInvalidCursor))
+	}
+	coll := s.b.c(ctx, identitiesCollection)
+	defer coll.Database.Session.Close()
+
+	var query interface{} = makeQuery(ref, filter)
+	if after != "" {
+		query = bson.M{"$and": []interface{}{
+			query,
+			bson.M{"username": bson.M{"$gt": after}},
+		}}
+	}
+	q := coll.Find(query).Sort(fieldNames[store.Username])
+	if limit > 0 {
+		// Fetch an extra identity to find out whether there is
+		// another page.
+		q = q.Limit(limit + 1)
+	}
+	identities, err := readIdentities(q.Iter(), limit)
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	var next string
+	if limit > 0 && len(identities) > limit {
+		identities = identities[:limit]
+		next = store.UsernameCursor(identities[limit-1].Username)
+	}
+	return identities, next, nil
+}
+
+// readIdentities reads all the identities from the given iterator,
+// size is a hint for the number of identities expected.
+func readIdentities(it *mgo.Iter, size int) ([]store.Identity, error) {
+	identities := make([]store.Identity, 0, size)
 	var doc identityDocument
 	for it.Next(&doc) {
 		identities = append(identities, store.Identity{
-			ID:            doc.ID.Hex(),
-			ProviderID:    store.ProviderIdentity(doc.ProviderID),
-			Username:      doc.Username,
-			Email:         doc.Email,
-			Name:          doc.Name,
-			Groups:        doc.Groups,
-			PublicKeys:    doc.PublicKeys(),
-			LastLogin:     doc.LastLogin,
-			LastDischarge: doc.LastDischarge,
-			ProviderInfo:  doc.ProviderInfo,
-			ExtraInfo:     doc.ExtraInfo,
-			Owner:         store.ProviderIdentity(doc.Owner),
+			ID:                doc.ID.Hex(),
+			ProviderID:        store.ProviderIdentity(doc.ProviderID),
+			Username:          doc.Username,
+			Email:             doc.Email,
+			Name:              doc.Name,
+			Groups:            doc.Groups,
+			PublicKeys:        doc.PublicKeys(),
+			LastLogin:         doc.LastLogin,
+			LastDischarge:     doc.LastDischarge,
+			ProviderInfo:      doc.ProviderInfo,
+			ExtraInfo:         doc.ExtraInfo,
+			Owner:             store.ProviderIdentity(doc.Owner),
+			Disabled:          doc.Disabled,
+			DisabledReason:    doc.DisabledReason,
+			Expires:           doc.Expires,
+			LinkedProviderIDs: doc.linkedProviderIDs(),
 		})
 	}
 	if err := it.Err(); err != nil {
@@ -133,6 +197,12 @@ func makeQuery(ref *store.Identity, filter store.Filter) bson.D {
 	query = appendComparison(query, fieldNames[store.LastLogin], filter[store.LastLogin], ref.LastLogin)
 	query = appendComparison(query, fieldNames[store.LastDischarge], filter[store.LastDischarge], ref.LastDischarge)
 	query = appendComparison(query, fieldNames[store.Owner], filter[store.Owner], ref.Owner)
+	query = appendComparison(query, fieldNames[store.Disabled], filter[store.Disabled], ref.Disabled)
+	query = appendComparison(query, fieldNames[store.DisabledReason], filter[store.DisabledReason], ref.DisabledReason)
+	query = appendComparison(query, fieldNames[store.Expires], filter[store.Expires], ref.Expires)
+	if filter[store.Groups] == store.Contains && len(ref.Groups) > 0 {
+		query = append(query, bson.DocElem{fieldNames[store.Groups], bson.D{{"$all", ref.Groups}}})
+	}
 	return query
 }
 
@@ -144,6 +214,15 @@ func appendComparison(query bson.D, fieldName string, p store.Comparison, value
 		// TODO with Mongo 3.0, we could remove this special case
 		// and use $eq instead.
 		return append(query, bson.DocElem{fieldName, value})
+	case store.Prefix:
+		return append(query, bson.DocElem{fieldName, bson.RegEx{
+			Pattern: "^" + regexp.QuoteMeta(fmt.Sprint(value)),
+		}})
+	case store.Match:
+		return append(query, bson.DocElem{fieldName, bson.RegEx{
+			Pattern: regexp.QuoteMeta(fmt.Sprint(value)),
+			Options: "i",
+		}})
 	default:
 		return append(query, bson.DocElem{fieldName, bson.D{{comparisonOps[p], value}}})
 	}
@@ -164,10 +243,27 @@ func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Iden
 	coll := s.b.c(ctx, identitiesCollection)
 	defer coll.Database.Session.Close()
 
+	if op := update[store.LinkedProviderIDs]; op == store.Set || op == store.Push {
+		if err := checkLinkedProviderIDs(coll, identity); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrDuplicateProviderID))
+		}
+	}
+	// idUpdate holds the update that is applied, which may differ
+	// from the caller's update.
+	idUpdate := update
 	if identity.ID == "" && identity.ProviderID != "" && identity.Username != "" && update[store.Username] == store.Set {
-		return errgo.Mask(s.upsertIdentity(coll, identity, update), errgo.Is(store.ErrDuplicateUsername))
+		n, err := coll.Find(bson.D{{"linkedproviderids", identity.ProviderID}}).Count()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if n == 0 {
+			return errgo.Mask(s.upsertIdentity(ctx, coll, identity, update), errgo.Is(store.ErrDuplicateUsername))
+		}
+		// Logging in with a linked provider ID never renames the
+		// identity.
+		idUpdate[store.Username] = store.NoUpdate
 	}
-	updateDoc := identityUpdate(identity, update)
+	updateDoc := identityUpdate(identity, idUpdate)
 	if updateDoc.IsZero() {
 		identity := store.Identity{
 			ID:         identity.ID,
@@ -176,30 +272,226 @@ func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Iden
 		}
 		return errgo.Mask(s.Identity(ctx, &identity), errgo.Is(store.ErrNotFound))
 	}
-	err := coll.Update(identityQuery(identity), updateDoc)
-	if err == nil {
-		return nil
-	}
+	var doc identityDocument
+	_, err := coll.Find(identityQuery(identity)).Select(changeSelector).Apply(mgo.Change{
+		Update:    updateDoc,
+		ReturnNew: true,
+	}, &doc)
 	if err == mgo.ErrNotFound {
 		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
 	}
 	if mgo.IsDup(err) {
 		return store.DuplicateUsernameError(identity.Username)
 	}
-	return errgo.Mask(err)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if fields := store.ChangedFields(idUpdate); len(fields) > 0 {
+		if err := s.insertChange(ctx, store.IdentityUpdated, doc.changedIdentity(), fields); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
 }
 
-func (s *identityStore) upsertIdentity(coll *mgo.Collection, identity *store.Identity, update store.Update) error {
-	changeInfo, err := coll.Upsert(bson.D{{"providerid", identity.ProviderID}}, identityUpdate(identity, update))
+// insertIdentity adds the given identity with the ID that it holds,
+// see store.BackupStore.InsertIdentity. A document holding just the ID,
+// provider ID and username is inserted first, and then updated.
+func (s *identityStore) insertIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if !bson.IsObjectIdHex(identity.ID) {
+		return errgo.WithCausef(nil, store.ErrInvalidID, "invalid identity id %q", identity.ID)
+	}
+	coll := s.b.c(ctx, identitiesCollection)
+	defer coll.Database.Session.Close()
+
+	if op := update[store.LinkedProviderIDs]; op == store.Set || op == store.Push {
+		if err := checkLinkedProviderIDs(coll, identity); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrDuplicateProviderID))
+		}
+	}
+	id := bson.ObjectIdHex(identity.ID)
+	err := coll.Insert(bson.D{
+		{"_id", id},
+		{"providerid", string(identity.ProviderID)},
+		{"username", identity.Username},
+	})
+	if mgo.IsDup(err) {
+		return errgo.Newf("identity %q, provider id %q or username %s already in use", identity.ID, identity.ProviderID, identity.Username)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if updateDoc := identityUpdate(identity, update); !updateDoc.IsZero() {
+		if err := coll.UpdateId(id, updateDoc); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(s.insertChange(ctx, store.IdentityCreated, &store.Identity{
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   identity.Username,
+	}, store.ChangedFields(update)))
+}
+
+// ReplaceInfo implements store.Store.ReplaceInfo. The replacement is
+// made by an update that only matches the identity if the old values
+// are still held.
+func (s *identityStore) ReplaceInfo(ctx context.Context, id string, old, new *store.Identity) error {
+	coll := s.b.c(ctx, identitiesCollection)
+	defer coll.Database.Session.Close()
+
+	query := identityQuery(&store.Identity{ID: id})
+	var doc updateDocument
+	var fields []store.Field
+	for _, f := range []struct {
+		field    store.Field
+		old, new map[string][]string
+	}{
+		{store.ProviderInfo, old.ProviderInfo, new.ProviderInfo},
+		{store.ExtraInfo, old.ExtraInfo, new.ExtraInfo},
+	} {
+		if len(f.old) == 0 {
+			continue
+		}
+		fields = append(fields, f.field)
+		for k, vs := range f.old {
+			name := fieldNames[f.field] + "." + k
+			if len(vs) == 0 {
+				query = append(query, bson.DocElem{name + ".0", bson.D{{"$exists", false}}})
+			} else {
+				query = append(query, bson.DocElem{name, bson.D{{"$size", len(vs)}, {"$all", vs}}})
+			}
+			if len(f.new[k]) == 0 {
+				doc.addUpdate(store.Clear, name, nil)
+			} else {
+				doc.addUpdate(store.Set, name, f.new[k])
+			}
+		}
+	}
+	if doc.IsZero() {
+		return errgo.Mask(s.Identity(ctx, &store.Identity{ID: id}), errgo.Is(store.ErrNotFound))
+	}
+	var changed identityDocument
+	_, err := coll.Find(query).Select(changeSelector).Apply(mgo.Change{
+		Update:    doc,
+		ReturnNew: true,
+	}, &changed)
+	if err == mgo.ErrNotFound {
+		// Either the identity doesn't exist or its values have
+		// changed.
+		if err := s.Identity(ctx, &store.Identity{ID: id}); err != nil {
+			return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+		}
+		return store.ConflictError(id)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.insertChange(ctx, store.IdentityUpdated, changed.changedIdentity(), fields))
+}
+
+// checkLinkedProviderIDs checks that none of the linked provider ids
+// in the given identity identify an identity other than the one that
+// will be updated.
+func checkLinkedProviderIDs(coll *mgo.Collection, identity *store.Identity) error {
+	for _, pid := range identity.LinkedProviderIDs {
+		var doc identityDocument
+		err := coll.Find(providerIDQuery(pid)).Select(linkSelector).One(&doc)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !doc.matches(identity) {
+			return store.DuplicateProviderIDError(pid)
+		}
+	}
+	return nil
+}
+
+// linkSelector selects the fields of an identity document that are
+// used to check whether it matches an identity.
+var linkSelector = bson.D{{"_id", 1}, {"providerid", 1}, {"username", 1}, {"linkedproviderids", 1}}
+
+// matches determines whether the document is the one that would be
+// selected by the given identity.
+func (d *identityDocument) matches(identity *store.Identity) bool {
+	switch {
+	case identity.ID != "":
+		return d.ID.Hex() == identity.ID
+	case identity.ProviderID != "":
+		if d.ProviderID == string(identity.ProviderID) {
+			return true
+		}
+		for _, pid := range d.LinkedProviderIDs {
+			if pid == string(identity.ProviderID) {
+				return true
+			}
+		}
+	case identity.Username != "":
+		return d.Username == identity.Username
+	}
+	return false
+}
+
+// changeSelector selects the fields of an identity document that are
+// recorded in a change.
+var changeSelector = bson.D{{"_id", 1}, {"providerid", 1}, {"username", 1}}
+
+// changedIdentity returns the identity fields of the document that are
+// recorded in a change.
+func (d *identityDocument) changedIdentity() *store.Identity {
+	return &store.Identity{
+		ID:         d.ID.Hex(),
+		ProviderID: store.ProviderIdentity(d.ProviderID),
+		Username:   d.Username,
+	}
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity by removing the
+// identity document from the mongodb database. The given context must
+// have a mgo.Session added using ContextWithSession.
+func (s *identityStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	coll := s.b.c(ctx, identitiesCollection)
+	defer coll.Database.Session.Close()
+
+	var doc identityDocument
+	_, err := coll.Find(identityQuery(identity)).Select(changeSelector).Apply(mgo.Change{
+		Remove: true,
+	}, &doc)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+		}
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.insertChange(ctx, store.IdentityRemoved, doc.changedIdentity(), nil))
+}
+
+func (s *identityStore) upsertIdentity(ctx context.Context, coll *mgo.Collection, identity *store.Identity, update store.Update) error {
+	var doc identityDocument
+	changeInfo, err := coll.Find(bson.D{{"providerid", identity.ProviderID}}).Select(changeSelector).Apply(mgo.Change{
+		Update:    identityUpdate(identity, update),
+		Upsert:    true,
+		ReturnNew: true,
+	}, &doc)
 	if err != nil {
 		if mgo.IsDup(err) {
 			return store.DuplicateUsernameError(identity.Username)
 		}
 		return errgo.Mask(err)
 	}
+	changeType := store.IdentityUpdated
 	id, ok := changeInfo.UpsertedId.(bson.ObjectId)
 	if ok {
 		identity.ID = id.Hex()
+		changeType = store.IdentityCreated
+	}
+	if fields := store.ChangedFields(update); len(fields) > 0 || changeType == store.IdentityCreated {
+		if err := s.insertChange(ctx, changeType, doc.changedIdentity(), fields); err != nil {
+			return errgo.Mask(err)
+		}
 	}
 	return nil
 }
@@ -220,6 +512,17 @@ func identityUpdate(identity *store.Identity, update store.Update) updateDocumen
 		doc.addUpdate(update[store.ExtraInfo], fieldNames[store.ExtraInfo]+"."+k, v)
 	}
 	doc.addUpdate(update[store.Owner], fieldNames[store.Owner], identity.Owner)
+	doc.addUpdate(update[store.Disabled], fieldNames[store.Disabled], identity.Disabled)
+	doc.addUpdate(update[store.DisabledReason], fieldNames[store.DisabledReason], identity.DisabledReason)
+	expiresOp := update[store.Expires]
+	if expiresOp == store.Set && identity.Expires.IsZero() {
+		// An identity that never expires has no expiry time
+		// stored, so that it isn't matched by comparisons with
+		// the expiry time.
+		expiresOp = store.Clear
+	}
+	doc.addUpdate(expiresOp, fieldNames[store.Expires], identity.Expires)
+	doc.addUpdate(update[store.LinkedProviderIDs], fieldNames[store.LinkedProviderIDs], identity.LinkedProviderIDs)
 	return doc
 }
 
@@ -240,6 +543,8 @@ func ensureIdentityIndexes(db *mgo.Database) error {
 	}, {
 		Key:    []string{"providerid"},
 		Unique: true,
+	}, {
+		Key: []string{"linkedproviderids"},
 	}}
 	for _, index := range indexes {
 		if err := coll.EnsureIndex(index); err != nil {
@@ -0,0 +1,203 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// A RootKey holds a bakery root key as stored by a backend.
+type RootKey struct {
+	// ID contains the ID of the root key.
+	ID []byte
+
+	// RootKey contains the key itself.
+	RootKey []byte
+
+	// Created contains the time the root key was created.
+	Created time.Time
+
+	// Expires contains the time after which the root key will no
+	// longer be used.
+	Expires time.Time
+}
+
+// RootKeyStore is the interface implemented by a backend's store of
+// bakery root keys.
+type RootKeyStore interface {
+	// RootKey returns the root key with the given ID. If there is no
+	// such key, or it has expired, an error with a cause of
+	// ErrNotFound will be returned.
+	RootKey(ctx context.Context, id []byte) (RootKey, error)
+
+	// FindLatestRootKey returns the most recently created root key
+	// that was created at or after createdAfter and expires at or
+	// after expiresAfter and at or before expiresBefore. If there is
+	// no such key an error with a cause of ErrNotFound will be
+	// returned.
+	FindLatestRootKey(ctx context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (RootKey, error)
+
+	// InsertRootKey adds the given root key to the store, replacing
+	// any key with the same ID.
+	InsertRootKey(ctx context.Context, key RootKey) error
+
+	// RootKeys returns all the unexpired root keys in the store, in
+	// order of creation.
+	RootKeys(ctx context.Context) ([]RootKey, error)
+
+	// RemoveRootKey removes the root key with the given ID from the
+	// store. If there is no such key an error with a cause of
+	// ErrNotFound will be returned.
+	RemoveRootKey(ctx context.Context, id []byte) error
+}
+
+// RootKeyPolicy holds the policy used to generate new root keys.
+type RootKeyPolicy struct {
+	// GenerateInterval holds the maximum length of time for which
+	// a root key will be used to create new macaroons. If this is
+	// zero, ExpiryDuration will be used.
+	GenerateInterval time.Duration
+
+	// ExpiryDuration holds the minimum length of time that a root
+	// key will remain valid after it was last used to create a
+	// macaroon.
+	ExpiryDuration time.Duration
+}
+
+// DefaultRootKeyPolicy holds the root key policy used when none has
+// been configured.
+var DefaultRootKeyPolicy = RootKeyPolicy{
+	ExpiryDuration: 365 * 24 * time.Hour,
+}
+
+func (p RootKeyPolicy) generateInterval() time.Duration {
+	if p.GenerateInterval == 0 {
+		return p.ExpiryDuration
+	}
+	return p.GenerateInterval
+}
+
+// NewRootKey generates a new root key created at the given time whose
+// expiry time conforms to the policy.
+func (p RootKeyPolicy) NewRootKey(now time.Time) (RootKey, error) {
+	key, err := randomBytes(24)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err)
+	}
+	id, err := randomBytes(16)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err)
+	}
+	return RootKey{
+		ID:      []byte(fmt.Sprintf("%x", id)),
+		RootKey: key,
+		Created: now,
+		Expires: now.Add(p.ExpiryDuration + p.generateInterval()),
+	}, nil
+}
+
+// IsCurrent reports whether the given root key may be used to create
+// new macaroons at the given time under the policy.
+func (p RootKeyPolicy) IsCurrent(key RootKey, now time.Time) bool {
+	createdAfter, expiresAfter, expiresBefore := p.currentRange(now)
+	return !key.Created.Before(createdAfter) && !key.Expires.Before(expiresAfter) && !key.Expires.After(expiresBefore)
+}
+
+// currentRange returns the parameters for FindLatestRootKey that find
+// a root key that may be used at the given time.
+func (p RootKeyPolicy) currentRange(now time.Time) (createdAfter, expiresAfter, expiresBefore time.Time) {
+	return now.Add(-p.generateInterval()), now.Add(p.ExpiryDuration), now.Add(p.ExpiryDuration + p.generateInterval())
+}
+
+// CurrentRootKey returns the root key in the given store that is
+// currently used to create new macaroons under the given policy. If
+// there is no such key an error with a cause of ErrNotFound will be
+// returned.
+func CurrentRootKey(ctx context.Context, s RootKeyStore, p RootKeyPolicy) (RootKey, error) {
+	createdAfter, expiresAfter, expiresBefore := p.currentRange(time.Now())
+	key, err := s.FindLatestRootKey(ctx, createdAfter, expiresAfter, expiresBefore)
+	if err != nil {
+		return RootKey{}, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return key, nil
+}
+
+// RotateRootKey adds a new root key to the given store, generated
+// according to the given policy, and returns it. The new key will be
+// used for all macaroons subsequently created using a
+// bakery.RootKeyStore returned from NewBakeryRootKeyStore. Macaroons
+// created with previous keys remain valid until those keys expire or
+// are removed.
+func RotateRootKey(ctx context.Context, s RootKeyStore, p RootKeyPolicy) (RootKey, error) {
+	key, err := p.NewRootKey(time.Now())
+	if err != nil {
+		return RootKey{}, errgo.Notef(err, "cannot generate root key")
+	}
+	if err := s.InsertRootKey(ctx, key); err != nil {
+		return RootKey{}, errgo.Notef(err, "cannot create root key")
+	}
+	return key, nil
+}
+
+// NewBakeryRootKeyStore returns a bakery.RootKeyStore that uses the
+// given store to hold its root keys, generating new keys according to
+// the given policy.
+//
+// Root keys are not cached, every use of the returned store reads the
+// key from the underlying store. This means that removing a root key
+// from the store immediately invalidates all macaroons created with
+// it, on every server that shares the store.
+func NewBakeryRootKeyStore(s RootKeyStore, p RootKeyPolicy) bakery.RootKeyStore {
+	return &bakeryRootKeyStore{
+		store:  s,
+		policy: p,
+	}
+}
+
+// bakeryRootKeyStore implements bakery.RootKeyStore.
+type bakeryRootKeyStore struct {
+	store  RootKeyStore
+	policy RootKeyPolicy
+}
+
+// Get implements bakery.RootKeyStore.Get.
+func (s *bakeryRootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+	key, err := s.store.RootKey(ctx, id)
+	if errgo.Cause(err) == ErrNotFound {
+		return nil, bakery.ErrNotFound
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if time.Now().After(key.Expires) {
+		return nil, bakery.ErrNotFound
+	}
+	return key.RootKey, nil
+}
+
+// RootKey implements bakery.RootKeyStore.RootKey.
+func (s *bakeryRootKeyStore) RootKey(ctx context.Context) ([]byte, []byte, error) {
+	key, err := CurrentRootKey(ctx, s.store, s.policy)
+	if errgo.Cause(err) == ErrNotFound {
+		key, err = RotateRootKey(ctx, s.store, s.policy)
+	}
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return key.RootKey, key.ID, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("cannot generate %d random bytes: %v", n, err)
+	}
+	return b, nil
+}
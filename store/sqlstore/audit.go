@@ -0,0 +1,136 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// auditStore is an implementation of store.AuditStore that uses an sql
+// table.
+type auditStore struct {
+	*backend
+}
+
+type auditEntryParams struct {
+	argBuilder
+	Time      time.Time
+	Actor     string
+	Operation string
+	Target    string
+	Before    string
+	After     string
+	RequestID string
+}
+
+// AddAuditEntry implements store.AuditStore.AddAuditEntry.
+func (s *auditStore) AddAuditEntry(_ context.Context, entry *store.AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	before, err := marshalStrings(entry.Before)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	after, err := marshalStrings(entry.After)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	params := &auditEntryParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Time:       entry.Time,
+		Actor:      entry.Actor,
+		Operation:  entry.Operation,
+		Target:     entry.Target,
+		Before:     before,
+		After:      after,
+		RequestID:  entry.RequestID,
+	}
+	row, err := s.driver.queryRow(s.db, tmplInsertAuditEntry, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := row.Scan(&entry.ID); err != nil {
+		return errgo.Notef(err, "cannot add audit entry")
+	}
+	return nil
+}
+
+type findAuditEntriesParams struct {
+	argBuilder
+	store.AuditFilter
+}
+
+// FindAuditEntries implements store.AuditStore.FindAuditEntries.
+func (s *auditStore) FindAuditEntries(_ context.Context, filter store.AuditFilter) ([]store.AuditEntry, error) {
+	params := &findAuditEntriesParams{
+		argBuilder:  s.driver.argBuilderFunc(),
+		AuditFilter: filter,
+	}
+	rows, err := s.driver.query(s.db, tmplFindAuditEntries, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+	var entries []store.AuditEntry
+	for rows.Next() {
+		var entry store.AuditEntry
+		var before, after string
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Time,
+			&entry.Actor,
+			&entry.Operation,
+			&entry.Target,
+			&before,
+			&after,
+			&entry.RequestID,
+		)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if entry.Before, err = unmarshalStrings(before); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if entry.After, err = unmarshalStrings(after); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return entries, nil
+}
+
+// marshalStrings encodes the given values for storage in a text
+// column.
+func marshalStrings(vs []string) (string, error) {
+	if len(vs) == 0 {
+		return "", nil
+	}
+	buf, err := json.Marshal(vs)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return string(buf), nil
+}
+
+// unmarshalStrings decodes values encoded with marshalStrings.
+func unmarshalStrings(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var vs []string
+	if err := json.Unmarshal([]byte(s), &vs); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal values")
+	}
+	return vs, nil
+}
@@ -8,11 +8,9 @@ import (
 	"time"
 
 	"github.com/juju/aclstore/v2"
-	"github.com/juju/simplekv/sqlsimplekv"
+	"github.com/juju/simplekv"
 	"github.com/juju/utils/debugstatus"
 	errgo "gopkg.in/errgo.v1"
-	"gopkg.in/macaroon-bakery.v2/bakery"
-	"gopkg.in/macaroon-bakery.v2/bakery/postgresrootkeystore"
 
 	"github.com/canonical/candid/meeting"
 	"github.com/canonical/candid/store"
@@ -24,39 +22,35 @@ import (
 type backend struct {
 	db       *sql.DB
 	driver   *driver
-	rootKeys *postgresrootkeystore.RootKeys
 	aclStore aclstore.ACLStore
 }
 
 // NewBackend creates a new store.Backend implementation using the
 // given driverName and *sql.DB. The driverName must match the value
-// used to open the database.
+// used to open the database, it can be either "postgres" or "sqlite3".
 //
 // Closing the returned Backend will also close db.
 func NewBackend(driverName string, db *sql.DB) (store.Backend, error) {
-	if driverName != "postgres" {
-		return nil, errgo.Newf("unsupported database driver %q", driverName)
-	}
-	driver, err := newPostgresDriver(db)
+	driver, err := newDriver(driverName)
 	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := driver.migrate(db, false); err != nil {
 		return nil, errgo.Notef(err, "cannot initialise database")
 	}
-	rootkeys := postgresrootkeystore.NewRootKeys(db, "rootkeys", 1000)
-	defer rootkeys.Close()
-	aclStore, err := sqlsimplekv.NewStore(driverName, db, "acls")
+	b := &backend{
+		db:     db,
+		driver: driver,
+	}
+	aclStore, err := driver.newKeyValueStoreFunc(b, aclKeyValueStore)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return &backend{
-		db:       db,
-		driver:   driver,
-		rootKeys: postgresrootkeystore.NewRootKeys(db, "rootkeys", 1000),
-		aclStore: aclstore.NewACLStore(aclStore),
-	}, nil
+	b.aclStore = aclstore.NewACLStore(aclStore)
+	return b, nil
 }
 
 func (b *backend) Close() {
-	b.rootKeys.Close()
 	b.db.Close()
 }
 
@@ -66,10 +60,10 @@ func (b *backend) Store() store.Store {
 	return &identityStore{b}
 }
 
-func (b *backend) BakeryRootKeyStore() bakery.RootKeyStore {
-	return b.rootKeys.NewStore(postgresrootkeystore.Policy{
-		ExpiryDuration: 365 * 24 * time.Hour,
-	})
+// RootKeyStore returns a new store.RootKeyStore implementation using
+// this database for persistent storage.
+func (b *backend) RootKeyStore() store.RootKeyStore {
+	return &rootKeyStore{b}
 }
 
 // ProviderDataStore returns a new store.ProviderDataStore implementation
@@ -88,6 +82,24 @@ func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
+// AuditStore returns a new store.AuditStore implementation using this
+// database for persistent storage.
+func (b *backend) AuditStore() store.AuditStore {
+	return &auditStore{b}
+}
+
+// GroupStore returns a new store.GroupStore implementation using this
+// database for persistent storage.
+func (b *backend) GroupStore() store.GroupStore {
+	return &groupStore{b}
+}
+
+// BackupStore returns a new store.BackupStore implementation using this
+// database.
+func (b *backend) BackupStore() store.BackupStore {
+	return &backupStore{b}
+}
+
 // DebugStatusCheckerFuncs implements store.Backend.DebugStatusCheckerFuncs.
 func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
 	return nil
@@ -96,7 +108,13 @@ func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
 // withTx runs f in a new transaction. any error returned by f will not
 // have it's cause masked.
 func (b *backend) withTx(f func(*sql.Tx) error) error {
-	tx, err := b.db.Begin()
+	return errgo.Mask(withTx(b.db, f), errgo.Any)
+}
+
+// withTx runs f in a new transaction on the given database. Any error
+// returned by f will not have it's cause masked.
+func withTx(db *sql.DB, f func(*sql.Tx) error) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -117,6 +135,7 @@ const (
 	tmplFindIdentities
 	tmplUpdateIdentity
 	tmplIdentityID
+	tmplLockIdentity
 	tmplUpsertIdentity
 	tmplClearIdentitySet
 	tmplPushIdentitySet
@@ -129,6 +148,33 @@ const (
 	tmplFindMeetings
 	tmplRemoveMeetings
 	tmplIdentityCounts
+	tmplRemoveIdentity
+	tmplInsertAuditEntry
+	tmplFindAuditEntries
+	tmplGetRootKey
+	tmplFindLatestRootKey
+	tmplInsertRootKey
+	tmplInitSchemaVersion
+	tmplSchemaVersion
+	tmplSetSchemaVersion
+	tmplInsertChange
+	tmplFindChanges
+	tmplLastChangeBefore
+	tmplRemoveChanges
+	tmplChangesRemoved
+	tmplSetChangesRemoved
+	tmplFindRootKeys
+	tmplRemoveRootKey
+	tmplFindKeyValueStores
+	tmplFindKeyValues
+	tmplFindAllMeetings
+	tmplGetGroup
+	tmplFindGroups
+	tmplUpsertGroup
+	tmplRemoveGroup
+	tmplLinkedIdentity
+	tmplInsertIdentity
+	tmplSyncIdentityID
 	numTmpl
 )
 
@@ -152,11 +198,43 @@ type argBuilder interface {
 	args() []interface{}
 }
 
+// A driver holds the parts of the backend that differ between SQL
+// dialects.
 type driver struct {
 	name            string
 	tmpls           [numTmpl]*template.Template
 	argBuilderFunc  func() argBuilder
 	isDuplicateFunc func(error) bool
+
+	// migrations holds the SQL for each schema migration, migration
+	// i takes the schema from version i to version i+1.
+	migrations []string
+
+	// newKeyValueStoreFunc creates a simplekv.Store using the given
+	// backend. The given name distinguishes the store from any other
+	// store created in the same database.
+	newKeyValueStoreFunc func(b *backend, name string) (simplekv.Store, error)
+}
+
+// newDriver returns the driver for the database driver with the given
+// name.
+func newDriver(driverName string) (*driver, error) {
+	var d *driver
+	var tmpls [numTmpl]string
+	switch driverName {
+	case "postgres":
+		d, tmpls = newPostgresDriver(), postgresTmpls
+	case "sqlite3":
+		d, tmpls = newSQLiteDriver(), sqliteTmpls
+	default:
+		return nil, errgo.Newf("unsupported database driver %q", driverName)
+	}
+	for i, t := range tmpls {
+		if err := d.parseTemplate(tmplID(i), t); err != nil {
+			return nil, errgo.Notef(err, "cannot parse template %v", t)
+		}
+	}
+	return d, nil
 }
 
 // exec performs the Exec method on the given queryer by processing the
@@ -197,7 +275,11 @@ func (d *driver) queryRow(q queryer, tmplID tmplID, params argBuilder) (*sql.Row
 func (d *driver) parseTemplate(tmplID tmplID, tmpl string) error {
 	var err error
 	d.tmpls[tmplID], err = template.New("").Funcs(template.FuncMap{
-		"join": strings.Join,
+		"join":       strings.Join,
+		"likePrefix": likePrefix,
+		"likeMatch":  likeMatch,
+		"globPrefix": globPrefix,
+		"now":        time.Now,
 	}).Parse(tmpl)
 	return errgo.Mask(err)
 }
@@ -210,6 +292,9 @@ func (d *driver) executeTemplate(tmplID tmplID, params interface{}) (string, err
 	return buf.String(), nil
 }
 
+// comparisons holds the SQL operator used for each comparison. The
+// templates treat the comparisons named "prefix", "match" and "member"
+// specially.
 var comparisons = map[store.Comparison]string{
 	store.Equal:              "=",
 	store.NotEqual:           "<>",
@@ -217,4 +302,28 @@ var comparisons = map[store.Comparison]string{
 	store.LessThan:           "<",
 	store.GreaterThanOrEqual: ">=",
 	store.LessThanOrEqual:    "<=",
+	store.Prefix:             "prefix",
+	store.Match:              "match",
+}
+
+var likeReplacer = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePrefix returns a LIKE pattern, using "\" as the escape character,
+// that matches strings starting with s.
+func likePrefix(s string) string {
+	return likeReplacer.Replace(s) + "%"
+}
+
+// likeMatch returns a LIKE pattern, using "\" as the escape character,
+// that matches strings containing s.
+func likeMatch(s string) string {
+	return "%" + likeReplacer.Replace(s) + "%"
+}
+
+var globReplacer = strings.NewReplacer(`[`, `[[]`, `*`, `[*]`, `?`, `[?]`)
+
+// globPrefix returns an sqlite GLOB pattern that matches strings
+// starting with s.
+func globPrefix(s string) string {
+	return globReplacer.Replace(s) + "*"
 }
@@ -0,0 +1,182 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// aclKeyValueStore holds the name of the key-value store that
+	// holds the ACLs.
+	aclKeyValueStore = "acls"
+
+	// idpKeyValueStorePrefix holds the prefix added to the name of
+	// an identity provider to make the name of its key-value store.
+	idpKeyValueStorePrefix = "idpkv_"
+)
+
+// backupStore implements store.BackupStore.
+type backupStore struct {
+	*backend
+}
+
+type backupParams struct {
+	argBuilder
+	Name string
+}
+
+// ACLNames implements store.BackupStore.ACLNames.
+func (s *backupStore) ACLNames(_ context.Context) ([]string, error) {
+	var names []string
+	err := s.keyValues(aclKeyValueStore, func(kv store.KeyValue) error {
+		names = append(names, kv.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find ACLs")
+	}
+	return names, nil
+}
+
+// KeyValues implements store.BackupStore.KeyValues.
+func (s *backupStore) KeyValues(_ context.Context, f func(store.KeyValue) error) error {
+	rows, err := s.driver.query(s.db, tmplFindKeyValueStores, &backupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot find key-value stores")
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot find key-value stores")
+		}
+		if strings.HasPrefix(name, idpKeyValueStorePrefix) {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errgo.Notef(err, "cannot find key-value stores")
+	}
+	for _, name := range names {
+		idp := strings.TrimPrefix(name, idpKeyValueStorePrefix)
+		err := s.keyValues(name, func(kv store.KeyValue) error {
+			kv.IDP = idp
+			return f(kv)
+		})
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+// keyValues calls f for each value in the key-value store with the
+// given name.
+func (s *backupStore) keyValues(name string, f func(store.KeyValue) error) error {
+	rows, err := s.driver.query(s.db, tmplFindKeyValues, &backupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Name:       name,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot read %q", name)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kv store.KeyValue
+		var expire nullTime
+		if err := rows.Scan(&kv.Key, &kv.Value, &expire); err != nil {
+			return errgo.Notef(err, "cannot read %q", name)
+		}
+		kv.Expire = expire.Time
+		if err := f(kv); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errgo.Notef(err, "cannot read %q", name)
+	}
+	return nil
+}
+
+// Meetings implements store.BackupStore.Meetings.
+func (s *backupStore) Meetings(_ context.Context) ([]store.Meeting, error) {
+	rows, err := s.driver.query(s.db, tmplFindAllMeetings, &backupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find meetings")
+	}
+	defer rows.Close()
+	var meetings []store.Meeting
+	for rows.Next() {
+		var m store.Meeting
+		if err := rows.Scan(&m.ID, &m.Address, &m.Created); err != nil {
+			return nil, errgo.Notef(err, "cannot find meetings")
+		}
+		meetings = append(meetings, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot find meetings")
+	}
+	return meetings, nil
+}
+
+// InsertMeeting implements store.BackupStore.InsertMeeting.
+func (s *backupStore) InsertMeeting(_ context.Context, m store.Meeting) error {
+	ms := &meetingStore{s.backend}
+	return errgo.Mask(ms.put(m.ID, m.Address, m.Created))
+}
+
+type insertIdentityParams struct {
+	argBuilder
+	ID         int64
+	ProviderID string
+	Username   string
+}
+
+// InsertIdentity implements store.BackupStore.InsertIdentity. A row
+// holding just the ID, provider ID and username is inserted first, and
+// then updated as UpdateIdentity would.
+func (s *backupStore) InsertIdentity(_ context.Context, identity *store.Identity, update store.Update) error {
+	id, err := strconv.ParseInt(identity.ID, 10, 64)
+	if err != nil || id <= 0 {
+		return errgo.WithCausef(nil, store.ErrInvalidID, "invalid identity id %q", identity.ID)
+	}
+	err = s.withTx(func(tx *sql.Tx) error {
+		params := &insertIdentityParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			ID:         id,
+			ProviderID: string(identity.ProviderID),
+			Username:   identity.Username,
+		}
+		if _, err := s.driver.exec(tx, tmplInsertIdentity, params); err != nil {
+			if s.driver.isDuplicateFunc(errgo.Cause(err)) {
+				return errgo.Newf("identity %q, provider id %q or username %s already in use", identity.ID, identity.ProviderID, identity.Username)
+			}
+			return errgo.Mask(err)
+		}
+		params.argBuilder = s.driver.argBuilderFunc()
+		if _, err := s.driver.exec(tx, tmplSyncIdentityID, params); err != nil {
+			return errgo.Mask(err)
+		}
+		is := &identityStore{s.backend}
+		return errgo.Mask(is.updateIdentity(tx, identity, update, store.IdentityCreated), errgo.Is(store.ErrDuplicateProviderID))
+	})
+	if err != nil {
+		return errgo.NoteMask(err, "cannot insert identity", errgo.Is(store.ErrDuplicateProviderID))
+	}
+	return nil
+}
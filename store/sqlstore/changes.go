@@ -0,0 +1,179 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// watchPollInterval holds the interval at which Watch checks the
+// database for new changes.
+var watchPollInterval = 500 * time.Millisecond
+
+type insertChangeParams struct {
+	argBuilder
+	Time       time.Time
+	Type       int
+	ID         string
+	ProviderID string
+	Username   string
+	Fields     int
+}
+
+// insertChange records a change of the given type to the given
+// identity in the change log.
+func (s *identityStore) insertChange(tx *sql.Tx, typ store.ChangeType, identity *store.Identity, fields []store.Field) error {
+	params := &insertChangeParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Time:       time.Now(),
+		Type:       int(typ),
+		ID:         identity.ID,
+		ProviderID: string(identity.ProviderID),
+		Username:   identity.Username,
+		Fields:     store.FieldMask(fields),
+	}
+	_, err := s.driver.exec(tx, tmplInsertChange, params)
+	return errgo.Mask(err)
+}
+
+type findChangesParams struct {
+	argBuilder
+	Since int64
+	Limit int
+}
+
+// Watch implements store.Store.Watch by polling the change log.
+func (s *identityStore) Watch(ctx context.Context, since uint64) ([]store.IdentityChange, error) {
+	var ticker *time.Ticker
+	for {
+		changes, err := s.findChanges(since)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		// Check for removed changes after finding the changes so
+		// that any removed while finding them are also detected.
+		if err := s.checkChangesRemoved(since); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if len(changes) > 0 {
+			return changes, nil
+		}
+		if ticker == nil {
+			ticker = time.NewTicker(watchPollInterval)
+			defer ticker.Stop()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, errgo.Mask(ctx.Err(), errgo.Any)
+		}
+	}
+}
+
+func (s *identityStore) findChanges(since uint64) ([]store.IdentityChange, error) {
+	params := &findChangesParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Since:      int64(since),
+		Limit:      store.MaxWatchChanges,
+	}
+	rows, err := s.driver.query(s.db, tmplFindChanges, params)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find changes")
+	}
+	defer rows.Close()
+	var changes []store.IdentityChange
+	for rows.Next() {
+		var change store.IdentityChange
+		var typ, fields int
+		err := rows.Scan(
+			&change.Sequence,
+			&change.Time,
+			&typ,
+			&change.ID,
+			&change.ProviderID,
+			&change.Username,
+			&fields,
+		)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot find changes")
+		}
+		change.Type = store.ChangeType(typ)
+		change.Fields = store.MaskFields(fields)
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot find changes")
+	}
+	return changes, nil
+}
+
+// checkChangesRemoved returns a *store.ChangesRemovedError if any
+// change after since has been removed from the change log.
+func (s *identityStore) checkChangesRemoved(since uint64) error {
+	row, err := s.driver.queryRow(s.db, tmplChangesRemoved, &changesRemovedParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot find removed changes")
+	}
+	var removed int64
+	if err := row.Scan(&removed); err != nil {
+		return errgo.Notef(err, "cannot find removed changes")
+	}
+	if uint64(removed) > since {
+		return &store.ChangesRemovedError{Sequence: uint64(removed)}
+	}
+	return nil
+}
+
+type changesRemovedParams struct {
+	argBuilder
+	Before   time.Time
+	Sequence int64
+}
+
+// RemoveChanges implements store.Store.RemoveChanges. The changes are
+// removed by sequence number, up to the last change made before the
+// given time, and that sequence number is recorded so that Watch can
+// detect that they have been removed.
+func (s *identityStore) RemoveChanges(_ context.Context, before time.Time) (int, error) {
+	var n int64
+	err := s.withTx(func(tx *sql.Tx) error {
+		params := &changesRemovedParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			Before:     before,
+		}
+		row, err := s.driver.queryRow(tx, tmplLastChangeBefore, params)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := row.Scan(&params.Sequence); err != nil {
+			return errgo.Mask(err)
+		}
+		if params.Sequence == 0 {
+			return nil
+		}
+		params.argBuilder = s.driver.argBuilderFunc()
+		res, err := s.driver.exec(tx, tmplRemoveChanges, params)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return errgo.Mask(err)
+		}
+		params.argBuilder = s.driver.argBuilderFunc()
+		_, err = s.driver.exec(tx, tmplSetChangesRemoved, params)
+		return errgo.Mask(err)
+	})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove changes")
+	}
+	return int(n), nil
+}
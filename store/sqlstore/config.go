@@ -2,7 +2,10 @@ package sqlstore
 
 import (
 	"database/sql"
+	"net/url"
 
+	// Register the sqlite3 database driver.
+	_ "github.com/mattn/go-sqlite3"
 	errgo "gopkg.in/errgo.v1"
 
 	"github.com/canonical/candid/store"
@@ -14,8 +17,17 @@ type Params struct {
 	ConnectionString string `yaml:"connection-string"`
 }
 
+// SQLiteParams holds the specification for the parameters used in the
+// config file for an sqlite backend.
+type SQLiteParams struct {
+	// Path holds the path of the database file, it will be
+	// created if it does not exist.
+	Path string `yaml:"path"`
+}
+
 func init() {
 	store.Register("postgres", unmarshalBackend)
+	store.Register("sqlite", unmarshalSQLiteBackend)
 }
 
 func unmarshalBackend(unmarshal func(interface{}) error) (store.BackendFactory, error) {
@@ -39,3 +51,63 @@ func (p Params) NewBackend() (store.Backend, error) {
 	}
 	return backend, nil
 }
+
+// MigrateSchema applies any pending schema migrations to the
+// configured database, see the MigrateSchema function for details.
+func (p Params) MigrateSchema(dryRun bool) ([]Migration, error) {
+	db, err := sql.Open("postgres", p.ConnectionString)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to database")
+	}
+	defer db.Close()
+	return MigrateSchema("postgres", db, dryRun)
+}
+
+func unmarshalSQLiteBackend(unmarshal func(interface{}) error) (store.BackendFactory, error) {
+	var p SQLiteParams
+	if err := unmarshal(&p); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if p.Path == "" {
+		return nil, errgo.Newf("no path field in sqlite storage configuration")
+	}
+	return p, nil
+}
+
+// NewBackend implements store.BackendFactory.
+func (p SQLiteParams) NewBackend() (store.Backend, error) {
+	logger.Infof("opening sqlite database %s", p.Path)
+	db, err := sql.Open("sqlite3", SQLiteDataSourceName(p.Path))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open database")
+	}
+	backend, err := NewBackend("sqlite3", db)
+	if err != nil {
+		db.Close()
+		return nil, errgo.Notef(err, "cannot initialise database")
+	}
+	return backend, nil
+}
+
+// MigrateSchema applies any pending schema migrations to the
+// configured database, see the MigrateSchema function for details.
+func (p SQLiteParams) MigrateSchema(dryRun bool) ([]Migration, error) {
+	db, err := sql.Open("sqlite3", SQLiteDataSourceName(p.Path))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open database")
+	}
+	defer db.Close()
+	return MigrateSchema("sqlite3", db, dryRun)
+}
+
+// SQLiteDataSourceName returns the data source name to use to open the
+// sqlite database at the given path. Foreign keys are enforced and
+// transactions take the database write lock when they start, waiting
+// for other connections to release it if necessary.
+func SQLiteDataSourceName(path string) string {
+	return "file:" + path + "?" + url.Values{
+		"_busy_timeout": {"10000"},
+		"_foreign_keys": {"1"},
+		"_txlock":       {"immediate"},
+	}.Encode()
+}
@@ -1,10 +1,13 @@
 package sqlstore_test
 
 import (
+	"path/filepath"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
+	"gopkg.in/yaml.v2"
 
+	"github.com/canonical/candid/store"
 	"github.com/canonical/candid/store/storetest"
 )
 
@@ -19,3 +22,28 @@ storage:
     connection-string: 'search_path=`+f.pg.Schema()+`'
 `)
 }
+
+func TestSQLiteConfigUnmarshal(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestUnmarshal(c, `
+storage:
+    type: sqlite
+    path: `+filepath.Join(c.Mkdir(), "candid.db")+`
+`)
+}
+
+func TestSQLiteConfigUnmarshalWithNoPath(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(`
+storage:
+    type: sqlite
+`), &cfg)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal sqlite configuration: no path field in sqlite storage configuration`)
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// groupStore implements store.GroupStore using the group_info table.
+type groupStore struct {
+	*backend
+}
+
+type groupParams struct {
+	argBuilder
+	Name        string
+	Description string
+	Owners      string
+	Subgroups   string
+}
+
+// Group implements store.GroupStore.Group.
+func (s *groupStore) Group(_ context.Context, group *store.Group) error {
+	params := &groupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Name:       group.Name,
+	}
+	row, err := s.driver.queryRow(s.db, tmplGetGroup, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	g, err := scanGroup(row)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return store.GroupNotFoundError(group.Name)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	*group = g
+	return nil
+}
+
+// Groups implements store.GroupStore.Groups.
+func (s *groupStore) Groups(_ context.Context) ([]store.Group, error) {
+	rows, err := s.driver.query(s.db, tmplFindGroups, &groupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find groups")
+	}
+	defer rows.Close()
+	var groups []store.Group
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot find groups")
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot find groups")
+	}
+	return groups, nil
+}
+
+// SetGroup implements store.GroupStore.SetGroup.
+func (s *groupStore) SetGroup(_ context.Context, group *store.Group) error {
+	owners, err := marshalStrings(group.Owners)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	subgroups, err := marshalStrings(group.Subgroups)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	params := &groupParams{
+		argBuilder:  s.driver.argBuilderFunc(),
+		Name:        group.Name,
+		Description: group.Description,
+		Owners:      owners,
+		Subgroups:   subgroups,
+	}
+	if _, err := s.driver.exec(s.db, tmplUpsertGroup, params); err != nil {
+		return errgo.Notef(err, "cannot set group")
+	}
+	return nil
+}
+
+// RemoveGroup implements store.GroupStore.RemoveGroup.
+func (s *groupStore) RemoveGroup(_ context.Context, name string) error {
+	params := &groupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Name:       name,
+	}
+	res, err := s.driver.exec(s.db, tmplRemoveGroup, params)
+	if err != nil {
+		return errgo.Notef(err, "cannot remove group")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errgo.Notef(err, "cannot remove group")
+	} else if n == 0 {
+		return store.GroupNotFoundError(name)
+	}
+	return nil
+}
+
+func scanGroup(s scanner) (store.Group, error) {
+	var g store.Group
+	var owners, subgroups string
+	if err := s.Scan(&g.Name, &g.Description, &owners, &subgroups); err != nil {
+		return store.Group{}, errgo.Mask(err, errgo.Any)
+	}
+	var err error
+	if g.Owners, err = unmarshalStrings(owners); err != nil {
+		return store.Group{}, errgo.Mask(err)
+	}
+	if g.Subgroups, err = unmarshalStrings(subgroups); err != nil {
+		return store.Group{}, errgo.Mask(err)
+	}
+	return g, nil
+}
@@ -5,9 +5,11 @@ package sqlstore
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/juju/simplekv"
-	"github.com/juju/simplekv/sqlsimplekv"
+	errgo "gopkg.in/errgo.v1"
 )
 
 // A providerDataStore implements store.ProviderDataStore.
@@ -16,5 +18,106 @@ type providerDataStore struct {
 }
 
 func (s *providerDataStore) KeyValueStore(_ context.Context, idp string) (simplekv.Store, error) {
-	return sqlsimplekv.NewStore(s.b.driver.name, s.b.db, "idpkv_"+idp)
+	return s.b.driver.newKeyValueStoreFunc(s.b, idpKeyValueStorePrefix+idp)
+}
+
+// keyValueStore implements simplekv.Store using the provider_data
+// table, each store uses a different value in the provider column.
+type keyValueStore struct {
+	*backend
+	provider string
+}
+
+// newKeyValueStore creates a new simplekv.Store that stores its values
+// in the provider_data table using the given name as the provider.
+func newKeyValueStore(b *backend, name string) (simplekv.Store, error) {
+	return &keyValueStore{
+		backend:  b,
+		provider: name,
+	}, nil
+}
+
+// Context implements simplekv.Store.Context by returning the given
+// context unmodified.
+func (s *keyValueStore) Context(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+type providerDataParams struct {
+	argBuilder
+	Provider string
+	Key      string
+	Value    []byte
+	Expire   nullTime
+	Update   bool
+}
+
+// Get implements simplekv.Store.Get.
+func (s *keyValueStore) Get(_ context.Context, key string) ([]byte, error) {
+	value, err := s.get(s.db, tmplGetProviderData, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+	}
+	return value, nil
+}
+
+func (s *keyValueStore) get(q queryer, tmpl tmplID, key string) ([]byte, error) {
+	params := &providerDataParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Provider:   s.provider,
+		Key:        key,
+	}
+	row, err := s.driver.queryRow(q, tmpl, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var value []byte
+	if err := row.Scan(&value); err != nil {
+		if errgo.Cause(err) == sql.ErrNoRows {
+			return nil, simplekv.KeyNotFoundError(key)
+		}
+		return nil, errgo.Mask(err)
+	}
+	if value == nil {
+		// Make sure that a stored empty value can be
+		// distinguished from a missing value.
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *keyValueStore) Set(_ context.Context, key string, value []byte, expire time.Time) error {
+	return errgo.Mask(s.set(s.db, key, value, expire))
+}
+
+func (s *keyValueStore) set(q queryer, key string, value []byte, expire time.Time) error {
+	if value == nil {
+		value = []byte{}
+	}
+	params := &providerDataParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Provider:   s.provider,
+		Key:        key,
+		Value:      value,
+		Expire:     nullTime{expire, !expire.IsZero()},
+		Update:     true,
+	}
+	_, err := s.driver.exec(q, tmplInsertProviderData, params)
+	return errgo.Mask(err)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *keyValueStore) Update(_ context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
+		old, err := s.get(tx, tmplGetProviderDataForUpdate, key)
+		if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+			return errgo.Mask(err)
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return errgo.Mask(s.set(tx, key, value, expire))
+	}), errgo.Any)
 }
@@ -0,0 +1,101 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"database/sql"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// A Migration holds a change to the database schema.
+type Migration struct {
+	// Version holds the schema version that results from applying
+	// the migration.
+	Version int
+
+	// SQL holds the statements that perform the migration.
+	SQL string
+}
+
+// MigrateSchema brings the schema of the given database up to date by
+// applying all pending migrations in a single transaction. The
+// driverName must match the value used to open the database. The
+// migrations are returned in the order they were applied. If dryRun is
+// true then the pending migrations are returned without being applied.
+//
+// NewBackend calls MigrateSchema automatically, it only needs to be
+// called directly in order to examine the migrations before they are
+// applied.
+func MigrateSchema(driverName string, db *sql.DB, dryRun bool) ([]Migration, error) {
+	d, err := newDriver(driverName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	migrations, err := d.migrate(db, dryRun)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot migrate schema")
+	}
+	return migrations, nil
+}
+
+// errDryRun is used to abandon the migration transaction in a dry run.
+var errDryRun = errgo.New("dry run")
+
+type schemaVersionParams struct {
+	argBuilder
+	Version int
+}
+
+// migrate applies any migrations that have not yet been applied to the
+// given database, returning the migrations. If dryRun is true the
+// migrations are not applied.
+func (d *driver) migrate(db *sql.DB, dryRun bool) ([]Migration, error) {
+	var pending []Migration
+	err := withTx(db, func(tx *sql.Tx) error {
+		if _, err := d.exec(tx, tmplInitSchemaVersion, d.argBuilderFunc()); err != nil {
+			return errgo.Notef(err, "cannot create schema_version table")
+		}
+		row, err := d.queryRow(tx, tmplSchemaVersion, d.argBuilderFunc())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var version int
+		if err := row.Scan(&version); err != nil {
+			return errgo.Notef(err, "cannot get schema version")
+		}
+		if version > len(d.migrations) {
+			return errgo.Newf("database schema version %d is newer than the latest known version %d", version, len(d.migrations))
+		}
+		for i := version; i < len(d.migrations); i++ {
+			pending = append(pending, Migration{
+				Version: i + 1,
+				SQL:     d.migrations[i],
+			})
+		}
+		if dryRun {
+			// Abandon the transaction so that the
+			// schema_version table is not left behind.
+			return errDryRun
+		}
+		for _, m := range pending {
+			logger.Infof("applying schema migration %d", m.Version)
+			if _, err := tx.Exec(m.SQL); err != nil {
+				return errgo.Notef(err, "cannot apply migration %d", m.Version)
+			}
+			params := &schemaVersionParams{
+				argBuilder: d.argBuilderFunc(),
+				Version:    m.Version,
+			}
+			if _, err := d.exec(tx, tmplSetSchemaVersion, params); err != nil {
+				return errgo.Notef(err, "cannot set schema version")
+			}
+		}
+		return nil
+	})
+	if err != nil && errgo.Cause(err) != errDryRun {
+		return nil, errgo.Mask(err)
+	}
+	return pending, nil
+}
@@ -1,14 +1,21 @@
 package sqlstore
 
 import (
-	"database/sql"
 	"fmt"
 
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
 	"github.com/lib/pq"
-	errgo "gopkg.in/errgo.v1"
 )
 
-const postgresInit = `
+// postgresMigrations holds the schema migrations for postgres. Once a
+// migration has been released it must not be changed, any further
+// changes to the schema must be made by adding a new migration.
+var postgresMigrations = []string{
+	// Migration 1 creates the schema as it was before schema
+	// versioning was introduced. Databases that were created
+	// before then will already contain some, or all, of it.
+	`
 CREATE TABLE IF NOT EXISTS identities ( 
 	id SERIAL PRIMARY KEY,
 	providerid TEXT UNIQUE NOT NULL,
@@ -85,19 +92,137 @@ CREATE TABLE IF NOT EXISTS meetings (
 	address TEXT NOT NULL,
 	created TIMESTAMP WITH TIME ZONE NOT NULL
 );
-`
+`,
+	// Migration 2 adds the audit log.
+	`
+CREATE TABLE IF NOT EXISTS audit_log ( 
+	id SERIAL PRIMARY KEY,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	actor TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	target TEXT NOT NULL,
+	before TEXT NOT NULL,
+	after TEXT NOT NULL,
+	requestid TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+`,
+	// Migration 3 adds the identity change log.
+	`
+CREATE TABLE IF NOT EXISTS identity_changes (
+	seq BIGSERIAL PRIMARY KEY,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	type INTEGER NOT NULL,
+	identity INTEGER NOT NULL,
+	providerid TEXT NOT NULL,
+	username TEXT NOT NULL,
+	fields INTEGER NOT NULL
+);
+`,
+	// Migration 4 creates the table used by postgresrootkeystore,
+	// which otherwise would not exist until the first root key is
+	// used, so that root keys can always be backed up and restored.
+	// The definition must match that used by postgresrootkeystore.
+	`
+CREATE TABLE IF NOT EXISTS rootkeys (
+	id BYTEA PRIMARY KEY NOT NULL,
+	rootkey BYTEA,
+	created TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires TIMESTAMP WITH TIME ZONE NOT NULL
+);
+`,
+	// Migration 5 adds the indexes and the trigger that removes
+	// expired keys that were previously created by
+	// postgresrootkeystore, which is no longer used. The names match
+	// those used by postgresrootkeystore so that databases that it
+	// has already initialised are unchanged.
+	`
+CREATE OR REPLACE FUNCTION rootkeys_expire_func() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+	BEGIN
+		DELETE FROM rootkeys WHERE expires < NOW();
+		RETURN NEW;
+	END;
+$$;
+
+CREATE INDEX IF NOT EXISTS rootkeys_index_create ON rootkeys (created);
+
+CREATE INDEX IF NOT EXISTS rootkeys_index_expire ON rootkeys (expires);
+
+DROP TRIGGER IF EXISTS rootkeys_trigger ON rootkeys;
+
+CREATE TRIGGER rootkeys_trigger
+	BEFORE INSERT ON rootkeys
+	EXECUTE PROCEDURE rootkeys_expire_func();
+`,
+	// Migration 6 adds the group store.
+	`
+CREATE TABLE IF NOT EXISTS group_info (
+	name TEXT PRIMARY KEY NOT NULL,
+	description TEXT NOT NULL,
+	owners TEXT NOT NULL
+);
+`,
+	// Migration 7 adds nested groups.
+	`
+ALTER TABLE group_info ADD COLUMN subgroups TEXT NOT NULL DEFAULT '';
+`,
+	// Migration 8 adds disabled identities.
+	`
+ALTER TABLE identities ADD COLUMN disabled TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE identities ADD COLUMN disabledreason TEXT;
+`,
+	// Migration 9 adds identity expiry.
+	`
+ALTER TABLE identities ADD COLUMN expires TIMESTAMP WITH TIME ZONE;
+`,
+	// Migration 10 adds linked provider IDs.
+	`
+CREATE TABLE IF NOT EXISTS identity_providerids (
+	identity INTEGER REFERENCES identities NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, value)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS identity_providerids_value ON identity_providerids (value);
+`,
+	// Migration 11 indexes the identity change log by time.
+	`
+CREATE INDEX IF NOT EXISTS identity_changes_time ON identity_changes (time);
+`,
+	// Migration 12 records the sequence number of the last change
+	// removed from the identity change log. Changes may already have
+	// been removed, so it starts from the change before the earliest
+	// remaining one or, if there are none, the last change made.
+	`
+CREATE TABLE IF NOT EXISTS identity_changes_removed (
+	seq BIGINT NOT NULL
+);
+
+INSERT INTO identity_changes_removed (seq)
+SELECT COALESCE(
+	(SELECT MIN(seq) - 1 FROM identity_changes),
+	(SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM identity_changes_seq_seq),
+	0
+);
+`,
+}
 
 var postgresTmpls = [numTmpl]string{
 	tmplIdentityFrom: `
-		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner,
+			disabled, disabledreason, expires
 		FROM identities
 		WHERE {{.Column}}={{.Identity | .Arg}}`,
 	tmplSelectIdentitySet: `
 		SELECT {{if .Key}}key, {{end}}value FROM {{.Table}} 
 		WHERE identity={{.Identity | .Arg}}`,
 	tmplFindIdentities: `
-		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner FROM identities
-		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{end}}
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner, disabled, disabledreason, expires FROM identities
+		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{if eq $w.Comparison "prefix"}}{{$w.Column}} LIKE {{$w.Value | likePrefix | $.Arg}} ESCAPE '\'{{else if eq $w.Comparison "match"}}{{$w.Column}} ILIKE {{$w.Value | likeMatch | $.Arg}} ESCAPE '\'{{else if eq $w.Comparison "member"}}EXISTS (SELECT 1 FROM identity_groups WHERE identity_groups.identity=identities.id AND identity_groups.value={{$w.Value | $.Arg}}){{else}}{{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{end}}{{end}}
 		{{if .Sort}}ORDER BY {{join .Sort ", "}}{{end}}
 		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}
 		{{if gt .Skip 0}}OFFSET {{.Skip}}{{end}}`,
@@ -105,17 +230,23 @@ var postgresTmpls = [numTmpl]string{
 		UPDATE identities
 		SET {{range $i, $u := .Updates}}{{if gt $i 0}}, {{end}} {{$u.Column}}={{$u.Value | $.Arg}}{{end}}
 		WHERE {{.Column}}={{.Identity | .Arg}}
-		RETURNING id`,
+		RETURNING id, providerid, username`,
 	tmplIdentityID: `
-		SELECT id FROM identities
+		SELECT id, providerid, username FROM identities
 		WHERE {{.Column}}={{.Identity | .Arg}}`,
+	// Locking the identity row serialises updates that only change
+	// the identity's sets with other updates to the identity.
+	tmplLockIdentity: `
+		SELECT id, providerid, username FROM identities
+		WHERE {{.Column}}={{.Identity | .Arg}}
+		FOR UPDATE`,
 	tmplUpsertIdentity: `
 		INSERT INTO identities (providerid{{range .Updates}}, {{.Column}}{{end}})
 		VALUES ({{.Identity | .Arg}}{{range .Updates}}, {{.Value | $.Arg}}{{end}})
 		ON CONFLICT (providerid) DO UPDATE 
 		SET{{range $i, $u := .Updates}}{{if gt $i 0}}, {{end}} {{$u.Column}}={{$u.Value | $.Arg}}{{end}}
 		WHERE identities.providerid={{.Identity | .Arg}}
-		RETURNING id`,
+		RETURNING id, providerid, username`,
 	tmplClearIdentitySet: `
 		DELETE FROM {{.Table}}
 		WHERE identity={{.ID | .Arg}}{{if .Key}} AND key={{.Key | .Arg}}{{end}}`,
@@ -154,27 +285,127 @@ var postgresTmpls = [numTmpl]string{
 	tmplIdentityCounts: `
 		SELECT substring(providerid, '^[^:]*') as idp, COUNT(1) 
 		FROM identities GROUP BY idp`,
+	tmplRemoveIdentity: `
+		DELETE FROM identities
+		WHERE id={{.ID | .Arg}}`,
+	tmplInsertAuditEntry: `
+		INSERT INTO audit_log (time, actor, operation, target, before, after, requestid)
+		VALUES ({{.Time | .Arg}}, {{.Actor | .Arg}}, {{.Operation | .Arg}}, {{.Target | .Arg}}, {{.Before | .Arg}}, {{.After | .Arg}}, {{.RequestID | .Arg}})
+		RETURNING id`,
+	tmplFindAuditEntries: `
+		SELECT id, time, actor, operation, target, before, after, requestid FROM audit_log
+		WHERE TRUE
+		{{if .Actor}}AND actor={{.Actor | .Arg}}{{end}}
+		{{if .Target}}AND target={{.Target | .Arg}}{{end}}
+		{{if .Operation}}AND operation={{.Operation | .Arg}}{{end}}
+		{{if not .Since.IsZero}}AND time>={{.Since | .Arg}}{{end}}
+		{{if not .Until.IsZero}}AND time<{{.Until | .Arg}}{{end}}
+		ORDER BY time DESC, id DESC
+		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}`,
+	tmplGetRootKey: `
+		SELECT id, created, expires, rootkey FROM rootkeys
+		WHERE id={{.ID | .Arg}} AND expires > now()`,
+	tmplFindLatestRootKey: `
+		SELECT id, created, expires, rootkey FROM rootkeys
+		WHERE created >= {{.CreatedAfter | .Arg}}
+		AND expires >= {{.ExpiresAfter | .Arg}}
+		AND expires <= {{.ExpiresBefore | .Arg}}
+		ORDER BY created DESC
+		LIMIT 1`,
+	tmplInsertRootKey: `
+		INSERT INTO rootkeys (id, rootkey, created, expires)
+		VALUES ({{.ID | .Arg}}, {{.RootKey | .Arg}}, {{.Created | .Arg}}, {{.Expires | .Arg}})
+		ON CONFLICT (id) DO UPDATE
+		SET rootkey={{.RootKey | .Arg}}, created={{.Created | .Arg}}, expires={{.Expires | .Arg}}`,
+	tmplInitSchemaVersion: `
+		-- Make sure that only one client migrates the schema at a time.
+		SELECT pg_advisory_xact_lock(7240836918);
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			applied TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+		)`,
+	tmplSchemaVersion: `
+		SELECT COALESCE(MAX(version), 0) FROM schema_version`,
+	tmplSetSchemaVersion: `
+		INSERT INTO schema_version (version)
+		VALUES ({{.Version | .Arg}})`,
+	// The lock makes sure that changes are committed in sequence
+	// order, so that a watcher never sees a change before one with
+	// a lower sequence number.
+	tmplInsertChange: `
+		WITH lock AS (SELECT pg_advisory_xact_lock(7240836919))
+		INSERT INTO identity_changes (time, type, identity, providerid, username, fields)
+		SELECT {{.Time | .Arg}}::timestamptz, {{.Type | .Arg}}::integer, {{.ID | .Arg}}::integer, {{.ProviderID | .Arg}}, {{.Username | .Arg}}, {{.Fields | .Arg}}::integer
+		FROM lock`,
+	tmplFindChanges: `
+		SELECT seq, time, type, identity, providerid, username, fields FROM identity_changes
+		WHERE seq > {{.Since | .Arg}}
+		ORDER BY seq
+		LIMIT {{.Limit}}`,
+	tmplLastChangeBefore: `
+		SELECT COALESCE(MAX(seq), 0) FROM identity_changes
+		WHERE time < {{.Before | .Arg}}`,
+	tmplRemoveChanges: `
+		DELETE FROM identity_changes WHERE seq <= {{.Sequence | .Arg}}`,
+	tmplChangesRemoved: `
+		SELECT seq FROM identity_changes_removed`,
+	tmplSetChangesRemoved: `
+		UPDATE identity_changes_removed SET seq=GREATEST(seq, {{.Sequence | .Arg}})`,
+	tmplFindRootKeys: `
+		SELECT id, created, expires, rootkey FROM rootkeys
+		WHERE expires > now()
+		ORDER BY created`,
+	tmplRemoveRootKey: `
+		DELETE FROM rootkeys WHERE id={{.ID | .Arg}}`,
+	// Key-value stores are held in tables created by sqlsimplekv,
+	// one for each store.
+	tmplFindKeyValueStores: `
+		SELECT table_name FROM information_schema.tables
+		WHERE table_schema=current_schema() AND table_name LIKE 'idpkv\_%'
+		ORDER BY table_name`,
+	tmplFindKeyValues: `
+		SELECT key, value, expire FROM {{.Name}}
+		WHERE expire IS NULL OR expire > now()
+		ORDER BY key`,
+	tmplFindAllMeetings: `
+		SELECT id, address, created FROM meetings
+		ORDER BY id`,
+	tmplGetGroup: `
+		SELECT name, description, owners, subgroups FROM group_info
+		WHERE name={{.Name | .Arg}}`,
+	tmplFindGroups: `
+		SELECT name, description, owners, subgroups FROM group_info
+		ORDER BY name`,
+	tmplUpsertGroup: `
+		INSERT INTO group_info (name, description, owners, subgroups)
+		VALUES ({{.Name | .Arg}}, {{.Description | .Arg}}, {{.Owners | .Arg}}, {{.Subgroups | .Arg}})
+		ON CONFLICT (name) DO UPDATE
+		SET description={{.Description | .Arg}}, owners={{.Owners | .Arg}}, subgroups={{.Subgroups | .Arg}}`,
+	tmplRemoveGroup: `
+		DELETE FROM group_info WHERE name={{.Name | .Arg}}`,
+	tmplLinkedIdentity: `
+		SELECT identity FROM identity_providerids
+		WHERE value={{.Identity | .Arg}}`,
+	tmplInsertIdentity: `
+		INSERT INTO identities (id, providerid, username)
+		VALUES ({{.ID | .Arg}}, {{.ProviderID | .Arg}}, {{.Username | .Arg}})`,
+	// Make sure that identities created later are not allocated an
+	// id that has been inserted explicitly.
+	tmplSyncIdentityID: `
+		SELECT setval('identities_id_seq', GREATEST((SELECT MAX(id) FROM identities), (SELECT last_value FROM identities_id_seq)))`,
 }
 
-// newPostgresDriver creates a postgres driver using the given DB.
-func newPostgresDriver(db *sql.DB) (*driver, error) {
-	_, err := db.Exec(postgresInit)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	d := &driver{
+// newPostgresDriver creates a postgres driver.
+func newPostgresDriver() *driver {
+	return &driver{
 		name: "postgres",
 		argBuilderFunc: func() argBuilder {
 			return &postgresArgBuilder{}
 		},
-		isDuplicateFunc: postgresIsDuplicate,
-	}
-	for i, t := range postgresTmpls {
-		if err := d.parseTemplate(tmplID(i), t); err != nil {
-			return nil, errgo.Notef(err, "cannot parse template %v", t)
-		}
+		isDuplicateFunc:      postgresIsDuplicate,
+		migrations:           postgresMigrations,
+		newKeyValueStoreFunc: newPostgresKeyValueStore,
 	}
-	return d, nil
 }
 
 func postgresIsDuplicate(err error) bool {
@@ -200,3 +431,9 @@ func (b *postgresArgBuilder) Arg(a interface{}) string {
 func (b *postgresArgBuilder) args() []interface{} {
 	return b.args_
 }
+
+// newPostgresKeyValueStore creates a simplekv.Store that stores its
+// values in the table with the given name.
+func newPostgresKeyValueStore(b *backend, name string) (simplekv.Store, error) {
+	return sqlsimplekv.NewStore("postgres", b.db, name)
+}
@@ -52,6 +52,42 @@ func TestACLStore(t *testing.T) {
 	})
 }
 
+func TestAuditStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestAuditStore(c, func(c *qt.C) store.AuditStore {
+		return newFixture(c).backend.AuditStore()
+	})
+}
+
+func TestBackupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestBackupStore(c, func(c *qt.C) store.Backend {
+		return newFixture(c).backend
+	})
+}
+
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestRootKeyStore(c, func(c *qt.C) store.RootKeyStore {
+		return newFixture(c).backend.RootKeyStore()
+	})
+}
+
+func TestGroupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestGroupStore(c, func(c *qt.C) store.GroupStore {
+		return newFixture(c).backend.GroupStore()
+	})
+}
+
 func TestUpdateIDNotFound(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -170,6 +206,36 @@ func TestInitIdempotent(t *testing.T) {
 	c.Assert(id2, qt.DeepEquals, id1)
 }
 
+func TestMigrateSchema(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	f := newFixture(c)
+
+	// The fixture's backend has already applied all the
+	// migrations.
+	migrations, err := sqlstore.MigrateSchema("postgres", f.pg.DB, true)
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrations, qt.HasLen, 0)
+
+	// Simulate a database created before schema versioning, all
+	// the migrations should be applied again without error.
+	_, err = f.pg.DB.Exec("DROP TABLE schema_version")
+	c.Assert(err, qt.IsNil)
+	migrations, err = sqlstore.MigrateSchema("postgres", f.pg.DB, true)
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(migrations) > 0, qt.Equals, true)
+	c.Assert(migrations[0].Version, qt.Equals, 1)
+
+	migrations1, err := sqlstore.MigrateSchema("postgres", f.pg.DB, false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrations1, qt.DeepEquals, migrations)
+
+	migrations, err = sqlstore.MigrateSchema("postgres", f.pg.DB, true)
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrations, qt.HasLen, 0)
+}
+
 type fixture struct {
 	backend store.Backend
 	pg      *postgrestest.DB
@@ -0,0 +1,130 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// rootKeyStore implements store.RootKeyStore using the rootkeys table.
+type rootKeyStore struct {
+	*backend
+}
+
+type rootKeyParams struct {
+	argBuilder
+	ID            []byte
+	RootKey       []byte
+	Created       time.Time
+	Expires       time.Time
+	CreatedAfter  time.Time
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+}
+
+// RootKey implements store.RootKeyStore.RootKey.
+func (s *rootKeyStore) RootKey(_ context.Context, id []byte) (store.RootKey, error) {
+	params := &rootKeyParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id,
+	}
+	row, err := s.driver.queryRow(s.db, tmplGetRootKey, params)
+	if err != nil {
+		return store.RootKey{}, errgo.Mask(err)
+	}
+	key, err := scanRootKey(row)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return store.RootKey{}, store.RootKeyNotFoundError(id)
+	}
+	return key, errgo.Mask(err)
+}
+
+// FindLatestRootKey implements store.RootKeyStore.FindLatestRootKey.
+func (s *rootKeyStore) FindLatestRootKey(_ context.Context, createdAfter, expiresAfter, expiresBefore time.Time) (store.RootKey, error) {
+	params := &rootKeyParams{
+		argBuilder:    s.driver.argBuilderFunc(),
+		CreatedAfter:  createdAfter.UTC(),
+		ExpiresAfter:  expiresAfter.UTC(),
+		ExpiresBefore: expiresBefore.UTC(),
+	}
+	row, err := s.driver.queryRow(s.db, tmplFindLatestRootKey, params)
+	if err != nil {
+		return store.RootKey{}, errgo.Mask(err)
+	}
+	key, err := scanRootKey(row)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return store.RootKey{}, errgo.WithCausef(nil, store.ErrNotFound, "no suitable root key found")
+	}
+	return key, errgo.Mask(err)
+}
+
+// InsertRootKey implements store.RootKeyStore.InsertRootKey.
+func (s *rootKeyStore) InsertRootKey(_ context.Context, key store.RootKey) error {
+	params := &rootKeyParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         key.ID,
+		RootKey:    key.RootKey,
+		Created:    key.Created.UTC(),
+		Expires:    key.Expires.UTC(),
+	}
+	if _, err := s.driver.exec(s.db, tmplInsertRootKey, params); err != nil {
+		return errgo.Notef(err, "cannot insert root key")
+	}
+	return nil
+}
+
+// RootKeys implements store.RootKeyStore.RootKeys.
+func (s *rootKeyStore) RootKeys(_ context.Context) ([]store.RootKey, error) {
+	rows, err := s.driver.query(s.db, tmplFindRootKeys, &rootKeyParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find root keys")
+	}
+	defer rows.Close()
+	var keys []store.RootKey
+	for rows.Next() {
+		key, err := scanRootKey(rows)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot find root keys")
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot find root keys")
+	}
+	return keys, nil
+}
+
+// RemoveRootKey implements store.RootKeyStore.RemoveRootKey.
+func (s *rootKeyStore) RemoveRootKey(_ context.Context, id []byte) error {
+	params := &rootKeyParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id,
+	}
+	res, err := s.driver.exec(s.db, tmplRemoveRootKey, params)
+	if err != nil {
+		return errgo.Notef(err, "cannot remove root key")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errgo.Notef(err, "cannot remove root key")
+	} else if n == 0 {
+		return store.RootKeyNotFoundError(id)
+	}
+	return nil
+}
+
+func scanRootKey(s scanner) (store.RootKey, error) {
+	var key store.RootKey
+	if err := s.Scan(&key.ID, &key.Created, &key.Expires, &key.RootKey); err != nil {
+		return store.RootKey{}, errgo.Mask(err, errgo.Any)
+	}
+	return key, nil
+}
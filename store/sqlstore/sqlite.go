@@ -0,0 +1,419 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations holds the schema migrations for sqlite. Once a
+// migration has been released it must not be changed, any further
+// changes to the schema must be made by adding a new migration.
+//
+// Timestamps are stored as text, the sqlite3 driver formats them such
+// that they compare correctly as long as they are all in UTC, see
+// sqliteArgBuilder. The text does not compare correctly with the
+// output of sqlite's own date functions, so queries compare against
+// the current time passed as an argument. Triggers cannot take
+// arguments and so compare using julianday instead.
+var sqliteMigrations = []string{
+	// Migration 1 creates the initial schema.
+	`
+CREATE TABLE IF NOT EXISTS identities (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	providerid TEXT UNIQUE NOT NULL,
+	username TEXT UNIQUE NOT NULL,
+	name TEXT,
+	email TEXT,
+	lastlogin TIMESTAMP,
+	lastdischarge TIMESTAMP,
+	owner TEXT
+);
+
+CREATE TABLE IF NOT EXISTS identity_groups (
+	identity INTEGER REFERENCES identities NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, value)
+);
+
+CREATE TABLE IF NOT EXISTS identity_publickeys (
+	identity INTEGER REFERENCES identities NOT NULL,
+	value BLOB NOT NULL,
+	UNIQUE (identity, value)
+);
+
+CREATE TABLE IF NOT EXISTS identity_providerinfo (
+	identity INTEGER REFERENCES identities NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, key, value)
+);
+
+CREATE TABLE IF NOT EXISTS identity_extrainfo (
+	identity INTEGER REFERENCES identities NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, key, value)
+);
+
+CREATE TABLE IF NOT EXISTS provider_data (
+	provider TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value BLOB NOT NULL,
+	expire TIMESTAMP,
+	UNIQUE (provider, key)
+);
+
+CREATE INDEX IF NOT EXISTS provider_data_expire ON provider_data (expire);
+
+CREATE TRIGGER IF NOT EXISTS provider_data_expire_tr
+	BEFORE INSERT ON provider_data
+	BEGIN
+		DELETE FROM provider_data WHERE expire < strftime('%Y-%m-%d %H:%M:%f', 'now');
+	END;
+
+CREATE TABLE IF NOT EXISTS meetings (
+	id TEXT NOT NULL PRIMARY KEY,
+	address TEXT NOT NULL,
+	created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	actor TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	target TEXT NOT NULL,
+	before TEXT NOT NULL,
+	after TEXT NOT NULL,
+	requestid TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+
+CREATE TABLE IF NOT EXISTS rootkeys (
+	id BLOB PRIMARY KEY NOT NULL,
+	rootkey BLOB,
+	created TIMESTAMP NOT NULL,
+	expires TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rootkeys_created ON rootkeys (created);
+
+CREATE TRIGGER IF NOT EXISTS rootkeys_expire_tr
+	BEFORE INSERT ON rootkeys
+	BEGIN
+		DELETE FROM rootkeys WHERE expires < strftime('%Y-%m-%d %H:%M:%f', 'now');
+	END;
+`,
+	// Migration 2 adds the identity change log.
+	`
+CREATE TABLE IF NOT EXISTS identity_changes (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	type INTEGER NOT NULL,
+	identity INTEGER NOT NULL,
+	providerid TEXT NOT NULL,
+	username TEXT NOT NULL,
+	fields INTEGER NOT NULL
+);
+`,
+	// Migration 3 adds the group store.
+	`
+CREATE TABLE IF NOT EXISTS group_info (
+	name TEXT PRIMARY KEY NOT NULL,
+	description TEXT NOT NULL,
+	owners TEXT NOT NULL
+);
+`,
+	// Migration 4 adds nested groups.
+	`
+ALTER TABLE group_info ADD COLUMN subgroups TEXT NOT NULL DEFAULT '';
+`,
+	// Migration 5 adds disabled identities.
+	`
+ALTER TABLE identities ADD COLUMN disabled TIMESTAMP;
+
+ALTER TABLE identities ADD COLUMN disabledreason TEXT;
+`,
+	// Migration 6 adds identity expiry.
+	`
+ALTER TABLE identities ADD COLUMN expires TIMESTAMP;
+`,
+	// Migration 7 adds linked provider IDs.
+	`
+CREATE TABLE IF NOT EXISTS identity_providerids (
+	identity INTEGER REFERENCES identities NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, value)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS identity_providerids_value ON identity_providerids (value);
+`,
+	// Migration 8 indexes the identity change log by time.
+	`
+CREATE INDEX IF NOT EXISTS identity_changes_time ON identity_changes (time);
+`,
+	// Migration 9 replaces the expiry triggers with ones that do not
+	// compare the stored time text with strftime.
+	`
+DROP TRIGGER IF EXISTS provider_data_expire_tr;
+
+CREATE TRIGGER provider_data_expire_tr
+	BEFORE INSERT ON provider_data
+	BEGIN
+		DELETE FROM provider_data WHERE julianday(expire) < julianday('now');
+	END;
+
+DROP TRIGGER IF EXISTS rootkeys_expire_tr;
+
+CREATE TRIGGER rootkeys_expire_tr
+	BEFORE INSERT ON rootkeys
+	BEGIN
+		DELETE FROM rootkeys WHERE julianday(expires) < julianday('now');
+	END;
+`,
+	// Migration 10 records the sequence number of the last change
+	// removed from the identity change log. Changes may already have
+	// been removed, so it starts from the change before the earliest
+	// remaining one or, if there are none, the last change made.
+	`
+CREATE TABLE IF NOT EXISTS identity_changes_removed (
+	seq INTEGER NOT NULL
+);
+
+INSERT INTO identity_changes_removed (seq)
+SELECT COALESCE(
+	(SELECT MIN(seq) - 1 FROM identity_changes),
+	(SELECT seq FROM sqlite_sequence WHERE name='identity_changes'),
+	0
+);
+`,
+}
+
+var sqliteTmpls = [numTmpl]string{
+	tmplIdentityFrom: `
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner,
+			disabled, disabledreason, expires
+		FROM identities
+		WHERE {{.Column}}={{.Identity | .Arg}}`,
+	tmplSelectIdentitySet: `
+		SELECT {{if .Key}}key, {{end}}value FROM {{.Table}}
+		WHERE identity={{.Identity | .Arg}}`,
+	tmplFindIdentities: `
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner, disabled, disabledreason, expires FROM identities
+		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{if eq $w.Comparison "prefix"}}{{$w.Column}} GLOB {{$w.Value | globPrefix | $.Arg}}{{else if eq $w.Comparison "match"}}{{$w.Column}} LIKE {{$w.Value | likeMatch | $.Arg}} ESCAPE '\'{{else if eq $w.Comparison "member"}}EXISTS (SELECT 1 FROM identity_groups WHERE identity_groups.identity=identities.id AND identity_groups.value={{$w.Value | $.Arg}}){{else}}{{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{end}}{{end}}
+		{{if .Sort}}ORDER BY {{join .Sort ", "}}{{end}}
+		{{if gt .Limit 0}}LIMIT {{.Limit}}{{else if gt .Skip 0}}LIMIT -1{{end}}
+		{{if gt .Skip 0}}OFFSET {{.Skip}}{{end}}`,
+	tmplUpdateIdentity: `
+		UPDATE identities
+		SET {{range $i, $u := .Updates}}{{if gt $i 0}}, {{end}} {{$u.Column}}={{$u.Value | $.Arg}}{{end}}
+		WHERE {{.Column}}={{.Identity | .Arg}}
+		RETURNING id, providerid, username`,
+	tmplIdentityID: `
+		SELECT id, providerid, username FROM identities
+		WHERE {{.Column}}={{.Identity | .Arg}}`,
+	// Transactions hold the database write lock, so there is no
+	// need to lock the identity.
+	tmplLockIdentity: `
+		SELECT id, providerid, username FROM identities
+		WHERE {{.Column}}={{.Identity | .Arg}}`,
+	tmplUpsertIdentity: `
+		INSERT INTO identities (providerid{{range .Updates}}, {{.Column}}{{end}})
+		VALUES ({{.Identity | .Arg}}{{range .Updates}}, {{.Value | $.Arg}}{{end}})
+		ON CONFLICT (providerid) DO UPDATE
+		SET{{range $i, $u := .Updates}}{{if gt $i 0}}, {{end}} {{$u.Column}}={{$u.Value | $.Arg}}{{end}}
+		WHERE identities.providerid={{.Identity | .Arg}}
+		RETURNING id, providerid, username`,
+	tmplClearIdentitySet: `
+		DELETE FROM {{.Table}}
+		WHERE identity={{.ID | .Arg}}{{if .Key}} AND key={{.Key | .Arg}}{{end}}`,
+	tmplPushIdentitySet: `
+		INSERT INTO {{.Table}} (identity, {{if .Key}}key, {{end}}value)
+		VALUES {{range $i, $v := .Values}}{{if gt $i 0}}, {{end}}({{$.ID | $.Arg}}, {{if $.Key}}{{$.Key | $.Arg}}, {{end}}{{$v | $.Arg}}){{end}}
+		ON CONFLICT (identity, {{if .Key}}key, {{end}}value) DO NOTHING`,
+	tmplPullIdentitySet: `
+		DELETE FROM {{.Table}}
+		WHERE identity={{.ID | $.Arg}}{{if .Key}} AND key={{.Key | $.Arg}}{{end}}
+		AND value IN ({{range $i, $v := .Values}}{{if gt $i 0}}, {{end}}{{$v | $.Arg}}{{end}})`,
+	tmplGetProviderData: `
+		SELECT value FROM provider_data
+		WHERE provider={{.Provider | .Arg}} AND key={{.Key | .Arg}} AND (expire IS NULL OR expire > {{now | .Arg}})`,
+	// sqlite locks the whole database when a transaction writes, so
+	// there is no need to lock the row here.
+	tmplGetProviderDataForUpdate: `
+		SELECT value FROM provider_data
+		WHERE provider={{.Provider | .Arg}} AND key={{.Key | .Arg}} AND (expire IS NULL OR expire > {{now | .Arg}})`,
+	tmplInsertProviderData: `
+		INSERT INTO provider_data (provider, key, value, expire)
+		VALUES ({{.Provider | .Arg}}, {{.Key | .Arg}}, {{.Value | .Arg}}, {{.Expire | .Arg}})
+		{{if .Update}}ON CONFLICT (provider, key) DO UPDATE
+		SET value={{.Value | .Arg}}, expire={{.Expire | .Arg}}{{end}}`,
+	tmplGetMeeting: `
+		SELECT address, created FROM meetings
+		WHERE id={{.ID | .Arg}}`,
+	tmplPutMeeting: `
+		INSERT INTO meetings (id, address, created)
+		VALUES ({{.ID | .Arg}}, {{.Address | .Arg}}, {{.Time | .Arg}})`,
+	tmplFindMeetings: `
+		SELECT id FROM meetings
+		WHERE created < {{.Time | .Arg}}{{if .Address}} AND address={{.Address | .Arg}}{{end}}`,
+	tmplRemoveMeetings: `
+		DELETE FROM meetings
+		WHERE id IN({{range $i, $id := .IDs}}{{if gt $i 0}}, {{end}}{{$id | $.Arg}}{{end}})`,
+	tmplIdentityCounts: `
+		SELECT CASE WHEN instr(providerid, ':') > 0 THEN substr(providerid, 1, instr(providerid, ':') - 1) ELSE providerid END AS idp, COUNT(1)
+		FROM identities GROUP BY idp`,
+	tmplRemoveIdentity: `
+		DELETE FROM identities
+		WHERE id={{.ID | .Arg}}`,
+	tmplInsertAuditEntry: `
+		INSERT INTO audit_log (time, actor, operation, target, before, after, requestid)
+		VALUES ({{.Time | .Arg}}, {{.Actor | .Arg}}, {{.Operation | .Arg}}, {{.Target | .Arg}}, {{.Before | .Arg}}, {{.After | .Arg}}, {{.RequestID | .Arg}})
+		RETURNING id`,
+	tmplFindAuditEntries: `
+		SELECT id, time, actor, operation, target, before, after, requestid FROM audit_log
+		WHERE TRUE
+		{{if .Actor}}AND actor={{.Actor | .Arg}}{{end}}
+		{{if .Target}}AND target={{.Target | .Arg}}{{end}}
+		{{if .Operation}}AND operation={{.Operation | .Arg}}{{end}}
+		{{if not .Since.IsZero}}AND time>={{.Since | .Arg}}{{end}}
+		{{if not .Until.IsZero}}AND time<{{.Until | .Arg}}{{end}}
+		ORDER BY time DESC, id DESC
+		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}`,
+	tmplGetRootKey: `
+		SELECT id, created, expires, rootkey FROM rootkeys
+		WHERE id={{.ID | .Arg}} AND expires > {{now | .Arg}}`,
+	tmplFindLatestRootKey: `
+		SELECT id, created, expires, rootkey FROM rootkeys
+		WHERE created >= {{.CreatedAfter | .Arg}}
+		AND expires >= {{.ExpiresAfter | .Arg}}
+		AND expires <= {{.ExpiresBefore | .Arg}}
+		ORDER BY created DESC
+		LIMIT 1`,
+	tmplInsertRootKey: `
+		INSERT INTO rootkeys (id, rootkey, created, expires)
+		VALUES ({{.ID | .Arg}}, {{.RootKey | .Arg}}, {{.Created | .Arg}}, {{.Expires | .Arg}})
+		ON CONFLICT (id) DO UPDATE
+		SET rootkey={{.RootKey | .Arg}}, created={{.Created | .Arg}}, expires={{.Expires | .Arg}}`,
+	// When the database is opened using SQLiteDataSourceName
+	// transactions take the database write lock when they start, so
+	// there is no need for further locking here.
+	tmplInitSchemaVersion: `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+	tmplSchemaVersion: `
+		SELECT COALESCE(MAX(version), 0) FROM schema_version`,
+	tmplSetSchemaVersion: `
+		INSERT INTO schema_version (version)
+		VALUES ({{.Version | .Arg}})`,
+	tmplInsertChange: `
+		INSERT INTO identity_changes (time, type, identity, providerid, username, fields)
+		VALUES ({{.Time | .Arg}}, {{.Type | .Arg}}, {{.ID | .Arg}}, {{.ProviderID | .Arg}}, {{.Username | .Arg}}, {{.Fields | .Arg}})`,
+	tmplFindChanges: `
+		SELECT seq, time, type, identity, providerid, username, fields FROM identity_changes
+		WHERE seq > {{.Since | .Arg}}
+		ORDER BY seq
+		LIMIT {{.Limit}}`,
+	tmplLastChangeBefore: `
+		SELECT COALESCE(MAX(seq), 0) FROM identity_changes
+		WHERE time < {{.Before | .Arg}}`,
+	tmplRemoveChanges: `
+		DELETE FROM identity_changes WHERE seq <= {{.Sequence | .Arg}}`,
+	tmplChangesRemoved: `
+		SELECT seq FROM identity_changes_removed`,
+	tmplSetChangesRemoved: `
+		UPDATE identity_changes_removed SET seq=max(seq, {{.Sequence | .Arg}})`,
+	tmplFindRootKeys: `
+		SELECT id, created, expires, rootkey FROM rootkeys
+		WHERE expires > {{now | .Arg}}
+		ORDER BY created`,
+	tmplRemoveRootKey: `
+		DELETE FROM rootkeys WHERE id={{.ID | .Arg}}`,
+	// Key-value stores are held in the provider_data table, the
+	// provider column holds the name of the store.
+	tmplFindKeyValueStores: `
+		SELECT DISTINCT provider FROM provider_data
+		ORDER BY provider`,
+	tmplFindKeyValues: `
+		SELECT key, value, expire FROM provider_data
+		WHERE provider={{.Name | .Arg}} AND (expire IS NULL OR expire > {{now | .Arg}})
+		ORDER BY key`,
+	tmplFindAllMeetings: `
+		SELECT id, address, created FROM meetings
+		ORDER BY id`,
+	tmplGetGroup: `
+		SELECT name, description, owners, subgroups FROM group_info
+		WHERE name={{.Name | .Arg}}`,
+	tmplFindGroups: `
+		SELECT name, description, owners, subgroups FROM group_info
+		ORDER BY name`,
+	tmplUpsertGroup: `
+		INSERT INTO group_info (name, description, owners, subgroups)
+		VALUES ({{.Name | .Arg}}, {{.Description | .Arg}}, {{.Owners | .Arg}}, {{.Subgroups | .Arg}})
+		ON CONFLICT (name) DO UPDATE
+		SET description={{.Description | .Arg}}, owners={{.Owners | .Arg}}, subgroups={{.Subgroups | .Arg}}`,
+	tmplRemoveGroup: `
+		DELETE FROM group_info WHERE name={{.Name | .Arg}}`,
+	tmplLinkedIdentity: `
+		SELECT identity FROM identity_providerids
+		WHERE value={{.Identity | .Arg}}`,
+	tmplInsertIdentity: `
+		INSERT INTO identities (id, providerid, username)
+		VALUES ({{.ID | .Arg}}, {{.ProviderID | .Arg}}, {{.Username | .Arg}})`,
+	// sqlite updates the AUTOINCREMENT sequence itself when a row is
+	// inserted with a larger id.
+	tmplSyncIdentityID: `
+		SELECT 1`,
+}
+
+// newSQLiteDriver creates an sqlite driver.
+func newSQLiteDriver() *driver {
+	return &driver{
+		name: "sqlite3",
+		argBuilderFunc: func() argBuilder {
+			return &sqliteArgBuilder{}
+		},
+		isDuplicateFunc:      sqliteIsDuplicate,
+		migrations:           sqliteMigrations,
+		newKeyValueStoreFunc: newKeyValueStore,
+	}
+}
+
+func sqliteIsDuplicate(err error) bool {
+	if sqerr, ok := err.(sqlite3.Error); ok && (sqerr.ExtendedCode == sqlite3.ErrConstraintUnique || sqerr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return true
+	}
+	return false
+}
+
+// sqliteArgBuilder implements an argBuilder that produces "?"
+// placeholders. Any time values are converted to UTC so that they
+// compare correctly when stored.
+type sqliteArgBuilder struct {
+	args_ []interface{}
+}
+
+// Arg implements argbuilder.Arg.
+func (b *sqliteArgBuilder) Arg(a interface{}) string {
+	switch v := a.(type) {
+	case time.Time:
+		a = v.UTC()
+	case nullTime:
+		v.Time = v.Time.UTC()
+		a = v
+	}
+	b.args_ = append(b.args_, a)
+	return "?"
+}
+
+// args implements argbuilder.args.
+func (b *sqliteArgBuilder) args() []interface{} {
+	return b.args_
+}
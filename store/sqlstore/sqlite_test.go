@@ -0,0 +1,321 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	aclstore "github.com/juju/aclstore/v2"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/meeting"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/sqlstore"
+	"github.com/canonical/candid/store/storetest"
+)
+
+func TestSQLiteKeyValueStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestKeyValueStore(c, func(c *qt.C) store.ProviderDataStore {
+		return newSQLiteFixture(c).backend.ProviderDataStore()
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestStore(c, func(c *qt.C) store.Store {
+		return newSQLiteFixture(c).backend.Store()
+	})
+}
+
+func TestSQLiteMeetingStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestMeetingStore(c, func(c *qt.C) meeting.Store {
+		return newSQLiteFixture(c).backend.MeetingStore()
+	}, sqlstore.PutAtTime)
+}
+
+func TestSQLiteACLStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestACLStore(c, func(c *qt.C) aclstore.ACLStore {
+		return newSQLiteFixture(c).backend.ACLStore()
+	})
+}
+
+func TestSQLiteAuditStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestAuditStore(c, func(c *qt.C) store.AuditStore {
+		return newSQLiteFixture(c).backend.AuditStore()
+	})
+}
+
+func TestSQLiteBackupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestBackupStore(c, func(c *qt.C) store.Backend {
+		return newSQLiteFixture(c).backend
+	})
+}
+
+func TestSQLiteRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestRootKeyStore(c, func(c *qt.C) store.RootKeyStore {
+		return newSQLiteFixture(c).backend.RootKeyStore()
+	})
+}
+
+func TestSQLiteGroupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestGroupStore(c, func(c *qt.C) store.GroupStore {
+		return newSQLiteFixture(c).backend.GroupStore()
+	})
+}
+
+func TestSQLiteBakeryRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	f := newSQLiteFixture(c)
+	rks := store.NewBakeryRootKeyStore(f.backend.RootKeyStore(), store.DefaultRootKeyPolicy)
+	key, id, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// Check that the same key is used again and that it can
+	// be retrieved by a new backend using the same database.
+	key1, id1, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.DeepEquals, key)
+	c.Assert(id1, qt.DeepEquals, id)
+
+	rks = store.NewBakeryRootKeyStore(f.newBackend(c).RootKeyStore(), store.DefaultRootKeyPolicy)
+	key2, err := rks.Get(ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key2, qt.DeepEquals, key)
+
+	_, err = rks.Get(ctx, []byte("no-such-key"))
+	c.Assert(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func TestSQLiteKeyValueExpiry(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	kv, err := newSQLiteFixture(c).backend.ProviderDataStore().KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+
+	err = kv.Set(ctx, "expired", []byte("value"), time.Now().Add(-time.Minute))
+	c.Assert(err, qt.IsNil)
+	err = kv.Set(ctx, "current", []byte("value"), time.Now().In(time.FixedZone("test", -5*3600)).Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+
+	_, err = kv.Get(ctx, "expired")
+	c.Assert(err, qt.ErrorMatches, `key expired not found`)
+	v, err := kv.Get(ctx, "current")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "value")
+}
+
+func TestSQLiteKeyValueExpiryWholeSecond(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	ctx := context.Background()
+	f := newSQLiteFixture(c)
+	kv, err := f.backend.ProviderDataStore().KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+
+	// The driver stores a time with no fractional seconds without
+	// the fractional part, check that it is still compared correctly.
+	expire := time.Now().Truncate(time.Second).Add(2 * time.Second)
+	err = kv.Set(ctx, "current", []byte("value"), expire)
+	c.Assert(err, qt.IsNil)
+	v, err := kv.Get(ctx, "current")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	err = kv.Set(ctx, "expired", []byte("value"), time.Now().Truncate(time.Second).Add(-time.Second))
+	c.Assert(err, qt.IsNil)
+
+	// Inserting another value removes the expired value from the
+	// database.
+	err = kv.Set(ctx, "another", []byte("value"), time.Time{})
+	c.Assert(err, qt.IsNil)
+
+	db, err := sql.Open("sqlite3", sqlstore.SQLiteDataSourceName(f.path))
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	var keys []string
+	rows, err := db.Query("SELECT key FROM provider_data ORDER BY key")
+	c.Assert(err, qt.IsNil)
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		c.Assert(err, qt.IsNil)
+		keys = append(keys, key)
+	}
+	c.Assert(rows.Err(), qt.IsNil)
+	c.Assert(keys, qt.DeepEquals, []string{"another", "current"})
+}
+
+func TestSQLiteInitIdempotent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	f := newSQLiteFixture(c)
+
+	var pk1 bakery.PublicKey
+	id1 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test-1"),
+		Username:   "test-1",
+		Name:       "Test User",
+		Email:      "test-1@example.com",
+		PublicKeys: []bakery.PublicKey{pk1},
+		ProviderInfo: map[string][]string{
+			"pk1": {"pk1v1", "pk1v2"},
+		},
+		ExtraInfo: map[string][]string{
+			"ek1": {"ek1v1", "ek1v2"},
+		},
+		Owner: store.MakeProviderIdentity("test", "test-0"),
+	}
+	err := f.backend.Store().UpdateIdentity(
+		context.Background(),
+		&id1,
+		store.Update{
+			store.Username:     store.Set,
+			store.Name:         store.Set,
+			store.Email:        store.Set,
+			store.PublicKeys:   store.Set,
+			store.ProviderInfo: store.Set,
+			store.ExtraInfo:    store.Set,
+			store.Owner:        store.Set,
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	backend := f.newBackend(c)
+	id2 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test-1"),
+	}
+	err = backend.Store().Identity(context.Background(), &id2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id2, qt.DeepEquals, id1)
+}
+
+func TestSQLiteMigrateSchema(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	db, err := sql.Open("sqlite3", sqlstore.SQLiteDataSourceName(filepath.Join(c.Mkdir(), "candid.db")))
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+
+	migrations, err := sqlstore.MigrateSchema("sqlite3", db, true)
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrations, qt.HasLen, 10)
+	c.Assert(migrations[0].Version, qt.Equals, 1)
+	c.Assert(migrations[0].SQL, qt.Contains, "CREATE TABLE IF NOT EXISTS identities")
+	c.Assert(migrations[1].Version, qt.Equals, 2)
+	c.Assert(migrations[1].SQL, qt.Contains, "CREATE TABLE IF NOT EXISTS identity_changes")
+	c.Assert(migrations[2].Version, qt.Equals, 3)
+	c.Assert(migrations[2].SQL, qt.Contains, "CREATE TABLE IF NOT EXISTS group_info")
+	c.Assert(migrations[3].Version, qt.Equals, 4)
+	c.Assert(migrations[3].SQL, qt.Contains, "ALTER TABLE group_info ADD COLUMN subgroups")
+	c.Assert(migrations[4].Version, qt.Equals, 5)
+	c.Assert(migrations[4].SQL, qt.Contains, "ALTER TABLE identities ADD COLUMN disabled")
+	c.Assert(migrations[5].Version, qt.Equals, 6)
+	c.Assert(migrations[5].SQL, qt.Contains, "ALTER TABLE identities ADD COLUMN expires")
+	c.Assert(migrations[6].Version, qt.Equals, 7)
+	c.Assert(migrations[6].SQL, qt.Contains, "CREATE TABLE IF NOT EXISTS identity_providerids")
+	c.Assert(migrations[7].Version, qt.Equals, 8)
+	c.Assert(migrations[7].SQL, qt.Contains, "CREATE INDEX IF NOT EXISTS identity_changes_time")
+	c.Assert(migrations[8].Version, qt.Equals, 9)
+	c.Assert(migrations[8].SQL, qt.Contains, "CREATE TRIGGER provider_data_expire_tr")
+	c.Assert(migrations[9].Version, qt.Equals, 10)
+	c.Assert(migrations[9].SQL, qt.Contains, "CREATE TABLE IF NOT EXISTS identity_changes_removed")
+
+	// Check that the dry run didn't change the database.
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table'").Scan(&n)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	migrations1, err := sqlstore.MigrateSchema("sqlite3", db, false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrations1, qt.DeepEquals, migrations)
+
+	migrations, err = sqlstore.MigrateSchema("sqlite3", db, true)
+	c.Assert(err, qt.IsNil)
+	c.Assert(migrations, qt.HasLen, 0)
+
+	var version int
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	c.Assert(err, qt.IsNil)
+	c.Assert(version, qt.Equals, 10)
+}
+
+func TestSQLiteMigrateSchemaNewerVersion(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	path := filepath.Join(c.Mkdir(), "candid.db")
+	db, err := sql.Open("sqlite3", sqlstore.SQLiteDataSourceName(path))
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+	_, err = sqlstore.MigrateSchema("sqlite3", db, false)
+	c.Assert(err, qt.IsNil)
+	_, err = db.Exec("INSERT INTO schema_version (version) VALUES (1000)")
+	c.Assert(err, qt.IsNil)
+
+	_, err = sqlstore.MigrateSchema("sqlite3", db, true)
+	c.Assert(err, qt.ErrorMatches, `cannot migrate schema: database schema version 1000 is newer than the latest known version 10`)
+	_, err = sqlstore.NewBackend("sqlite3", db)
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: database schema version 1000 is newer than the latest known version 10`)
+}
+
+type sqliteFixture struct {
+	backend store.Backend
+	path    string
+}
+
+func newSQLiteFixture(c *qt.C) *sqliteFixture {
+	f := &sqliteFixture{
+		path: filepath.Join(c.Mkdir(), "candid.db"),
+	}
+	f.backend = f.newBackend(c)
+	return f
+}
+
+// newBackend opens a new backend on the fixture's database.
+func (f *sqliteFixture) newBackend(c *qt.C) store.Backend {
+	db, err := sql.Open("sqlite3", sqlstore.SQLiteDataSourceName(f.path))
+	c.Assert(err, qt.IsNil)
+	backend, err := sqlstore.NewBackend("sqlite3", db)
+	c.Assert(err, qt.IsNil)
+	// Note: closing backend also closes the db.
+	c.Defer(backend.Close)
+	return backend
+}
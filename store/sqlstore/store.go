@@ -17,13 +17,16 @@ import (
 var logger = loggo.GetLogger("candid.sqlstore")
 
 var identityColumns = [store.NumFields]string{
-	store.ProviderID:    "providerid",
-	store.Username:      "username",
-	store.Name:          "name",
-	store.Email:         "email",
-	store.LastLogin:     "lastlogin",
-	store.LastDischarge: "lastdischarge",
-	store.Owner:         "owner",
+	store.ProviderID:     "providerid",
+	store.Username:       "username",
+	store.Name:           "name",
+	store.Email:          "email",
+	store.LastLogin:      "lastlogin",
+	store.LastDischarge:  "lastdischarge",
+	store.Owner:          "owner",
+	store.Disabled:       "disabled",
+	store.DisabledReason: "disabledreason",
+	store.Expires:        "expires",
 }
 
 type identityStore struct {
@@ -42,6 +45,28 @@ func (s *identityStore) Identity(ctx context.Context, identity *store.Identity)
 	}), errgo.Is(store.ErrNotFound))
 }
 
+// linkedIdentityID returns the ID of the identity that the given
+// provider ID is linked to. If the provider ID is not linked to any
+// identity then an empty ID is returned.
+func (s *identityStore) linkedIdentityID(tx *sql.Tx, providerID store.ProviderIdentity) (string, error) {
+	params := &identityFromParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Identity:   providerID,
+	}
+	row, err := s.driver.queryRow(tx, tmplLinkedIdentity, params)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	var id string
+	if err := row.Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", errgo.Notef(err, "cannot get linked identity")
+	}
+	return id, nil
+}
+
 type identityFromParams struct {
 	argBuilder
 
@@ -58,6 +83,15 @@ func (s *identityStore) identity(tx *sql.Tx, identity *store.Identity) error {
 		params.Column = "id"
 		params.Identity = identity.ID
 	case identity.ProviderID != "":
+		id, err := s.linkedIdentityID(tx, identity.ProviderID)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if id != "" {
+			params.Column = "id"
+			params.Identity = id
+			break
+		}
 		params.Column = "providerid"
 		params.Identity = identity.ProviderID
 	case identity.Username != "":
@@ -112,17 +146,72 @@ type findIdentitiesParams struct {
 }
 
 func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	return s.findIdentitiesWhere(tx, filterWheres(ref, filter), sort, skip, limit)
+}
+
+// filterWheres returns the where clauses that implement the given
+// filter.
+func filterWheres(ref *store.Identity, filter store.Filter) []where {
 	var wheres []where
 	for f, op := range filter {
+		if store.Field(f) == store.Groups {
+			if op == store.Contains {
+				for _, g := range ref.Groups {
+					wheres = append(wheres, where{"", "member", g})
+				}
+			}
+			continue
+		}
 		col := identityColumns[f]
 		cond := comparisons[op]
 		if col == "" || cond == "" {
 			continue
 		}
+		value := fieldValue(store.Field(f), ref)
+		if op == store.Prefix || op == store.Match {
+			// The pattern matching comparisons need the
+			// plain string value.
+			value = stringFieldValue(store.Field(f), ref)
+		}
+		wheres = append(wheres, where{col, cond, value})
+	}
+	return wheres
+}
 
-		wheres = append(wheres, where{col, cond, fieldValue(store.Field(f), ref)})
+// FindIdentitiesPage implements store.FindIdentitiesPage.
+func (s *identityStore) FindIdentitiesPage(ctx context.Context, ref *store.Identity, filter store.Filter, cursor string, limit int) ([]store.Identity, string, error) {
+	after, err := store.ParseUsernameCursor(cursor)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Is(store.ErrInvalidCursor))
+	}
+	wheres := filterWheres(ref, filter)
+	if after != "" {
+		wheres = append(wheres, where{"username", ">", after})
 	}
+	qlimit := 0
+	if limit > 0 {
+		// Fetch an extra identity to find out whether there is
+		// another page.
+		qlimit = limit + 1
+	}
+	var identities []store.Identity
+	err = s.withTx(func(tx *sql.Tx) error {
+		var err error
+		identities, err = s.findIdentitiesWhere(tx, wheres, []store.Sort{{Field: store.Username}}, 0, qlimit)
+		return err
+	})
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot find identities")
+	}
+	var next string
+	if limit > 0 && len(identities) > limit {
+		identities = identities[:limit]
+		next = store.UsernameCursor(identities[limit-1].Username)
+	}
+	return identities, next, nil
+}
 
+func (s *identityStore) findIdentitiesWhere(tx *sql.Tx, wheres []where, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
 	sorts := make([]string, 0, len(sort))
 	for _, s := range sort {
 		col := identityColumns[s.Field]
@@ -182,10 +271,36 @@ func fieldValue(f store.Field, id *store.Identity) interface{} {
 		return nullTime{id.LastDischarge, !id.LastDischarge.IsZero()}
 	case store.Owner:
 		return sql.NullString{string(id.Owner), id.Owner != ""}
+	case store.Disabled:
+		return nullTime{id.Disabled, !id.Disabled.IsZero()}
+	case store.DisabledReason:
+		return sql.NullString{id.DisabledReason, id.DisabledReason != ""}
+	case store.Expires:
+		return nullTime{id.Expires, !id.Expires.IsZero()}
 	}
 	return nil
 }
 
+// stringFieldValue returns the value of the given string field in the
+// given identity.
+func stringFieldValue(f store.Field, id *store.Identity) string {
+	switch f {
+	case store.ProviderID:
+		return string(id.ProviderID)
+	case store.Username:
+		return id.Username
+	case store.Name:
+		return id.Name
+	case store.Email:
+		return id.Email
+	case store.Owner:
+		return string(id.Owner)
+	case store.DisabledReason:
+		return id.DisabledReason
+	}
+	return ""
+}
+
 func (s *identityStore) completeIdentity(tx *sql.Tx, identity *store.Identity) error {
 	var err error
 	identity.Groups, err = s.getGroups(tx, identity.ID)
@@ -204,6 +319,10 @@ func (s *identityStore) completeIdentity(tx *sql.Tx, identity *store.Identity) e
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	identity.LinkedProviderIDs, err = s.getLinkedProviderIDs(tx, identity.ID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
@@ -237,6 +356,28 @@ func (s *identityStore) getGroups(tx *sql.Tx, id string) ([]string, error) {
 	return groups, errgo.Mask(rows.Err())
 }
 
+func (s *identityStore) getLinkedProviderIDs(tx *sql.Tx, id string) ([]store.ProviderIdentity, error) {
+	params := selectIdentitySetParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Table:      "identity_providerids",
+		Identity:   id,
+	}
+	rows, err := s.driver.query(tx, tmplSelectIdentitySet, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+	var pids []store.ProviderIdentity
+	for rows.Next() {
+		var pid store.ProviderIdentity
+		if err := rows.Scan(&pid); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, errgo.Mask(rows.Err())
+}
+
 func (s *identityStore) getPublicKeys(tx *sql.Tx, id string) ([]bakery.PublicKey, error) {
 	params := selectIdentitySetParams{
 		argBuilder: s.driver.argBuilderFunc(),
@@ -290,8 +431,8 @@ func (s *identityStore) getInfoMap(tx *sql.Tx, table string, id string) (map[str
 // UpdateIdentity implements store.Store.UpdateIdentity.
 func (s *identityStore) UpdateIdentity(_ context.Context, identity *store.Identity, update store.Update) (err error) {
 	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
-		return s.updateIdentity(tx, identity, update)
-	}), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrNotFound))
+		return s.updateIdentity(tx, identity, update, store.IdentityUpdated)
+	}), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrDuplicateProviderID), errgo.Is(store.ErrNotFound))
 }
 
 type update struct {
@@ -317,7 +458,9 @@ type updateIdentityParams struct {
 	Updates []update
 }
 
-func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd store.Update) error {
+// updateIdentity updates the given identity, recording the change with
+// the given type unless the update creates the identity.
+func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd store.Update, changeType store.ChangeType) error {
 	tmpl := tmplUpdateIdentity
 	params := updateIdentityParams{
 		argBuilder: s.driver.argBuilderFunc(),
@@ -331,6 +474,18 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 		params.Column = "id"
 		params.Identity = identity.ID
 	case identity.ProviderID != "":
+		id, err := s.linkedIdentityID(tx, identity.ProviderID)
+		if err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
+		if id != "" {
+			// Logging in with a linked provider ID never renames
+			// the identity.
+			upd[store.Username] = store.NoUpdate
+			params.Column = "id"
+			params.Identity = id
+			break
+		}
 		if upd[store.Username] == store.Set {
 			tmpl = tmplUpsertIdentity
 		}
@@ -364,13 +519,28 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 		params.Updates = append(params.Updates, update{col, arg})
 	}
 	if len(params.Updates) == 0 {
-		tmpl = tmplIdentityID
+		tmpl = tmplLockIdentity
+	}
+	if tmpl == tmplUpsertIdentity {
+		row, err := s.driver.queryRow(tx, tmplIdentityID, params)
+		if err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
+		var changed store.Identity
+		if err := scanChangedIdentity(row, &changed); errgo.Cause(err) == sql.ErrNoRows {
+			changeType = store.IdentityCreated
+		} else if err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
+		// Reset the arg builder
+		params.argBuilder = s.driver.argBuilderFunc()
 	}
 	row, err := s.driver.queryRow(tx, tmpl, params)
 	if err != nil {
 		return errgo.Notef(err, "cannot update identity")
 	}
-	if err := row.Scan(&identity.ID); err != nil {
+	var changed store.Identity
+	if err := scanChangedIdentity(row, &changed); err != nil {
 		if errgo.Cause(err) == sql.ErrNoRows {
 			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
 		}
@@ -379,6 +549,7 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 		}
 		return errgo.Notef(err, "cannot update identity")
 	}
+	identity.ID = changed.ID
 
 	if err := s.updateGroups(tx, identity.ID, upd[store.Groups], identity.Groups); err != nil {
 		return errgo.Notef(err, "cannot update identity")
@@ -386,6 +557,9 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 	if err := s.updatePublicKeys(tx, identity.ID, upd[store.PublicKeys], identity.PublicKeys); err != nil {
 		return errgo.Notef(err, "cannot update identity")
 	}
+	if err := s.updateLinkedProviderIDs(tx, &changed, upd[store.LinkedProviderIDs], identity.LinkedProviderIDs); err != nil {
+		return errgo.NoteMask(err, "cannot update identity", errgo.Is(store.ErrDuplicateProviderID))
+	}
 	for k, vs := range identity.ProviderInfo {
 		if err := s.updateProviderInfo(tx, identity.ID, k, upd[store.ProviderInfo], vs); err != nil {
 			return errgo.Notef(err, "cannot update identity")
@@ -396,10 +570,22 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 			return errgo.Notef(err, "cannot update identity")
 		}
 	}
-
+	if fields := store.ChangedFields(upd); len(fields) > 0 || changeType == store.IdentityCreated {
+		if err := s.insertChange(tx, changeType, &changed, fields); err != nil {
+			return errgo.Notef(err, "cannot update identity")
+		}
+	}
 	return nil
 }
 
+// scanChangedIdentity scans the ID, provider ID and username of an
+// identity, as returned by tmplIdentityID, into the given identity. The
+// returned error is not annotated so that it can be checked with the
+// driver's isDuplicateFunc.
+func scanChangedIdentity(row *sql.Row, identity *store.Identity) error {
+	return row.Scan(&identity.ID, &identity.ProviderID, &identity.Username)
+}
+
 type updateSetParams struct {
 	argBuilder
 	Table  string
@@ -443,7 +629,7 @@ func (s *identityStore) updateSet(tx *sql.Tx, table, id, key string, op store.Op
 		return nil
 	}
 	if _, err := s.driver.exec(tx, tmpl, params); err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Any)
 	}
 	return nil
 }
@@ -465,6 +651,64 @@ func (s *identityStore) updatePublicKeys(tx *sql.Tx, id string, op store.Operati
 	return errgo.Mask(s.updateSet(tx, "identity_publickeys", id, "", op, values))
 }
 
+// updateLinkedProviderIDs updates the provider IDs linked to the given
+// identity. The primary provider ID of the identity is never linked. If
+// any of the provider IDs being linked already identifies another
+// identity then an error with a cause of store.ErrDuplicateProviderID is
+// returned.
+func (s *identityStore) updateLinkedProviderIDs(tx *sql.Tx, identity *store.Identity, op store.Operation, pids []store.ProviderIdentity) error {
+	values := make([]interface{}, 0, len(pids))
+	for _, pid := range pids {
+		if pid == identity.ProviderID {
+			continue
+		}
+		if op == store.Set || op == store.Push {
+			if err := s.checkProviderIDAvailable(tx, identity.ID, pid); err != nil {
+				return errgo.Mask(err, errgo.Is(store.ErrDuplicateProviderID))
+			}
+		}
+		values = append(values, pid)
+	}
+	err := s.updateSet(tx, "identity_providerids", identity.ID, "", op, values)
+	if err != nil && s.driver.isDuplicateFunc(errgo.Cause(err)) {
+		// Another identity has linked one of the provider IDs
+		// since it was checked.
+		return store.DuplicateProviderIDError(pids[0])
+	}
+	return errgo.Mask(err)
+}
+
+// checkProviderIDAvailable checks that the given provider ID does not
+// identify any identity other than the one with the given ID.
+func (s *identityStore) checkProviderIDAvailable(tx *sql.Tx, id string, pid store.ProviderIdentity) error {
+	linkedID, err := s.linkedIdentityID(tx, pid)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if linkedID != "" && linkedID != id {
+		return store.DuplicateProviderIDError(pid)
+	}
+	params := updateIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Column:     "providerid",
+		Identity:   string(pid),
+	}
+	row, err := s.driver.queryRow(tx, tmplIdentityID, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var other store.Identity
+	switch err := scanChangedIdentity(row, &other); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return errgo.Mask(err)
+	case other.ID != id:
+		return store.DuplicateProviderIDError(pid)
+	}
+	return nil
+}
+
 func (s *identityStore) updateProviderInfo(tx *sql.Tx, id, key string, op store.Operation, values []string) error {
 	vals := make([]interface{}, len(values))
 	for i, v := range values {
@@ -481,6 +725,161 @@ func (s *identityStore) updateExtraInfo(tx *sql.Tx, id, key string, op store.Ope
 	return errgo.Mask(s.updateSet(tx, "identity_extrainfo", id, key, op, vals))
 }
 
+// ReplaceInfo implements store.Store.ReplaceInfo.
+func (s *identityStore) ReplaceInfo(_ context.Context, id string, old, new *store.Identity) error {
+	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
+		return s.replaceInfo(tx, id, old, new)
+	}), errgo.Is(store.ErrNotFound), errgo.Is(store.ErrConflict))
+}
+
+func (s *identityStore) replaceInfo(tx *sql.Tx, id string, old, new *store.Identity) error {
+	if _, err := strconv.Atoi(id); err != nil {
+		// By definition if id isn't numeric it won't exist.
+		return store.NotFoundError(id, "", "")
+	}
+	row, err := s.driver.queryRow(tx, tmplLockIdentity, updateIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Column:     "id",
+		Identity:   id,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot replace identity info")
+	}
+	var changed store.Identity
+	if err := scanChangedIdentity(row, &changed); err != nil {
+		if errgo.Cause(err) == sql.ErrNoRows {
+			return store.NotFoundError(id, "", "")
+		}
+		return errgo.Notef(err, "cannot replace identity info")
+	}
+	var fields []store.Field
+	for _, f := range []struct {
+		field    store.Field
+		table    string
+		old, new map[string][]string
+	}{
+		{store.ProviderInfo, "identity_providerinfo", old.ProviderInfo, new.ProviderInfo},
+		{store.ExtraInfo, "identity_extrainfo", old.ExtraInfo, new.ExtraInfo},
+	} {
+		if len(f.old) == 0 {
+			continue
+		}
+		info, err := s.getInfoMap(tx, f.table, id)
+		if err != nil {
+			return errgo.Notef(err, "cannot replace identity info")
+		}
+		for k, vs := range f.old {
+			if !store.EqualValues(info[k], vs) {
+				return store.ConflictError(id)
+			}
+		}
+		for k := range f.old {
+			vals := make([]interface{}, len(f.new[k]))
+			for i, v := range f.new[k] {
+				vals[i] = v
+			}
+			if err := s.updateSet(tx, f.table, id, k, store.Set, vals); err != nil {
+				return errgo.Notef(err, "cannot replace identity info")
+			}
+		}
+		fields = append(fields, f.field)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	if err := s.insertChange(tx, store.IdentityUpdated, &changed, fields); err != nil {
+		return errgo.Notef(err, "cannot replace identity info")
+	}
+	return nil
+}
+
+// RemoveIdentity implements store.Store.RemoveIdentity.
+func (s *identityStore) RemoveIdentity(_ context.Context, identity *store.Identity) error {
+	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
+		return s.removeIdentity(tx, identity)
+	}), errgo.Is(store.ErrNotFound))
+}
+
+// identitySetTables contains the tables holding the multi-valued
+// fields of an identity.
+var identitySetTables = []string{
+	"identity_groups",
+	"identity_publickeys",
+	"identity_providerinfo",
+	"identity_extrainfo",
+	"identity_providerids",
+}
+
+type removeIdentityParams struct {
+	argBuilder
+	ID string
+}
+
+func (s *identityStore) removeIdentity(tx *sql.Tx, identity *store.Identity) error {
+	params := updateIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	}
+	switch {
+	case identity.ID != "":
+		if _, err := strconv.Atoi(identity.ID); err != nil {
+			// By definition if id isn't numeric it won't exist.
+			return store.NotFoundError(identity.ID, "", "")
+		}
+		params.Column = "id"
+		params.Identity = identity.ID
+	case identity.ProviderID != "":
+		id, err := s.linkedIdentityID(tx, identity.ProviderID)
+		if err != nil {
+			return errgo.Notef(err, "cannot remove identity")
+		}
+		if id != "" {
+			params.Column = "id"
+			params.Identity = id
+			break
+		}
+		params.Column = "providerid"
+		params.Identity = string(identity.ProviderID)
+	case identity.Username != "":
+		params.Column = "username"
+		params.Identity = identity.Username
+	default:
+		return store.NotFoundError("", "", "")
+	}
+	row, err := s.driver.queryRow(tx, tmplIdentityID, params)
+	if err != nil {
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	var removed store.Identity
+	if err := scanChangedIdentity(row, &removed); err != nil {
+		if errgo.Cause(err) == sql.ErrNoRows {
+			return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+		}
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	id := removed.ID
+	for _, table := range identitySetTables {
+		setParams := &updateSetParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			Table:      table,
+			ID:         id,
+		}
+		if _, err := s.driver.exec(tx, tmplClearIdentitySet, setParams); err != nil {
+			return errgo.Notef(err, "cannot remove identity")
+		}
+	}
+	removeParams := &removeIdentityParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id,
+	}
+	if _, err := s.driver.exec(tx, tmplRemoveIdentity, removeParams); err != nil {
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	if err := s.insertChange(tx, store.IdentityRemoved, &removed, nil); err != nil {
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	return nil
+}
+
 // IdentityCounts implements store.IdentityCounts.
 func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
 	counts := make(map[string]int)
@@ -543,8 +942,8 @@ type scanner interface {
 }
 
 func scanIdentity(s scanner, identity *store.Identity) error {
-	var name, email, owner sql.NullString
-	var lastLogin, lastDischarge nullTime
+	var name, email, owner, disabledReason sql.NullString
+	var lastLogin, lastDischarge, disabled, expires nullTime
 	err := s.Scan(
 		&identity.ID,
 		&identity.ProviderID,
@@ -554,6 +953,9 @@ func scanIdentity(s scanner, identity *store.Identity) error {
 		&lastLogin,
 		&lastDischarge,
 		&owner,
+		&disabled,
+		&disabledReason,
+		&expires,
 	)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
@@ -563,5 +965,8 @@ func scanIdentity(s scanner, identity *store.Identity) error {
 	identity.LastLogin = lastLogin.Time
 	identity.LastDischarge = lastDischarge.Time
 	identity.Owner = store.ProviderIdentity(owner.String)
+	identity.Disabled = disabled.Time
+	identity.DisabledReason = disabledReason.String
+	identity.Expires = expires.Time
 	return nil
 }
@@ -6,6 +6,7 @@ package store
 import (
 	"context"
 	"database/sql/driver"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +29,10 @@ const (
 	ProviderInfo
 	ExtraInfo
 	Owner
+	Disabled
+	DisabledReason
+	Expires
+	LinkedProviderIDs
 	NumFields
 )
 
@@ -83,6 +88,20 @@ const (
 	LessThan
 	GreaterThanOrEqual
 	LessThanOrEqual
+
+	// Prefix matches string fields that start with the value in
+	// the reference identity.
+	Prefix
+
+	// Match matches string fields that contain the value in the
+	// reference identity, ignoring case. Backends are only required
+	// to fold the case of ASCII letters.
+	Match
+
+	// Contains matches identities whose Groups contain all of the
+	// groups in the reference identity. It is only valid for the
+	// Groups field.
+	Contains
 )
 
 // A Filter is used in a Store.FindEntities call to specify how the
@@ -125,6 +144,17 @@ type Store interface {
 	// will be skipped before those that are returned.
 	FindIdentities(ctx context.Context, ref *Identity, filter Filter, sort []Sort, skip, limit int) ([]Identity, error)
 
+	// FindIdentitiesPage is like FindIdentities except that the
+	// results are always sorted by username and are returned a
+	// page at a time. The page starts after the position specified
+	// by cursor, an empty cursor starts at the first result. If
+	// limit is greater than 0 then the page will contain at most
+	// that many identities. If there are more results then next
+	// holds the cursor for the following page, otherwise it is
+	// empty. If the cursor is not valid then an error with a cause
+	// of ErrInvalidCursor will be returned.
+	FindIdentitiesPage(ctx context.Context, ref *Identity, filter Filter, cursor string, limit int) (_ []Identity, next string, _ error)
+
 	// UpdateIdentity stores the data from the given identity in
 	// persistant storage. The identity that is updated will be the
 	// one matching the first non-zero value of ID, ProviderID or
@@ -133,19 +163,71 @@ type Store interface {
 	// is no match for an identity specified by ProviderID and the
 	// update specifies setting the username then a new record will
 	// be created for the identity, in this case the assigned ID will
-	// be written back into the given identity.
+	// be written back into the given identity. If the ProviderID
+	// matches one of the linked provider IDs of an identity then the
+	// username of that identity is never changed.
 	//
 	// The fields that are written to the database are dictated by
 	// the given UpdateOperations parameter. For each updatable field
 	// this parameter will be consulted for the type of update to
 	// perform. If the update would result in a duplicate username
 	// being used then an error with the cause ErrDuplicateUsername
-	// will be returned.
+	// will be returned. If the update would link a provider ID that
+	// already identifies a different identity then an error with the
+	// cause ErrDuplicateProviderID will be returned.
 	UpdateIdentity(ctx context.Context, identity *Identity, update Update) error
 
+	// ReplaceInfo atomically replaces values in the ProviderInfo and
+	// ExtraInfo fields of the identity with the given ID. For each
+	// key in the ProviderInfo and ExtraInfo fields of old, the
+	// values held for the key are replaced with the values for the
+	// same key in new, or the key is removed if new holds no values
+	// for it. The replacement is only made if every key still holds
+	// exactly the values in old, in any order, where no values means
+	// that the key is not set. Otherwise no change is made and an
+	// error with a cause of ErrConflict is returned. If there is no
+	// identity with the given ID then an error with a cause of
+	// ErrNotFound is returned.
+	ReplaceInfo(ctx context.Context, id string, old, new *Identity) error
+
+	// RemoveIdentity removes the identity matching the first
+	// non-zero value of ID, ProviderID or Username from persistant
+	// storage, along with all of its stored groups, public keys,
+	// provider information and extra information. If no match can
+	// be found for the given identity then an error with the cause
+	// ErrNotFound will be returned.
+	RemoveIdentity(ctx context.Context, identity *Identity) error
+
 	// IdentityCounts returns the number of identities stored in the
 	// store split by provider ID.
 	IdentityCounts(ctx context.Context) (map[string]int, error)
+
+	// Watch returns the changes made to identities that have a
+	// sequence number greater than since, in sequence order. If
+	// there are no such changes then Watch waits until there are,
+	// or until the given context is done, in which case an error
+	// with the context's error as its cause is returned.
+	//
+	// At most MaxWatchChanges changes are returned by each call,
+	// any further changes can be retrieved by calling Watch again
+	// with the sequence number of the last change returned. Updates
+	// that only write the LastLogin or LastDischarge fields are not
+	// recorded as changes.
+	//
+	// If any change after since has been removed by RemoveChanges
+	// then Watch returns a *ChangesRemovedError holding the sequence
+	// number of the last removed change, from which watching can
+	// continue.
+	Watch(ctx context.Context, since uint64) ([]IdentityChange, error)
+
+	// RemoveChanges removes the changes that were made before the
+	// given time from the change log, returning the number of
+	// changes removed. Removed changes are no longer returned by
+	// Watch, the sequence numbers of the remaining changes are
+	// unaffected. Changes are removed in sequence order, so no
+	// change remains that has a lower sequence number than a
+	// removed one.
+	RemoveChanges(ctx context.Context, before time.Time) (int, error)
 }
 
 // A ProviderIdentity is a provider-specific unique identity.
@@ -234,4 +316,65 @@ type Identity struct {
 	// Owner contains the ProviderIdentity of the identity that owns
 	// this one.
 	Owner ProviderIdentity
+
+	// Disabled contains the time that the identity was disabled. An
+	// identity with a zero Disabled time is enabled.
+	Disabled time.Time
+
+	// DisabledReason contains the reason that the identity was
+	// disabled.
+	DisabledReason string
+
+	// Expires contains the time after which the identity can no
+	// longer be used. An identity with a zero Expires time never
+	// expires.
+	Expires time.Time
+
+	// LinkedProviderIDs contains the provider IDs, other than
+	// ProviderID, that identify the identity. These are added when
+	// a user links their account with another identity provider. No
+	// provider ID may identify more than one identity.
+	LinkedProviderIDs []ProviderIdentity
+}
+
+// EqualValues reports whether a and b hold the same values, in any
+// order. It is intended for use by implementations of
+// Store.ReplaceInfo.
+func EqualValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a1 := append([]string(nil), a...)
+	b1 := append([]string(nil), b...)
+	sort.Strings(a1)
+	sort.Strings(b1)
+	for i := range a1 {
+		if a1[i] != b1[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// OwnsIdentities reports whether any identities in the given store are
+// owned by the given identity, through either its provider ID or any of
+// its linked provider IDs. An identity that owns others should not be
+// removed, as that would leave them without an owner.
+func OwnsIdentities(ctx context.Context, st Store, id *Identity) (bool, error) {
+	for _, pid := range append([]ProviderIdentity{id.ProviderID}, id.LinkedProviderIDs...) {
+		owned, err := st.FindIdentities(
+			ctx,
+			&Identity{Owner: pid},
+			Filter{Owner: Equal},
+			nil,
+			0, 1,
+		)
+		if err != nil {
+			return false, errgo.Notef(err, "cannot find identities owned by %s", id.Username)
+		}
+		if len(owned) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
 }
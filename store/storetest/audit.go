@@ -0,0 +1,168 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetest
+
+import (
+	"context"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/canonical/candid/store"
+)
+
+type auditSuite struct {
+	newStore func(c *qt.C) store.AuditStore
+	Store    store.AuditStore
+}
+
+// TestAuditStore runs a suite of tests on the given AuditStore
+// implementation.
+func TestAuditStore(c *qt.C, newStore func(c *qt.C) store.AuditStore) {
+	qtsuite.Run(c, &auditSuite{
+		newStore: newStore,
+	})
+}
+
+func (s *auditSuite) Init(c *qt.C) {
+	s.Store = s.newStore(c)
+}
+
+var auditEntries = []store.AuditEntry{{
+	Time:      time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	Actor:     "admin@candid",
+	Operation: "set-groups",
+	Target:    "bob",
+	After:     []string{"g1", "g2"},
+	RequestID: "req1",
+}, {
+	Time:      time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+	Actor:     "admin@candid",
+	Operation: "modify-groups",
+	Target:    "alice",
+	Before:    []string{"g1"},
+	After:     []string{"g1", "g3"},
+	RequestID: "req2",
+}, {
+	Time:      time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+	Actor:     "bob",
+	Operation: "set-acl",
+	Target:    "read-user",
+	Before:    []string{"admin@candid"},
+	After:     []string{"admin@candid", "bob"},
+	RequestID: "req3",
+}, {
+	Time:      time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC),
+	Actor:     "bob",
+	Operation: "set-groups",
+	Target:    "alice",
+	Before:    []string{"g1", "g3"},
+	RequestID: "req4",
+}}
+
+var findAuditEntriesTests = []struct {
+	about         string
+	filter        store.AuditFilter
+	expectEntries []int
+}{{
+	about:         "all",
+	expectEntries: []int{3, 2, 1, 0},
+}, {
+	about: "actor",
+	filter: store.AuditFilter{
+		Actor: "bob",
+	},
+	expectEntries: []int{3, 2},
+}, {
+	about: "target",
+	filter: store.AuditFilter{
+		Target: "alice",
+	},
+	expectEntries: []int{3, 1},
+}, {
+	about: "operation",
+	filter: store.AuditFilter{
+		Operation: "set-groups",
+	},
+	expectEntries: []int{3, 0},
+}, {
+	about: "since",
+	filter: store.AuditFilter{
+		Since: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+	},
+	expectEntries: []int{3, 2, 1},
+}, {
+	about: "until",
+	filter: store.AuditFilter{
+		Until: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC),
+	},
+	expectEntries: []int{1, 0},
+}, {
+	about: "limit",
+	filter: store.AuditFilter{
+		Limit: 3,
+	},
+	expectEntries: []int{3, 2, 1},
+}, {
+	about: "combined",
+	filter: store.AuditFilter{
+		Actor: "admin@candid",
+		Since: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		Limit: 3,
+	},
+	expectEntries: []int{1},
+}, {
+	about: "no matches",
+	filter: store.AuditFilter{
+		Target: "no-such-target",
+	},
+}}
+
+func (s *auditSuite) TestFindAuditEntries(c *qt.C) {
+	ctx := context.Background()
+	for i := range auditEntries {
+		e := auditEntries[i]
+		err := s.Store.AddAuditEntry(ctx, &e)
+		c.Assert(err, qt.IsNil)
+		c.Assert(e.ID, qt.Not(qt.Equals), "")
+	}
+	for _, test := range findAuditEntriesTests {
+		c.Run(test.about, func(c *qt.C) {
+			entries, err := s.Store.FindAuditEntries(ctx, test.filter)
+			c.Assert(err, qt.IsNil)
+			var expect []store.AuditEntry
+			for _, i := range test.expectEntries {
+				expect = append(expect, auditEntries[i])
+			}
+			c.Assert(entries, qt.CmpEquals(
+				cmpopts.EquateEmpty(),
+				cmpopts.IgnoreFields(store.AuditEntry{}, "ID"),
+			), expect)
+		})
+	}
+}
+
+func (s *auditSuite) TestAddAuditEntryAssignsIDAndTime(c *qt.C) {
+	ctx := context.Background()
+	e1 := store.AuditEntry{
+		Actor:     "admin@candid",
+		Operation: "remove-user",
+		Target:    "bob",
+	}
+	err := s.Store.AddAuditEntry(ctx, &e1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e1.Time.IsZero(), qt.Equals, false)
+	e2 := e1
+	err = s.Store.AddAuditEntry(ctx, &e2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e2.ID, qt.Not(qt.Equals), e1.ID)
+
+	entries, err := s.Store.FindAuditEntries(ctx, store.AuditFilter{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 2)
+	c.Assert(entries[0].ID, qt.Equals, e2.ID)
+	c.Assert(entries[1].ID, qt.Equals, e1.ID)
+}
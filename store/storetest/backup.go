@@ -0,0 +1,234 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetest
+
+import (
+	"context"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+type backupSuite struct {
+	newBackend func(c *qt.C) store.Backend
+	backend    store.Backend
+	Store      store.BackupStore
+}
+
+// TestBackupStore runs a suite of tests on the BackupStore returned by
+// backends created by the given function.
+func TestBackupStore(c *qt.C, newBackend func(c *qt.C) store.Backend) {
+	qtsuite.Run(c, &backupSuite{
+		newBackend: newBackend,
+	})
+}
+
+func (s *backupSuite) Init(c *qt.C) {
+	s.backend = s.newBackend(c)
+	s.Store = s.backend.BackupStore()
+}
+
+func (s *backupSuite) TestEmpty(c *qt.C) {
+	ctx := context.Background()
+	names, err := s.Store.ACLNames(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(names, qt.HasLen, 0)
+	kvs := s.keyValues(c)
+	c.Check(kvs, qt.HasLen, 0)
+	meetings, err := s.Store.Meetings(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(meetings, qt.HasLen, 0)
+}
+
+func (s *backupSuite) TestACLNames(c *qt.C) {
+	ctx := context.Background()
+	aclStore := s.backend.ACLStore()
+	err := aclStore.CreateACL(ctx, "acl2", []string{"bob"})
+	c.Assert(err, qt.IsNil)
+	err = aclStore.CreateACL(ctx, "acl1", []string{"alice"})
+	c.Assert(err, qt.IsNil)
+
+	names, err := s.Store.ACLNames(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(names, qt.DeepEquals, []string{"acl1", "acl2"})
+}
+
+func (s *backupSuite) TestKeyValues(c *qt.C) {
+	ctx := context.Background()
+	pds := s.backend.ProviderDataStore()
+	expire := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	kv1, err := pds.KeyValueStore(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	kv2, err := pds.KeyValueStore(ctx, "test2")
+	c.Assert(err, qt.IsNil)
+	err = kv2.Set(ctx, "b", []byte("value2b"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	err = kv1.Set(ctx, "a", []byte("value1a"), expire)
+	c.Assert(err, qt.IsNil)
+	err = kv2.Set(ctx, "a", []byte("value2a"), time.Time{})
+	c.Assert(err, qt.IsNil)
+	err = kv1.Set(ctx, "expired", []byte("expired"), time.Now().Add(-time.Hour))
+	c.Assert(err, qt.IsNil)
+
+	// Setting an ACL does not create a provider key-value value.
+	err = s.backend.ACLStore().CreateACL(ctx, "acl", []string{"bob"})
+	c.Assert(err, qt.IsNil)
+
+	kvs := s.keyValues(c)
+	c.Assert(kvs, qt.HasLen, 3)
+	c.Check(kvs[0].IDP, qt.Equals, "test1")
+	c.Check(kvs[0].Key, qt.Equals, "a")
+	c.Check(string(kvs[0].Value), qt.Equals, "value1a")
+	c.Check(kvs[0].Expire.Equal(expire), qt.Equals, true, qt.Commentf("%v != %v", kvs[0].Expire, expire))
+	c.Check(kvs[1].IDP, qt.Equals, "test2")
+	c.Check(kvs[1].Key, qt.Equals, "a")
+	c.Check(string(kvs[1].Value), qt.Equals, "value2a")
+	c.Check(kvs[1].Expire.IsZero(), qt.Equals, true)
+	c.Check(kvs[2].IDP, qt.Equals, "test2")
+	c.Check(kvs[2].Key, qt.Equals, "b")
+	c.Check(string(kvs[2].Value), qt.Equals, "value2b")
+}
+
+func (s *backupSuite) TestKeyValuesError(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.backend.ProviderDataStore().KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	err = kv.Set(ctx, "a", []byte("value"), time.Time{})
+	c.Assert(err, qt.IsNil)
+
+	testErr := errgo.New("test error")
+	err = s.Store.KeyValues(ctx, func(store.KeyValue) error {
+		return testErr
+	})
+	c.Check(errgo.Cause(err), qt.Equals, testErr)
+}
+
+func (s *backupSuite) TestMeetings(c *qt.C) {
+	ctx := context.Background()
+	err := s.backend.MeetingStore().Put(ctx, "m2", "addr2")
+	c.Assert(err, qt.IsNil)
+	created := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+	err = s.Store.InsertMeeting(ctx, store.Meeting{
+		ID:      "m1",
+		Address: "addr1",
+		Created: created,
+	})
+	c.Assert(err, qt.IsNil)
+
+	meetings, err := s.Store.Meetings(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(meetings, qt.HasLen, 2)
+	c.Check(meetings[0].ID, qt.Equals, "m1")
+	c.Check(meetings[0].Address, qt.Equals, "addr1")
+	c.Check(meetings[0].Created.Equal(created), qt.Equals, true, qt.Commentf("%v != %v", meetings[0].Created, created))
+	c.Check(meetings[1].ID, qt.Equals, "m2")
+	c.Check(meetings[1].Address, qt.Equals, "addr2")
+
+	addr, err := s.backend.MeetingStore().Get(ctx, "m1")
+	c.Assert(err, qt.IsNil)
+	c.Check(addr, qt.Equals, "addr1")
+}
+
+func (s *backupSuite) TestInsertIdentity(c *qt.C) {
+	// Create identities in another backend of the same kind to
+	// allocate IDs that are valid for the backend.
+	src := s.newBackend(c).Store()
+	ctx, close := src.Context(context.Background())
+	defer close()
+	var ids []string
+	for _, name := range []string{"alice", "bob", "carol"} {
+		identity := store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}
+		err := src.UpdateIdentity(ctx, &identity, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+		ids = append(ids, identity.ID)
+	}
+
+	st := s.backend.Store()
+	ctx, close = st.Context(context.Background())
+	defer close()
+	update := store.Update{
+		store.Username:     store.Set,
+		store.Groups:       store.Set,
+		store.ProviderInfo: store.Set,
+	}
+	// Insert carol before bob, leaving alice's ID unused.
+	for _, i := range []int{2, 1} {
+		name := []string{"alice", "bob", "carol"}[i]
+		err := s.Store.InsertIdentity(ctx, &store.Identity{
+			ID:           ids[i],
+			ProviderID:   store.MakeProviderIdentity("test", name),
+			Username:     name,
+			Groups:       []string{"g1"},
+			ProviderInfo: map[string][]string{"k": {name}},
+		}, update)
+		c.Assert(err, qt.IsNil)
+	}
+	identity := store.Identity{ID: ids[1]}
+	err := st.Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Check(identity.Username, qt.Equals, "bob")
+	c.Check(identity.ProviderID, qt.Equals, store.MakeProviderIdentity("test", "bob"))
+	c.Check(identity.Groups, qt.DeepEquals, []string{"g1"})
+	c.Check(identity.ProviderInfo, qt.DeepEquals, map[string][]string{"k": {"bob"}})
+
+	changes, err := st.Watch(ctx, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes, qt.HasLen, 2)
+	c.Check(changes[0].ID, qt.Equals, ids[2])
+	c.Check(changes[0].Type, qt.Equals, store.IdentityCreated)
+	c.Check(changes[1].ID, qt.Equals, ids[1])
+	c.Check(changes[1].Type, qt.Equals, store.IdentityCreated)
+
+	// Identities created later do not reuse the inserted IDs.
+	for _, name := range []string{"alice", "dave", "erin"} {
+		identity := store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}
+		err := st.UpdateIdentity(ctx, &identity, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Check(identity.ID, qt.Not(qt.Equals), ids[1])
+		c.Check(identity.ID, qt.Not(qt.Equals), ids[2])
+	}
+
+	// The ID, provider ID and username must not be in use.
+	err = s.Store.InsertIdentity(ctx, &store.Identity{
+		ID:         ids[1],
+		ProviderID: store.MakeProviderIdentity("test", "frank"),
+		Username:   "frank",
+	}, update)
+	c.Check(err, qt.ErrorMatches, `.*already in use`)
+	identity = store.Identity{Username: "bob"}
+	err = st.Identity(ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Check(identity.ID, qt.Equals, ids[1])
+
+	err = s.Store.InsertIdentity(ctx, &store.Identity{
+		ID:         "not-an-id",
+		ProviderID: store.MakeProviderIdentity("test", "frank"),
+		Username:   "frank",
+	}, update)
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrInvalidID)
+}
+
+func (s *backupSuite) keyValues(c *qt.C) []store.KeyValue {
+	var kvs []store.KeyValue
+	err := s.Store.KeyValues(context.Background(), func(kv store.KeyValue) error {
+		kvs = append(kvs, kv)
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	return kvs
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetest
+
+import (
+	"context"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+type groupSuite struct {
+	newStore func(c *qt.C) store.GroupStore
+	Store    store.GroupStore
+}
+
+// TestGroupStore runs a suite of tests on the GroupStore returned by the
+// given function.
+func TestGroupStore(c *qt.C, newStore func(c *qt.C) store.GroupStore) {
+	qtsuite.Run(c, &groupSuite{
+		newStore: newStore,
+	})
+}
+
+func (s *groupSuite) Init(c *qt.C) {
+	s.Store = s.newStore(c)
+}
+
+func (s *groupSuite) TestEmpty(c *qt.C) {
+	groups, err := s.Store.Groups(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Check(groups, qt.HasLen, 0)
+}
+
+func (s *groupSuite) TestGroupNotFound(c *qt.C) {
+	g := store.Group{Name: "no-such-group"}
+	err := s.Store.Group(context.Background(), &g)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `group no-such-group not found`)
+}
+
+func (s *groupSuite) TestSetGroup(c *qt.C) {
+	ctx := context.Background()
+	err := s.Store.SetGroup(ctx, &store.Group{
+		Name:        "g2",
+		Description: "Group Two",
+		Owners:      []string{"alice", "g1"},
+		Subgroups:   []string{"g1", "g3"},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.SetGroup(ctx, &store.Group{
+		Name: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+
+	g := store.Group{Name: "g2"}
+	err = s.Store.Group(ctx, &g)
+	c.Assert(err, qt.IsNil)
+	c.Check(g, qt.DeepEquals, store.Group{
+		Name:        "g2",
+		Description: "Group Two",
+		Owners:      []string{"alice", "g1"},
+		Subgroups:   []string{"g1", "g3"},
+	})
+
+	groups, err := s.Store.Groups(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(groups, qt.DeepEquals, []store.Group{{
+		Name: "g1",
+	}, {
+		Name:        "g2",
+		Description: "Group Two",
+		Owners:      []string{"alice", "g1"},
+		Subgroups:   []string{"g1", "g3"},
+	}})
+
+	// Setting an existing group replaces it.
+	err = s.Store.SetGroup(ctx, &store.Group{
+		Name:        "g2",
+		Description: "Group 2",
+	})
+	c.Assert(err, qt.IsNil)
+	g = store.Group{Name: "g2"}
+	err = s.Store.Group(ctx, &g)
+	c.Assert(err, qt.IsNil)
+	c.Check(g, qt.DeepEquals, store.Group{
+		Name:        "g2",
+		Description: "Group 2",
+	})
+}
+
+func (s *groupSuite) TestRemoveGroup(c *qt.C) {
+	ctx := context.Background()
+	err := s.Store.SetGroup(ctx, &store.Group{
+		Name:   "g1",
+		Owners: []string{"alice"},
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = s.Store.RemoveGroup(ctx, "g1")
+	c.Assert(err, qt.IsNil)
+	g := store.Group{Name: "g1"}
+	err = s.Store.Group(ctx, &g)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	err = s.Store.RemoveGroup(ctx, "g1")
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `group g1 not found`)
+}
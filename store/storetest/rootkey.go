@@ -0,0 +1,216 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetest
+
+import (
+	"context"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/store"
+)
+
+type rootKeySuite struct {
+	newStore func(c *qt.C) store.RootKeyStore
+	Store    store.RootKeyStore
+}
+
+// TestRootKeyStore runs a suite of tests on the RootKeyStore returned
+// by the given function.
+func TestRootKeyStore(c *qt.C, newStore func(c *qt.C) store.RootKeyStore) {
+	qtsuite.Run(c, &rootKeySuite{
+		newStore: newStore,
+	})
+}
+
+func (s *rootKeySuite) Init(c *qt.C) {
+	s.Store = s.newStore(c)
+}
+
+func (s *rootKeySuite) TestEmpty(c *qt.C) {
+	ctx := context.Background()
+	keys, err := s.Store.RootKeys(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(keys, qt.HasLen, 0)
+}
+
+func (s *rootKeySuite) TestInsertRootKey(c *qt.C) {
+	ctx := context.Background()
+	inserted := s.insertKeys(c)
+
+	keys, err := s.Store.RootKeys(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 2)
+	checkRootKey(c, keys[0], inserted[1])
+	checkRootKey(c, keys[1], inserted[0])
+
+	// Inserting a key with an existing ID replaces it.
+	replacement := inserted[0]
+	replacement.RootKey = []byte("11111111111111111111111111111111")
+	err = s.Store.InsertRootKey(ctx, replacement)
+	c.Assert(err, qt.IsNil)
+	key, err := s.Store.RootKey(ctx, []byte("key2"))
+	c.Assert(err, qt.IsNil)
+	checkRootKey(c, key, replacement)
+}
+
+func (s *rootKeySuite) TestRootKey(c *qt.C) {
+	ctx := context.Background()
+	inserted := s.insertKeys(c)
+
+	key, err := s.Store.RootKey(ctx, []byte("key1"))
+	c.Assert(err, qt.IsNil)
+	checkRootKey(c, key, inserted[1])
+
+	// Expired keys cannot be retrieved.
+	_, err = s.Store.RootKey(ctx, []byte("key3"))
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Check(err, qt.ErrorMatches, `root key "key3" not found`)
+
+	_, err = s.Store.RootKey(ctx, []byte("no-such-key"))
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Check(err, qt.ErrorMatches, `root key "no-such-key" not found`)
+}
+
+func (s *rootKeySuite) TestFindLatestRootKey(c *qt.C) {
+	ctx := context.Background()
+	inserted := s.insertKeys(c)
+	now := inserted[0].Created.Add(time.Hour)
+
+	key, err := s.Store.FindLatestRootKey(ctx, now.Add(-3*time.Hour), now, now.Add(2*time.Hour))
+	c.Assert(err, qt.IsNil)
+	checkRootKey(c, key, inserted[0])
+
+	key, err = s.Store.FindLatestRootKey(ctx, now.Add(-3*time.Hour), now, now.Add(90*time.Minute))
+	c.Assert(err, qt.IsNil)
+	checkRootKey(c, key, inserted[1])
+
+	_, err = s.Store.FindLatestRootKey(ctx, now.Add(-30*time.Minute), now, now.Add(2*time.Hour))
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *rootKeySuite) TestRemoveRootKey(c *qt.C) {
+	ctx := context.Background()
+	inserted := s.insertKeys(c)
+
+	err := s.Store.RemoveRootKey(ctx, []byte("key1"))
+	c.Assert(err, qt.IsNil)
+
+	keys, err := s.Store.RootKeys(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 1)
+	checkRootKey(c, keys[0], inserted[0])
+
+	_, err = s.Store.RootKey(ctx, []byte("key1"))
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	err = s.Store.RemoveRootKey(ctx, []byte("key1"))
+	c.Check(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Check(err, qt.ErrorMatches, `root key "key1" not found`)
+}
+
+func (s *rootKeySuite) TestBakeryRootKeyStore(c *qt.C) {
+	ctx := context.Background()
+	rks := store.NewBakeryRootKeyStore(s.Store, store.DefaultRootKeyPolicy)
+	key, id, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// The same key is used again.
+	key1, id1, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(key1, qt.DeepEquals, key)
+	c.Check(id1, qt.DeepEquals, id)
+
+	key2, err := rks.Get(ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Check(key2, qt.DeepEquals, key)
+
+	keys, err := s.Store.RootKeys(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 1)
+	c.Check(keys[0].ID, qt.DeepEquals, id)
+	c.Check(keys[0].RootKey, qt.DeepEquals, key)
+
+	_, err = rks.Get(ctx, []byte("no-such-key"))
+	c.Check(err, qt.Equals, bakery.ErrNotFound)
+}
+
+func (s *rootKeySuite) TestRotateRootKey(c *qt.C) {
+	ctx := context.Background()
+	rks := store.NewBakeryRootKeyStore(s.Store, store.DefaultRootKeyPolicy)
+	_, id, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	// Make sure the new key is created later than the old one.
+	time.Sleep(10 * time.Millisecond)
+	key, err := store.RotateRootKey(ctx, s.Store, store.DefaultRootKeyPolicy)
+	c.Assert(err, qt.IsNil)
+	c.Check(key.ID, qt.Not(qt.DeepEquals), id)
+
+	current, err := store.CurrentRootKey(ctx, s.Store, store.DefaultRootKeyPolicy)
+	c.Assert(err, qt.IsNil)
+	c.Check(current.ID, qt.DeepEquals, key.ID)
+	_, id1, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(id1, qt.DeepEquals, key.ID)
+
+	// The old key can still be used to check macaroons.
+	_, err = rks.Get(ctx, id)
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *rootKeySuite) TestRevokeRootKey(c *qt.C) {
+	ctx := context.Background()
+	rks := store.NewBakeryRootKeyStore(s.Store, store.DefaultRootKeyPolicy)
+	_, id, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+
+	err = s.Store.RemoveRootKey(ctx, id)
+	c.Assert(err, qt.IsNil)
+
+	// The key can no longer be used and a new one is generated.
+	_, err = rks.Get(ctx, id)
+	c.Check(err, qt.Equals, bakery.ErrNotFound)
+	_, id1, err := rks.RootKey(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Check(id1, qt.Not(qt.DeepEquals), id)
+}
+
+// insertKeys inserts a set of test root keys into the store and returns
+// them. The third key has expired.
+func (s *rootKeySuite) insertKeys(c *qt.C) []store.RootKey {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	inserted := []store.RootKey{{
+		ID:      []byte("key2"),
+		RootKey: []byte("0123456789abcdef0123456789abcdef"),
+		Created: now.Add(-time.Hour),
+		Expires: now.Add(2 * time.Hour),
+	}, {
+		ID:      []byte("key1"),
+		RootKey: []byte("fedcba9876543210fedcba9876543210"),
+		Created: now.Add(-2 * time.Hour),
+		Expires: now.Add(time.Hour),
+	}, {
+		ID:      []byte("key3"),
+		RootKey: []byte("00000000000000000000000000000000"),
+		Created: now.Add(-3 * time.Hour),
+		Expires: now.Add(-time.Hour),
+	}}
+	for _, key := range inserted {
+		err := s.Store.InsertRootKey(context.Background(), key)
+		c.Assert(err, qt.IsNil)
+	}
+	return inserted
+}
+
+func checkRootKey(c *qt.C, obtained, expect store.RootKey) {
+	c.Check(obtained.ID, qt.DeepEquals, expect.ID)
+	c.Check(obtained.RootKey, qt.DeepEquals, expect.RootKey)
+	c.Check(obtained.Created.Equal(expect.Created), qt.Equals, true, qt.Commentf("%v != %v", obtained.Created, expect.Created))
+	c.Check(obtained.Expires.Equal(expect.Expires), qt.Equals, true, qt.Commentf("%v != %v", obtained.Expires, expect.Expires))
+}
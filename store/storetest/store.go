@@ -12,6 +12,7 @@ import (
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
@@ -192,6 +193,45 @@ var updateIdentityTests = []struct {
 		store.LastLogin: store.Clear,
 	},
 	expectIdentity: &store.Identity{},
+}, {
+	about:         "set disabled",
+	startIdentity: &store.Identity{},
+	updateIdentity: &store.Identity{
+		Disabled:       time.Date(2017, 12, 26, 0, 0, 0, 0, time.UTC),
+		DisabledReason: "left the company",
+	},
+	update: store.Update{
+		store.Disabled:       store.Set,
+		store.DisabledReason: store.Set,
+	},
+	expectIdentity: &store.Identity{
+		Disabled:       time.Date(2017, 12, 26, 0, 0, 0, 0, time.UTC),
+		DisabledReason: "left the company",
+	},
+}, {
+	about:         "set expires",
+	startIdentity: &store.Identity{},
+	updateIdentity: &store.Identity{
+		Expires: time.Date(2017, 12, 26, 0, 0, 0, 0, time.UTC),
+	},
+	update: store.Update{
+		store.Expires: store.Set,
+	},
+	expectIdentity: &store.Identity{
+		Expires: time.Date(2017, 12, 26, 0, 0, 0, 0, time.UTC),
+	},
+}, {
+	about: "clear disabled",
+	startIdentity: &store.Identity{
+		Disabled:       time.Date(2017, 12, 25, 0, 0, 0, 0, time.UTC),
+		DisabledReason: "left the company",
+	},
+	updateIdentity: &store.Identity{},
+	update: store.Update{
+		store.Disabled:       store.Clear,
+		store.DisabledReason: store.Clear,
+	},
+	expectIdentity: &store.Identity{},
 }, {
 	about: "set groups",
 	startIdentity: &store.Identity{
@@ -778,6 +818,10 @@ func (s *storeSuite) TestUpdateIdentity(c *qt.C) {
 				if !test.startIdentity.LastLogin.IsZero() {
 					update[store.LastLogin] = store.Set
 				}
+				if !test.startIdentity.Disabled.IsZero() {
+					update[store.Disabled] = store.Set
+					update[store.DisabledReason] = store.Set
+				}
 				err := s.Store.UpdateIdentity(s.ctx, test.startIdentity, update)
 				c.Assert(err, qt.IsNil)
 			}
@@ -932,6 +976,208 @@ func (s *storeSuite) TestUpdateIDEmpty(c *qt.C) {
 	c.Assert(err, qt.IsNil)
 }
 
+func (s *storeSuite) TestLinkedProviderIDs(c *qt.C) {
+	identity := store.Identity{
+		ProviderID:        store.MakeProviderIdentity("test", "test-user"),
+		Username:          "test-user",
+		LinkedProviderIDs: []store.ProviderIdentity{"test2:test-user"},
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username:          store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: "test2:test-user",
+		Name:       "Test User",
+		LinkedProviderIDs: []store.ProviderIdentity{
+			store.MakeProviderIdentity("test", "test-user"),
+			"test3:test-user",
+		},
+	}, store.Update{
+		store.Name:              store.Set,
+		store.LinkedProviderIDs: store.Push,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Setting the username of an identity found by a linked
+	// provider ID does not create a new identity.
+	identity2 := store.Identity{
+		ProviderID: "test3:test-user",
+		Username:   "test-user",
+	}
+	err = s.Store.UpdateIdentity(s.ctx, &identity2, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	for _, pid := range []store.ProviderIdentity{"test:test-user", "test2:test-user", "test3:test-user"} {
+		obtained := store.Identity{
+			ProviderID: pid,
+		}
+		err = s.Store.Identity(s.ctx, &obtained)
+		c.Assert(err, qt.IsNil)
+		candidtest.AssertEqualIdentity(c, &obtained, &store.Identity{
+			ID:                identity.ID,
+			ProviderID:        store.MakeProviderIdentity("test", "test-user"),
+			Username:          "test-user",
+			Name:              "Test User",
+			LinkedProviderIDs: []store.ProviderIdentity{"test2:test-user", "test3:test-user"},
+		})
+	}
+
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		Username:          "test-user",
+		LinkedProviderIDs: []store.ProviderIdentity{"test2:test-user"},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Pull,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.Identity(s.ctx, &store.Identity{ProviderID: "test2:test-user"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{ProviderID: "test3:test-user"})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "test-user"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *storeSuite) TestLinkedProviderIDsDuplicate(c *qt.C) {
+	for _, username := range []string{"test-user-1", "test-user-2"} {
+		err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		Username:          "test-user-2",
+		LinkedProviderIDs: []store.ProviderIdentity{"test2:test-user-2"},
+	}, store.Update{
+		store.LinkedProviderIDs: store.Push,
+	})
+	c.Assert(err, qt.IsNil)
+
+	for _, pid := range []store.ProviderIdentity{"test:test-user-2", "test2:test-user-2"} {
+		err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+			Username:          "test-user-1",
+			LinkedProviderIDs: []store.ProviderIdentity{pid},
+		}, store.Update{
+			store.LinkedProviderIDs: store.Push,
+		})
+		c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`.*provider id %q already in use`, pid))
+		c.Assert(errgo.Cause(err), qt.Equals, store.ErrDuplicateProviderID)
+	}
+
+	identity := store.Identity{
+		Username: "test-user-1",
+	}
+	err = s.Store.Identity(s.ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.LinkedProviderIDs, qt.HasLen, 0)
+}
+
+func (s *storeSuite) TestUpdateIdentityLinkedProviderIDKeepsUsername(c *qt.C) {
+	err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID:        store.MakeProviderIdentity("test", "test-user"),
+		Username:          "test-user",
+		LinkedProviderIDs: []store.ProviderIdentity{"test2:test-user"},
+	}, store.Update{
+		store.Username:          store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: "test2:test-user",
+		Username:   "test2-user",
+		Name:       "Test User",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test-user"),
+	}
+	err = s.Store.Identity(s.ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.Username, qt.Equals, "test-user")
+	c.Assert(identity.Name, qt.Equals, "Test User")
+
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "test2-user"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *storeSuite) TestLinkProviderIDMerge(c *qt.C) {
+	err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test-user-1"),
+		Username:   "test-user-1",
+		Groups:     []string{"g1", "g2"},
+		PublicKeys: []bakery.PublicKey{pk1},
+	}, store.Update{
+		store.Username:   store.Set,
+		store.Groups:     store.Set,
+		store.PublicKeys: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID:        store.MakeProviderIdentity("test2", "test-user-2"),
+		Username:          "test-user-2",
+		Groups:            []string{"g2", "g3"},
+		PublicKeys:        []bakery.PublicKey{pk2},
+		ExtraInfo:         map[string][]string{"sshkeys": {"ssh-rsa key"}},
+		LinkedProviderIDs: []store.ProviderIdentity{"test3:test-user-2"},
+	}, store.Update{
+		store.Username:          store.Set,
+		store.Groups:            store.Set,
+		store.PublicKeys:        store.Set,
+		store.ExtraInfo:         store.Set,
+		store.LinkedProviderIDs: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	identity := store.Identity{
+		Username: "test-user-1",
+	}
+	merged, err := store.LinkProviderID(s.ctx, s.Store, &identity, "test2:test-user-2", true, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(merged, qt.Not(qt.IsNil))
+	c.Assert(merged.Username, qt.Equals, "test-user-2")
+	c.Assert(identity.Username, qt.Equals, "test-user-1")
+	c.Assert(identity.Groups, qt.CmpEquals(cmpopts.SortSlices(func(x, y string) bool { return x < y })), []string{"g1", "g2", "g3"})
+	c.Assert(identity.PublicKeys, qt.HasLen, 2)
+	c.Assert(identity.ExtraInfo["sshkeys"], qt.DeepEquals, []string{"ssh-rsa key"})
+	c.Assert(identity.LinkedProviderIDs, qt.CmpEquals(cmpopts.SortSlices(func(x, y store.ProviderIdentity) bool { return x < y })), []store.ProviderIdentity{"test2:test-user-2", "test3:test-user-2"})
+
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "test-user-2"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	for _, pid := range []store.ProviderIdentity{"test:test-user-1", "test2:test-user-2", "test3:test-user-2"} {
+		identity := store.Identity{
+			ProviderID: pid,
+		}
+		err := s.Store.Identity(s.ctx, &identity)
+		c.Assert(err, qt.IsNil)
+		c.Assert(identity.Username, qt.Equals, "test-user-1")
+	}
+
+	// Linking a provider id that is already linked does nothing.
+	merged, err = store.LinkProviderID(s.ctx, s.Store, &identity, "test3:test-user-2", true, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(merged, qt.IsNil)
+
+	// Linking an unused provider id just adds it.
+	merged, err = store.LinkProviderID(s.ctx, s.Store, &identity, "test4:test-user-1", true, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(merged, qt.IsNil)
+	c.Assert(identity.LinkedProviderIDs, qt.HasLen, 3)
+}
+
 func (s *storeSuite) TestIdentity(c *qt.C) {
 	identity := store.Identity{
 		ProviderID:    store.MakeProviderIdentity("test", "test-user"),
@@ -1038,6 +1284,7 @@ var testIdentities = []store.Identity{{
 	Username:      "test3",
 	Name:          "Test User 3",
 	Email:         "test3@example.com",
+	Groups:        []string{"g2", "g3"},
 	LastLogin:     time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 7, 0, 0, 0, 0, time.UTC),
 }, {
@@ -1045,6 +1292,7 @@ var testIdentities = []store.Identity{{
 	Username:      "test4",
 	Name:          "Test User 4",
 	Email:         "test4@example.com",
+	Groups:        []string{"g3"},
 	LastLogin:     time.Date(2017, 1, 4, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 6, 0, 0, 0, 0, time.UTC),
 }, {
@@ -1070,6 +1318,7 @@ var testIdentities = []store.Identity{{
 	LastLogin:     time.Date(2017, 1, 7, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 3, 0, 0, 0, 0, time.UTC),
 	Owner:         "test:test2",
+	Expires:       time.Date(2017, 3, 7, 0, 0, 0, 0, time.UTC),
 }, {
 	ProviderID:    store.MakeProviderIdentity("test", "test8"),
 	Username:      "test8",
@@ -1078,6 +1327,7 @@ var testIdentities = []store.Identity{{
 	LastLogin:     time.Date(2017, 1, 8, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 2, 0, 0, 0, 0, time.UTC),
 	Owner:         "test:test3",
+	Expires:       time.Date(2017, 3, 8, 0, 0, 0, 0, time.UTC),
 }, {
 	ProviderID:    store.MakeProviderIdentity("test", "test9"),
 	Username:      "test9",
@@ -1384,9 +1634,216 @@ var findIdentitiesTests = []struct {
 		store.Owner: store.Equal,
 	},
 	expect: []int{5},
+}, {
+	about: "username prefix",
+	ref: store.Identity{
+		Username: "test",
+	},
+	filter: store.Filter{
+		store.Username: store.Prefix,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{0, 1, 2, 3, 4, 5, 6, 7, 8},
+}, {
+	about: "username prefix with pattern characters",
+	ref: store.Identity{
+		Username: "test_",
+	},
+	filter: store.Filter{
+		store.Username: store.Prefix,
+	},
+}, {
+	about: "email prefix",
+	ref: store.Identity{
+		Email: "test9@",
+	},
+	filter: store.Filter{
+		store.Email: store.Prefix,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{6, 8},
+}, {
+	about: "name match is case insensitive",
+	ref: store.Identity{
+		Name: "USER 1",
+	},
+	filter: store.Filter{
+		store.Name: store.Match,
+	},
+	expect: []int{0},
+}, {
+	about: "match with pattern characters",
+	ref: store.Identity{
+		Name: "user%",
+	},
+	filter: store.Filter{
+		store.Name: store.Match,
+	},
+}, {
+	about: "expires less than or equal",
+	ref: store.Identity{
+		Expires: time.Date(2017, 3, 7, 0, 0, 0, 0, time.UTC),
+	},
+	filter: store.Filter{
+		store.Expires: store.LessThanOrEqual,
+	},
+	expect: []int{6},
+}, {
+	about: "expires greater than",
+	ref: store.Identity{
+		Expires: time.Date(2017, 3, 7, 0, 0, 0, 0, time.UTC),
+	},
+	filter: store.Filter{
+		store.Expires: store.GreaterThan,
+	},
+	expect: []int{7},
+}, {
+	about: "groups contains",
+	ref: store.Identity{
+		Groups: []string{"g3"},
+	},
+	filter: store.Filter{
+		store.Groups: store.Contains,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{2, 3},
+}, {
+	about: "groups contains all",
+	ref: store.Identity{
+		Groups: []string{"g2", "g3"},
+	},
+	filter: store.Filter{
+		store.Groups: store.Contains,
+	},
+	expect: []int{2},
+}, {
+	about: "groups contains combined with other filters",
+	ref: store.Identity{
+		Username: "test1",
+		Groups:   []string{"g2"},
+	},
+	filter: store.Filter{
+		store.Username: store.GreaterThan,
+		store.Groups:   store.Contains,
+	},
+	expect: []int{2},
 }}
 
 func (s *storeSuite) TestFindIdentities(c *qt.C) {
+	s.addTestIdentities(c)
+	for i, test := range findIdentitiesTests {
+		c.Logf("%d. %s", i, test.about)
+		identities, err := s.Store.FindIdentities(s.ctx, &test.ref, test.filter, test.sort, test.skip, test.limit)
+		c.Assert(err, qt.IsNil)
+		c.Assert(len(identities), qt.Equals, len(test.expect))
+		for i, identity := range identities {
+			candidtest.AssertEqualIdentity(c, &identity, &testIdentities[test.expect[i]])
+		}
+	}
+}
+
+func (s *storeSuite) TestFindIdentitiesZeroExpires(c *qt.C) {
+	// An identity whose expiry time is explicitly set to the zero
+	// time never expires, so must not be found by a search for
+	// expired identities.
+	err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test1"),
+		Username:   "test1",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Expires:  store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test2"),
+		Username:   "test2",
+		Expires:    time.Date(2017, 3, 7, 0, 0, 0, 0, time.UTC),
+	}, store.Update{
+		store.Username: store.Set,
+		store.Expires:  store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		Username: "test2",
+	}, store.Update{
+		store.Expires: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	identities, err := s.Store.FindIdentities(s.ctx, &store.Identity{
+		Expires: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, store.Filter{
+		store.Expires: store.LessThanOrEqual,
+	}, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 0)
+}
+
+func (s *storeSuite) TestFindIdentitiesPage(c *qt.C) {
+	s.addTestIdentities(c)
+
+	var got []int
+	var cursor string
+	for pages := 0; ; pages++ {
+		c.Assert(pages < 5, qt.Equals, true, qt.Commentf("too many pages"))
+		identities, next, err := s.Store.FindIdentitiesPage(s.ctx, &store.Identity{}, store.Filter{}, cursor, 2)
+		c.Assert(err, qt.IsNil)
+		c.Assert(len(identities) <= 2, qt.Equals, true)
+		for _, identity := range identities {
+			got = append(got, identityIndex(identity.Username))
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	c.Assert(got, qt.DeepEquals, []int{0, 1, 2, 3, 4, 5, 6, 7, 8})
+
+	// Exactly filling the last page does not result in an empty
+	// extra page.
+	identities, next, err := s.Store.FindIdentitiesPage(s.ctx, &store.Identity{}, store.Filter{}, "", 9)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 9)
+	c.Assert(next, qt.Equals, "")
+
+	// A filter is applied to every page.
+	ref := store.Identity{Groups: []string{"g2"}}
+	filter := store.Filter{store.Groups: store.Contains}
+	identities, next, err = s.Store.FindIdentitiesPage(s.ctx, &ref, filter, "", 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 1)
+	candidtest.AssertEqualIdentity(c, &identities[0], &testIdentities[0])
+	c.Assert(next, qt.Not(qt.Equals), "")
+	identities, next, err = s.Store.FindIdentitiesPage(s.ctx, &ref, filter, next, 1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 1)
+	candidtest.AssertEqualIdentity(c, &identities[0], &testIdentities[2])
+	c.Assert(next, qt.Equals, "")
+
+	// No limit returns everything.
+	identities, next, err = s.Store.FindIdentitiesPage(s.ctx, &store.Identity{}, store.Filter{}, "", 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 9)
+	c.Assert(next, qt.Equals, "")
+}
+
+func (s *storeSuite) TestFindIdentitiesPageInvalidCursor(c *qt.C) {
+	_, _, err := s.Store.FindIdentitiesPage(s.ctx, &store.Identity{}, store.Filter{}, "not a cursor!", 2)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrInvalidCursor)
+}
+
+// identityIndex returns the index in testIdentities of the identity
+// with the given username.
+func identityIndex(username string) int {
+	for i := range testIdentities {
+		if testIdentities[i].Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *storeSuite) addTestIdentities(c *qt.C) {
 	for i := range testIdentities {
 		var update store.Update
 		if testIdentities[i].Username != "" {
@@ -1419,19 +1876,177 @@ func (s *storeSuite) TestFindIdentities(c *qt.C) {
 		if testIdentities[i].Owner != "" {
 			update[store.Owner] = store.Set
 		}
-		err := s.Store.UpdateIdentity(s.ctx, &testIdentities[i], update)
+		if !testIdentities[i].Expires.IsZero() {
+			update[store.Expires] = store.Set
+		}
+		// Update a copy so that the ID assigned by the store
+		// isn't retained between tests.
+		identity := testIdentities[i]
+		err := s.Store.UpdateIdentity(s.ctx, &identity, update)
 		c.Assert(err, qt.IsNil)
 	}
+}
 
-	for i, test := range findIdentitiesTests {
-		c.Logf("%d. %s", i, test.about)
-		identities, err := s.Store.FindIdentities(s.ctx, &test.ref, test.filter, test.sort, test.skip, test.limit)
-		c.Assert(err, qt.IsNil)
-		c.Assert(len(identities), qt.Equals, len(test.expect))
-		for i, identity := range identities {
-			candidtest.AssertEqualIdentity(c, &identity, &testIdentities[test.expect[i]])
+func (s *storeSuite) TestWatch(c *qt.C) {
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Bob",
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username:  store.Set,
+		store.Name:      store.Set,
+		store.LastLogin: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"g1"},
+	}, store.Update{
+		store.Groups: store.Push,
+	})
+	c.Assert(err, qt.IsNil)
+	// Updates to the login and discharge times are not recorded.
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		Username:      "bob",
+		LastDischarge: time.Now(),
+	}, store.Update{
+		store.LastDischarge: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+
+	changes, err := s.Store.Watch(s.ctx, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes, qt.HasLen, 3)
+	for i := range changes {
+		c.Assert(changes[i].Time.IsZero(), qt.Equals, false)
+		changes[i].Time = time.Time{}
+		if i > 0 {
+			c.Assert(changes[i].Sequence > changes[i-1].Sequence, qt.Equals, true)
 		}
 	}
+	seq := changes[0].Sequence
+	c.Assert(changes, qt.DeepEquals, []store.IdentityChange{{
+		Sequence:   seq,
+		Type:       store.IdentityCreated,
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   "bob",
+		Fields:     []store.Field{store.Username, store.Name},
+	}, {
+		Sequence:   changes[1].Sequence,
+		Type:       store.IdentityUpdated,
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   "bob",
+		Fields:     []store.Field{store.Groups},
+	}, {
+		Sequence:   changes[2].Sequence,
+		Type:       store.IdentityRemoved,
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   "bob",
+	}})
+
+	changes1, err := s.Store.Watch(s.ctx, seq)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes1, qt.HasLen, 2)
+	c.Assert(changes1[0].Sequence, qt.Equals, changes[1].Sequence)
+}
+
+func (s *storeSuite) TestWatchWaits(c *qt.C) {
+	ctx, cancel := context.WithTimeout(s.ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err := s.Store.Watch(ctx, 0)
+	c.Assert(errgo.Cause(err), qt.Equals, context.DeadlineExceeded)
+
+	type result struct {
+		changes []store.IdentityChange
+		err     error
+	}
+	ctx, cancel = context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	resultc := make(chan result)
+	go func() {
+		changes, err := s.Store.Watch(ctx, 0)
+		resultc <- result{changes, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	r := <-resultc
+	c.Assert(r.err, qt.IsNil)
+	c.Assert(r.changes, qt.HasLen, 1)
+	c.Assert(r.changes[0].Type, qt.Equals, store.IdentityCreated)
+	c.Assert(r.changes[0].Username, qt.Equals, "bob")
+}
+
+func (s *storeSuite) TestRemoveChanges(c *qt.C) {
+	for _, name := range []string{"alice", "bob"} {
+		err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	changes, err := s.Store.Watch(s.ctx, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes, qt.HasLen, 2)
+
+	n, err := s.Store.RemoveChanges(s.ctx, changes[0].Time.Add(-time.Second))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	// Remove the changes made before the second one.
+	n, err = s.Store.RemoveChanges(s.ctx, changes[1].Time)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+
+	// Watching from before the removed change reports the removal.
+	_, err = s.Store.Watch(s.ctx, 0)
+	c.Assert(errgo.Cause(err), qt.DeepEquals, &store.ChangesRemovedError{
+		Sequence: changes[0].Sequence,
+	})
+
+	changes1, err := s.Store.Watch(s.ctx, changes[0].Sequence)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes1, qt.HasLen, 1)
+	c.Assert(changes1[0].Sequence, qt.Equals, changes[1].Sequence)
+	c.Assert(changes1[0].Username, qt.Equals, "bob")
+
+	// New changes follow on from the removed ones.
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{
+		Username: "alice",
+	})
+	c.Assert(err, qt.IsNil)
+	changes2, err := s.Store.Watch(s.ctx, changes[1].Sequence)
+	c.Assert(err, qt.IsNil)
+	c.Assert(changes2, qt.HasLen, 1)
+	c.Assert(changes2[0].Sequence > changes[1].Sequence, qt.Equals, true)
+	c.Assert(changes2[0].Type, qt.Equals, store.IdentityRemoved)
+
+	n, err = s.Store.RemoveChanges(s.ctx, time.Now().Add(time.Second))
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+	_, err = s.Store.Watch(s.ctx, changes[0].Sequence)
+	c.Assert(errgo.Cause(err), qt.DeepEquals, &store.ChangesRemovedError{
+		Sequence: changes2[0].Sequence,
+	})
+	ctx, cancel := context.WithTimeout(s.ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = s.Store.Watch(ctx, changes2[0].Sequence)
+	c.Assert(errgo.Cause(err), qt.Equals, context.DeadlineExceeded)
 }
 
 func (s *storeSuite) TestIdentityCounts(c *qt.C) {
@@ -1454,3 +2069,221 @@ func (s *storeSuite) TestIdentityCounts(c *qt.C) {
 		"c": 1,
 	})
 }
+
+func (s *storeSuite) TestReplaceInfo(c *qt.C) {
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "test-user"),
+		Username:   "test-user",
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v1", "pf1v2"},
+			"pf2": {"pf2v1"},
+		},
+		ExtraInfo: map[string][]string{
+			"ef1": {"ef1v1"},
+		},
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username:     store.Set,
+		store.ProviderInfo: store.Set,
+		store.ExtraInfo:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Replace values, in a different order, remove a key and add
+	// a key.
+	err = s.Store.ReplaceInfo(s.ctx, identity.ID, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v2", "pf1v1"},
+			"pf2": {"pf2v1"},
+		},
+		ExtraInfo: map[string][]string{
+			"ef2": nil,
+		},
+	}, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v3"},
+		},
+		ExtraInfo: map[string][]string{
+			"ef2": {"ef2v1"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	identity2 := store.Identity{ID: identity.ID}
+	err = s.Store.Identity(s.ctx, &identity2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity2.ProviderInfo, qt.DeepEquals, map[string][]string{
+		"pf1": {"pf1v3"},
+	})
+	c.Assert(identity2.ExtraInfo, qt.DeepEquals, map[string][]string{
+		"ef1": {"ef1v1"},
+		"ef2": {"ef2v1"},
+	})
+
+	// Values that have changed are not replaced.
+	err = s.Store.ReplaceInfo(s.ctx, identity.ID, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v3"},
+		},
+		ExtraInfo: map[string][]string{
+			"ef1": {"ef1v2"},
+		},
+	}, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v4"},
+		},
+		ExtraInfo: map[string][]string{
+			"ef1": {"ef1v3"},
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrConflict)
+
+	// Keys that have been set are not replaced.
+	err = s.Store.ReplaceInfo(s.ctx, identity.ID, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": nil,
+		},
+	}, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v4"},
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrConflict)
+
+	identity3 := store.Identity{ID: identity.ID}
+	err = s.Store.Identity(s.ctx, &identity3)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity3.ProviderInfo, qt.DeepEquals, identity2.ProviderInfo)
+	c.Assert(identity3.ExtraInfo, qt.DeepEquals, identity2.ExtraInfo)
+
+	// Removed identities are not found.
+	err = s.Store.RemoveIdentity(s.ctx, &store.Identity{ID: identity.ID})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.ReplaceInfo(s.ctx, identity.ID, &store.Identity{
+		ProviderInfo: map[string][]string{
+			"pf1": {"pf1v3"},
+		},
+	}, &store.Identity{})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+var removeIdentityTests = []struct {
+	about  string
+	remove func(*store.Identity) *store.Identity
+}{{
+	about: "remove by ID",
+	remove: func(id *store.Identity) *store.Identity {
+		return &store.Identity{ID: id.ID}
+	},
+}, {
+	about: "remove by provider ID",
+	remove: func(id *store.Identity) *store.Identity {
+		return &store.Identity{ProviderID: id.ProviderID}
+	},
+}, {
+	about: "remove by username",
+	remove: func(id *store.Identity) *store.Identity {
+		return &store.Identity{Username: id.Username}
+	},
+}}
+
+func (s *storeSuite) TestRemoveIdentity(c *qt.C) {
+	for i, test := range removeIdentityTests {
+		c.Logf("%d. %s", i, test.about)
+		identity := store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", fmt.Sprintf("test-user-%d", i)),
+			Username:   fmt.Sprintf("test-user-%d", i),
+			Name:       "Test User",
+			Groups:     []string{"g1", "g2"},
+			PublicKeys: []bakery.PublicKey{pk1},
+			ProviderInfo: map[string][]string{
+				"pf1": {"pf1v1", "pf1v2"},
+			},
+			ExtraInfo: map[string][]string{
+				"ef1": {"ef1v1", "ef1v2"},
+			},
+		}
+		err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+			store.Username:     store.Set,
+			store.Name:         store.Set,
+			store.Groups:       store.Set,
+			store.PublicKeys:   store.Set,
+			store.ProviderInfo: store.Set,
+			store.ExtraInfo:    store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+
+		err = s.Store.RemoveIdentity(s.ctx, test.remove(&identity))
+		c.Assert(err, qt.IsNil)
+
+		err = s.Store.Identity(s.ctx, &store.Identity{ProviderID: identity.ProviderID})
+		c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+		err = s.Store.Identity(s.ctx, &store.Identity{Username: identity.Username})
+		c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+		// Creating a new identity with the same provider ID
+		// must not resurrect any of the removed data.
+		identity2 := store.Identity{
+			ProviderID: identity.ProviderID,
+			Username:   identity.Username,
+		}
+		err = s.Store.UpdateIdentity(s.ctx, &identity2, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+		identity3 := store.Identity{
+			ProviderID: identity.ProviderID,
+		}
+		err = s.Store.Identity(s.ctx, &identity3)
+		c.Assert(err, qt.IsNil)
+		candidtest.AssertEqualIdentity(c, &identity3, &store.Identity{
+			ID:         identity2.ID,
+			ProviderID: identity.ProviderID,
+			Username:   identity.Username,
+		})
+	}
+}
+
+func (s *storeSuite) TestRemoveIdentityLeavesOthers(c *qt.C) {
+	for _, username := range []string{"test-user-1", "test-user-2"} {
+		err := s.Store.UpdateIdentity(s.ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+			Groups:     []string{"g1"},
+		}, store.Update{
+			store.Username: store.Set,
+			store.Groups:   store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	err := s.Store.RemoveIdentity(s.ctx, &store.Identity{Username: "test-user-1"})
+	c.Assert(err, qt.IsNil)
+
+	identity := store.Identity{
+		Username: "test-user-2",
+	}
+	err = s.Store.Identity(s.ctx, &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.Groups, qt.DeepEquals, []string{"g1"})
+}
+
+func (s *storeSuite) TestRemoveIdentityNotFound(c *qt.C) {
+	err := s.Store.RemoveIdentity(s.ctx, &store.Identity{
+		Username: "no-such-user",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `user no-such-user not found`)
+}
+
+func (s *storeSuite) TestRemoveIdentityNotFoundBadID(c *qt.C) {
+	err := s.Store.RemoveIdentity(s.ctx, &store.Identity{
+		ID: "1234",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func (s *storeSuite) TestRemoveIdentityNotFoundNoQuery(c *qt.C) {
+	err := s.Store.RemoveIdentity(s.ctx, &store.Identity{})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `identity not specified`)
+}